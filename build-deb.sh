@@ -44,7 +44,7 @@ esac
 
 go get
 
-go build -ldflags '-s -w' -o $PACKAGE_NAME
+go build -ldflags "-s -w -X github.com/google/apt-golang-s3/version.version=$VERSION" -o $PACKAGE_NAME
 
 chmod +x ./$PACKAGE_NAME
 
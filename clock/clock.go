@@ -0,0 +1,74 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package clock abstracts the passing of time, so that code depending on it
+// can be tested without sleeping.
+package clock
+
+import (
+	"time"
+)
+
+// A Clock tells the current time and waits for time to pass.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// After waits for the duration to elapse and then sends the current time
+	// on the returned channel.
+	After(d time.Duration) <-chan time.Time
+	// Sleep pauses the current goroutine for at least the duration d.
+	Sleep(d time.Duration)
+	// NewTicker returns a Ticker sending the current time every d.
+	NewTicker(d time.Duration) Ticker
+}
+
+// A Ticker sends the current time at intervals, dropping ticks for slow
+// receivers, like time.Ticker.
+type Ticker interface {
+	// C returns the channel the ticks are sent on.
+	C() <-chan time.Time
+	// Stop turns the Ticker off. No tick is sent once it returns.
+	Stop()
+}
+
+// Real is the Clock backed by the time package.
+type Real struct{}
+
+// Now returns time.Now().
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+// After returns time.After(d).
+func (Real) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Sleep calls time.Sleep(d).
+func (Real) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// NewTicker returns a Ticker backed by time.NewTicker(d).
+func (Real) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (ticker realTicker) C() <-chan time.Time {
+	return ticker.Ticker.C
+}
@@ -0,0 +1,132 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/arn"
+)
+
+const (
+	arnPrefix              = "arn:"
+	arnSections            = 6
+	arnAccessPointResource = "accesspoint/"
+	arnServiceS3           = "s3"
+)
+
+// ErrInvalidARN is returned by Locate and Fetch when the host of an s3:// URI
+// starts with "arn:" but is not a bucket or access point ARN, or when its
+// RoleParameter is not the ARN of a role.
+var ErrInvalidARN = errors.New("invalid S3 ARN")
+
+// ValidRoleARN tells whether value is the ARN of an IAM role, as the
+// RoleParameter of a URI and the Config's RoleARN must be.
+func ValidRoleARN(value string) bool {
+	parsed, err := arn.Parse(value)
+	return err == nil && parsed.Service == "iam" && strings.HasPrefix(parsed.Resource, "role/")
+}
+
+// arnLocation parses an s3:// URI whose host is an S3 ARN, such as
+// s3://arn:aws:s3:::bucket/key or
+// s3://arn:aws:s3:us-west-2:123456789012:accesspoint/name/key. The ARN may be
+// percent-encoded. The second result is false if the URI does not name an
+// ARN, in which case it is left to newLocation. The query of the URI is kept
+// in the URI of the Location, for newLocation to apply its parameters.
+//
+// Bucket ARNs yield the bucket they name. Access point ARNs are passed to S3
+// as the bucket, which the SDK routes to the access point, and carry the
+// region of the access point.
+func arnLocation(value string) (Location, bool, error) {
+	scheme, rest, found := strings.Cut(value, "://")
+	if !found {
+		return Location{}, false, nil
+	}
+	var user *url.Userinfo
+	if idx := strings.Index(rest, "@"); idx >= 0 && hasARNPrefix(rest[idx+1:]) {
+		key, secret, hasSecret := strings.Cut(rest[:idx], ":")
+		if hasSecret {
+			user = url.UserPassword(unescapeUserinfo(key), unescapeUserinfo(secret))
+		} else {
+			user = url.User(unescapeUserinfo(key))
+		}
+		rest = rest[idx+1:]
+	}
+	if !hasARNPrefix(rest) {
+		return Location{}, false, nil
+	}
+	// The query holds the parameters newLocation handles, followed by the
+	// path apt appended to the URI of the source, as restorePath describes.
+	rest, query, _ := strings.Cut(rest, "?")
+	if params, appended, found := strings.Cut(query, "/"); found {
+		rest, query = strings.TrimSuffix(rest, "/")+"/"+appended, params
+	}
+	decoded, err := url.PathUnescape(rest)
+	if err != nil {
+		return Location{}, true, fmt.Errorf("%w: %w", ErrInvalidARN, err)
+	}
+
+	// The resource, the last of the colon-separated sections, continues
+	// with the object key.
+	sections := strings.SplitN(decoded, ":", arnSections)
+	if len(sections) < arnSections {
+		return Location{}, true, fmt.Errorf("%w %q: expected arn:partition:s3:region:account:resource", ErrInvalidARN, decoded)
+	}
+	prefix, resource := strings.Join(sections[:arnSections-1], ":"), sections[arnSections-1]
+	accessPoint := strings.HasPrefix(resource, arnAccessPointResource)
+	name, key, _ := strings.Cut(strings.TrimPrefix(resource, arnAccessPointResource), "/")
+	if accessPoint {
+		resource = arnAccessPointResource + name
+	} else {
+		resource = name
+	}
+	parsed, err := arn.Parse(prefix + ":" + resource)
+	if err != nil {
+		return Location{}, true, fmt.Errorf("%w: %w", ErrInvalidARN, err)
+	}
+
+	switch {
+	case parsed.Service != arnServiceS3:
+		return Location{}, true, fmt.Errorf("%w %q: service is %q, not %q", ErrInvalidARN, parsed, parsed.Service, arnServiceS3)
+	case name == "":
+		return Location{}, true, fmt.Errorf("%w %q: resource name is empty", ErrInvalidARN, parsed)
+	case accessPoint && (parsed.Region == "" || parsed.AccountID == ""):
+		return Location{}, true, fmt.Errorf("%w %q: access point ARNs need a region and an account ID", ErrInvalidARN, parsed)
+	case !accessPoint && (parsed.Region != "" || parsed.AccountID != ""):
+		return Location{}, true, fmt.Errorf("%w %q: bucket ARNs have no region or account ID", ErrInvalidARN, parsed)
+	}
+
+	loc := Location{
+		URI:    &url.URL{Scheme: scheme, User: user, Host: name, Path: "/" + key, RawQuery: query},
+		Bucket: name,
+		Key:    key,
+	}
+	if accessPoint {
+		loc.Bucket, loc.Region = parsed.String(), parsed.Region
+	}
+	if loc.Key == "" {
+		return Location{}, true, fmt.Errorf("%w: %s", ErrEmptyKey, parsed)
+	}
+	return loc, true, nil
+}
+
+// hasARNPrefix reports whether the given host and path, possibly
+// percent-encoded, start with an ARN.
+func hasARNPrefix(value string) bool {
+	return strings.HasPrefix(value, arnPrefix) || strings.HasPrefix(strings.ToLower(value), "arn%3a")
+}
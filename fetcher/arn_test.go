@@ -0,0 +1,118 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLocateARN(t *testing.T) {
+	f := New(Config{Region: "us-east-1"})
+	specs := map[string]Location{
+		"s3://arn:aws:s3:::apt-repo-bucket/dists/stable/Release": {
+			Bucket: "apt-repo-bucket", Key: "dists/stable/Release",
+		},
+		"s3://arn%3Aaws%3As3%3A%3A%3Aapt-repo-bucket/dists/stable/Release": {
+			Bucket: "apt-repo-bucket", Key: "dists/stable/Release",
+		},
+		"s3://arn:aws:s3:eu-west-1:123456789012:accesspoint/apt-repo/pool/hello%2Bworld.deb": {
+			Bucket: "arn:aws:s3:eu-west-1:123456789012:accesspoint/apt-repo", Key: "pool/hello+world.deb", Region: "eu-west-1",
+		},
+		"s3://arn:aws:s3:::apt-repo-bucket/dists/stable/Release?region=eu-west-1": {
+			Bucket: "apt-repo-bucket", Key: "dists/stable/Release", Region: "eu-west-1",
+		},
+		"s3://arn:aws:s3:::apt-repo-bucket/repo?region=eu-west-1&role=" + url.QueryEscape("arn:aws:iam::123456789012:role/apt-reader") +
+			"/dists/stable/Release": {
+			Bucket: "apt-repo-bucket", Key: "repo/dists/stable/Release", Region: "eu-west-1",
+			RoleARN: "arn:aws:iam::123456789012:role/apt-reader",
+		},
+		"s3://arn:aws:s3:eu-west-1:123456789012:accesspoint/apt-repo/repo/?region=us-west-2/pool/hello.deb": {
+			Bucket: "arn:aws:s3:eu-west-1:123456789012:accesspoint/apt-repo", Key: "repo/pool/hello.deb", Region: "eu-west-1",
+		},
+	}
+	for uri, expected := range specs {
+		objLoc, err := f.Locate(uri)
+		if err != nil {
+			t.Fatalf("Locate(%s) returned unexpected error: %v", uri, err)
+		}
+		objLoc.URI = nil
+		if diff := cmp.Diff(expected, objLoc); diff != "" {
+			t.Errorf("Locate(%s) mismatch (-want +got):\n%s", uri, diff)
+		}
+	}
+}
+
+func TestLocateARNCredentials(t *testing.T) {
+	uri := "s3://fake-access-key-id:fake%2Fsecret@arn:aws:s3:::apt-repo-bucket/dists/stable/Release"
+	objLoc, err := New(Config{Region: "us-east-1"}).Locate(uri)
+	if err != nil {
+		t.Fatalf("Locate(%s) returned unexpected error: %v", uri, err)
+	}
+	if secret, _ := objLoc.URI.User.Password(); objLoc.URI.User.Username() != "fake-access-key-id" || secret != "fake/secret" {
+		t.Errorf("Locate(%s).URI.User = %v; expected fake-access-key-id:fake/secret", uri, objLoc.URI.User)
+	}
+	if objLoc.Bucket != "apt-repo-bucket" {
+		t.Errorf("Locate(%s).Bucket = %s; expected apt-repo-bucket", uri, objLoc.Bucket)
+	}
+}
+
+func TestLocateARNRegion(t *testing.T) {
+	f := New(Config{Region: "us-east-1"})
+	uri := "s3://arn:aws:s3:eu-west-1:123456789012:accesspoint/apt-repo/dists/stable/Release"
+	objLoc, err := f.Locate(uri)
+	if err != nil {
+		t.Fatalf("Locate(%s) returned unexpected error: %v", uri, err)
+	}
+	if region := f.ClientConfig(objLoc).Region; region != "eu-west-1" {
+		t.Errorf("ClientConfig(%s).Region = %s; expected eu-west-1", uri, region)
+	}
+}
+
+func TestLocateInvalidARN(t *testing.T) {
+	specs := map[string]error{
+		"s3://arn:aws:s3/dists/stable/Release":                                        ErrInvalidARN,
+		"s3://arn:aws:sqs:::apt-repo-bucket/dists/stable/Release":                     ErrInvalidARN,
+		"s3://arn:aws:s3:::/dists/stable/Release":                                     ErrInvalidARN,
+		"s3://arn:aws:s3:eu-west-1:123456789012:apt-repo-bucket/dists/stable/Release": ErrInvalidARN,
+		"s3://arn:aws:s3:::accesspoint/apt-repo/dists/stable/Release":                 ErrInvalidARN,
+		"s3://arn:aws%zz:s3:::apt-repo-bucket/dists/stable/Release":                   ErrInvalidARN,
+		"s3://arn:aws:s3:::apt-repo-bucket":                                           ErrEmptyKey,
+	}
+	for uri, expected := range specs {
+		_, err := New(Config{Region: "us-east-1"}).Locate(uri)
+		if !errors.Is(err, expected) {
+			t.Errorf("Locate(%s) = %v; expected %v", uri, err, expected)
+		}
+	}
+}
+
+func TestValidRoleARN(t *testing.T) {
+	specs := map[string]bool{
+		"arn:aws:iam::123456789012:role/apt-reader":  true,
+		"arn:aws-cn:iam::123456789012:role/path/apt": true,
+		"arn:aws:iam::123456789012:user/apt-reader":  false,
+		"arn:aws:s3:::apt-repo-bucket":               false,
+		"apt-reader":                                 false,
+	}
+	for value, expected := range specs {
+		if actual := ValidRoleARN(value); actual != expected {
+			t.Errorf("ValidRoleARN(%q) = %t; expected %t", value, actual, expected)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	authConfMachine  = "machine"
+	authConfLogin    = "login"
+	authConfPassword = "password"
+	authConfScheme   = "s3://"
+	authConfPartsExt = ".conf"
+)
+
+var (
+	errAuthConfMissingValue = errors.New("auth.conf token is missing its value")
+)
+
+// An AuthEntry is a machine entry of an apt auth.conf file, as described in
+// apt_auth.conf(5). For s3:// URIs, Login is the access key id and Password is
+// the secret access key.
+type AuthEntry struct {
+	// Machine is a host name, optionally prefixed with s3:// and followed by a
+	// path prefix, e.g. s3.amazonaws.com/apt-repo-bucket.
+	Machine  string
+	Login    string
+	Password string
+}
+
+// ParseAuthConf parses the entries of a file in the netrc-like format of apt's
+// auth.conf. Lines starting with '#' are comments.
+func ParseAuthConf(r io.Reader) ([]AuthEntry, error) {
+	tokens := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens = append(tokens, strings.Fields(line)...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	entries := []AuthEntry{}
+	for idx := 0; idx < len(tokens); idx += 2 {
+		if idx+1 >= len(tokens) {
+			return nil, fmt.Errorf("%w: %s", errAuthConfMissingValue, tokens[idx])
+		}
+		value := tokens[idx+1]
+		switch tokens[idx] {
+		case authConfMachine:
+			entries = append(entries, AuthEntry{Machine: value})
+		case authConfLogin:
+			if len(entries) > 0 {
+				entries[len(entries)-1].Login = value
+			}
+		case authConfPassword:
+			if len(entries) > 0 {
+				entries[len(entries)-1].Password = value
+			}
+		}
+	}
+	return entries, nil
+}
+
+// LoadAuthConf reads the entries of the auth.conf file at path, followed by
+// those of the *.conf files in the partsDir directory in lexical order. Files
+// and directories that do not exist are skipped.
+func LoadAuthConf(path, partsDir string) ([]AuthEntry, error) {
+	paths := []string{path}
+	parts, err := os.ReadDir(partsDir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	for _, part := range parts {
+		if !part.IsDir() && strings.HasSuffix(part.Name(), authConfPartsExt) {
+			paths = append(paths, filepath.Join(partsDir, part.Name()))
+		}
+	}
+	slices.Sort(paths[1:])
+
+	entries := []AuthEntry{}
+	for _, p := range paths {
+		fileEntries, err := readAuthConf(p)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, fileEntries...)
+	}
+	return entries, nil
+}
+
+func readAuthConf(path string) ([]AuthEntry, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	entries, err := ParseAuthConf(file)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return entries, nil
+}
+
+// matches reports whether the entry applies to the given URI: its host must
+// equal the URI's host, and its path, if any, must be a prefix of the URI's
+// path.
+func (entry AuthEntry) matches(uri *url.URL) bool {
+	machine := strings.TrimPrefix(entry.Machine, authConfScheme)
+	host, path, _ := strings.Cut(machine, "/")
+	if !strings.EqualFold(host, uri.Host) {
+		return false
+	}
+	return strings.HasPrefix(strings.TrimPrefix(uri.Path, "/"), path)
+}
+
+// authUser returns the credentials of the first entry that applies to the
+// given URI, or nil if there is none.
+func authUser(entries []AuthEntry, uri *url.URL) *url.Userinfo {
+	for _, entry := range entries {
+		if entry.matches(uri) {
+			return url.UserPassword(entry.Login, entry.Password)
+		}
+	}
+	return nil
+}
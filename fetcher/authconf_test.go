@@ -0,0 +1,111 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseAuthConf(t *testing.T) {
+	conf := `# Credentials for the private repository.
+machine s3.amazonaws.com/apt-repo-bucket
+login AKIDEXAMPLE
+password wJalr/K7MDENG+bPxRfiCY@EXAMPLE:KEY
+
+machine s3://minio.example.com login minio password minio123
+`
+	actual, err := ParseAuthConf(strings.NewReader(conf))
+	if err != nil {
+		t.Fatalf("ParseAuthConf() returned unexpected error: %v", err)
+	}
+	expected := []AuthEntry{
+		{Machine: "s3.amazonaws.com/apt-repo-bucket", Login: "AKIDEXAMPLE", Password: "wJalr/K7MDENG+bPxRfiCY@EXAMPLE:KEY"},
+		{Machine: "s3://minio.example.com", Login: "minio", Password: "minio123"},
+	}
+	if diff := cmp.Diff(expected, actual); diff != "" {
+		t.Errorf("ParseAuthConf() mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := ParseAuthConf(strings.NewReader("machine s3.amazonaws.com login")); err == nil {
+		t.Error("ParseAuthConf() with a dangling token returned no error")
+	}
+}
+
+func TestLoadAuthConf(t *testing.T) {
+	dir := t.TempDir()
+	partsDir := filepath.Join(dir, "auth.conf.d")
+	if err := os.Mkdir(partsDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		filepath.Join(dir, "auth.conf"):          "machine a.example.com login a password a",
+		filepath.Join(partsDir, "20-c.conf"):     "machine c.example.com login c password c",
+		filepath.Join(partsDir, "10-b.conf"):     "machine b.example.com login b password b",
+		filepath.Join(partsDir, "ignored.conf~"): "machine d.example.com login d password d",
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	actual, err := LoadAuthConf(filepath.Join(dir, "auth.conf"), partsDir)
+	if err != nil {
+		t.Fatalf("LoadAuthConf() returned unexpected error: %v", err)
+	}
+	machines := []string{}
+	for _, entry := range actual {
+		machines = append(machines, entry.Machine)
+	}
+	if diff := cmp.Diff([]string{"a.example.com", "b.example.com", "c.example.com"}, machines); diff != "" {
+		t.Errorf("LoadAuthConf() machines mismatch (-want +got):\n%s", diff)
+	}
+
+	actual, err = LoadAuthConf(filepath.Join(dir, "missing.conf"), filepath.Join(dir, "missing.d"))
+	if err != nil || len(actual) != 0 {
+		t.Errorf("LoadAuthConf() of missing files = %v, %v; expected no entries and no error", actual, err)
+	}
+}
+
+func TestAuthUser(t *testing.T) {
+	entries := []AuthEntry{
+		{Machine: "s3.amazonaws.com/apt-repo-bucket/private", Login: "private", Password: "private-secret"},
+		{Machine: "s3.amazonaws.com/apt-repo-bucket", Login: "bucket", Password: "bucket-secret"},
+		{Machine: "s3://minio.example.com", Login: "minio", Password: "minio-secret"},
+	}
+	specs := map[string]string{
+		"s3://s3.amazonaws.com/apt-repo-bucket/private/hello.deb": "private",
+		"s3://s3.amazonaws.com/apt-repo-bucket/public/hello.deb":  "bucket",
+		"s3://MINIO.example.com/apt-repo-bucket/hello.deb":        "minio",
+		"s3://s3.amazonaws.com/other-bucket/hello.deb":            "",
+	}
+
+	for uri, expected := range specs {
+		parsed, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual := authUser(entries, parsed)
+		if actual.Username() != expected {
+			t.Errorf("authUser(%s) = %s; expected %s", uri, actual.Username(), expected)
+		}
+	}
+}
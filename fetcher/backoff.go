@@ -0,0 +1,53 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/apt-golang-s3/clock"
+)
+
+// A Backoff computes the delays between retries of a failed request. The delay
+// starts at Base and doubles with every attempt, up to Max.
+type Backoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+// Delay returns how long to wait before the given retry attempt, counting
+// from zero.
+func (b Backoff) Delay(attempt int) time.Duration {
+	delay := b.Base
+	for range attempt {
+		if delay >= b.Max/2 {
+			return b.Max
+		}
+		delay *= 2
+	}
+	return min(delay, b.Max)
+}
+
+// Wait blocks for the delay of the given attempt as measured by clk. It
+// returns ctx.Err() if ctx is done first.
+func (b Backoff) Wait(ctx context.Context, clk clock.Clock, attempt int) error {
+	select {
+	case <-clk.After(b.Delay(attempt)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
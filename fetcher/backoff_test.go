@@ -0,0 +1,85 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	backoff := Backoff{Base: 100 * time.Millisecond, Max: time.Second}
+	expected := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+	actual := []time.Duration{}
+	for attempt := range len(expected) {
+		actual = append(actual, backoff.Delay(attempt))
+	}
+	if diff := cmp.Diff(expected, actual); diff != "" {
+		t.Errorf("Delay() schedule mismatch (-want +got):\n%s", diff)
+	}
+
+	if actual := backoff.Delay(1000); actual != time.Second {
+		t.Errorf("Delay(1000) = %s; expected %s", actual, time.Second)
+	}
+}
+
+func TestBackoffWait(t *testing.T) {
+	backoff := Backoff{Base: time.Second, Max: time.Minute}
+	clock := testutil.NewFakeClock(time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC))
+	errc := make(chan error, 1)
+	go func() { errc <- backoff.Wait(context.Background(), clock, 2) }()
+
+	clock.BlockUntil(1)
+	clock.Advance(3 * time.Second)
+	select {
+	case <-errc:
+		t.Fatal("Wait() returned before the 4s delay elapsed")
+	default:
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("Wait() = %v; expected nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait() did not return after the 4s delay elapsed")
+	}
+}
+
+func TestBackoffWaitCancelled(t *testing.T) {
+	backoff := Backoff{Base: time.Second, Max: time.Minute}
+	clock := testutil.NewFakeClock(time.Time{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := backoff.Wait(ctx, clock, 0); !errors.Is(err, context.Canceled) {
+		t.Errorf("Wait() = %v; expected %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	bucketNameMinLength = 3
+	bucketNameMaxLength = 63
+)
+
+// ErrInvalidBucket is returned by Locate and Fetch when the bucket a URI
+// names violates the S3 bucket naming rules. This usually means that the URI
+// was not split into bucket and key as intended.
+var ErrInvalidBucket = errors.New("invalid bucket name")
+
+// validateBucket checks loc.Bucket against the S3 bucket naming rules. The
+// returned error names the violated rule and how the URI was split into
+// bucket and key.
+func validateBucket(loc Location) error {
+	if rule := bucketNameViolation(loc.Bucket); rule != "" {
+		return fmt.Errorf("%w %q, bucket names %s (%s was split into bucket %q and key %q)",
+			ErrInvalidBucket, loc.Bucket, rule, loc.URI.Redacted(), loc.Bucket, loc.Key)
+	}
+	return nil
+}
+
+// bucketNameViolation returns the first S3 bucket naming rule that name
+// violates, or an empty string if it is valid.
+func bucketNameViolation(name string) string {
+	switch {
+	case len(name) < bucketNameMinLength || len(name) > bucketNameMaxLength:
+		return fmt.Sprintf("must be between %d and %d characters long", bucketNameMinLength, bucketNameMaxLength)
+	case strings.IndexFunc(name, func(r rune) bool { return !isBucketNameChar(r) }) >= 0:
+		return "may only contain lowercase letters, numbers, dots and hyphens"
+	case !isLowerAlphanumeric(rune(name[0])) || !isLowerAlphanumeric(rune(name[len(name)-1])):
+		return "must begin and end with a letter or number"
+	case strings.Contains(name, ".."):
+		return "must not contain two adjacent dots"
+	case net.ParseIP(name) != nil:
+		return "must not be formatted as an IP address"
+	case strings.HasPrefix(name, "xn--"):
+		return `must not start with "xn--"`
+	}
+	return ""
+}
+
+func isBucketNameChar(r rune) bool {
+	return isLowerAlphanumeric(r) || r == '.' || r == '-'
+}
+
+func isLowerAlphanumeric(r rune) bool {
+	return ('a' <= r && r <= 'z') || ('0' <= r && r <= '9')
+}
@@ -0,0 +1,60 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestBucketNameViolation(t *testing.T) {
+	specs := map[string]string{
+		"apt-repo-bucket":         "",
+		"apt.repo.bucket":         "",
+		"123":                     "",
+		"ab":                      "must be between 3 and 63 characters long",
+		strings.Repeat("a", 64):   "must be between 3 and 63 characters long",
+		"Apt-Repo-Bucket":         "may only contain lowercase letters, numbers, dots and hyphens",
+		"apt_repo_bucket":         "may only contain lowercase letters, numbers, dots and hyphens",
+		"minio.internal:9000":     "may only contain lowercase letters, numbers, dots and hyphens",
+		".apt-repo-bucket":        "must begin and end with a letter or number",
+		"apt-repo-bucket-":        "must begin and end with a letter or number",
+		"apt..repo":               "must not contain two adjacent dots",
+		"192.168.5.4":             "must not be formatted as an IP address",
+		"xn--apt-repo-bucket":     `must not start with "xn--"`,
+		"apt-repo-bucket-s3alias": "",
+	}
+
+	for name, expected := range specs {
+		if actual := bucketNameViolation(name); actual != expected {
+			t.Errorf("bucketNameViolation(%q) = %q; expected %q", name, actual, expected)
+		}
+	}
+}
+
+func TestLocateInvalidBucket(t *testing.T) {
+	uri := "s3://fake-access-key-id:fake-access-key-secret@s3.amazonaws.com/Apt_Repo/dists/stable/Release"
+	_, err := New(Config{Region: "us-east-1"}).Locate(uri)
+	if !errors.Is(err, ErrInvalidBucket) {
+		t.Fatalf("Locate(%s) = %v; expected %v", uri, err, ErrInvalidBucket)
+	}
+	expected := `invalid bucket name "Apt_Repo", bucket names may only contain lowercase letters, numbers, dots ` +
+		`and hyphens (s3://fake-access-key-id:xxxxx@s3.amazonaws.com/Apt_Repo/dists/stable/Release was split ` +
+		`into bucket "Apt_Repo" and key "dists/stable/Release")`
+	if err.Error() != expected {
+		t.Errorf("Locate(%s) = %q; expected %q", uri, err, expected)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// bucketRegionHeader is the header of HeadBucket responses naming the region
+// of the bucket, which S3 sends along with redirects and denials as well.
+const bucketRegionHeader = "X-Amz-Bucket-Region"
+
+// errNoBucketRegion is returned by discoverRegion if S3 did not name the
+// region of the bucket.
+var errNoBucketRegion = errors.New("no " + bucketRegionHeader + " header in the HeadBucket response")
+
+// A BucketRegions remembers the region of every bucket a fetch discovered, so
+// that each bucket is asked for its region once, by whichever fetch needs it
+// first, and later fetches are sent to, and signed for, that region right
+// away. Failed discoveries are remembered as well. A BucketRegions is safe for
+// concurrent use.
+type BucketRegions struct {
+	mu      sync.Mutex
+	buckets map[string]*bucketRegion
+}
+
+// A bucketRegion holds the outcome of the discovery of a bucket's region. Its
+// fields must not be read before done is closed.
+type bucketRegion struct {
+	done   chan struct{}
+	region string
+	err    error
+}
+
+// NewBucketRegions returns a BucketRegions that has discovered nothing yet.
+func NewBucketRegions() *BucketRegions {
+	return &BucketRegions{buckets: map[string]*bucketRegion{}}
+}
+
+// region returns the region of bucket, calling discover if no fetch did
+// before, and whether this call discovered it. It returns ctx.Err() if ctx is
+// cancelled while another fetch is discovering the region.
+func (br *BucketRegions) region(
+	ctx context.Context, bucket string, discover func() (string, error),
+) (string, bool, error) {
+	br.mu.Lock()
+	entry, found := br.buckets[bucket]
+	if !found {
+		entry = &bucketRegion{done: make(chan struct{})}
+		br.buckets[bucket] = entry
+	}
+	br.mu.Unlock()
+
+	if !found {
+		entry.region, entry.err = discover()
+		close(entry.done)
+	}
+	select {
+	case <-entry.done:
+	case <-ctx.Done():
+		return "", false, ctx.Err()
+	}
+	return entry.region, !found, entry.err
+}
+
+// bucketRegion returns the region the Config's BucketRegions discovered for
+// the bucket of loc, or an empty string, leaving the Config's Region in
+// place, if it could not. Buckets named by ARNs are left alone, as the ARNs
+// name their regions. The fetch that discovers the region of a bucket calls
+// req.OnBucketRegion.
+func (f *Fetcher) bucketRegion(ctx context.Context, req FetchRequest, loc Location) string {
+	if f.cfg.BucketRegions == nil || loc.Region != "" || arn.IsARN(loc.Bucket) {
+		return ""
+	}
+	region, discovered, err := f.cfg.BucketRegions.region(ctx, loc.Bucket, func() (string, error) {
+		return f.discoverRegion(ctx, loc)
+	})
+	if discovered && req.OnBucketRegion != nil {
+		req.OnBucketRegion(region, err)
+	}
+	return region
+}
+
+// discoverRegion asks for the region of the bucket of loc with HeadBucket,
+// sent to us-east-1, which names the region of buckets in any other region in
+// the response redirecting there.
+func (f *Fetcher) discoverRegion(ctx context.Context, loc Location) (string, error) {
+	loc.Region = s3GlobalRegion
+	client, err := f.newS3Client(f.ClientConfig(loc))
+	if err != nil {
+		return "", err
+	}
+	if err := f.throttle(ctx); err != nil {
+		return "", err
+	}
+	var region string
+	_, err = client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(loc.Bucket)},
+		request.WithGetResponseHeader(bucketRegionHeader, &region))
+	if region != "" {
+		return region, nil
+	}
+	if err == nil {
+		err = errNoBucketRegion
+	}
+	return "", fmt.Errorf("discovering the region of bucket %s: %w", loc.Bucket, err)
+}
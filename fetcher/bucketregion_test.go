@@ -0,0 +1,150 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+)
+
+func TestBucketRegionsDiscoverOnce(t *testing.T) {
+	regions := NewBucketRegions()
+	var discoveries atomic.Int32
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			region, _, err := regions.region(context.Background(), "apt-repo-bucket", func() (string, error) {
+				discoveries.Add(1)
+				return "eu-central-1", nil
+			})
+			if region != "eu-central-1" || err != nil {
+				t.Errorf("region() = %q, %v; expected eu-central-1", region, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if actual := discoveries.Load(); actual != 1 {
+		t.Errorf("region discovered %d times; expected once", actual)
+	}
+}
+
+// A headBucketCounter is a FakeS3 that counts its HeadBucket calls.
+type headBucketCounter struct {
+	*testutil.FakeS3
+	calls atomic.Int32
+}
+
+func (fake *headBucketCounter) HeadBucketWithContext(
+	ctx aws.Context, input *s3.HeadBucketInput, opts ...request.Option,
+) (*s3.HeadBucketOutput, error) {
+	fake.calls.Add(1)
+	return fake.FakeS3.HeadBucketWithContext(ctx, input, opts...)
+}
+
+func TestFetchBucketRegion(t *testing.T) {
+	specs := map[string]struct {
+		uri             string
+		bucketRegions   map[string]string
+		expectedRegions []string
+		discovered      string
+		failed          bool
+	}{
+		"discovered": {
+			uri:             "s3://AKID:secret@apt-repo-bucket/apt/generic/hello.deb",
+			bucketRegions:   map[string]string{"apt-repo-bucket": "eu-central-1"},
+			expectedRegions: []string{"us-east-1", "eu-central-1", "eu-central-1"},
+			discovered:      "eu-central-1",
+		},
+		"not named": {
+			uri:             "s3://AKID:secret@apt-repo-bucket/apt/generic/hello.deb",
+			expectedRegions: []string{"us-east-1", "us-west-2", "us-west-2"},
+			failed:          true,
+		},
+		"named by the URI": {
+			uri:             "s3://AKID:secret@apt-repo-bucket/apt/generic/hello.deb?region=ap-south-1",
+			bucketRegions:   map[string]string{"apt-repo-bucket": "eu-central-1"},
+			expectedRegions: []string{"ap-south-1", "ap-south-1"},
+		},
+		"named by the host": {
+			uri:             "s3://AKID:secret@apt-repo-bucket.s3.sa-east-1.amazonaws.com/apt/generic/hello.deb",
+			bucketRegions:   map[string]string{"apt-repo-bucket": "eu-central-1"},
+			expectedRegions: []string{"sa-east-1", "sa-east-1"},
+		},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			fake := &headBucketCounter{FakeS3: testutil.NewFakeS3()}
+			fake.BucketRegions = spec.bucketRegions
+			fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+			var mu sync.Mutex
+			var regions []string
+			f := New(Config{Region: "us-west-2", BucketRegions: NewBucketRegions()},
+				WithS3ClientFactory(func(cfg ClientConfig) (s3iface.S3API, error) {
+					mu.Lock()
+					defer mu.Unlock()
+					regions = append(regions, cfg.Region)
+					return fake, nil
+				}))
+
+			var reported []string
+			for range 2 {
+				req := FetchRequest{
+					URI:      spec.uri,
+					Filename: filepath.Join(t.TempDir(), "hello.deb"),
+					OnBucketRegion: func(region string, err error) {
+						reported = append(reported, region)
+						if (err != nil) != spec.failed {
+							t.Errorf("OnBucketRegion() called with error %v; expected an error: %t", err, spec.failed)
+						}
+						if err != nil && !errors.Is(err, errNoBucketRegion) {
+							t.Errorf("OnBucketRegion() called with error %v; expected %v", err, errNoBucketRegion)
+						}
+					},
+				}
+				if _, err := f.Fetch(context.Background(), req); err != nil {
+					t.Fatalf("Fetch() returned unexpected error: %v", err)
+				}
+			}
+			if diff := cmp.Diff(spec.expectedRegions, regions); diff != "" {
+				t.Errorf("regions of the clients mismatch (-want +got):\n%s", diff)
+			}
+			discoveries := 0
+			if len(spec.expectedRegions) > 2 {
+				discoveries = 1
+			}
+			if actual := int(fake.calls.Load()); actual != discoveries {
+				t.Errorf("HeadBucket called %d times; expected %d", actual, discoveries)
+			}
+			if len(reported) != discoveries || (discoveries > 0 && reported[0] != spec.discovered) {
+				t.Errorf("OnBucketRegion() called with %q; expected %d call with %q", reported, discoveries, spec.discovered)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"io"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// copyBufferSize is the size of the buffers copyBuffered uses.
+const copyBufferSize = 64 << 10
+
+// copyBuffers holds the buffers of copyBuffered, so that the many small files
+// of an update do not each allocate their own.
+var copyBuffers = sync.Pool{ //nolint:gochecknoglobals
+	New: func() any {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	},
+}
+
+// copyBuffered copies src to dst like io.Copy does, but through a pooled
+// buffer, which neither src nor dst may bypass. The buffer is zeroed before
+// it is returned to the pool, so that no file content outlives the copy.
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte) //nolint:forcetypeassert
+	defer func() {
+		clear(*buf)
+		copyBuffers.Put(buf)
+	}()
+	// Hiding io.WriterTo and io.ReaderFrom keeps io.CopyBuffer from
+	// allocating a buffer of its own in their fallback paths.
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
+
+// pooledBuffers is the s3manager.WriterReadFromProvider that makes the parts of
+// a download be copied through copyBuffered rather than a buffer each.
+type pooledBuffers struct{}
+
+// GetReadFrom implements s3manager.WriterReadFromProvider. The buffer is only
+// taken from the pool for the duration of each copy, so there is nothing to
+// clean up.
+func (pooledBuffers) GetReadFrom(w io.Writer) (s3manager.WriterReadFrom, func()) {
+	return bufferedReaderFrom{w}, func() {}
+}
+
+// A bufferedReaderFrom reads into its Writer through copyBuffered.
+type bufferedReaderFrom struct {
+	io.Writer
+}
+
+func (w bufferedReaderFrom) ReadFrom(r io.Reader) (int64, error) {
+	return copyBuffered(w.Writer, r)
+}
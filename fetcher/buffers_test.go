@@ -0,0 +1,40 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+func TestCopyBuffered(t *testing.T) {
+	content := bytes.Repeat([]byte("apt"), copyBufferSize)
+	dst := &bytes.Buffer{}
+	numBytes, err := copyBuffered(dst, bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("copyBuffered() returned unexpected error: %v", err)
+	}
+	if numBytes != int64(len(content)) || !bytes.Equal(dst.Bytes(), content) {
+		t.Errorf("copyBuffered() copied %d bytes; expected the %d bytes of the source", numBytes, len(content))
+	}
+
+	// The buffer returned to the pool must not retain any of the content.
+	buf := copyBuffers.Get().(*[]byte) //nolint:forcetypeassert
+	defer copyBuffers.Put(buf)
+	if slices.ContainsFunc(*buf, func(b byte) bool { return b != 0 }) {
+		t.Error("pooled buffer retains content after the copy")
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/google/apt-golang-s3/clock"
+)
+
+// DefaultCacheMaxSize is the size, in bytes, a Cache is limited to unless
+// specified otherwise.
+const DefaultCacheMaxSize = 1 << 30
+
+// cacheTempPrefix starts the names of the files put writes before they are
+// moved into place.
+const cacheTempPrefix = ".tmp-"
+
+// A Cache stores downloaded objects on the local disk, keyed by bucket, key
+// and ETag, so that an object which did not change need not be downloaded
+// again. When the files in the Cache exceed its maximum size, the least
+// recently used ones are evicted. A Cache is safe for concurrent use.
+type Cache struct {
+	dir     string
+	maxSize int64
+	clock   clock.Clock
+	mu      sync.Mutex
+}
+
+// OpenCache returns a Cache storing up to maxSize bytes in dir, which is
+// created if it does not exist. It returns an error if dir is not writable.
+// When entries were last used is told by clk.
+func OpenCache(dir string, maxSize int64, clk clock.Clock) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	probe, err := os.CreateTemp(dir, ".probe-*")
+	if err != nil {
+		return nil, err
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return &Cache{dir: dir, maxSize: maxSize, clock: clk}, nil
+}
+
+// path returns the path of the cached copy of the object at loc with the
+// given ETag.
+func (c *Cache) path(loc Location, etag string) string {
+	sum := sha256.Sum256([]byte(loc.Bucket + "\x00" + loc.Key + "\x00" + etag))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+// get copies the cached copy of the object at loc with the given ETag and
+// size to filename. It reports whether there was one. The entry is only opened
+// under the Cache's lock and copied outside of it, so that a large copy does
+// not hold up other lookups; the open file stays intact if the entry is
+// evicted or replaced meanwhile.
+func (c *Cache) get(loc Location, etag string, size int64, filename string) bool {
+	path := c.path(loc, etag)
+	c.mu.Lock()
+	in, err := os.Open(path)
+	c.mu.Unlock()
+	if err != nil {
+		return false
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil || (size >= 0 && info.Size() != size) {
+		return false
+	}
+	if err := copyTo(in, filename); err != nil {
+		os.Remove(filename)
+		return false
+	}
+	// The modification time records when the entry was last used.
+	now := c.clock.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	os.Chtimes(path, now, now)
+	return true
+}
+
+// put stores a copy of filename as the object at loc with the given ETag and
+// evicts the least recently used entries beyond the Cache's maximum size. The
+// copy is written to a temporary file outside of the Cache's lock, which is
+// only held to move it into place and evict.
+func (c *Cache) put(loc Location, etag, filename string) error {
+	tmp, err := os.CreateTemp(c.dir, cacheTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	if err := copyFile(filename, tmp.Name()); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	now := c.clock.Now()
+	os.Chtimes(tmp.Name(), now, now)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.Rename(tmp.Name(), c.path(loc, etag)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return c.evict()
+}
+
+// evict removes the least recently used entries until the Cache is no larger
+// than its maximum size.
+func (c *Cache) evict() error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	var total int64
+	for _, entry := range entries {
+		// The temporary files of concurrent puts are not entries yet.
+		if strings.HasPrefix(entry.Name(), cacheTempPrefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		infos = append(infos, info)
+		total += info.Size()
+	}
+	slices.SortFunc(infos, func(a, b os.FileInfo) int {
+		return a.ModTime().Compare(b.ModTime())
+	})
+	for _, info := range infos {
+		if total <= c.maxSize {
+			break
+		}
+		if err := os.Remove(filepath.Join(c.dir, info.Name())); err != nil {
+			return fmt.Errorf("evicting %s from the cache: %w", info.Name(), err)
+		}
+		total -= info.Size()
+	}
+	return nil
+}
+
+// copyFile copies the contents of the file src to the file dst, which is
+// created or truncated.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return copyTo(in, dst)
+}
+
+// copyTo copies what remains of in to the file dst, which is created or
+// truncated.
+func copyTo(in io.Reader, dst string) error {
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
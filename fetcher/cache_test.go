@@ -0,0 +1,119 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/google/apt-golang-s3/clock"
+	"github.com/google/apt-golang-s3/internal/testutil"
+)
+
+func TestFetchUsesCache(t *testing.T) {
+	cache, err := OpenCache(t.TempDir(), DefaultCacheMaxSize, clock.Real{})
+	if err != nil {
+		t.Fatalf("OpenCache() returned unexpected error: %v", err)
+	}
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello"), ETag: `"v1"`})
+	f := New(Config{Region: "us-east-1", Cache: cache}, WithS3ClientFactory(func(ClientConfig) (s3iface.S3API, error) {
+		return fake, nil
+	}))
+	fetch := func(expectedCached bool, expectedContents string) {
+		t.Helper()
+		filename := filepath.Join(t.TempDir(), "hello.deb")
+		result, err := f.Fetch(context.Background(), FetchRequest{URI: testURI, Filename: filename})
+		if err != nil {
+			t.Fatalf("Fetch() returned unexpected error: %v", err)
+		}
+		if result.Cached != expectedCached {
+			t.Errorf("Fetch() cached = %t; expected %t", result.Cached, expectedCached)
+		}
+		contents, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("failed to read fetched file: %v", err)
+		}
+		if string(contents) != expectedContents {
+			t.Errorf("fetched contents = %q; expected %q", contents, expectedContents)
+		}
+	}
+
+	fetch(false, "hello")
+	fetch(true, "hello")
+	if gets := fake.Gets(); gets != 1 {
+		t.Errorf("GetObject called %d times; expected once", gets)
+	}
+
+	fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello, world"), ETag: `"v2"`})
+	fetch(false, "hello, world")
+	fetch(true, "hello, world")
+	if gets := fake.Gets(); gets != 2 {
+		t.Errorf("GetObject called %d times; expected twice", gets)
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	clk := testutil.NewFakeClock(time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC))
+	cache, err := OpenCache(t.TempDir(), 10, clk)
+	if err != nil {
+		t.Fatalf("OpenCache() returned unexpected error: %v", err)
+	}
+	src := filepath.Join(t.TempDir(), "src")
+	if err := os.WriteFile(src, []byte("hello"), 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	put := func(key string) {
+		t.Helper()
+		loc := Location{Bucket: "apt-repo-bucket", Key: key}
+		if err := cache.put(loc, "etag", src); err != nil {
+			t.Fatalf("put(%s) returned unexpected error: %v", key, err)
+		}
+		clk.Advance(time.Minute)
+	}
+	has := func(key string) bool {
+		return cache.get(Location{Bucket: "apt-repo-bucket", Key: key}, "etag", 5,
+			filepath.Join(t.TempDir(), "dst"))
+	}
+
+	put("a")
+	put("b")
+	clk.Advance(time.Minute)
+	if !has("a") {
+		t.Fatalf("cache is missing a")
+	}
+	put("c")
+
+	for key, expected := range map[string]bool{"a": true, "b": false, "c": true} {
+		if actual := has(key); actual != expected {
+			t.Errorf("cache has %s = %t; expected %t", key, actual, expected)
+		}
+	}
+}
+
+func TestOpenCacheNotWritable(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if _, err := OpenCache(filepath.Join(file, "cache"), DefaultCacheMaxSize, clock.Real{}); err == nil {
+		t.Errorf("OpenCache() returned no error for a directory below a file")
+	}
+}
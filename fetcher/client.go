@@ -0,0 +1,520 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fetcher
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/endpointcreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sts"
+
+	"github.com/google/apt-golang-s3/version"
+)
+
+var (
+	// ErrMissingPassword is returned by Fetch when the URI contains an access
+	// key id but no secret access key.
+	ErrMissingPassword = errors.New("a secret access key is required when the URI contains an access key id")
+	// ErrNoSharedFiles is returned by Fetch when credentials are to be taken
+	// from a profile, but there are no shared AWS configuration files to read
+	// it from.
+	ErrNoSharedFiles = errors.New("no shared AWS configuration files")
+	// ErrSession is returned by Fetch when the AWS session every client is
+	// built from cannot be created from the configuration and environment.
+	ErrSession = errors.New("cannot create the AWS session")
+)
+
+// A ClientConfig holds the settings an S3 client is built from for a single
+// fetch.
+type ClientConfig struct {
+	Region   string
+	Endpoint string
+	// PathStyle makes requests name the bucket in the path rather than the
+	// host of the Endpoint.
+	PathStyle bool
+	RoleARN   string
+	// RoleSourceIdentity is the source identity set when assuming RoleARN.
+	RoleSourceIdentity string
+	// STSEndpoint, when set, overrides the regional STS endpoint RoleARN is
+	// assumed through.
+	STSEndpoint string
+	// User carries the static credentials embedded in the requested URI, if
+	// any. The access key id and secret access key correspond to its
+	// Username() and Password() functions.
+	User *url.Userinfo
+	// Profile, when set, names the shared configuration profile credentials
+	// are taken from.
+	Profile string
+	// SharedCredentialsFile and SharedConfigFile, when set, replace the shared
+	// AWS credentials and configuration files, like AWS_SHARED_CREDENTIALS_FILE
+	// and AWS_CONFIG_FILE do.
+	SharedCredentialsFile, SharedConfigFile string
+	// DisableIMDS keeps the default credential chain from asking the EC2
+	// instance metadata service for the credentials of an instance role.
+	DisableIMDS bool
+	// DisableSSL makes requests to S3 use plain HTTP.
+	DisableSSL bool
+	// Accelerate makes requests to S3 use its Transfer Acceleration endpoint.
+	Accelerate bool
+	// SSLCert and SSLKey, when SSLCert is set, name the PEM files of the
+	// client certificate and its private key presented to Endpoint, unless
+	// it is a host of AWS. SSLKey defaults to SSLCert.
+	SSLCert, SSLKey string
+	// TLSMinVersion is the oldest TLS version negotiated, such as
+	// tls.VersionTLS12. Zero means DefaultTLSMinVersion.
+	TLSMinVersion uint16
+	// TLSRestrictCiphers limits the cipher suites offered below TLS 1.3 to
+	// those with forward secrecy and authenticated encryption.
+	TLSRestrictCiphers bool
+	// RoleCache, when set, shares the credentials of RoleARN between the
+	// clients built with it, so that the role is assumed once rather than for
+	// every object.
+	RoleCache *RoleCache
+	// IdleTimeout, when positive, is how long idle HTTP connections are kept
+	// open before they are closed.
+	IdleTimeout time.Duration
+	// Transports, when set, shares the HTTP transports of the clients built
+	// with it, so that their connections are reused.
+	Transports *TransportCache
+}
+
+// A CredentialsInfo describes the credentials an S3 client signs its requests
+// with.
+type CredentialsInfo struct {
+	// Provider is the name of the provider the credentials were retrieved
+	// from, e.g. "EnvConfigCredentials", or empty if it is unknown.
+	Provider string
+	// Expires is when the credentials expire, or zero if they do not or it is
+	// unknown.
+	Expires time.Time
+}
+
+// Container tells whether the credentials were retrieved from a container
+// credentials endpoint, as used by ECS tasks and EKS Pod Identity.
+func (info CredentialsInfo) Container() bool {
+	return info.Provider == endpointcreds.ProviderName
+}
+
+// An S3ClientFactory builds the S3 client used for a fetch.
+type S3ClientFactory func(cfg ClientConfig) (s3iface.S3API, error)
+
+// Endpoint returns the URL of the S3 service the Fetcher talks to: the
+// configured endpoint when there is one, and the regional AWS endpoint
+// otherwise.
+//
+// An endpoint template is expanded for the configured region, without any
+// bucket.
+func (f *Fetcher) Endpoint() (*url.URL, error) {
+	return f.endpointURL(f.cfg.Endpoint)
+}
+
+// endpointURL returns the URL of the given endpoint, or of the regional AWS
+// endpoint if it is empty, expanding endpoint templates for the configured
+// region.
+func (f *Fetcher) endpointURL(endpoint string) (*url.URL, error) {
+	if endpoint != "" {
+		expanded, err := expandEndpoint(endpoint, f.cfg.Region)
+		if err != nil {
+			return nil, err
+		}
+		s3URL, err := url.Parse(expanded.URL)
+		if err != nil {
+			return nil, fmt.Errorf("parsing S3 endpoint %s: %w", endpoint, err)
+		}
+		return s3URL, nil
+	}
+	return s3EndpointURL(f.cfg.Region)
+}
+
+// hostEndpoint returns the endpoint of the Config's HostEndpoints for the
+// host of the given URI, or an empty string if there is none.
+func (f *Fetcher) hostEndpoint(uri string) string {
+	parsed, err := url.Parse(preProcessURL(uri))
+	if err != nil || len(f.cfg.HostEndpoints) == 0 {
+		return ""
+	}
+	hostname, endpoint, longest := strings.ToLower(parsed.Hostname()), "", -1
+	for host, candidate := range f.cfg.HostEndpoints {
+		host = strings.ToLower(host)
+		if (hostname == host || strings.HasSuffix(hostname, "."+host)) && len(host) > longest {
+			endpoint, longest = candidate, len(host)
+		}
+	}
+	return endpoint
+}
+
+// ClientConfig returns the ClientConfig for a fetch of the object at loc, based
+// on the Fetcher's Config. Credentials embedded in the URI take precedence over
+// those of a matching AuthEntry. If the Config says so, a user name without a
+// password names a profile instead.
+func (f *Fetcher) ClientConfig(loc Location) ClientConfig {
+	return f.clientConfig(loc, f.cfg.Endpoint)
+}
+
+// clientConfig returns the ClientConfig for a fetch of the object at loc from
+// the given endpoint, expanding it if it is a template.
+func (f *Fetcher) clientConfig(loc Location, endpoint string) ClientConfig {
+	if loc.Endpoint != "" {
+		endpoint = loc.Endpoint
+	}
+	cfg := ClientConfig{
+		Region:   f.cfg.Region,
+		Endpoint: endpoint,
+		RoleARN:  f.cfg.RoleARN,
+		User:     loc.URI.User,
+
+		RoleSourceIdentity: f.cfg.RoleSourceIdentity,
+		STSEndpoint:        f.cfg.STSEndpoint,
+		DisableIMDS:        f.cfg.DisableIMDS,
+		DisableSSL:         f.cfg.DisableSSL,
+		Accelerate:         f.cfg.Accelerate,
+		TLSMinVersion:      f.cfg.TLSMinVersion,
+		TLSRestrictCiphers: f.cfg.TLSRestrictCiphers,
+
+		SharedCredentialsFile: f.cfg.SharedCredentialsFile,
+		SharedConfigFile:      f.cfg.SharedConfigFile,
+	}
+	cfg.RoleCache, cfg.IdleTimeout, cfg.Transports = f.cfg.RoleCache, f.cfg.IdleTimeout, f.cfg.Transports
+	if loc.Region != "" {
+		cfg.Region = loc.Region
+	}
+	if loc.RoleARN != "" {
+		cfg.RoleARN = loc.RoleARN
+	}
+	// Client certificates are for the configured endpoint only, not for its
+	// fallbacks or the endpoints URIs name.
+	if loc.Endpoint == "" && endpoint == f.cfg.Endpoint {
+		cfg.SSLCert, cfg.SSLKey = f.cfg.SSLCert, f.cfg.SSLKey
+	}
+	if expanded, err := expandEndpoint(endpoint, f.hostRegion(loc, endpoint, cfg.Region)); err == nil {
+		cfg.Endpoint, cfg.PathStyle = expanded.URL, expanded.PathStyle
+	}
+	if cfg.User == nil {
+		cfg.User = authUser(f.cfg.AuthEntries, loc.URI)
+	}
+	if f.cfg.UserAsProfile && cfg.User != nil {
+		if _, hasPassword := cfg.User.Password(); !hasPassword {
+			cfg.Profile, cfg.User = cfg.User.Username(), nil
+		}
+	}
+	return cfg
+}
+
+// hostRegion returns the region to expand the given endpoint template for in
+// a fetch of the object at loc whose requests are signed for region. A URI
+// whose host is that of the endpoint, or a subdomain of it, as in path-style
+// and virtual-hosted-style URIs, names the host to connect to: the endpoint is
+// then expanded for the configured region it was matched with, whatever
+// region the requests are signed for. Otherwise, as for URIs that only name
+// the bucket, the endpoint is expanded for region.
+func (f *Fetcher) hostRegion(loc Location, endpoint, region string) string {
+	if !strings.Contains(endpoint, regionPlaceholder) || loc.URI == nil {
+		return region
+	}
+	matched, err := f.endpointURL(endpoint)
+	if err != nil || !namesHost(loc.URI.Hostname(), matched.Hostname()) {
+		return region
+	}
+	return f.cfg.Region
+}
+
+// NewS3Client is the default S3ClientFactory. It provides an initialized
+// s3iface.S3API based on the contents of the provided ClientConfig.
+func NewS3Client(cfg ClientConfig) (s3iface.S3API, error) {
+	sess, config, err := NewSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Resolve the credentials up front rather than on the first request, so that
+	// the time it takes is accounted for separately.
+	creds := config.Credentials
+	if creds == nil {
+		creds = sess.Config.Credentials
+	}
+	if _, err := creds.Get(); err != nil {
+		if config.Credentials != nil && cfg.RoleARN != "" && cfg.User.Username() == "" {
+			return nil, assumeRoleError(cfg, err)
+		}
+		return nil, err
+	}
+
+	client := s3.New(sess, config)
+	client.Handlers.UnmarshalError.PushBack(recordServerTime)
+	client.Handlers.Send.PushBack(tlsVersionHandler(cfg.tlsMinVersion()))
+	return client, nil
+}
+
+// NewSession creates the AWS session and client configuration used to talk to
+// S3. When the returned config carries no Credentials, the session's default
+// credential chain applies.
+func NewSession(cfg ClientConfig) (*session.Session, *aws.Config, error) {
+	config := &aws.Config{
+		Region: aws.String(cfg.Region),
+	}
+	if cfg.Endpoint != "" {
+		config.Endpoint = aws.String(cfg.Endpoint)
+	}
+	if cfg.PathStyle {
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+	// Name every provider of the default credential chain when none of them
+	// yields credentials, not just the last one.
+	sessConfig := *config
+	sessConfig.CredentialsChainVerboseErrors = aws.Bool(true)
+	// The SDK changes the transport of the session's HTTP client to trust the
+	// CA bundle AWS_CA_BUNDLE names. It is given one of its own to change,
+	// before the session is handed the shared one of the TransportCache.
+	sessConfig.HTTPClient = &http.Client{}
+	opts := session.Options{
+		Config:            sessConfig,
+		Profile:           cfg.Profile,
+		Handlers:          defaults.Handlers(),
+		SharedConfigFiles: cfg.SharedFiles(),
+	}
+	// Only S3 is asked over plain HTTP or through Transfer Acceleration, not
+	// the services credentials come from.
+	if cfg.DisableSSL {
+		config.DisableSSL = aws.Bool(true)
+	}
+	if cfg.Accelerate {
+		config.S3UseAccelerate = aws.Bool(true)
+	}
+	if cfg.Profile != "" && len(opts.SharedConfigFiles) == 0 {
+		return nil, nil, fmt.Errorf("%w: cannot read profile %s without a home directory, "+
+			"set Acquire::s3::shared-credentials-file", ErrNoSharedFiles, cfg.Profile)
+	}
+	// The SDK falls back to the default credential chain for profiles that
+	// no file defines, failing with an error that does not name the profile.
+	if cfg.Profile != "" && !profileDefined(opts.SharedConfigFiles, cfg.Profile) {
+		return nil, nil, session.SharedConfigProfileNotExistsError{Profile: cfg.Profile}
+	}
+	if cfg.DisableIMDS {
+		opts.Handlers.Build.PushFrontNamed(disableIMDSHandler)
+	}
+	if cfg.Profile != "" {
+		opts.SharedConfigState = session.SharedConfigEnable
+	}
+	sess, err := session.NewSessionWithOptions(opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrSession, err)
+	}
+	if sess.Config.HTTPClient, err = cfg.Transports.client(cfg, false); err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrSession, err)
+	}
+	if cfg.SSLCert != "" && cfg.Endpoint != "" && !isAWSEndpoint(cfg.Endpoint) {
+		if config.HTTPClient, err = cfg.Transports.client(cfg, true); err != nil {
+			return nil, nil, err
+		}
+	}
+	sess.Handlers.Build.PushBack(request.MakeAddToUserAgentHandler(version.Name, version.Get()))
+	switch SelectCredentials(cfg).Used {
+	case CredentialSourceURI:
+		// Use explicitly specified static credentials to access S3
+		secretAccessKey, ok := cfg.User.Password()
+		if !ok {
+			return nil, nil, ErrMissingPassword
+		}
+		config.Credentials = credentials.NewStaticCredentials(cfg.User.Username(), secretAccessKey, "")
+	case CredentialSourceRole:
+		// Use default credential chain to assume specified role
+		config.Credentials = cfg.RoleCache.credentials(cfg, func() *credentials.Credentials {
+			stsClient := sts.New(sess, &aws.Config{
+				Endpoint:            aws.String(cfg.STSEndpoint),
+				STSRegionalEndpoint: endpoints.RegionalSTSEndpoint,
+			})
+			return stscreds.NewCredentialsWithClient(stsClient, cfg.RoleARN,
+				func(p *stscreds.AssumeRoleProvider) {
+					if cfg.RoleSourceIdentity != "" {
+						p.SourceIdentity = aws.String(cfg.RoleSourceIdentity)
+					}
+				})
+		})
+	case CredentialSourceContainer:
+		config.Credentials = containerCredentials(sess)
+	}
+
+	return sess, config, nil
+}
+
+// SharedFiles returns the shared AWS configuration and credentials files the
+// default credential chain reads, in that order. Files that are neither
+// configured nor in the environment are looked for in the user's home
+// directory and left out if it is unknown.
+func (cfg ClientConfig) SharedFiles() []string {
+	files, home := []string{}, homeDir()
+	for _, file := range []struct{ configured, envVar, name string }{
+		{cfg.SharedConfigFile, "AWS_CONFIG_FILE", "config"},
+		{cfg.SharedCredentialsFile, "AWS_SHARED_CREDENTIALS_FILE", "credentials"},
+	} {
+		switch {
+		case file.configured != "":
+			files = append(files, file.configured)
+		case os.Getenv(file.envVar) != "":
+			files = append(files, os.Getenv(file.envVar))
+		case home != "":
+			files = append(files, filepath.Join(home, ".aws", file.name))
+		}
+	}
+	return files
+}
+
+// profileDefined tells whether any of the given shared configuration and
+// credentials files has a section for the named profile, as "[name]" or
+// "[profile name]". Files that cannot be read are skipped.
+func profileDefined(files []string, name string) bool {
+	for _, file := range files {
+		contents, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(contents), "\n") {
+			section, found := strings.CutPrefix(strings.TrimSpace(line), "[")
+			if !found {
+				continue
+			}
+			section, found = strings.CutSuffix(section, "]")
+			if !found {
+				continue
+			}
+			fields := strings.Fields(section)
+			if len(fields) > 0 && fields[0] == "profile" {
+				fields = fields[1:]
+			}
+			if len(fields) == 1 && fields[0] == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// homeDir returns the home directory of the user, preferably from HOME, or
+// an empty string if it is unknown.
+func homeDir() string {
+	if home, err := os.UserHomeDir(); err == nil && home != "" {
+		return home
+	}
+	if current, err := user.Current(); err == nil {
+		return current.HomeDir
+	}
+	return ""
+}
+
+// disableIMDSHandler fails requests to the EC2 instance metadata service
+// before they are sent, as the SDK does when AWS_EC2_METADATA_DISABLED is set.
+//
+//nolint:gochecknoglobals
+var disableIMDSHandler = request.NamedHandler{
+	Name: "aptgolangs3.DisableIMDS",
+	Fn: func(r *request.Request) {
+		if r.ClientInfo.ServiceName == ec2metadata.ServiceName {
+			r.Error = awserr.New(request.CanceledErrorCode, "EC2 IMDS access disabled via Acquire::s3::disable-imds", nil)
+		}
+	},
+}
+
+// assumeRoleError describes the failure to assume the role of cfg, naming the
+// STS error code, if any, and the STS endpoint contacted.
+func assumeRoleError(cfg ClientConfig, err error) error {
+	endpoint := cfg.STSEndpoint
+	if endpoint == "" {
+		resolved, resolveErr := endpoints.DefaultResolver().EndpointFor(sts.EndpointsID, cfg.Region,
+			endpoints.STSRegionalEndpointOption)
+		if resolveErr == nil {
+			endpoint = resolved.URL
+		}
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		return fmt.Errorf("assuming role %s through %s failed with %s: %w", cfg.RoleARN, endpoint, awsErr.Code(), err)
+	}
+	return fmt.Errorf("assuming role %s through %s failed: %w", cfg.RoleARN, endpoint, err)
+}
+
+// containerCredentials returns credentials from the container credentials
+// endpoint that ECS and EKS Pod Identity announce in the environment, sending
+// the token of AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE if set. Unlike the
+// default credential chain, these credentials tell when they expire.
+func containerCredentials(sess *session.Session) *credentials.Credentials {
+	return credentials.NewCredentials(defaults.RemoteCredProvider(*sess.Config, sess.Handlers))
+}
+
+// credentialsInfo returns the CredentialsInfo of the credentials client has
+// already retrieved. Clients that do not expose their credentials yield a
+// zero value.
+func credentialsInfo(client s3iface.S3API) CredentialsInfo {
+	creds := clientCredentials(client)
+	if creds == nil {
+		return CredentialsInfo{}
+	}
+	value, err := creds.Get()
+	if err != nil {
+		return CredentialsInfo{}
+	}
+	info := CredentialsInfo{Provider: value.ProviderName}
+	if expires, err := creds.ExpiresAt(); err == nil {
+		info.Expires = expires
+	}
+	return info
+}
+
+// A credentialsExposer is an S3 client, such as a fake, that exposes the
+// credentials it signs its requests with.
+type credentialsExposer interface {
+	ClientCredentials() *credentials.Credentials
+}
+
+// clientCredentials returns the credentials client signs its requests with,
+// or nil if it does not expose them.
+func clientCredentials(client s3iface.S3API) *credentials.Credentials {
+	switch client := client.(type) {
+	case *s3.S3:
+		return client.Config.Credentials
+	case credentialsExposer:
+		return client.ClientCredentials()
+	default:
+		return nil
+	}
+}
+
+func s3EndpointURL(region string) (*url.URL, error) {
+	resolver := endpoints.DefaultResolver()
+
+	endpoint, err := resolver.EndpointFor(s3.EndpointsID, region, endpoints.StrictMatchingOption)
+	if err != nil {
+		return nil, fmt.Errorf("resolving S3 endpoint for region %s: %w", region, err)
+	}
+
+	return url.Parse(endpoint.URL)
+}
@@ -0,0 +1,557 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fetcher
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+func TestS3EndpointURL(t *testing.T) {
+	specs := map[string]struct {
+		expectedURL *url.URL
+		expectError bool
+	}{
+		"us-east-1": {
+			&url.URL{
+				Scheme: "https",
+				Host:   "s3.amazonaws.com",
+			},
+			false,
+		},
+		"us-west-2": {
+			&url.URL{
+				Scheme: "https",
+				Host:   "s3.us-west-2.amazonaws.com",
+			},
+			false,
+		},
+		"us-gov-east-1": {
+			&url.URL{
+				Scheme: "https",
+				Host:   "s3.us-gov-east-1.amazonaws.com",
+			},
+			false,
+		},
+		"cn-north-1": {
+			&url.URL{
+				Scheme: "https",
+				Host:   "s3.cn-north-1.amazonaws.com.cn",
+			},
+			false,
+		},
+		"outer-space-0": {
+			nil,
+			true,
+		},
+	}
+
+	for region, spec := range specs {
+		t.Run(region, func(t *testing.T) {
+			s3URL, err := s3EndpointURL(region)
+			if err != nil && !spec.expectError {
+				t.Errorf("expected s3EndpointURL(%#v) not to return an error but got %#v", region, err)
+			} else if err == nil && spec.expectError {
+				t.Errorf("expected s3EndpointURL(%#v) to return an error but got none", region)
+			}
+
+			if diff := cmp.Diff(spec.expectedURL, s3URL); diff != "" {
+				t.Errorf("s3EndpointURL(%#v) mismatch (-want +got):\n%s", region, diff)
+			}
+		})
+	}
+}
+
+func TestNewSessionStaticCredentials(t *testing.T) {
+	secrets := []string{
+		"wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY",
+		"with:colon",
+		"with@at",
+		"with@two@ats",
+		"with+plus",
+		"with#hash",
+		"with?question",
+		"with%percent",
+		"with space",
+		"with/slash:and@everything+else#?",
+	}
+	hosts := []string{"s3.amazonaws.com/apt-repo-bucket", "apt-repo-bucket.s3.amazonaws.com"}
+
+	for _, secret := range secrets {
+		for _, host := range hosts {
+			uri := "s3://AKIDEXAMPLE:" + secret + "@" + host + "/dists/stable/Release"
+			t.Run(uri, func(t *testing.T) {
+				assertStaticCredentials(t, uri, secret)
+			})
+		}
+
+		// Percent-encoded secrets must not be encoded twice.
+		encoded := url.UserPassword("AKIDEXAMPLE", secret).String()
+		uri := "s3://" + encoded + "@s3.amazonaws.com/apt-repo-bucket/dists/stable/Release"
+		t.Run(uri, func(t *testing.T) {
+			assertStaticCredentials(t, uri, secret)
+		})
+	}
+}
+
+// assertStaticCredentials checks that the credentials of a session created for
+// the given URI are its embedded access key id and secret.
+func assertStaticCredentials(t *testing.T, uri, secret string) {
+	t.Helper()
+	loc, err := newLocation(uri, "s3.amazonaws.com")
+	if err != nil {
+		t.Fatalf("newLocation() returned unexpected error: %v", err)
+	}
+	if loc.Bucket != "apt-repo-bucket" || loc.Key != "dists/stable/Release" {
+		t.Errorf("newLocation() = bucket %s, key %s; expected bucket apt-repo-bucket, key dists/stable/Release",
+			loc.Bucket, loc.Key)
+	}
+	_, config, err := NewSession(ClientConfig{Region: "us-east-1", User: loc.URI.User})
+	if err != nil {
+		t.Fatalf("NewSession() returned unexpected error: %v", err)
+	}
+	value, err := config.Credentials.Get()
+	if err != nil {
+		t.Fatalf("Credentials.Get() returned unexpected error: %v", err)
+	}
+	if value.AccessKeyID != "AKIDEXAMPLE" || value.SecretAccessKey != secret {
+		t.Errorf("credentials = %s:%s; expected AKIDEXAMPLE:%s", value.AccessKeyID, value.SecretAccessKey, secret)
+	}
+}
+
+func TestClientConfigUserWithoutPassword(t *testing.T) {
+	specs := map[string]struct {
+		uri             string
+		userAsProfile   bool
+		expectedUser    *url.Userinfo
+		expectedProfile string
+	}{
+		"user only": {
+			"s3://AKIDEXAMPLE@apt-repo-bucket/dists/stable/Release", false, url.User("AKIDEXAMPLE"), "",
+		},
+		"user as profile": {
+			"s3://apt-reader@apt-repo-bucket/dists/stable/Release", true, nil, "apt-reader",
+		},
+		"user and password with user as profile": {
+			"s3://AKIDEXAMPLE:secret@apt-repo-bucket/dists/stable/Release", true,
+			url.UserPassword("AKIDEXAMPLE", "secret"), "",
+		},
+	}
+
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			f := New(Config{Region: "us-east-1", UserAsProfile: spec.userAsProfile})
+			loc, err := f.Locate(spec.uri)
+			if err != nil {
+				t.Fatalf("Locate(%s) returned unexpected error: %v", spec.uri, err)
+			}
+			cfg := f.ClientConfig(loc)
+			if cfg.User.String() != spec.expectedUser.String() || cfg.Profile != spec.expectedProfile {
+				t.Errorf("ClientConfig() = user %v, profile %q; expected user %v, profile %q",
+					cfg.User, cfg.Profile, spec.expectedUser, spec.expectedProfile)
+			}
+		})
+	}
+}
+
+func TestNewSessionMissingPassword(t *testing.T) {
+	_, _, err := NewSession(ClientConfig{Region: "us-east-1", User: url.User("AKIDEXAMPLE")})
+	if !errors.Is(err, ErrMissingPassword) {
+		t.Errorf("NewSession() = %v; expected %v", err, ErrMissingPassword)
+	}
+}
+
+func TestNewSessionDisableSSLAndAccelerate(t *testing.T) {
+	sess, config, err := NewSession(ClientConfig{
+		Region: "us-east-1", User: url.UserPassword("AKIDEXAMPLE", "secret"), DisableSSL: true, Accelerate: true,
+	})
+	if err != nil {
+		t.Fatalf("NewSession() returned unexpected error: %v", err)
+	}
+	if config.DisableSSL == nil || !*config.DisableSSL || config.S3UseAccelerate == nil || !*config.S3UseAccelerate {
+		t.Errorf("S3 config has DisableSSL %v, S3UseAccelerate %v; expected both true", config.DisableSSL, config.S3UseAccelerate)
+	}
+	// The session is shared with STS, which must still be asked over HTTPS.
+	if sess.Config.DisableSSL != nil && *sess.Config.DisableSSL {
+		t.Error("session config has DisableSSL; expected only the S3 config to")
+	}
+}
+
+func TestNewSessionProfile(t *testing.T) {
+	credentialsFile := filepath.Join(t.TempDir(), "credentials")
+	contents := "[apt-reader]\naws_access_key_id = AKIDEXAMPLE\naws_secret_access_key = secret\n"
+	if err := os.WriteFile(credentialsFile, []byte(contents), 0o600); err != nil {
+		t.Fatalf("failed to write credentials file: %v", err)
+	}
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", credentialsFile)
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+
+	sess, config, err := NewSession(ClientConfig{Region: "us-east-1", Profile: "apt-reader"})
+	if err != nil {
+		t.Fatalf("NewSession() returned unexpected error: %v", err)
+	}
+	if config.Credentials != nil {
+		t.Fatalf("NewSession() config has credentials; expected the session's to apply")
+	}
+	value, err := sess.Config.Credentials.Get()
+	if err != nil {
+		t.Fatalf("Credentials.Get() returned unexpected error: %v", err)
+	}
+	if value.AccessKeyID != "AKIDEXAMPLE" || value.SecretAccessKey != "secret" {
+		t.Errorf("credentials = %s:%s; expected AKIDEXAMPLE:secret", value.AccessKeyID, value.SecretAccessKey)
+	}
+}
+
+func TestNewSessionUndefinedProfile(t *testing.T) {
+	dir := t.TempDir()
+	credentialsFile, configFile := filepath.Join(dir, "credentials"), filepath.Join(dir, "config")
+	for file, contents := range map[string]string{
+		credentialsFile: "[apt-reader]\naws_access_key_id = AKIDEXAMPLE\naws_secret_access_key = secret\n",
+		configFile:      "[profile apt-admin]\nregion = eu-west-1\n",
+	} {
+		if err := os.WriteFile(file, []byte(contents), 0o600); err != nil {
+			t.Fatalf("failed to write %s: %v", file, err)
+		}
+	}
+
+	cfg := ClientConfig{Region: "us-east-1", SharedCredentialsFile: credentialsFile, SharedConfigFile: configFile}
+	for _, profile := range []string{"apt-reader", "apt-admin"} {
+		cfg.Profile = profile
+		if _, _, err := NewSession(cfg); err != nil {
+			t.Errorf("NewSession() with profile %s returned unexpected error: %v", profile, err)
+		}
+	}
+	cfg.Profile = "apt"
+	_, _, err := NewSession(cfg)
+	var notExists session.SharedConfigProfileNotExistsError
+	if !errors.As(err, &notExists) || notExists.Profile != "apt" {
+		t.Errorf("NewSession() with profile apt returned %v; expected the SDK's error for a profile that does not exist", err)
+	}
+	if !IsCredentialError(err) {
+		t.Errorf("IsCredentialError(%v) = false; expected true", err)
+	}
+}
+
+func TestS3ClientContainerCredentials(t *testing.T) {
+	expires := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	specs := map[string]struct {
+		token string
+	}{
+		"token file": {"pod-identity-token"},
+		"no token":   {""},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			var authorization string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				authorization = r.Header.Get("Authorization")
+				fmt.Fprintf(w, `{"AccessKeyId":"AKIDCONTAINER","SecretAccessKey":"secret","Token":"session","Expiration":%q}`,
+					expires.Format(time.RFC3339))
+			}))
+			defer server.Close()
+			t.Setenv("AWS_ACCESS_KEY_ID", "")
+			t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+			t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+			t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+			t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", server.URL)
+			t.Setenv("AWS_CONTAINER_AUTHORIZATION_TOKEN", "")
+			t.Setenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE", "")
+			if spec.token != "" {
+				tokenFile := filepath.Join(t.TempDir(), "token")
+				if err := os.WriteFile(tokenFile, []byte(spec.token), 0o600); err != nil {
+					t.Fatalf("failed to write token file: %v", err)
+				}
+				t.Setenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE", tokenFile)
+			}
+
+			client, err := NewS3Client(ClientConfig{Region: "us-east-1"})
+			if err != nil {
+				t.Fatalf("NewS3Client() returned unexpected error: %v", err)
+			}
+			if authorization != spec.token {
+				t.Errorf("Authorization header = %q; expected %q", authorization, spec.token)
+			}
+			info := credentialsInfo(client)
+			if !info.Container() {
+				t.Errorf("credentials provider = %q; expected container credentials", info.Provider)
+			}
+			if !info.Expires.Equal(expires.Add(-5 * time.Minute)) {
+				t.Errorf("credentials expire at %s; expected %s less the expiry window", info.Expires, expires)
+			}
+		})
+	}
+}
+
+func TestS3ClientAssumeRole(t *testing.T) {
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("failed to parse STS request: %v", err)
+		}
+		form = r.PostForm
+		if r.PostForm.Get("RoleArn") != "arn:aws:iam::123456789012:role/s3-apt-reader" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<ErrorResponse><Error><Type>Sender</Type><Code>AccessDenied</Code>`+
+				`<Message>not authorized</Message></Error><RequestId>id</RequestId></ErrorResponse>`)
+			return
+		}
+		fmt.Fprint(w, `<AssumeRoleResponse><AssumeRoleResult><Credentials>`+
+			`<AccessKeyId>AKIDROLE</AccessKeyId><SecretAccessKey>secret</SecretAccessKey>`+
+			`<SessionToken>session</SessionToken><Expiration>2024-01-01T12:00:00Z</Expiration>`+
+			`</Credentials></AssumeRoleResult></AssumeRoleResponse>`)
+	}))
+	defer server.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	cfg := ClientConfig{
+		Region:             "us-east-1",
+		RoleARN:            "arn:aws:iam::123456789012:role/s3-apt-reader",
+		RoleSourceIdentity: "build-runner",
+		STSEndpoint:        server.URL,
+	}
+	if _, err := NewS3Client(cfg); err != nil {
+		t.Fatalf("NewS3Client() returned unexpected error: %v", err)
+	}
+	if sourceIdentity := form.Get("SourceIdentity"); sourceIdentity != "build-runner" {
+		t.Errorf("SourceIdentity = %q; expected %q", sourceIdentity, "build-runner")
+	}
+
+	cfg.RoleARN = "arn:aws:iam::123456789012:role/other"
+	_, err := NewS3Client(cfg)
+	if err == nil {
+		t.Fatalf("NewS3Client() returned no error; expected the assumption to fail")
+	}
+	for _, expected := range []string{"AccessDenied", server.URL} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("NewS3Client() error %q does not contain %q", err, expected)
+		}
+	}
+}
+
+func TestS3ClientRoleCache(t *testing.T) {
+	assumed := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("failed to parse STS request: %v", err)
+		}
+		assumed[r.PostForm.Get("RoleArn")]++
+		fmt.Fprint(w, `<AssumeRoleResponse><AssumeRoleResult><Credentials>`+
+			`<AccessKeyId>AKIDROLE</AccessKeyId><SecretAccessKey>secret</SecretAccessKey>`+
+			`<SessionToken>session</SessionToken><Expiration>`+time.Now().Add(time.Hour).UTC().Format(time.RFC3339)+`</Expiration>`+
+			`</Credentials></AssumeRoleResult></AssumeRoleResponse>`)
+	}))
+	defer server.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	cache := NewRoleCache()
+	cfg := ClientConfig{Region: "us-east-1", STSEndpoint: server.URL, RoleCache: cache}
+	for _, role := range []string{"s3-apt-reader", "s3-apt-reader", "other", "s3-apt-reader"} {
+		cfg.RoleARN = "arn:aws:iam::123456789012:role/" + role
+		if _, err := NewS3Client(cfg); err != nil {
+			t.Fatalf("NewS3Client() returned unexpected error: %v", err)
+		}
+	}
+	expected := map[string]int{"arn:aws:iam::123456789012:role/s3-apt-reader": 1, "arn:aws:iam::123456789012:role/other": 1}
+	if diff := cmp.Diff(expected, assumed); diff != "" {
+		t.Errorf("roles assumed differ (-expected +actual):\n%s", diff)
+	}
+
+	cfg.RoleCache = nil
+	if _, err := NewS3Client(cfg); err != nil {
+		t.Fatalf("NewS3Client() returned unexpected error: %v", err)
+	}
+	if count := assumed[cfg.RoleARN]; count != 2 {
+		t.Errorf("%s was assumed %d times; expected it to be assumed again without a RoleCache", cfg.RoleARN, count)
+	}
+}
+
+func TestRoleCacheRefreshExpiring(t *testing.T) {
+	// The credentials of the role "short" expire within the hour, those of
+	// "long" do not.
+	assumed, failing := map[string]int{}, false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("failed to parse STS request: %v", err)
+		}
+		role := strings.TrimPrefix(r.PostForm.Get("RoleArn"), "arn:aws:iam::123456789012:role/")
+		assumed[role]++
+		if failing {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<ErrorResponse><Error><Code>AccessDenied</Code><Message>denied</Message></Error></ErrorResponse>`)
+			return
+		}
+		lifetime := 2 * time.Hour
+		if role == "short" {
+			lifetime = 10 * time.Minute
+		}
+		fmt.Fprint(w, `<AssumeRoleResponse><AssumeRoleResult><Credentials>`+
+			`<AccessKeyId>AKIDROLE</AccessKeyId><SecretAccessKey>secret</SecretAccessKey>`+
+			`<SessionToken>session</SessionToken><Expiration>`+time.Now().Add(lifetime).UTC().Format(time.RFC3339)+`</Expiration>`+
+			`</Credentials></AssumeRoleResult></AssumeRoleResponse>`)
+	}))
+	defer server.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	var cache *RoleCache
+	if refreshed, err := cache.RefreshExpiring(time.Now()); refreshed != 0 || err != nil {
+		t.Errorf("RefreshExpiring() = %d, %v on a nil RoleCache; expected 0, nil", refreshed, err)
+	}
+	cache = NewRoleCache()
+	cfg := ClientConfig{Region: "us-east-1", STSEndpoint: server.URL, RoleCache: cache}
+	for _, role := range []string{"short", "long"} {
+		cfg.RoleARN = "arn:aws:iam::123456789012:role/" + role
+		if _, err := NewS3Client(cfg); err != nil {
+			t.Fatalf("NewS3Client() returned unexpected error: %v", err)
+		}
+	}
+
+	refreshed, err := cache.RefreshExpiring(time.Now().Add(time.Hour))
+	if refreshed != 1 || err != nil {
+		t.Errorf("RefreshExpiring() = %d, %v; expected 1, nil", refreshed, err)
+	}
+	expected := map[string]int{"short": 2, "long": 1}
+	if diff := cmp.Diff(expected, assumed); diff != "" {
+		t.Errorf("roles assumed differ (-expected +actual):\n%s", diff)
+	}
+
+	failing = true
+	refreshed, err = cache.RefreshExpiring(time.Now().Add(time.Hour))
+	if refreshed != 0 || err == nil || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Errorf("RefreshExpiring() = %d, %v; expected 0 and the AccessDenied error", refreshed, err)
+	}
+}
+
+func TestS3ClientDisableIMDS(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", "")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "")
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "")
+
+	start := time.Now()
+	_, err := NewS3Client(ClientConfig{Region: "us-east-1", DisableIMDS: true})
+	elapsed := time.Since(start)
+	if err == nil {
+		t.Fatalf("NewS3Client() returned no error; expected no credentials to be found")
+	}
+	if elapsed > 100*time.Millisecond {
+		t.Errorf("NewS3Client() took %s to fail; expected less than 100ms", elapsed)
+	}
+	for _, expected := range []string{"EnvAccessKeyNotFound", "SharedCredsLoad", "Acquire::s3::disable-imds"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("NewS3Client() error %q does not name %q", err, expected)
+		}
+	}
+}
+
+func TestNewSessionCABundleLeavesDefaultClient(t *testing.T) {
+	certFile, _, _ := writeClientCert(t, t.TempDir(), "ca")
+	t.Setenv("AWS_CA_BUNDLE", certFile)
+
+	transports := NewTransportCache()
+	sessions := make([]*session.Session, 3)
+	for idx := range sessions {
+		cfg := ClientConfig{Region: "us-east-1", Transports: transports}
+		if idx == 2 {
+			cfg.TLSRestrictCiphers = true
+		}
+		sess, _, err := NewSession(cfg)
+		if err != nil {
+			t.Fatalf("NewSession() returned unexpected error: %v", err)
+		}
+		sessions[idx] = sess
+	}
+	if http.DefaultClient.Transport != nil {
+		t.Errorf("NewSession() set the transport of http.DefaultClient; expected the session to have a client of its own")
+	}
+	if sessions[0].Config.HTTPClient.Transport != sessions[1].Config.HTTPClient.Transport {
+		t.Errorf("NewSession() gave sessions with the same TLS settings transports of their own; expected them to share one")
+	}
+	if sessions[0].Config.HTTPClient.Transport == sessions[2].Config.HTTPClient.Transport {
+		t.Errorf("NewSession() shared a transport between sessions with different TLS settings; expected one for each")
+	}
+	transport, ok := sessions[0].Config.HTTPClient.Transport.(*http.Transport)
+	if !ok || transport.TLSClientConfig.RootCAs == nil {
+		t.Errorf("NewSession() made a transport that does not trust the CA bundle AWS_CA_BUNDLE names")
+	}
+}
+
+func TestSharedFiles(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("AWS_CONFIG_FILE", "/etc/aws/config")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", "")
+
+	cfg := ClientConfig{}
+	expected := []string{"/etc/aws/config", filepath.Join(home, ".aws", "credentials")}
+	if diff := cmp.Diff(expected, cfg.SharedFiles()); diff != "" {
+		t.Errorf("SharedFiles() mismatch (-want +got):\n%s", diff)
+	}
+
+	cfg = ClientConfig{SharedCredentialsFile: "/home/builder/.aws/credentials", SharedConfigFile: "/home/builder/.aws/config"}
+	expected = []string{"/home/builder/.aws/config", "/home/builder/.aws/credentials"}
+	if diff := cmp.Diff(expected, cfg.SharedFiles()); diff != "" {
+		t.Errorf("SharedFiles() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestNewSessionSharedCredentialsFile(t *testing.T) {
+	credentialsFile := filepath.Join(t.TempDir(), "credentials")
+	contents := "[apt-reader]\naws_access_key_id = AKIDEXAMPLE\naws_secret_access_key = secret\n"
+	if err := os.WriteFile(credentialsFile, []byte(contents), 0o600); err != nil {
+		t.Fatalf("failed to write credentials file: %v", err)
+	}
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", "")
+	t.Setenv("AWS_CONFIG_FILE", "")
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+
+	sess, _, err := NewSession(ClientConfig{
+		Region:                "us-east-1",
+		Profile:               "apt-reader",
+		SharedCredentialsFile: credentialsFile,
+	})
+	if err != nil {
+		t.Fatalf("NewSession() returned unexpected error: %v", err)
+	}
+	value, err := sess.Config.Credentials.Get()
+	if err != nil {
+		t.Fatalf("Credentials.Get() returned unexpected error: %v", err)
+	}
+	if value.AccessKeyID != "AKIDEXAMPLE" {
+		t.Errorf("credentials access key id = %s; expected AKIDEXAMPLE", value.AccessKeyID)
+	}
+}
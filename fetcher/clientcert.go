@@ -0,0 +1,81 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ErrClientCert is returned when the client certificate presented to a custom
+// endpoint cannot be loaded.
+var ErrClientCert = errors.New("cannot load the client certificate")
+
+// clientCertTLSConfig returns a copy of tlsConfig presenting the certificate
+// in certFile, with the private key in keyFile or, like apt's
+// Acquire::https::SslCert, in certFile as well when keyFile is empty.
+func clientCertTLSConfig(certFile, keyFile string, tlsConfig *tls.Config) (*tls.Config, error) {
+	if keyFile == "" {
+		keyFile = certFile
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s with the key in %s: %w", ErrClientCert, certFile, keyFile, err)
+	}
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.Certificates = []tls.Certificate{pair}
+	return tlsConfig, nil
+}
+
+// applyCABundle makes tlsConfig trust the CA bundle AWS_CA_BUNDLE names, if
+// set, in addition to the system's certificates.
+func applyCABundle(tlsConfig *tls.Config) error {
+	bundle := os.Getenv("AWS_CA_BUNDLE")
+	if bundle == "" {
+		return nil
+	}
+	pem, err := os.ReadFile(bundle)
+	if err != nil {
+		return fmt.Errorf("reading the CA bundle AWS_CA_BUNDLE names: %w", err)
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("the CA bundle %s AWS_CA_BUNDLE names holds no certificate", bundle)
+	}
+	tlsConfig.RootCAs = roots
+	return nil
+}
+
+// isAWSEndpoint tells whether the endpoint is a host of AWS, which client
+// certificates are never presented to.
+func isAWSEndpoint(endpoint string) bool {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return true
+	}
+	host := strings.ToLower(parsed.Hostname())
+	return host == "amazonaws.com" || strings.HasSuffix(host, ".amazonaws.com") || strings.HasSuffix(host, ".amazonaws.com.cn")
+}
@@ -0,0 +1,180 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// writeClientCert writes a self-signed client certificate and its key as PEM
+// files to dir and returns their paths along with the certificate.
+func writeClientCert(t *testing.T, dir, name string) (string, string, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	for file, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := os.WriteFile(file, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return certFile, keyFile, cert
+}
+
+func TestNewSessionClientCert(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, _ := writeClientCert(t, dir, "apt")
+	_, otherKeyFile, _ := writeClientCert(t, dir, "other")
+
+	specs := map[string]struct {
+		endpoint, certFile, keyFile string
+		expectClient                bool
+		expectedErr                 string
+	}{
+		"custom endpoint":         {"https://gateway.internal", certFile, keyFile, true, ""},
+		"endpoint without scheme": {"gateway.internal:9000", certFile, keyFile, true, ""},
+		"AWS endpoint":            {"https://s3.eu-west-1.amazonaws.com", certFile, keyFile, false, ""},
+		"no endpoint":             {"", certFile, keyFile, false, ""},
+		"mismatched key": {
+			"https://gateway.internal", certFile, otherKeyFile, false,
+			"cannot load the client certificate " + certFile + " with the key in " + otherKeyFile + ": ",
+		},
+		"missing file": {
+			"https://gateway.internal", filepath.Join(dir, "missing.crt"), "", false,
+			"cannot load the client certificate " + filepath.Join(dir, "missing.crt") + " with the key in " +
+				filepath.Join(dir, "missing.crt") + ": open ",
+		},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			_, config, err := NewSession(ClientConfig{
+				Region: "us-east-1", Endpoint: spec.endpoint, SSLCert: spec.certFile, SSLKey: spec.keyFile,
+			})
+			if spec.expectedErr != "" {
+				if !errors.Is(err, ErrClientCert) || !strings.Contains(err.Error(), spec.expectedErr) {
+					t.Errorf("NewSession() returned %v; expected an error containing %q", err, spec.expectedErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewSession() returned unexpected error: %v", err)
+			}
+			if (config.HTTPClient != nil) != spec.expectClient {
+				t.Errorf("NewSession() set HTTPClient %v; expected one presenting the certificate: %t", config.HTTPClient, spec.expectClient)
+			}
+		})
+	}
+}
+
+func TestS3ClientPresentsClientCert(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, cert := writeClientCert(t, dir, "apt")
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+	var presented string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented = r.TLS.PeerCertificates[0].Subject.CommonName
+		w.Header().Set("Content-Length", "5")
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs, MinVersion: tls.VersionTLS12}
+	server.StartTLS()
+	defer server.Close()
+	// The server's certificate is trusted through the SDK's CA bundle
+	// variable, which has to keep working along with the client certificate.
+	bundle := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_CA_BUNDLE", bundle)
+
+	client, err := NewS3Client(ClientConfig{
+		Region:    "us-east-1",
+		Endpoint:  server.URL,
+		PathStyle: true,
+		User:      url.UserPassword("fake-access-key-id", "fake-secret-access-key"),
+		SSLCert:   certFile,
+		SSLKey:    keyFile,
+	})
+	if err != nil {
+		t.Fatalf("NewS3Client() returned unexpected error: %v", err)
+	}
+	if _, err := client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String("bucket"), Key: aws.String("key")}); err != nil {
+		t.Fatalf("HeadObject() returned unexpected error: %v", err)
+	}
+	if presented != "apt" {
+		t.Errorf("the server saw client certificate %q; expected %q", presented, "apt")
+	}
+}
+
+func TestClientConfigClientCertForConfiguredEndpointOnly(t *testing.T) {
+	f := New(Config{
+		Region:            "us-east-1",
+		Endpoint:          "https://gateway.internal",
+		FallbackEndpoints: []string{"https://replica.internal"},
+		SSLCert:           "/etc/apt/s3.crt",
+		SSLKey:            "/etc/apt/s3.key",
+	})
+	loc := Location{URI: &url.URL{Scheme: "s3", Host: "bucket", Path: "/key"}, Bucket: "bucket", Key: "key"}
+
+	if cfg := f.clientConfig(loc, f.cfg.Endpoint); cfg.SSLCert != "/etc/apt/s3.crt" || cfg.SSLKey != "/etc/apt/s3.key" {
+		t.Errorf("clientConfig() for the configured endpoint = %+v; expected the client certificate", cfg)
+	}
+	if cfg := f.clientConfig(loc, "https://replica.internal"); cfg.SSLCert != "" || cfg.SSLKey != "" {
+		t.Errorf("clientConfig() for a fallback endpoint = %+v; expected no client certificate", cfg)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+const errCodeRequestTimeTooSkewed = "RequestTimeTooSkewed"
+
+// ClockSkewThreshold is how far the local clock may be from S3's before a
+// ClockOffset corrects for it. Lesser skews are within what the one second
+// resolution of the Date header and the time responses take can account for.
+const ClockSkewThreshold = 30 * time.Second
+
+// A ClockOffset holds how far S3's clock is ahead of the local one, as the
+// Date header of the first HeadObject response of any fetch tells, if that is
+// more than ClockSkewThreshold. Local times are corrected by it where they are
+// compared with times S3 gave. It is safe for concurrent use, and a nil
+// ClockOffset measures and corrects nothing.
+type ClockOffset struct {
+	once   sync.Once
+	offset atomic.Int64
+}
+
+// NewClockOffset returns a ClockOffset that has not measured anything yet.
+func NewClockOffset() *ClockOffset {
+	return &ClockOffset{}
+}
+
+// measure records how far serverTime is ahead of now, unless a measurement
+// was recorded before or serverTime is the zero time. It returns the skew and
+// whether it was recorded as the offset, which it is only if it is more than
+// ClockSkewThreshold.
+func (c *ClockOffset) measure(serverTime, now time.Time) (time.Duration, bool) {
+	if c == nil || serverTime.IsZero() {
+		return 0, false
+	}
+	skew, recorded := serverTime.Sub(now), false
+	c.once.Do(func() {
+		if skew.Abs() > ClockSkewThreshold {
+			c.offset.Store(int64(skew))
+			recorded = true
+		}
+	})
+	return skew, recorded
+}
+
+// Offset returns how far S3's clock is ahead of the local one, negative if it
+// is behind, or zero if no skew beyond ClockSkewThreshold was measured.
+func (c *ClockOffset) Offset() time.Duration {
+	if c == nil {
+		return 0
+	}
+	return time.Duration(c.offset.Load())
+}
+
+// ServerTime returns the local time now as S3's clock tells it.
+func (c *ClockOffset) ServerTime(now time.Time) time.Time {
+	return now.Add(c.Offset())
+}
+
+// A ClockSkewError is the error S3 answers requests with that were signed at
+// a time too far from its own. It carries S3's time, as the Date header of
+// the response gives it.
+type ClockSkewError struct {
+	awserr.RequestFailure
+	// ServerTime is the zero time if the response had no valid Date header.
+	ServerTime time.Time
+}
+
+func (e *ClockSkewError) Unwrap() error {
+	return e.RequestFailure
+}
+
+// recordServerTime is an UnmarshalError handler that turns RequestTimeTooSkewed
+// errors into ClockSkewErrors, since the time S3 reports is only known while
+// the response is at hand.
+func recordServerTime(r *request.Request) {
+	var reqErr awserr.RequestFailure
+	if r.HTTPResponse == nil || !errors.As(r.Error, &reqErr) || reqErr.Code() != errCodeRequestTimeTooSkewed {
+		return
+	}
+	serverTime, _ := http.ParseTime(r.HTTPResponse.Header.Get("Date"))
+	r.Error = &ClockSkewError{RequestFailure: reqErr, ServerTime: serverTime}
+}
@@ -0,0 +1,134 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+)
+
+func TestS3ClientClockSkew(t *testing.T) {
+	serverTime := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", serverTime.Format(http.TimeFormat))
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<Error><Code>RequestTimeTooSkewed</Code>`+
+			`<Message>The difference between the request time and the current time is too large.</Message>`+
+			`<RequestId>id</RequestId></Error>`)
+	}))
+	defer server.Close()
+
+	client, err := NewS3Client(ClientConfig{
+		Region: "us-east-1", Endpoint: server.URL, PathStyle: true, User: url.UserPassword("AKIDEXAMPLE", "secret"),
+	})
+	if err != nil {
+		t.Fatalf("NewS3Client() returned unexpected error: %v", err)
+	}
+	_, err = client.GetObject(&s3.GetObjectInput{Bucket: aws.String("apt-repo-bucket"), Key: aws.String("dists/stable/Release")})
+
+	var skewErr *ClockSkewError
+	if !errors.As(err, &skewErr) {
+		t.Fatalf("GetObject() = %v; expected a ClockSkewError", err)
+	}
+	if !skewErr.ServerTime.Equal(serverTime) {
+		t.Errorf("ServerTime = %s; expected %s", skewErr.ServerTime, serverTime)
+	}
+	if skewErr.Code() != "RequestTimeTooSkewed" || skewErr.StatusCode() != http.StatusForbidden {
+		t.Errorf("GetObject() = %v; expected RequestTimeTooSkewed with HTTP 403", err)
+	}
+}
+
+func TestClockOffset(t *testing.T) {
+	now := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	for name, tc := range map[string]struct {
+		serverTimes []time.Time
+		expected    time.Duration
+	}{
+		"none":             {},
+		"zero time":        {serverTimes: []time.Time{{}, now.Add(time.Hour)}, expected: time.Hour},
+		"below threshold":  {serverTimes: []time.Time{now.Add(ClockSkewThreshold), now.Add(time.Hour)}},
+		"ahead":            {serverTimes: []time.Time{now.Add(5 * time.Minute)}, expected: 5 * time.Minute},
+		"behind":           {serverTimes: []time.Time{now.Add(-5 * time.Minute)}, expected: -5 * time.Minute},
+		"first recorded":   {serverTimes: []time.Time{now.Add(time.Hour), now.Add(2 * time.Hour)}, expected: time.Hour},
+		"behind then near": {serverTimes: []time.Time{now.Add(-time.Hour), now}, expected: -time.Hour},
+	} {
+		t.Run(name, func(t *testing.T) {
+			offset := NewClockOffset()
+			for _, serverTime := range tc.serverTimes {
+				offset.measure(serverTime, now)
+			}
+			if actual := offset.Offset(); actual != tc.expected {
+				t.Errorf("Offset() = %s; expected %s", actual, tc.expected)
+			}
+			if actual, expected := offset.ServerTime(now), now.Add(tc.expected); !actual.Equal(expected) {
+				t.Errorf("ServerTime() = %s; expected %s", actual, expected)
+			}
+		})
+	}
+}
+
+func TestNilClockOffset(t *testing.T) {
+	var offset *ClockOffset
+	now := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	if _, recorded := offset.measure(now.Add(time.Hour), now); recorded {
+		t.Error("measure() on a nil ClockOffset recorded a skew")
+	}
+	if actual := offset.ServerTime(now); !actual.Equal(now) {
+		t.Errorf("ServerTime() = %s; expected %s", actual, now)
+	}
+}
+
+func TestFetchClockSkew(t *testing.T) {
+	now := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	fake := testutil.NewFakeS3()
+	fake.Date = now.Add(-10 * time.Minute)
+	fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	offset := NewClockOffset()
+	f := New(Config{Region: "us-east-1", ClockOffset: offset}, WithClock(testutil.NewFakeClock(now)),
+		WithS3ClientFactory(func(ClientConfig) (s3iface.S3API, error) {
+			return fake, nil
+		}))
+
+	var skews []time.Duration
+	for i := range 2 {
+		req := FetchRequest{
+			URI:         testURI,
+			Filename:    filepath.Join(t.TempDir(), fmt.Sprintf("hello-%d.deb", i)),
+			OnClockSkew: func(skew time.Duration) { skews = append(skews, skew) },
+		}
+		if _, err := f.Fetch(context.Background(), req); err != nil {
+			t.Fatalf("Fetch() returned unexpected error: %v", err)
+		}
+	}
+	if len(skews) != 1 || skews[0] != -10*time.Minute {
+		t.Errorf("OnClockSkew called with %v; expected once with -10m0s", skews)
+	}
+	if actual := offset.Offset(); actual != -10*time.Minute {
+		t.Errorf("Offset() = %s; expected -10m0s", actual)
+	}
+}
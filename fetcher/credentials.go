@@ -0,0 +1,142 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// A CredentialSource names where the credentials of a fetch come from.
+type CredentialSource string
+
+// The CredentialSources in the order of their precedence.
+const (
+	CredentialSourceURI         CredentialSource = "the access key of the URI or auth.conf"
+	CredentialSourceRole        CredentialSource = "the role of Acquire::s3::role"
+	CredentialSourceProfile     CredentialSource = "the profile of the URI"
+	CredentialSourceEnv         CredentialSource = "the access key of AWS_ACCESS_KEY_ID"
+	CredentialSourceWebIdentity CredentialSource = "the web identity token of AWS_WEB_IDENTITY_TOKEN_FILE"
+	CredentialSourceEnvProfile  CredentialSource = "the profile of AWS_PROFILE"
+	CredentialSourceContainer   CredentialSource = "the container credentials endpoint"
+	CredentialSourceDefault     CredentialSource = "the default profile or instance role"
+)
+
+// A CredentialSelection tells which CredentialSource a fetch takes its
+// credentials from and which other available sources it ignores.
+type CredentialSelection struct {
+	Used    CredentialSource
+	Ignored []CredentialSource
+}
+
+// SelectCredentials decides where the credentials for cfg come from. Static
+// credentials of the URI win over an assumed role, which wins over a profile
+// named in the URI. Otherwise the AWS SDK's default chain applies, with the
+// sources it considers in order of its precedence. An assumed role takes its
+// own credentials from that chain, so none of its sources are ignored then.
+func SelectCredentials(cfg ClientConfig) CredentialSelection {
+	available := []CredentialSource{}
+	if cfg.User.Username() != "" {
+		available = append(available, CredentialSourceURI)
+	}
+	if cfg.RoleARN != "" {
+		available = append(available, CredentialSourceRole)
+	}
+	if cfg.Profile != "" {
+		available = append(available, CredentialSourceProfile)
+	}
+	chainStart := len(available)
+	for _, env := range []struct {
+		source CredentialSource
+		vars   []string
+	}{
+		{CredentialSourceEnv, []string{"AWS_ACCESS_KEY_ID"}},
+		{CredentialSourceWebIdentity, []string{"AWS_WEB_IDENTITY_TOKEN_FILE"}},
+		{CredentialSourceEnvProfile, []string{"AWS_PROFILE"}},
+		{CredentialSourceContainer, []string{
+			"AWS_CONTAINER_CREDENTIALS_FULL_URI", "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI",
+		}},
+	} {
+		for _, name := range env.vars {
+			if os.Getenv(name) != "" {
+				available = append(available, env.source)
+				break
+			}
+		}
+	}
+
+	if len(available) == 0 {
+		return CredentialSelection{Used: CredentialSourceDefault}
+	}
+	selection := CredentialSelection{Used: available[0], Ignored: available[1:]}
+	if selection.Used == CredentialSourceRole {
+		selection.Ignored = available[1:chainStart]
+	}
+	if len(selection.Ignored) == 0 {
+		selection.Ignored = nil
+	}
+	return selection
+}
+
+// DescribeCredentials tells where the credentials for cfg come from, as
+// SelectCredentials decides, for the debug output and failure messages.
+// Access key IDs are cut to their first four characters, and secrets and
+// session tokens are never included.
+func DescribeCredentials(cfg ClientConfig) string {
+	switch source := SelectCredentials(cfg).Used; source {
+	case CredentialSourceURI:
+		return "static credentials of the URI or auth.conf, access key " + partialKeyID(cfg.User.Username())
+	case CredentialSourceRole:
+		chain := cfg
+		chain.RoleARN = ""
+		return fmt.Sprintf("assumed role %s via %s", cfg.RoleARN, DescribeCredentials(chain))
+	case CredentialSourceProfile:
+		return fmt.Sprintf("shared profile '%s'", cfg.Profile)
+	case CredentialSourceEnv:
+		return "static credentials of AWS_ACCESS_KEY_ID, access key " + partialKeyID(os.Getenv("AWS_ACCESS_KEY_ID"))
+	case CredentialSourceEnvProfile:
+		return fmt.Sprintf("shared profile '%s' of AWS_PROFILE", os.Getenv("AWS_PROFILE"))
+	default:
+		return string(source)
+	}
+}
+
+// partialKeyID returns the first four characters of an access key ID, which
+// tell its kind and help telling keys apart without disclosing them.
+func partialKeyID(keyID string) string {
+	return keyID[:min(len(keyID), 4)] + "..."
+}
+
+// IsCredentialError tells whether err stems from the credentials a request was
+// signed with: there were none, they expired, or S3 rejected them.
+func IsCredentialError(err error) bool {
+	if errors.Is(err, ErrCredentialsExpired) {
+		return true
+	}
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return false
+	}
+	switch awsErr.Code() {
+	case "NoCredentialProviders", "ExpiredToken", "ExpiredTokenException", "TokenRefreshRequired", "InvalidToken",
+		"AccessDenied", "Forbidden", "InvalidAccessKeyId", "SignatureDoesNotMatch", "SharedConfigProfileNotExistsError":
+		return true
+	default:
+		return false
+	}
+}
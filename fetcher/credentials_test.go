@@ -0,0 +1,268 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+)
+
+func TestSelectCredentials(t *testing.T) {
+	specs := map[string]struct {
+		cfg      ClientConfig
+		env      map[string]string
+		expected CredentialSelection
+	}{
+		"nothing": {
+			cfg:      ClientConfig{},
+			expected: CredentialSelection{Used: CredentialSourceDefault},
+		},
+		"uri and role": {
+			cfg: ClientConfig{User: url.UserPassword("AKIDEXAMPLE", "secret"), RoleARN: "arn:aws:iam::123456789012:role/r"},
+			expected: CredentialSelection{
+				Used:    CredentialSourceURI,
+				Ignored: []CredentialSource{CredentialSourceRole},
+			},
+		},
+		"uri and environment": {
+			cfg: ClientConfig{User: url.UserPassword("AKIDEXAMPLE", "secret")},
+			env: map[string]string{"AWS_ACCESS_KEY_ID": "AKIDENV"},
+			expected: CredentialSelection{
+				Used:    CredentialSourceURI,
+				Ignored: []CredentialSource{CredentialSourceEnv},
+			},
+		},
+		"role and environment": {
+			cfg:      ClientConfig{RoleARN: "arn:aws:iam::123456789012:role/r"},
+			env:      map[string]string{"AWS_ACCESS_KEY_ID": "AKIDENV"},
+			expected: CredentialSelection{Used: CredentialSourceRole},
+		},
+		"profile and environment": {
+			cfg: ClientConfig{Profile: "apt-reader"},
+			env: map[string]string{"AWS_ACCESS_KEY_ID": "AKIDENV", "AWS_PROFILE": "other"},
+			expected: CredentialSelection{
+				Used:    CredentialSourceProfile,
+				Ignored: []CredentialSource{CredentialSourceEnv, CredentialSourceEnvProfile},
+			},
+		},
+		"environment and container": {
+			cfg: ClientConfig{},
+			env: map[string]string{"AWS_ACCESS_KEY_ID": "AKIDENV", "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI": "/v2/creds"},
+			expected: CredentialSelection{
+				Used:    CredentialSourceEnv,
+				Ignored: []CredentialSource{CredentialSourceContainer},
+			},
+		},
+		"container": {
+			cfg:      ClientConfig{},
+			env:      map[string]string{"AWS_CONTAINER_CREDENTIALS_FULL_URI": "http://169.254.170.23/v1/credentials"},
+			expected: CredentialSelection{Used: CredentialSourceContainer},
+		},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			for _, name := range []string{
+				"AWS_ACCESS_KEY_ID", "AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_PROFILE",
+				"AWS_CONTAINER_CREDENTIALS_FULL_URI", "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI",
+			} {
+				t.Setenv(name, spec.env[name])
+			}
+			if diff := cmp.Diff(spec.expected, SelectCredentials(spec.cfg)); diff != "" {
+				t.Errorf("SelectCredentials() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDescribeCredentials(t *testing.T) {
+	role := "arn:aws:iam::123456789012:role/apt-reader"
+	specs := map[string]struct {
+		cfg      ClientConfig
+		env      map[string]string
+		expected string
+	}{
+		"uri": {
+			cfg:      ClientConfig{User: url.UserPassword("AKIDEXAMPLE", "secret")},
+			expected: "static credentials of the URI or auth.conf, access key AKID...",
+		},
+		"role via profile": {
+			cfg:      ClientConfig{RoleARN: role, Profile: "prod"},
+			expected: "assumed role " + role + " via shared profile 'prod'",
+		},
+		"role via default chain": {
+			cfg:      ClientConfig{RoleARN: role},
+			expected: "assumed role " + role + " via the default profile or instance role",
+		},
+		"environment": {
+			env:      map[string]string{"AWS_ACCESS_KEY_ID": "ASIAENVEXAMPLE", "AWS_SECRET_ACCESS_KEY": "secret"},
+			expected: "static credentials of AWS_ACCESS_KEY_ID, access key ASIA...",
+		},
+		"environment profile": {
+			env:      map[string]string{"AWS_PROFILE": "staging"},
+			expected: "shared profile 'staging' of AWS_PROFILE",
+		},
+		"container": {
+			env:      map[string]string{"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI": "/v2/creds"},
+			expected: "the container credentials endpoint",
+		},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			for _, name := range []string{
+				"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_PROFILE",
+				"AWS_CONTAINER_CREDENTIALS_FULL_URI", "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI",
+			} {
+				t.Setenv(name, spec.env[name])
+			}
+			if actual := DescribeCredentials(spec.cfg); actual != spec.expected {
+				t.Errorf("DescribeCredentials() = %q; expected %q", actual, spec.expected)
+			}
+		})
+	}
+}
+
+func TestIsCredentialError(t *testing.T) {
+	specs := map[string]struct {
+		err      error
+		expected bool
+	}{
+		"no providers": {awserr.New("NoCredentialProviders", "no valid providers in chain", nil), true},
+		"access denied": {
+			requestError("GetObject", Location{Bucket: "b", Key: "k"},
+				awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), http.StatusForbidden, "id")),
+			true,
+		},
+		"expired":   {ErrCredentialsExpired, true},
+		"not found": {awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), http.StatusNotFound, "id"), false},
+		"other":     {errors.New("connection reset by peer"), false},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			if actual := IsCredentialError(spec.err); actual != spec.expected {
+				t.Errorf("IsCredentialError(%v) = %t; expected %t", spec.err, actual, spec.expected)
+			}
+		})
+	}
+}
+
+// An expiringProvider hands out credentials that expire after the next of
+// its lifetimes, counting how often they were retrieved.
+type expiringProvider struct {
+	credentials.Expiry
+	lifetimes []time.Duration
+	retrieved int
+}
+
+func (p *expiringProvider) Retrieve() (credentials.Value, error) {
+	lifetime := p.lifetimes[min(p.retrieved, len(p.lifetimes)-1)]
+	p.retrieved++
+	p.SetExpiration(time.Now().Add(lifetime), 0)
+	return credentials.Value{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret", ProviderName: "expiringProvider"}, nil
+}
+
+func TestFetchRefreshesCredentials(t *testing.T) {
+	expiredToken := awserr.NewRequestFailure(
+		awserr.New("ExpiredToken", "The provided token has expired.", nil), http.StatusBadRequest, "id")
+	specs := map[string]struct {
+		lifetimes         []time.Duration
+		getErr            error
+		expectedRetrieved int
+		expectedReasons   []string
+	}{
+		"long-lived": {
+			lifetimes:         []time.Duration{time.Hour},
+			expectedRetrieved: 1,
+		},
+		"about to expire": {
+			lifetimes:         []time.Duration{30 * time.Second, time.Hour},
+			expectedRetrieved: 2,
+			expectedReasons:   []string{"they would likely expire during the download"},
+		},
+		"expired during the download": {
+			lifetimes:         []time.Duration{time.Hour},
+			getErr:            expiredToken,
+			expectedRetrieved: 2,
+			expectedReasons:   []string{"S3 reported them expired"},
+		},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			provider := &expiringProvider{lifetimes: spec.lifetimes}
+			fake := testutil.NewFakeS3()
+			fake.Creds = credentials.NewCredentials(provider)
+			if _, err := fake.Creds.Get(); err != nil {
+				t.Fatalf("Credentials.Get() returned unexpected error: %v", err)
+			}
+			fake.GetErrOnce = spec.getErr
+			fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+			f := New(Config{Region: "us-east-1"}, WithS3ClientFactory(func(ClientConfig) (s3iface.S3API, error) {
+				return fake, nil
+			}))
+
+			var reasons []string
+			_, err := f.Fetch(context.Background(), FetchRequest{
+				URI:      testURI,
+				Filename: filepath.Join(t.TempDir(), "hello.deb"),
+				OnCredentialsRefresh: func(reason string, info CredentialsInfo) {
+					reasons = append(reasons, reason)
+					if !info.Expires.After(time.Now().Add(30 * time.Minute)) {
+						t.Errorf("refreshed credentials expire at %s; expected in an hour", info.Expires)
+					}
+				},
+			})
+			if err != nil {
+				t.Fatalf("Fetch() returned unexpected error: %v", err)
+			}
+			if provider.retrieved != spec.expectedRetrieved {
+				t.Errorf("credentials retrieved %d times; expected %d", provider.retrieved, spec.expectedRetrieved)
+			}
+			if diff := cmp.Diff(spec.expectedReasons, reasons); diff != "" {
+				t.Errorf("refresh reasons mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFetchCredentialsExpiredAfterRefresh(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Creds = credentials.NewCredentials(&expiringProvider{lifetimes: []time.Duration{time.Hour}})
+	fake.GetErr = awserr.NewRequestFailure(
+		awserr.New("ExpiredToken", "The provided token has expired.", nil), http.StatusBadRequest, "id")
+	fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	f := New(Config{Region: "us-east-1"}, WithS3ClientFactory(func(ClientConfig) (s3iface.S3API, error) {
+		return fake, nil
+	}))
+
+	_, err := f.Fetch(context.Background(), FetchRequest{URI: testURI, Filename: filepath.Join(t.TempDir(), "hello.deb")})
+	if !errors.Is(err, ErrCredentialsExpired) {
+		t.Errorf("Fetch() returned error %v; expected %v", err, ErrCredentialsExpired)
+	}
+	if gets := fake.Gets(); gets != 2 {
+		t.Errorf("GetObject called %d times; expected twice", gets)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/aws/aws-sdk-go/service/s3/s3crypto"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// ErrDecrypt is returned by Fetch when an object stored with client-side
+// encryption could not be decrypted. The error names the KMS key involved.
+var ErrDecrypt = errors.New("failed to decrypt the object")
+
+// The metadata the S3 encryption client stores the envelope of an encrypted
+// object in, as HeadObject reports it.
+const (
+	metaKeyV1                = "X-Amz-Key"
+	metaKeyV2                = "X-Amz-Key-V2"
+	metaMatDesc              = "X-Amz-Matdesc"
+	metaUnencryptedLength    = "X-Amz-Unencrypted-Content-Length"
+	matDescKMSKeyID          = "kms_cmk_id"
+	unknownKMSKeyDescription = "named in the object's envelope"
+)
+
+// recordEnvelope marks result as Decrypted if metadata, as HeadObject reported
+// it, carries a client-side encryption envelope. Its size then becomes that of
+// the plaintext, or -1 if the envelope does not tell, and its KMSKeyID the key
+// the Config or the envelope names. The content encoding of encrypted objects
+// applies to their ciphertext, so they are not Decoded. Other objects are left
+// untouched.
+func (f *Fetcher) recordEnvelope(metadata map[string]*string, result *FetchResult) {
+	if metaValue(metadata, metaKeyV2) == "" && metaValue(metadata, metaKeyV1) == "" {
+		return
+	}
+	result.Decrypted, result.Decoded = true, false
+	result.Size, result.KMSKeyID = -1, f.cfg.CSEKMSKeyID
+	if size, err := strconv.ParseInt(metaValue(metadata, metaUnencryptedLength), 10, 64); err == nil && size >= 0 {
+		result.Size = size
+	}
+	var matDesc map[string]string
+	if json.Unmarshal([]byte(metaValue(metadata, metaMatDesc)), &matDesc) == nil && result.KMSKeyID == "" {
+		result.KMSKeyID = matDesc[matDescKMSKeyID]
+	}
+}
+
+// metaValue returns the value of the named user metadata, whose keys S3
+// clients canonicalize differently, or "" if there is none.
+func metaValue(metadata map[string]*string, name string) string {
+	for key, value := range metadata {
+		if strings.EqualFold(key, name) {
+			return aws.StringValue(value)
+		}
+	}
+	return ""
+}
+
+// kmsClient creates the KMS client data keys of encrypted objects are
+// decrypted with.
+func kmsClient(p client.ConfigProvider, cfgs ...*aws.Config) kmsiface.KMSAPI {
+	return kms.New(p, cfgs...)
+}
+
+// downloadDecrypted writes the decrypted content of the object at loc, which
+// is stored with client-side encryption, to the file of req and records its
+// plaintext size in result. The object is decrypted while it is streamed in a
+// single request, as its authentication tag covers all of it. Decryption
+// failures name the KMS key recorded in result. The file is closed, and synced
+// if the Config asks for it, before downloadDecrypted returns successfully.
+func (f *Fetcher) downloadDecrypted(
+	ctx context.Context, client s3iface.S3API, loc Location, req FetchRequest, result *FetchResult,
+) error {
+	keyID := result.KMSKeyID
+	if keyID == "" {
+		keyID = unknownKMSKeyDescription
+	}
+	decrypter, err := f.decryptionClient(client, loc)
+	if err != nil {
+		return fmt.Errorf("%w s3://%s/%s with KMS key %s: %w", ErrDecrypt, loc.Bucket, loc.Key, keyID, err)
+	}
+
+	file, err := f.createSizedFile(req.Filename, result.Size)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	result.Timings.PartSize, result.Timings.Concurrency = 0, 1
+	writer := &firstByteWriterAt{WriterAt: file, now: f.clock.Now, onProgress: req.OnProgress}
+	start := f.clock.Now()
+	var numBytes int64
+	output, err := decrypter.GetObjectWithContext(ctx, getObjectInput(loc, result.ETag))
+	if err == nil {
+		defer output.Body.Close()
+		numBytes, err = copyBuffered(io.NewOffsetWriter(writer, 0), output.Body)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		if diskErr := diskError(err); errors.Is(diskErr, ErrWriteFile) {
+			return diskErr
+		}
+		return fmt.Errorf("%w s3://%s/%s with KMS key %s: %w", ErrDecrypt, loc.Bucket, loc.Key, keyID, err)
+	}
+	result.Timings.Transfer = f.since(start)
+	result.Timings.FirstByte = writer.sinceStart(start)
+	switch {
+	case result.Size < 0:
+		result.Size = numBytes
+	case numBytes != result.Size:
+		return fmt.Errorf("%w: got %d bytes, expected %d", ErrSizeMismatch, numBytes, result.Size)
+	}
+	return f.closeFile(file)
+}
+
+// decryptionClient creates an S3 encryption client that gets objects through
+// client and decrypts their data keys with KMS, using the same credentials as
+// client. Only the Config's CSEKMSKeyID is accepted if it is set, and any key
+// otherwise. KMS is asked in the region of the key if CSEKMSKeyID is an ARN.
+func (f *Fetcher) decryptionClient(client s3iface.S3API, loc Location) (*s3crypto.DecryptionClientV2, error) {
+	config := &aws.Config{Region: aws.String(f.cfg.Region), Credentials: clientCredentials(client)}
+	if loc.Region != "" {
+		config.Region = aws.String(loc.Region)
+	}
+	if keyARN, err := arn.Parse(f.cfg.CSEKMSKeyID); err == nil && keyARN.Region != "" {
+		config.Region = aws.String(keyARN.Region)
+	}
+	// As in NewSession, the SDK is given an HTTP client of its own to apply
+	// AWS_CA_BUNDLE to, rather than http.DefaultClient, and KMS is then asked
+	// through the shared transports.
+	config.HTTPClient = &http.Client{}
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, err
+	}
+	if sess.Config.HTTPClient, err = f.cfg.Transports.client(f.ClientConfig(loc), false); err != nil {
+		return nil, err
+	}
+	kmsAPI := f.newKMSClient(sess)
+
+	registry := s3crypto.NewCryptoRegistry()
+	if f.cfg.CSEKMSKeyID != "" {
+		err = errors.Join(
+			s3crypto.RegisterKMSContextWrapWithCMK(registry, kmsAPI, f.cfg.CSEKMSKeyID),
+			s3crypto.RegisterKMSWrapWithCMK(registry, kmsAPI, f.cfg.CSEKMSKeyID))
+	} else {
+		err = errors.Join(
+			s3crypto.RegisterKMSContextWrapWithAnyCMK(registry, kmsAPI),
+			s3crypto.RegisterKMSWrapWithAnyCMK(registry, kmsAPI))
+	}
+	err = errors.Join(err,
+		s3crypto.RegisterAESGCMContentCipher(registry),
+		s3crypto.RegisterAESCBCContentCipher(registry, s3crypto.AESCBCPadder))
+	if err != nil {
+		return nil, err
+	}
+	return s3crypto.NewDecryptionClientV2(sess, registry, func(options *s3crypto.DecryptionClientOptions) {
+		options.S3Client = client
+	})
+}
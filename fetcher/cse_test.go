@@ -0,0 +1,170 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+)
+
+const (
+	testKMSKeyID      = "arn:aws:kms:us-east-1:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab"
+	testEncryptedKey  = "encrypted data key"
+	testEncryptedPath = "/apt-repo-bucket/apt/generic/hello.deb"
+)
+
+// fakeKMS decrypts the test data key, as long as it is not asked to use a
+// key other than testKMSKeyID.
+type fakeKMS struct {
+	kmsiface.KMSAPI
+	dataKey []byte
+}
+
+func (k *fakeKMS) DecryptWithContext(
+	_ aws.Context, input *kms.DecryptInput, _ ...request.Option,
+) (*kms.DecryptOutput, error) {
+	if keyID := aws.StringValue(input.KeyId); keyID != "" && keyID != testKMSKeyID {
+		return nil, awserr.New(kms.ErrCodeIncorrectKeyException, "the ciphertext was not encrypted with "+keyID, nil)
+	}
+	if string(input.CiphertextBlob) != testEncryptedKey {
+		return nil, awserr.New(kms.ErrCodeInvalidCiphertextException, "unknown ciphertext", nil)
+	}
+	return &kms.DecryptOutput{KeyId: aws.String(testKMSKeyID), Plaintext: k.dataKey}, nil
+}
+
+// encryptedObjectServer serves body as the object at testEncryptedPath, along
+// with the given metadata headers.
+func encryptedObjectServer(body []byte, metadata map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != testEncryptedPath {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for key, value := range metadata {
+			w.Header().Set("X-Amz-Meta-"+key, value)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		if r.Method != http.MethodHead {
+			w.Write(body)
+		}
+	}))
+}
+
+func TestFetchDecrypted(t *testing.T) {
+	const content = "Package: hello\nVersion: 1.0\n"
+	dataKey := bytes.Repeat([]byte{0x42}, 32)
+	iv := bytes.Repeat([]byte{0x24}, 12)
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		t.Fatalf("aes.NewCipher() returned unexpected error: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatalf("cipher.NewGCM() returned unexpected error: %v", err)
+	}
+	encrypted := gcm.Seal(nil, iv, []byte(content), nil)
+	tampered := bytes.Clone(encrypted)
+	tampered[0] ^= 0xff
+	envelope := map[string]string{
+		"X-Amz-Key-V2":                     base64.StdEncoding.EncodeToString([]byte(testEncryptedKey)),
+		"X-Amz-Iv":                         base64.StdEncoding.EncodeToString(iv),
+		"X-Amz-Matdesc":                    `{"aws:x-amz-cek-alg":"AES/GCM/NoPadding"}`,
+		"X-Amz-Wrap-Alg":                   "kms+context",
+		"X-Amz-Cek-Alg":                    "AES/GCM/NoPadding",
+		"X-Amz-Tag-Len":                    "128",
+		"X-Amz-Unencrypted-Content-Length": strconv.Itoa(len(content)),
+	}
+	sum := sha256.Sum256([]byte(content))
+
+	specs := map[string]struct {
+		keyID             string
+		body              []byte
+		metadata          map[string]string
+		expected          []byte
+		expectedDecrypted bool
+		expectedErr       string
+	}{
+		"any key":             {"", encrypted, envelope, []byte(content), true, ""},
+		"configured key":      {testKMSKeyID, encrypted, envelope, []byte(content), true, ""},
+		"other key":           {"alias/other", encrypted, envelope, nil, false, "with KMS key alias/other"},
+		"tampered ciphertext": {"", tampered, envelope, nil, false, "with KMS key named in the object's envelope"},
+		"not encrypted":       {testKMSKeyID, []byte(content), nil, []byte(content), false, ""},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			server := encryptedObjectServer(spec.body, spec.metadata)
+			defer server.Close()
+			dir := t.TempDir()
+			filename := filepath.Join(dir, "hello.deb")
+			before := testutil.SnapshotDir(t, dir)
+			f := New(Config{Region: "us-east-1", Endpoint: server.URL + "/{bucket}", CSEKMSKeyID: spec.keyID})
+			f.newKMSClient = func(client.ConfigProvider, ...*aws.Config) kmsiface.KMSAPI {
+				return &fakeKMS{dataKey: dataKey}
+			}
+
+			result, err := f.Fetch(context.Background(), FetchRequest{
+				URI: "s3://AKIDEXAMPLE:secret@apt-repo-bucket/apt/generic/hello.deb", Filename: filename,
+			})
+			if spec.expectedErr != "" {
+				if !errors.Is(err, ErrDecrypt) || !strings.Contains(err.Error(), spec.expectedErr) {
+					t.Fatalf("Fetch() = %v; expected ErrDecrypt naming %q", err, spec.expectedErr)
+				}
+				before.CheckUnchanged(t)
+				return
+			}
+			if err != nil {
+				t.Fatalf("Fetch() returned unexpected error: %v", err)
+			}
+			contents, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatalf("failed to read fetched file: %v", err)
+			}
+			if !bytes.Equal(contents, spec.expected) {
+				t.Errorf("fetched file contains %q; expected %q", contents, spec.expected)
+			}
+			if result.Decrypted != spec.expectedDecrypted {
+				t.Errorf("Decrypted = %t; expected %t", result.Decrypted, spec.expectedDecrypted)
+			}
+			if result.Size != int64(len(content)) {
+				t.Errorf("Size = %d; expected %d", result.Size, len(content))
+			}
+			if result.Digests.SHA256 != hex.EncodeToString(sum[:]) {
+				t.Errorf("SHA256 = %s; expected the digest of the plaintext", result.Digests.SHA256)
+			}
+		})
+	}
+}
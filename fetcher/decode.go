@@ -0,0 +1,100 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+const contentEncodingGzip = "gzip"
+
+// ErrDecodeContent is returned by Fetch when an object stored with
+// Content-Encoding: gzip could not be decoded.
+var ErrDecodeContent = errors.New("failed to decode the object content")
+
+// isGzipEncoded tells whether the given Content-Encoding header value says
+// that the object is stored gzip-compressed.
+func isGzipEncoded(contentEncoding *string) bool {
+	for _, encoding := range strings.Split(aws.StringValue(contentEncoding), ",") {
+		if strings.EqualFold(strings.TrimSpace(encoding), contentEncodingGzip) {
+			return true
+		}
+	}
+	return false
+}
+
+// downloadDecoded writes the gzip-decoded content of the object at loc to the
+// file of req and records its decoded size in result, decoding while the object
+// is streamed in a single request. The file is closed, and synced if the
+// Config asks for it, before downloadDecoded returns successfully.
+func (f *Fetcher) downloadDecoded(
+	ctx context.Context, client s3iface.S3API, loc Location, req FetchRequest, result *FetchResult,
+) error {
+	file, err := f.createFile(req.Filename)
+	if err != nil {
+		return diskError(err)
+	}
+	defer file.Close()
+
+	result.Timings.PartSize, result.Timings.Concurrency = 0, 1
+	writer := &firstByteWriterAt{WriterAt: file, now: f.clock.Now, onProgress: req.OnProgress}
+	start := f.clock.Now()
+	// Go's HTTP transport transparently decodes gzip responses to requests it
+	// added Accept-Encoding to, which it does not for range requests. Asking
+	// for the whole object as a range thus leaves decoding to us, whatever the
+	// transport does.
+	input := getObjectInput(loc, result.ETag)
+	input.Range = aws.String("bytes=0-")
+	output, err := client.GetObjectWithContext(ctx, input)
+	if err == nil {
+		defer output.Body.Close()
+		err = decodeGzip(io.NewOffsetWriter(writer, 0), output.Body, &result.Size)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		if diskErr := diskError(err); errors.Is(diskErr, ErrWriteFile) {
+			return diskErr
+		}
+		return requestError("GetObject", loc, err)
+	}
+	result.Timings.Transfer = f.since(start)
+	result.Timings.FirstByte = writer.sinceStart(start)
+	return f.closeFile(file)
+}
+
+// decodeGzip writes the gzip-decoded content of body to w and stores the
+// number of decoded bytes in size. Malformed content yields an error wrapping
+// ErrDecodeContent.
+func decodeGzip(w io.Writer, body io.Reader, size *int64) error {
+	reader, err := gzip.NewReader(body)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDecodeContent, err)
+	}
+	*size, err = copyBuffered(w, reader)
+	if errors.Is(err, gzip.ErrChecksum) || errors.Is(err, gzip.ErrHeader) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %w", ErrDecodeContent, err)
+	}
+	return err
+}
@@ -0,0 +1,116 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+)
+
+func gzipped(t *testing.T, content string) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	writer := gzip.NewWriter(buf)
+	if _, err := writer.Write([]byte(content)); err != nil {
+		t.Fatalf("failed to compress %q: %v", content, err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("failed to compress %q: %v", content, err)
+	}
+	return buf.Bytes()
+}
+
+func TestFetchDecodeContent(t *testing.T) {
+	const content = "Package: hello\nVersion: 1.0\n"
+	encoded := gzipped(t, content)
+	specs := map[string]struct {
+		decode          bool
+		contentEncoding string
+		expected        []byte
+		expectedStart   int64
+	}{
+		"pass-through by default":    {false, "gzip", encoded, int64(len(encoded))},
+		"decoded":                    {true, "gzip", []byte(content), -1},
+		"decoded case-insensitively": {true, "GZIP", []byte(content), -1},
+		"not encoded":                {true, "", encoded, int64(len(encoded))},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			fake := testutil.NewFakeS3()
+			fake.Put("apt-repo-bucket", "apt/generic/hello.deb",
+				testutil.FakeObject{Body: encoded, ContentEncoding: spec.contentEncoding})
+			filename := filepath.Join(t.TempDir(), "Packages")
+			f := New(Config{Region: "us-east-1", DecodeContent: spec.decode},
+				WithS3ClientFactory(func(ClientConfig) (s3iface.S3API, error) {
+					return fake, nil
+				}))
+
+			var start Object
+			result, err := f.Fetch(context.Background(), FetchRequest{
+				URI: testURI, Filename: filename, OnStart: func(obj Object) { start = obj },
+			})
+			if err != nil {
+				t.Fatalf("Fetch() returned unexpected error: %v", err)
+			}
+			contents, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatalf("failed to read fetched file: %v", err)
+			}
+			if !bytes.Equal(contents, spec.expected) {
+				t.Errorf("fetched contents = %q; expected %q", contents, spec.expected)
+			}
+			if result.Size != int64(len(spec.expected)) {
+				t.Errorf("result.Size = %d; expected %d", result.Size, len(spec.expected))
+			}
+			if start.Size != spec.expectedStart {
+				t.Errorf("OnStart size = %d; expected %d", start.Size, spec.expectedStart)
+			}
+			expectedDigests, err := FileDigests(filename)
+			if err != nil {
+				t.Fatalf("failed to hash fetched file: %v", err)
+			}
+			if result.Digests != expectedDigests {
+				t.Errorf("result.Digests = %v; expected those of the written file, %v", result.Digests, expectedDigests)
+			}
+		})
+	}
+}
+
+func TestFetchDecodeContentMalformed(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "apt/generic/hello.deb",
+		testutil.FakeObject{Body: []byte("not gzip at all"), ContentEncoding: "gzip"})
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "Packages")
+	before := testutil.SnapshotDir(t, dir)
+	f := New(Config{Region: "us-east-1", DecodeContent: true}, WithS3ClientFactory(func(ClientConfig) (s3iface.S3API, error) {
+		return fake, nil
+	}))
+
+	_, err := f.Fetch(context.Background(), FetchRequest{URI: testURI, Filename: filename})
+	if !errors.Is(err, ErrDecodeContent) {
+		t.Errorf("Fetch() = %v; expected %v", err, ErrDecodeContent)
+	}
+	before.CheckUnchanged(t)
+}
@@ -0,0 +1,246 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// parallelDigestMinSize is the size from which files are hashed by a
+// parallelDigester. Smaller ones take less time to hash than handing their
+// buffers to other goroutines does.
+const parallelDigestMinSize = 1 << 20
+
+// Digests holds the hex encoded digests of a file, one per algorithm apt
+// knows about.
+type Digests struct {
+	MD5    string
+	SHA1   string
+	SHA256 string
+	SHA512 string
+}
+
+// A Hash is a checksum algorithm apt verifies files with.
+type Hash struct {
+	// Name is the name apt gives the algorithm in the fields of its messages,
+	// as in SHA256-Hash and Expected-SHA256.
+	Name string
+	// Aliases are the other names apt knows the algorithm by, which the
+	// fields of its messages may use as well.
+	Aliases []string
+	// New returns a hash.Hash computing the algorithm's digests.
+	New func() hash.Hash
+	// digest returns the field of Digests that holds the algorithm's digest.
+	digest func(*Digests) *string
+}
+
+// Names returns the Name and the Aliases of h.
+func (h Hash) Names() []string {
+	return append([]string{h.Name}, h.Aliases...)
+}
+
+// Hashes lists the algorithms files are hashed with, in the order apt lists
+// their fields. Adding an algorithm takes an entry here and a field in
+// Digests.
+var Hashes = []Hash{ //nolint:gochecknoglobals
+	{Name: "MD5", Aliases: []string{"MD5Sum"}, New: md5.New, digest: func(d *Digests) *string { return &d.MD5 }},
+	{Name: "SHA1", New: sha1.New, digest: func(d *Digests) *string { return &d.SHA1 }},
+	{Name: "SHA256", New: sha256.New, digest: func(d *Digests) *string { return &d.SHA256 }},
+	{Name: "SHA512", New: sha512.New, digest: func(d *Digests) *string { return &d.SHA512 }},
+}
+
+// Get returns the digest of the given algorithm, or an empty string if there
+// is none.
+func (d Digests) Get(h Hash) string {
+	return *h.digest(&d)
+}
+
+// Set sets the digest of the given algorithm.
+func (d *Digests) Set(h Hash, digest string) {
+	*h.digest(d) = digest
+}
+
+// FileDigests computes the Digests of the named file for every algorithm of
+// Hashes, reading it once and without holding more than a buffer of it in
+// memory. They are the digests a fetch reports for the file it wrote.
+func FileDigests(filename string) (Digests, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return Digests{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return Digests{}, err
+	}
+	digester := newDigester(info.Size())
+	defer digester.Close()
+	if _, err := copyBuffered(digester, file); err != nil {
+		return Digests{}, err
+	}
+	return digester.digests(), nil
+}
+
+// A digester computes the digests of everything written to it for every
+// algorithm of Hashes, so that a download can be hashed while it is written.
+// Writes never fail. It must be closed once it is no longer written to.
+type digester interface {
+	io.WriteCloser
+	// digests returns the Digests of what was written. Nothing may be
+	// written afterwards.
+	digests() Digests
+}
+
+// newDigester returns a digester for size bytes, or for an unknown number of
+// them if size is negative: a parallelDigester if there is enough to hash and
+// more than one CPU to hash it with, and a sequentialDigester otherwise.
+func newDigester(size int64) digester {
+	if size >= parallelDigestMinSize && len(Hashes) > 1 && runtime.GOMAXPROCS(0) > 1 {
+		return newParallelDigester()
+	}
+	return newSequentialDigester()
+}
+
+// A sequentialDigester is a digester that computes every digest in the
+// goroutine that writes to it.
+type sequentialDigester []hash.Hash
+
+func newSequentialDigester() sequentialDigester {
+	d := make(sequentialDigester, len(Hashes))
+	for idx, h := range Hashes {
+		d[idx] = h.New()
+	}
+	return d
+}
+
+// Write implements io.Writer.
+func (d sequentialDigester) Write(p []byte) (int, error) {
+	for _, h := range d {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+// Close implements io.Closer. There is nothing to release.
+func (d sequentialDigester) Close() error {
+	return nil
+}
+
+func (d sequentialDigester) digests() Digests {
+	return hashDigests(d)
+}
+
+// A parallelDigester is a digester that computes the digest of every algorithm
+// of Hashes but the first in a goroutine of its own, and that of the first in
+// the goroutine that writes to it, so that hashing takes about as long as the
+// slowest algorithm rather than all of them together. Each Write waits for all
+// of them to have hashed its buffer, which the caller may reuse afterwards.
+type parallelDigester struct {
+	hashes  []hash.Hash
+	chunks  []chan []byte
+	written sync.WaitGroup
+	stopped sync.WaitGroup
+	stop    sync.Once
+}
+
+func newParallelDigester() *parallelDigester {
+	d := &parallelDigester{hashes: make([]hash.Hash, len(Hashes))}
+	for idx, h := range Hashes {
+		d.hashes[idx] = h.New()
+		if idx == 0 {
+			continue
+		}
+		chunks := make(chan []byte)
+		d.chunks = append(d.chunks, chunks)
+		d.stopped.Add(1)
+		go d.hash(d.hashes[idx], chunks)
+	}
+	return d
+}
+
+// hash writes each chunk it receives to h until chunks is closed.
+func (d *parallelDigester) hash(h hash.Hash, chunks <-chan []byte) {
+	defer d.stopped.Done()
+	for p := range chunks {
+		h.Write(p)
+		d.written.Done()
+	}
+}
+
+// Write implements io.Writer.
+func (d *parallelDigester) Write(p []byte) (int, error) {
+	d.written.Add(len(d.chunks))
+	for _, chunks := range d.chunks {
+		chunks <- p
+	}
+	d.hashes[0].Write(p)
+	d.written.Wait()
+	return len(p), nil
+}
+
+// Close implements io.Closer. It stops the goroutines hashing what is written,
+// and may be called more than once.
+func (d *parallelDigester) Close() error {
+	d.stop.Do(d.stopHashing)
+	return nil
+}
+
+func (d *parallelDigester) stopHashing() {
+	for _, chunks := range d.chunks {
+		close(chunks)
+	}
+	d.stopped.Wait()
+}
+
+func (d *parallelDigester) digests() Digests {
+	d.stop.Do(d.stopHashing)
+	return hashDigests(d.hashes)
+}
+
+// hashDigests returns the Digests the given hashes computed, one per algorithm
+// of Hashes and in the same order.
+func hashDigests(hashes []hash.Hash) Digests {
+	var digests Digests
+	for idx, h := range Hashes {
+		digests.Set(h, hexSum(hashes[idx]))
+	}
+	return digests
+}
+
+func hexSum(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// verify returns an error wrapping ErrHashMismatch if any of the expected
+// digests differs from the actual one. Digests that are not expected are
+// skipped.
+func (expected Digests) verify(actual Digests) error {
+	for _, h := range Hashes {
+		if digest := expected.Get(h); digest != "" && digest != actual.Get(h) {
+			return fmt.Errorf("%w: %s is %s, expected %s", ErrHashMismatch, h.Name, actual.Get(h), digest)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileDigests(t *testing.T) {
+	large := bytes.Repeat([]byte("0123456789abcdef"), copyBufferSize/4+1)
+	largeSum := sha256.Sum256(large)
+	huge := bytes.Repeat([]byte("0123456789abcdef"), parallelDigestMinSize/8+1)
+	hugeSum := sha256.Sum256(huge)
+	specs := map[string]struct {
+		content  []byte
+		expected Digests
+	}{
+		"hello": {[]byte("hello"), Digests{
+			MD5:    "5d41402abc4b2a76b9719d911017c592",
+			SHA1:   "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d",
+			SHA256: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+			SHA512: "9b71d224bd62f3785d96d46ad3ea3d73319bfbc2890caadae2dff72519673ca7" +
+				"2323c3d99ba5c11d7c7acc6e14b8c5da0c4663475c2e5c3adef46f73bcdec043",
+		}},
+		"larger than a buffer": {large, Digests{SHA256: hex.EncodeToString(largeSum[:])}},
+		"hashed in parallel":   {huge, Digests{SHA256: hex.EncodeToString(hugeSum[:])}},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "hello.deb")
+			if err := os.WriteFile(filename, spec.content, 0o600); err != nil {
+				t.Fatalf("failed to write test file: %v", err)
+			}
+			actual, err := FileDigests(filename)
+			if err != nil {
+				t.Fatalf("FileDigests() returned unexpected error: %v", err)
+			}
+			if err := spec.expected.verify(actual); err != nil {
+				t.Errorf("FileDigests() = %+v; %v", actual, err)
+			}
+		})
+	}
+}
+
+func BenchmarkFileDigests(b *testing.B) {
+	filename := filepath.Join(b.TempDir(), "Release")
+	if err := os.WriteFile(filename, bytes.Repeat([]byte("a"), 4<<10), 0o600); err != nil {
+		b.Fatalf("failed to write test file: %v", err)
+	}
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := FileDigests(filename); err != nil {
+			b.Fatalf("FileDigests() returned unexpected error: %v", err)
+		}
+	}
+}
+
+func TestDigesters(t *testing.T) {
+	content := make([]byte, 3*copyBufferSize+17)
+	for idx := range content {
+		content[idx] = byte(idx * 7)
+	}
+	var expected Digests
+	for _, h := range Hashes {
+		hash := h.New()
+		hash.Write(content)
+		expected.Set(h, hexSum(hash))
+	}
+	for name, newDigester := range map[string]func() digester{
+		"sequential": func() digester { return newSequentialDigester() },
+		"parallel":   func() digester { return newParallelDigester() },
+	} {
+		t.Run(name, func(t *testing.T) {
+			digester := newDigester()
+			defer digester.Close()
+			if _, err := copyBuffered(digester, bytes.NewReader(content)); err != nil {
+				t.Fatalf("copyBuffered() returned unexpected error: %v", err)
+			}
+			if actual := digester.digests(); actual != expected {
+				t.Errorf("digests() = %+v; expected %+v", actual, expected)
+			}
+		})
+	}
+}
+
+func TestParallelDigesterClose(t *testing.T) {
+	digester := newParallelDigester()
+	if _, err := digester.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write() returned unexpected error: %v", err)
+	}
+	if err := digester.Close(); err != nil {
+		t.Fatalf("Close() returned unexpected error: %v", err)
+	}
+	// The goroutines are gone, but the digests are still there.
+	if actual, expected := digester.digests().MD5, "5d41402abc4b2a76b9719d911017c592"; actual != expected {
+		t.Errorf("MD5 after Close() = %s; expected %s", actual, expected)
+	}
+	if err := digester.Close(); err != nil {
+		t.Errorf("second Close() returned unexpected error: %v", err)
+	}
+}
+
+// BenchmarkDigesters compares hashing a 1 GiB payload in the goroutine that
+// writes it with hashing it in a goroutine per algorithm. The latter takes
+// about as long as SHA512 alone where there are enough CPUs.
+func BenchmarkDigesters(b *testing.B) {
+	const payloadSize = 1 << 30
+	buf := bytes.Repeat([]byte("0123456789abcdef"), copyBufferSize/16)
+	for name, newDigester := range map[string]func() digester{
+		"sequential": func() digester { return newSequentialDigester() },
+		"parallel":   func() digester { return newParallelDigester() },
+	} {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(payloadSize)
+			for b.Loop() {
+				digester := newDigester()
+				for range payloadSize / len(buf) {
+					digester.Write(buf) //nolint:errcheck
+				}
+				digester.digests()
+				digester.Close() //nolint:errcheck
+			}
+		})
+	}
+}
+
+func TestHashesCoverDigests(t *testing.T) {
+	var digests Digests
+	for _, h := range Hashes {
+		if digests.Get(h) != "" {
+			t.Errorf("%s shares its field of Digests with another hash", h.Name)
+		}
+		digests.Set(h, h.Name)
+	}
+	expected := Digests{MD5: "MD5", SHA1: "SHA1", SHA256: "SHA256", SHA512: "SHA512"}
+	if digests != expected {
+		t.Errorf("Digests set for every hash = %+v; expected %+v", digests, expected)
+	}
+}
+
+func TestDigestsVerify(t *testing.T) {
+	actual := Digests{MD5: "md5", SHA1: "sha1", SHA256: "sha256", SHA512: "sha512"}
+	specs := map[string]struct {
+		expected    Digests
+		expectedErr error
+	}{
+		"nothing expected": {Digests{}, nil},
+		"all match":        {actual, nil},
+		"partial match":    {Digests{SHA256: "sha256"}, nil},
+		"mismatch":         {Digests{SHA256: "other"}, ErrHashMismatch},
+	}
+
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			if err := spec.expected.verify(actual); !errors.Is(err, spec.expectedErr) {
+				t.Errorf("verify() = %v; expected %v", err, spec.expectedErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrInsufficientSpace is returned by Fetch when the filesystem the object is
+// written to cannot hold it, once the Config's DiskSpace accounted for what
+// concurrent fetches are about to write.
+var ErrInsufficientSpace = errors.New("insufficient free space")
+
+// A DiskSpace accounts for the bytes concurrent fetches are about to write, so
+// that together they do not overcommit a filesystem, which its free space
+// alone would let them. A fetch that does not fit waits for the others on the
+// same filesystem to finish, and fails with ErrInsufficientSpace once none is
+// left. Filesystems whose free space is unknown are not accounted for. A
+// DiskSpace is safe for concurrent use.
+type DiskSpace struct {
+	mu           sync.Mutex
+	reservations map[*reservation]bool
+	// released is closed, and replaced, whenever a reservation is released.
+	released chan struct{}
+}
+
+// A reservation holds the size of an object a fetch writes to filename, on
+// the filesystem fs.
+type reservation struct {
+	filename string
+	fs       uint64
+	size     int64
+}
+
+// NewDiskSpace returns a DiskSpace without reservations.
+func NewDiskSpace() *DiskSpace {
+	return &DiskSpace{reservations: map[*reservation]bool{}, released: make(chan struct{})}
+}
+
+// reserve reserves size bytes for the named file, calling onWait with the
+// ErrInsufficientSpace that keeps it waiting for others to finish, if set, and
+// returns the function releasing them, which must be called once the fetch
+// succeeded or failed. Unknown, negative sizes are not reserved. A nil
+// DiskSpace reserves nothing.
+func (space *DiskSpace) reserve(ctx context.Context, filename string, size int64, onWait func(err error)) (func(), error) {
+	if space == nil || size < 0 {
+		return func() {}, nil
+	}
+	fs, ok := filesystemID(filename)
+	if !ok {
+		return func() {}, nil
+	}
+	for {
+		space.mu.Lock()
+		available, known := space.available(filename, fs)
+		if !known || available >= size {
+			res := &reservation{filename: filename, fs: fs, size: size}
+			space.reservations[res] = true
+			space.mu.Unlock()
+			return func() { space.release(res) }, nil
+		}
+		others, released := space.pending(fs), space.released
+		space.mu.Unlock()
+
+		err := fmt.Errorf("%w: need %d bytes, have %d, for %s", ErrInsufficientSpace, size, max(available, 0), filename)
+		if others == 0 {
+			return nil, err
+		}
+		if onWait != nil {
+			onWait(err)
+		}
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// available returns the free space of the filesystem fs, which the named file
+// is on, less what the reservations on it are yet to write. The caller must
+// hold mu.
+func (space *DiskSpace) available(filename string, fs uint64) (int64, bool) {
+	free, ok := availableBytes(filename)
+	if !ok {
+		return 0, false
+	}
+	available := int64(free) //nolint:gosec
+	for res := range space.reservations {
+		if res.fs == fs {
+			// The space already allocated to the file is no longer free.
+			available -= max(res.size-allocatedBytes(res.filename), 0)
+		}
+	}
+	return available, true
+}
+
+// pending returns the number of reservations on the filesystem fs. The caller
+// must hold mu.
+func (space *DiskSpace) pending(fs uint64) int {
+	count := 0
+	for res := range space.reservations {
+		if res.fs == fs {
+			count++
+		}
+	}
+	return count
+}
+
+// release removes res and wakes up the fetches waiting for it.
+func (space *DiskSpace) release(res *reservation) {
+	space.mu.Lock()
+	defer space.mu.Unlock()
+	delete(space.reservations, res)
+	close(space.released)
+	space.released = make(chan struct{})
+}
@@ -0,0 +1,113 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+)
+
+func newDiskSpaceFetcher(fake *testutil.FakeS3, space *DiskSpace, disablePreallocate bool) *Fetcher {
+	cfg := Config{Region: "us-east-1", DiskSpace: space, DisablePreallocate: disablePreallocate}
+	return New(cfg, WithS3ClientFactory(func(ClientConfig) (s3iface.S3API, error) {
+		return fake, nil
+	}))
+}
+
+func TestFetchInsufficientSpace(t *testing.T) {
+	dir := testutil.MountTmpfs(t, 1<<20)
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: make([]byte, 2<<20)})
+	filename := filepath.Join(dir, "hello.deb")
+
+	_, err := newDiskSpaceFetcher(fake, NewDiskSpace(), false).Fetch(context.Background(), FetchRequest{URI: testURI, Filename: filename})
+	if !errors.Is(err, ErrInsufficientSpace) || !strings.Contains(err.Error(), "need 2097152 bytes, have ") {
+		t.Errorf("Fetch() = %v; expected ErrInsufficientSpace saying how many bytes are needed", err)
+	}
+	if fake.Gets() != 0 {
+		t.Errorf("Fetch() sent %d GetObject requests; expected none", fake.Gets())
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("Fetch() left %s behind (%v)", filename, err)
+	}
+}
+
+func TestFetchWaitsForDiskSpace(t *testing.T) {
+	for _, disablePreallocate := range []bool{false, true} {
+		t.Run(fmt.Sprintf("preallocate=%t", !disablePreallocate), func(t *testing.T) {
+			dir := testutil.MountTmpfs(t, 1<<20)
+			body := bytes.Repeat([]byte("0123456789abcdef"), 600<<10/16)
+			space := NewDiskSpace()
+
+			// The first fetch stalls part way through its download, which
+			// leaves too little space for the second.
+			stalled := testutil.NewFakeS3()
+			stalled.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: body})
+			stalled.StallAfter, stalled.Stalled = 100<<10, make(chan struct{})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			firstErr := make(chan error, 1)
+			go func() {
+				_, err := newDiskSpaceFetcher(stalled, space, disablePreallocate).Fetch(ctx, FetchRequest{
+					URI: testURI, Filename: filepath.Join(dir, "first.deb"),
+				})
+				firstErr <- err
+			}()
+			<-stalled.Stalled
+
+			fake := testutil.NewFakeS3()
+			fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: body})
+			waiting := make(chan error, 1)
+			secondErr := make(chan error, 1)
+			go func() {
+				_, err := newDiskSpaceFetcher(fake, space, disablePreallocate).Fetch(context.Background(), FetchRequest{
+					URI: testURI, Filename: filepath.Join(dir, "second.deb"),
+					OnDiskSpaceWait: func(err error) {
+						select {
+						case waiting <- err:
+						default:
+						}
+					},
+				})
+				secondErr <- err
+			}()
+			if err := <-waiting; !errors.Is(err, ErrInsufficientSpace) || !strings.Contains(err.Error(), "need 614400 bytes") {
+				t.Errorf("OnDiskSpaceWait called with %v; expected ErrInsufficientSpace saying how many bytes are needed", err)
+			}
+			if fake.Gets() != 0 {
+				t.Errorf("waiting fetch sent %d GetObject requests; expected none", fake.Gets())
+			}
+
+			// The failure of the first fetch releases its space.
+			cancel()
+			if err := <-firstErr; !errors.Is(err, context.Canceled) {
+				t.Errorf("first Fetch() = %v; expected %v", err, context.Canceled)
+			}
+			if err := <-secondErr; err != nil {
+				t.Errorf("second Fetch() = %v; expected nil once the first released its space", err)
+			}
+		})
+	}
+}
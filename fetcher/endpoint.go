@@ -0,0 +1,147 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+const (
+	bucketPlaceholder = "{bucket}"
+	regionPlaceholder = "{region}"
+)
+
+var (
+	// ErrInvalidEndpoint is returned by ValidateEndpoint, Locate and Fetch
+	// when an endpoint, or endpoint template, is not a valid URL.
+	ErrInvalidEndpoint = errors.New("invalid endpoint")
+)
+
+// An expandedEndpoint is an endpoint whose template placeholders were
+// replaced for a single bucket and region.
+type expandedEndpoint struct {
+	// URL is the endpoint the AWS SDK is configured with. It never contains
+	// the bucket, which the SDK adds to the host or the path itself.
+	URL string
+	// PathStyle tells whether the SDK must add the bucket to the path rather
+	// than the host.
+	PathStyle bool
+}
+
+// ValidateEndpoint returns an error wrapping ErrInvalidEndpoint if endpoint is
+// neither a URL nor a valid endpoint template.
+func ValidateEndpoint(endpoint string) error {
+	_, err := expandEndpoint(endpoint, "us-east-1")
+	return err
+}
+
+// isEndpointTemplate tells whether endpoint contains placeholders.
+func isEndpointTemplate(endpoint string) bool {
+	return strings.Contains(endpoint, bucketPlaceholder) || strings.Contains(endpoint, regionPlaceholder)
+}
+
+// expandEndpoint replaces the {region} placeholder of an endpoint template
+// with region. The {bucket} placeholder must either be the first label of the
+// host, as in https://{bucket}.objects.{region}.example.com, or the last
+// segment of the path, as in https://s3.{region}.example.com/{bucket}, and is
+// removed, since the SDK adds the bucket where the placeholder was. Requests
+// to templates without {bucket} in the host are path-style, as are requests to
+// endpoints whose host is an IP address, which has no subdomains to name
+// buckets, and to endpoints with a path, such as gateways that serve S3 below
+// a prefix, which a bucket in the host would bypass. Endpoints that are not
+// templates are returned as is; the SDK keeps their path as the prefix of the
+// path of every request.
+func expandEndpoint(endpoint, region string) (expandedEndpoint, error) {
+	if !isEndpointTemplate(endpoint) {
+		return expandedEndpoint{URL: endpoint, PathStyle: isIPEndpoint(endpoint) || hasPathPrefix(endpoint)}, nil
+	}
+	expanded := strings.ReplaceAll(endpoint, regionPlaceholder, region)
+	scheme, rest, _ := strings.Cut(expanded, "://")
+	host, path, _ := strings.Cut(rest, "/")
+	result := expandedEndpoint{PathStyle: true}
+	switch {
+	case strings.HasPrefix(host, bucketPlaceholder+"."):
+		host, result.PathStyle = strings.TrimPrefix(host, bucketPlaceholder+"."), false
+	case strings.TrimSuffix(path, "/") == bucketPlaceholder:
+		path = ""
+	case strings.HasSuffix(strings.TrimSuffix(path, "/"), "/"+bucketPlaceholder):
+		path = strings.TrimSuffix(strings.TrimSuffix(path, "/"), "/"+bucketPlaceholder)
+	}
+	result.URL = scheme + "://" + host
+	if path != "" {
+		result.URL += "/" + path
+	}
+	if strings.ContainsAny(result.URL, "{}") {
+		return expandedEndpoint{}, fmt.Errorf("%w %s: {bucket} must be the first label of the host or "+
+			"the last segment of the path, and {region} the only other placeholder", ErrInvalidEndpoint, endpoint)
+	}
+	parsed, err := url.Parse(result.URL)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return expandedEndpoint{}, fmt.Errorf("%w %s: not an absolute URL", ErrInvalidEndpoint, endpoint)
+	}
+	if !result.PathStyle && isIPAddress(parsed.Hostname()) {
+		return expandedEndpoint{}, fmt.Errorf("%w %s: {bucket} cannot be a label of an IP address", ErrInvalidEndpoint, endpoint)
+	}
+	return result, nil
+}
+
+// isIPEndpoint tells whether the host of the endpoint URL is an IP address.
+func isIPEndpoint(endpoint string) bool {
+	parsed, err := url.Parse(endpoint)
+	return err == nil && isIPAddress(parsed.Hostname())
+}
+
+// hasPathPrefix tells whether the endpoint URL has a path other than the root.
+func hasPathPrefix(endpoint string) bool {
+	parsed, err := url.Parse(endpoint)
+	return err == nil && strings.Trim(parsed.Path, "/") != ""
+}
+
+// isIPAddress tells whether host, as returned by url.URL.Hostname, is an IPv4
+// or IPv6 address rather than a host name.
+func isIPAddress(host string) bool {
+	return net.ParseIP(host) != nil
+}
+
+// sameHost tells whether the host names a and b name the same host. IP
+// addresses are compared by value, since IPv6 addresses have several spellings.
+func sameHost(a, b string) bool {
+	if ipA, ipB := net.ParseIP(a), net.ParseIP(b); ipA != nil && ipB != nil {
+		return ipA.Equal(ipB)
+	}
+	return a == b
+}
+
+// isSubdomain tells whether the host name a is a subdomain of the host name b.
+// IP addresses have no subdomains.
+func isSubdomain(a, b string) bool {
+	return !isIPAddress(b) && strings.HasSuffix(a, "."+b)
+}
+
+// namesHost tells whether a URI whose host is a names the endpoint host b, by
+// being b or a subdomain of it.
+func namesHost(a, b string) bool {
+	return sameHost(a, b) || isSubdomain(a, b)
+}
+
+// displayEndpoint returns endpoint with its placeholders replaced by bucket
+// and region, as the endpoint would be named to users.
+func displayEndpoint(endpoint, bucket, region string) string {
+	return strings.NewReplacer(bucketPlaceholder, bucket, regionPlaceholder, region).Replace(endpoint)
+}
@@ -0,0 +1,249 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestExpandEndpoint(t *testing.T) {
+	specs := map[string]expandedEndpoint{
+		"https://minio.example.com":                       {URL: "https://minio.example.com"},
+		"https://{bucket}.objects.{region}.corp.example":  {URL: "https://objects.us-west-2.corp.example"},
+		"https://s3.{region}.internal/{bucket}":           {URL: "https://s3.us-west-2.internal", PathStyle: true},
+		"https://gateway.internal/s3/{bucket}/":           {URL: "https://gateway.internal/s3", PathStyle: true},
+		"https://s3.{region}.internal":                    {URL: "https://s3.us-west-2.internal", PathStyle: true},
+		"http://{bucket}.localhost:9000":                  {URL: "http://localhost:9000"},
+		"https://{bucket}.s3.{region}.amazonaws.com/path": {URL: "https://s3.us-west-2.amazonaws.com/path"},
+		"http://10.0.0.5:9000":                            {URL: "http://10.0.0.5:9000", PathStyle: true},
+		"https://[fd00::10]":                              {URL: "https://[fd00::10]", PathStyle: true},
+		"https://[fd00::10]:9000/{bucket}":                {URL: "https://[fd00::10]:9000", PathStyle: true},
+		"https://gw.corp/api/s3/":                         {URL: "https://gw.corp/api/s3/", PathStyle: true},
+		"https://gw.corp/":                                {URL: "https://gw.corp/"},
+	}
+	for endpoint, expected := range specs {
+		actual, err := expandEndpoint(endpoint, "us-west-2")
+		if err != nil {
+			t.Errorf("expandEndpoint(%s) returned unexpected error: %v", endpoint, err)
+			continue
+		}
+		if diff := cmp.Diff(expected, actual); diff != "" {
+			t.Errorf("expandEndpoint(%s) mismatch (-want +got):\n%s", endpoint, diff)
+		}
+	}
+}
+
+func TestValidateEndpointInvalid(t *testing.T) {
+	for _, endpoint := range []string{
+		"https://objects-{bucket}.corp.example",
+		"https://s3.internal/{bucket}/objects",
+		"https://{bucket}.{zone}.corp.example",
+		"{bucket}.corp.example",
+		"http://{bucket}.10.0.0.5:9000",
+	} {
+		if err := ValidateEndpoint(endpoint); !errors.Is(err, ErrInvalidEndpoint) {
+			t.Errorf("ValidateEndpoint(%s) = %v; expected %v", endpoint, err, ErrInvalidEndpoint)
+		}
+	}
+}
+
+func TestEndpointTemplateRequestURL(t *testing.T) {
+	specs := map[string]string{
+		"https://{bucket}.objects.{region}.corp.example": "https://apt-repo-bucket.objects.us-west-2.corp.example" +
+			"/dists/stable/Release",
+		"https://s3.{region}.internal/{bucket}": "https://s3.us-west-2.internal/apt-repo-bucket/dists/stable/Release",
+		"http://10.0.0.5:9000":                  "http://10.0.0.5:9000/apt-repo-bucket/dists/stable/Release",
+		"https://[fd00::10]:9000":               "https://[fd00::10]:9000/apt-repo-bucket/dists/stable/Release",
+		"https://gw.corp/api/s3/":               "https://gw.corp/api/s3/apt-repo-bucket/dists/stable/Release",
+		"https://gw.corp/api/s3":                "https://gw.corp/api/s3/apt-repo-bucket/dists/stable/Release",
+	}
+	for endpoint, expected := range specs {
+		f := New(Config{Region: "us-west-2", Endpoint: endpoint})
+		loc, err := f.Locate("s3://AKIDEXAMPLE:secret@apt-repo-bucket/dists/stable/Release")
+		if err != nil {
+			t.Fatalf("Locate() returned unexpected error: %v", err)
+		}
+		sess, config, err := NewSession(f.ClientConfig(loc))
+		if err != nil {
+			t.Fatalf("NewSession() returned unexpected error: %v", err)
+		}
+		req, _ := s3.New(sess, config).GetObjectRequest(&s3.GetObjectInput{
+			Bucket: aws.String(loc.Bucket),
+			Key:    aws.String(loc.Key),
+		})
+		if err := req.Build(); err != nil {
+			t.Fatalf("Build() returned unexpected error: %v", err)
+		}
+		actual := &url.URL{Scheme: req.HTTPRequest.URL.Scheme, Host: req.HTTPRequest.URL.Host, Path: req.HTTPRequest.URL.Path}
+		if actual.String() != expected {
+			t.Errorf("request URL for endpoint %s = %s; expected %s", endpoint, actual, expected)
+		}
+	}
+}
+
+// credentialScope matches the region of the credential scope of a signed
+// request's Authorization header.
+var credentialScope = regexp.MustCompile(`Credential=[^/]+/[^/]+/([^/]+)/s3/`) //nolint:gochecknoglobals
+
+func TestEndpointRegionPrecedence(t *testing.T) {
+	type form struct{ uri, host, region string }
+	specs := map[string]struct {
+		cfg   Config
+		forms map[string]form
+	}{
+		"endpoint and region": {
+			Config{Endpoint: "https://minio.internal:9000", Region: "eu-west-1"},
+			map[string]form{
+				"path-style":   {"minio.internal:9000/apt-repo-bucket/", "apt-repo-bucket.minio.internal:9000", "eu-west-1"},
+				"virtual-host": {"apt-repo-bucket.minio.internal:9000/", "apt-repo-bucket.minio.internal:9000", "eu-west-1"},
+				"bare bucket":  {"apt-repo-bucket/", "apt-repo-bucket.minio.internal:9000", "eu-west-1"},
+			},
+		},
+		"endpoint only": {
+			Config{Endpoint: "https://minio.internal:9000", Region: "us-east-1"},
+			map[string]form{
+				"path-style":   {"minio.internal/apt-repo-bucket/", "apt-repo-bucket.minio.internal:9000", "us-east-1"},
+				"virtual-host": {"apt-repo-bucket.minio.internal/", "apt-repo-bucket.minio.internal:9000", "us-east-1"},
+				"bare bucket":  {"apt-repo-bucket/", "apt-repo-bucket.minio.internal:9000", "us-east-1"},
+			},
+		},
+		"region only": {
+			Config{Region: "eu-west-1"},
+			map[string]form{
+				"path-style":   {"s3.eu-west-1.amazonaws.com/apt-repo-bucket/", "apt-repo-bucket.s3.eu-west-1.amazonaws.com", "eu-west-1"},
+				"virtual-host": {"apt-repo-bucket.s3.eu-west-1.amazonaws.com/", "apt-repo-bucket.s3.eu-west-1.amazonaws.com", "eu-west-1"},
+				"bare bucket":  {"apt-repo-bucket/", "apt-repo-bucket.s3.eu-west-1.amazonaws.com", "eu-west-1"},
+			},
+		},
+		// The host a URI names is connected to even if its region parameter,
+		// which the requests are signed for, would expand the template to
+		// another host.
+		"endpoint template and URI region": {
+			Config{Endpoint: "https://s3.{region}.corp.example/{bucket}", Region: "eu-west-1"},
+			map[string]form{
+				"path-style":   {"s3.eu-west-1.corp.example/apt-repo-bucket/", "s3.eu-west-1.corp.example", "us-east-2"},
+				"virtual-host": {"apt-repo-bucket.s3.eu-west-1.corp.example/", "s3.eu-west-1.corp.example", "us-east-2"},
+				"bare bucket":  {"apt-repo-bucket/", "s3.us-east-2.corp.example", "us-east-2"},
+			},
+		},
+	}
+	for name, spec := range specs {
+		for formName, form := range spec.forms {
+			t.Run(name+"/"+formName, func(t *testing.T) {
+				uri := "s3://AKIDEXAMPLE:secret@" + form.uri + "dists/stable/Release"
+				if strings.Contains(spec.cfg.Endpoint, regionPlaceholder) {
+					uri += "?region=us-east-2"
+				}
+				f := New(spec.cfg)
+				loc, err := f.Locate(uri)
+				if err != nil {
+					t.Fatalf("Locate() returned unexpected error: %v", err)
+				}
+				sess, config, err := NewSession(f.ClientConfig(loc))
+				if err != nil {
+					t.Fatalf("NewSession() returned unexpected error: %v", err)
+				}
+				req, _ := s3.New(sess, config).GetObjectRequest(&s3.GetObjectInput{
+					Bucket: aws.String(loc.Bucket),
+					Key:    aws.String(loc.Key),
+				})
+				if err := req.Sign(); err != nil {
+					t.Fatalf("Sign() returned unexpected error: %v", err)
+				}
+				if host := req.HTTPRequest.URL.Host; host != form.host {
+					t.Errorf("request host = %s; expected %s", host, form.host)
+				}
+				scope := credentialScope.FindStringSubmatch(req.HTTPRequest.Header.Get("Authorization"))
+				if scope == nil || scope[1] != form.region {
+					t.Errorf("signing region = %v; expected %s", scope, form.region)
+				}
+			})
+		}
+	}
+}
+
+func TestFetchEndpointPathPrefix(t *testing.T) {
+	var requests []string
+	var mu sync.Mutex
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/s3/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.Host+r.URL.EscapedPath())
+		mu.Unlock()
+		w.Header().Set("ETag", `"5d41402abc4b2a76b9719d911017c592"`)
+		w.Header().Set("Content-Length", "5")
+		if r.Method == http.MethodGet {
+			fmt.Fprint(w, "hello")
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	// A host name rather than the IP address of the server, whose requests
+	// would be path-style whatever the path of the endpoint.
+	host := "localhost:" + strings.TrimPrefix(server.URL, "http://127.0.0.1:")
+
+	for _, uri := range []string{
+		"s3://AKIDEXAMPLE:secret@apt-repo-bucket/dists/stable/Release",
+		"s3://AKIDEXAMPLE:secret@" + host + "/apt-repo-bucket/dists/stable/Release",
+		"s3://AKIDEXAMPLE:secret@apt-repo-bucket." + host + "/dists/stable/Release",
+	} {
+		f := New(Config{Region: "us-east-1", Endpoint: "http://" + host + "/api/s3/"})
+		if _, err := f.Fetch(context.Background(), FetchRequest{URI: uri, Filename: filepath.Join(t.TempDir(), "Release")}); err != nil {
+			t.Fatalf("Fetch(%s) returned unexpected error: %v", uri, err)
+		}
+		expected := []string{
+			"HEAD " + host + "/api/s3/apt-repo-bucket/dists/stable/Release",
+			"GET " + host + "/api/s3/apt-repo-bucket/dists/stable/Release",
+		}
+		mu.Lock()
+		actual := requests
+		requests = nil
+		mu.Unlock()
+		if diff := cmp.Diff(expected, actual); diff != "" {
+			t.Errorf("requests for %s mismatch (-want +got):\n%s", uri, diff)
+		}
+	}
+}
+
+func TestHostname(t *testing.T) {
+	specs := map[string]string{
+		"https://s3.us-west-2.amazonaws.com": "s3.us-west-2.amazonaws.com",
+		"https://minio.internal:9000/s3":     "minio.internal",
+		"http://10.0.0.5:9000":               "10.0.0.5",
+		"https://[fd00::10]":                 "[fd00::10]",
+		"https://[fd00::10]:9000":            "[fd00::10]",
+		"us-west-2":                          "us-west-2",
+	}
+	for endpoint, expected := range specs {
+		if actual := hostname(endpoint); actual != expected {
+			t.Errorf("hostname(%s) = %s; expected %s", endpoint, actual, expected)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+const (
+	// errorPageSniffLength is how many leading bytes of a download are
+	// inspected for HTML markup.
+	errorPageSniffLength = 512
+	// errorPageLineLength limits how much of the first line of an error page
+	// is quoted in the error.
+	errorPageLineLength = 200
+)
+
+// ErrErrorPage is returned by Fetch when an endpoint answered with an HTML
+// page, such as the error page of a misconfigured reverse proxy, rather than
+// the object.
+var ErrErrorPage = errors.New("the endpoint returned an error page instead of the object")
+
+// checkErrorPage returns an error wrapping ErrErrorPage, quoting the first
+// line of the page, if the downloaded file looks like an HTML page although
+// the key does not name one. It is HTML if S3 reported contentType as
+// text/html, or if the file starts with an HTML doctype or tag.
+func checkErrorPage(filename, key string, contentType *string) error {
+	switch strings.ToLower(path.Ext(key)) {
+	case ".html", ".htm":
+		return nil
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	head := make([]byte, errorPageSniffLength)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return err
+	}
+	head = head[:n]
+
+	mediaType, _, _ := mime.ParseMediaType(aws.StringValue(contentType))
+	if mediaType != "text/html" && !looksLikeHTML(head) {
+		return nil
+	}
+	return fmt.Errorf("%w, check the endpoint; the page starts with %q", ErrErrorPage, firstLine(head))
+}
+
+// looksLikeHTML tells whether head starts, after any whitespace, with an HTML
+// doctype or html tag.
+func looksLikeHTML(head []byte) bool {
+	head = bytes.ToLower(bytes.TrimLeft(head, " \t\r\n\ufeff"))
+	return bytes.HasPrefix(head, []byte("<!doctype html")) || bytes.HasPrefix(head, []byte("<html"))
+}
+
+// firstLine returns the first non-empty line of head, shortened to
+// errorPageLineLength bytes.
+func firstLine(head []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(head))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			if len(line) > errorPageLineLength {
+				line = line[:errorPageLineLength]
+			}
+			return line
+		}
+	}
+	return ""
+}
@@ -0,0 +1,101 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+)
+
+func TestFetchErrorPage(t *testing.T) {
+	const page = "\n<!DOCTYPE html>\n<html><head><title>502 Bad Gateway</title></head></html>\n"
+	specs := map[string]struct {
+		key         string
+		obj         testutil.FakeObject
+		allowHTML   bool
+		expectedErr error
+	}{
+		"doctype": {
+			"dists/stable/Release", testutil.FakeObject{Body: []byte(page)}, false, ErrErrorPage,
+		},
+		"html tag": {
+			"dists/stable/Release", testutil.FakeObject{Body: []byte("<HTML><body>Forbidden</body></HTML>")}, false, ErrErrorPage,
+		},
+		"content type": {
+			"dists/stable/Release",
+			testutil.FakeObject{Body: []byte("Service Unavailable"), ContentType: "text/html; charset=utf-8"},
+			false, ErrErrorPage,
+		},
+		"html key": {
+			"docs/index.html", testutil.FakeObject{Body: []byte(page), ContentType: "text/html"}, false, nil,
+		},
+		"allowed": {
+			"dists/stable/Release", testutil.FakeObject{Body: []byte(page), ContentType: "text/html"}, true, nil,
+		},
+		"release file": {
+			"dists/stable/Release", testutil.FakeObject{Body: []byte("Origin: Example\nSuite: stable\n")}, false, nil,
+		},
+		"empty file": {
+			"dists/stable/Release", testutil.FakeObject{Body: []byte{}}, false, nil,
+		},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			fake := testutil.NewFakeS3()
+			fake.Put("apt-repo-bucket", spec.key, spec.obj)
+			dir := t.TempDir()
+			filename := filepath.Join(dir, "Release")
+			before := testutil.SnapshotDir(t, dir)
+			f := New(Config{Region: "us-east-1", AllowHTML: spec.allowHTML},
+				WithS3ClientFactory(func(ClientConfig) (s3iface.S3API, error) {
+					return fake, nil
+				}))
+
+			_, err := f.Fetch(context.Background(), FetchRequest{URI: "s3://apt-repo-bucket/" + spec.key, Filename: filename})
+			if !errors.Is(err, spec.expectedErr) {
+				t.Fatalf("Fetch() = %v; expected %v", err, spec.expectedErr)
+			}
+			if err != nil {
+				before.CheckUnchanged(t)
+			} else if _, err := os.Stat(filename); err != nil {
+				t.Errorf("os.Stat(%s) = %v; expected the fetched file to exist", filename, err)
+			}
+		})
+	}
+}
+
+func TestFetchErrorPageQuotesFirstLine(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "dists/stable/Release",
+		testutil.FakeObject{Body: []byte("\r\n  <!DOCTYPE html>\r\n<html></html>")})
+	f := New(Config{Region: "us-east-1"}, WithS3ClientFactory(func(ClientConfig) (s3iface.S3API, error) {
+		return fake, nil
+	}))
+
+	_, err := f.Fetch(context.Background(), FetchRequest{
+		URI: "s3://apt-repo-bucket/dists/stable/Release", Filename: filepath.Join(t.TempDir(), "Release"),
+	})
+	if err == nil || !strings.Contains(err.Error(), `"<!DOCTYPE html>"`) {
+		t.Errorf("Fetch() = %v; expected it to quote the first line of the page", err)
+	}
+}
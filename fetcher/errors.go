@@ -0,0 +1,65 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// A RequestError describes a request to S3 that failed with an error
+// response. It carries the error code and message S3 returned, so that they
+// can be reported rather than a generic description.
+type RequestError struct {
+	// Op is the S3 operation, such as "HeadObject".
+	Op         string
+	Bucket     string
+	Key        string
+	Code       string
+	Message    string
+	StatusCode int
+	RequestID  string
+	Err        error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("%s s3://%s/%s failed: %s: %s (HTTP %d, request id %s)",
+		e.Op, e.Bucket, e.Key, e.Code, e.Message, e.StatusCode, e.RequestID)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// requestError wraps err in a RequestError if it is an awserr.RequestFailure,
+// and returns any other error unchanged.
+func requestError(op string, loc Location, err error) error {
+	var reqErr awserr.RequestFailure
+	if !errors.As(err, &reqErr) {
+		return err
+	}
+	return &RequestError{
+		Op:         op,
+		Bucket:     loc.Bucket,
+		Key:        loc.Key,
+		Code:       reqErr.Code(),
+		Message:    reqErr.Message(),
+		StatusCode: reqErr.StatusCode(),
+		RequestID:  reqErr.RequestID(),
+		Err:        err,
+	}
+}
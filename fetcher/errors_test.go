@@ -0,0 +1,65 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestRequestError(t *testing.T) {
+	loc := Location{Bucket: "apt-repo-bucket", Key: "dists/stable/Release"}
+	reqErr := awserr.NewRequestFailure(
+		awserr.New("AccessDenied", "Access Denied", nil), http.StatusForbidden, "4442587FB7D0A2F9")
+
+	err := requestError("GetObject", loc, reqErr)
+	expected := &RequestError{
+		Op:         "GetObject",
+		Bucket:     "apt-repo-bucket",
+		Key:        "dists/stable/Release",
+		Code:       "AccessDenied",
+		Message:    "Access Denied",
+		StatusCode: http.StatusForbidden,
+		RequestID:  "4442587FB7D0A2F9",
+	}
+	var actual *RequestError
+	if !errors.As(err, &actual) {
+		t.Fatalf("requestError() = %v; expected a *RequestError", err)
+	}
+	if diff := cmp.Diff(expected, actual, cmpopts.IgnoreFields(RequestError{}, "Err")); diff != "" {
+		t.Errorf("requestError() mismatch (-want +got):\n%s", diff)
+	}
+	if !errors.Is(err, reqErr) {
+		t.Errorf("requestError() = %v; expected it to wrap %v", err, reqErr)
+	}
+	expectedMsg := "GetObject s3://apt-repo-bucket/dists/stable/Release failed: AccessDenied: Access Denied " +
+		"(HTTP 403, request id 4442587FB7D0A2F9)"
+	if err.Error() != expectedMsg {
+		t.Errorf("requestError() = %q; expected %q", err, expectedMsg)
+	}
+}
+
+func TestRequestErrorPassesOtherErrors(t *testing.T) {
+	otherErr := errors.New("connection reset by peer")
+	if err := requestError("GetObject", Location{}, otherErr); err != otherErr { //nolint:errorlint
+		t.Errorf("requestError() = %v; expected %v unchanged", err, otherErr)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ErrObjectChanged is returned by Fetch when the object was replaced between
+// its HeadObject and its download, every time it was fetched.
+var ErrObjectChanged = errors.New("object changed during the download")
+
+// getObjectInput returns the input of a GetObject of the object at loc that
+// fails with a 412 unless the object still has the given ETag, the one its
+// HeadObject reported, so that the file matches the metadata apt was told
+// about. An empty ETag makes the GetObject unconditional.
+func getObjectInput(loc Location, etag string) *s3.GetObjectInput {
+	input := &s3.GetObjectInput{Bucket: aws.String(loc.Bucket), Key: aws.String(loc.Key)}
+	if etag != "" {
+		input.IfMatch = aws.String(etag)
+	}
+	return input
+}
+
+// fetchUnchanged downloads the object at loc as described by req from the
+// given endpoint like fetchFrom does. If the object changed after its
+// HeadObject, the HeadObject and download are repeated once before an error
+// wrapping ErrObjectChanged is returned.
+func (f *Fetcher) fetchUnchanged(ctx context.Context, req FetchRequest, loc Location, endpoint string) (FetchResult, error) {
+	result, err := f.fetchFrom(ctx, req, loc, endpoint)
+	if !isPreconditionFailed(err) {
+		return result, err
+	}
+	if req.OnObjectChanged != nil {
+		req.OnObjectChanged(err)
+	}
+	result, err = f.fetchFrom(ctx, req, loc, endpoint)
+	if isPreconditionFailed(err) {
+		return FetchResult{}, fmt.Errorf("%w: s3://%s/%s: %w", ErrObjectChanged, loc.Bucket, loc.Key, err)
+	}
+	return result, err
+}
+
+// isPreconditionFailed tells whether err stems from S3 refusing a conditional
+// request because its condition did not hold.
+func isPreconditionFailed(err error) bool {
+	var reqErr awserr.RequestFailure
+	return errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusPreconditionFailed
+}
@@ -0,0 +1,99 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+)
+
+func TestFetchObjectChanged(t *testing.T) {
+	specs := map[string]struct {
+		swaps           int
+		expectedErr     error
+		expectedChanges int
+		expectedHeads   int
+		expectedContent string
+	}{
+		"unchanged":          {0, nil, 0, 1, "version 0"},
+		"changed once":       {1, nil, 1, 2, "version 1"},
+		"changed every time": {3, ErrObjectChanged, 1, 2, ""},
+	}
+	for name, spec := range specs {
+		for _, disableMultipart := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/multipart disabled %t", name, disableMultipart), func(t *testing.T) {
+				const key = "apt/generic/hello.deb"
+				fake := testutil.NewFakeS3()
+				version := 0
+				put := func() {
+					fake.Put("apt-repo-bucket", key, testutil.FakeObject{
+						Body: []byte(fmt.Sprintf("version %d", version)),
+						ETag: fmt.Sprintf(`"%d"`, version),
+					})
+				}
+				put()
+				fake.BeforeGet = func(string) {
+					if version < spec.swaps {
+						version++
+						put()
+					}
+				}
+				filename := filepath.Join(t.TempDir(), "hello.deb")
+				f := New(Config{Region: "us-east-1", DisableMultipart: disableMultipart},
+					WithS3ClientFactory(func(ClientConfig) (s3iface.S3API, error) { return fake, nil }))
+
+				changes := 0
+				result, err := f.Fetch(context.Background(), FetchRequest{
+					URI:             testURI,
+					Filename:        filename,
+					OnObjectChanged: func(error) { changes++ },
+				})
+				if !errors.Is(err, spec.expectedErr) {
+					t.Fatalf("Fetch() = %v; expected %v", err, spec.expectedErr)
+				}
+				if changes != spec.expectedChanges {
+					t.Errorf("OnObjectChanged called %d times; expected %d", changes, spec.expectedChanges)
+				}
+				if heads := fake.Heads(); heads != spec.expectedHeads {
+					t.Errorf("HeadObject called %d times; expected %d", heads, spec.expectedHeads)
+				}
+				if err != nil {
+					if _, statErr := os.Stat(filename); !os.IsNotExist(statErr) {
+						t.Errorf("%s left behind after a failed fetch: %v", filename, statErr)
+					}
+					return
+				}
+				contents, err := os.ReadFile(filename)
+				if err != nil {
+					t.Fatalf("failed to read fetched file: %v", err)
+				}
+				if string(contents) != spec.expectedContent || result.Size != int64(len(spec.expectedContent)) {
+					t.Errorf("fetched %q (%d bytes); expected %q", contents, result.Size, spec.expectedContent)
+				}
+				if expected := fmt.Sprintf(`"%d"`, spec.swaps); result.ETag != expected {
+					t.Errorf("ETag = %s; expected %s", result.ETag, expected)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"os"
+)
+
+// existingResult returns the result of a fetch of req that a complete file
+// already at req.Filename makes unnecessary, as apt leaves behind in its
+// partial directory when a run was interrupted after a download finished. The
+// file must match at least one expected digest and every expected digest, and
+// be no larger than the maximum size and exactly the expected size the request
+// gives, if any. Its modification time stands in for the object's.
+func existingResult(req FetchRequest) (FetchResult, bool) {
+	if req.ExpectedHashes == (Digests{}) {
+		return FetchResult{}, false
+	}
+	info, err := os.Stat(req.Filename)
+	if err != nil || !info.Mode().IsRegular() {
+		return FetchResult{}, false
+	}
+	if (req.ExpectedSize > 0 && info.Size() != req.ExpectedSize) || (req.MaxSize > 0 && info.Size() > req.MaxSize) {
+		return FetchResult{}, false
+	}
+	digests, err := FileDigests(req.Filename)
+	if err != nil || req.ExpectedHashes.verify(digests) != nil {
+		return FetchResult{}, false
+	}
+	return FetchResult{
+		Object:  Object{Size: info.Size(), LastModified: info.ModTime()},
+		Digests: digests,
+		Reused:  true,
+	}, true
+}
@@ -0,0 +1,82 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+)
+
+func TestFetchReusesExistingFile(t *testing.T) {
+	const sha256Hello = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	modified := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	specs := map[string]struct {
+		reuse    bool
+		existing string
+		req      FetchRequest
+		reused   bool
+	}{
+		"complete":        {true, "hello", FetchRequest{ExpectedHashes: Digests{SHA256: sha256Hello}, ExpectedSize: 5}, true},
+		"within max size": {true, "hello", FetchRequest{ExpectedHashes: Digests{SHA256: sha256Hello}, MaxSize: 5}, true},
+		"disabled":        {false, "hello", FetchRequest{ExpectedHashes: Digests{SHA256: sha256Hello}}, false},
+		"truncated":       {true, "hel", FetchRequest{ExpectedHashes: Digests{SHA256: sha256Hello}}, false},
+		"other size":      {true, "hello", FetchRequest{ExpectedHashes: Digests{SHA256: sha256Hello}, ExpectedSize: 6}, false},
+		"no hashes":       {true, "hello", FetchRequest{}, false},
+		"missing":         {true, "", FetchRequest{ExpectedHashes: Digests{SHA256: sha256Hello}}, false},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			fake := testutil.NewFakeS3()
+			fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+			req := spec.req
+			req.URI, req.Filename = testURI, filepath.Join(t.TempDir(), "hello.deb")
+			if spec.existing != "" {
+				if err := os.WriteFile(req.Filename, []byte(spec.existing), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(req.Filename, modified, modified); err != nil {
+					t.Fatal(err)
+				}
+			}
+			f := New(Config{Region: "us-east-1", ReuseExisting: spec.reuse}, WithS3ClientFactory(func(ClientConfig) (s3iface.S3API, error) {
+				return fake, nil
+			}))
+
+			result, err := f.Fetch(context.Background(), req)
+			if err != nil {
+				t.Fatalf("Fetch() returned unexpected error: %v", err)
+			}
+			if result.Reused != spec.reused {
+				t.Errorf("Fetch().Reused = %t; expected %t", result.Reused, spec.reused)
+			}
+			if requests := fake.Heads() + fake.Gets(); spec.reused && requests != 0 {
+				t.Errorf("Fetch() made %d requests to S3; expected none", requests)
+			}
+			if spec.reused && !result.LastModified.Equal(modified) {
+				t.Errorf("Fetch().LastModified = %s; expected the modification time %s of the file", result.LastModified, modified)
+			}
+			if result.Size != 5 || result.Digests.SHA256 != sha256Hello {
+				t.Errorf("Fetch() = size %d, SHA256 %s; expected size 5, SHA256 %s", result.Size, result.Digests.SHA256, sha256Hello)
+			}
+		})
+	}
+}
@@ -0,0 +1,892 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fetcher downloads objects identified by s3:// URIs to local files.
+// It resolves the S3 endpoint and credentials for a URI, downloads the object
+// and computes the digests apt expects, independently of the APT method
+// protocol.
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+
+	"github.com/google/apt-golang-s3/clock"
+)
+
+var (
+	// ErrNotFound is returned by Fetch when the requested object does not exist.
+	ErrNotFound = errors.New("the specified key does not exist")
+	// ErrBucketNotFound is returned by Fetch when the bucket of the requested
+	// object does not exist.
+	ErrBucketNotFound = errors.New("the specified bucket does not exist")
+	// ErrTooLarge is returned by Fetch when the requested object is larger than
+	// the FetchRequest allows.
+	ErrTooLarge = errors.New("object exceeds the maximum size")
+	// ErrSizeMismatch is returned by Fetch when the number of bytes downloaded
+	// differs from the size S3 reported for the object.
+	ErrSizeMismatch = errors.New("downloaded size does not match the object size")
+	// ErrHashMismatch is returned by Fetch when a digest of the downloaded file
+	// differs from the one the FetchRequest expects.
+	ErrHashMismatch = errors.New("hash sum mismatch")
+	// ErrWriteFile is returned by Fetch when the downloaded file could not be
+	// written to disk completely, for example because the disk is full or not
+	// writable. Any partially written file is removed.
+	ErrWriteFile = errors.New("failed to write the downloaded file")
+	// ErrCredentialsExpired is returned by Fetch when S3 reports the
+	// credentials expired even after they were refreshed.
+	ErrCredentialsExpired = errors.New("the credentials expired")
+)
+
+// minThroughput is the download speed, in bytes per second, assumed when
+// estimating whether credentials outlive a download.
+const minThroughput = 1 << 20
+
+// A Config holds the S3 settings shared by all fetches of a Fetcher.
+type Config struct {
+	// Region is the AWS region of the S3 endpoint.
+	Region string
+	// Endpoint, when set, is the URL of an S3 compatible service to use instead
+	// of the regional AWS endpoint. It may be a template with {bucket} and
+	// {region} placeholders, which are expanded for each fetch.
+	Endpoint string
+	// HostEndpoints maps URI hosts to the endpoints, or endpoint templates,
+	// objects of URIs with that host are fetched from instead of Endpoint and
+	// its fallbacks. A host also matches the URIs of its subdomains; of several
+	// matching hosts, the longest wins.
+	HostEndpoints map[string]string
+	// BucketAliases maps bucket names used in URIs to the names of the buckets
+	// actually fetched from, so that the same URIs can refer to different
+	// buckets in different environments.
+	BucketAliases map[string]string
+	// FallbackEndpoints are tried in order, for the same bucket and key, when
+	// a fetch from the endpoint before them fails because it could not be
+	// reached or answered with a server error. An empty string stands for the
+	// regional AWS endpoint.
+	FallbackEndpoints []string
+	// RoleARN, when set, is assumed for fetches of URIs without static
+	// credentials.
+	RoleARN string
+	// RoleSourceIdentity, when set, is passed as the source identity when
+	// assuming RoleARN, as trust policies requiring sts:SourceIdentity demand.
+	RoleSourceIdentity string
+	// STSEndpoint, when set, is the URL of the STS service RoleARN is assumed
+	// through, e.g. a VPC endpoint, instead of the regional STS endpoint.
+	STSEndpoint string
+	// RoleCache, when set, keeps the credentials of the roles assumed by
+	// fetches for later ones, until they expire.
+	RoleCache *RoleCache
+	// Transports, when set, keeps the HTTP transports of fetches for later
+	// ones, so that they reuse the connections to S3 earlier ones opened.
+	Transports *TransportCache
+	// AuthEntries provide static credentials for URIs that do not embed any,
+	// as read from apt's auth.conf by LoadAuthConf.
+	AuthEntries []AuthEntry
+	// SharedCredentialsFile and SharedConfigFile, when set, are read instead of
+	// the shared AWS credentials and configuration files in the home directory
+	// or named by AWS_SHARED_CREDENTIALS_FILE and AWS_CONFIG_FILE.
+	SharedCredentialsFile, SharedConfigFile string
+	// DisableIMDS keeps fetches from asking the EC2 instance metadata service
+	// for credentials, so that a machine without any fails fast rather than
+	// after IMDS timed out. AWS_EC2_METADATA_DISABLED=true has the same effect.
+	DisableIMDS bool
+	// DisableSSL makes fetches use plain HTTP, as the s3+http method does.
+	DisableSSL bool
+	// Accelerate makes fetches use S3 Transfer Acceleration, as the s3+accel
+	// method does.
+	Accelerate bool
+	// UserAsProfile makes a URI user name without a password name the shared
+	// configuration profile to take credentials from, as in
+	// s3://profile-name@bucket/key, rather than be an incomplete pair of
+	// static credentials.
+	UserAsProfile bool
+	// Cache, when set, holds copies of previously fetched objects, which are
+	// used instead of downloading objects whose ETag did not change.
+	Cache *Cache
+	// ReuseExisting makes Fetch report a file already at the Filename of a
+	// request as fetched, without asking S3, if its size and digests are
+	// those the request expects.
+	ReuseExisting bool
+	// KeyIndex, when set, lists the keys below the prefix of each requested
+	// key once, so that keys that do not exist fail without a HeadObject.
+	KeyIndex *KeyIndex
+	// Fsync makes Fetch flush each downloaded file to stable storage before
+	// computing its digests.
+	Fsync bool
+	// DecodeContent makes Fetch decompress objects stored with
+	// Content-Encoding: gzip, so that the file and its digests and size are
+	// those of the decoded content. By default such objects are written as
+	// stored.
+	DecodeContent bool
+	// ListFallback makes Fetch learn the size and modification time of an
+	// object by listing its key when HeadObject is forbidden, as it is for
+	// credentials that may list the bucket but not read object metadata.
+	ListFallback bool
+	// VerifyParts makes Fetch download objects uploaded in parts with
+	// checksums part by part, failing as soon as a part does not match its
+	// checksum rather than after the whole object was downloaded.
+	VerifyParts bool
+	// Throttle, when set, paces the requests of all fetches and retries
+	// fetches S3 throttled.
+	Throttle *Throttle
+	// DiskSpace, when set, accounts for the bytes concurrent fetches are about
+	// to write, deferring or failing fetches that would overcommit the disk.
+	DiskSpace *DiskSpace
+	// ClockOffset, when set, measures how far the local clock is from S3's,
+	// and corrects for it when the expiry of credentials is checked.
+	ClockOffset *ClockOffset
+	// BucketRegions, when set, discovers the region of the bucket of every
+	// fetch whose Location names none, which the fetch is then sent to and
+	// signed for instead of Region.
+	BucketRegions *BucketRegions
+	// CSEKMSKeyID, when set, is the only KMS key objects stored with
+	// client-side encryption may be decrypted with. Such objects are
+	// decrypted with whatever key their envelope names otherwise.
+	CSEKMSKeyID string
+	// Latest makes Fetch accept URIs ending in '/' with ?latest=true, or with
+	// a path segment starting with latest:, and fetch the most recently
+	// modified object below the prefix they name, which takes a ListObjectsV2.
+	Latest bool
+	// PartSize, when positive, is the size of the ranged requests objects are
+	// downloaded in. Otherwise it is chosen per object, growing with the
+	// object's size.
+	PartSize int64
+	// DisableMultipart makes Fetch download every object in a single
+	// GetObject written in order, for S3 compatible services that mishandle
+	// concurrent ranged requests. Otherwise an object downloaded in ranged
+	// requests that does not match its size or digests is downloaded again
+	// that way.
+	DisableMultipart bool
+	// ResumeAttempts is how often a download in a single GetObject that the
+	// connection broke off is resumed from where it stopped before it fails.
+	// Zero makes such downloads fail at once.
+	ResumeAttempts int
+	// GetEmptyObjects makes Fetch download objects HeadObject reports as empty
+	// with a single GetObject of the whole object, rather than create their
+	// files without asking S3 for their content at all.
+	GetEmptyObjects bool
+	// IdleTimeout, when positive, is how long the HTTP connections of fetches
+	// are kept open while idle before they are closed, rather than Go's
+	// default of 90 seconds, so that none outlives a pause between fetches
+	// that proxies would cut them after.
+	IdleTimeout time.Duration
+	// IdleTracker, when set, counts the fetches in flight.
+	IdleTracker *IdleTracker
+	// DisablePreallocate keeps Fetch from preallocating the file of an object
+	// of known size before downloading it, for filesystems where that is
+	// slow or unsupported.
+	DisablePreallocate bool
+	// SSLCert and SSLKey name the client certificate and private key
+	// presented to the configured Endpoint, as ClientConfig describes.
+	SSLCert, SSLKey string
+	// TLSMinVersion and TLSRestrictCiphers control the TLS negotiated with
+	// every endpoint, as ClientConfig describes.
+	TLSMinVersion      uint16
+	TLSRestrictCiphers bool
+	// FileMode is the permissions fetched files are given, whatever the umask.
+	// Zero means DefaultFileMode.
+	FileMode os.FileMode
+	// SandboxUser, when set, names the user apt's sandboxed methods run as,
+	// to whom fetched files in apt's partial directory are handed when
+	// running as root.
+	SandboxUser string
+	// AllowHTML turns off the check that fails fetches of objects that look
+	// like HTML pages although their keys do not end in .html, for buckets
+	// that legitimately serve such objects.
+	AllowHTML bool
+}
+
+// A Fetcher downloads objects from S3.
+type Fetcher struct {
+	cfg         Config
+	newS3Client S3ClientFactory
+	clock       clock.Clock
+	createFile  func(name string) (outputFile, error)
+	// newKMSClient creates the KMS clients data keys of encrypted objects are
+	// decrypted with.
+	newKMSClient func(p client.ConfigProvider, cfgs ...*aws.Config) kmsiface.KMSAPI
+}
+
+// An outputFile is the file a Fetcher writes an object to.
+type outputFile interface {
+	io.WriterAt
+	Name() string
+	Sync() error
+	Close() error
+}
+
+// An Option customizes a Fetcher created by New.
+type Option func(*Fetcher)
+
+// WithS3ClientFactory makes the Fetcher build its S3 clients with the given
+// factory instead of creating AWS sessions itself.
+func WithS3ClientFactory(factory S3ClientFactory) Option {
+	return func(f *Fetcher) {
+		f.newS3Client = factory
+	}
+}
+
+// WithClock makes the Fetcher tell time with the given Clock instead of the
+// real one.
+func WithClock(clk clock.Clock) Option {
+	return func(f *Fetcher) {
+		f.clock = clk
+	}
+}
+
+// New returns a new Fetcher for the given Config.
+func New(cfg Config, opts ...Option) *Fetcher {
+	f := &Fetcher{cfg: cfg, newS3Client: NewS3Client, clock: clock.Real{}, createFile: createFile, newKMSClient: kmsClient}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+// A FetchRequest describes a single object to fetch.
+type FetchRequest struct {
+	// URI is the s3:// URI of the object, optionally carrying static
+	// credentials in its user information.
+	URI string
+	// Filename is the path the object is written to.
+	Filename string
+	// ExpectedHashes holds the digests the downloaded file must match. Empty
+	// digests are not checked.
+	ExpectedHashes Digests
+	// MaxSize is the largest object size accepted, in bytes. Zero means there
+	// is no limit.
+	MaxSize int64
+	// ExpectedSize is the size of the object, in bytes, if known in advance.
+	// Zero means it is not. Only a file already at Filename that has this
+	// size is reused.
+	ExpectedSize int64
+	// OnStart, when set, is called once the object's metadata is known and
+	// before its content is downloaded. Without a size from HeadObject, it
+	// waits for the headers of the download, which report it.
+	OnStart func(obj Object)
+	// OnProgress, when set, is called with the number of bytes written to
+	// Filename so far as the download proceeds. It restarts from zero if the
+	// download is repeated.
+	OnProgress func(written int64)
+	// OnConnect, when set, is called with the host name of the endpoint before
+	// the object is requested from it.
+	OnConnect func(host string)
+	// OnHeaders, when set, is called when the request for the object's
+	// metadata is dispatched.
+	OnHeaders func()
+	// OnFallback, when set, is called with the error of a failed attempt before
+	// the fetch is retried against the given fallback endpoint.
+	OnFallback func(endpoint string, err error)
+	// OnCredentialsRefresh, when set, is called with the reason and the
+	// refreshed credentials whenever the credentials of the fetch are
+	// refreshed before or during the download.
+	OnCredentialsRefresh func(reason string, info CredentialsInfo)
+	// OnThrottle, when set, is called with the delay before a fetch S3
+	// throttled is retried.
+	OnThrottle func(delay time.Duration)
+	// OnSequentialRetry, when set, is called with the error of a download in
+	// ranged requests before the object is downloaded again in a single
+	// request.
+	OnSequentialRetry func(err error)
+	// OnResume, when set, is called with the number of bytes written so far
+	// and the error that broke off a download in a single request before the
+	// rest of the object is requested.
+	OnResume func(offset int64, err error)
+	// OnObjectChanged, when set, is called with the error of a download that
+	// failed because the object changed after its HeadObject, before both are
+	// repeated.
+	OnObjectChanged func(err error)
+	// OnDiskSpaceWait, when set, is called with the ErrInsufficientSpace of a
+	// fetch the Config's DiskSpace defers until concurrent fetches finish.
+	OnDiskSpaceWait func(err error)
+	// OnClockSkew, when set, is called with how far S3's clock is ahead of the
+	// local one, negative if it is behind, when the Config's ClockOffset
+	// records it from the response to the object's HeadObject.
+	OnClockSkew func(skew time.Duration)
+	// OnBucketRegion, when set, is called with the region the Config's
+	// BucketRegions discovered for the bucket, or the error it failed with,
+	// by the one fetch of the bucket that discovered it.
+	OnBucketRegion func(region string, err error)
+}
+
+// An Object describes the metadata of a fetched object.
+type Object struct {
+	// Size is the size of the object in bytes. It is -1 when passed to OnStart
+	// for an object whose size S3 did not report before the download.
+	Size int64
+	// LastModified is the zero time if S3 did not report it.
+	LastModified time.Time
+}
+
+// A FetchResult describes a completed fetch.
+type FetchResult struct {
+	Object
+	Digests Digests
+	Timings Timings
+	// Endpoint is the URL of the endpoint the object was fetched from.
+	Endpoint string
+	// ETag is the entity tag HeadObject reported for the object, if any, which
+	// the download was conditional on.
+	ETag string
+	// Cached tells whether the object was copied from the Config's Cache
+	// rather than downloaded.
+	Cached bool
+	// Reused tells whether the file already at the Filename of the request was
+	// complete, as the Config's ReuseExisting allows, and S3 not asked at all.
+	Reused bool
+	// Credentials describes the credentials the object was fetched with.
+	Credentials CredentialsInfo
+	// Decoded tells whether the object was stored gzip-encoded and written
+	// decoded, as the Config's DecodeContent asks for.
+	Decoded bool
+	// Decrypted tells whether the object was stored with client-side
+	// encryption and written decrypted.
+	Decrypted bool
+	// Sequential tells whether the object was downloaded in a single request
+	// rather than in ranged ones, as the Config's DisableMultipart asks for or
+	// after a download in ranged requests did not match.
+	Sequential bool
+	// Resumes counts how often a Sequential download was resumed after the
+	// connection broke off, as the Config's ResumeAttempts allows.
+	Resumes int
+	// KMSKeyID names the KMS key a Decrypted object's data key was decrypted
+	// with, if the Config or the object's envelope named one.
+	KMSKeyID string
+	// LatestKey is the key of the object fetched for a URI asking for the
+	// latest object below a prefix.
+	LatestKey string
+}
+
+// Fetch downloads the object described by req to req.Filename, falling back
+// to the Config's FallbackEndpoints in turn if an endpoint fails. If S3 asks
+// to slow down, the fetch is retried as the Config's Throttle allows. The file
+// is given the Config's FileMode. If the Config's ReuseExisting says so, a
+// complete file already at req.Filename is kept instead of being downloaded
+// again. The fetch waits for concurrent ones, or fails, if the Config's
+// DiskSpace finds too little space for the object. Unless the URI names the
+// region of the bucket, the Config's BucketRegions, if any, discovers it
+// first. If the fetch fails for whatever reason, including ctx being cancelled
+// during the download, the file it wrote to req.Filename, if any, is removed.
+func (f *Fetcher) Fetch(ctx context.Context, req FetchRequest) (FetchResult, error) {
+	f.cfg.IdleTracker.begin()
+	defer func() { f.cfg.IdleTracker.end(f.clock.Now()) }()
+	loc, err := f.Locate(req.URI)
+	if err != nil {
+		return FetchResult{}, err
+	}
+	if f.cfg.ReuseExisting {
+		if result, ok := existingResult(req); ok {
+			if req.OnStart != nil {
+				req.OnStart(result.Object)
+			}
+			return result, nil
+		}
+	}
+	if region := f.bucketRegion(ctx, req, loc); region != "" {
+		loc.Region = region
+	}
+	output := recordOutput(req.Filename)
+	result, err := f.fetchWithRetries(ctx, req, loc)
+	if err == nil {
+		err = f.setPermissions(req.Filename)
+	}
+	if err != nil {
+		output.cleanUp()
+		return FetchResult{}, err
+	}
+	return result, nil
+}
+
+// fetchWithRetries downloads the object at loc as described by req, retrying
+// as the Config's Throttle allows if S3 asks to slow down.
+func (f *Fetcher) fetchWithRetries(ctx context.Context, req FetchRequest, loc Location) (FetchResult, error) {
+	// OnStart must be called only once, however many endpoints and attempts are
+	// tried.
+	onStart := req.OnStart
+	req.OnStart = func(obj Object) {
+		if onStart != nil {
+			onStart(obj)
+			onStart = nil
+		}
+	}
+	if req.OnConnect == nil {
+		req.OnConnect = func(string) {}
+	}
+	if req.OnHeaders == nil {
+		req.OnHeaders = func() {}
+	}
+	for attempt := 0; ; attempt++ {
+		result, err := f.fetchFromEndpoints(ctx, req, loc)
+		if f.cfg.Throttle == nil || !isSlowDown(err) {
+			return result, err
+		}
+		if f.cfg.Throttle.exhausted(attempt) {
+			return FetchResult{}, fmt.Errorf("%w after %d attempts: %w", ErrThrottled, attempt+1, err)
+		}
+		delay := f.cfg.Throttle.slowDown(attempt)
+		if req.OnThrottle != nil {
+			req.OnThrottle(delay)
+		}
+	}
+}
+
+// fetchFromEndpoints downloads the object at loc as described by req from the
+// Config's endpoint, or the one loc names, falling back to the Config's
+// FallbackEndpoints in turn if an endpoint fails.
+func (f *Fetcher) fetchFromEndpoints(ctx context.Context, req FetchRequest, loc Location) (FetchResult, error) {
+	endpoints := append([]string{f.cfg.Endpoint}, f.cfg.FallbackEndpoints...)
+	if loc.Endpoint != "" {
+		endpoints = []string{loc.Endpoint}
+	}
+	for idx := 0; ; idx++ {
+		result, err := f.fetchUnchanged(ctx, req, loc, endpoints[idx])
+		if err == nil || idx == len(endpoints)-1 || !isEndpointFailure(err) {
+			return result, err
+		}
+		if req.OnFallback != nil {
+			req.OnFallback(f.endpointName(endpoints[idx+1]), err)
+		}
+	}
+}
+
+// fetchFrom downloads the object at loc as described by req from the given
+// endpoint.
+func (f *Fetcher) fetchFrom(ctx context.Context, req FetchRequest, loc Location, endpoint string) (FetchResult, error) {
+	cfg := f.clientConfig(loc, endpoint)
+	result := FetchResult{Endpoint: f.endpointName(displayEndpoint(endpoint, loc.Bucket, f.hostRegion(loc, endpoint, cfg.Region)))}
+	req.OnConnect(hostname(result.Endpoint))
+	start := f.clock.Now()
+	client, err := f.newS3Client(cfg)
+	if err != nil {
+		return FetchResult{}, err
+	}
+	result.Timings.Credentials = f.since(start)
+	result.Credentials = credentialsInfo(client)
+
+	if loc.Latest {
+		if err := f.throttle(ctx); err != nil {
+			return FetchResult{}, err
+		}
+		if loc.Key, err = latestKey(ctx, client, loc); err != nil {
+			return FetchResult{}, err
+		}
+		loc.Latest, result.LatestKey = false, loc.Key
+	}
+	if f.cfg.KeyIndex != nil {
+		if exists, known := f.cfg.KeyIndex.exists(ctx, client, loc); known && !exists {
+			return FetchResult{}, fmt.Errorf("%w: bucket %s, key %s", ErrNotFound, loc.Bucket, loc.Key)
+		}
+	}
+
+	if err := f.throttle(ctx); err != nil {
+		return FetchResult{}, err
+	}
+	start = f.clock.Now()
+	req.OnHeaders()
+	headObjectInput := &s3.HeadObjectInput{Bucket: aws.String(loc.Bucket), Key: aws.String(loc.Key)}
+	var date string
+	headObjectOutput, err := client.HeadObjectWithContext(ctx, headObjectInput, request.WithGetResponseHeader("Date", &date))
+	result.Timings.HeadObject = f.since(start)
+	if ctx.Err() != nil {
+		return FetchResult{}, ctx.Err()
+	}
+	if err != nil && f.cfg.ListFallback && isForbidden(err) {
+		if headObjectOutput, err = headFromList(ctx, client, loc, err); err != nil {
+			return FetchResult{}, err
+		}
+	}
+	if err != nil {
+		var reqErr awserr.RequestFailure
+		if errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusNotFound {
+			if !f.bucketExists(ctx, client, loc) {
+				return FetchResult{}, fmt.Errorf("%w: %s", ErrBucketNotFound, loc.Bucket)
+			}
+			return FetchResult{}, fmt.Errorf("%w: bucket %s, key %s", ErrNotFound, loc.Bucket, loc.Key)
+		}
+		return FetchResult{}, requestError("HeadObject", loc, err)
+	}
+
+	serverTime, _ := http.ParseTime(date)
+	if skew, recorded := f.cfg.ClockOffset.measure(serverTime, f.clock.Now()); recorded && req.OnClockSkew != nil {
+		req.OnClockSkew(skew)
+	}
+	// Some S3 compatible services and Object Lambda access points omit these,
+	// so the size is then taken from the download itself.
+	result.Size = -1
+	if headObjectOutput.ContentLength != nil {
+		result.Size = *headObjectOutput.ContentLength
+	}
+	result.LastModified = aws.TimeValue(headObjectOutput.LastModified)
+	if req.MaxSize > 0 && result.Size > req.MaxSize {
+		return FetchResult{}, fmt.Errorf("%w: %d bytes, limit %d", ErrTooLarge, result.Size, req.MaxSize)
+	}
+	if f.cfg.DecodeContent && isGzipEncoded(headObjectOutput.ContentEncoding) {
+		// The reported size is that of the encoded object, the decoded size
+		// is only known once it was downloaded.
+		result.Size, result.Decoded = -1, true
+	}
+	f.recordEnvelope(headObjectOutput.Metadata, &result)
+	result.ETag = aws.StringValue(headObjectOutput.ETag)
+	// The size of an object HeadObject did not report is taken from the
+	// headers of a single GetObject, before which apt is not told about the
+	// download, as it could not tell how far along it is.
+	unsized := result.Size < 0 && !result.Decoded && !result.Decrypted
+	// Ranged requests for empty objects have no range to ask for, which some
+	// S3 compatible services fail.
+	result.Sequential = f.cfg.DisableMultipart || unsized || result.Size == 0
+	release, err := f.cfg.DiskSpace.reserve(ctx, req.Filename, result.Size, req.OnDiskSpaceWait)
+	if err != nil {
+		return FetchResult{}, err
+	}
+	defer release()
+	if !unsized {
+		req.OnStart(result.Object)
+	}
+
+	attempt := result
+	err = f.transfer(ctx, client, loc, req, headObjectOutput, &result)
+	if err != nil && !result.Sequential && !result.Cached && !result.Decoded && !result.Decrypted && isRangedMismatch(err) {
+		if req.OnSequentialRetry != nil {
+			req.OnSequentialRetry(err)
+		}
+		result = attempt
+		result.Sequential = true
+		err = f.transfer(ctx, client, loc, req, headObjectOutput, &result)
+	}
+	if err != nil {
+		return FetchResult{}, err
+	}
+	// Unsized objects copied from the Cache, unlike those downloaded, have not
+	// been started yet; OnStart does nothing for every other object.
+	req.OnStart(result.Object)
+	return result, nil
+}
+
+// transfer writes the object at loc, described by head, to the file of req,
+// copying it from the Config's Cache if it holds the object, or just creating
+// the file if the object is empty and the Config does not ask to get such
+// objects, and verifies the file's size, content and digests, which it
+// records in result.
+func (f *Fetcher) transfer(
+	ctx context.Context, client s3iface.S3API, loc Location, req FetchRequest, head *s3.HeadObjectOutput, result *FetchResult,
+) error {
+	etag := result.ETag
+	empty := result.Size == 0 && !result.Decrypted
+	if empty && !f.cfg.GetEmptyObjects {
+		if err := f.createEmptyFile(req.Filename); err != nil {
+			return err
+		}
+	} else if f.cfg.Cache != nil && etag != "" && f.cfg.Cache.get(loc, etag, result.Size, req.Filename) {
+		result.Cached = true
+		if info, err := os.Stat(req.Filename); err == nil {
+			result.Size = info.Size()
+		}
+	} else if err := f.throttle(ctx); err != nil {
+		return err
+	} else if err := f.downloadWithFreshCredentials(ctx, client, loc, req, result); err != nil {
+		return err
+	}
+	if req.MaxSize > 0 && result.Size > req.MaxSize {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrTooLarge, result.Size, req.MaxSize)
+	}
+	// An empty file is no error page, whatever the Content-Type of its object.
+	if !f.cfg.AllowHTML && !result.Cached && !empty {
+		if err := checkErrorPage(req.Filename, loc.Key, head.ContentType); err != nil {
+			return err
+		}
+	}
+
+	// A download in a single request hashes the object as it goes.
+	if result.Digests == (Digests{}) {
+		start := f.clock.Now()
+		digests, err := FileDigests(req.Filename)
+		if err != nil {
+			return err
+		}
+		result.Digests, result.Timings.Hashing = digests, f.since(start)
+	}
+	if err := req.ExpectedHashes.verify(result.Digests); err != nil {
+		return err
+	}
+	if f.cfg.Cache != nil && etag != "" && !result.Cached && !empty {
+		// A failure to cache the object does not fail the fetch.
+		f.cfg.Cache.put(loc, etag, req.Filename) //nolint:errcheck
+	}
+	return nil
+}
+
+// download writes the object at loc to the file of req and checks that its
+// size matches the one already recorded in result. The file is closed, and synced
+// if the Config asks for it, before download returns successfully. Objects
+// to be decrypted are left to downloadDecrypted, those to be decoded to
+// downloadDecoded, those to be downloaded in a single request to
+// downloadSequential, and those whose parts are to be verified to
+// downloadParts.
+func (f *Fetcher) download(
+	ctx context.Context, client s3iface.S3API, loc Location, req FetchRequest, result *FetchResult,
+) error {
+	if result.Decrypted {
+		return f.downloadDecrypted(ctx, client, loc, req, result)
+	}
+	if result.Decoded {
+		return f.downloadDecoded(ctx, client, loc, req, result)
+	}
+	if result.Sequential {
+		return f.downloadSequential(ctx, client, loc, req, result)
+	}
+	if f.cfg.VerifyParts {
+		if parts := partChecksums(ctx, client, loc); len(parts) > 0 {
+			return f.downloadParts(ctx, client, loc, req, result, parts)
+		}
+	}
+	file, err := f.createSizedFile(req.Filename, result.Size)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	downloader := s3manager.NewDownloaderWithClient(client, func(d *s3manager.Downloader) {
+		d.PartSize = partSize(result.Size, f.cfg.PartSize)
+		d.BufferProvider = pooledBuffers{}
+	})
+	result.Timings.PartSize, result.Timings.Concurrency = downloader.PartSize, downloader.Concurrency
+	writer := &firstByteWriterAt{WriterAt: file, now: f.clock.Now, onProgress: req.OnProgress}
+	start := f.clock.Now()
+	numBytes, err := downloader.DownloadWithContext(ctx, writer, getObjectInput(loc, result.ETag))
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		if diskErr := diskError(err); errors.Is(diskErr, ErrWriteFile) {
+			return diskErr
+		}
+		return requestError("GetObject", loc, err)
+	}
+	result.Timings.Transfer = f.since(start)
+	result.Timings.FirstByte = writer.sinceStart(start)
+	switch {
+	case result.Size < 0:
+		result.Size = numBytes
+	case numBytes != result.Size:
+		return fmt.Errorf("%w: got %d bytes, expected %d", ErrSizeMismatch, numBytes, result.Size)
+	}
+	return f.closeFile(file)
+}
+
+// downloadWithFreshCredentials downloads the object at loc like download does.
+// If the credentials of client would likely expire during the download, they
+// are refreshed first, and if S3 reports them expired nonetheless, they are
+// refreshed and the download is retried once before ErrCredentialsExpired is
+// returned.
+func (f *Fetcher) downloadWithFreshCredentials(
+	ctx context.Context, client s3iface.S3API, loc Location, req FetchRequest, result *FetchResult,
+) error {
+	creds := clientCredentials(client)
+	if creds == nil {
+		return f.download(ctx, client, loc, req, result)
+	}
+	// The expiry is S3's time, as the service that issued the credentials told
+	// it.
+	expires, err := creds.ExpiresAt()
+	now := f.cfg.ClockOffset.ServerTime(f.clock.Now())
+	if err == nil && !expires.IsZero() && expires.Before(now.Add(likelyDownloadDuration(result.Size))) {
+		f.refreshCredentials(creds, req, result, "they would likely expire during the download")
+	}
+	err = f.download(ctx, client, loc, req, result)
+	if isExpiredToken(err) {
+		f.refreshCredentials(creds, req, result, "S3 reported them expired")
+		err = f.download(ctx, client, loc, req, result)
+		if isExpiredToken(err) {
+			return fmt.Errorf("%w: %w", ErrCredentialsExpired, err)
+		}
+	}
+	return err
+}
+
+// refreshCredentials makes creds retrieve new credentials and records them in
+// result. Errors are left for the next request signed with creds to report.
+func (f *Fetcher) refreshCredentials(
+	creds *credentials.Credentials, req FetchRequest, result *FetchResult, reason string,
+) {
+	creds.Expire()
+	value, err := creds.Get()
+	if err != nil {
+		return
+	}
+	result.Credentials = CredentialsInfo{Provider: value.ProviderName}
+	if expires, err := creds.ExpiresAt(); err == nil {
+		result.Credentials.Expires = expires
+	}
+	if req.OnCredentialsRefresh != nil {
+		req.OnCredentialsRefresh(reason, result.Credentials)
+	}
+}
+
+// likelyDownloadDuration estimates how long downloading size bytes takes at
+// worst. An unknown, negative size only accounts for the fixed overhead.
+func likelyDownloadDuration(size int64) time.Duration {
+	return time.Minute + time.Duration(max(size, 0)/minThroughput)*time.Second
+}
+
+// isExpiredToken tells whether err means that the credentials a request was
+// signed with expired.
+func isExpiredToken(err error) bool {
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return false
+	}
+	switch awsErr.Code() {
+	case "ExpiredToken", "ExpiredTokenException", "TokenRefreshRequired":
+		return true
+	default:
+		return false
+	}
+}
+
+// isEndpointFailure tells whether err means that the endpoint could not be
+// reached or failed to serve the request, such that another endpoint might
+// succeed.
+func isEndpointFailure(err error) bool {
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		return reqErr.StatusCode() >= http.StatusInternalServerError
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == request.ErrCodeRequestError {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// endpointName returns the URL of the given endpoint, resolving the empty
+// string to the regional AWS endpoint.
+func (f *Fetcher) endpointName(endpoint string) string {
+	if endpoint != "" {
+		return endpoint
+	}
+	s3URL, err := s3EndpointURL(f.cfg.Region)
+	if err != nil {
+		return f.cfg.Region
+	}
+	return s3URL.String()
+}
+
+// hostname returns the host name of the given endpoint URL, or the endpoint
+// itself if it cannot be parsed. IPv6 addresses keep their brackets, as they
+// are written in URLs.
+func hostname(endpoint string) string {
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil || endpointURL.Hostname() == "" {
+		return endpoint
+	}
+	host := endpointURL.Hostname()
+	if strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+	return host
+}
+
+// bucketExists tells whether the bucket of loc exists, which a HeadObject
+// response without a body cannot. Unless S3 answers that it does not, the
+// bucket is assumed to exist.
+func (f *Fetcher) bucketExists(ctx context.Context, client s3iface.S3API, loc Location) bool {
+	_, err := client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(loc.Bucket)})
+	var reqErr awserr.RequestFailure
+	return !errors.As(err, &reqErr) || reqErr.StatusCode() != http.StatusNotFound
+}
+
+// closeFile syncs file if the Config asks for it and closes it. On failure
+// the file is removed, so that no truncated file is mistaken for a complete
+// one.
+func (f *Fetcher) closeFile(file outputFile) error {
+	var err error
+	if f.cfg.Fsync {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("%w: %w", ErrWriteFile, err)
+	}
+	return nil
+}
+
+// createEmptyFile creates the named file, or truncates it, for an empty
+// object.
+func (f *Fetcher) createEmptyFile(filename string) error {
+	file, err := f.createSizedFile(filename, 0)
+	if err != nil {
+		return err
+	}
+	return f.closeFile(file)
+}
+
+// createFile creates the named file with os.Create.
+func createFile(name string) (outputFile, error) {
+	return os.Create(name)
+}
+
+// diskError wraps err with ErrWriteFile if it stems from the local disk being
+// full, read-only or not writable, and returns any other error unchanged. Such
+// errors concern the file of a single acquire, which apt should learn about
+// without every other queued acquire failing as well.
+func diskError(err error) error {
+	for _, errno := range []syscall.Errno{syscall.ENOSPC, syscall.EDQUOT, syscall.EACCES, syscall.EROFS} {
+		if errors.Is(err, errno) {
+			var pathErr *os.PathError
+			if errors.As(err, &pathErr) {
+				return fmt.Errorf("%w: %s: %w", ErrWriteFile, pathErr.Path, errno)
+			}
+			return fmt.Errorf("%w: %w", ErrWriteFile, errno)
+		}
+	}
+	return err
+}
+
+// throttle blocks until the Config's Throttle, if any, lets the next request
+// through.
+func (f *Fetcher) throttle(ctx context.Context) error {
+	if f.cfg.Throttle == nil {
+		return nil
+	}
+	return f.cfg.Throttle.wait(ctx)
+}
+
+// since returns the time elapsed since start according to the Fetcher's
+// Clock.
+func (f *Fetcher) since(start time.Time) time.Duration {
+	return f.clock.Now().Sub(start)
+}
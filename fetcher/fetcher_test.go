@@ -0,0 +1,600 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+)
+
+const testURI = "s3://fake-access-key-id:fake-access-key-secret@s3.amazonaws.com/apt-repo-bucket/apt/generic/hello.deb"
+
+func TestFetch(t *testing.T) {
+	lastModified := time.Date(2018, time.October, 25, 20, 17, 39, 0, time.UTC)
+	errForbidden := awserr.NewRequestFailure(awserr.New("Forbidden", "Forbidden", nil), http.StatusForbidden, "id")
+	helloDigests := Digests{
+		MD5:    "5d41402abc4b2a76b9719d911017c592",
+		SHA1:   "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d",
+		SHA256: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		SHA512: "9b71d224bd62f3785d96d46ad3ea3d73319bfbc2890caadae2dff72519673ca7" +
+			"2323c3d99ba5c11d7c7acc6e14b8c5da0c4663475c2e5c3adef46f73bcdec043",
+	}
+	specs := map[string]struct {
+		setup          func(fake *testutil.FakeS3)
+		req            FetchRequest
+		expectedResult FetchResult
+		expectedErr    error
+		expectedStart  bool
+	}{
+		"success": {
+			func(fake *testutil.FakeS3) {
+				fake.Put("apt-repo-bucket", "apt/generic/hello.deb",
+					testutil.FakeObject{Body: []byte("hello"), LastModified: lastModified})
+			},
+			FetchRequest{ExpectedHashes: Digests{SHA256: helloDigests.SHA256}, MaxSize: 5},
+			FetchResult{
+				Object: Object{Size: 5, LastModified: lastModified}, Digests: helloDigests, Endpoint: "https://s3.amazonaws.com",
+			},
+			nil,
+			true,
+		},
+		"head without metadata": {
+			func(fake *testutil.FakeS3) {
+				fake.Put("apt-repo-bucket", "apt/generic/hello.deb",
+					testutil.FakeObject{Body: []byte("hello"), LastModified: lastModified, OmitHeadMetadata: true})
+			},
+			FetchRequest{MaxSize: 5},
+			FetchResult{
+				Object: Object{Size: 5, LastModified: lastModified}, Digests: helloDigests, Endpoint: "https://s3.amazonaws.com",
+				Sequential: true,
+			},
+			nil,
+			true,
+		},
+		"head without metadata too large": {
+			func(fake *testutil.FakeS3) {
+				fake.Put("apt-repo-bucket", "apt/generic/hello.deb",
+					testutil.FakeObject{Body: []byte("hello"), LastModified: lastModified, OmitHeadMetadata: true})
+			},
+			FetchRequest{MaxSize: 4},
+			FetchResult{},
+			ErrTooLarge,
+			false,
+		},
+		"not found": {
+			func(fake *testutil.FakeS3) {
+				fake.AddBucket("apt-repo-bucket")
+			},
+			FetchRequest{},
+			FetchResult{},
+			ErrNotFound,
+			false,
+		},
+		"bucket not found": {
+			func(*testutil.FakeS3) {},
+			FetchRequest{},
+			FetchResult{},
+			ErrBucketNotFound,
+			false,
+		},
+		"head forbidden": {
+			func(fake *testutil.FakeS3) {
+				fake.HeadErr = errForbidden
+			},
+			FetchRequest{},
+			FetchResult{},
+			errForbidden,
+			false,
+		},
+		"too large": {
+			func(fake *testutil.FakeS3) {
+				fake.Put("apt-repo-bucket", "apt/generic/hello.deb",
+					testutil.FakeObject{Body: []byte("hello"), LastModified: lastModified})
+			},
+			FetchRequest{MaxSize: 4},
+			FetchResult{},
+			ErrTooLarge,
+			false,
+		},
+		"size mismatch": {
+			func(fake *testutil.FakeS3) {
+				fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{
+					Body: []byte("hello"), LastModified: lastModified, ContentLength: aws.Int64(10),
+				})
+			},
+			FetchRequest{},
+			FetchResult{},
+			ErrSizeMismatch,
+			true,
+		},
+		"get failure": {
+			func(fake *testutil.FakeS3) {
+				fake.Put("apt-repo-bucket", "apt/generic/hello.deb",
+					testutil.FakeObject{Body: []byte("hello"), LastModified: lastModified})
+				fake.GetErr = errForbidden
+			},
+			FetchRequest{},
+			FetchResult{},
+			errForbidden,
+			true,
+		},
+		"hash mismatch": {
+			func(fake *testutil.FakeS3) {
+				fake.Put("apt-repo-bucket", "apt/generic/hello.deb",
+					testutil.FakeObject{Body: []byte("hello"), LastModified: lastModified})
+			},
+			FetchRequest{ExpectedHashes: Digests{SHA256: helloDigests.SHA1}},
+			FetchResult{},
+			ErrHashMismatch,
+			true,
+		},
+	}
+
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			fake := testutil.NewFakeS3()
+			spec.setup(fake)
+			req := spec.req
+			req.URI = testURI
+			dir := t.TempDir()
+			req.Filename = filepath.Join(dir, "hello.deb")
+			before := testutil.SnapshotDir(t, dir)
+			started := false
+			req.OnStart = func(Object) { started = true }
+
+			result, err := newFakeFetcher(fake).Fetch(context.Background(), req)
+			if !errors.Is(err, spec.expectedErr) {
+				t.Errorf("Fetch() error = %v; expected %v", err, spec.expectedErr)
+			}
+			if err != nil {
+				before.CheckUnchanged(t)
+			}
+			if started != spec.expectedStart {
+				t.Errorf("OnStart called = %t; expected %t", started, spec.expectedStart)
+			}
+			result.Timings = Timings{}
+			if diff := cmp.Diff(spec.expectedResult, result); diff != "" {
+				t.Errorf("Fetch() result mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFetchProgress(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	for name, obj := range map[string]testutil.FakeObject{
+		"head":                  {Body: body},
+		"head without metadata": {Body: body, OmitHeadMetadata: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fake := testutil.NewFakeS3()
+			fake.Put("apt-repo-bucket", "apt/generic/hello.deb", obj)
+			var started Object
+			var progress []int64
+			var mu sync.Mutex
+			req := FetchRequest{
+				URI:      testURI,
+				Filename: filepath.Join(t.TempDir(), "hello.deb"),
+				OnStart:  func(obj Object) { started = obj },
+				OnProgress: func(written int64) {
+					mu.Lock()
+					defer mu.Unlock()
+					if started.Size == 0 {
+						t.Errorf("OnProgress(%d) called before OnStart", written)
+					}
+					progress = append(progress, written)
+				},
+			}
+
+			result, err := newFakeFetcher(fake).Fetch(context.Background(), req)
+			if err != nil {
+				t.Fatalf("Fetch() returned unexpected error: %v", err)
+			}
+			if started.Size != int64(len(body)) || started.Size != result.Size {
+				t.Errorf("OnStart called with size %d, result has %d; expected %d", started.Size, result.Size, len(body))
+			}
+			if len(progress) == 0 || slices.Max(progress) != int64(len(body)) {
+				t.Errorf("OnProgress called with %v; expected counts up to %d", progress, len(body))
+			}
+		})
+	}
+}
+
+func TestFetchWritesFile(t *testing.T) {
+	for _, fsync := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fsync=%t", fsync), func(t *testing.T) {
+			fake := testutil.NewFakeS3()
+			fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+			filename := filepath.Join(t.TempDir(), "hello.deb")
+			f := New(Config{Region: "us-east-1", Fsync: fsync}, WithS3ClientFactory(func(ClientConfig) (s3iface.S3API, error) {
+				return fake, nil
+			}))
+
+			if _, err := f.Fetch(context.Background(), FetchRequest{URI: testURI, Filename: filename}); err != nil {
+				t.Fatalf("Fetch() returned unexpected error: %v", err)
+			}
+			contents, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatalf("failed to read fetched file: %v", err)
+			}
+			if string(contents) != "hello" {
+				t.Errorf("fetched contents = %q; expected %q", contents, "hello")
+			}
+		})
+	}
+}
+
+func TestFetchEmptyObject(t *testing.T) {
+	// Like the S3 compatible service that fails ranged requests for empty
+	// objects with a 400 rather than the 416 the SDK expects.
+	rangeErr := awserr.NewRequestFailure(awserr.New("InvalidArgument", "Invalid range", nil), http.StatusBadRequest, "fake-request-id")
+	empty := newSequentialDigester().digests()
+	specs := map[string]struct {
+		getEmptyObjects bool
+		contentType     string
+		existing        string
+		expectedHashes  Digests
+		expectedErr     error
+		expectedRanges  []string
+	}{
+		"not downloaded":     {expectedHashes: empty},
+		"existing truncated": {existing: "stale content", expectedHashes: empty},
+		"HTML content type":  {contentType: "text/html", expectedHashes: empty},
+		"unexpected hash":    {expectedHashes: Digests{SHA256: strings.Repeat("0", 64)}, expectedErr: ErrHashMismatch},
+		// A single GetObject of the whole object, which has no range to ask
+		// for.
+		"downloaded": {getEmptyObjects: true, expectedRanges: []string{""}},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			fake := testutil.NewFakeS3()
+			fake.EmptyRangeErr = rangeErr
+			fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{
+				ETag: `"d41d8cd98f00b204e9800998ecf8427e"`, ContentType: spec.contentType,
+			})
+			filename := filepath.Join(t.TempDir(), "hello.deb")
+			if spec.existing != "" {
+				if err := os.WriteFile(filename, []byte(spec.existing), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			f := New(Config{Region: "us-east-1", GetEmptyObjects: spec.getEmptyObjects},
+				WithS3ClientFactory(func(ClientConfig) (s3iface.S3API, error) { return fake, nil }))
+
+			var started []Object
+			result, err := f.Fetch(context.Background(), FetchRequest{
+				URI:            testURI,
+				Filename:       filename,
+				ExpectedHashes: spec.expectedHashes,
+				OnStart:        func(obj Object) { started = append(started, obj) },
+			})
+			if !errors.Is(err, spec.expectedErr) {
+				t.Fatalf("Fetch() = %v; expected %v", err, spec.expectedErr)
+			}
+			if diff := cmp.Diff(spec.expectedRanges, fake.Ranges()); diff != "" {
+				t.Errorf("GetObject ranges mismatch (-want +got):\n%s", diff)
+			}
+			if err != nil {
+				return
+			}
+			if result.Size != 0 || len(started) != 1 || started[0].Size != 0 {
+				t.Errorf("Size = %d, OnStart called with %v; expected 0 once", result.Size, started)
+			}
+			if diff := cmp.Diff(empty, result.Digests); diff != "" {
+				t.Errorf("unexpected digests (-want +got):\n%s", diff)
+			}
+			info, err := os.Stat(filename)
+			if err != nil {
+				t.Fatalf("failed to stat fetched file: %v", err)
+			}
+			if info.Size() != 0 {
+				t.Errorf("file size = %d; expected 0", info.Size())
+			}
+		})
+	}
+}
+
+func TestCloseFileRemovesFileOnError(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "hello.deb")
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	// Closing the file twice makes the second Close, and Sync, fail.
+	file.Close()
+
+	err = New(Config{Fsync: true}).closeFile(file)
+	if !errors.Is(err, ErrWriteFile) {
+		t.Errorf("closeFile() = %v; expected %v", err, ErrWriteFile)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("file still exists after failed close: %v", err)
+	}
+}
+
+func TestFetchFallbackEndpoints(t *testing.T) {
+	errUnavailable := awserr.NewRequestFailure(
+		awserr.New("ServiceUnavailable", "Service Unavailable", nil), http.StatusServiceUnavailable, "id")
+	errForbidden := awserr.NewRequestFailure(awserr.New("Forbidden", "Forbidden", nil), http.StatusForbidden, "id")
+	specs := map[string]struct {
+		setupPrimary      func(fake *testutil.FakeS3)
+		expectedErr       error
+		expectedEndpoint  string
+		expectedFallbacks []string
+	}{
+		"primary succeeds": {
+			func(*testutil.FakeS3) {},
+			nil,
+			"https://gateway.internal",
+			nil,
+		},
+		"head unavailable": {
+			func(fake *testutil.FakeS3) {
+				fake.HeadErr = errUnavailable
+			},
+			nil,
+			"https://s3.us-east-1.amazonaws.com",
+			[]string{"https://s3.us-east-1.amazonaws.com"},
+		},
+		"get unavailable": {
+			func(fake *testutil.FakeS3) {
+				fake.GetErr = errUnavailable
+			},
+			nil,
+			"https://s3.us-east-1.amazonaws.com",
+			[]string{"https://s3.us-east-1.amazonaws.com"},
+		},
+		"head forbidden": {
+			func(fake *testutil.FakeS3) {
+				fake.HeadErr = errForbidden
+			},
+			errForbidden,
+			"",
+			nil,
+		},
+	}
+
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			fakes := map[string]*testutil.FakeS3{}
+			for _, endpoint := range []string{"https://gateway.internal", "https://s3.us-east-1.amazonaws.com"} {
+				fakes[endpoint] = testutil.NewFakeS3()
+				fakes[endpoint].Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+			}
+			spec.setupPrimary(fakes["https://gateway.internal"])
+			f := New(Config{
+				Region:            "us-east-1",
+				Endpoint:          "https://gateway.internal",
+				FallbackEndpoints: []string{"https://s3.us-east-1.amazonaws.com"},
+			}, WithS3ClientFactory(func(cfg ClientConfig) (s3iface.S3API, error) {
+				return fakes[cfg.Endpoint], nil
+			}))
+			starts := 0
+			var fallbacks []string
+			req := FetchRequest{
+				URI:        "s3://gateway.internal/apt-repo-bucket/apt/generic/hello.deb",
+				Filename:   filepath.Join(t.TempDir(), "hello.deb"),
+				OnStart:    func(Object) { starts++ },
+				OnFallback: func(endpoint string, _ error) { fallbacks = append(fallbacks, endpoint) },
+			}
+
+			result, err := f.Fetch(context.Background(), req)
+			if !errors.Is(err, spec.expectedErr) {
+				t.Errorf("Fetch() error = %v; expected %v", err, spec.expectedErr)
+			}
+			if result.Endpoint != spec.expectedEndpoint {
+				t.Errorf("Fetch() endpoint = %q; expected %q", result.Endpoint, spec.expectedEndpoint)
+			}
+			if diff := cmp.Diff(spec.expectedFallbacks, fallbacks); diff != "" {
+				t.Errorf("OnFallback calls mismatch (-want +got):\n%s", diff)
+			}
+			if err == nil && starts != 1 {
+				t.Errorf("OnStart called %d times; expected once", starts)
+			}
+		})
+	}
+}
+
+func TestIsEndpointFailure(t *testing.T) {
+	specs := map[string]struct {
+		err      error
+		expected bool
+	}{
+		"server error": {
+			awserr.NewRequestFailure(awserr.New("InternalError", "We encountered an internal error", nil), 500, "id"),
+			true,
+		},
+		"client error": {
+			awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "id"),
+			false,
+		},
+		"send failure": {awserr.New(request.ErrCodeRequestError, "send request failed", nil), true},
+		"network":      {&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, true},
+		"cancelled":    {context.Canceled, false},
+		"hash":         {ErrHashMismatch, false},
+	}
+
+	for name, spec := range specs {
+		if actual := isEndpointFailure(spec.err); actual != spec.expected {
+			t.Errorf("%s: isEndpointFailure(%v) = %t; expected %t", name, spec.err, actual, spec.expected)
+		}
+	}
+}
+
+// fullFile is an outputFile on a disk without free space.
+type fullFile struct {
+	*os.File
+}
+
+func (file fullFile) WriteAt([]byte, int64) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: file.Name(), Err: syscall.ENOSPC}
+}
+
+func TestFetchDiskFull(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "hello.deb")
+	before := testutil.SnapshotDir(t, dir)
+	f := newFakeFetcher(fake)
+	f.createFile = func(name string) (outputFile, error) {
+		file, err := os.Create(name)
+		return fullFile{file}, err
+	}
+
+	_, err := f.Fetch(context.Background(), FetchRequest{URI: testURI, Filename: filename})
+	if !errors.Is(err, ErrWriteFile) || !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("Fetch() = %v; expected %v and %v", err, ErrWriteFile, syscall.ENOSPC)
+	}
+	if !strings.Contains(err.Error(), filename) {
+		t.Errorf("Fetch() = %v; expected it to name %s", err, filename)
+	}
+	before.CheckUnchanged(t)
+}
+
+func TestFetchKeepsUntouchedFile(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.AddBucket("apt-repo-bucket")
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "hello.deb")
+	if err := os.WriteFile(filename, []byte("hel"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	before := testutil.SnapshotDir(t, dir)
+
+	_, err := newFakeFetcher(fake).Fetch(context.Background(), FetchRequest{URI: testURI, Filename: filename})
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Fetch() error = %v; expected %v", err, ErrNotFound)
+	}
+	before.CheckUnchanged(t)
+}
+
+func TestDiskError(t *testing.T) {
+	otherErr := errors.New("connection reset")
+	specs := map[string]struct {
+		err       error
+		expected  string
+		writeFile bool
+	}{
+		"no space": {
+			&os.PathError{Op: "write", Path: "/var/cache/apt/archives/partial/hello.deb", Err: syscall.ENOSPC},
+			"failed to write the downloaded file: /var/cache/apt/archives/partial/hello.deb: no space left on device",
+			true,
+		},
+		"quota": {syscall.EDQUOT, "failed to write the downloaded file: disk quota exceeded", true},
+		"permission": {
+			&os.PathError{Op: "open", Path: "/a", Err: syscall.EACCES},
+			"failed to write the downloaded file: /a: permission denied",
+			true,
+		},
+		"read-only": {
+			&os.PathError{Op: "open", Path: "/a", Err: syscall.EROFS},
+			"failed to write the downloaded file: /a: read-only file system",
+			true,
+		},
+		"other": {otherErr, "connection reset", false},
+	}
+
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			err := diskError(spec.err)
+			if err.Error() != spec.expected {
+				t.Errorf("diskError(%v) = %q; expected %q", spec.err, err, spec.expected)
+			}
+			if errors.Is(err, ErrWriteFile) != spec.writeFile {
+				t.Errorf("errors.Is(diskError(%v), ErrWriteFile) = %t; expected %t", spec.err, !spec.writeFile, spec.writeFile)
+			}
+		})
+	}
+}
+
+func TestFetchCancelledMidDownload(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello world")})
+	fake.StallAfter = 5
+	fake.Stalled = make(chan struct{})
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "hello.deb")
+	before := testutil.SnapshotDir(t, dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-fake.Stalled
+		cancel()
+	}()
+	_, err := newFakeFetcher(fake).Fetch(ctx, FetchRequest{URI: testURI, Filename: filename})
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Fetch() error = %v; expected %v", err, context.Canceled)
+	}
+	before.CheckUnchanged(t)
+}
+
+func TestFetchUsesAuthConf(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	entries := []AuthEntry{{Machine: "s3.amazonaws.com/apt-repo-bucket", Login: "AKIDEXAMPLE", Password: "secret"}}
+	specs := map[string]string{
+		"s3://s3.amazonaws.com/apt-repo-bucket/apt/generic/hello.deb":                   "AKIDEXAMPLE",
+		"s3://embedded:embedded@s3.amazonaws.com/apt-repo-bucket/apt/generic/hello.deb": "embedded",
+		"s3://apt-repo-bucket.s3.amazonaws.com/apt/generic/hello.deb":                   "",
+	}
+
+	for uri, expected := range specs {
+		t.Run(uri, func(t *testing.T) {
+			var cfg ClientConfig
+			f := New(Config{Region: "us-east-1", AuthEntries: entries},
+				WithS3ClientFactory(func(c ClientConfig) (s3iface.S3API, error) {
+					cfg = c
+					return fake, nil
+				}))
+			req := FetchRequest{URI: uri, Filename: filepath.Join(t.TempDir(), "hello.deb")}
+			if _, err := f.Fetch(context.Background(), req); err != nil {
+				t.Fatalf("Fetch() returned unexpected error: %v", err)
+			}
+			if actual := cfg.User.Username(); actual != expected {
+				t.Errorf("access key id = %q; expected %q", actual, expected)
+			}
+		})
+	}
+}
+
+// newFakeFetcher returns a Fetcher whose S3 clients are the given fake.
+func newFakeFetcher(fake *testutil.FakeS3) *Fetcher {
+	return New(Config{Region: "us-east-1"}, WithS3ClientFactory(func(ClientConfig) (s3iface.S3API, error) {
+		return fake, nil
+	}))
+}
@@ -0,0 +1,68 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+// DefaultFileMode is the permissions fetched files are given unless the
+// Config's FileMode says otherwise, those apt's http method leaves them with.
+const DefaultFileMode os.FileMode = 0o644
+
+// partialDir is the name of apt's directory for files being downloaded.
+const partialDir = "partial"
+
+// setPermissions gives the fetched file the Config's FileMode, whatever the
+// umask of the process. Files in apt's partial directory are moreover handed
+// to the Config's SandboxUser when running as root, which is how apt's own
+// methods, running as that user, leave them, so that apt's sandboxed
+// verification can read them.
+func (f *Fetcher) setPermissions(filename string) error {
+	mode := f.cfg.FileMode
+	if mode == 0 {
+		mode = DefaultFileMode
+	}
+	if err := os.Chmod(filename, mode); err != nil {
+		return fmt.Errorf("%w: %w", ErrWriteFile, err)
+	}
+	if f.cfg.SandboxUser == "" || filepath.Base(filepath.Dir(filename)) != partialDir || os.Geteuid() != 0 {
+		return nil
+	}
+	// Systems without the user, and thus without apt's sandbox, keep the file
+	// root's.
+	uid, ok := userID(f.cfg.SandboxUser)
+	if !ok {
+		return nil
+	}
+	if err := os.Chown(filename, uid, -1); err != nil {
+		return fmt.Errorf("%w: %w", ErrWriteFile, err)
+	}
+	return nil
+}
+
+// userID returns the numeric ID of the named user, if it exists.
+func userID(name string) (int, bool) {
+	found, err := user.Lookup(name)
+	if err != nil {
+		return 0, false
+	}
+	uid, err := strconv.Atoi(found.Uid)
+	return uid, err == nil
+}
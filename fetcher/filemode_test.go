@@ -0,0 +1,102 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix
+
+package fetcher
+
+import (
+	"context"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+)
+
+func TestFetchFileMode(t *testing.T) {
+	specs := map[string]struct {
+		mode     os.FileMode
+		expected os.FileMode
+	}{
+		"default":    {0, 0o644},
+		"configured": {0o640, 0o640},
+		"wider":      {0o664, 0o664},
+	}
+	// Files would be created 0600 under a restrictive umask.
+	defer syscall.Umask(syscall.Umask(0o077))
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			fake := testutil.NewFakeS3()
+			fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+			filename := filepath.Join(t.TempDir(), "hello.deb")
+			f := New(Config{Region: "us-east-1", FileMode: spec.mode}, WithS3ClientFactory(func(ClientConfig) (s3iface.S3API, error) {
+				return fake, nil
+			}))
+
+			if _, err := f.Fetch(context.Background(), FetchRequest{URI: testURI, Filename: filename}); err != nil {
+				t.Fatalf("Fetch() returned unexpected error: %v", err)
+			}
+			info, err := os.Stat(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != spec.expected {
+				t.Errorf("mode of the fetched file = %v; expected %v", info.Mode().Perm(), spec.expected)
+			}
+		})
+	}
+}
+
+func TestFetchHandsPartialFilesToSandboxUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("handing files to another user takes root")
+	}
+	sandbox, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skipf("no user to hand files to: %v", err)
+	}
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	partial := filepath.Join(t.TempDir(), "partial")
+	if err := os.Mkdir(partial, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	f := New(Config{Region: "us-east-1", SandboxUser: sandbox.Username}, WithS3ClientFactory(func(ClientConfig) (s3iface.S3API, error) {
+		return fake, nil
+	}))
+
+	for dir, expected := range map[string]string{partial: sandbox.Uid, filepath.Dir(partial): "0"} {
+		filename := filepath.Join(dir, "hello.deb")
+		if _, err := f.Fetch(context.Background(), FetchRequest{URI: testURI, Filename: filename}); err != nil {
+			t.Fatalf("Fetch() returned unexpected error: %v", err)
+		}
+		info, err := os.Stat(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			t.Fatalf("no owner in %T", info.Sys())
+		}
+		if owner := strconv.FormatUint(uint64(stat.Uid), 10); owner != expected {
+			t.Errorf("owner of %s = %s; expected %s", filename, owner, expected)
+		}
+	}
+}
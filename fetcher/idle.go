@@ -0,0 +1,70 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"sync"
+	"time"
+)
+
+// An IdleTracker counts the fetches in flight, so that a process can tell
+// when it sits idle between batches of fetches, and for how long. It is safe
+// for concurrent use.
+type IdleTracker struct {
+	mu       sync.Mutex
+	inFlight int
+	// idleSince is when the last fetch in flight finished, or the zero time
+	// if none ever ran.
+	idleSince time.Time
+}
+
+// NewIdleTracker returns an IdleTracker no fetch ran with yet.
+func NewIdleTracker() *IdleTracker {
+	return &IdleTracker{}
+}
+
+// begin records that a fetch started. A nil IdleTracker records nothing.
+func (t *IdleTracker) begin() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.inFlight++
+}
+
+// end records that a fetch started with begin finished at now.
+func (t *IdleTracker) end(now time.Time) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.inFlight--
+	if t.inFlight == 0 {
+		t.idleSince = now
+	}
+}
+
+// State returns the number of fetches in flight and, if there are none, when
+// the last one finished, which is the zero time if none ever ran.
+func (t *IdleTracker) State() (int, time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.inFlight > 0 {
+		return t.inFlight, time.Time{}
+	}
+	return 0, t.idleSince
+}
@@ -0,0 +1,102 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+)
+
+func TestIdleTracker(t *testing.T) {
+	var untracked *IdleTracker
+	untracked.begin()
+	untracked.end(time.Now())
+
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tracker := NewIdleTracker()
+	if inFlight, idleSince := tracker.State(); inFlight != 0 || !idleSince.IsZero() {
+		t.Errorf("State() = %d, %s before any fetch; expected 0 and the zero time", inFlight, idleSince)
+	}
+	tracker.begin()
+	tracker.begin()
+	tracker.end(start)
+	if inFlight, idleSince := tracker.State(); inFlight != 1 || !idleSince.IsZero() {
+		t.Errorf("State() = %d, %s with a fetch in flight; expected 1 and the zero time", inFlight, idleSince)
+	}
+	tracker.end(start.Add(time.Minute))
+	if inFlight, idleSince := tracker.State(); inFlight != 0 || !idleSince.Equal(start.Add(time.Minute)) {
+		t.Errorf("State() = %d, %s; expected 0 and %s", inFlight, idleSince, start.Add(time.Minute))
+	}
+}
+
+func TestFetchTracksInFlight(t *testing.T) {
+	clk := testutil.NewFakeClock(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	tracker := NewIdleTracker()
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	var inFlight int
+	fake.BeforeGet = func(string) {
+		inFlight, _ = tracker.State()
+		clk.Advance(time.Second)
+	}
+	f := New(Config{Region: "us-east-1", IdleTracker: tracker},
+		WithS3ClientFactory(func(ClientConfig) (s3iface.S3API, error) { return fake, nil }), WithClock(clk))
+
+	if _, err := f.Fetch(context.Background(), FetchRequest{URI: testURI, Filename: filepath.Join(t.TempDir(), "hello.deb")}); err != nil {
+		t.Fatalf("Fetch() returned unexpected error: %v", err)
+	}
+	if inFlight != 1 {
+		t.Errorf("%d fetches in flight during the download; expected 1", inFlight)
+	}
+	if count, idleSince := tracker.State(); count != 0 || !idleSince.Equal(clk.Now()) {
+		t.Errorf("State() = %d, %s after the fetch; expected 0 and %s", count, idleSince, clk.Now())
+	}
+
+	if _, err := f.Fetch(context.Background(), FetchRequest{URI: "s3://not a uri"}); err == nil {
+		t.Fatalf("Fetch() returned no error; expected the URI to be rejected")
+	}
+	if count, _ := tracker.State(); count != 0 {
+		t.Errorf("%d fetches in flight after a failed one; expected 0", count)
+	}
+}
+
+func TestNewSessionIdleTimeout(t *testing.T) {
+	for _, spec := range []struct {
+		idleTimeout time.Duration
+		expected    time.Duration
+	}{
+		{idleTimeout: 5 * time.Second, expected: 5 * time.Second},
+		{expected: 90 * time.Second},
+	} {
+		sess, _, err := NewSession(ClientConfig{Region: "us-east-1", IdleTimeout: spec.idleTimeout})
+		if err != nil {
+			t.Fatalf("NewSession() returned unexpected error: %v", err)
+		}
+		transport, ok := sess.Config.HTTPClient.Transport.(*http.Transport)
+		if !ok {
+			t.Fatalf("NewSession() made a client with a %T transport; expected *http.Transport", sess.Config.HTTPClient.Transport)
+		}
+		if transport.IdleConnTimeout != spec.expected {
+			t.Errorf("IdleConnTimeout = %s for IdleTimeout %s; expected %s", transport.IdleConnTimeout, spec.idleTimeout, spec.expected)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// IMDSRegion asks the EC2 instance metadata service for the region of the
+// instance, using an IMDSv2 session token, and gives up after timeout, so that
+// machines outside EC2 are delayed no longer. It honours
+// AWS_EC2_METADATA_DISABLED and AWS_EC2_METADATA_SERVICE_ENDPOINT as the SDK
+// does.
+func IMDSRegion(ctx context.Context, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config: aws.Config{HTTPClient: &http.Client{Timeout: timeout}, MaxRetries: aws.Int(0)},
+	})
+	if err != nil {
+		return "", err
+	}
+	return ec2metadata.New(sess).RegionWithContext(ctx)
+}
@@ -0,0 +1,85 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// imdsToken is the session token the fake instance metadata service hands out.
+const imdsToken = "fake-imds-token"
+
+// newFakeIMDS returns an instance metadata service that reports region, only
+// to requests carrying an IMDSv2 session token, after delay. The SDK is pointed
+// at it through the environment.
+func newFakeIMDS(t *testing.T, region string, delay time.Duration) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/latest/api/token":
+			w.Header().Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", r.Header.Get("X-Aws-Ec2-Metadata-Token-Ttl-Seconds"))
+			w.Write([]byte(imdsToken))
+		case r.URL.Path == "/latest/dynamic/instance-identity/document" && r.Header.Get("X-Aws-Ec2-Metadata-Token") == imdsToken:
+			w.Write([]byte(`{"region": "` + region + `", "instanceId": "i-0123456789abcdef0"}`))
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "")
+	t.Setenv("AWS_EC2_METADATA_SERVICE_ENDPOINT", server.URL)
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+}
+
+func TestIMDSRegion(t *testing.T) {
+	newFakeIMDS(t, "eu-central-1", 0)
+
+	region, err := IMDSRegion(context.Background(), time.Second)
+	if err != nil || region != "eu-central-1" {
+		t.Errorf("IMDSRegion() = %q, %v; expected eu-central-1", region, err)
+	}
+}
+
+func TestIMDSRegionTimeout(t *testing.T) {
+	newFakeIMDS(t, "eu-central-1", time.Minute)
+
+	start := time.Now()
+	region, err := IMDSRegion(context.Background(), 100*time.Millisecond)
+	if err == nil {
+		t.Errorf("IMDSRegion() = %q; expected an error once the timeout passed", region)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("IMDSRegion() took %s; expected it to give up after its timeout", elapsed)
+	}
+}
+
+func TestIMDSRegionDisabled(t *testing.T) {
+	newFakeIMDS(t, "eu-central-1", 0)
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	if region, err := IMDSRegion(context.Background(), time.Second); err == nil {
+		t.Errorf("IMDSRegion() = %q; expected an error with AWS_EC2_METADATA_DISABLED set", region)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"path"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// A KeyIndex remembers which keys exist below the prefixes it listed, so that
+// fetches of keys that do not exist can fail without a HeadObject request
+// each. Every prefix, the "directory" of a key, is listed once with
+// ListObjectsV2, by whichever fetch needs it first. Prefixes that cannot be
+// listed, e.g. because the credentials lack s3:ListBucket, are not consulted.
+// A KeyIndex is safe for concurrent use.
+type KeyIndex struct {
+	mu       sync.Mutex
+	listings map[string]*listing
+}
+
+// A listing holds the keys below a single prefix. Its keys are nil if the
+// prefix could not be listed, and must not be read before done is closed.
+type listing struct {
+	done chan struct{}
+	keys map[string]bool
+}
+
+// NewKeyIndex returns an empty KeyIndex.
+func NewKeyIndex() *KeyIndex {
+	return &KeyIndex{listings: map[string]*listing{}}
+}
+
+// exists reports whether the key of loc exists, listing its prefix with
+// client if that was not done before. The returned known is false if the
+// prefix could not be listed, in which case exists is meaningless.
+func (idx *KeyIndex) exists(ctx context.Context, client s3iface.S3API, loc Location) (exists, known bool) {
+	prefix := path.Dir(loc.Key) + "/"
+	if prefix == "./" {
+		prefix = ""
+	}
+	idx.mu.Lock()
+	entry, found := idx.listings[loc.Bucket+"/"+prefix]
+	if !found {
+		entry = &listing{done: make(chan struct{})}
+		idx.listings[loc.Bucket+"/"+prefix] = entry
+	}
+	idx.mu.Unlock()
+
+	if !found {
+		entry.keys = listKeys(ctx, client, loc.Bucket, prefix)
+		close(entry.done)
+	}
+	select {
+	case <-entry.done:
+	case <-ctx.Done():
+		return false, false
+	}
+	if entry.keys == nil {
+		return false, false
+	}
+	return entry.keys[loc.Key], true
+}
+
+// listKeys returns the set of keys directly below prefix in bucket, or nil if
+// they could not be listed.
+func listKeys(ctx context.Context, client s3iface.S3API, bucket, prefix string) map[string]bool {
+	keys := map[string]bool{}
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(bucket), Prefix: aws.String(prefix), Delimiter: aws.String("/")}
+	for {
+		output, err := client.ListObjectsV2WithContext(ctx, input)
+		if err != nil {
+			return nil
+		}
+		for _, obj := range output.Contents {
+			keys[aws.StringValue(obj.Key)] = true
+		}
+		if !aws.BoolValue(output.IsTruncated) {
+			return keys
+		}
+		input.ContinuationToken = output.NextContinuationToken
+	}
+}
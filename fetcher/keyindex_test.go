@@ -0,0 +1,95 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+)
+
+func TestFetchWithKeyIndex(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.ListPageSize = 1
+	fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	fake.Put("apt-repo-bucket", "apt/generic/world.deb", testutil.FakeObject{Body: []byte("world")})
+	fake.Put("apt-repo-bucket", "apt/other/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	f := New(Config{Region: "us-east-1", KeyIndex: NewKeyIndex()},
+		WithS3ClientFactory(func(ClientConfig) (s3iface.S3API, error) {
+			return fake, nil
+		}))
+	fetch := func(key string) error {
+		t.Helper()
+		filename := filepath.Join(t.TempDir(), "file")
+		_, err := f.Fetch(context.Background(), FetchRequest{URI: "s3://apt-repo-bucket/" + key, Filename: filename})
+		return err
+	}
+
+	for _, key := range []string{"apt/generic/missing.deb", "apt/generic/gone.deb"} {
+		if err := fetch(key); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Fetch(%s) returned error %v; expected %v", key, err, ErrNotFound)
+		}
+	}
+	if heads := fake.Heads(); heads != 0 {
+		t.Errorf("HeadObject called %d times for missing keys; expected never", heads)
+	}
+	for _, key := range []string{"apt/generic/hello.deb", "apt/generic/world.deb"} {
+		if err := fetch(key); err != nil {
+			t.Errorf("Fetch(%s) returned unexpected error: %v", key, err)
+		}
+	}
+	if heads := fake.Heads(); heads != 2 {
+		t.Errorf("HeadObject called %d times; expected twice", heads)
+	}
+	// Both keys of apt/generic/ are listed on a page of their own.
+	if lists := fake.Lists(); lists != 2 {
+		t.Errorf("ListObjectsV2 called %d times; expected twice", lists)
+	}
+}
+
+func TestFetchWithKeyIndexListDenied(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.ListErr = awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), http.StatusForbidden, "id")
+	fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	f := New(Config{Region: "us-east-1", KeyIndex: NewKeyIndex()},
+		WithS3ClientFactory(func(ClientConfig) (s3iface.S3API, error) {
+			return fake, nil
+		}))
+
+	_, err := f.Fetch(context.Background(), FetchRequest{URI: testURI, Filename: filepath.Join(t.TempDir(), "file")})
+	if err != nil {
+		t.Errorf("Fetch() returned unexpected error: %v", err)
+	}
+	_, err = f.Fetch(context.Background(), FetchRequest{
+		URI:      "s3://apt-repo-bucket/apt/generic/missing.deb",
+		Filename: filepath.Join(t.TempDir(), "file"),
+	})
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Fetch() returned error %v; expected %v", err, ErrNotFound)
+	}
+	if heads := fake.Heads(); heads != 2 {
+		t.Errorf("HeadObject called %d times; expected twice", heads)
+	}
+	if lists := fake.Lists(); lists != 1 {
+		t.Errorf("ListObjectsV2 called %d times; expected once", lists)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+const (
+	// latestQuery is the query parameter that, set to true on a URI ending
+	// in '/', asks for the most recently modified object below its path.
+	latestQuery = "latest"
+	// latestMarker, at the start of a path segment, asks for the most recently
+	// modified object whose key starts with the rest of the path.
+	latestMarker = "latest:"
+)
+
+// ErrEmptyPrefix is returned by Fetch when a URI asks for the most recently
+// modified object below a prefix that has no objects.
+var ErrEmptyPrefix = errors.New("no objects found under the prefix")
+
+// latestLocation marks loc as Latest if its URI asks for the most recently
+// modified object below a prefix, either with ?latest=true after a path ending
+// in '/' or with a latest: marker starting a path segment, which is removed
+// from the Key.
+func latestLocation(loc Location) Location {
+	if loc.URI.Query().Get(latestQuery) == "true" && strings.HasSuffix(loc.Key, "/") {
+		loc.Latest = true
+		return loc
+	}
+	if before, after, found := strings.Cut("/"+loc.Key, "/"+latestMarker); found {
+		loc.Key, loc.Latest = strings.TrimPrefix(before+"/"+after, "/"), true
+	}
+	return loc
+}
+
+// latestKey returns the key of the most recently modified object directly
+// below the prefix loc.Key, listing the prefix with ListObjectsV2. Of objects
+// modified at the same time, the one with the greatest key wins, as it does
+// for keys with timestamps of a finer resolution than S3's. Keys ending in
+// '/', which stand for folders, are skipped.
+func latestKey(ctx context.Context, client s3iface.S3API, loc Location) (string, error) {
+	var latest *s3.Object
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(loc.Bucket), Prefix: aws.String(loc.Key), Delimiter: aws.String("/")}
+	for {
+		output, err := client.ListObjectsV2WithContext(ctx, input)
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if err != nil {
+			return "", requestError("ListObjectsV2", loc, err)
+		}
+		for _, obj := range output.Contents {
+			if strings.HasSuffix(aws.StringValue(obj.Key), "/") {
+				continue
+			}
+			if latest == nil || isNewer(obj, latest) {
+				latest = obj
+			}
+		}
+		if !aws.BoolValue(output.IsTruncated) {
+			break
+		}
+		input.ContinuationToken = output.NextContinuationToken
+	}
+	if latest == nil {
+		return "", fmt.Errorf("%w s3://%s/%s", ErrEmptyPrefix, loc.Bucket, loc.Key)
+	}
+	return aws.StringValue(latest.Key), nil
+}
+
+// isNewer tells whether obj was modified after other, or at the same time and
+// has the greater key.
+func isNewer(obj, other *s3.Object) bool {
+	modified, otherModified := aws.TimeValue(obj.LastModified), aws.TimeValue(other.LastModified)
+	if !modified.Equal(otherModified) {
+		return modified.After(otherModified)
+	}
+	return aws.StringValue(obj.Key) > aws.StringValue(other.Key)
+}
@@ -0,0 +1,138 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+)
+
+func TestLocateLatest(t *testing.T) {
+	specs := map[string]struct {
+		uri            string
+		latest         bool
+		expectedKey    string
+		expectedLatest bool
+	}{
+		"query":                 {"s3://apt-repo-bucket/pool/nightly/?latest=true", true, "pool/nightly/", true},
+		"query without slash":   {"s3://apt-repo-bucket/pool/nightly?latest=true", true, "pool/nightly", false},
+		"query not true":        {"s3://apt-repo-bucket/pool/nightly/?latest=false", true, "pool/nightly/", false},
+		"marker":                {"s3://apt-repo-bucket/pool/nightly/latest:app_", true, "pool/nightly/app_", true},
+		"marker at key start":   {"s3://apt-repo-bucket/latest:pool/nightly/", true, "pool/nightly/", true},
+		"marker within segment": {"s3://apt-repo-bucket/pool/nightly/app_latest:1", true, "pool/nightly/app_latest:1", false},
+		"disabled":              {"s3://apt-repo-bucket/pool/nightly/latest:app_", false, "pool/nightly/latest:app_", false},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			f := New(Config{Region: "us-east-1", Latest: spec.latest})
+			loc, err := f.Locate(spec.uri)
+			if err != nil {
+				t.Fatalf("Locate(%q) returned unexpected error: %v", spec.uri, err)
+			}
+			if loc.Key != spec.expectedKey || loc.Latest != spec.expectedLatest {
+				t.Errorf("Locate(%q) = key %q, latest %t; expected key %q, latest %t",
+					spec.uri, loc.Key, loc.Latest, spec.expectedKey, spec.expectedLatest)
+			}
+		})
+	}
+}
+
+func TestFetchLatest(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, time.March, d, 12, 0, 0, 0, time.UTC) }
+	specs := map[string]struct {
+		objects     map[string]testutil.FakeObject
+		expectedKey string
+		expectedErr error
+	}{
+		"newest": {
+			map[string]testutil.FakeObject{
+				"pool/nightly/app_1_amd64.deb": {Body: []byte("1"), LastModified: day(1)},
+				"pool/nightly/app_3_amd64.deb": {Body: []byte("3"), LastModified: day(3)},
+				"pool/nightly/app_2_amd64.deb": {Body: []byte("2"), LastModified: day(2)},
+			},
+			"pool/nightly/app_3_amd64.deb",
+			nil,
+		},
+		"tie broken by key": {
+			map[string]testutil.FakeObject{
+				"pool/nightly/app_1_amd64.deb": {Body: []byte("1"), LastModified: day(1)},
+				"pool/nightly/app_2_amd64.deb": {Body: []byte("2"), LastModified: day(1)},
+			},
+			"pool/nightly/app_2_amd64.deb",
+			nil,
+		},
+		"folders and subfolders skipped": {
+			map[string]testutil.FakeObject{
+				"pool/nightly/app_1_amd64.deb":     {Body: []byte("1"), LastModified: day(1)},
+				"pool/nightly/":                    {LastModified: day(2)},
+				"pool/nightly/old/app_0_amd64.deb": {Body: []byte("0"), LastModified: day(3)},
+			},
+			"pool/nightly/app_1_amd64.deb",
+			nil,
+		},
+		"empty prefix": {
+			map[string]testutil.FakeObject{
+				"pool/stable/app_1_amd64.deb": {Body: []byte("1"), LastModified: day(1)},
+			},
+			"",
+			ErrEmptyPrefix,
+		},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			fake := testutil.NewFakeS3()
+			fake.ListPageSize = 1
+			for key, obj := range spec.objects {
+				fake.Put("apt-repo-bucket", key, obj)
+			}
+			filename := filepath.Join(t.TempDir(), "app.deb")
+			f := New(Config{Region: "us-east-1", Latest: true},
+				WithS3ClientFactory(func(ClientConfig) (s3iface.S3API, error) {
+					return fake, nil
+				}))
+
+			result, err := f.Fetch(context.Background(), FetchRequest{
+				URI: "s3://apt-repo-bucket/pool/nightly/?latest=true", Filename: filename,
+			})
+			if spec.expectedErr != nil {
+				if !errors.Is(err, spec.expectedErr) {
+					t.Fatalf("Fetch() = %v; expected %v", err, spec.expectedErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Fetch() returned unexpected error: %v", err)
+			}
+			if result.LatestKey != spec.expectedKey {
+				t.Errorf("LatestKey = %q; expected %q", result.LatestKey, spec.expectedKey)
+			}
+			contents, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatalf("failed to read fetched file: %v", err)
+			}
+			if expected := spec.objects[spec.expectedKey].Body; string(contents) != string(expected) {
+				t.Errorf("fetched file contains %q; expected %q", contents, expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// isForbidden tells whether err is an HTTP 403 answer from S3.
+func isForbidden(err error) bool {
+	var reqErr awserr.RequestFailure
+	return errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusForbidden
+}
+
+// headFromList learns the metadata that a HeadObject of the object at loc,
+// which failed with headErr, would have returned by listing the keys that
+// start with loc.Key instead. Some policies grant s3:ListBucket but deny
+// HeadObject. Since no other key starting with loc.Key sorts before it, the
+// first key listed is the object's if it exists, and ErrNotFound is returned
+// otherwise. If the listing fails, the returned error names both failures.
+func headFromList(ctx context.Context, client s3iface.S3API, loc Location, headErr error) (*s3.HeadObjectOutput, error) {
+	output, err := client.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket:  aws.String(loc.Bucket),
+		Prefix:  aws.String(loc.Key),
+		MaxKeys: aws.Int64(1),
+	})
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w, and listing the key instead failed too: %w",
+			requestError("HeadObject", loc, headErr), requestError("ListObjectsV2", loc, err))
+	}
+	if len(output.Contents) == 0 || aws.StringValue(output.Contents[0].Key) != loc.Key {
+		return nil, fmt.Errorf("%w: bucket %s, key %s", ErrNotFound, loc.Bucket, loc.Key)
+	}
+	obj := output.Contents[0]
+	return &s3.HeadObjectOutput{ContentLength: obj.Size, LastModified: obj.LastModified, ETag: obj.ETag}, nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+)
+
+func TestFetchListFallback(t *testing.T) {
+	lastModified := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	errForbidden := func() error {
+		return awserr.NewRequestFailure(awserr.New("Forbidden", "Forbidden", nil), http.StatusForbidden, "id")
+	}
+	specs := map[string]struct {
+		listFallback bool
+		setup        func(fake *testutil.FakeS3)
+		expectedErr  error
+		expectedText []string
+	}{
+		"present": {
+			true,
+			func(fake *testutil.FakeS3) {
+				fake.Put("apt-repo-bucket", "apt/generic/hello.deb",
+					testutil.FakeObject{Body: []byte("hello"), LastModified: lastModified})
+				fake.Put("apt-repo-bucket", "apt/generic/hello.deb.asc", testutil.FakeObject{Body: []byte("signature")})
+			},
+			nil,
+			nil,
+		},
+		"absent": {
+			true,
+			func(fake *testutil.FakeS3) {
+				fake.Put("apt-repo-bucket", "apt/generic/hello.deb.asc", testutil.FakeObject{Body: []byte("signature")})
+			},
+			ErrNotFound,
+			nil,
+		},
+		"list also denied": {
+			true,
+			func(fake *testutil.FakeS3) {
+				fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+				fake.ListErr = awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), http.StatusForbidden, "id")
+			},
+			nil,
+			[]string{"HeadObject s3://apt-repo-bucket/apt/generic/hello.deb failed: Forbidden",
+				"ListObjectsV2 s3://apt-repo-bucket/apt/generic/hello.deb failed: AccessDenied"},
+		},
+		"off by default": {
+			false,
+			func(fake *testutil.FakeS3) {
+				fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+			},
+			nil,
+			[]string{"HeadObject s3://apt-repo-bucket/apt/generic/hello.deb failed: Forbidden"},
+		},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			fake := testutil.NewFakeS3()
+			spec.setup(fake)
+			fake.HeadErr = errForbidden()
+			f := New(Config{Region: "us-east-1", ListFallback: spec.listFallback}, WithS3ClientFactory(func(ClientConfig) (s3iface.S3API, error) {
+				return fake, nil
+			}))
+
+			var start Object
+			result, err := f.Fetch(context.Background(), FetchRequest{
+				URI: testURI, Filename: filepath.Join(t.TempDir(), "hello.deb"), OnStart: func(obj Object) { start = obj },
+			})
+			switch {
+			case spec.expectedErr != nil:
+				if !errors.Is(err, spec.expectedErr) {
+					t.Errorf("Fetch() = %v; expected %v", err, spec.expectedErr)
+				}
+			case spec.expectedText != nil:
+				for _, text := range spec.expectedText {
+					if err == nil || !strings.Contains(err.Error(), text) {
+						t.Errorf("Fetch() = %v; expected it to contain %q", err, text)
+					}
+				}
+			case err != nil:
+				t.Fatalf("Fetch() returned unexpected error: %v", err)
+			default:
+				expected := Object{Size: 5, LastModified: lastModified}
+				if start != expected || result.Object != expected {
+					t.Errorf("OnStart(%v), Fetch() = %v; expected %v", start, result.Object, expected)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,359 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/arn"
+)
+
+const (
+	locationMinTokensCount = 3
+
+	// RegionParameter is the query parameter of s3:// URIs that names the
+	// region of the bucket, for sources outside the configured region.
+	RegionParameter = "region"
+	// RoleParameter is the query parameter of s3:// URIs that names, percent
+	// encoded, the ARN of the IAM role to assume for the source.
+	RoleParameter = "role"
+)
+
+var (
+	// ErrEmptyKey is returned by Locate and Fetch when the URI names a bucket,
+	// or nothing at all, instead of an object.
+	ErrEmptyKey = errors.New("URI does not contain an object key")
+	// ErrInvalidRegion is returned by Locate and Fetch when the
+	// RegionParameter of the URI is not a region name.
+	ErrInvalidRegion = errors.New("invalid region")
+	// ErrInvalidURI is returned by Locate and Fetch when the URI cannot be
+	// parsed.
+	ErrInvalidURI = errors.New("invalid URI")
+)
+
+// regionName matches the region names of AWS and of the S3 compatible
+// services, which use names such as auto or garage.
+var regionName = regexp.MustCompile(`^[a-z0-9-]+$`) //nolint:gochecknoglobals
+
+// ValidRegion tells whether value is a region name, as the RegionParameter of
+// a URI and the Config's Region must be.
+func ValidRegion(value string) bool {
+	return regionName.MatchString(value)
+}
+
+// A Location wraps details about the requested items location in S3.
+type Location struct {
+	URI    *url.URL
+	Bucket string
+	// Alias is the bucket name of the URI if it is an alias, which Bucket
+	// is the real name of.
+	Alias string
+	// Key is the percent-decoded object key, passed to S3 as is.
+	Key string
+	// Region is the region the URI names, which access point ARNs, interface
+	// endpoint hosts and the RegionParameter do. It takes precedence over the
+	// configured region.
+	Region string
+	// RoleARN is the role the URI names in its RoleParameter, which takes
+	// precedence over the configured role.
+	RoleARN string
+	// Endpoint is the endpoint, or endpoint template, the URI names, which
+	// interface endpoint hosts do, or that the Config's HostEndpoints give
+	// its host. It takes precedence over the configured endpoint and its
+	// fallbacks.
+	Endpoint string
+	// Latest tells whether Key is a prefix, the most recently modified object
+	// directly below which is to be fetched. Locate only sets it if the
+	// Config's Latest allows it.
+	Latest bool
+}
+
+// Locate returns the Location of the object the given s3:// URI refers to.
+// Bucket names that are aliases are replaced by the buckets they stand for.
+// URIs asking for the latest object below a prefix are recognised if the
+// Config's Latest allows them. URIs whose host has an endpoint of its own in
+// the Config's HostEndpoints are split into bucket and key, and fetched, with
+// that endpoint.
+func (f *Fetcher) Locate(uri string) (Location, error) {
+	hostEndpoint := f.hostEndpoint(uri)
+	endpoint := f.cfg.Endpoint
+	if hostEndpoint != "" {
+		endpoint = hostEndpoint
+	}
+	s3URL, err := f.endpointURL(endpoint)
+	if err != nil {
+		return Location{}, err
+	}
+	loc, err := newLocation(uri, s3URL.Hostname())
+	if err != nil {
+		return Location{}, err
+	}
+	if loc.Endpoint == "" {
+		loc.Endpoint = hostEndpoint
+	}
+	if f.cfg.Latest {
+		loc = latestLocation(loc)
+	}
+	if bucket, ok := f.cfg.BucketAliases[loc.Bucket]; ok {
+		loc.Alias, loc.Bucket = loc.Bucket, bucket
+	}
+	if arn.IsARN(loc.Bucket) {
+		return loc, nil
+	}
+	if err := validateBucket(loc); err != nil {
+		return Location{}, err
+	}
+	return loc, nil
+}
+
+// newLocation parses the given s3:// URI into a Location. The URI is
+// path-style if its host is s3Hostname, virtual-hosted-style if its host is a
+// subdomain of s3Hostname, and names the bucket as its host otherwise. Ports
+// are ignored when comparing hosts, so that a URI matches an endpoint that
+// listens on a custom port whether or not the URI spells the port out, and IPv6
+// addresses are compared without their brackets. Only host names have
+// subdomains. Hosts that are S3 ARNs are parsed by arnLocation, those of S3 interface
+// endpoints by vpceLocation, and other S3 endpoints of AWS, whatever their
+// region, by s3HostLocation. The RegionParameter sets the region of URIs whose
+// host names none, and the RoleParameter the role to assume, whatever the form
+// of the URI.
+func newLocation(value, s3Hostname string) (Location, error) {
+	loc, isARN, err := arnLocation(value)
+	if !isARN {
+		loc, err = hostLocation(value, s3Hostname)
+	}
+	if err != nil {
+		return Location{}, err
+	}
+	uri := loc.URI
+	if region := uri.Query().Get(RegionParameter); region != "" && loc.Region == "" {
+		if !ValidRegion(region) {
+			return Location{}, fmt.Errorf("%w %q in %s", ErrInvalidRegion, region, uri.Redacted())
+		}
+		loc.Region = region
+	}
+	if role := uri.Query().Get(RoleParameter); role != "" {
+		if !ValidRoleARN(role) {
+			return Location{}, fmt.Errorf("%w %q in %s: expected the ARN of an IAM role", ErrInvalidARN, role, uri.Redacted())
+		}
+		loc.RoleARN = role
+	}
+	return loc, nil
+}
+
+// hostLocation parses an s3:// URI whose host is not an ARN into a Location,
+// as newLocation describes, leaving its query parameters to newLocation.
+func hostLocation(value, s3Hostname string) (Location, error) {
+	uri, err := url.Parse(preProcessURL(value))
+	if err != nil {
+		return Location{}, invalidURIError(value, err)
+	}
+	restorePath(uri)
+	hostname := uri.Hostname()
+	loc := Location{URI: uri}
+	switch {
+	case sameHost(hostname, s3Hostname):
+		tokens := strings.Split(uri.Path, "/")
+
+		// Splitting "/bucket/this/is/a/path" on "/" produces
+		// ["", "bucket", "this", "is", "a", "path"]
+		// Note the initial empty string
+		if len(tokens) < locationMinTokensCount {
+			return Location{}, fmt.Errorf("%w: %s", ErrEmptyKey, uri.Redacted())
+		}
+
+		// The first non-zero length string is assumed to be the bucket. The rest are
+		// concatenated back together as the path to the object in the bucket.
+		loc.Bucket, loc.Key = tokens[1], strings.Join(tokens[2:], "/")
+	case isSubdomain(hostname, s3Hostname):
+		loc.Bucket, loc.Key = strings.TrimSuffix(hostname, "."+s3Hostname), strings.TrimPrefix(uri.Path, "/")
+	case vpceHostname.MatchString(hostname):
+		loc, _ = vpceLocation(uri)
+	case s3AWSHostname.MatchString(hostname):
+		loc, _ = s3HostLocation(uri)
+	default:
+		loc.Bucket, loc.Key = hostname, strings.TrimPrefix(uri.Path, "/")
+	}
+	if loc.Key == "" {
+		return Location{}, fmt.Errorf("%w: %s", ErrEmptyKey, uri.Redacted())
+	}
+	return loc, nil
+}
+
+// invalidURIError returns the ErrInvalidURI for the error url.Parse returned
+// for value. That error quotes the URI and the part of it that did not parse,
+// either of which may be a secret that was not told apart from the host, so
+// it is only repeated for URIs without user information.
+func invalidURIError(value string, err error) error {
+	if strings.Contains(value, "@") {
+		return fmt.Errorf("%w: its credentials or host do not parse, a '/' in the credentials must be percent-encoded as %%2F",
+			ErrInvalidURI)
+	}
+	return fmt.Errorf("%w: %w", ErrInvalidURI, err)
+}
+
+// restorePath moves what follows a slash in the query of the URI back to its
+// path. apt builds the URIs it acquires by appending paths such as
+// dists/stable/Release to the URI of the source, which places them in the
+// query of sources such as s3://bucket/repo?region=eu-central-1.
+func restorePath(uri *url.URL) {
+	query, rest, found := strings.Cut(uri.RawQuery, "/")
+	if !found {
+		return
+	}
+	if unescaped, err := url.PathUnescape(rest); err == nil {
+		rest = unescaped
+	}
+	uri.RawQuery = query
+	uri.Path = strings.TrimSuffix(uri.Path, "/") + "/" + rest
+	uri.RawPath = ""
+}
+
+// EncodeURI returns an s3:// URI that apt sent decoded, as apt releases that
+// predate the Send-URI-Encoded capability do, in the percent-encoded form
+// Locate expects. The '%' and '#' of the object key, which Locate would take
+// for escapes and the start of a fragment, are escaped. The user information
+// is left to preProcessURL, and the parameters of the query, which apt
+// decodes and only name regions and roles, are kept.
+func EncodeURI(uri string) string {
+	scheme, rest, found := strings.Cut(uri, "://")
+	if !found {
+		return uri
+	}
+	userinfo := ""
+	if idx := userinfoEnd(rest); idx >= 0 {
+		userinfo, rest = rest[:idx+1], rest[idx+1:]
+	}
+	host, path, found := strings.Cut(rest, "/")
+	if !found {
+		return uri
+	}
+	escape := strings.NewReplacer("%", "%25", "#", "%23").Replace
+	path, query, hasQuery := strings.Cut(path, "?")
+	path = escape(path)
+	if hasQuery {
+		// restorePath moves what follows a slash in the query to the path.
+		params, restored, hasPath := strings.Cut(query, "/")
+		path += "?" + params
+		if hasPath {
+			path += "/" + escape(restored)
+		}
+	}
+	return scheme + "://" + userinfo + host + "/" + path
+}
+
+// EscapeStrayPercents escapes every '%' of uri that is not followed by two
+// hexadecimal digits, which apt's own decoding takes for itself. apt sends such
+// URIs even once it honours Send-URI-Encoded, as it decodes the URIs of its
+// sources.
+func EscapeStrayPercents(uri string) string {
+	var escaped strings.Builder
+	for idx := 0; idx < len(uri); idx++ {
+		escaped.WriteByte(uri[idx])
+		if uri[idx] == '%' && (idx+2 >= len(uri) || !isHex(uri[idx+1]) || !isHex(uri[idx+2])) {
+			escaped.WriteString("25")
+		}
+	}
+	return escaped.String()
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+// EncodeUserinfo returns uri with the credentials in its user information
+// percent-encoded as Locate encodes them before parsing it, so that url.Parse
+// takes them for user information rather than for the host or path.
+func EncodeUserinfo(uri string) string {
+	return preProcessURL(uri)
+}
+
+// preProcessURL escapes the access key id and secret access key embedded in
+// the user information of an s3:// URI, which may contain characters such as
+// '/', '@' or '#' that would otherwise end the authority. Credentials that are
+// already percent-encoded are decoded first, so they are not encoded twice.
+// The host and path are never modified.
+func preProcessURL(value string) string {
+	scheme, rest, found := strings.Cut(value, "://")
+	if !found {
+		return value
+	}
+	idx := userinfoEnd(rest)
+	if idx < 0 {
+		return value
+	}
+	userinfo, hostAndPath := rest[:idx], rest[idx+1:]
+	key, secret, found := strings.Cut(userinfo, ":")
+	if !found {
+		return value
+	}
+	user := url.UserPassword(unescapeUserinfo(key), unescapeUserinfo(secret))
+	return scheme + "://" + user.String() + "@" + hostAndPath
+}
+
+// userinfoEnd returns the index of the '@' that ends the user information of
+// the given URI without its scheme, or -1 if there is none. User information
+// is an access key id and a secret separated by a ':', and since both the
+// secret and the object key may contain '@', it is the last '@' that follows
+// a ':' and no '/', so that an '@' in the key is never taken for it. Only if
+// there is no such '@' may the credentials contain a '/', and then only where
+// the '@' is followed by a host name with a dot in it and a path; elsewhere a
+// '/' in the credentials must be percent-encoded.
+func userinfoEnd(rest string) int {
+	end, dotted := -1, -1
+	// Since the last '/', pending is the last '@' that may end the credentials
+	// if they contain a '/', and pendingDotted the last one a dot followed.
+	colon, slash, pending, pendingDotted := false, false, -1, -1
+	for idx := range len(rest) {
+		switch rest[idx] {
+		case ':':
+			colon = true
+		case '@':
+			switch {
+			case !colon:
+			case !slash:
+				end = idx
+			default:
+				pending = idx
+			}
+		case '.':
+			pendingDotted = pending
+		case '/':
+			if pendingDotted >= 0 {
+				dotted = pendingDotted
+			}
+			slash, pending, pendingDotted = true, -1, -1
+		}
+	}
+	if end >= 0 {
+		return end
+	}
+	return dotted
+}
+
+// unescapeUserinfo decodes percent-encoded characters in one half of the user
+// information, so that credentials which were already escaped in the URI are
+// not escaped twice.
+func unescapeUserinfo(value string) string {
+	unescaped, err := url.PathUnescape(value)
+	if err != nil {
+		return value
+	}
+	return unescaped
+}
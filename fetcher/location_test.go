@@ -0,0 +1,542 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type locTest struct {
+	url             string
+	accessKey       string
+	accessKeySecret string
+}
+
+func TestCreateLocation(t *testing.T) {
+	locTests := []locTest{
+		{
+			"s3://fake-access-key-id:fake-access-key-secret@s3.amazonaws.com/apt-repo-bucket/apt/generic/python-bernhard_0.2.3-1_all.deb",
+			"fake-access-key-id",
+			"fake-access-key-secret",
+		},
+		{
+			"s3://fake-ac/cess-key-id:fake-ac/cess-key-secret@s3.amazonaws.com/apt-repo-bucket/apt/generic/python-bernhard_0.2.3-1_all.deb",
+			"fake-ac/cess-key-id",
+			"fake-ac/cess-key-secret", // secret contains a forward slash
+		},
+		{
+			"s3://fake-ac%2Fcess-key-id:fake-ac%2Fcess-key-secret@s3.amazonaws.com/apt-repo-bucket/apt/generic/python-bernhard_0.2.3-1_all.deb",
+			"fake-ac/cess-key-id",     // access key contains a forward slash that was encoded as %2F in the original url
+			"fake-ac/cess-key-secret", // secret contains a forward slash that was encoded as %2F in the original url
+		},
+		{
+			"s3://fake-access-key-id:@s3.amazonaws.com/apt-repo-bucket/apt/generic/python-bernhard_0.2.3-1_all.deb",
+			"fake-access-key-id",
+			"", // secret is blank
+		},
+		{
+			"s3://:fake-access-key-secret@s3.amazonaws.com/apt-repo-bucket/apt/generic/python-bernhard_0.2.3-1_all.deb",
+			"", // access key is blank
+			"fake-access-key-secret",
+		},
+		{
+			"s3://fake-access-key-id:a/b:c+d@s3.amazonaws.com/apt-repo-bucket/apt/generic/python-bernhard_0.2.3-1_all.deb",
+			"fake-access-key-id",
+			"a/b:c+d", // secret contains a forward slash, a colon and a plus sign
+		},
+	}
+
+	for _, spec := range locTests {
+		objLoc, err := newLocation(spec.url, "s3.amazonaws.com")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if objLoc.URI.User.Username() != spec.accessKey {
+			t.Errorf("unexpected accessKey: got %s, want %s", objLoc.URI.User.Username(), spec.accessKey)
+		}
+		pass, _ := objLoc.URI.User.Password()
+		if pass != spec.accessKeySecret {
+			t.Errorf("unexpected accessKeySecret: got %s, want %s", pass, spec.accessKeySecret)
+		}
+	}
+}
+
+func TestPreProcessURLKeepsHostAndPath(t *testing.T) {
+	specs := map[string]struct {
+		url            string
+		accessKey      string
+		secret         string
+		expectedBucket string
+		expectedKey    string
+	}{
+		"secret is part of the bucket": {
+			"s3://apt:repo@s3.amazonaws.com/apt-repo-bucket/apt/generic/hello.deb",
+			"apt",
+			"repo",
+			"apt-repo-bucket",
+			"apt/generic/hello.deb",
+		},
+		"access key is the bucket": {
+			"s3://apt-repo-bucket:se/cret@apt-repo-bucket.s3.amazonaws.com/apt-repo-bucket/hello.deb",
+			"apt-repo-bucket",
+			"se/cret",
+			"apt-repo-bucket",
+			"apt-repo-bucket/hello.deb",
+		},
+		"key contains @": {
+			"s3://AKID:secret@apt-repo-bucket/pool/v@1.0/hello.deb",
+			"AKID",
+			"secret",
+			"apt-repo-bucket",
+			"pool/v@1.0/hello.deb",
+		},
+		"secret is part of the path": {
+			"s3://AKIDEXAMPLE:a+b/c@s3.amazonaws.com/apt-repo-bucket/a+b/c/hello.deb",
+			"AKIDEXAMPLE",
+			"a+b/c",
+			"apt-repo-bucket",
+			"a+b/c/hello.deb",
+		},
+	}
+
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			objLoc, err := newLocation(spec.url, "s3.amazonaws.com")
+			if err != nil {
+				t.Fatalf("newLocation(%s) returned unexpected error: %v", spec.url, err)
+			}
+			if objLoc.Bucket != spec.expectedBucket || objLoc.Key != spec.expectedKey {
+				t.Errorf("newLocation(%s) = bucket %s, key %s; expected bucket %s, key %s",
+					spec.url, objLoc.Bucket, objLoc.Key, spec.expectedBucket, spec.expectedKey)
+			}
+			if actual := objLoc.URI.User.Username(); actual != spec.accessKey {
+				t.Errorf("access key = %s; expected %s", actual, spec.accessKey)
+			}
+			if actual, _ := objLoc.URI.User.Password(); actual != spec.secret {
+				t.Errorf("secret = %s; expected %s", actual, spec.secret)
+			}
+		})
+	}
+}
+
+func TestPreProcessURLWithoutCredentials(t *testing.T) {
+	for _, value := range []string{
+		"s3://apt-repo-bucket/apt/generic/hello.deb",
+		"s3://apt-repo-bucket/apt/generic/hello@1.0.deb",
+		"s3://apt-repo-bucket/pool/v@1.0/hel%lo.deb",
+		"s3://fake-access-key-id@s3.amazonaws.com/apt-repo-bucket/hello.deb",
+	} {
+		if actual := preProcessURL(value); actual != value {
+			t.Errorf("preProcessURL(%s) = %s; expected it unchanged", value, actual)
+		}
+	}
+}
+
+func TestCreateLocationDecodesKey(t *testing.T) {
+	keys := map[string]struct {
+		path        string
+		expectedKey string
+	}{
+		"space":             {"pool/hello%20world.deb", "pool/hello world.deb"},
+		"plus":              {"pool/hello+world.deb", "pool/hello+world.deb"},
+		"encoded plus":      {"pool/hello%2Bworld.deb", "pool/hello+world.deb"},
+		"non-ASCII":         {"pool/grüße.deb", "pool/grüße.deb"},
+		"encoded non-ASCII": {"pool/gr%C3%BC%C3%9Fe.deb", "pool/grüße.deb"},
+	}
+	forms := map[string]string{
+		"path-style":   "s3://AKIDEXAMPLE:secret@s3.amazonaws.com/apt-repo-bucket/",
+		"virtual-host": "s3://apt-repo-bucket/",
+	}
+
+	for formName, prefix := range forms {
+		for keyName, spec := range keys {
+			t.Run(formName+"/"+keyName, func(t *testing.T) {
+				value := prefix + spec.path
+				objLoc, err := newLocation(value, "s3.amazonaws.com")
+				if err != nil {
+					t.Fatalf("newLocation(%s) returned unexpected error: %v", value, err)
+				}
+				if objLoc.Bucket != "apt-repo-bucket" || objLoc.Key != spec.expectedKey {
+					t.Errorf("newLocation(%s) = bucket %s, key %q; expected bucket apt-repo-bucket, key %q",
+						value, objLoc.Bucket, objLoc.Key, spec.expectedKey)
+				}
+			})
+		}
+	}
+}
+
+func TestEncodeURI(t *testing.T) {
+	specs := map[string]struct {
+		uri      string
+		expected string
+	}{
+		"plain":         {"s3://apt-repo-bucket/dists/stable/Release", "s3://apt-repo-bucket/dists/stable/Release"},
+		"space":         {"s3://apt-repo-bucket/pool/a b.deb", "s3://apt-repo-bucket/pool/a b.deb"},
+		"percent":       {"s3://apt-repo-bucket/pool/100% done+1.deb", "s3://apt-repo-bucket/pool/100%25 done+1.deb"},
+		"escape in key": {"s3://apt-repo-bucket/pool/a%20b.deb", "s3://apt-repo-bucket/pool/a%2520b.deb"},
+		"hash":          {"s3://apt-repo-bucket/pool/c#.deb", "s3://apt-repo-bucket/pool/c%23.deb"},
+		"query":         {"s3://apt-repo-bucket/repo?region=eu-west-1/pool/a%b.deb", "s3://apt-repo-bucket/repo?region=eu-west-1/pool/a%25b.deb"},
+		"credentials":   {"s3://AKID:se%cret@apt-repo-bucket/pool/a%b.deb", "s3://AKID:se%cret@apt-repo-bucket/pool/a%25b.deb"},
+		"@ in key":      {"s3://apt-repo-bucket/pool/v@1.0/hel%lo.deb", "s3://apt-repo-bucket/pool/v@1.0/hel%25lo.deb"},
+		"no path":       {"s3://apt-repo-bucket", "s3://apt-repo-bucket"},
+		"no scheme":     {"apt-repo-bucket/a%b", "apt-repo-bucket/a%b"},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			if actual := EncodeURI(spec.uri); actual != spec.expected {
+				t.Errorf("EncodeURI(%s) = %s; expected %s", spec.uri, actual, spec.expected)
+			}
+		})
+	}
+}
+
+func TestEscapeStrayPercents(t *testing.T) {
+	specs := map[string]struct {
+		uri      string
+		expected string
+	}{
+		"escapes":   {"s3://apt-repo-bucket/pool/a%2520b.deb", "s3://apt-repo-bucket/pool/a%2520b.deb"},
+		"stray":     {"s3://apt-repo-bucket/repo%x+y z/Release", "s3://apt-repo-bucket/repo%25x+y z/Release"},
+		"one digit": {"s3://apt-repo-bucket/100%a", "s3://apt-repo-bucket/100%25a"},
+		"trailing":  {"s3://apt-repo-bucket/100%", "s3://apt-repo-bucket/100%25"},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			if actual := EscapeStrayPercents(spec.uri); actual != spec.expected {
+				t.Errorf("EscapeStrayPercents(%s) = %s; expected %s", spec.uri, actual, spec.expected)
+			}
+		})
+	}
+}
+
+func TestLocateWithEndpointPort(t *testing.T) {
+	specs := map[string]struct {
+		endpoint       string
+		uri            string
+		expectedBucket string
+	}{
+		"endpoint and URI with port": {
+			"https://minio.internal:9000",
+			"s3://minio.internal:9000/apt-repo-bucket/pool/hello.deb",
+			"apt-repo-bucket",
+		},
+		"endpoint with port, URI without": {
+			"https://minio.internal:9000",
+			"s3://minio.internal/apt-repo-bucket/pool/hello.deb",
+			"apt-repo-bucket",
+		},
+		"URI with port, endpoint without": {
+			"https://minio.internal",
+			"s3://minio.internal:9000/apt-repo-bucket/pool/hello.deb",
+			"apt-repo-bucket",
+		},
+		"credentials and port": {
+			"https://minio.internal:9000",
+			"s3://fake-access-key-id:fake-access-key-secret@minio.internal:9000/apt-repo-bucket/pool/hello.deb",
+			"apt-repo-bucket",
+		},
+		"virtual host with port": {
+			"https://minio.internal:9000",
+			"s3://apt-repo-bucket.minio.internal:9000/pool/hello.deb",
+			"apt-repo-bucket",
+		},
+		"virtual host, endpoint with port": {
+			"https://minio.internal:9000",
+			"s3://apt-repo-bucket.minio.internal/pool/hello.deb",
+			"apt-repo-bucket",
+		},
+		"IPv4 address": {
+			"http://10.0.0.5:9000",
+			"s3://10.0.0.5:9000/apt-repo-bucket/pool/hello.deb",
+			"apt-repo-bucket",
+		},
+		"IPv6 address and URI with port": {
+			"https://[fd00::10]:9000",
+			"s3://[fd00::10]:9000/apt-repo-bucket/pool/hello.deb",
+			"apt-repo-bucket",
+		},
+		"IPv6 address, URI without port": {
+			"https://[fd00::10]:9000",
+			"s3://[fd00::10]/apt-repo-bucket/pool/hello.deb",
+			"apt-repo-bucket",
+		},
+		"IPv6 address spelled out": {
+			"https://[fd00::10]",
+			"s3://[FD00:0:0:0:0:0:0:10]/apt-repo-bucket/pool/hello.deb",
+			"apt-repo-bucket",
+		},
+		"credentials and IPv6 address": {
+			"https://[fd00::10]:9000",
+			"s3://fake-access-key-id:fake-access-key-secret@[fd00::10]:9000/apt-repo-bucket/pool/hello.deb",
+			"apt-repo-bucket",
+		},
+		"bucket of an IPv6 endpoint": {
+			"https://[fd00::10]:9000",
+			"s3://apt-repo-bucket/pool/hello.deb",
+			"apt-repo-bucket",
+		},
+	}
+
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			objLoc, err := New(Config{Endpoint: spec.endpoint}).Locate(spec.uri)
+			if err != nil {
+				t.Fatalf("Locate(%s) returned unexpected error: %v", spec.uri, err)
+			}
+			if objLoc.Bucket != spec.expectedBucket || objLoc.Key != "pool/hello.deb" {
+				t.Errorf("Locate(%s) = bucket %s, key %s; expected bucket %s, key pool/hello.deb",
+					spec.uri, objLoc.Bucket, objLoc.Key, spec.expectedBucket)
+			}
+		})
+	}
+}
+
+func TestCreateLocationEmptyKey(t *testing.T) {
+	for _, value := range []string{
+		"s3://s3.amazonaws.com/apt-repo-bucket/",
+		"s3://s3.amazonaws.com/apt-repo-bucket",
+		"s3://s3.amazonaws.com/",
+		"s3://s3.amazonaws.com",
+		"s3://fake-access-key-id:fake-access-key-secret@s3.amazonaws.com/apt-repo-bucket",
+		"s3://apt-repo-bucket.s3.amazonaws.com/",
+		"s3://apt-repo-bucket.s3.amazonaws.com",
+		"s3://apt-repo-bucket/",
+		"s3://apt-repo-bucket",
+	} {
+		t.Run(value, func(t *testing.T) {
+			_, err := newLocation(value, "s3.amazonaws.com")
+			if !errors.Is(err, ErrEmptyKey) {
+				t.Errorf("newLocation(%s) = %v; expected %v", value, err, ErrEmptyKey)
+			}
+			if err != nil && strings.Contains(err.Error(), "fake-access-key-secret") {
+				t.Errorf("newLocation(%s) = %v; expected the secret to be redacted", value, err)
+			}
+		})
+	}
+}
+
+func TestCreateLocationRegionParameter(t *testing.T) {
+	specs := map[string]struct {
+		url            string
+		expectedRegion string
+		expectedErr    error
+	}{
+		"path-style":        {"s3://s3.amazonaws.com/apt-repo-bucket/dists/stable/Release?region=eu-central-1", "eu-central-1", nil},
+		"bucket host":       {"s3://apt-repo-bucket/dists/stable/Release?region=eu-central-1", "eu-central-1", nil},
+		"empty":             {"s3://apt-repo-bucket/dists/stable/Release?region=", "", nil},
+		"source":            {"s3://apt-repo-bucket/dists?region=eu-central-1/stable/Release", "eu-central-1", nil},
+		"source with slash": {"s3://apt-repo-bucket/dists/?region=eu-central-1/stable/Release", "eu-central-1", nil},
+		"interface endpoint": {
+			"s3://bucket.vpce-1a2b3c4d-5e6f.s3.us-east-1.vpce.amazonaws.com/apt-repo-bucket/dists/stable/Release?region=eu-central-1",
+			"us-east-1",
+			nil,
+		},
+		"invalid": {"s3://apt-repo-bucket/dists/stable/Release?region=evil.example.com/", "", ErrInvalidRegion},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			loc, err := newLocation(spec.url, "s3.amazonaws.com")
+			if !errors.Is(err, spec.expectedErr) {
+				t.Fatalf("newLocation(%s) returned %v; expected %v", spec.url, err, spec.expectedErr)
+			}
+			if loc.Region != spec.expectedRegion {
+				t.Errorf("newLocation(%s).Region = %q; expected %q", spec.url, loc.Region, spec.expectedRegion)
+			}
+			if err == nil && loc.Key != "dists/stable/Release" {
+				t.Errorf("newLocation(%s).Key = %q; expected the query to be left out", spec.url, loc.Key)
+			}
+		})
+	}
+}
+
+func TestLocateRoleParameter(t *testing.T) {
+	f := New(Config{Region: "us-east-1", RoleARN: "arn:aws:iam::123456789012:role/global"})
+	specs := map[string]struct {
+		url          string
+		expectedRole string
+		expectedErr  error
+	}{
+		"configured": {"s3://apt-repo-bucket/dists/stable/Release", "arn:aws:iam::123456789012:role/global", nil},
+		"encoded": {
+			"s3://apt-repo-bucket/dists/stable/Release?role=arn%3Aaws%3Aiam%3A%3A123456789012%3Arole%2Fapt-reader",
+			"arn:aws:iam::123456789012:role/apt-reader",
+			nil,
+		},
+		"source": {
+			"s3://apt-repo-bucket/dists?role=arn%3Aaws%3Aiam%3A%3A123456789012%3Arole%2Fapt-reader&region=eu-west-1/stable/Release",
+			"arn:aws:iam::123456789012:role/apt-reader",
+			nil,
+		},
+		"not a role": {"s3://apt-repo-bucket/dists/stable/Release?role=arn%3Aaws%3As3%3A%3A%3Abucket", "", ErrInvalidARN},
+		"not an ARN": {"s3://apt-repo-bucket/dists/stable/Release?role=apt-reader", "", ErrInvalidARN},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			loc, err := f.Locate(spec.url)
+			if !errors.Is(err, spec.expectedErr) {
+				t.Fatalf("Locate(%s) returned %v; expected %v", spec.url, err, spec.expectedErr)
+			}
+			if err != nil {
+				return
+			}
+			if loc.Key != "dists/stable/Release" {
+				t.Errorf("Locate(%s).Key = %q; expected %q", spec.url, loc.Key, "dists/stable/Release")
+			}
+			if role := f.ClientConfig(loc).RoleARN; role != spec.expectedRole {
+				t.Errorf("ClientConfig().RoleARN = %q; expected %q", role, spec.expectedRole)
+			}
+		})
+	}
+}
+
+func TestLocateHostEndpoints(t *testing.T) {
+	f := New(Config{Region: "us-east-1", HostEndpoints: map[string]string{
+		"internal":            "https://{bucket}.s3.internal",
+		"MinIO.corp.internal": "https://minio.corp.internal:9000/{bucket}",
+	}})
+	specs := map[string]Location{
+		"s3://minio.corp.internal:9000/apt-repo/pool/hello.deb": {
+			Bucket: "apt-repo", Key: "pool/hello.deb", Endpoint: "https://minio.corp.internal:9000/{bucket}",
+		},
+		"s3://apt-repo.s3.internal/pool/hello.deb": {Bucket: "apt-repo", Key: "pool/hello.deb", Endpoint: "https://{bucket}.s3.internal"},
+		"s3://apt-repo/pool/hello.deb":             {Bucket: "apt-repo", Key: "pool/hello.deb"},
+	}
+	for url, expected := range specs {
+		loc, err := f.Locate(url)
+		if err != nil {
+			t.Errorf("Locate(%s) returned %v; expected nil", url, err)
+			continue
+		}
+		expected.URI = loc.URI
+		if diff := cmp.Diff(expected, loc); diff != "" {
+			t.Errorf("Locate(%s) differs (-expected +actual):\n%s", url, diff)
+		}
+	}
+}
+
+func TestLocateBucketAlias(t *testing.T) {
+	f := New(Config{Region: "us-east-1", BucketAliases: map[string]string{"apt-repo": "apt-repo-prod-eu"}})
+	specs := map[string]Location{
+		"s3://apt-repo/pool/hello.deb":                  {Bucket: "apt-repo-prod-eu", Alias: "apt-repo", Key: "pool/hello.deb"},
+		"s3://s3.amazonaws.com/apt-repo/pool/hello.deb": {Bucket: "apt-repo-prod-eu", Alias: "apt-repo", Key: "pool/hello.deb"},
+		"s3://apt-repo-prod-eu/pool/hello.deb":          {Bucket: "apt-repo-prod-eu", Key: "pool/hello.deb"},
+	}
+	for uri, expected := range specs {
+		objLoc, err := f.Locate(uri)
+		if err != nil {
+			t.Fatalf("Locate(%s) returned unexpected error: %v", uri, err)
+		}
+		objLoc.URI = nil
+		if diff := cmp.Diff(expected, objLoc); diff != "" {
+			t.Errorf("Locate(%s) mismatch (-want +got):\n%s", uri, diff)
+		}
+	}
+}
+
+// FuzzPreProcessURL checks that preProcessURL does not panic, leaves the host
+// and path of the URI alone and escapes credentials only once, so that
+// preprocessing its result changes nothing.
+func FuzzPreProcessURL(f *testing.F) {
+	for _, seed := range []string{
+		"s3://fake-ac/cess-key-id:fake-ac/cess-key-secret@s3.amazonaws.com/apt-repo-bucket/hello.deb",
+		"s3://fake-ac%2Fcess-key-id:fake-ac%2Fcess-key-secret@s3.amazonaws.com/apt-repo-bucket/hello.deb",
+		"s3://AKIDEXAMPLE:a+b/c@s3.amazonaws.com/apt-repo-bucket/a+b/c/hello@1.0.deb",
+		"s3://apt-repo-bucket/apt/generic/hello.deb",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, value string) {
+		processed := preProcessURL(value)
+		if processed == value {
+			return
+		}
+		_, rest, _ := strings.Cut(value, "://")
+		if hostAndPath := rest[userinfoEnd(rest)+1:]; !strings.HasSuffix(processed, "@"+hostAndPath) {
+			t.Errorf("preProcessURL(%q) = %q; expected it to keep the host and path %q", value, processed, hostAndPath)
+		}
+		if again := preProcessURL(processed); again != processed {
+			t.Errorf("preProcessURL(%q) = %q; expected it to be left alone", processed, again)
+		}
+	})
+}
+
+// FuzzNewLocation checks that newLocation does not panic, and that the bucket
+// and key of the Locations it returns for path-style and virtual-hosted-style
+// URIs reassemble into the path of the URI. The corpus in
+// testdata/fuzz/FuzzNewLocation is replayed by every go test run.
+func FuzzNewLocation(f *testing.F) {
+	for _, seed := range []string{
+		"s3://fake-access-key-id:fake-access-key-secret@s3.amazonaws.com/apt-repo-bucket/apt/generic/hello.deb",
+		"s3://fake-ac%2Fcess-key-id:a/b:c+d@s3.amazonaws.com/apt-repo-bucket/a+b/c/hello.deb",
+		"s3://apt-repo-bucket:se/cret@apt-repo-bucket.s3.amazonaws.com/apt-repo-bucket/hello.deb",
+		"s3://apt-repo-bucket/apt/generic/hello@1.0.deb",
+		"s3://apt-repo-bucket/apt/generic/hello%20world.deb",
+		"s3://bucket.vpce-1a2b3c4d-5e6f.s3.us-east-1.vpce.amazonaws.com/hello.deb",
+		"s3://arn:aws:s3:us-west-2:123456789012:accesspoint/apt-repo/hello.deb",
+		"s3://s3.amazonaws.com/apt-repo-bucket",
+	} {
+		f.Add(seed)
+	}
+	const s3Hostname = "s3.amazonaws.com"
+	f.Fuzz(func(t *testing.T, value string) {
+		loc, err := newLocation(value, s3Hostname)
+		if err != nil {
+			return
+		}
+		if loc.Key == "" {
+			t.Errorf("newLocation(%q) returned an empty key", value)
+		}
+		var expected string
+		switch hostname := loc.URI.Hostname(); {
+		case loc.Region != "" || loc.Endpoint != "":
+			// Access point ARNs and interface endpoints name the bucket
+			// differently.
+			return
+		case validateBucket(loc) != nil:
+			// Locate rejects the URI.
+			return
+		case hostname == s3Hostname:
+			expected = "/" + loc.Bucket + "/" + loc.Key
+		case hostname == loc.Bucket || hostname == loc.Bucket+"."+s3Hostname:
+			expected = "/" + loc.Key
+		default:
+			t.Fatalf("newLocation(%q) = bucket %q; expected it to be named by the host %q", value, loc.Bucket, hostname)
+		}
+		if loc.URI.Path != expected {
+			t.Errorf("newLocation(%q) = bucket %q, key %q; expected them to reassemble into %q", value, loc.Bucket, loc.Key, loc.URI.Path)
+		}
+	})
+}
+
+func TestValidRegion(t *testing.T) {
+	specs := map[string]bool{
+		"eu-west-1":                 true,
+		"auto":                      true,
+		"garage":                    true,
+		"":                          false,
+		"EU-WEST-1":                 false,
+		"evil.example.com/":         false,
+		"us-east-1\nMessage: hello": false,
+	}
+	for value, expected := range specs {
+		if actual := ValidRegion(value); actual != expected {
+			t.Errorf("ValidRegion(%q) = %t; expected %t", value, actual, expected)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"os"
+)
+
+// An outputState records the file a fetch writes to as it was before the
+// fetch, so that a failed fetch removes whatever it wrote, but not a file it
+// never touched.
+type outputState struct {
+	filename string
+	before   os.FileInfo
+}
+
+func recordOutput(filename string) outputState {
+	before, err := os.Stat(filename)
+	if err != nil {
+		before = nil
+	}
+	return outputState{filename: filename, before: before}
+}
+
+// cleanUp removes the file unless it is unchanged since recordOutput.
+func (output outputState) cleanUp() {
+	after, err := os.Stat(output.filename)
+	if err != nil {
+		return
+	}
+	if output.before != nil && os.SameFile(output.before, after) &&
+		after.Size() == output.before.Size() && after.ModTime().Equal(output.before.ModTime()) {
+		return
+	}
+	os.Remove(output.filename)
+}
@@ -0,0 +1,212 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"crypto/sha1" //nolint:gosec
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// ErrPartChecksumMismatch is returned by Fetch when a part of a multipart
+// object does not match the checksum S3 recorded for it on upload.
+var ErrPartChecksumMismatch = errors.New("part checksum mismatch")
+
+// partChecksumAlgorithms are the checksums S3 may record for the parts of a
+// multipart upload, in the order they are preferred in.
+//
+//nolint:gochecknoglobals
+var partChecksumAlgorithms = []struct {
+	name    string
+	value   func(part *s3.ObjectPart) *string
+	newHash func() hash.Hash
+}{
+	{"SHA256", func(part *s3.ObjectPart) *string { return part.ChecksumSHA256 }, sha256.New},
+	{"SHA1", func(part *s3.ObjectPart) *string { return part.ChecksumSHA1 }, sha1.New},
+	{"CRC32C", func(part *s3.ObjectPart) *string { return part.ChecksumCRC32C }, func() hash.Hash {
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	}},
+	{"CRC32", func(part *s3.ObjectPart) *string { return part.ChecksumCRC32 }, func() hash.Hash {
+		return crc32.NewIEEE()
+	}},
+}
+
+// A checksummedPart is a part of a multipart object along with the checksum
+// S3 recorded for it on upload.
+type checksummedPart struct {
+	number, offset, size int64
+	algorithm            string
+	checksum             string
+	newHash              func() hash.Hash
+}
+
+// partChecksums returns the parts of the object at loc with their checksums,
+// or nil if the object was not uploaded in parts with checksums or S3 would
+// not tell.
+func partChecksums(ctx context.Context, client s3iface.S3API, loc Location) []checksummedPart {
+	input := &s3.GetObjectAttributesInput{
+		Bucket:           aws.String(loc.Bucket),
+		Key:              aws.String(loc.Key),
+		ObjectAttributes: aws.StringSlice([]string{s3.ObjectAttributesObjectParts}),
+	}
+	var parts []checksummedPart
+	offset := int64(0)
+	for {
+		output, err := client.GetObjectAttributesWithContext(ctx, input)
+		if err != nil || output.ObjectParts == nil {
+			return nil
+		}
+		for _, objectPart := range output.ObjectParts.Parts {
+			part, ok := newChecksummedPart(objectPart, offset)
+			if !ok {
+				return nil
+			}
+			parts = append(parts, part)
+			offset += part.size
+		}
+		if !aws.BoolValue(output.ObjectParts.IsTruncated) {
+			return parts
+		}
+		input.PartNumberMarker = output.ObjectParts.NextPartNumberMarker
+	}
+}
+
+// newChecksummedPart describes the given part, starting at offset, by its
+// preferred checksum. The second result is false if it has none.
+func newChecksummedPart(objectPart *s3.ObjectPart, offset int64) (checksummedPart, bool) {
+	for _, algorithm := range partChecksumAlgorithms {
+		if checksum := aws.StringValue(algorithm.value(objectPart)); checksum != "" {
+			return checksummedPart{
+				number:    aws.Int64Value(objectPart.PartNumber),
+				offset:    offset,
+				size:      aws.Int64Value(objectPart.Size),
+				algorithm: algorithm.name,
+				checksum:  checksum,
+				newHash:   algorithm.newHash,
+			}, true
+		}
+	}
+	return checksummedPart{}, false
+}
+
+// downloadParts writes the object at loc to the file of req part by part,
+// verifying each part against its checksum as soon as it is complete. The
+// first mismatch cancels the remaining parts. Otherwise it behaves like download.
+func (f *Fetcher) downloadParts(
+	ctx context.Context, client s3iface.S3API, loc Location, req FetchRequest, result *FetchResult, parts []checksummedPart,
+) error {
+	file, err := f.createSizedFile(req.Filename, result.Size)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	partsCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	result.Timings.PartSize, result.Timings.Concurrency = parts[0].size, s3manager.DefaultDownloadConcurrency
+	writer := &firstByteWriterAt{WriterAt: file, now: f.clock.Now, onProgress: req.OnProgress}
+	start := f.clock.Now()
+
+	pending := make(chan checksummedPart, len(parts))
+	for _, part := range parts {
+		pending <- part
+	}
+	close(pending)
+	errs := make(chan error, len(parts))
+	var wg sync.WaitGroup
+	for range result.Timings.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for part := range pending {
+				if partsCtx.Err() != nil {
+					return
+				}
+				if err := downloadPart(partsCtx, client, loc, result.ETag, writer, part); err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err := <-errs; err != nil {
+		if diskErr := diskError(err); errors.Is(diskErr, ErrWriteFile) {
+			return diskErr
+		}
+		return requestError("GetObject", loc, err)
+	}
+	result.Timings.Transfer = f.since(start)
+	result.Timings.FirstByte = writer.sinceStart(start)
+	last := parts[len(parts)-1]
+	switch size := last.offset + last.size; {
+	case result.Size < 0:
+		result.Size = size
+	case size != result.Size:
+		return fmt.Errorf("%w: parts add up to %d bytes, expected %d", ErrSizeMismatch, size, result.Size)
+	}
+	return f.closeFile(file)
+}
+
+// downloadPart writes a single part of the object at loc to w at the part's
+// offset and verifies its size and checksum. The GetObject is conditional on
+// etag as getObjectInput describes.
+func downloadPart(
+	ctx context.Context, client s3iface.S3API, loc Location, etag string, w io.WriterAt, part checksummedPart,
+) error {
+	input := getObjectInput(loc, etag)
+	input.PartNumber = aws.Int64(part.number)
+	// The checksum is that of the stored bytes, so Go's HTTP transport must
+	// not decode the part, as it would if it asked for gzip itself.
+	output, err := client.GetObjectWithContext(ctx, input,
+		request.WithSetRequestHeaders(map[string]string{"Accept-Encoding": "identity"}))
+	if err != nil {
+		return err
+	}
+	defer output.Body.Close()
+
+	digest := part.newHash()
+	numBytes, err := copyBuffered(io.NewOffsetWriter(w, part.offset), io.TeeReader(output.Body, digest))
+	if err != nil {
+		return err
+	}
+	if numBytes != part.size {
+		return fmt.Errorf("%w: part %d got %d bytes, expected %d", ErrSizeMismatch, part.number, numBytes, part.size)
+	}
+	if checksum := base64.StdEncoding.EncodeToString(digest.Sum(nil)); checksum != part.checksum {
+		return fmt.Errorf("%w: part %d of s3://%s/%s has %s %s, expected %s",
+			ErrPartChecksumMismatch, part.number, loc.Bucket, loc.Key, part.algorithm, checksum, part.checksum)
+	}
+	return nil
+}
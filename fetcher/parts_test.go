@@ -0,0 +1,90 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+)
+
+func sha256Part(t *testing.T, content string) testutil.FakePart {
+	t.Helper()
+	sum := sha256.Sum256([]byte(content))
+	return testutil.FakePart{Size: int64(len(content)), ChecksumSHA256: base64.StdEncoding.EncodeToString(sum[:])}
+}
+
+func TestFetchVerifyParts(t *testing.T) {
+	const content = "hello, multipart world"
+	chunks := []string{content[:8], content[8:16], content[16:]}
+	goodParts := []testutil.FakePart{sha256Part(t, chunks[0]), sha256Part(t, chunks[1]), sha256Part(t, chunks[2])}
+	badParts := []testutil.FakePart{sha256Part(t, chunks[0]), sha256Part(t, "corrupted"), sha256Part(t, chunks[2])}
+	specs := map[string]struct {
+		verify       bool
+		parts        []testutil.FakePart
+		expectedErr  error
+		expectedGets int
+	}{
+		"verified":        {true, goodParts, nil, 3},
+		"mismatch":        {true, badParts, ErrPartChecksumMismatch, -1},
+		"off by default":  {false, badParts, nil, 1},
+		"single part":     {true, nil, nil, 1},
+		"no checksums":    {true, []testutil.FakePart{{Size: 8}, {Size: 8}, {Size: 6}}, nil, 1},
+		"paged part list": {true, append(goodParts[:2:2], sha256Part(t, chunks[2][:3]), sha256Part(t, chunks[2][3:])), nil, 4},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			fake := testutil.NewFakeS3()
+			fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte(content), Parts: spec.parts})
+			dir := t.TempDir()
+			filename := filepath.Join(dir, "hello.deb")
+			before := testutil.SnapshotDir(t, dir)
+			f := New(Config{Region: "us-east-1", VerifyParts: spec.verify}, WithS3ClientFactory(func(ClientConfig) (s3iface.S3API, error) {
+				return fake, nil
+			}))
+
+			result, err := f.Fetch(context.Background(), FetchRequest{URI: testURI, Filename: filename})
+			if !errors.Is(err, spec.expectedErr) {
+				t.Fatalf("Fetch() = %v; expected %v", err, spec.expectedErr)
+			}
+			if err != nil {
+				if !strings.Contains(err.Error(), "part 2 of s3://apt-repo-bucket/apt/generic/hello.deb has SHA256") {
+					t.Errorf("Fetch() = %v; expected it to name the mismatched part", err)
+				}
+				before.CheckUnchanged(t)
+				return
+			}
+			contents, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatalf("failed to read fetched file: %v", err)
+			}
+			if string(contents) != content || result.Size != int64(len(content)) {
+				t.Errorf("fetched %q (%d bytes); expected %q", contents, result.Size, content)
+			}
+			if gets := fake.Gets(); gets != spec.expectedGets {
+				t.Errorf("GetObject called %d times; expected %d", gets, spec.expectedGets)
+			}
+		})
+	}
+}
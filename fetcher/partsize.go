@@ -0,0 +1,54 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const (
+	// maxParts is the number of ranged GetObject requests a large object is
+	// downloaded in, unless that would make its parts larger than
+	// maxPartSize.
+	maxParts = 64
+	// maxPartSize bounds the part size chosen for large objects.
+	maxPartSize = 128 << 20
+	// partSizeAlignment is the multiple part sizes chosen for large objects
+	// are rounded up to.
+	partSizeAlignment = 1 << 20
+)
+
+// partSize returns the size of the ranged requests an object of the given
+// size is downloaded in. A configured part size always wins. Otherwise,
+// objects no larger than the default part size take a single request, and
+// objects that would take more than maxParts requests of the default size
+// take maxParts larger ones, up to maxPartSize each, so that multi-gigabyte
+// packages do not take thousands of requests. Objects of unknown size use
+// the default.
+func partSize(size, configured int64) int64 {
+	switch {
+	case configured > 0:
+		return configured
+	case size <= 0:
+		return s3manager.DefaultDownloadPartSize
+	case size <= s3manager.DefaultDownloadPartSize:
+		return size
+	case size <= maxParts*s3manager.DefaultDownloadPartSize:
+		return s3manager.DefaultDownloadPartSize
+	}
+	part := (size + maxParts - 1) / maxParts
+	part = (part + partSizeAlignment - 1) / partSizeAlignment * partSizeAlignment
+	return min(part, maxPartSize)
+}
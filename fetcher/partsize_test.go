@@ -0,0 +1,49 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+func TestPartSize(t *testing.T) {
+	const mib = 1 << 20
+	specs := map[string]struct {
+		size, configured int64
+		expected         int64
+	}{
+		"unknown size":         {-1, 0, s3manager.DefaultDownloadPartSize},
+		"empty":                {0, 0, s3manager.DefaultDownloadPartSize},
+		"small":                {1000, 0, 1000},
+		"default part size":    {s3manager.DefaultDownloadPartSize, 0, s3manager.DefaultDownloadPartSize},
+		"mid-size":             {100 * mib, 0, s3manager.DefaultDownloadPartSize},
+		"largest default":      {maxParts * s3manager.DefaultDownloadPartSize, 0, s3manager.DefaultDownloadPartSize},
+		"large":                {4096 * mib, 0, 64 * mib},
+		"large, rounded up":    {4096*mib + 1, 0, 65 * mib},
+		"huge":                 {64 * 1024 * mib, 0, maxPartSize},
+		"configured":           {4096 * mib, 16 * mib, 16 * mib},
+		"configured for small": {1000, 16 * mib, 16 * mib},
+		"configured, unknown":  {-1, 16 * mib, 16 * mib},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			if actual := partSize(spec.size, spec.configured); actual != spec.expected {
+				t.Errorf("partSize(%d, %d) = %d; expected %d", spec.size, spec.configured, actual, spec.expected)
+			}
+		})
+	}
+}
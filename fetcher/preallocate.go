@@ -0,0 +1,60 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// createSizedFile creates the named file like the Fetcher's createFile does,
+// and preallocates size bytes for it unless the Config disables that or the
+// size is unknown, so that a disk without enough space fails the fetch before
+// the download rather than during it. Preallocating also spares copy-on-write
+// filesystems from the fragmentation of writing parts out of order.
+func (f *Fetcher) createSizedFile(filename string, size int64) (outputFile, error) {
+	file, err := f.createFile(filename)
+	if err != nil {
+		return nil, diskError(err)
+	}
+	osFile, ok := file.(*os.File)
+	if f.cfg.DisablePreallocate || !ok || size <= 0 {
+		return file, nil
+	}
+	if err := preallocationError(filename, size, allocate(osFile, size)); err != nil {
+		file.Close()
+		os.Remove(filename)
+		return nil, err
+	}
+	return file, nil
+}
+
+// preallocationError turns the error of preallocating size bytes for the named
+// file into one wrapping ErrWriteFile that tells how many bytes are needed and
+// available if the disk is full. Other failures, e.g. of filesystems that do
+// not support preallocation, are not worth failing the fetch for and yield
+// nil.
+func preallocationError(filename string, size int64, err error) error {
+	if !errors.Is(err, syscall.ENOSPC) && !errors.Is(err, syscall.EDQUOT) {
+		return nil
+	}
+	if available, ok := availableBytes(filename); ok {
+		return fmt.Errorf("%w: %s: the object needs %d bytes, but only %d are available: %w",
+			ErrWriteFile, filename, size, available, err)
+	}
+	return fmt.Errorf("%w: %s: the object needs %d bytes: %w", ErrWriteFile, filename, size, err)
+}
@@ -0,0 +1,66 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const (
+	// fallocKeepSize is FALLOC_FL_KEEP_SIZE, which the syscall package lacks.
+	fallocKeepSize = 0x1
+	// statBlockSize is the unit of the blocks stat counts, whatever the block
+	// size of the filesystem.
+	statBlockSize = 512
+)
+
+// allocate reserves size bytes on disk for file with fallocate. The file keeps
+// its size, which grows as the object is written, since apt tells how far
+// along a download is by the size of its file.
+func allocate(file *os.File, size int64) error {
+	return syscall.Fallocate(int(file.Fd()), fallocKeepSize, 0, size)
+}
+
+// filesystemID returns the device of the filesystem the named file is, or
+// will be, created on.
+func filesystemID(filename string) (uint64, bool) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(filepath.Dir(filename), &stat); err != nil {
+		return 0, false
+	}
+	return stat.Dev, true
+}
+
+// allocatedBytes returns the number of bytes allocated on disk to the named
+// file, preallocated ones included, or zero if it does not exist.
+func allocatedBytes(filename string) int64 {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(filename, &stat); err != nil {
+		return 0
+	}
+	return stat.Blocks * statBlockSize
+}
+
+// availableBytes returns the number of bytes available to unprivileged users
+// on the filesystem of the named file.
+func availableBytes(filename string) (uint64, bool) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(filepath.Dir(filename), &stat); err != nil {
+		return 0, false
+	}
+	return stat.Bavail * uint64(stat.Bsize), true //nolint:gosec
+}
@@ -0,0 +1,42 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestAllocateKeepsSize(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "hello.deb"))
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	defer file.Close()
+
+	if err := allocate(file, 1<<20); err != nil {
+		t.Skipf("fallocate is not supported here: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatalf("failed to stat file: %v", err)
+	}
+	stat := info.Sys().(*syscall.Stat_t) //nolint:forcetypeassert
+	if info.Size() != 0 || stat.Blocks*statBlockSize < 1<<20 {
+		t.Errorf("allocated file has %d bytes in %d blocks; expected 0 bytes in at least 1 MiB of blocks", info.Size(), stat.Blocks)
+	}
+}
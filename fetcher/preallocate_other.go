@@ -0,0 +1,42 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+
+package fetcher
+
+import "os"
+
+// allocate does nothing without fallocate: the space could not be reserved,
+// and a full disk only shows during the download, while extending the file
+// would keep apt, which tells how far along a download is by the size of its
+// file, from showing any progress.
+func allocate(*os.File, int64) error {
+	return nil
+}
+
+// availableBytes does not know the available space without statfs.
+func availableBytes(string) (uint64, bool) {
+	return 0, false
+}
+
+// filesystemID does not tell filesystems apart without stat.
+func filesystemID(string) (uint64, bool) {
+	return 0, false
+}
+
+// allocatedBytes does not know the allocated space without stat.
+func allocatedBytes(string) int64 {
+	return 0
+}
@@ -0,0 +1,83 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestCreateSizedFile(t *testing.T) {
+	specs := map[string]struct {
+		disable      bool
+		size         int64
+		expectedSize int64
+	}{
+		// The space is reserved, but the file grows as it is written.
+		"preallocated": {false, 1 << 20, 0},
+		"disabled":     {true, 1 << 20, 0},
+		"unknown size": {false, -1, 0},
+		"empty object": {false, 0, 0},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "hello.deb")
+			f := New(Config{Region: "us-east-1", DisablePreallocate: spec.disable})
+			file, err := f.createSizedFile(filename, spec.size)
+			if err != nil {
+				t.Fatalf("createSizedFile() returned unexpected error: %v", err)
+			}
+			file.Close()
+			info, err := os.Stat(filename)
+			if err != nil {
+				t.Fatalf("failed to stat created file: %v", err)
+			}
+			if info.Size() != spec.expectedSize {
+				t.Errorf("created file has %d bytes; expected %d", info.Size(), spec.expectedSize)
+			}
+		})
+	}
+}
+
+func TestPreallocationError(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "hello.deb")
+	specs := map[string]struct {
+		err          error
+		expectedText string
+	}{
+		"disk full":   {&os.SyscallError{Syscall: "fallocate", Err: syscall.ENOSPC}, "the object needs 100 bytes"},
+		"quota":       {syscall.EDQUOT, "the object needs 100 bytes"},
+		"unsupported": {syscall.EOPNOTSUPP, ""},
+		"success":     {nil, ""},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			err := preallocationError(filename, 100, spec.err)
+			if spec.expectedText == "" {
+				if err != nil {
+					t.Errorf("preallocationError() = %v; expected nil", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrWriteFile) || !strings.Contains(err.Error(), spec.expectedText) {
+				t.Errorf("preallocationError() = %v; expected ErrWriteFile saying %q", err, spec.expectedText)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// A RoleCache keeps the credentials of assumed roles, so that the clients of
+// many fetches share them. The credentials are renewed by assuming the role
+// again once they expire. It is safe for concurrent use.
+type RoleCache struct {
+	mu    sync.Mutex
+	roles map[roleKey]*credentials.Credentials
+}
+
+// A roleKey identifies the assumption of a role: the role, how it is assumed
+// and the credentials it is assumed with.
+type roleKey struct {
+	roleARN, sourceIdentity, stsEndpoint, region     string
+	profile, sharedCredentialsFile, sharedConfigFile string
+	disableIMDS                                      bool
+}
+
+// NewRoleCache returns an empty RoleCache.
+func NewRoleCache() *RoleCache {
+	return &RoleCache{roles: map[roleKey]*credentials.Credentials{}}
+}
+
+// credentials returns the cached credentials of the role of cfg, calling
+// assume for them if there are none yet. A nil RoleCache caches nothing.
+func (cache *RoleCache) credentials(cfg ClientConfig, assume func() *credentials.Credentials) *credentials.Credentials {
+	if cache == nil {
+		return assume()
+	}
+	key := roleKey{
+		roleARN:               cfg.RoleARN,
+		sourceIdentity:        cfg.RoleSourceIdentity,
+		stsEndpoint:           cfg.STSEndpoint,
+		region:                cfg.Region,
+		profile:               cfg.Profile,
+		sharedCredentialsFile: cfg.SharedCredentialsFile,
+		sharedConfigFile:      cfg.SharedConfigFile,
+		disableIMDS:           cfg.DisableIMDS,
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	creds, ok := cache.roles[key]
+	if !ok {
+		creds = assume()
+		cache.roles[key] = creds
+	}
+	return creds
+}
+
+// RefreshExpiring assumes again the cached roles whose credentials expire
+// before the given time, as told by the clock of the service that issued
+// them, so that the first fetch after a pause need not wait for that. It
+// returns how many were refreshed and the errors of those that could not be,
+// which the next fetch that needs them tries again. A nil RoleCache refreshes
+// nothing.
+func (cache *RoleCache) RefreshExpiring(before time.Time) (int, error) {
+	if cache == nil {
+		return 0, nil
+	}
+	// The roles are assumed without holding the lock, which fetches starting
+	// meanwhile need.
+	cache.mu.Lock()
+	cached := slices.Collect(maps.Values(cache.roles))
+	cache.mu.Unlock()
+	refreshed, errs := 0, []error{}
+	for _, creds := range cached {
+		expires, err := creds.ExpiresAt()
+		if err != nil || expires.IsZero() || !expires.Before(before) {
+			continue
+		}
+		creds.Expire()
+		if _, err := creds.Get(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		refreshed++
+	}
+	return refreshed, errors.Join(errs...)
+}
@@ -0,0 +1,60 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// s3GlobalRegion is the region requests to the global S3 endpoints,
+// s3.amazonaws.com and s3-external-1.amazonaws.com, are signed for.
+const s3GlobalRegion = "us-east-1"
+
+// s3AWSHostname matches the DNS names of the S3 endpoints of AWS, optionally
+// preceded by a bucket, capturing the bucket, the endpoint's host name and its
+// region. Regional endpoints are named s3.<region> or, in older regions,
+// s3-<region>, optionally with fips and dualstack variants; the global
+// endpoints name no region.
+//
+//nolint:gochecknoglobals
+var s3AWSHostname = regexp.MustCompile(`^(?:([a-z0-9][a-z0-9.-]*)\.)?` +
+	`((?:s3(?:-fips)?(?:\.dualstack)?(?:[.-]([a-z]{2}(?:-[a-z]+)+-[0-9]+))?|s3-external-1)\.amazonaws\.com(?:\.cn)?)$`)
+
+// s3HostLocation splits a URI whose host is the DNS name of an S3 endpoint of
+// AWS into bucket and key, and points the Location at the endpoint and the
+// region it names, whatever the configured region. The bucket is the first
+// label of the host, if the URI is virtual-hosted-style, or the first segment
+// of the path. The second result is false if the host is not such a name.
+func s3HostLocation(uri *url.URL) (Location, bool) {
+	match := s3AWSHostname.FindStringSubmatch(uri.Hostname())
+	if match == nil {
+		return Location{}, false
+	}
+	bucket, host, region := match[1], match[2], match[3]
+	if region == "" {
+		region = s3GlobalRegion
+	}
+	loc := Location{URI: uri, Region: region}
+	if bucket == "" {
+		loc.Endpoint = "https://" + host + "/" + bucketPlaceholder
+		loc.Bucket, loc.Key, _ = strings.Cut(strings.TrimPrefix(uri.Path, "/"), "/")
+	} else {
+		loc.Endpoint = "https://" + bucketPlaceholder + "." + host
+		loc.Bucket, loc.Key = bucket, strings.TrimPrefix(uri.Path, "/")
+	}
+	return loc, true
+}
@@ -0,0 +1,117 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLocateS3Hostname(t *testing.T) {
+	type expectation struct {
+		Bucket, Key string
+		Region      string
+		Endpoint    string
+	}
+	specs := map[string]expectation{
+		"s3://s3.eu-west-1.amazonaws.com/apt-repo-bucket/pool/hello.deb": {
+			"apt-repo-bucket", "pool/hello.deb", "eu-west-1", "https://s3.eu-west-1.amazonaws.com",
+		},
+		"s3://apt-repo-bucket.s3.eu-west-1.amazonaws.com/pool/hello.deb": {
+			"apt-repo-bucket", "pool/hello.deb", "eu-west-1", "https://s3.eu-west-1.amazonaws.com",
+		},
+		"s3://apt.repo.bucket.s3.eu-west-1.amazonaws.com/pool/hello.deb": {
+			"apt.repo.bucket", "pool/hello.deb", "eu-west-1", "https://s3.eu-west-1.amazonaws.com",
+		},
+		"s3://s3-eu-west-1.amazonaws.com/apt-repo-bucket/pool/hello.deb": {
+			"apt-repo-bucket", "pool/hello.deb", "eu-west-1", "https://s3-eu-west-1.amazonaws.com",
+		},
+		"s3://apt-repo-bucket.s3-ap-southeast-2.amazonaws.com/pool/hello.deb": {
+			"apt-repo-bucket", "pool/hello.deb", "ap-southeast-2", "https://s3-ap-southeast-2.amazonaws.com",
+		},
+		"s3://s3.amazonaws.com/apt-repo-bucket/pool/hello.deb": {
+			"apt-repo-bucket", "pool/hello.deb", "us-east-1", "https://s3.amazonaws.com",
+		},
+		"s3://apt-repo-bucket.s3.amazonaws.com/pool/hello.deb": {
+			"apt-repo-bucket", "pool/hello.deb", "us-east-1", "https://s3.amazonaws.com",
+		},
+		"s3://s3-external-1.amazonaws.com/apt-repo-bucket/pool/hello.deb": {
+			"apt-repo-bucket", "pool/hello.deb", "us-east-1", "https://s3-external-1.amazonaws.com",
+		},
+		"s3://s3.dualstack.us-west-2.amazonaws.com/apt-repo-bucket/pool/hello.deb": {
+			"apt-repo-bucket", "pool/hello.deb", "us-west-2", "https://s3.dualstack.us-west-2.amazonaws.com",
+		},
+		"s3://apt-repo-bucket.s3.dualstack.us-west-2.amazonaws.com/pool/hello.deb": {
+			"apt-repo-bucket", "pool/hello.deb", "us-west-2", "https://s3.dualstack.us-west-2.amazonaws.com",
+		},
+		"s3://s3-fips.us-gov-west-1.amazonaws.com/apt-repo-bucket/pool/hello.deb": {
+			"apt-repo-bucket", "pool/hello.deb", "us-gov-west-1", "https://s3-fips.us-gov-west-1.amazonaws.com",
+		},
+		"s3://apt-repo-bucket.s3-fips.dualstack.us-east-2.amazonaws.com/pool/hello.deb": {
+			"apt-repo-bucket", "pool/hello.deb", "us-east-2", "https://s3-fips.dualstack.us-east-2.amazonaws.com",
+		},
+		"s3://apt-repo-bucket.s3.cn-north-1.amazonaws.com.cn/pool/hello.deb": {
+			"apt-repo-bucket", "pool/hello.deb", "cn-north-1", "https://s3.cn-north-1.amazonaws.com.cn",
+		},
+		"s3://AKIDEXAMPLE:se/cret@s3.eu-central-1.amazonaws.com/apt-repo-bucket/pool/hello.deb": {
+			"apt-repo-bucket", "pool/hello.deb", "eu-central-1", "https://s3.eu-central-1.amazonaws.com",
+		},
+	}
+	for _, region := range []string{"us-east-1", "eu-west-1", "ap-south-1"} {
+		f := New(Config{Region: region})
+		for uri, expected := range specs {
+			t.Run(region+"/"+uri, func(t *testing.T) {
+				objLoc, err := f.Locate(uri)
+				if err != nil {
+					t.Fatalf("Locate(%s) returned unexpected error: %v", uri, err)
+				}
+				// URIs naming the endpoint of the configured region are
+				// fetched from it as if they named none.
+				cfg := f.ClientConfig(objLoc)
+				endpoint := cfg.Endpoint
+				if endpoint == "" {
+					s3URL, err := s3EndpointURL(cfg.Region)
+					if err != nil {
+						t.Fatal(err)
+					}
+					endpoint = s3URL.String()
+				}
+				actual := expectation{objLoc.Bucket, objLoc.Key, cfg.Region, endpoint}
+				if diff := cmp.Diff(expected, actual); diff != "" {
+					t.Errorf("Locate(%s) mismatch (-want +got):\n%s", uri, diff)
+				}
+			})
+		}
+	}
+}
+
+func TestLocateNotS3Hostname(t *testing.T) {
+	for _, uri := range []string{
+		"s3://apt-repo-bucket/pool/hello.deb",
+		"s3://apt-repo-bucket.s3.example.com/pool/hello.deb",
+		"s3://apt-repo-bucket.s3-website-us-east-1.amazonaws.com/pool/hello.deb",
+		"s3://apt-repo-bucket.s3.eu-west-1.amazonaws.com.example.com/pool/hello.deb",
+		"s3://apt-repo-bucket.ec2.eu-west-1.amazonaws.com/pool/hello.deb",
+	} {
+		objLoc, err := New(Config{Region: "eu-west-1"}).Locate(uri)
+		if err != nil {
+			continue
+		}
+		if objLoc.Endpoint != "" || objLoc.Region != "" {
+			t.Errorf("Locate(%s) = endpoint %q, region %q; expected neither", uri, objLoc.Endpoint, objLoc.Region)
+		}
+	}
+}
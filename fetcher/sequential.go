@@ -0,0 +1,188 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// DefaultResumeAttempts is how often a download in a single request that the
+// connection broke off is resumed before it fails, unless configured
+// otherwise.
+const DefaultResumeAttempts = 3
+
+// ErrResumeFailed is returned by Fetch when the connection broke off a
+// download in a single request that could not be resumed, as the Config's
+// ResumeAttempts were used up, the object has no ETag to resume it by, or the
+// service answered the request for the rest of it with the whole object.
+var ErrResumeFailed = errors.New("the broken off download could not be resumed")
+
+// downloadSequential writes the object at loc to the file of req from a single
+// GetObject, streamed to the file in order rather than in ranged requests,
+// and records the Digests of what it wrote in result as it goes. The size and
+// modification time of an object HeadObject did not report are taken from
+// the headers of the GetObject, and OnStart is only called with them then.
+// If the connection breaks off during the download, it is resumed with a
+// GetObject of the rest of the object, conditional on its ETag, as often as
+// the Config's ResumeAttempts allows, keeping what was written and hashed so
+// far. Otherwise it behaves like download.
+func (f *Fetcher) downloadSequential(
+	ctx context.Context, client s3iface.S3API, loc Location, req FetchRequest, result *FetchResult,
+) error {
+	start := f.clock.Now()
+	output, err := getFrom(ctx, client, loc, result.ETag, 0)
+	if err != nil {
+		return err
+	}
+	defer func() { output.Body.Close() }()
+	if result.Size < 0 && output.ContentLength != nil {
+		result.Size = *output.ContentLength
+		if req.MaxSize > 0 && result.Size > req.MaxSize {
+			return fmt.Errorf("%w: %d bytes, limit %d", ErrTooLarge, result.Size, req.MaxSize)
+		}
+	}
+	if result.LastModified.IsZero() {
+		result.LastModified = aws.TimeValue(output.LastModified)
+	}
+	req.OnStart(result.Object)
+	// Resumed downloads must get the rest of the very object they started
+	// with, which an object HeadObject reported no ETag for is identified by
+	// that of the GetObject.
+	etag := result.ETag
+	if etag == "" {
+		etag = aws.StringValue(output.ETag)
+	}
+
+	file, err := f.createSizedFile(req.Filename, result.Size)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	result.Timings.PartSize, result.Timings.Concurrency = 0, 1
+	writer := &firstByteWriterAt{WriterAt: file, now: f.clock.Now, onProgress: req.OnProgress}
+	digester := newDigester(result.Size)
+	defer digester.Close()
+	var written int64
+	for {
+		numBytes, err := copyBuffered(io.MultiWriter(io.NewOffsetWriter(writer, written), digester), output.Body)
+		written += numBytes
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// A connection that broke off after the last byte lost nothing.
+		if err == nil || written == result.Size && isConnectionBroken(err) {
+			break
+		}
+		if diskErr := diskError(err); errors.Is(diskErr, ErrWriteFile) {
+			return diskErr
+		}
+		if !isConnectionBroken(err) {
+			return requestError("GetObject", loc, err)
+		}
+		if etag == "" || result.Resumes >= f.cfg.ResumeAttempts {
+			return fmt.Errorf("%w: broken off at byte %d after %d resumes: %w", ErrResumeFailed, written, result.Resumes, err)
+		}
+		if req.OnResume != nil {
+			req.OnResume(written, err)
+		}
+		rest, err := f.resumeFrom(ctx, client, loc, etag, written)
+		if err != nil {
+			return err
+		}
+		output.Body.Close()
+		output = rest
+		result.Resumes++
+	}
+	result.Timings.Transfer = f.since(start)
+	result.Timings.FirstByte = writer.sinceStart(start)
+	switch {
+	case result.Size < 0:
+		result.Size = written
+	case written != result.Size:
+		return fmt.Errorf("%w: got %d bytes, expected %d", ErrSizeMismatch, written, result.Size)
+	}
+	result.Digests = digester.digests()
+	return f.closeFile(file)
+}
+
+// getFrom returns the GetObject of the object at loc from the given offset
+// on, conditional on the given ETag as getObjectInput describes. The object is
+// written as stored, so Go's HTTP transport must not decode it, as it would
+// if it asked for gzip itself.
+func getFrom(ctx context.Context, client s3iface.S3API, loc Location, etag string, offset int64) (*s3.GetObjectOutput, error) {
+	input := getObjectInput(loc, etag)
+	if offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+	}
+	output, err := client.GetObjectWithContext(ctx, input,
+		request.WithSetRequestHeaders(map[string]string{"Accept-Encoding": "identity"}))
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, requestError("GetObject", loc, err)
+	}
+	return output, nil
+}
+
+// resumeFrom returns the GetObject of the rest of the object at loc from the
+// given offset on, provided the object still has the given ETag, which fails
+// with a 412 otherwise, and the response starts at the offset rather than
+// serving the whole object, as services that ignore the Range header do.
+func (f *Fetcher) resumeFrom(
+	ctx context.Context, client s3iface.S3API, loc Location, etag string, offset int64,
+) (*s3.GetObjectOutput, error) {
+	if err := f.throttle(ctx); err != nil {
+		return nil, err
+	}
+	output, err := getFrom(ctx, client, loc, etag, offset)
+	if err != nil {
+		return nil, err
+	}
+	if expected := fmt.Sprintf("bytes %d-", offset); offset > 0 && !strings.HasPrefix(aws.StringValue(output.ContentRange), expected) {
+		output.Body.Close()
+		return nil, fmt.Errorf("%w: resuming at byte %d, got range %q", ErrResumeFailed, offset, aws.StringValue(output.ContentRange))
+	}
+	return output, nil
+}
+
+// isConnectionBroken tells whether err, returned while reading the body of a
+// GetObject, means that the connection broke off, or the body ended early,
+// rather than that the request was refused, so that the rest of the object
+// can still be requested.
+func isConnectionBroken(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.As(err, &netErr)
+}
+
+// isRangedMismatch tells whether err says that an object downloaded in ranged
+// requests did not match its size or expected digests, which a download in a
+// single request may not suffer from. Parts that do not match their checksums
+// are not, as failing on them is what the Config's VerifyParts asks for.
+func isRangedMismatch(err error) bool {
+	return errors.Is(err, ErrSizeMismatch) || errors.Is(err, ErrHashMismatch)
+}
@@ -0,0 +1,212 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+)
+
+func TestFetchSequential(t *testing.T) {
+	const content = "hello, sequential world"
+	digester := newSequentialDigester()
+	digester.Write([]byte(content)) //nolint:errcheck
+	expected := digester.digests()
+	specs := map[string]struct {
+		disableMultipart bool
+		corruptRanges    bool
+		expectedHashes   Digests
+		expectedErr      error
+		expectedRetries  int
+		expectedGets     int
+		sequential       bool
+	}{
+		"ranged":                 {false, false, expected, nil, 0, 1, false},
+		"multipart disabled":     {true, true, expected, nil, 0, 1, true},
+		"retry after mismatch":   {false, true, expected, nil, 1, 2, true},
+		"unexpected hash":        {false, false, Digests{SHA256: strings.Repeat("0", 64)}, ErrHashMismatch, 1, 2, false},
+		"corruption not checked": {false, true, Digests{}, nil, 0, 1, false},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			fake := testutil.NewFakeS3()
+			fake.CorruptRanges = spec.corruptRanges
+			fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte(content)})
+			filename := filepath.Join(t.TempDir(), "hello.deb")
+			f := New(Config{Region: "us-east-1", DisableMultipart: spec.disableMultipart},
+				WithS3ClientFactory(func(ClientConfig) (s3iface.S3API, error) { return fake, nil }))
+
+			var retries []error
+			result, err := f.Fetch(context.Background(), FetchRequest{
+				URI:               testURI,
+				Filename:          filename,
+				ExpectedHashes:    spec.expectedHashes,
+				OnSequentialRetry: func(err error) { retries = append(retries, err) },
+			})
+			if !errors.Is(err, spec.expectedErr) {
+				t.Fatalf("Fetch() = %v; expected %v", err, spec.expectedErr)
+			}
+			if len(retries) != spec.expectedRetries {
+				t.Errorf("OnSequentialRetry called with %v; expected %d calls", retries, spec.expectedRetries)
+			}
+			for _, retryErr := range retries {
+				if !errors.Is(retryErr, ErrHashMismatch) {
+					t.Errorf("OnSequentialRetry called with %v; expected %v", retryErr, ErrHashMismatch)
+				}
+			}
+			if gets := fake.Gets(); gets != spec.expectedGets {
+				t.Errorf("GetObject called %d times; expected %d", gets, spec.expectedGets)
+			}
+			if err != nil {
+				return
+			}
+			contents, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatalf("failed to read fetched file: %v", err)
+			}
+			if spec.corruptRanges && !spec.sequential {
+				// The corruption goes unnoticed without digests to check.
+				return
+			}
+			if string(contents) != content {
+				t.Errorf("fetched %q; expected %q", contents, content)
+			}
+			if result.Sequential != spec.sequential {
+				t.Errorf("Sequential = %t; expected %t", result.Sequential, spec.sequential)
+			}
+			if diff := cmp.Diff(expected, result.Digests); diff != "" {
+				t.Errorf("unexpected digests (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFetchSequentialResume(t *testing.T) {
+	const content = "a package whose download the connection breaks off"
+	const changed = "the package that replaced it during the download"
+	specs := map[string]struct {
+		resetAt        []int64
+		ignoreRanges   bool
+		resumeAttempts int
+		etag           string
+		change         bool
+		expected       string
+		expectedErr    error
+		expectedRanges []string
+		expectedResume []int64
+	}{
+		"resumed": {
+			[]int64{10}, false, 3, "etag-1", false, content, nil, []string{"", "bytes=10-"}, []int64{10},
+		},
+		"resumed twice": {
+			[]int64{5, 30}, false, 3, "etag-1", false, content, nil, []string{"", "bytes=5-", "bytes=30-"}, []int64{5, 30},
+		},
+		"reset before the first byte": {
+			[]int64{0}, false, 3, "etag-1", false, content, nil, []string{"", ""}, []int64{0},
+		},
+		"attempts exhausted": {
+			[]int64{5, 10, 15}, false, 2, "etag-1", false, "", ErrResumeFailed, []string{"", "bytes=5-", "bytes=10-"}, []int64{5, 10},
+		},
+		"resuming disabled": {
+			[]int64{10}, false, 0, "etag-1", false, "", ErrResumeFailed, []string{""}, nil,
+		},
+		"no ETag": {
+			[]int64{10}, false, 3, "", false, "", ErrResumeFailed, []string{""}, nil,
+		},
+		// The service serves the whole object rather than the rest of it.
+		"range ignored": {
+			[]int64{10}, true, 3, "etag-1", false, "", ErrResumeFailed, []string{"", "bytes=10-"}, []int64{10},
+		},
+		// The resumed GetObject fails its If-Match, so the object is fetched
+		// again from the start.
+		"object changed": {
+			[]int64{10}, false, 3, "etag-1", true, changed, nil, []string{"", "bytes=10-", ""}, []int64{10},
+		},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			fake := testutil.NewFakeS3()
+			fake.ResetAt, fake.IgnoreRanges = spec.resetAt, spec.ignoreRanges
+			fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte(content), ETag: spec.etag})
+			if spec.change {
+				fake.BeforeGet = func(string) {
+					if fake.Gets() == 2 {
+						fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte(changed), ETag: "etag-2"})
+					}
+				}
+			}
+			filename := filepath.Join(t.TempDir(), "hello.deb")
+			f := New(Config{Region: "us-east-1", DisableMultipart: true, ResumeAttempts: spec.resumeAttempts},
+				WithS3ClientFactory(func(ClientConfig) (s3iface.S3API, error) { return fake, nil }))
+
+			var resumed []int64
+			result, err := f.Fetch(context.Background(), FetchRequest{
+				URI:      testURI,
+				Filename: filename,
+				OnResume: func(offset int64, err error) {
+					if !isConnectionBroken(err) {
+						t.Errorf("OnResume called with %v; expected a broken connection", err)
+					}
+					resumed = append(resumed, offset)
+				},
+			})
+			if !errors.Is(err, spec.expectedErr) {
+				t.Fatalf("Fetch() = %v; expected %v", err, spec.expectedErr)
+			}
+			if diff := cmp.Diff(spec.expectedRanges, fake.Ranges()); diff != "" {
+				t.Errorf("GetObject ranges mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(spec.expectedResume, resumed); diff != "" {
+				t.Errorf("OnResume offsets mismatch (-want +got):\n%s", diff)
+			}
+			if err != nil {
+				if _, statErr := os.Stat(filename); !os.IsNotExist(statErr) {
+					t.Errorf("file of the failed fetch was kept: %v", statErr)
+				}
+				return
+			}
+			contents, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatalf("failed to read fetched file: %v", err)
+			}
+			if string(contents) != spec.expected {
+				t.Errorf("fetched %q; expected %q", contents, spec.expected)
+			}
+			digester := newSequentialDigester()
+			digester.Write([]byte(spec.expected)) //nolint:errcheck
+			if diff := cmp.Diff(digester.digests(), result.Digests); diff != "" {
+				t.Errorf("unexpected digests (-want +got):\n%s", diff)
+			}
+			// A changed object is fetched again in full, without resuming.
+			expectedResumes := len(spec.expectedResume)
+			if spec.change {
+				expectedResumes = 0
+			}
+			if result.Resumes != expectedResumes {
+				t.Errorf("Resumes = %d; expected %d", result.Resumes, expectedResumes)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+
+	"github.com/google/apt-golang-s3/clock"
+)
+
+const (
+	// DefaultThrottleAttempts is how often a throttled fetch is attempted
+	// before it fails, unless configured otherwise.
+	DefaultThrottleAttempts = 5
+
+	errCodeSlowDown = "SlowDown"
+)
+
+// ErrThrottled is returned by Fetch when S3 kept throttling the fetch for all
+// of the Throttle's attempts.
+var ErrThrottled = errors.New("throttled by S3")
+
+// throttleBackoff is the schedule of delays before throttled fetches are
+// retried, before jitter is applied.
+//
+//nolint:gochecknoglobals
+var throttleBackoff = Backoff{Base: time.Second, Max: time.Minute}
+
+// A Throttle is shared by all fetches of a process. It paces requests to S3 to
+// a maximum rate, and once S3 asks to slow down, holds back every fetch, not
+// only the throttled one, until the backoff delay passed. It is safe for
+// concurrent use.
+type Throttle struct {
+	clock  clock.Clock
+	jitter func(time.Duration) time.Duration
+
+	mu       sync.Mutex
+	attempts int
+	interval time.Duration
+	// next is the earliest time the next request may be sent.
+	next time.Time
+}
+
+// NewThrottle returns a Throttle that attempts throttled fetches up to
+// attempts times, or DefaultThrottleAttempts times if attempts is not
+// positive, and lets at most rate requests per second through, or any number
+// if rate is not positive. Time is told by clk.
+func NewThrottle(attempts int, rate float64, clk clock.Clock) *Throttle {
+	throttle := &Throttle{clock: clk, jitter: halfJitter}
+	throttle.Configure(attempts, rate)
+	return throttle
+}
+
+// Configure changes the attempts and rate of the Throttle as NewThrottle
+// describes them, keeping the fetches it holds back held back.
+func (t *Throttle) Configure(attempts int, rate float64) {
+	if attempts <= 0 {
+		attempts = DefaultThrottleAttempts
+	}
+	var interval time.Duration
+	if rate > 0 {
+		interval = time.Duration(float64(time.Second) / rate)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.attempts, t.interval = attempts, interval
+}
+
+// String describes the Throttle for debug output.
+func (t *Throttle) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.interval == 0 {
+		return fmt.Sprintf("up to %d attempts when throttled", t.attempts)
+	}
+	return fmt.Sprintf("up to %d attempts when throttled, %.0f requests per second", t.attempts, float64(time.Second)/float64(t.interval))
+}
+
+// wait blocks until the next request may be sent, reserving its slot. It
+// returns ctx.Err() if ctx is done first.
+func (t *Throttle) wait(ctx context.Context) error {
+	t.mu.Lock()
+	now := t.clock.Now()
+	start := now
+	if t.next.After(now) {
+		start = t.next
+	}
+	t.next = start.Add(t.interval)
+	t.mu.Unlock()
+
+	if start.Equal(now) {
+		return nil
+	}
+	select {
+	case <-t.clock.After(start.Sub(now)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// exhausted tells whether the given attempt, counting from zero, was the
+// last one.
+func (t *Throttle) exhausted(attempt int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return attempt+1 >= t.attempts
+}
+
+// slowDown records that S3 throttled the given attempt, counting from zero,
+// and returns the delay before it is retried. No request of any fetch is sent
+// before the delay passed.
+func (t *Throttle) slowDown(attempt int) time.Duration {
+	delay := t.jitter(throttleBackoff.Delay(attempt))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if until := t.clock.Now().Add(delay); until.After(t.next) {
+		t.next = until
+	}
+	return delay
+}
+
+// halfJitter returns a random duration between half of delay and delay, so
+// that fetches throttled at the same time do not retry in lockstep.
+func halfJitter(delay time.Duration) time.Duration {
+	if delay <= 1 {
+		return delay
+	}
+	return delay/2 + rand.N(delay/2) //nolint:gosec
+}
+
+// isSlowDown tells whether err means that S3 asked to reduce the request
+// rate.
+func isSlowDown(err error) bool {
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == errCodeSlowDown {
+		return true
+	}
+	var reqErr awserr.RequestFailure
+	return errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusServiceUnavailable
+}
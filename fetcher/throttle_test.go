@@ -0,0 +1,175 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+)
+
+func errSlowDown() error {
+	return awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate.", nil),
+		http.StatusServiceUnavailable, "id")
+}
+
+func TestThrottleRate(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC))
+	throttle := NewThrottle(1, 2, clock)
+
+	if err := throttle.wait(context.Background()); err != nil {
+		t.Fatalf("wait() = %v; expected the first request to pass at once", err)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- throttle.wait(context.Background()) }()
+	clock.BlockUntil(1)
+	select {
+	case <-errc:
+		t.Fatal("wait() returned before the 500ms interval elapsed")
+	default:
+	}
+	clock.Advance(500 * time.Millisecond)
+	if err := <-errc; err != nil {
+		t.Errorf("wait() = %v; expected nil", err)
+	}
+}
+
+func TestThrottleSlowDownHoldsBackAllFetches(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC))
+	throttle := NewThrottle(5, 0, clock)
+	throttle.jitter = func(delay time.Duration) time.Duration { return delay }
+
+	delays := []time.Duration{throttle.slowDown(0), throttle.slowDown(3)}
+	if diff := cmp.Diff([]time.Duration{time.Second, 8 * time.Second}, delays); diff != "" {
+		t.Errorf("slowDown() delays mismatch (-want +got):\n%s", diff)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- throttle.wait(ctx) }()
+	clock.BlockUntil(1)
+	clock.Advance(7 * time.Second)
+	select {
+	case <-errc:
+		t.Fatal("wait() returned before the 8s backoff elapsed")
+	default:
+	}
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Errorf("wait() = %v; expected %v", err, context.Canceled)
+	}
+}
+
+func TestThrottleConfigure(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC))
+	throttle := NewThrottle(5, 0, clock)
+	throttle.jitter = func(delay time.Duration) time.Duration { return delay }
+	throttle.slowDown(3)
+
+	throttle.Configure(2, 4)
+	if expected := "up to 2 attempts when throttled, 4 requests per second"; throttle.String() != expected {
+		t.Errorf("String() = %q; expected %q", throttle, expected)
+	}
+	if throttle.exhausted(0) || !throttle.exhausted(1) {
+		t.Errorf("exhausted() = %t, %t for the first two attempts; expected false, true", throttle.exhausted(0), throttle.exhausted(1))
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- throttle.wait(context.Background()) }()
+	clock.BlockUntil(1)
+	clock.Advance(7 * time.Second)
+	select {
+	case <-errc:
+		t.Fatal("wait() returned before the 8s backoff from before Configure() elapsed")
+	default:
+	}
+	clock.Advance(time.Second)
+	if err := <-errc; err != nil {
+		t.Errorf("wait() = %v; expected nil", err)
+	}
+}
+
+func TestHalfJitter(t *testing.T) {
+	for range 100 {
+		if delay := halfJitter(8 * time.Second); delay < 4*time.Second || delay > 8*time.Second {
+			t.Fatalf("halfJitter(8s) = %s; expected between 4s and 8s", delay)
+		}
+	}
+}
+
+func TestFetchThrottled(t *testing.T) {
+	specs := map[string]struct {
+		setup          func(fake *testutil.FakeS3)
+		expectedErr    error
+		succeeds       bool
+		expectedDelays int
+	}{
+		"recovers": {
+			func(fake *testutil.FakeS3) { fake.GetErrOnce = errSlowDown() },
+			nil,
+			true,
+			1,
+		},
+		"gives up": {
+			func(fake *testutil.FakeS3) { fake.HeadErr = errSlowDown() },
+			ErrThrottled,
+			false,
+			2,
+		},
+		"other error": {
+			func(fake *testutil.FakeS3) {
+				fake.HeadErr = awserr.NewRequestFailure(awserr.New("Forbidden", "Forbidden", nil), http.StatusForbidden, "id")
+			},
+			nil,
+			false,
+			0,
+		},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			fake := testutil.NewFakeS3()
+			fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+			spec.setup(fake)
+			throttle := NewThrottle(3, 0, testutil.NewFakeClock(time.Time{}))
+			throttle.jitter = func(time.Duration) time.Duration { return 0 }
+			f := New(Config{Region: "us-east-1", Throttle: throttle}, WithS3ClientFactory(func(ClientConfig) (s3iface.S3API, error) {
+				return fake, nil
+			}))
+
+			delays := 0
+			_, err := f.Fetch(context.Background(), FetchRequest{
+				URI: testURI, Filename: filepath.Join(t.TempDir(), "hello.deb"),
+				OnThrottle: func(time.Duration) { delays++ },
+			})
+			if spec.expectedErr != nil && !errors.Is(err, spec.expectedErr) {
+				t.Errorf("Fetch() = %v; expected %v", err, spec.expectedErr)
+			}
+			if (err == nil) != spec.succeeds {
+				t.Errorf("Fetch() = %v; expected success to be %t", err, spec.succeeds)
+			}
+			if delays != spec.expectedDelays {
+				t.Errorf("OnThrottle called %d times; expected %d", delays, spec.expectedDelays)
+			}
+		})
+	}
+}
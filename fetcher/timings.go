@@ -0,0 +1,72 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Timings records how long each phase of a single fetch took.
+type Timings struct {
+	Credentials time.Duration
+	HeadObject  time.Duration
+	FirstByte   time.Duration
+	Transfer    time.Duration
+	Hashing     time.Duration
+	PartSize    int64
+	Concurrency int
+}
+
+// String formats the timings for a debug log.
+func (t Timings) String() string {
+	return fmt.Sprintf("credentials=%s head=%s first-byte=%s transfer=%s hashing=%s part-size=%d concurrency=%d",
+		t.Credentials, t.HeadObject, t.FirstByte, t.Transfer, t.Hashing, t.PartSize, t.Concurrency)
+}
+
+// A firstByteWriterAt wraps an io.WriterAt and records when the first byte was
+// written to it, which is the closest the s3manager.Downloader lets us get to
+// the time-to-first-byte of a download. The time is taken from now. The
+// number of bytes written so far is passed to onProgress, if set, after each
+// write.
+type firstByteWriterAt struct {
+	io.WriterAt
+	now        func() time.Time
+	once       sync.Once
+	first      time.Time
+	onProgress func(written int64)
+	written    atomic.Int64
+}
+
+func (w *firstByteWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	w.once.Do(func() { w.first = w.now() })
+	n, err := w.WriterAt.WriteAt(p, off)
+	if w.onProgress != nil && n > 0 {
+		w.onProgress(w.written.Add(int64(n)))
+	}
+	return n, err
+}
+
+// sinceStart returns the time between start and the first write, or zero if
+// nothing was written.
+func (w *firstByteWriterAt) sinceStart(start time.Time) time.Duration {
+	if w.first.IsZero() {
+		return 0
+	}
+	return w.first.Sub(start)
+}
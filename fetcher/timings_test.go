@@ -0,0 +1,54 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+)
+
+func TestFirstByteWriterAt(t *testing.T) {
+	buf := &writerAtBuffer{}
+	start := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	clock := testutil.NewFakeClock(start)
+	writer := &firstByteWriterAt{WriterAt: buf, now: clock.Now}
+	if actual := writer.sinceStart(start); actual != 0 {
+		t.Errorf("sinceStart() before any write = %s; expected 0", actual)
+	}
+
+	clock.Advance(250 * time.Millisecond)
+	if _, err := writer.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatalf("WriteAt() returned unexpected error: %v", err)
+	}
+	clock.Advance(time.Second)
+	if _, err := writer.WriteAt([]byte(" world"), 5); err != nil {
+		t.Fatalf("WriteAt() returned unexpected error: %v", err)
+	}
+	if actual, expected := writer.sinceStart(start), 250*time.Millisecond; actual != expected {
+		t.Errorf("sinceStart() after two writes = %s; expected %s", actual, expected)
+	}
+}
+
+// A writerAtBuffer is an in-memory io.WriterAt.
+type writerAtBuffer struct {
+	bytes.Buffer
+}
+
+func (buf *writerAtBuffer) WriteAt(p []byte, _ int64) (int, error) {
+	return buf.Write(p)
+}
@@ -0,0 +1,175 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// DefaultTLSMinVersion is the oldest TLS version negotiated with S3 unless
+// the ClientConfig allows an older one.
+const DefaultTLSMinVersion = tls.VersionTLS12
+
+// ErrInvalidTLSVersion is returned by ParseTLSVersion for anything but the
+// TLS versions 1.0 to 1.3.
+var ErrInvalidTLSVersion = errors.New("invalid TLS version")
+
+// tlsVersions are the TLS versions by the names ParseTLSVersion accepts.
+//
+//nolint:gochecknoglobals
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// restrictedCipherSuites are the only cipher suites offered below TLS 1.3
+// when the ClientConfig restricts them: those with forward secrecy and
+// authenticated encryption. The suites of TLS 1.3 all qualify and cannot be
+// configured.
+//
+//nolint:gochecknoglobals
+var restrictedCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// unsupportedVersion matches the error crypto/tls fails the handshake with
+// when the server selects a version below the client's minimum, capturing
+// the version in hexadecimal.
+var unsupportedVersion = regexp.MustCompile(`server selected unsupported protocol version ([0-9a-f]+)`) //nolint:gochecknoglobals
+
+// versionAlert is the error crypto/tls fails the handshake with when the
+// server, rather than selecting an older version, refuses all the versions
+// the client offered.
+const versionAlert = "remote error: tls: protocol version not supported"
+
+// tlsProbeTimeout bounds the handshake that finds out which version a server
+// refusing the client's versions speaks.
+const tlsProbeTimeout = 5 * time.Second
+
+// ParseTLSVersion returns the TLS version of the given name, such as 1.2.
+func ParseTLSVersion(name string) (uint16, error) {
+	version, ok := tlsVersions[name]
+	if !ok {
+		return 0, fmt.Errorf("%w %q: expected 1.0, 1.1, 1.2 or 1.3", ErrInvalidTLSVersion, name)
+	}
+	return version, nil
+}
+
+// A TLSVersionError is returned by Fetch when the handshake with S3 failed
+// because the server only speaks TLS versions older than the ClientConfig's
+// TLSMinVersion.
+type TLSVersionError struct {
+	Err awserr.Error
+	// Negotiated is the version the server selected, or zero if it is
+	// unknown, and Required the oldest one the client accepts.
+	Negotiated, Required uint16
+}
+
+func (e *TLSVersionError) Error() string {
+	if e.Negotiated == 0 {
+		return fmt.Sprintf("the server negotiates no TLS version as recent as the required %s: %v",
+			tls.VersionName(e.Required), e.Err.OrigErr())
+	}
+	return fmt.Sprintf("the server negotiated %s, older than the required %s: %v",
+		tls.VersionName(e.Negotiated), tls.VersionName(e.Required), e.Err.OrigErr())
+}
+
+func (e *TLSVersionError) Unwrap() error {
+	return e.Err
+}
+
+// tlsConfig returns the TLS configuration of the requests an S3 client built
+// from cfg sends.
+func (cfg ClientConfig) tlsConfig() *tls.Config {
+	config := &tls.Config{MinVersion: cfg.tlsMinVersion()}
+	if cfg.TLSRestrictCiphers {
+		config.CipherSuites = restrictedCipherSuites
+	}
+	return config
+}
+
+func (cfg ClientConfig) tlsMinVersion() uint16 {
+	if cfg.TLSMinVersion == 0 {
+		return DefaultTLSMinVersion
+	}
+	return cfg.TLSMinVersion
+}
+
+// tlsVersionHandler returns a Send handler that turns the failed handshakes
+// of servers older than the minimum version into TLSVersionErrors, which are
+// not worth retrying. Servers that refuse the versions the client offers are
+// asked which version they speak in a handshake of their own.
+func tlsVersionHandler(required uint16) func(r *request.Request) {
+	return func(r *request.Request) {
+		var awsErr awserr.Error
+		if !errors.As(r.Error, &awsErr) || awsErr.Code() != request.ErrCodeRequestError || awsErr.OrigErr() == nil {
+			return
+		}
+		var negotiated uint16
+		if match := unsupportedVersion.FindStringSubmatch(awsErr.OrigErr().Error()); match != nil {
+			version, err := strconv.ParseUint(match[1], 16, 16)
+			if err != nil {
+				return
+			}
+			negotiated = uint16(version)
+		} else if strings.Contains(awsErr.OrigErr().Error(), versionAlert) {
+			negotiated = probeTLSVersion(r.HTTPRequest.URL)
+		} else {
+			return
+		}
+		r.Error = &TLSVersionError{Err: awsErr, Negotiated: negotiated, Required: required}
+		r.Retryable = aws.Bool(false)
+	}
+}
+
+// probeTLSVersion returns the TLS version the server at the given URL
+// negotiates when any version is acceptable, or zero if the handshake fails.
+// The certificate is not verified, as nothing is sent over the connection.
+func probeTLSVersion(target *url.URL) uint16 {
+	port := target.Port()
+	if port == "" {
+		port = "443"
+	}
+	dialer := &net.Dialer{Timeout: tlsProbeTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(target.Hostname(), port), &tls.Config{
+		ServerName:         target.Hostname(),
+		MinVersion:         tls.VersionTLS10,
+		InsecureSkipVerify: true, //nolint:gosec
+	})
+	if err != nil {
+		return 0
+	}
+	defer conn.Close()
+	return conn.ConnectionState().Version
+}
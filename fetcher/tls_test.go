@@ -0,0 +1,155 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	specs := map[string]uint16{"1.0": tls.VersionTLS10, "1.1": tls.VersionTLS11, "1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13}
+	for name, expected := range specs {
+		if actual, err := ParseTLSVersion(name); err != nil || actual != expected {
+			t.Errorf("ParseTLSVersion(%s) = %x, %v; expected %x, nil", name, actual, err, expected)
+		}
+	}
+	for _, name := range []string{"", "1", "1.4", "TLS 1.2", "tls1.2"} {
+		if _, err := ParseTLSVersion(name); !errors.Is(err, ErrInvalidTLSVersion) {
+			t.Errorf("ParseTLSVersion(%q) returned %v; expected ErrInvalidTLSVersion", name, err)
+		}
+	}
+}
+
+// startTLSServer starts an S3 stand-in negotiating TLS as config says, whose
+// certificate is trusted through AWS_CA_BUNDLE.
+func startTLSServer(t *testing.T, config *tls.Config) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Length", "5")
+	}))
+	server.TLS = config
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	trustServer(t, server)
+	return server
+}
+
+// trustServer makes the certificate of server trusted through AWS_CA_BUNDLE.
+func trustServer(t *testing.T, server *httptest.Server) {
+	t.Helper()
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_CA_BUNDLE", bundle)
+}
+
+func headObject(t *testing.T, cfg ClientConfig) error {
+	t.Helper()
+	cfg.Region, cfg.PathStyle = "us-east-1", true
+	cfg.User = url.UserPassword("fake-access-key-id", "fake-secret-access-key")
+	client, err := NewS3Client(cfg)
+	if err != nil {
+		t.Fatalf("NewS3Client() returned unexpected error: %v", err)
+	}
+	_, err = client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String("bucket"), Key: aws.String("key")})
+	return err
+}
+
+func TestS3ClientRefusesOldTLSVersion(t *testing.T) {
+	server := startTLSServer(t, &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS10})
+
+	err := headObject(t, ClientConfig{Endpoint: server.URL})
+	var versionErr *TLSVersionError
+	if !errors.As(err, &versionErr) {
+		t.Fatalf("HeadObject() returned %v; expected a TLSVersionError", err)
+	}
+	if versionErr.Negotiated != tls.VersionTLS10 || versionErr.Required != tls.VersionTLS12 {
+		t.Errorf("TLSVersionError negotiated %x, required %x; expected %x, %x",
+			versionErr.Negotiated, versionErr.Required, tls.VersionTLS10, tls.VersionTLS12)
+	}
+	if expected := "the server negotiated TLS 1.0, older than the required TLS 1.2"; !strings.Contains(err.Error(), expected) {
+		t.Errorf("HeadObject() returned %q; expected it to contain %q", err, expected)
+	}
+	if !isEndpointFailure(err) {
+		t.Errorf("isEndpointFailure(%v) = false; expected true, for fallback endpoints to be tried", err)
+	}
+
+	if err := headObject(t, ClientConfig{Endpoint: server.URL, TLSMinVersion: tls.VersionTLS10}); err != nil {
+		t.Errorf("HeadObject() allowing TLS 1.0 returned %v; expected nil", err)
+	}
+}
+
+func TestS3ClientRestrictsCipherSuites(t *testing.T) {
+	server := startTLSServer(t, &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA, tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA},
+	})
+
+	if err := headObject(t, ClientConfig{Endpoint: server.URL}); err != nil {
+		t.Errorf("HeadObject() returned %v; expected nil", err)
+	}
+	if err := headObject(t, ClientConfig{Endpoint: server.URL, TLSRestrictCiphers: true}); err == nil {
+		t.Errorf("HeadObject() restricting the cipher suites returned nil; expected the handshake to fail")
+	}
+}
+
+func TestS3ClientsShareConnections(t *testing.T) {
+	var connections atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Length", "5")
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	trustServer(t, server)
+
+	transports := NewTransportCache()
+	for range 3 {
+		if err := headObject(t, ClientConfig{Endpoint: server.URL, Transports: transports}); err != nil {
+			t.Fatalf("HeadObject() returned %v; expected nil", err)
+		}
+	}
+	if count := connections.Load(); count != 1 {
+		t.Errorf("clients sharing a TransportCache opened %d connections; expected 1", count)
+	}
+
+	transports.CloseIdle()
+	if err := headObject(t, ClientConfig{Endpoint: server.URL, Transports: transports}); err != nil {
+		t.Fatalf("HeadObject() returned %v; expected nil", err)
+	}
+	if count := connections.Load(); count != 2 {
+		t.Errorf("clients opened %d connections after CloseIdle(); expected 2", count)
+	}
+}
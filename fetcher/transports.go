@@ -0,0 +1,112 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A TransportCache keeps the HTTP clients of S3 clients, so that the clients
+// of many fetches reuse the connections earlier ones opened rather than each
+// open connections of their own. It is safe for concurrent use.
+type TransportCache struct {
+	mu      sync.Mutex
+	clients map[transportKey]*http.Client
+}
+
+// A transportKey identifies the settings of a transport: the TLS it
+// negotiates, the client certificate it presents, if any, and how long it
+// keeps connections open while idle.
+type transportKey struct {
+	tlsMinVersion      uint16
+	tlsRestrictCiphers bool
+	sslCert, sslKey    string
+	idleTimeout        time.Duration
+}
+
+// NewTransportCache returns an empty TransportCache.
+func NewTransportCache() *TransportCache {
+	return &TransportCache{clients: map[transportKey]*http.Client{}}
+}
+
+// client returns the cached HTTP client for the TLS settings and idle timeout
+// of cfg, presenting its client certificate if withCert, creating it if there
+// is none yet. A nil TransportCache caches nothing.
+func (cache *TransportCache) client(cfg ClientConfig, withCert bool) (*http.Client, error) {
+	key := transportKey{
+		tlsMinVersion:      cfg.TLSMinVersion,
+		tlsRestrictCiphers: cfg.TLSRestrictCiphers,
+		idleTimeout:        cfg.IdleTimeout,
+	}
+	if withCert {
+		key.sslCert, key.sslKey = cfg.SSLCert, cfg.SSLKey
+	}
+	if cache == nil {
+		return newHTTPClient(key)
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if client, ok := cache.clients[key]; ok {
+		return client, nil
+	}
+	client, err := newHTTPClient(key)
+	if err != nil {
+		return nil, err
+	}
+	cache.clients[key] = client
+	return client, nil
+}
+
+// newHTTPClient returns an HTTP client with a transport of its own for the
+// settings of key, trusting the CA bundle AWS_CA_BUNDLE names. The bundle is
+// applied here, once for every transport, as the SDK would otherwise apply
+// it to the transport of every session it creates, racing with the requests
+// of the other sessions that share it.
+func newHTTPClient(key transportKey) (*http.Client, error) {
+	tlsConfig := ClientConfig{TLSMinVersion: key.tlsMinVersion, TLSRestrictCiphers: key.tlsRestrictCiphers}.tlsConfig()
+	if key.sslCert != "" {
+		var err error
+		if tlsConfig, err = clientCertTLSConfig(key.sslCert, key.sslKey, tlsConfig); err != nil {
+			return nil, err
+		}
+	}
+	if err := applyCABundle(tlsConfig); err != nil {
+		return nil, err
+	}
+	transport, _ := http.DefaultTransport.(*http.Transport)
+	transport = transport.Clone()
+	transport.TLSClientConfig = tlsConfig
+	if key.idleTimeout > 0 {
+		transport.IdleConnTimeout = key.idleTimeout
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// CloseIdle closes the connections of the cached transports that sat idle
+// since their last request. Connections requests are using are left alone,
+// and requests that start meanwhile open new ones, so closing them does not
+// race with fetches. A nil TransportCache has none to close.
+func (cache *TransportCache) CloseIdle() {
+	if cache == nil {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for _, client := range cache.clients {
+		client.CloseIdleConnections()
+	}
+}
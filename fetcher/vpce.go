@@ -0,0 +1,57 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// vpceGenericLabel is the first label of the host name AWS documents for
+// path-style requests through an S3 interface endpoint, as in
+// bucket.vpce-1a2b3c4d-5e6f.s3.us-east-1.vpce.amazonaws.com/my-bucket/key.
+const vpceGenericLabel = "bucket"
+
+// vpceHostname matches the DNS names of S3 interface endpoints, optionally
+// preceded by a bucket, capturing the bucket, the endpoint-specific host name
+// and its region. The endpoint ID may carry an availability zone suffix.
+//
+//nolint:gochecknoglobals
+var vpceHostname = regexp.MustCompile(
+	`^(?:([a-z0-9][a-z0-9.-]*)\.)?(vpce-[a-z0-9-]+\.s3\.([a-z0-9-]+)\.vpce\.amazonaws\.com(?:\.cn)?)$`)
+
+// vpceLocation splits a URI whose host is the DNS name of an S3 interface
+// endpoint into bucket and key, and points the Location at the endpoint and
+// its region. The bucket is the first label of the host, or the first
+// segment of the path if the host has no such label or the label is the
+// generic "bucket". The second result is false if the host is not an
+// interface endpoint.
+func vpceLocation(uri *url.URL) (Location, bool) {
+	match := vpceHostname.FindStringSubmatch(uri.Hostname())
+	if match == nil {
+		return Location{}, false
+	}
+	bucket, host, region := match[1], match[2], match[3]
+	loc := Location{URI: uri, Region: region}
+	if bucket == "" || bucket == vpceGenericLabel {
+		loc.Endpoint = "https://" + uri.Hostname() + "/" + bucketPlaceholder
+		loc.Bucket, loc.Key, _ = strings.Cut(strings.TrimPrefix(uri.Path, "/"), "/")
+	} else {
+		loc.Endpoint = "https://" + bucketPlaceholder + "." + host
+		loc.Bucket, loc.Key = bucket, strings.TrimPrefix(uri.Path, "/")
+	}
+	return loc, true
+}
@@ -0,0 +1,101 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+)
+
+func TestLocateInterfaceEndpoint(t *testing.T) {
+	specs := map[string]ClientConfig{
+		"s3://apt-repo-bucket.vpce-0abc123-xyz.s3.us-east-1.vpce.amazonaws.com/pool/hello.deb": {
+			Region: "us-east-1", Endpoint: "https://vpce-0abc123-xyz.s3.us-east-1.vpce.amazonaws.com",
+		},
+		"s3://apt.repo.bucket.vpce-1a2b3c4d-5e6f.s3.eu-central-1.vpce.amazonaws.com/pool/hello.deb": {
+			Region: "eu-central-1", Endpoint: "https://vpce-1a2b3c4d-5e6f.s3.eu-central-1.vpce.amazonaws.com",
+		},
+		"s3://bucket.vpce-1a2b3c4d-5e6f.s3.us-west-2.vpce.amazonaws.com/apt-repo-bucket/pool/hello.deb": {
+			Region: "us-west-2", Endpoint: "https://bucket.vpce-1a2b3c4d-5e6f.s3.us-west-2.vpce.amazonaws.com", PathStyle: true,
+		},
+		"s3://vpce-1a2b3c4d-5e6f-us-east-1a.s3.us-east-1.vpce.amazonaws.com/apt-repo-bucket/pool/hello.deb": {
+			Region: "us-east-1", Endpoint: "https://vpce-1a2b3c4d-5e6f-us-east-1a.s3.us-east-1.vpce.amazonaws.com", PathStyle: true,
+		},
+		"s3://apt-repo-bucket.vpce-0abc123-xyz.s3.cn-north-1.vpce.amazonaws.com.cn/pool/hello.deb": {
+			Region: "cn-north-1", Endpoint: "https://vpce-0abc123-xyz.s3.cn-north-1.vpce.amazonaws.com.cn",
+		},
+	}
+	f := New(Config{Region: "ap-south-1", Endpoint: "https://gateway.internal", FallbackEndpoints: []string{"https://replica.internal"}})
+	for uri, expected := range specs {
+		objLoc, err := f.Locate(uri)
+		if err != nil {
+			t.Fatalf("Locate(%s) returned unexpected error: %v", uri, err)
+		}
+		if objLoc.Bucket != "apt-repo-bucket" && objLoc.Bucket != "apt.repo.bucket" || objLoc.Key != "pool/hello.deb" {
+			t.Errorf("Locate(%s) = bucket %q, key %q; expected the bucket and pool/hello.deb", uri, objLoc.Bucket, objLoc.Key)
+		}
+		cfg := f.ClientConfig(objLoc)
+		actual := ClientConfig{Region: cfg.Region, Endpoint: cfg.Endpoint, PathStyle: cfg.PathStyle}
+		if diff := cmp.Diff(expected, actual); diff != "" {
+			t.Errorf("ClientConfig(%s) mismatch (-want +got):\n%s", uri, diff)
+		}
+	}
+}
+
+func TestLocateNotInterfaceEndpoint(t *testing.T) {
+	for _, uri := range []string{
+		"s3://apt-repo-bucket.example.com/pool/hello.deb",
+		"s3://vpce-0abc123-xyz.execute-api.us-east-1.vpce.amazonaws.com/pool/hello.deb",
+		"s3://apt-repo-bucket/pool/hello.deb",
+	} {
+		objLoc, err := New(Config{Region: "us-east-1"}).Locate(uri)
+		if err != nil {
+			continue
+		}
+		if objLoc.Endpoint != "" || objLoc.Region != "" {
+			t.Errorf("Locate(%s) = endpoint %q, region %q; expected neither", uri, objLoc.Endpoint, objLoc.Region)
+		}
+	}
+}
+
+func TestFetchInterfaceEndpointSkipsFallbacks(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.HeadErr = awserr.NewRequestFailure(
+		awserr.New("ServiceUnavailable", "Service Unavailable", nil), http.StatusServiceUnavailable, "id")
+	endpoints := []string{}
+	f := New(Config{Region: "us-east-1", FallbackEndpoints: []string{"https://replica.internal"}},
+		WithS3ClientFactory(func(cfg ClientConfig) (s3iface.S3API, error) {
+			endpoints = append(endpoints, cfg.Endpoint)
+			return fake, nil
+		}))
+	uri := "s3://apt-repo-bucket.vpce-0abc123-xyz.s3.us-east-1.vpce.amazonaws.com/pool/hello.deb"
+	_, err := f.Fetch(context.Background(), FetchRequest{URI: uri, Filename: filepath.Join(t.TempDir(), "hello.deb")})
+	if err == nil {
+		t.Fatalf("Fetch(%s) returned no error; expected the interface endpoint's", uri)
+	}
+	expected := []string{"https://vpce-0abc123-xyz.s3.us-east-1.vpce.amazonaws.com"}
+	if diff := cmp.Diff(expected, endpoints); diff != "" {
+		t.Errorf("endpoints mismatch (-want +got):\n%s", diff)
+	}
+}
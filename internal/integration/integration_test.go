@@ -0,0 +1,178 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package integration drives the method through apt's protocol against an
+// S3 compatible server reached through the AWS SDK, so that mistakes in
+// endpoint resolution, addressing and signing surface, which tests against
+// the in-memory FakeS3 cannot catch. The tests skip with -short.
+package integration
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+	"github.com/google/apt-golang-s3/method"
+)
+
+const (
+	region          = "eu-west-1"
+	accessKeyID     = "AKIAINTEGRATION"
+	secretAccessKey = "integration/secret+key"
+)
+
+// An object is seeded into the server and acquired by a test.
+type object struct {
+	key  string
+	uri  string
+	body []byte
+}
+
+// isolate keeps the credentials and configuration of the machine running the
+// tests out of them, providing the server's credentials in the environment.
+func isolate(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	t.Setenv("AWS_ACCESS_KEY_ID", accessKeyID)
+	t.Setenv("AWS_SECRET_ACCESS_KEY", secretAccessKey)
+	t.Setenv("AWS_SESSION_TOKEN", "")
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	t.Setenv("AWS_CA_BUNDLE", "")
+}
+
+// run feeds apt's configuration, with the given items, and a URI Acquire for
+// each URI to a Method and returns what it sent back and the error Run
+// returned. The URIs are percent-encoded, as apt sends them if it honours
+// Send-URI-Encoded.
+func run(t *testing.T, items []string, uris []string, dir string) (string, error) {
+	t.Helper()
+	input := "601 Configuration\n"
+	for _, item := range append(items, "Acquire::Send-URI-Encoded=1", "Dir::Etc::netrc="+filepath.Join(dir, "auth.conf")) {
+		input += "Config-Item: " + item + "\n"
+	}
+	input += "\n"
+	for idx, uri := range uris {
+		input += fmt.Sprintf("600 URI Acquire\nURI: %s\nFilename: %s\n\n", uri, filepath.Join(dir, fmt.Sprintf("%d.deb", idx)))
+	}
+	out := &bytes.Buffer{}
+	m := method.NewWithOptions(method.Options{Input: strings.NewReader(input), Output: out})
+
+	errc := make(chan error, 1)
+	go func() { errc <- m.Run() }()
+	select {
+	case err := <-errc:
+		return out.String(), err
+	case <-time.After(time.Minute):
+		t.Fatalf("Run() did not return after the input was exhausted\n%s", out)
+		return "", nil
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+	isolate(t)
+	server := testutil.NewS3Server(region, accessKeyID, secretAccessKey)
+	defer server.Close()
+	objects := []object{
+		{"dists/stable/Release", "s3://apt-repo-bucket/dists/stable/Release", []byte("Origin: apt-repo-bucket\n")},
+		{"pool/main/e/empty/empty_1.0_all.deb", "s3://apt-repo-bucket/pool/main/e/empty/empty_1.0_all.deb", nil},
+		{"pool/main/h/hello/hello world_1.0_all.deb", "s3://apt-repo-bucket/pool/main/h/hello/hello%20world_1.0_all.deb", []byte("hello")},
+		{"pool/main/l/large/large_1.0_amd64.deb", "s3://apt-repo-bucket/pool/main/l/large/large_1.0_amd64.deb",
+			bytes.Repeat([]byte("0123456789abcdef"), 100<<20/16)},
+	}
+	for _, obj := range objects {
+		server.Put("apt-repo-bucket", obj.key, testutil.FakeObject{Body: obj.body})
+	}
+	missing := "s3://apt-repo-bucket/pool/main/m/missing/missing_1.0_all.deb"
+
+	for name, endpoint := range map[string]string{
+		"endpoint":          server.URL,
+		"endpoint template": server.URL + "/{bucket}",
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			uris := []string{missing}
+			for _, obj := range objects {
+				uris = append(uris, obj.uri)
+			}
+			output, err := run(t, []string{"Acquire::s3::region=" + region, "Acquire::s3::endpoint=" + endpoint}, uris, dir)
+			if err != nil {
+				t.Errorf("Run() = %v; expected nil\n%s", err, output)
+			}
+
+			for idx, obj := range objects {
+				sum := sha256.Sum256(obj.body)
+				expected := fmt.Sprintf("201 URI Done\nURI: %s\nFilename: %s\nSize: %d\n",
+					obj.uri, filepath.Join(dir, fmt.Sprintf("%d.deb", idx+1)), len(obj.body))
+				if !strings.Contains(output, expected) {
+					t.Errorf("output does not contain %q:\n%s", expected, output)
+				}
+				if !strings.Contains(output, "SHA256-Hash: "+hex.EncodeToString(sum[:])+"\n") {
+					t.Errorf("output does not report the SHA256 of %s:\n%s", obj.key, output)
+				}
+				contents, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("%d.deb", idx+1)))
+				if err != nil || !bytes.Equal(contents, obj.body) {
+					t.Errorf("file of %s has %d bytes (%v); expected the %d bytes of the object", obj.key, len(contents), err, len(obj.body))
+				}
+			}
+			expected := "400 URI Failure\nURI: " + missing + "\nMessage: The specified key does not exist."
+			if !strings.Contains(output, expected) {
+				t.Errorf("output does not contain %q:\n%s", expected, output)
+			}
+		})
+	}
+}
+
+func TestAcquireRejectedSignature(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+	isolate(t)
+	server := testutil.NewS3Server(region, accessKeyID, secretAccessKey)
+	defer server.Close()
+	server.Put("apt-repo-bucket", "dists/stable/Release", testutil.FakeObject{Body: []byte("Origin: apt-repo-bucket\n")})
+
+	specs := map[string]struct {
+		items []string
+		uri   string
+	}{
+		"other region":     {[]string{"Acquire::s3::region=us-east-1"}, "s3://apt-repo-bucket/dists/stable/Release"},
+		"other secret key": {[]string{"Acquire::s3::region=" + region}, "s3://" + accessKeyID + ":wrong@apt-repo-bucket/dists/stable/Release"},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			output, err := run(t, append(spec.items, "Acquire::s3::endpoint="+server.URL), []string{spec.uri}, t.TempDir())
+
+			// S3 rejecting the credentials fails the acquire of the URI, not
+			// those of other sources.
+			expected := "400 URI Failure\nURI: " + spec.uri + "\nMessage: HeadObject s3://apt-repo-bucket/dists/stable/Release failed: Forbidden"
+			if err != nil || !strings.Contains(output, expected) {
+				t.Errorf("Run() = %v; expected nil, and output containing %q:\n%s", err, expected, output)
+			}
+		})
+	}
+}
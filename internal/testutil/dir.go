@@ -0,0 +1,71 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// A DirSnapshot holds the contents of the files below a directory at one
+// point in time.
+type DirSnapshot struct {
+	dir   string
+	files map[string]string
+}
+
+// SnapshotDir records the contents of the files below dir.
+func SnapshotDir(t testing.TB, dir string) DirSnapshot {
+	t.Helper()
+	return DirSnapshot{dir: dir, files: readDir(t, dir)}
+}
+
+// CheckUnchanged reports an error if any file below the directory was added,
+// removed or changed since the snapshot was taken, such as a partial download
+// a failed fetch left behind.
+func (snapshot DirSnapshot) CheckUnchanged(t testing.TB) {
+	t.Helper()
+	if diff := cmp.Diff(snapshot.files, readDir(t, snapshot.dir)); diff != "" {
+		t.Errorf("%s changed (-before +after):\n%s", snapshot.dir, diff)
+	}
+}
+
+func readDir(t testing.TB, dir string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[rel] = string(contents)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", dir, err)
+	}
+	return files
+}
@@ -0,0 +1,141 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/apt-golang-s3/clock"
+)
+
+// A FakeClock is a clock.Clock whose time only moves when Advance is called.
+// It is safe for concurrent use.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	deadline time.Time
+	c        chan time.Time
+	// period is the interval of a ticker, which keeps waiting after firing,
+	// and zero for After.
+	period time.Duration
+}
+
+// NewFakeClock returns a FakeClock set to the given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the fake current time.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After returns a channel that receives the fake current time once the clock
+// was advanced by at least d.
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeWaiter{deadline: c.now.Add(d), c: ch})
+	return ch
+}
+
+// Sleep blocks until the clock was advanced by at least d.
+func (c *FakeClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+// NewTicker returns a Ticker that ticks whenever the clock was advanced past
+// its next tick. Like a time.Ticker, it drops the ticks its receiver is not
+// ready for, and sends one tick however many periods an Advance spans.
+func (c *FakeClock) NewTicker(d time.Duration) clock.Ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ticker := &fakeTicker{clock: c, c: make(chan time.Time, 1)}
+	c.waiters = append(c.waiters, fakeWaiter{deadline: c.now.Add(d), c: ticker.c, period: d})
+	return ticker
+}
+
+// Advance moves the clock forward by d and wakes up every After, Sleep and
+// Ticker whose deadline has passed.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.waiters[:0]
+	for _, waiter := range c.waiters {
+		if waiter.deadline.After(c.now) {
+			pending = append(pending, waiter)
+			continue
+		}
+		if waiter.period == 0 {
+			waiter.c <- c.now
+			continue
+		}
+		select {
+		case waiter.c <- c.now:
+		default:
+		}
+		for !waiter.deadline.After(c.now) {
+			waiter.deadline = waiter.deadline.Add(waiter.period)
+		}
+		pending = append(pending, waiter)
+	}
+	c.waiters = pending
+}
+
+type fakeTicker struct {
+	clock *FakeClock
+	c     chan time.Time
+}
+
+func (ticker *fakeTicker) C() <-chan time.Time {
+	return ticker.c
+}
+
+// Stop removes the ticker from the clock's waiters.
+func (ticker *fakeTicker) Stop() {
+	ticker.clock.mu.Lock()
+	defer ticker.clock.mu.Unlock()
+	ticker.clock.waiters = slices.DeleteFunc(ticker.clock.waiters, func(waiter fakeWaiter) bool {
+		return waiter.c == ticker.c
+	})
+}
+
+// BlockUntil blocks until at least n goroutines are waiting on the clock,
+// which lets a test advance it only once the code under test is ready.
+func (c *FakeClock) BlockUntil(n int) {
+	for {
+		c.mu.Lock()
+		waiting := len(c.waiters)
+		c.mu.Unlock()
+		if waiting >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
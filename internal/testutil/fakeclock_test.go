@@ -0,0 +1,104 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClockAdvance(t *testing.T) {
+	start := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	short := clock.After(time.Second)
+	long := clock.After(time.Minute)
+
+	clock.Advance(30 * time.Second)
+	select {
+	case now := <-short:
+		if expected := start.Add(30 * time.Second); !now.Equal(expected) {
+			t.Errorf("After(1s) fired with %s; expected %s", now, expected)
+		}
+	default:
+		t.Error("After(1s) did not fire after advancing 30s")
+	}
+	select {
+	case <-long:
+		t.Error("After(1m) fired after advancing only 30s")
+	default:
+	}
+
+	clock.Advance(30 * time.Second)
+	select {
+	case <-long:
+	default:
+		t.Error("After(1m) did not fire after advancing 1m")
+	}
+	if expected := start.Add(time.Minute); !clock.Now().Equal(expected) {
+		t.Errorf("Now() = %s; expected %s", clock.Now(), expected)
+	}
+}
+
+func TestFakeClockSleep(t *testing.T) {
+	clock := NewFakeClock(time.Time{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		clock.Sleep(time.Hour)
+	}()
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Hour)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sleep(1h) did not return after advancing 1h")
+	}
+}
+
+func TestFakeClockTicker(t *testing.T) {
+	clock := NewFakeClock(time.Time{})
+	ticker := clock.NewTicker(time.Second)
+
+	clock.Advance(500 * time.Millisecond)
+	select {
+	case <-ticker.C():
+		t.Error("ticker ticked before its period passed")
+	default:
+	}
+	clock.Advance(3 * time.Second)
+	select {
+	case <-ticker.C():
+	default:
+		t.Error("ticker did not tick after its period passed")
+	}
+	clock.Advance(time.Second)
+	select {
+	case <-ticker.C():
+	default:
+		t.Error("ticker did not tick again after another period")
+	}
+
+	ticker.Stop()
+	clock.Advance(time.Minute)
+	select {
+	case <-ticker.C():
+		t.Error("ticker ticked after it was stopped")
+	default:
+	}
+	if len(clock.waiters) != 0 {
+		t.Errorf("clock has %d waiters after the ticker was stopped; expected none", len(clock.waiters))
+	}
+}
@@ -0,0 +1,562 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package testutil provides fakes shared by the tests of the other packages.
+package testutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// A FakeObject is an object stored in a FakeS3.
+type FakeObject struct {
+	Body         []byte
+	LastModified time.Time
+	// ContentLength overrides the size reported by HeadObject when non-nil.
+	ContentLength *int64
+	// ETag is reported by HeadObject, if set.
+	ETag string
+	// OmitHeadMetadata makes HeadObject report neither ContentLength nor
+	// LastModified, like some S3 compatible services do.
+	OmitHeadMetadata bool
+	// ContentEncoding is reported by HeadObject and GetObject, if set.
+	ContentEncoding string
+	// ContentType is reported by HeadObject, if set.
+	ContentType string
+	// Parts, when set, describe how the object was uploaded in parts, as
+	// GetObjectAttributes reports and GetObject with a PartNumber serves.
+	Parts []FakePart
+}
+
+// A FakePart is a part of a FakeObject uploaded in parts.
+type FakePart struct {
+	Size           int64
+	ChecksumSHA256 string
+}
+
+// A FakeS3 is an in-memory implementation of the parts of s3iface.S3API that
+// fetching objects uses. Calling any other function panics.
+type FakeS3 struct {
+	s3iface.S3API
+
+	mu      sync.Mutex
+	buckets map[string]bool
+	objects map[string]FakeObject
+	// HeadErr and GetErr, when set, are returned by every HeadObject and
+	// GetObject call respectively.
+	HeadErr error
+	GetErr  error
+	// GetErrOnce, when set, is returned by the next GetObject call only.
+	GetErrOnce error
+	// Creds, when set, are exposed as the credentials the fake signs its
+	// requests with.
+	Creds *credentials.Credentials
+	// ListErr, when set, is returned by every ListObjectsV2 call.
+	ListErr error
+	// ListPageSize limits the number of keys per ListObjectsV2 page when
+	// positive.
+	ListPageSize int
+	// BeforePut, when set, is called with the key of every PutObject call
+	// before its preconditions are checked, which lets tests interleave a
+	// concurrent writer.
+	BeforePut func(key string)
+	// BeforeGet, when set, is called with the key of every GetObject call
+	// before the object is looked up, which lets tests replace it between its
+	// HeadObject and its download.
+	BeforeGet func(key string)
+	// CorruptRanges makes GetObject serve requests for a byte range with every
+	// byte inverted, like S3 compatible services that mishandle them.
+	CorruptRanges bool
+	// IgnoreRanges makes GetObject serve the whole object whatever byte range
+	// is requested, like S3 compatible services that ignore the Range header.
+	IgnoreRanges bool
+	// EmptyRangeErr, when set, is returned by GetObject calls for a byte range
+	// or part of an empty object, like S3 compatible services that fail them
+	// rather than answering with a 416 the SDK recognises.
+	EmptyRangeErr error
+	// Date, when set, is the time the Date header of HeadObject responses
+	// gives, which request options such as request.WithGetResponseHeader see.
+	Date time.Time
+	// BucketRegions gives the region the x-amz-bucket-region header of
+	// HeadBucket responses names for each bucket, which request options such
+	// as request.WithGetResponseHeader see. Buckets it does not name get no
+	// such header.
+	BucketRegions map[string]string
+	// ResetAt lists offsets into objects at which the bodies of GetObject
+	// calls break off with a connection reset, like a connection dropped
+	// mid-transfer. Each offset is used up by the first GetObject whose range
+	// spans it.
+	ResetAt []int64
+	// When Stalled is non-nil, GetObject bodies deliver StallAfter bytes, then
+	// close Stalled and block until the request context is cancelled.
+	StallAfter int64
+	Stalled    chan struct{}
+	stallOnce  sync.Once
+	heads      int
+	gets       int
+	ranges     []string
+	lists      int
+}
+
+// NewFakeS3 returns an empty FakeS3.
+func NewFakeS3() *FakeS3 {
+	return &FakeS3{buckets: map[string]bool{}, objects: map[string]FakeObject{}}
+}
+
+// AddBucket adds an empty bucket.
+func (fake *FakeS3) AddBucket(bucket string) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.buckets[bucket] = true
+}
+
+// Put stores obj under the given bucket and key, creating the bucket if
+// necessary.
+func (fake *FakeS3) Put(bucket, key string, obj FakeObject) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.buckets[bucket] = true
+	fake.objects[bucket+"/"+key] = obj
+}
+
+// ClientCredentials returns the Creds of the fake.
+func (fake *FakeS3) ClientCredentials() *credentials.Credentials {
+	return fake.Creds
+}
+
+// Heads returns the number of HeadObject calls so far.
+func (fake *FakeS3) Heads() int {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return fake.heads
+}
+
+// Gets returns the number of GetObject calls so far.
+func (fake *FakeS3) Gets() int {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return fake.gets
+}
+
+// Ranges returns the Range of every GetObject call so far, in order, with an
+// empty string for those of whole objects.
+func (fake *FakeS3) Ranges() []string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return slices.Clone(fake.ranges)
+}
+
+// Lists returns the number of ListObjectsV2 calls so far.
+func (fake *FakeS3) Lists() int {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return fake.lists
+}
+
+// completeHead runs the Complete handlers the options of a HeadObject call
+// add on a response carrying the Date header.
+func (fake *FakeS3) completeHead(opts []request.Option) {
+	header := http.Header{}
+	if !fake.Date.IsZero() {
+		header.Set("Date", fake.Date.UTC().Format(http.TimeFormat))
+	}
+	complete(opts, header)
+}
+
+// complete runs the Complete handlers the given request options add on a
+// response with the given header.
+func complete(opts []request.Option, header http.Header) {
+	r := &request.Request{HTTPRequest: &http.Request{Header: http.Header{}}, HTTPResponse: &http.Response{Header: header}}
+	r.ApplyOptions(opts...)
+	r.Handlers.Complete.Run(r)
+}
+
+func (fake *FakeS3) object(bucket, key *string) (FakeObject, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	obj, ok := fake.objects[aws.StringValue(bucket)+"/"+aws.StringValue(key)]
+	if !ok {
+		return FakeObject{}, awserr.NewRequestFailure(
+			awserr.New("NotFound", "Not Found", nil), http.StatusNotFound, "fake-request-id")
+	}
+	return obj, nil
+}
+
+func (fake *FakeS3) HeadBucket(input *s3.HeadBucketInput) (*s3.HeadBucketOutput, error) {
+	return fake.HeadBucketWithContext(aws.BackgroundContext(), input)
+}
+
+func (fake *FakeS3) HeadBucketWithContext(
+	ctx aws.Context, input *s3.HeadBucketInput, opts ...request.Option,
+) (*s3.HeadBucketOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	header := http.Header{}
+	if region, ok := fake.BucketRegions[aws.StringValue(input.Bucket)]; ok {
+		header.Set("X-Amz-Bucket-Region", region)
+	}
+	complete(opts, header)
+	if !fake.buckets[aws.StringValue(input.Bucket)] {
+		return nil, awserr.NewRequestFailure(
+			awserr.New("NotFound", "Not Found", nil), http.StatusNotFound, "fake-request-id")
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (fake *FakeS3) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	return fake.ListObjectsV2WithContext(aws.BackgroundContext(), input)
+}
+
+// ListObjectsV2WithContext lists the keys of a bucket in lexical order. The
+// continuation token is the last key of the previous page.
+func (fake *FakeS3) ListObjectsV2WithContext(
+	ctx aws.Context, input *s3.ListObjectsV2Input, _ ...request.Option,
+) (*s3.ListObjectsV2Output, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.lists++
+	if fake.ListErr != nil {
+		return nil, fake.ListErr
+	}
+	bucket := aws.StringValue(input.Bucket)
+	if !fake.buckets[bucket] {
+		return nil, awserr.NewRequestFailure(
+			awserr.New(s3.ErrCodeNoSuchBucket, "The specified bucket does not exist", nil), http.StatusNotFound, "fake-request-id")
+	}
+	prefix, delimiter := aws.StringValue(input.Prefix), aws.StringValue(input.Delimiter)
+	keys := []string{}
+	for name := range fake.objects {
+		objBucket, key, _ := strings.Cut(name, "/")
+		rest, found := strings.CutPrefix(key, prefix)
+		if objBucket != bucket || !found || key <= aws.StringValue(input.ContinuationToken) ||
+			(delimiter != "" && strings.Contains(rest, delimiter)) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	output := &s3.ListObjectsV2Output{}
+	if fake.ListPageSize > 0 && len(keys) > fake.ListPageSize {
+		keys = keys[:fake.ListPageSize]
+		output.IsTruncated = aws.Bool(true)
+		output.NextContinuationToken = aws.String(keys[len(keys)-1])
+	}
+	for _, key := range keys {
+		obj := fake.objects[bucket+"/"+key]
+		object := &s3.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(int64(len(obj.Body))),
+			LastModified: aws.Time(obj.LastModified),
+		}
+		if obj.ETag != "" {
+			object.ETag = aws.String(obj.ETag)
+		}
+		output.Contents = append(output.Contents, object)
+	}
+	return output, nil
+}
+
+func (fake *FakeS3) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	return fake.HeadObjectWithContext(aws.BackgroundContext(), input)
+}
+
+func (fake *FakeS3) HeadObjectWithContext(
+	ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option,
+) (*s3.HeadObjectOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	fake.mu.Lock()
+	fake.heads++
+	fake.mu.Unlock()
+	if fake.HeadErr != nil {
+		return nil, fake.HeadErr
+	}
+	obj, err := fake.object(input.Bucket, input.Key)
+	if err != nil {
+		return nil, err
+	}
+	fake.completeHead(opts)
+	if obj.OmitHeadMetadata {
+		return &s3.HeadObjectOutput{}, nil
+	}
+	size := int64(len(obj.Body))
+	if obj.ContentLength != nil {
+		size = *obj.ContentLength
+	}
+	output := &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(size),
+		LastModified:  aws.Time(obj.LastModified),
+	}
+	if obj.ETag != "" {
+		output.ETag = aws.String(obj.ETag)
+	}
+	if obj.ContentEncoding != "" {
+		output.ContentEncoding = aws.String(obj.ContentEncoding)
+	}
+	if obj.ContentType != "" {
+		output.ContentType = aws.String(obj.ContentType)
+	}
+	return output, nil
+}
+
+func (fake *FakeS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return fake.GetObjectWithContext(aws.BackgroundContext(), input)
+}
+
+// GetObjectWithContext serves the requested byte range of the object, which
+// is what the s3manager.Downloader relies on. An IfMatch that is not the
+// object's ETag fails with a 412.
+func (fake *FakeS3) GetObjectWithContext(
+	ctx aws.Context, input *s3.GetObjectInput, _ ...request.Option,
+) (*s3.GetObjectOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	fake.mu.Lock()
+	fake.gets++
+	fake.ranges = append(fake.ranges, aws.StringValue(input.Range))
+	fake.mu.Unlock()
+	if fake.GetErr != nil {
+		return nil, fake.GetErr
+	}
+	fake.mu.Lock()
+	errOnce := fake.GetErrOnce
+	fake.GetErrOnce = nil
+	fake.mu.Unlock()
+	if errOnce != nil {
+		return nil, errOnce
+	}
+	if fake.BeforeGet != nil {
+		fake.BeforeGet(aws.StringValue(input.Key))
+	}
+	obj, err := fake.object(input.Bucket, input.Key)
+	if err != nil {
+		return nil, err
+	}
+	if input.IfMatch != nil && aws.StringValue(input.IfMatch) != obj.ETag {
+		return nil, awserr.NewRequestFailure(
+			awserr.New("PreconditionFailed", "At least one of the pre-conditions you specified did not hold", nil),
+			http.StatusPreconditionFailed, "fake-request-id")
+	}
+	total := int64(len(obj.Body))
+	if fake.EmptyRangeErr != nil && total == 0 && (input.Range != nil || input.PartNumber != nil) {
+		return nil, fake.EmptyRangeErr
+	}
+	start, end := int64(0), total-1
+	switch {
+	case input.PartNumber != nil:
+		start, end = partRange(obj.Parts, aws.Int64Value(input.PartNumber))
+	case input.Range != nil && !fake.IgnoreRanges:
+		start, end = parseRange(aws.StringValue(input.Range), total)
+	}
+	body := obj.Body[start : end+1]
+	if fake.CorruptRanges && input.Range != nil {
+		body = bytes.Clone(body)
+		for idx := range body {
+			body[idx] ^= 0xff
+		}
+	}
+	var reader io.Reader = bytes.NewReader(body)
+	if cut, ok := fake.takeReset(start, end); ok {
+		reader = io.MultiReader(bytes.NewReader(body[:cut-start]), connectionResetReader{})
+	}
+	if fake.Stalled != nil {
+		reader = io.MultiReader(
+			bytes.NewReader(body[:min(fake.StallAfter, int64(len(body)))]),
+			&stallingReader{ctx: ctx, onStall: func() { fake.stallOnce.Do(func() { close(fake.Stalled) }) }},
+		)
+	}
+	output := &s3.GetObjectOutput{
+		Body:          io.NopCloser(reader),
+		ContentLength: aws.Int64(int64(len(body))),
+		ContentRange:  aws.String(fmt.Sprintf("bytes %d-%d/%d", start, end, total)),
+		LastModified:  aws.Time(obj.LastModified),
+	}
+	if obj.ContentEncoding != "" {
+		output.ContentEncoding = aws.String(obj.ContentEncoding)
+	}
+	if obj.ETag != "" {
+		output.ETag = aws.String(obj.ETag)
+	}
+	return output, nil
+}
+
+// PutObjectWithContext stores the object, giving it the hex MD5 digest of its
+// body as ETag like S3 does. The If-Match and If-None-Match headers set
+// through request options are honoured, failing with a 412 when they do not
+// hold.
+func (fake *FakeS3) PutObjectWithContext(
+	ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option,
+) (*s3.PutObjectOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	if fake.BeforePut != nil {
+		fake.BeforePut(aws.StringValue(input.Key))
+	}
+	r := &request.Request{HTTPRequest: &http.Request{Header: http.Header{}}}
+	r.ApplyOptions(opts...)
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if !fake.buckets[aws.StringValue(input.Bucket)] {
+		return nil, awserr.NewRequestFailure(
+			awserr.New(s3.ErrCodeNoSuchBucket, "The specified bucket does not exist", nil), http.StatusNotFound, "fake-request-id")
+	}
+	name := aws.StringValue(input.Bucket) + "/" + aws.StringValue(input.Key)
+	current, exists := fake.objects[name]
+	ifMatch, ifNoneMatch := r.HTTPRequest.Header.Get("If-Match"), r.HTTPRequest.Header.Get("If-None-Match")
+	if (ifMatch != "" && (!exists || current.ETag != ifMatch)) || (ifNoneMatch == "*" && exists) {
+		return nil, awserr.NewRequestFailure(
+			awserr.New("PreconditionFailed", "At least one of the pre-conditions you specified did not hold", nil),
+			http.StatusPreconditionFailed, "fake-request-id")
+	}
+	etag := fmt.Sprintf("%q", fmt.Sprintf("%x", md5.Sum(body)))
+	fake.objects[name] = FakeObject{
+		Body:         body,
+		LastModified: time.Now(),
+		ETag:         etag,
+		ContentType:  aws.StringValue(input.ContentType),
+	}
+	return &s3.PutObjectOutput{ETag: aws.String(etag)}, nil
+}
+
+// Object returns the object stored under the given bucket and key, if any.
+func (fake *FakeS3) Object(bucket, key string) (FakeObject, bool) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	obj, ok := fake.objects[bucket+"/"+key]
+	return obj, ok
+}
+
+// partRange returns the first and last byte of the given part, counting from
+// one.
+func partRange(parts []FakePart, number int64) (int64, int64) {
+	start := int64(0)
+	for _, part := range parts[:number-1] {
+		start += part.Size
+	}
+	return start, start + parts[number-1].Size - 1
+}
+
+// GetObjectAttributesWithContext reports the Parts of the object, paging
+// through them two at a time.
+func (fake *FakeS3) GetObjectAttributesWithContext(
+	ctx aws.Context, input *s3.GetObjectAttributesInput, _ ...request.Option,
+) (*s3.GetObjectAttributesOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	obj, err := fake.object(input.Bucket, input.Key)
+	if err != nil {
+		return nil, err
+	}
+	output := &s3.GetObjectAttributesOutput{}
+	if len(obj.Parts) == 0 {
+		return output, nil
+	}
+	first := aws.Int64Value(input.PartNumberMarker)
+	last := min(first+2, int64(len(obj.Parts)))
+	output.ObjectParts = &s3.GetObjectAttributesParts{
+		IsTruncated:          aws.Bool(last < int64(len(obj.Parts))),
+		NextPartNumberMarker: aws.Int64(last),
+		TotalPartsCount:      aws.Int64(int64(len(obj.Parts))),
+	}
+	for idx := first; idx < last; idx++ {
+		part := obj.Parts[idx]
+		objectPart := &s3.ObjectPart{PartNumber: aws.Int64(idx + 1), Size: aws.Int64(part.Size)}
+		if part.ChecksumSHA256 != "" {
+			objectPart.ChecksumSHA256 = aws.String(part.ChecksumSHA256)
+		}
+		output.ObjectParts.Parts = append(output.ObjectParts.Parts, objectPart)
+	}
+	return output, nil
+}
+
+// parseRange parses a "bytes=start-end" header value, clamping end to the
+// object size.
+func parseRange(value string, total int64) (int64, int64) {
+	first, last, _ := strings.Cut(strings.TrimPrefix(value, "bytes="), "-")
+	start, _ := strconv.ParseInt(first, 10, 64)
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end >= total {
+		end = total - 1
+	}
+	return start, end
+}
+
+// takeReset returns, and uses up, the next of the ResetAt offsets if it lies
+// between start and end.
+func (fake *FakeS3) takeReset(start, end int64) (int64, bool) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.ResetAt) == 0 || fake.ResetAt[0] < start || fake.ResetAt[0] > end {
+		return 0, false
+	}
+	cut := fake.ResetAt[0]
+	fake.ResetAt = fake.ResetAt[1:]
+	return cut, true
+}
+
+// A connectionResetReader fails like the body of a response whose connection
+// the server reset.
+type connectionResetReader struct{}
+
+func (connectionResetReader) Read([]byte) (int, error) {
+	return 0, &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+}
+
+// A stallingReader blocks until its context is cancelled, simulating a
+// download that stopped making progress.
+type stallingReader struct {
+	ctx     context.Context
+	onStall func()
+}
+
+func (r *stallingReader) Read([]byte) (int, error) {
+	r.onStall()
+	<-r.ctx.Done()
+	return 0, r.ctx.Err()
+}
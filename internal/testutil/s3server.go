@@ -0,0 +1,186 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"crypto/md5" //nolint:gosec
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// signaturePattern matches the Authorization header of requests signed with
+// Signature Version 4.
+var signaturePattern = regexp.MustCompile( //nolint:gochecknoglobals
+	`^AWS4-HMAC-SHA256 Credential=([^/]+)/\d{8}/([^/]+)/s3/aws4_request, SignedHeaders=([^,]+), Signature=([0-9a-f]{64})$`)
+
+// rangePattern matches the single byte ranges the S3 downloader requests.
+var rangePattern = regexp.MustCompile(`^bytes=(\d+)-(\d*)$`) //nolint:gochecknoglobals
+
+// An S3Server is an S3 compatible HTTP server that serves HeadBucket,
+// HeadObject and GetObject requests for path-style URLs, as S3 compatible
+// services such as MinIO do. Unlike FakeS3, it is reached through the AWS SDK,
+// so that it catches mistakes in addressing and signing: requests not signed
+// for its region with its credentials are rejected, as S3 rejects them.
+type S3Server struct {
+	*httptest.Server
+
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+
+	mu      sync.Mutex
+	buckets map[string]bool
+	objects map[string]FakeObject
+}
+
+// NewS3Server starts an S3Server accepting requests signed for region with
+// the given credentials. It must be closed when no longer needed.
+func NewS3Server(region, accessKeyID, secretAccessKey string) *S3Server {
+	server := &S3Server{
+		region:          region,
+		accessKeyID:     accessKeyID,
+		secretAccessKey: secretAccessKey,
+		buckets:         map[string]bool{},
+		objects:         map[string]FakeObject{},
+	}
+	server.Server = httptest.NewServer(server)
+	return server
+}
+
+// Put stores obj under the given bucket and key, creating the bucket if
+// necessary. Only its Body and LastModified are served.
+func (server *S3Server) Put(bucket, key string, obj FakeObject) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.buckets[bucket] = true
+	server.objects[bucket+"/"+key] = obj
+}
+
+// ServeHTTP implements http.Handler.
+func (server *S3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if code, message := server.checkSignature(r); code != "" {
+		writeS3Error(w, r, http.StatusForbidden, code, message)
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	server.mu.Lock()
+	bucketExists := server.buckets[bucket]
+	obj, objectExists := server.objects[bucket+"/"+key]
+	server.mu.Unlock()
+	switch {
+	case r.Method != http.MethodGet && r.Method != http.MethodHead:
+		writeS3Error(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed.")
+	case !bucketExists:
+		writeS3Error(w, r, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.")
+	case key == "":
+		w.WriteHeader(http.StatusOK)
+	case !objectExists:
+		writeS3Error(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+	default:
+		serveObject(w, r, obj)
+	}
+}
+
+// checkSignature signs r again as the AWS SDK would have signed it for the
+// server's region and credentials, and returns the code and message of the
+// S3 error to answer with if the signatures differ.
+func (server *S3Server) checkSignature(r *http.Request) (string, string) {
+	match := signaturePattern.FindStringSubmatch(r.Header.Get("Authorization"))
+	if match == nil {
+		return "AccessDenied", "Access Denied"
+	}
+	if match[1] != server.accessKeyID {
+		return "InvalidAccessKeyId", "The AWS Access Key Id you provided does not exist in our records."
+	}
+	if match[2] != server.region {
+		return "AuthorizationHeaderMalformed", fmt.Sprintf("The authorization header is malformed; the region '%s' is wrong; "+
+			"expecting '%s'", match[2], server.region)
+	}
+	signTime, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return "AccessDenied", "AWS authentication requires a valid Date or x-amz-date header"
+	}
+	signed, err := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	if err != nil {
+		return "AccessDenied", err.Error()
+	}
+	for _, name := range strings.Split(match[3], ";") {
+		if name != "host" {
+			signed.Header[http.CanonicalHeaderKey(name)] = r.Header.Values(name)
+		}
+	}
+	signer := v4.NewSigner(credentials.NewStaticCredentials(server.accessKeyID, server.secretAccessKey, ""),
+		func(signer *v4.Signer) { signer.DisableURIPathEscaping = true })
+	if _, err := signer.Sign(signed, nil, "s3", server.region, signTime); err != nil {
+		return "AccessDenied", err.Error()
+	}
+	if !strings.HasSuffix(signed.Header.Get("Authorization"), "Signature="+match[4]) {
+		return "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided."
+	}
+	return "", ""
+}
+
+// serveObject answers a HeadObject or GetObject request for obj, honouring
+// the byte range a GetObject asks for.
+func serveObject(w http.ResponseWriter, r *http.Request, obj FakeObject) {
+	sum := md5.Sum(obj.Body) //nolint:gosec
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	if !obj.LastModified.IsZero() {
+		w.Header().Set("Last-Modified", obj.LastModified.UTC().Format(http.TimeFormat))
+	}
+	body, status := obj.Body, http.StatusOK
+	if match := rangePattern.FindStringSubmatch(r.Header.Get("Range")); match != nil {
+		first, _ := strconv.Atoi(match[1])
+		last := len(body) - 1
+		if match[2] != "" {
+			last, _ = strconv.Atoi(match[2])
+		}
+		if first >= len(body) {
+			writeS3Error(w, r, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable")
+			return
+		}
+		last = min(last, len(body)-1)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, len(body)))
+		body, status = body[first:last+1], http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		w.Write(body) //nolint:errcheck
+	}
+}
+
+// writeS3Error answers r with an S3 error. HEAD requests get the status only,
+// as S3 sends no body for them.
+func writeS3Error(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>`+"\n"+
+		`<Error><Code>%s</Code><Message>%s</Message><RequestId>s3server</RequestId></Error>`, code, message)
+}
@@ -18,31 +18,330 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
 	"runtime"
+	"strings"
 
+	"github.com/google/apt-golang-s3/fetcher"
 	"github.com/google/apt-golang-s3/method"
+	"github.com/google/apt-golang-s3/publish"
+	"github.com/google/apt-golang-s3/version"
 )
 
 const (
-	version = "1.0.0"
+	exitCodeUsage    = 2
+	exitCodeNotFound = 4
 )
 
 var (
-	//nolint:gochecknoglobals
-	showVersion = flag.Bool("version", false, "Print version and exit")
+	errGetUsage     = errors.New("get takes exactly one s3:// URI")
+	errPublishUsage = errors.New("publish takes a .deb file or directory and an s3:// URI")
 )
 
+// usageText describes the binary for --help.
+const usageText = `%[1]s is an apt method for repositories hosted in Amazon S3.
+
+apt runs it without arguments for s3:// sources and talks to it on stdin and
+stdout; run by hand that way from a terminal, it explains itself and exits
+unless given --stdin.
+
+Usage:
+  %[1]s [--log-level debug|info|warn] [--stdin] [--config-file file] [--transcript file]
+  %[1]s doctor s3://bucket/path/to/key
+  %[1]s get s3://bucket/path/to/key [-o file]
+  %[1]s check-config [--from file]
+  %[1]s publish <file.deb|directory> s3://bucket/prefix
+  %[1]s --version
+
+Flags:
+`
+
+// terminalText explains the binary to those who run it from a terminal, where
+// it would otherwise wait for apt's messages without a word.
+const terminalText = `%[1]s is an APT transport for s3:// sources, which apt runs once it is
+installed as /usr/lib/apt/methods/s3, and talks to on stdin and stdout.
+
+To check whether an object can be acquired, or to fetch it, run:
+  %[1]s doctor s3://bucket/path/to/key
+  %[1]s get s3://bucket/path/to/key
+
+Pass --stdin to type apt's messages on this terminal anyway, or --help for
+the other commands.
+`
+
+// mainFlags are the flags of the binary, which apt gives none of.
+type mainFlags struct {
+	version, help bool
+	stdin         bool
+	configFile    string
+	transcript    string
+	logLevel      method.LogLevel
+	args          []string
+}
+
+// parseFlags parses the flags that precede the subcommand, if any, writing
+// errors and the usage to output.
+func parseFlags(args []string, output io.Writer) (mainFlags, error) {
+	var parsed mainFlags
+	flags := flag.NewFlagSet(version.Name, flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.BoolVar(&parsed.version, "version", false, "print the version and exit")
+	flags.BoolVar(&parsed.help, "help", false, "print this help and exit")
+	flags.BoolVar(&parsed.stdin, "stdin", false, "wait for apt's messages on stdin even if it is a terminal")
+	flags.StringVar(&parsed.configFile, "config-file", "",
+		"apply the configuration items of this file, one name=value per line, before apt's 601 Configuration message")
+	flags.StringVar(&parsed.transcript, "transcript", "",
+		"append the messages exchanged with apt to this file, timestamped and with credentials redacted")
+	flags.Func("log-level", "write diagnostics of this level or above to stderr: debug, info or warn", func(value string) error {
+		level, err := method.ParseLogLevel(value)
+		parsed.logLevel = level
+		return err
+	})
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), usageText, version.Name)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return mainFlags{}, err
+	}
+	if parsed.help {
+		flags.Usage()
+	}
+	parsed.args = flags.Args()
+	return parsed, nil
+}
+
 func main() {
-	flag.Parse()
+	parsed, err := parseFlags(os.Args[1:], os.Stderr)
+	if errors.Is(err, flag.ErrHelp) || parsed.help {
+		os.Exit(0)
+	}
+	if err != nil {
+		os.Exit(exitCodeUsage)
+	}
 
 	logger := log.New(os.Stdout, "", 0)
-	if *showVersion {
-		logger.Printf("apt-golang-s3 %s (Go version: %s)\n", version, runtime.Version())
+	if parsed.version {
+		logger.Printf("%s %s (Go version: %s)\n", version.Name, version.Get(), runtime.Version())
 		os.Exit(0)
 	}
 
-	method.New(logger).Run()
+	if len(parsed.args) > 0 {
+		switch parsed.args[0] {
+		case "doctor":
+			os.Exit(doctor(parsed.args[1:]))
+		case "get":
+			os.Exit(get(parsed.args[1:]))
+		case "check-config":
+			os.Exit(checkConfig(parsed.args[1:]))
+		case "publish":
+			os.Exit(runPublish(parsed.args[1:]))
+		}
+	}
+
+	if explainTerminal(os.Stdin, parsed, os.Stderr) {
+		os.Exit(exitCodeUsage)
+	}
+	opts := aliasOptions(filepath.Base(os.Args[0]))
+	opts.Input, opts.Output = os.Stdin, os.Stdout
+	opts.LogLevel, opts.Diagnostics = parsed.logLevel, os.Stderr
+	opts.Transcript = parsed.transcript
+	if parsed.configFile != "" {
+		if opts.ConfigItems, err = method.ReadConfigFile(parsed.configFile); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", version.Name, err)
+			os.Exit(1)
+		}
+	}
+	if err := method.NewWithOptions(opts).Run(); err != nil {
+		os.Exit(1)
+	}
+}
+
+// explainTerminal writes terminalText to output and returns true if stdin is a
+// terminal, so that the method is not run, unless --stdin was given. apt runs
+// the method on a pipe, which is left alone.
+func explainTerminal(stdin *os.File, parsed mainFlags, output io.Writer) bool {
+	if parsed.stdin || !isTerminal(stdin) {
+		return false
+	}
+	fmt.Fprintf(output, terminalText, version.Name)
+	return true
+}
+
+// aliasOptions returns the Options of the method the binary was invoked as,
+// so that symlinks such as /usr/lib/apt/methods/s3+http behave differently
+// without any configuration. Unknown names get the Options of the s3 method.
+func aliasOptions(name string) method.Options {
+	switch name {
+	case "s3+http":
+		return method.Options{Scheme: name, DisableSSL: true}
+	case "s3+accel":
+		return method.Options{Scheme: name, Accelerate: true}
+	default:
+		return method.Options{}
+	}
+}
+
+// doctor runs the self-test subcommand and returns the process exit code.
+func doctor(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "usage: %s doctor s3://bucket/path/to/key\n", version.Name)
+		return exitCodeUsage
+	}
+	if err := method.Doctor(os.Stdout, args[0]); err != nil {
+		fmt.Fprintf(os.Stderr, "doctor: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// checkConfig runs the configuration check subcommand and returns the process
+// exit code, which is 1 when an item is unknown or invalid.
+func checkConfig(args []string) int {
+	flags := flag.NewFlagSet("check-config", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	from := flags.String("from", "", "apt.conf file to check instead of the output of apt-config dump")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s check-config [--from /etc/apt/apt.conf.d/s3]\n", version.Name)
+		return exitCodeUsage
+	}
+	if err := method.CheckConfig(os.Stdout, *from); err != nil {
+		fmt.Fprintf(os.Stderr, "check-config: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// getArgs are the arguments of the get subcommand.
+type getArgs struct {
+	uri, output string
+	opts        method.GetOptions
+}
+
+// parseGetArgs parses the arguments of the get subcommand, whose flags may
+// come before or after the URI.
+func parseGetArgs(args []string) (getArgs, error) {
+	var parsed getArgs
+	flags := flag.NewFlagSet("get", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.StringVar(&parsed.output, "o", "", "file to write the object to, by default its name in the current directory")
+	flags.StringVar(&parsed.opts.Region, "region", "", "AWS region, overriding Acquire::s3::region")
+	flags.StringVar(&parsed.opts.Endpoint, "endpoint", "", "S3 endpoint, overriding Acquire::s3::endpoint")
+	flags.StringVar(&parsed.opts.Role, "role", "", "IAM role to assume, overriding Acquire::s3::role")
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return getArgs{}, err
+	}
+	if len(positional) != 1 {
+		return getArgs{}, errGetUsage
+	}
+	parsed.uri = positional[0]
+	if parsed.output == "" {
+		parsed.output = objectName(parsed.uri)
+	}
+	return parsed, nil
+}
+
+// objectName returns the last element of the key the URI names, without any
+// query string that follows it.
+func objectName(uri string) string {
+	if parsed, err := url.Parse(uri); err == nil {
+		return path.Base(parsed.Path)
+	}
+	name, _, _ := strings.Cut(uri, "?")
+	return path.Base(name)
+}
+
+// parseInterspersed parses args with flags, which may come before, between or
+// after the positional arguments it returns.
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		if flags.NArg() == 0 {
+			return positional, nil
+		}
+		positional, args = append(positional, flags.Arg(0)), flags.Args()[1:]
+	}
+}
+
+// get runs the standalone fetch subcommand and returns the process exit code:
+// 0 on success, exitCodeNotFound if the object does not exist and 1 on any
+// other failure.
+func get(args []string) int {
+	parsed, err := parseGetArgs(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "usage: %s get s3://bucket/path/to/key [-o file] [--region region] "+
+			"[--endpoint url] [--role arn]\n", version.Name)
+		return exitCodeUsage
+	}
+	return getExitCode(method.Get(os.Stdout, parsed.uri, parsed.output, parsed.opts))
+}
+
+// getExitCode maps the error of method.Get to the exit code of the get
+// subcommand, reporting it on stderr.
+func getExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "get: %v\n", err)
+	if errors.Is(err, fetcher.ErrNotFound) || errors.Is(err, fetcher.ErrBucketNotFound) {
+		return exitCodeNotFound
+	}
+	return 1
+}
+
+// publishArgs are the arguments of the publish subcommand.
+type publishArgs struct {
+	source, uri string
+	opts        publish.Options
+}
+
+// parsePublishArgs parses the arguments of the publish subcommand, whose flags
+// may come before, between or after the source and the URI.
+func parsePublishArgs(args []string) (publishArgs, error) {
+	var parsed publishArgs
+	flags := flag.NewFlagSet("publish", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.StringVar(&parsed.opts.Dist, "dist", "stable", "distribution to publish to")
+	flags.StringVar(&parsed.opts.Component, "component", "main", "component to publish to")
+	flags.BoolVar(&parsed.opts.Release, "release", false, "regenerate the Release file of the distribution")
+	flags.StringVar(&parsed.opts.Region, "region", "", "AWS region")
+	flags.StringVar(&parsed.opts.Endpoint, "endpoint", "", "S3 endpoint")
+	flags.StringVar(&parsed.opts.Role, "role", "", "IAM role to assume")
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return publishArgs{}, err
+	}
+	if len(positional) != 2 {
+		return publishArgs{}, errPublishUsage
+	}
+	parsed.source, parsed.uri = positional[0], positional[1]
+	return parsed, nil
+}
+
+// runPublish runs the publish subcommand and returns the process exit code.
+func runPublish(args []string) int {
+	parsed, err := parsePublishArgs(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "usage: %s publish <file.deb|directory> s3://bucket/prefix [--dist stable] [--component main] "+
+			"[--release] [--region region] [--endpoint url] [--role arn]\n", version.Name)
+		return exitCodeUsage
+	}
+	if err := publish.Publish(context.Background(), os.Stdout, parsed.source, parsed.uri, parsed.opts); err != nil {
+		fmt.Fprintf(os.Stderr, "publish: %v\n", err)
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,249 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/google/apt-golang-s3/fetcher"
+	"github.com/google/apt-golang-s3/internal/testutil"
+	"github.com/google/apt-golang-s3/method"
+	"github.com/google/apt-golang-s3/publish"
+)
+
+func TestAliasOptions(t *testing.T) {
+	specs := map[string]method.Options{
+		"s3":            {},
+		"s3+http":       {Scheme: "s3+http", DisableSSL: true},
+		"s3+accel":      {Scheme: "s3+accel", Accelerate: true},
+		"apt-golang-s3": {},
+		"s3+ftp":        {},
+	}
+	for name, expected := range specs {
+		t.Run(name, func(t *testing.T) {
+			if diff := cmp.Diff(expected, aliasOptions(name)); diff != "" {
+				t.Errorf("aliasOptions(%q) mismatch (-want +got):\n%s", name, diff)
+			}
+		})
+	}
+}
+
+func TestRunAsAlias(t *testing.T) {
+	specs := map[string]struct {
+		expectedDisableSSL bool
+		expectedAccelerate bool
+	}{
+		"s3":       {false, false},
+		"s3+http":  {true, false},
+		"s3+accel": {false, true},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			fake := testutil.NewFakeS3()
+			fake.Put("apt-repo-bucket", "pool/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+			var cfg fetcher.ClientConfig
+			uri := name + "://apt-repo-bucket/pool/hello.deb"
+			out := &bytes.Buffer{}
+			opts := aliasOptions(name)
+			opts.Input = strings.NewReader("601 Configuration\nConfig-Item: Acquire::s3::region=us-east-1\n\n" +
+				"600 URI Acquire\nURI: " + uri + "\nFilename: " + filepath.Join(t.TempDir(), "hello.deb") + "\n\n")
+			opts.Output = out
+			opts.S3ClientFactory = func(c fetcher.ClientConfig) (s3iface.S3API, error) {
+				cfg = c
+				return fake, nil
+			}
+
+			errc := make(chan error, 1)
+			go func() { errc <- method.NewWithOptions(opts).Run() }()
+			select {
+			case err := <-errc:
+				if err != nil {
+					t.Fatalf("Run() = %v; expected nil", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Run() did not return after all messages were processed")
+			}
+
+			if expected := "201 URI Done\nURI: " + uri + "\n"; !strings.Contains(out.String(), expected) {
+				t.Errorf("output = %q; expected it to contain %q", out, expected)
+			}
+			if cfg.DisableSSL != spec.expectedDisableSSL || cfg.Accelerate != spec.expectedAccelerate {
+				t.Errorf("ClientConfig has DisableSSL %t, Accelerate %t; expected %t, %t",
+					cfg.DisableSSL, cfg.Accelerate, spec.expectedDisableSSL, spec.expectedAccelerate)
+			}
+		})
+	}
+}
+
+func TestParseGetArgs(t *testing.T) {
+	specs := map[string]struct {
+		args     []string
+		expected getArgs
+		err      bool
+	}{
+		"flags after the URI": {
+			[]string{"s3://apt-repo-bucket/pool/hello.deb", "-o", "./file", "--region", "eu-west-1"},
+			getArgs{uri: "s3://apt-repo-bucket/pool/hello.deb", output: "./file", opts: method.GetOptions{Region: "eu-west-1"}},
+			false,
+		},
+		"flags before the URI": {
+			[]string{"--endpoint", "https://minio.example.com", "--role", "arn:aws:iam::123456789012:role/apt",
+				"s3://apt-repo-bucket/pool/hello.deb"},
+			getArgs{uri: "s3://apt-repo-bucket/pool/hello.deb", output: "hello.deb", opts: method.GetOptions{
+				Endpoint: "https://minio.example.com", Role: "arn:aws:iam::123456789012:role/apt",
+			}},
+			false,
+		},
+		"query string": {
+			[]string{"s3://apt-repo-bucket/pool/hello.deb?region=eu-west-1"},
+			getArgs{uri: "s3://apt-repo-bucket/pool/hello.deb?region=eu-west-1", output: "hello.deb"},
+			false,
+		},
+		"no URI":       {[]string{"-o", "./file"}, getArgs{}, true},
+		"two URIs":     {[]string{"s3://a/b", "s3://a/c"}, getArgs{}, true},
+		"unknown flag": {[]string{"--bucket", "a", "s3://a/b"}, getArgs{}, true},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			actual, err := parseGetArgs(spec.args)
+			if (err != nil) != spec.err {
+				t.Fatalf("parseGetArgs(%q) returned error %v; expected an error: %t", spec.args, err, spec.err)
+			}
+			if diff := cmp.Diff(spec.expected, actual, cmp.AllowUnexported(getArgs{})); diff != "" {
+				t.Errorf("parseGetArgs(%q) mismatch (-want +got):\n%s", spec.args, diff)
+			}
+		})
+	}
+}
+
+func TestParsePublishArgs(t *testing.T) {
+	specs := map[string]struct {
+		args     []string
+		expected publishArgs
+		err      bool
+	}{
+		"defaults": {
+			[]string{"./debs", "s3://apt-repo-bucket/repo"},
+			publishArgs{source: "./debs", uri: "s3://apt-repo-bucket/repo", opts: publish.Options{Dist: "stable", Component: "main"}},
+			false,
+		},
+		"interspersed flags": {
+			[]string{"--dist", "jammy", "hello.deb", "--release", "s3://apt-repo-bucket", "--component", "contrib"},
+			publishArgs{source: "hello.deb", uri: "s3://apt-repo-bucket", opts: publish.Options{
+				Dist: "jammy", Component: "contrib", Release: true,
+			}},
+			false,
+		},
+		"no URI":   {[]string{"hello.deb"}, publishArgs{}, true},
+		"too many": {[]string{"a.deb", "b.deb", "s3://a/b"}, publishArgs{}, true},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			actual, err := parsePublishArgs(spec.args)
+			if (err != nil) != spec.err {
+				t.Fatalf("parsePublishArgs(%q) returned error %v; expected an error: %t", spec.args, err, spec.err)
+			}
+			if diff := cmp.Diff(spec.expected, actual, cmp.AllowUnexported(publishArgs{})); diff != "" {
+				t.Errorf("parsePublishArgs(%q) mismatch (-want +got):\n%s", spec.args, diff)
+			}
+		})
+	}
+}
+
+func TestGetExitCode(t *testing.T) {
+	specs := map[string]struct {
+		err      error
+		expected int
+	}{
+		"success":          {nil, 0},
+		"key not found":    {fmt.Errorf("%w: bucket b, key k", fetcher.ErrNotFound), exitCodeNotFound},
+		"bucket not found": {fmt.Errorf("%w: b", fetcher.ErrBucketNotFound), exitCodeNotFound},
+		"other failure":    {errors.New("access denied"), 1},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			if actual := getExitCode(spec.err); actual != spec.expected {
+				t.Errorf("getExitCode(%v) = %d; expected %d", spec.err, actual, spec.expected)
+			}
+		})
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	specs := map[string]struct {
+		args     []string
+		expected mainFlags
+		err      bool
+	}{
+		"none, as apt runs it": {nil, mainFlags{}, false},
+		"version":              {[]string{"--version"}, mainFlags{version: true, args: []string{}}, false},
+		"log level":            {[]string{"--log-level=debug"}, mainFlags{logLevel: method.LogLevelDebug, args: []string{}}, false},
+		"log level and subcommand": {
+			[]string{"-log-level", "warn", "doctor", "s3://a/b"},
+			mainFlags{logLevel: method.LogLevelWarn, args: []string{"doctor", "s3://a/b"}},
+			false,
+		},
+		"stdin":             {[]string{"--stdin"}, mainFlags{stdin: true, args: []string{}}, false},
+		"unknown log level": {[]string{"--log-level=trace"}, mainFlags{}, true},
+		"unknown flag":      {[]string{"--verbose"}, mainFlags{}, true},
+		"config file": {
+			[]string{"--config-file", "/etc/image-build/s3.items"},
+			mainFlags{configFile: "/etc/image-build/s3.items", args: []string{}},
+			false,
+		},
+		"transcript": {
+			[]string{"--transcript", "/tmp/apt-s3.transcript"},
+			mainFlags{transcript: "/tmp/apt-s3.transcript", args: []string{}},
+			false,
+		},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			actual, err := parseFlags(spec.args, io.Discard)
+			if (err != nil) != spec.err {
+				t.Fatalf("parseFlags(%q) returned error %v; expected an error: %t", spec.args, err, spec.err)
+			}
+			if diff := cmp.Diff(spec.expected, actual, cmp.AllowUnexported(mainFlags{})); diff != "" {
+				t.Errorf("parseFlags(%q) mismatch (-want +got):\n%s", spec.args, diff)
+			}
+		})
+	}
+}
+
+func TestParseFlagsHelp(t *testing.T) {
+	out := &bytes.Buffer{}
+
+	parsed, err := parseFlags([]string{"--help"}, out)
+
+	if err != nil || !parsed.help {
+		t.Fatalf("parseFlags(--help) = %+v, %v; expected help to be requested", parsed, err)
+	}
+	for _, expected := range []string{"is an apt method", "publish <file.deb|directory>", "-log-level"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("usage = %q; expected it to contain %q", out, expected)
+		}
+	}
+}
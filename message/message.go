@@ -21,8 +21,10 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // Header models the first line of a message specified by the APT method
@@ -99,9 +101,74 @@ func (h *Header) String() string {
 }
 
 // String returns a string representation of a Field formatted according to the
-// APT method interface.
+// APT method interface. Lines longer than maxLineLength are folded at spaces
+// in the value.
 func (f *Field) String() string {
-	return fmt.Sprintf("%s: %s", f.Name, f.Value)
+	line := fmt.Sprintf("%s: %s", f.Name, f.Value)
+	if len(line) <= maxLineLength {
+		return line
+	}
+	return fold(line, len(f.Name)+len(": "))
+}
+
+// fold breaks line into lines of at most maxLineLength bytes where it can,
+// replacing a space in the value, which starts at valueStart, with a newline
+// and the space. Only spaces between two non-blank characters are folded at,
+// since unfolding joins the lines with a single space.
+func fold(line string, valueStart int) string {
+	folded := &strings.Builder{}
+	start, last := 0, -1
+	for idx := valueStart; idx < len(line); idx++ {
+		if idx-start > maxLineLength && last > start {
+			folded.WriteString(line[start:last])
+			folded.WriteString("\n")
+			start = last
+		}
+		if line[idx] == ' ' && idx+1 < len(line) && !isBlank(line[idx-1]) && !isBlank(line[idx+1]) {
+			last = idx
+		}
+	}
+	folded.WriteString(line[start:])
+	return folded.String()
+}
+
+func isBlank(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+// A Writer writes Messages to an underlying io.Writer, terminating each with a
+// blank line as required by the APT method interface. Every Message is written
+// with a single call to the underlying io.Writer while holding a lock, so
+// Messages written from concurrent goroutines are never interleaved.
+type Writer struct {
+	mu  sync.Mutex
+	w   io.Writer
+	tap func(*Message)
+}
+
+// NewWriter returns a Writer that writes Messages to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Write writes the given Message followed by a blank line.
+func (w *Writer) Write(msg *Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := io.WriteString(w.w, msg.String()+"\n")
+	if err == nil && w.tap != nil {
+		w.tap(msg)
+	}
+	return err
+}
+
+// SetTap makes the Writer call tap with every Message it wrote successfully.
+// tap is called while the Writer holds its lock, so it sees the Messages in
+// the order they were written, and must not write to the Writer itself.
+func (w *Writer) SetTap(tap func(*Message)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.tap = tap
 }
 
 var (
@@ -110,6 +177,9 @@ var (
 
 const (
 	msgMinLineCount = 2
+	// maxLineLength is the length beyond which String folds the line of a
+	// Field.
+	maxLineLength = 1000
 )
 
 // parse splits a string message by line, and then constructs a Message from a
@@ -155,29 +225,33 @@ func parseHeader(line string) (*Header, error) {
 	return &Header{Status: statusCode, Description: strings.Join(descTkns, " ")}, nil
 }
 
+// parseFields constructs a Field from every line, except for lines starting
+// with a space or tab, which continue the value of the preceding Field. They
+// are joined onto it with a single space.
 func parseFields(lines []string) []*Field {
 	fields := []*Field{}
 	for _, l := range lines {
+		if len(fields) > 0 && l != "" && isBlank(l[0]) {
+			if continuation := strings.TrimSpace(l); continuation != "" {
+				last := fields[len(fields)-1]
+				last.Value = strings.TrimPrefix(last.Value+" "+continuation, " ")
+			}
+			continue
+		}
 		fields = append(fields, parseField(l))
 	}
 	return fields
 }
 
-// parseField splits a string field by colon and constructs a Field based on
-// the name and value.
+// parseField splits a string field at its first colon and constructs a Field
+// based on the name and value. Further colons belong to the value, which is
+// kept as it is apart from the surrounding white space.
 //
 // Lines might look like the following:
 //
 // URI:s3://my-s3-repository/project-a/dists/trusty/main/binary-amd64/Packages
 // Config-Item: Aptitude::Get-Root-Command=sudo:/usr/bin/sudo
 func parseField(line string) *Field {
-	tokens := strings.Split(strings.TrimSpace(line), ":")
-
-	// The line may have additional colons, so the value needs to be any tokens
-	// after the first joined with a colon.
-	valueTkns := make([]string, len(tokens[1:]))
-	for idx, valueTkn := range tokens[1:] {
-		valueTkns[idx] = strings.TrimSpace(valueTkn)
-	}
-	return &Field{Name: tokens[0], Value: strings.Join(valueTkns, ":")}
+	name, value, _ := strings.Cut(strings.TrimSpace(line), ":")
+	return &Field{Name: name, Value: strings.TrimSpace(value)}
 }
@@ -15,7 +15,14 @@
 package message
 
 import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 const (
@@ -181,3 +188,143 @@ func TestParseFieldsWithMissingSpaces(t *testing.T) {
 		t.Errorf("field.Value = %s; expected %s", field.Value, expectedVal)
 	}
 }
+
+func TestParseFieldsKeepsColonsInValues(t *testing.T) {
+	msg, err := FromBytes([]byte("400 URI Failure\nMessage: Bucket: apt-repo-bucket, Key: a:b\n"))
+	if err != nil {
+		t.Fatalf("FromBytes() returned unexpected error: %v", err)
+	}
+	expected := "Bucket: apt-repo-bucket, Key: a:b"
+	if value, _ := msg.GetFieldValue("Message"); value != expected {
+		t.Errorf("msg.GetFieldValue(\"Message\") = %q; expected %q", value, expected)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	hdr := &Header{Status: 700, Description: "Fake Description"}
+	fields := []*Field{
+		{Name: "Foo", Value: "bar"},
+		{Name: "Baz", Value: "false"},
+		{Name: "Filename", Value: "apt-transport.deb"},
+	}
+	msg := &Message{Header: hdr, Fields: fields}
+
+	buf := &bytes.Buffer{}
+	writer := NewWriter(buf)
+	count := 50
+	var wg sync.WaitGroup
+	for range count {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := writer.Write(msg); err != nil {
+				t.Errorf("writer.Write() returned unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	expected := strings.Repeat(fakeMsg+"\n", count)
+	if actual := buf.String(); actual != expected {
+		t.Errorf("concurrent writes produced %q; expected %d copies of %q", actual, count, fakeMsg+"\n")
+	}
+}
+
+func TestWriterTap(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writer := NewWriter(buf)
+	var tapped []string
+	writer.SetTap(func(msg *Message) {
+		// The Message was written by the time it is tapped.
+		tapped = append(tapped, fmt.Sprintf("%d after %d bytes", msg.Header.Status, buf.Len()))
+	})
+	for _, status := range []int{101, 102} {
+		if err := writer.Write(&Message{Header: &Header{Status: status, Description: "Fake"}}); err != nil {
+			t.Fatalf("writer.Write() returned unexpected error: %v", err)
+		}
+	}
+	expected := []string{"101 after 10 bytes", "102 after 20 bytes"}
+	if !slices.Equal(tapped, expected) {
+		t.Errorf("tapped %q; expected %q", tapped, expected)
+	}
+}
+
+func TestParseFoldedFields(t *testing.T) {
+	folded := "400 URI Failure\n" +
+		"URI: s3://apt-repo-bucket/apt/generic/hello.deb\n" +
+		"Message: The specified key does not exist.\n" +
+		" Bucket apt-repo-bucket,\n" +
+		"\tkey apt/generic/hello.deb\n" +
+		"Fail-Reason: NotFound\n"
+
+	msg, err := FromBytes([]byte(folded))
+	if err != nil {
+		t.Fatalf("FromBytes() returned unexpected error: %v", err)
+	}
+	if count, expected := len(msg.Fields), 3; count != expected {
+		t.Errorf("len(msg.Fields) = %d; expected %d", count, expected)
+	}
+	expected := "The specified key does not exist. Bucket apt-repo-bucket, key apt/generic/hello.deb"
+	if value, _ := msg.GetFieldValue("Message"); value != expected {
+		t.Errorf("msg.GetFieldValue(\"Message\") = %q; expected %q", value, expected)
+	}
+	if value, _ := msg.GetFieldValue("Fail-Reason"); value != "NotFound" {
+		t.Errorf("msg.GetFieldValue(\"Fail-Reason\") = %q; expected %q", value, "NotFound")
+	}
+}
+
+func TestFieldStringFoldsLongValues(t *testing.T) {
+	specs := map[string]string{
+		"words":         strings.Repeat("the quick brown fox jumps over the lazy dog ", 100) + "end",
+		"long word":     strings.Repeat("a", 2*maxLineLength) + " and " + strings.Repeat("b", 2*maxLineLength),
+		"double spaces": strings.Repeat("spaced  out\tand tabbed ", 200) + "end",
+		"short":         "fits on a line",
+		"no spaces":     strings.Repeat("x", 3*maxLineLength),
+		"short words":   strings.Repeat("y ", maxLineLength) + "z",
+	}
+	for name, value := range specs {
+		t.Run(name, func(t *testing.T) {
+			msg := &Message{Header: &Header{Status: 400, Description: "URI Failure"}, Fields: []*Field{{Name: "Message", Value: value}}}
+
+			text := msg.String()
+			for _, line := range strings.Split(text, "\n") {
+				if len(line) > maxLineLength && strings.Contains(strings.TrimSpace(strings.TrimPrefix(line, "Message: ")), " ") {
+					t.Errorf("String() has a line of %d bytes that could have been folded", len(line))
+				}
+			}
+			parsed, err := FromBytes([]byte(text))
+			if err != nil {
+				t.Fatalf("FromBytes() returned unexpected error: %v", err)
+			}
+			if len(parsed.Fields) != 1 || parsed.Fields[0].Value != value {
+				t.Errorf("FromBytes(String()) = %v; expected the value to round-trip", parsed.Fields)
+			}
+		})
+	}
+}
+
+// FuzzFromBytes checks that FromBytes does not panic and that serializing
+// what it parsed and parsing that again is a fixed point. The corpus in
+// testdata/fuzz/FuzzFromBytes is replayed by every go test run.
+func FuzzFromBytes(f *testing.F) {
+	for _, seed := range []string{fakeMsg, configMsg, acqMsg, acqMsgNoSpaces, "400 URI Failure\nMessage: a\n b\n\tc\n"} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := FromBytes(data)
+		if err != nil {
+			return
+		}
+		serialized := msg.String()
+		reparsed, err := FromBytes([]byte(serialized))
+		if err != nil {
+			t.Fatalf("FromBytes(%q) returned unexpected error: %v", serialized, err)
+		}
+		if diff := cmp.Diff(msg, reparsed); diff != "" {
+			t.Errorf("FromBytes(%q) differs from what it was serialized from (-parsed +reparsed):\n%s", serialized, diff)
+		}
+		if reserialized := reparsed.String(); reserialized != serialized {
+			t.Errorf("String() = %q after reparsing; expected %q", reserialized, serialized)
+		}
+	})
+}
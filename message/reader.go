@@ -0,0 +1,126 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// DefaultMaxSize is the default limit on the size of a message read by a
+	// Reader, in bytes. apt's largest messages, the 601 Configuration with its
+	// dump of the whole configuration, take a few hundred kilobytes.
+	DefaultMaxSize = 16 << 20
+	// DefaultMaxFields is the default limit on the number of fields of a
+	// message read by a Reader.
+	DefaultMaxFields = 100000
+)
+
+var (
+	// ErrTooLarge is returned by Reader.Read for a message exceeding the
+	// Reader's size limit.
+	ErrTooLarge = errors.New("message exceeds the size limit")
+	// ErrTooManyFields is returned by Reader.Read for a message exceeding the
+	// Reader's limit on the number of fields.
+	ErrTooManyFields = errors.New("message exceeds the limit on the number of fields")
+)
+
+// A Reader splits the messages read from an underlying io.Reader at the blank
+// lines terminating them. Messages exceeding its limits are skipped without
+// being buffered, so that a runaway sender cannot exhaust the memory of the
+// reading process.
+type Reader struct {
+	r         *bufio.Reader
+	maxSize   int64
+	maxFields int64
+}
+
+// NewReader returns a Reader reading messages from r with the DefaultMaxSize
+// and DefaultMaxFields limits.
+func NewReader(r io.Reader) *Reader {
+	reader := &Reader{r: bufio.NewReader(r)}
+	reader.SetLimits(DefaultMaxSize, DefaultMaxFields)
+	return reader
+}
+
+// SetLimits changes the limits on the size, in bytes, and the number of
+// fields of the messages read next.
+func (r *Reader) SetLimits(maxSize, maxFields int64) {
+	r.maxSize, r.maxFields = maxSize, maxFields
+}
+
+// Read returns the next message, including its terminating blank line. A
+// message exceeding the Reader's limits is skipped up to the next blank line,
+// and an error wrapping ErrTooLarge or ErrTooManyFields is returned instead;
+// reading can continue with the message after it. A message cut short by the
+// end of the input is dropped, and io.EOF is returned.
+func (r *Reader) Read() ([]byte, error) {
+	var (
+		buf      bytes.Buffer
+		lines    int64
+		limitErr error
+		// startsLine tells whether the next chunk starts a line, which
+		// chunks of lines longer than the bufio.Reader's buffer do not.
+		startsLine = true
+	)
+	for {
+		chunk, err := r.r.ReadSlice('\n')
+		if startsLine && len(chunk) > 0 && !isBlank(chunk[0]) && !isNewline(chunk) {
+			// Lines starting with blanks continue the value of a field, the
+			// others are the header and the fields.
+			lines++
+			if limitErr == nil && lines > r.maxFields+1 {
+				limitErr = fmt.Errorf("%w of %d", ErrTooManyFields, r.maxFields)
+				buf = bytes.Buffer{}
+			}
+		}
+		if limitErr == nil && int64(buf.Len()+len(chunk)) > r.maxSize {
+			limitErr = fmt.Errorf("%w of %d bytes", ErrTooLarge, r.maxSize)
+			buf = bytes.Buffer{}
+		}
+		if limitErr == nil {
+			buf.Write(chunk)
+		}
+		switch {
+		case errors.Is(err, bufio.ErrBufferFull):
+			startsLine = false
+			continue
+		case errors.Is(err, io.EOF) && limitErr != nil:
+			return nil, limitErr
+		case err != nil:
+			return nil, err
+		}
+		if startsLine && isNewline(chunk) {
+			if limitErr != nil {
+				return nil, limitErr
+			}
+			if lines > 0 {
+				return buf.Bytes(), nil
+			}
+			// Blank lines between messages are skipped.
+			buf.Reset()
+		}
+		startsLine = true
+	}
+}
+
+// isNewline tells whether line is nothing but a line ending.
+func isNewline(line []byte) bool {
+	return string(line) == "\n" || string(line) == "\r\n"
+}
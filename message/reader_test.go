@@ -0,0 +1,113 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import (
+	"errors"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestReaderSplitsMessages(t *testing.T) {
+	input := "\n" + fakeMsg + "\n\n" + acqMsg + "\n" + "600 URI Acquire\nURI: s3://cut/short\n"
+	reader := NewReader(strings.NewReader(input))
+
+	for _, expected := range []string{fakeMsg + "\n", acqMsg + "\n"} {
+		msg, err := reader.Read()
+		if err != nil {
+			t.Fatalf("Read() returned unexpected error: %v", err)
+		}
+		if string(msg) != expected {
+			t.Errorf("Read() = %q; expected %q", msg, expected)
+		}
+	}
+	if msg, err := reader.Read(); !errors.Is(err, io.EOF) {
+		t.Errorf("Read() = %q, %v; expected %v for the message cut short", msg, err, io.EOF)
+	}
+}
+
+func TestReaderLimits(t *testing.T) {
+	specs := map[string]struct {
+		oversized string
+		expected  error
+	}{
+		"size":             {"700 Fake\nFoo: " + strings.Repeat("bar ", 300) + "\n\n", ErrTooLarge},
+		"fields":           {"700 Fake\n" + strings.Repeat("Foo: bar\n", 11) + "\n", ErrTooManyFields},
+		"folded long line": {"700 Fake\nFoo: bar\n " + strings.Repeat("baz", 5000) + "\n\n", ErrTooLarge},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			folded := "700 Fake\nFoo: bar\n" + strings.Repeat(" baz\n", 20) + "\n"
+			reader := NewReader(strings.NewReader(spec.oversized + folded))
+			reader.SetLimits(1024, 10)
+
+			if _, err := reader.Read(); !errors.Is(err, spec.expected) {
+				t.Errorf("Read() returned error %v; expected %v", err, spec.expected)
+			}
+			// Continuation lines do not count as fields.
+			msg, err := reader.Read()
+			if err != nil || string(msg) != folded {
+				t.Errorf("Read() after the oversized message = %q, %v; expected %q", msg, err, folded)
+			}
+		})
+	}
+}
+
+// An endlessMessage is a message of size bytes, with fields of a kilobyte
+// each, that is generated as it is read.
+type endlessMessage struct {
+	size int
+	line string
+	pos  int
+}
+
+func (m *endlessMessage) Read(p []byte) (int, error) {
+	if m.size <= 0 {
+		return 0, io.EOF
+	}
+	n := 0
+	for n < len(p) && m.size > 0 {
+		copied := copy(p[n:min(len(p), n+m.size)], m.line[m.pos:])
+		n, m.size, m.pos = n+copied, m.size-copied, (m.pos+copied)%len(m.line)
+	}
+	return n, nil
+}
+
+func TestReaderBoundsMemory(t *testing.T) {
+	const size = 100 << 20
+	input := io.MultiReader(
+		strings.NewReader("700 Fake\n"),
+		&endlessMessage{size: size, line: "Foo: " + strings.Repeat("a", 1018) + "\n"},
+		strings.NewReader("\n"+fakeMsg+"\n"),
+	)
+	reader := NewReader(input)
+	reader.SetLimits(DefaultMaxSize, size)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := reader.Read()
+	runtime.ReadMemStats(&after)
+	if !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Read() of a %d byte message returned error %v; expected %v", size, err, ErrTooLarge)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; !raceEnabled && allocated > 4*DefaultMaxSize {
+		t.Errorf("Read() allocated %d bytes for a %d byte message; expected at most %d", allocated, size, 4*DefaultMaxSize)
+	}
+	if msg, err := reader.Read(); err != nil || string(msg) != fakeMsg+"\n" {
+		t.Errorf("Read() after the oversized message = %q, %v; expected %q", msg, err, fakeMsg+"\n")
+	}
+}
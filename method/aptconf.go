@@ -0,0 +1,178 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+var errAptConfSyntax = errors.New("syntax error")
+
+// An aptConfLexer splits configuration in the syntax of apt.conf into
+// tokens: names and unquoted values, quoted values, and the punctuation
+// characters {, } and ;.
+type aptConfLexer struct {
+	input string
+	line  int
+}
+
+// next returns the next token and whether it was quoted, or io.EOF at the end
+// of the input.
+func (lex *aptConfLexer) next() (string, bool, error) {
+	for {
+		lex.skipSpace()
+		switch {
+		case lex.input == "":
+			return "", false, io.EOF
+		case strings.HasPrefix(lex.input, "//"):
+			lex.skipLine()
+		case strings.HasPrefix(lex.input, "/*"):
+			end := strings.Index(lex.input, "*/")
+			if end < 0 {
+				return "", false, fmt.Errorf("%w on line %d: unterminated comment", errAptConfSyntax, lex.line)
+			}
+			lex.line += strings.Count(lex.input[:end], "\n")
+			lex.input = lex.input[end+2:]
+		case strings.HasPrefix(lex.input, "#include"), strings.HasPrefix(lex.input, "#clear"):
+			return "", false, fmt.Errorf("%w on line %d: directives are not supported", errAptConfSyntax, lex.line)
+		case lex.input[0] == '#':
+			lex.skipLine()
+		case lex.input[0] == '"':
+			end := strings.IndexByte(lex.input[1:], '"')
+			if end < 0 || strings.Contains(lex.input[1:end+1], "\n") {
+				return "", false, fmt.Errorf("%w on line %d: unterminated quote", errAptConfSyntax, lex.line)
+			}
+			token := lex.input[1 : end+1]
+			lex.input = lex.input[end+2:]
+			return token, true, nil
+		case strings.ContainsRune("{};", rune(lex.input[0])):
+			token := lex.input[:1]
+			lex.input = lex.input[1:]
+			return token, false, nil
+		default:
+			end := strings.IndexFunc(lex.input, func(r rune) bool {
+				return unicode.IsSpace(r) || strings.ContainsRune(`{};"`, r)
+			})
+			if end < 0 {
+				end = len(lex.input)
+			}
+			token := lex.input[:end]
+			lex.input = lex.input[end:]
+			return token, false, nil
+		}
+	}
+}
+
+func (lex *aptConfLexer) skipSpace() {
+	trimmed := strings.TrimLeftFunc(lex.input, unicode.IsSpace)
+	lex.line += strings.Count(lex.input[:len(lex.input)-len(trimmed)], "\n")
+	lex.input = trimmed
+}
+
+func (lex *aptConfLexer) skipLine() {
+	if end := strings.IndexByte(lex.input, '\n'); end >= 0 {
+		lex.input = lex.input[end:]
+	} else {
+		lex.input = ""
+	}
+}
+
+// parseAptConf parses configuration in the syntax of apt.conf, which the
+// output of `apt-config dump` has as well, into "name=value" items in the
+// order they appear. Scopes are flattened into the names, and each value of
+// a list is an item whose name ends in "::", like apt sends them to methods.
+// The #include and #clear directives are not supported.
+//
+// The input might look like the following:
+//
+//	Acquire::s3::region "us-west-2";
+//	Acquire::s3 {
+//	  fallback-endpoint { "https://replica.internal"; };
+//	};
+func parseAptConf(r io.Reader) ([]string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	lex := &aptConfLexer{input: string(data), line: 1}
+	var (
+		items  []string
+		scopes []string
+	)
+	scoped := func(name string) string {
+		return strings.Join(append(slices.Clone(scopes), name), "::")
+	}
+	for {
+		token, quoted, err := lex.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case token == ";" && !quoted:
+		case token == "}" && !quoted:
+			if len(scopes) == 0 {
+				return nil, fmt.Errorf("%w on line %d: unbalanced }", errAptConfSyntax, lex.line)
+			}
+			scopes = scopes[:len(scopes)-1]
+		case token == "{" && !quoted:
+			return nil, fmt.Errorf("%w on line %d: { without a name", errAptConfSyntax, lex.line)
+		case quoted:
+			// A value without a name is an element of the enclosing list.
+			items = append(items, scoped("")+"="+token)
+			if err := lex.expect(";"); err != nil {
+				return nil, err
+			}
+		default:
+			next, nextQuoted, err := lex.next()
+			if err != nil {
+				return nil, fmt.Errorf("%w on line %d: %s has no value", errAptConfSyntax, lex.line, token)
+			}
+			switch {
+			case next == "{" && !nextQuoted:
+				scopes = append(scopes, token)
+			case next == ";" && !nextQuoted:
+				items = append(items, scoped(token)+"=")
+			case next == "}" && !nextQuoted:
+				return nil, fmt.Errorf("%w on line %d: %s has no value", errAptConfSyntax, lex.line, token)
+			default:
+				items = append(items, scoped(token)+"="+next)
+				if err := lex.expect(";"); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if len(scopes) > 0 {
+		return nil, fmt.Errorf("%w: %s is not closed", errAptConfSyntax, strings.Join(scopes, "::"))
+	}
+	return items, nil
+}
+
+// expect consumes the next token, which must be the given punctuation.
+func (lex *aptConfLexer) expect(punctuation string) error {
+	token, quoted, err := lex.next()
+	if err != nil || quoted || token != punctuation {
+		return fmt.Errorf("%w on line %d: expected %s", errAptConfSyntax, lex.line, punctuation)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseAptConf(t *testing.T) {
+	input := `// Generated by the provisioning scripts.
+Acquire::s3::region "us-west-2";
+/* A block
+   comment. */
+Acquire::s3 {
+  endpoint "https://gateway.internal";
+  fallback-endpoint { "https://replica.internal"; "https://s3.us-east-1.amazonaws.com"; };
+  alias::apt-repo "my-bucket";
+};
+# An old-style comment.
+Acquire::s3::fsync true;
+Dir::Etc "";
+`
+	actual, err := parseAptConf(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("parseAptConf() returned unexpected error: %v", err)
+	}
+	expected := []string{
+		"Acquire::s3::region=us-west-2",
+		"Acquire::s3::endpoint=https://gateway.internal",
+		"Acquire::s3::fallback-endpoint::=https://replica.internal",
+		"Acquire::s3::fallback-endpoint::=https://s3.us-east-1.amazonaws.com",
+		"Acquire::s3::alias::apt-repo=my-bucket",
+		"Acquire::s3::fsync=true",
+		"Dir::Etc=",
+	}
+	if diff := cmp.Diff(expected, actual); diff != "" {
+		t.Errorf("parseAptConf() mismatch (-want +got):\n%s", diff)
+	}
+
+	dumped, err := parseAptConf(strings.NewReader(aptConfigDump))
+	if err != nil {
+		t.Fatalf("parseAptConf() returned unexpected error for apt-config dump output: %v", err)
+	}
+	if len(dumped) != 8 || dumped[4] != "Acquire::s3::region=eu-west-1" {
+		t.Errorf("parseAptConf() = %q; expected the items of the apt-config dump output", dumped)
+	}
+}
+
+func TestParseAptConfSyntaxErrors(t *testing.T) {
+	specs := map[string]string{
+		"missing semicolon": "Acquire::s3::region \"us-west-2\"\nAcquire::s3::fsync \"true\";",
+		"unclosed scope":    "Acquire::s3 {\n  region \"us-west-2\";\n",
+		"unbalanced brace":  "};",
+		"unterminated":      "Acquire::s3::region \"us-west-2;\n",
+		"include":           "#include \"/etc/apt/other.conf\";",
+	}
+	for name, input := range specs {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseAptConf(strings.NewReader(input)); !errors.Is(err, errAptConfSyntax) {
+				t.Errorf("parseAptConf(%q) returned %v; expected %v", input, err, errAptConfSyntax)
+			}
+		})
+	}
+}
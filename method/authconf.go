@@ -0,0 +1,72 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"path/filepath"
+
+	"github.com/google/apt-golang-s3/fetcher"
+)
+
+const (
+	configItemDir              = "Dir"
+	configItemDirEtc           = "Dir::Etc"
+	configItemDirEtcNetrc      = "Dir::Etc::netrc"
+	configItemDirEtcNetrcParts = "Dir::Etc::netrcparts"
+)
+
+// aptDirs holds the apt directory settings that locate auth.conf, with apt's
+// defaults.
+type aptDirs struct {
+	dir, etc, netrc, netrcParts string
+}
+
+func defaultAptDirs() aptDirs {
+	return aptDirs{dir: "/", etc: "etc/apt/", netrc: "auth.conf", netrcParts: "auth.conf.d"}
+}
+
+// authConf returns the paths of the auth.conf file and of the directory of
+// auth.conf parts.
+func (dirs aptDirs) authConf() (string, string) {
+	etc := aptPath(dirs.dir, dirs.etc)
+	return aptPath(etc, dirs.netrc), aptPath(etc, dirs.netrcParts)
+}
+
+// aptPath joins nested directory settings the way apt resolves them: each
+// value is relative to the ones before it, unless it is absolute.
+func aptPath(values ...string) string {
+	path := ""
+	for _, value := range values {
+		if filepath.IsAbs(value) {
+			path = value
+			continue
+		}
+		path = filepath.Join(path, value)
+	}
+	return path
+}
+
+// loadAuthConf reads the credentials in apt's auth.conf, which are used for
+// URIs that do not embed any. Since the Method usually runs unprivileged, a
+// file it cannot read is only reported in the debug output.
+func (method *Method) loadAuthConf() {
+	path, partsDir := method.dirs.authConf()
+	entries, err := fetcher.LoadAuthConf(path, partsDir)
+	if err != nil {
+		method.debugf("Ignoring auth.conf: %v", err)
+		return
+	}
+	method.authEntries = entries
+}
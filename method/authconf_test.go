@@ -0,0 +1,63 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAptPath(t *testing.T) {
+	specs := map[string]struct {
+		values   []string
+		expected string
+	}{
+		"defaults":          {[]string{"/", "etc/apt/", "auth.conf"}, "/etc/apt/auth.conf"},
+		"relative root":     {[]string{"/srv/chroot", "etc/apt/", "auth.conf"}, "/srv/chroot/etc/apt/auth.conf"},
+		"absolute etc":      {[]string{"/", "/opt/apt/etc", "auth.conf"}, "/opt/apt/etc/auth.conf"},
+		"absolute filename": {[]string{"/", "etc/apt/", "/root/auth.conf"}, "/root/auth.conf"},
+	}
+
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			if actual := aptPath(spec.values...); actual != spec.expected {
+				t.Errorf("aptPath(%q) = %s; expected %s", spec.values, actual, spec.expected)
+			}
+		})
+	}
+}
+
+func TestConfigureLoadsAuthConf(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "etc/apt"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	conf := "machine s3.amazonaws.com/apt-repo-bucket login AKIDEXAMPLE password secret\n"
+	if err := os.WriteFile(filepath.Join(root, "etc/apt/auth.conf"), []byte(conf), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := strings.NewReader("601 Configuration\nConfig-Item: Dir=" + root + "\n\n")
+	method := New(logger(t))
+	go method.readInput(t.Context(), reader)
+	method.handleBytes(context.Background(), <-method.msgChan)
+
+	if len(method.authEntries) != 1 || method.authEntries[0].Login != "AKIDEXAMPLE" {
+		t.Errorf("method.authEntries = %+v; expected the entry from %s", method.authEntries, root)
+	}
+}
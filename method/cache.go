@@ -0,0 +1,43 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"github.com/google/apt-golang-s3/fetcher"
+)
+
+const (
+	configItemAcquireS3CacheDir     = "Acquire::s3::CacheDir"
+	configItemAcquireS3CacheMaxSize = "Acquire::s3::CacheMaxSize"
+)
+
+// openCache opens the cache configured with Acquire::s3::CacheDir, if any. A
+// cache directory the Method cannot write to is only reported in the debug
+// output, and objects are then always downloaded.
+func (method *Method) openCache() {
+	if method.cacheDir == "" {
+		return
+	}
+	maxSize := method.cacheMaxSize
+	if maxSize <= 0 {
+		maxSize = fetcher.DefaultCacheMaxSize
+	}
+	cache, err := fetcher.OpenCache(method.cacheDir, maxSize, method.clock)
+	if err != nil {
+		method.debugf("Ignoring cache: %v", err)
+		return
+	}
+	method.cache = cache
+}
@@ -0,0 +1,78 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+	"github.com/google/apt-golang-s3/message"
+)
+
+func TestConfigureOpensCache(t *testing.T) {
+	cacheDir := filepath.Join(t.TempDir(), "cache")
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "dists/stable/Release", testutil.FakeObject{Body: []byte("Suite: stable"), ETag: `"v1"`})
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0), WithS3ClientFactory(fakeFactory(fake)))
+	method.configure(&message.Message{Fields: []*message.Field{
+		field(fieldNameConfigItem, "Acquire::s3::CacheDir="+cacheDir),
+		field(fieldNameConfigItem, "Debug::Acquire::s3=true"),
+	}})
+
+	for _, name := range []string{"Release", "Release.again"} {
+		method.acquire(context.Background(), &message.Message{
+			Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+			Fields: []*message.Field{
+				field(fieldNameURI, "s3://apt-repo-bucket/dists/stable/Release"),
+				field(fieldNameFilename, filepath.Join(t.TempDir(), name)),
+			},
+		})
+	}
+
+	if gets := fake.Gets(); gets != 1 {
+		t.Errorf("GetObject called %d times; expected once", gets)
+	}
+	expected := "Message: Copied s3://apt-repo-bucket/dists/stable/Release from the cache, unchanged at https://s3.amazonaws.com\n"
+	if output := out.String(); !strings.Contains(output, expected) {
+		t.Errorf("output = %q; expected it to contain %q", output, expected)
+	}
+}
+
+func TestConfigureIgnoresUnwritableCache(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0))
+	method.configure(&message.Message{Fields: []*message.Field{
+		field(fieldNameConfigItem, "Acquire::s3::CacheDir="+filepath.Join(file, "cache")),
+		field(fieldNameConfigItem, "Debug::Acquire::s3=true"),
+	}})
+
+	if method.cache != nil {
+		t.Errorf("method.cache = %v; expected none", method.cache)
+	}
+	if output := out.String(); !strings.Contains(output, "Message: Ignoring cache: ") {
+		t.Errorf("output = %q; expected it to report the ignored cache", output)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var errInvalidConfig = errors.New("the configuration has unknown or invalid items")
+
+// CheckConfig validates the Acquire::s3 configuration items against what the
+// method understands. The items are read from `apt-config dump`, or from the
+// file at from, in the syntax of apt.conf, when it is not empty. The
+// effective configuration is written to out, with the passwords of URLs
+// redacted, followed by a line for each unknown or invalid item, suggesting
+// the item that was likely meant. An error wrapping errInvalidConfig is
+// returned when there is any.
+func CheckConfig(out io.Writer, from string) error {
+	items, err := readConfigItems(from)
+	if err != nil {
+		return err
+	}
+	items = mergeConfigItems(items)
+	if len(items) == 0 {
+		fmt.Fprintln(out, "No Acquire::s3 configuration items found")
+		return nil
+	}
+
+	var problems []error
+	for _, item := range items {
+		name, value, _ := strings.Cut(item, "=")
+		fmt.Fprintf(out, "%s %q;\n", name, redactConfigValue(value))
+		if err := validateConfigItem(name, value); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	for _, problem := range problems {
+		fmt.Fprintf(out, "[FAIL] %v\n", problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %d found", errInvalidConfig, len(problems))
+	}
+	return nil
+}
+
+// readConfigItems returns the Acquire::s3 configuration items of apt, or of
+// the apt.conf style file at from when it is not empty.
+func readConfigItems(from string) ([]string, error) {
+	if from == "" {
+		return aptConfigItems()
+	}
+	file, err := os.Open(from)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	items, err := parseAptConf(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", from, err)
+	}
+	var s3Items []string
+	for _, item := range items {
+		if name, _, _ := strings.Cut(item, "="); isS3ConfigItem(name) {
+			s3Items = append(s3Items, item)
+		}
+	}
+	return s3Items, nil
+}
+
+// mergeConfigItems returns the items as apt ends up sending them: a later
+// value of an item replaces the earlier one, while the values of lists
+// accumulate.
+func mergeConfigItems(items []string) []string {
+	var merged []string
+	positions := map[string]int{}
+	for _, item := range items {
+		name, _, _ := strings.Cut(item, "=")
+		if position, found := positions[name]; found && !strings.HasSuffix(name, "::") {
+			merged[position] = item
+			continue
+		}
+		positions[name] = len(merged)
+		merged = append(merged, item)
+	}
+	return merged
+}
+
+// redactConfigValue redacts the password of values that are URLs.
+func redactConfigValue(value string) string {
+	if parsed, err := url.Parse(value); err == nil && parsed.User != nil {
+		return parsed.Redacted()
+	}
+	return value
+}
@@ -0,0 +1,397 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/apt-golang-s3/fetcher"
+)
+
+var (
+	errNotBool     = errors.New("is not a boolean, such as true or false")
+	errNotCount    = errors.New("is not a non-negative integer")
+	errNotRate     = errors.New("is not a non-negative number")
+	errNotRegion   = errors.New("is not a region name, such as us-east-1")
+	errNotRoleARN  = errors.New("is not the ARN of an IAM role")
+	errNotURL      = errors.New("is not an http or https URL")
+	errNotFileMode = errors.New("is not an octal file mode, such as 0644")
+	errNotTLS      = errors.New("is not a TLS version, such as 1.2 or 1.3")
+	errNotEnum     = errors.New("is not one of")
+	errEmptyAlias  = errors.New("names no bucket")
+	errUnknownItem = errors.New("is not a configuration item of the method")
+	errNeedsItem   = errors.New("needs")
+	errConflicting = errors.New("cannot be combined with")
+)
+
+// A configItemSpec describes a configuration item the Method understands.
+// Its apply parses the value, and sets it on the Method unless it returns an
+// error, so that checking a value and applying it cannot disagree. Empty
+// values, which apt sends for items that only have children, are neither
+// checked nor applied.
+type configItemSpec struct {
+	apply func(method *Method, value string) error
+}
+
+// configItemSpecs are the configuration items the Method understands, by
+// name. They drive both configure and the check-config subcommand, so that
+// what is checked is what is applied. Items that take a list of values are
+// sent by apt once per value, with a name ending in "::", and are looked up
+// without that suffix. Bucket aliases, whose names carry the alias after
+// configItemAcquireS3AliasPrefix, and the endpoints of hosts, whose names
+// carry the host after configItemAcquireS3EndpointPrefix, are handled
+// separately.
+//
+//nolint:gochecknoglobals
+var configItemSpecs = map[string]configItemSpec{
+	configItemAcquireS3Region:             checkedItem(validateRegion, (*Method).setRegion),
+	configItemAcquireS3Role:               checkedItem(validateRoleARN, func(m *Method, v string) { m.roleARN = v }),
+	configItemAcquireS3RoleSourceIdentity: anyItem(func(m *Method, v string) { m.roleSourceIdentity = v }),
+	configItemAcquireS3STSEndpoint:        checkedItem(validateURL, func(m *Method, v string) { m.stsEndpoint = v }),
+	configItemAcquireS3Endpoint:           endpointItem(func(m *Method, v string) { m.endpoint = v }),
+	configItemAcquireS3FallbackEndpoint: endpointItem(func(m *Method, v string) {
+		m.fallbackEndpoints = append(m.fallbackEndpoints, v)
+	}),
+	configItemAcquireS3Fsync:             boolItem(func(m *Method, v bool) { m.fsync = v }),
+	configItemAcquireS3CacheDir:          anyItem(func(m *Method, v string) { m.cacheDir = v }),
+	configItemAcquireS3CacheMaxSize:      sizeItem(func(m *Method, v int64) { m.cacheMaxSize = v }),
+	configItemAcquireS3SharedCredsFile:   anyItem(func(m *Method, v string) { m.sharedCredentialsFile = v }),
+	configItemAcquireS3SharedConfigFile:  anyItem(func(m *Method, v string) { m.sharedConfigFile = v }),
+	configItemAcquireS3UserinfoIsProfile: boolItem(func(m *Method, v bool) { m.userAsProfile = v }),
+	configItemAcquireQueueMode:           checkedItem(validateOneOf(queueModeHost, "access"), func(m *Method, v string) { m.queueMode = v }),
+	configItemAcquireS3MaxParallel:       countItem(func(m *Method, v int) { m.maxParallel = v }),
+	configItemAcquireS3DisableIMDS:       boolItem(func(m *Method, v bool) { m.disableIMDS = v }),
+	configItemAcquireS3IMDSRegion:        boolItem(func(m *Method, v bool) { m.imdsRegion = v }),
+	configItemAcquireS3BatchHead:         boolItem(func(m *Method, v bool) { m.batchHead = v }),
+	configItemAcquireS3DecodeContent:     boolItem(func(m *Method, v bool) { m.decodeContent = v }),
+	configItemAcquireS3AllowHTML:         boolItem(func(m *Method, v bool) { m.allowHTML = v }),
+	configItemAcquireS3VerifyParts:       boolItem(func(m *Method, v bool) { m.verifyParts = v }),
+	configItemAcquireS3ListFallback:      boolItem(func(m *Method, v bool) { m.listFallback = v }),
+	configItemAcquireS3CSEKMSKeyID:       anyItem(func(m *Method, v string) { m.cseKMSKeyID = v }),
+	configItemAcquireS3Latest:            boolItem(func(m *Method, v bool) { m.latest = v }),
+	configItemAcquireS3Preallocate:       boolItem(func(m *Method, v bool) { m.disablePreallocate = !v }),
+	configItemAcquireS3Multipart:         boolItem(func(m *Method, v bool) { m.disableMultipart = !v }),
+	configItemAcquireSendURIEncoded:      boolItem(func(m *Method, v bool) { m.sendURIEncoded = v }),
+	configItemAcquireS3Strict:            boolItem(func(m *Method, v bool) { m.strict = v }),
+	configItemAcquireS3ReuseExisting:     boolItem(func(m *Method, v bool) { m.reuseExisting = v }),
+	configItemAcquireS3PartSize:          sizeItem(func(m *Method, v int64) { m.partSize = v }),
+	configItemAcquireS3Profile:           anyItem(func(m *Method, v string) { m.profilePath = v }),
+	configItemAcquireS3Trace:             anyItem(func(m *Method, v string) { m.tracePath = v }),
+	configItemAcquireS3Transcript:        anyItem(func(m *Method, v string) { m.transcriptPath = v }),
+	configItemAcquireS3StatsFile:         anyItem(func(m *Method, v string) { m.statsFile = v }),
+	configItemAcquireS3ThrottleAttempts:  countItem(func(m *Method, v int) { m.throttleAttempts = v }),
+	configItemAcquireS3ResumeAttempts:    countItem(func(m *Method, v int) { m.resumeAttempts = v }),
+	configItemAcquireS3GetEmptyObjects:   boolItem(func(m *Method, v bool) { m.getEmptyObjects = v }),
+	configItemAcquireS3MaxRequestRate:    rateItem(func(m *Method, v float64) { m.maxRequestRate = v }),
+	configItemAcquireS3SSLCert:           anyItem(func(m *Method, v string) { m.sslCert = v }),
+	configItemAcquireS3SSLKey:            anyItem(func(m *Method, v string) { m.sslKey = v }),
+	configItemAcquireS3FileMode:          {applyFileMode},
+	configItemAPTSandboxUser:             anyItem(func(m *Method, v string) { m.sandboxUser = v }),
+	configItemAcquireS3LogTarget: checkedItem(validateOneOf(logTargetStderr, logTargetSyslog), func(m *Method, v string) {
+		m.logTarget = v
+	}),
+	configItemAcquireS3Provider:           checkedItem(validateOneOf(providerNames()...), func(m *Method, v string) { m.provider = v }),
+	configItemAcquireS3Namespace:          anyItem(func(m *Method, v string) { m.namespace = v }),
+	configItemAcquireS3MaxMessageSize:     sizeItem(func(m *Method, v int64) { m.messageSizeLimit.Store(v) }),
+	configItemAcquireS3IdleTimeout:        countItem(func(m *Method, v int) { m.idleTimeout = time.Duration(v) * time.Second }),
+	configItemAcquireS3TLSMinVersion:      {applyTLSMinVersion},
+	configItemAcquireS3TLSRestrictCiphers: boolItem(func(m *Method, v bool) { m.tlsRestrictCiphers = v }),
+	configItemDebugAcquireS3:              boolItem(func(m *Method, v bool) { m.debug.Store(v) }),
+	configItemQuiet:                       countItem(func(m *Method, v int) { m.quiet = v }),
+	configItemAPTQuiet:                    countItem(func(m *Method, v int) { m.quiet = v }),
+	configItemDir:                         anyItem(func(m *Method, v string) { m.dirs.dir = v }),
+	configItemDirEtc:                      anyItem(func(m *Method, v string) { m.dirs.etc = v }),
+	configItemDirEtcNetrc:                 anyItem(func(m *Method, v string) { m.dirs.netrc = v }),
+	configItemDirEtcNetrcParts:            anyItem(func(m *Method, v string) { m.dirs.netrcParts = v }),
+}
+
+// validateConfigItem checks the name and value of a configuration item
+// against configItemSpecs, by applying it to a Method of its own.
+func validateConfigItem(name, value string) error {
+	return (&Method{}).applyConfigItem(name, value)
+}
+
+// applyConfigItem applies the configuration item of the given name and value
+// as configItemSpecs describes, and returns the error of a value that is not
+// applied as it is invalid. Unknown names, which are ignored, yield an error
+// wrapping errUnknownItem that suggests the closest known name, if any.
+func (method *Method) applyConfigItem(name, value string) error {
+	// apt sends each value of a list as an item whose name ends in "::".
+	name = strings.TrimSuffix(name, "::")
+	if alias, found := strings.CutPrefix(name, configItemAcquireS3AliasPrefix); found {
+		if alias != "" && value == "" {
+			return fmt.Errorf("%s %w", name, errEmptyAlias)
+		}
+		if alias != "" {
+			if method.bucketAliases == nil {
+				method.bucketAliases = map[string]string{}
+			}
+			method.bucketAliases[alias] = value
+		}
+		return nil
+	}
+	if host, found := strings.CutPrefix(name, configItemAcquireS3EndpointPrefix); found && host != "" {
+		if method.hostEndpoints == nil {
+			method.hostEndpoints = map[string]string{}
+		}
+		// Invalid endpoints are kept for validateEndpoints to fail the run.
+		method.hostEndpoints[host] = value
+		if err := fetcher.ValidateEndpoint(value); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		return nil
+	}
+	spec, found := configItemSpecs[name]
+	switch {
+	case !found && name == strings.TrimSuffix(configItemAcquireS3AliasPrefix, "::"):
+		// The parent of the aliases, which apt-config dump lists.
+		return nil
+	case !found && !isS3ConfigItem(name):
+		// Most of apt's configuration is for others, and not worth a suggestion.
+		return fmt.Errorf("%s %w", name, errUnknownItem)
+	case !found:
+		if suggestion := closestConfigItem(name); suggestion != "" {
+			return fmt.Errorf("%s %w, did you mean %s?", name, errUnknownItem, suggestion)
+		}
+		return fmt.Errorf("%s %w", name, errUnknownItem)
+	case value == "":
+		return nil
+	}
+	if err := spec.apply(method, value); err != nil {
+		return fmt.Errorf("%s: %q %w", name, value, err)
+	}
+	return nil
+}
+
+// anyItem returns the configItemSpec of an item that takes any value, which
+// set applies.
+func anyItem(set func(method *Method, value string)) configItemSpec {
+	return configItemSpec{func(method *Method, value string) error {
+		set(method, value)
+		return nil
+	}}
+}
+
+// checkedItem returns the configItemSpec of an item that takes the values
+// check accepts, which set applies.
+func checkedItem(check func(value string) error, set func(method *Method, value string)) configItemSpec {
+	return configItemSpec{func(method *Method, value string) error {
+		if err := check(value); err != nil {
+			return err
+		}
+		set(method, value)
+		return nil
+	}}
+}
+
+// endpointItem returns the configItemSpec of an item that takes an endpoint,
+// which set applies even if it is invalid, for validateEndpoints to fail the
+// run with.
+func endpointItem(set func(method *Method, value string)) configItemSpec {
+	return configItemSpec{func(method *Method, value string) error {
+		set(method, value)
+		return fetcher.ValidateEndpoint(value)
+	}}
+}
+
+// boolItem returns the configItemSpec of an item that takes a boolean, which
+// set applies.
+func boolItem(set func(method *Method, value bool)) configItemSpec {
+	return configItemSpec{func(method *Method, value string) error {
+		parsed, err := parseBool(value)
+		if err != nil {
+			return err
+		}
+		set(method, parsed)
+		return nil
+	}}
+}
+
+// countItem returns the configItemSpec of an item that takes a non-negative
+// integer, which set applies.
+func countItem(set func(method *Method, value int)) configItemSpec {
+	return configItemSpec{func(method *Method, value string) error {
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 0 {
+			return errNotCount
+		}
+		set(method, count)
+		return nil
+	}}
+}
+
+// sizeItem returns the configItemSpec of an item that takes a non-negative
+// number of bytes, which set applies.
+func sizeItem(set func(method *Method, value int64)) configItemSpec {
+	return configItemSpec{func(method *Method, value string) error {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size < 0 {
+			return errNotCount
+		}
+		set(method, size)
+		return nil
+	}}
+}
+
+// rateItem returns the configItemSpec of an item that takes a non-negative
+// number, which set applies.
+func rateItem(set func(method *Method, value float64)) configItemSpec {
+	return configItemSpec{func(method *Method, value string) error {
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 {
+			return errNotRate
+		}
+		set(method, rate)
+		return nil
+	}}
+}
+
+// applyFileMode applies the octal file mode of configItemAcquireS3FileMode.
+func applyFileMode(method *Method, value string) error {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > uint64(os.ModePerm) {
+		return errNotFileMode
+	}
+	method.fileMode = os.FileMode(mode)
+	return nil
+}
+
+// applyTLSMinVersion applies the TLS version of
+// configItemAcquireS3TLSMinVersion.
+func applyTLSMinVersion(method *Method, value string) error {
+	version, err := fetcher.ParseTLSVersion(value)
+	if err != nil {
+		return errNotTLS
+	}
+	method.tlsMinVersion = version
+	return nil
+}
+
+// configConflicts returns an error wrapping errNeedsItem or
+// errConflicting for each configured item that takes effect only with an
+// item that is not configured, or cannot take effect with one that is.
+func (method *Method) configConflicts() []error {
+	var conflicts []error
+	needs := func(configured bool, item string, needed bool, neededItem string) {
+		if configured && !needed {
+			conflicts = append(conflicts, fmt.Errorf("%s %w %s", item, errNeedsItem, neededItem))
+		}
+	}
+	needs(method.roleSourceIdentity != "", configItemAcquireS3RoleSourceIdentity, method.roleARN != "", configItemAcquireS3Role)
+	needs(method.sslKey != "", configItemAcquireS3SSLKey, method.sslCert != "", configItemAcquireS3SSLCert)
+	needs(method.cacheMaxSize > 0, configItemAcquireS3CacheMaxSize, method.cacheDir != "", configItemAcquireS3CacheDir)
+	if method.verifyParts && method.disableMultipart {
+		conflicts = append(conflicts, fmt.Errorf("%s %w %s false, as parts are only verified when downloaded in parts",
+			configItemAcquireS3VerifyParts, errConflicting, configItemAcquireS3Multipart))
+	}
+	return conflicts
+}
+
+// strictConfigError returns the error Acquire::s3::strict fails the run with,
+// which names every problem applyConfig found.
+func strictConfigError(problems []error) error {
+	descriptions := make([]string, len(problems))
+	for idx, problem := range problems {
+		descriptions[idx] = problem.Error()
+	}
+	return fmt.Errorf("%w, which %s refuses: %s", errInvalidConfig, configItemAcquireS3Strict, strings.Join(descriptions, "; "))
+}
+
+// closestConfigItem returns the known configuration item whose name is the
+// closest to name, ignoring case, or "" if none is close enough to be what
+// was meant.
+func closestConfigItem(name string) string {
+	// Allow for a typo or two, and more in long item names.
+	_, item, _ := strings.Cut(strings.ToLower(name), strings.ToLower(aptConfigS3Prefix))
+	best, bestDistance := "", max(2, len(item)/3)+1
+	for known := range configItemSpecs {
+		distance := editDistance(strings.ToLower(name), strings.ToLower(known))
+		if distance < bestDistance || (distance == bestDistance && best != "" && known < best) {
+			best, bestDistance = known, distance
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	previous, current := make([]int, len(b)+1), make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// parseBool parses the values apt interprets as booleans.
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "1", fieldValueTrue, fieldValueYes, "on", "enable":
+		return true, nil
+	case "0", "false", "no", "off", "disable":
+		return false, nil
+	default:
+		return false, errNotBool
+	}
+}
+
+func validateRegion(value string) error {
+	if !fetcher.ValidRegion(value) {
+		return errNotRegion
+	}
+	return nil
+}
+
+func validateRoleARN(value string) error {
+	if !fetcher.ValidRoleARN(value) {
+		return errNotRoleARN
+	}
+	return nil
+}
+
+func validateURL(value string) error {
+	parsed, err := url.Parse(value)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return errNotURL
+	}
+	return nil
+}
+
+// validateOneOf returns a validation function accepting the given values.
+func validateOneOf(values ...string) func(string) error {
+	return func(value string) error {
+		if !slices.Contains(values, value) {
+			return fmt.Errorf("%w %s", errNotEnum, strings.Join(values, ", "))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/google/apt-golang-s3/message"
+)
+
+func TestValidateConfigItem(t *testing.T) {
+	specs := map[string]struct {
+		item     string
+		expected string
+	}{
+		"valid region":         {"Acquire::s3::region=eu-west-1", ""},
+		"invalid region":       {"Acquire::s3::region=EU West", `Acquire::s3::region: "EU West" is not a region name`},
+		"empty value":          {"Acquire::s3::part-size=", ""},
+		"invalid size":         {"Acquire::s3::part-size=8MB", `"8MB" is not a non-negative integer`},
+		"invalid boolean":      {"Acquire::s3::fsync=maybe", `"maybe" is not a boolean`},
+		"false boolean":        {"Acquire::s3::preallocate=off", ""},
+		"invalid role":         {"Acquire::s3::role=s3-apt-reader", "is not the ARN of an IAM role"},
+		"list value":           {"Acquire::s3::fallback-endpoint::=https://replica.internal", ""},
+		"invalid endpoint":     {"Acquire::s3::endpoint=https://objects-{bucket}.internal", "Acquire::s3::endpoint"},
+		"invalid queue mode":   {"Acquire::Queue-Mode=any", `"any" is not one of host, access`},
+		"file mode":            {"Acquire::s3::FileMode=0640", ""},
+		"invalid file mode":    {"Acquire::s3::FileMode=0844", `"0844" is not an octal file mode`},
+		"tls version":          {"Acquire::s3::tls-min-version=1.3", ""},
+		"invalid tls version":  {"Acquire::s3::tls-min-version=TLSv1.2", `"TLSv1.2" is not a TLS version`},
+		"invalid log target":   {"Acquire::s3::LogTarget=journald", `"journald" is not one of stderr, syslog`},
+		"invalid provider":     {"Acquire::s3::provider=backblaze", `"backblaze" is not one of generic, oracle, scaleway, wasabi`},
+		"alias":                {"Acquire::s3::alias::apt-repo=my-bucket", ""},
+		"alias without bucket": {"Acquire::s3::alias::apt-repo=", "Acquire::s3::alias::apt-repo names no bucket"},
+		"host endpoint":        {"Acquire::s3::endpoint::minio.internal=https://minio.internal:9000/{bucket}", ""},
+		"invalid host endpoint": {
+			"Acquire::s3::endpoint::minio.internal=https://objects-{bucket}.internal",
+			"Acquire::s3::endpoint::minio.internal",
+		},
+		"misspelled": {
+			"Acquire::s3::regoin=eu-west-1",
+			"Acquire::s3::regoin is not a configuration item of the method, did you mean Acquire::s3::region?",
+		},
+		"wrong case": {"Acquire::S3::Region=eu-west-1", "did you mean Acquire::s3::region?"},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			itemName, value, _ := strings.Cut(spec.item, "=")
+			err := validateConfigItem(itemName, value)
+			switch {
+			case spec.expected == "" && err != nil:
+				t.Errorf("validateConfigItem(%q) returned unexpected error: %v", spec.item, err)
+			case spec.expected != "" && (err == nil || !strings.Contains(err.Error(), spec.expected)):
+				t.Errorf("validateConfigItem(%q) returned %v; expected an error containing %q", spec.item, err, spec.expected)
+			}
+		})
+	}
+}
+
+func TestClosestConfigItem(t *testing.T) {
+	specs := map[string]string{
+		"Acquire::s3::regoin":      configItemAcquireS3Region,
+		"Acquire::s3::max-paralel": configItemAcquireS3MaxParallel,
+		"Acquire::s3::cachedir":    configItemAcquireS3CacheDir,
+		"Acquire::s3::colour":      "",
+	}
+	for name, expected := range specs {
+		if actual := closestConfigItem(name); actual != expected {
+			t.Errorf("closestConfigItem(%q) = %q; expected %q", name, actual, expected)
+		}
+	}
+}
+
+func TestApplyConfigItemSuggestsOnlyS3Items(t *testing.T) {
+	err := (&Method{}).applyConfigItem("Acquire::s4::region", "eu-west-1")
+	if expected := "Acquire::s4::region is not a configuration item of the method"; err == nil || err.Error() != expected {
+		t.Errorf("applyConfigItem() returned %v; expected %q, without a suggestion", err, expected)
+	}
+}
+
+func TestConfigureWarnsAboutInvalidItems(t *testing.T) {
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0))
+	method.configure(&message.Message{Fields: []*message.Field{
+		field(fieldNameConfigItem, "Acquire::s3::part-size=8MB"),
+		field(fieldNameConfigItem, "Acquire::s3::regoin=eu-west-1"),
+		field(fieldNameConfigItem, "Acquire::http::Proxy=http://proxy.internal:3128"),
+	}})
+
+	expected := "104 Warning\nMessage: Invalid configuration item Acquire::s3::part-size: \"8MB\" is not a non-negative integer\n"
+	if !strings.Contains(out.String(), expected) {
+		t.Errorf("output = %q; expected it to contain %q", out, expected)
+	}
+	if strings.Contains(out.String(), "regoin") || strings.Contains(out.String(), "Proxy") {
+		t.Errorf("output = %q; expected no warning about items that are not invalid values", out)
+	}
+}
+
+func TestConfigureWarnsAboutConflictingItems(t *testing.T) {
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0))
+	method.configure(&message.Message{Fields: []*message.Field{
+		field(fieldNameConfigItem, "Acquire::s3::SslKey=/etc/apt/s3-client.key"),
+	}})
+
+	expected := "104 Warning\nMessage: Conflicting configuration items: Acquire::s3::SslKey needs Acquire::s3::SslCert\n"
+	if !strings.Contains(out.String(), expected) {
+		t.Errorf("output = %q; expected it to contain %q", out, expected)
+	}
+	select {
+	case <-method.configured:
+	default:
+		t.Error("configure() left the Method unconfigured; expected it to proceed")
+	}
+}
+
+func TestConfigureStrict(t *testing.T) {
+	const prefix = "the configuration has unknown or invalid items, which Acquire::s3::strict refuses: "
+	specs := map[string]struct {
+		items    []string
+		expected string
+	}{
+		"valid":                        {[]string{"Acquire::s3::region=eu-west-1", "Acquire::http::Proxy=http://proxy.internal:3128"}, ""},
+		"certificate bundling its key": {[]string{"Acquire::s3::SslCert=/etc/apt/s3-client.pem"}, ""},
+		"unknown item": {
+			[]string{"Acquire::s3::regoin=eu-west-1"},
+			"Acquire::s3::regoin is not a configuration item of the method, did you mean Acquire::s3::region?",
+		},
+		"invalid size":    {[]string{"Acquire::s3::part-size=8MB"}, `Acquire::s3::part-size: "8MB" is not a non-negative integer`},
+		"malformed role":  {[]string{"Acquire::s3::role=s3-apt-reader"}, `Acquire::s3::role: "s3-apt-reader" is not the ARN of an IAM role`},
+		"invalid boolean": {[]string{"Acquire::s3::fsync=maybe"}, `Acquire::s3::fsync: "maybe" is not a boolean, such as true or false`},
+		"source identity without role": {
+			[]string{"Acquire::s3::role-source-identity=ci-runner"},
+			"Acquire::s3::role-source-identity needs Acquire::s3::role",
+		},
+		"key without certificate": {[]string{"Acquire::s3::SslKey=/etc/apt/s3-client.key"}, "Acquire::s3::SslKey needs Acquire::s3::SslCert"},
+		"cache size without directory": {
+			[]string{"Acquire::s3::CacheMaxSize=1048576"},
+			"Acquire::s3::CacheMaxSize needs Acquire::s3::CacheDir",
+		},
+		"verified parts without multipart": {
+			[]string{"Acquire::s3::verify-parts=true", "Acquire::s3::multipart=false"},
+			"Acquire::s3::verify-parts cannot be combined with Acquire::s3::multipart false, as parts are only verified when downloaded in parts",
+		},
+		"every problem": {
+			[]string{"Acquire::s3::part-size=8MB", "Acquire::s3::regoin=eu-west-1", "Acquire::s3::SslKey=/etc/apt/s3-client.key"},
+			`Acquire::s3::part-size: "8MB" is not a non-negative integer; ` +
+				"Acquire::s3::regoin is not a configuration item of the method, did you mean Acquire::s3::region?; " +
+				"Acquire::s3::SslKey needs Acquire::s3::SslCert",
+		},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			method := New(log.New(out, "", 0))
+			msg := &message.Message{Fields: []*message.Field{field(fieldNameConfigItem, "Acquire::s3::strict=true")}}
+			for _, item := range spec.items {
+				msg.Fields = append(msg.Fields, field(fieldNameConfigItem, item))
+			}
+
+			method.configure(msg)
+
+			if spec.expected == "" {
+				select {
+				case err := <-method.fatalErr:
+					t.Fatalf("configure() aborted the Method: %v", err)
+				case <-method.configured:
+				}
+				return
+			}
+			select {
+			case err := <-method.fatalErr:
+				if err.Error() != prefix+spec.expected {
+					t.Errorf("configure() aborted the Method with %q; expected %q", err, prefix+spec.expected)
+				}
+			default:
+				t.Fatal("configure() did not abort the Method")
+			}
+			if expected := "401 General Failure\nMessage: " + prefix + spec.expected + "\n\n"; out.String() != expected {
+				t.Errorf("output = %q; expected %q", out, expected)
+			}
+			select {
+			case <-method.configured:
+				t.Error("configure() configured the Method; expected acquires to be left unprocessed")
+			default:
+			}
+		})
+	}
+}
+
+func TestApplyConfigItemLeavesInvalidValuesUnapplied(t *testing.T) {
+	method := New(logger(t))
+	for _, item := range []string{"Acquire::s3::Max-Parallel=4", "Acquire::s3::fsync=true", "Acquire::s3::region=eu-west-1"} {
+		if err := method.setConfigItem(item); err != nil {
+			t.Fatalf("setConfigItem(%q) returned unexpected error: %v", item, err)
+		}
+	}
+	for _, item := range []string{"Acquire::s3::Max-Parallel=many", "Acquire::s3::fsync=maybe", "Acquire::s3::region=EU West"} {
+		if err := method.setConfigItem(item); err == nil {
+			t.Errorf("setConfigItem(%q) = nil; expected an error", item)
+		}
+	}
+	if method.maxParallel != 4 || !method.fsync || method.region != "eu-west-1" {
+		t.Errorf("maxParallel, fsync, region = %d, %t, %s; expected the valid values 4, true, eu-west-1",
+			method.maxParallel, method.fsync, method.region)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var errConfigFileSyntax = errors.New("is not a configuration item, such as Acquire::s3::region=eu-west-1")
+
+// ReadConfigFile returns the configuration items of the file at path, for
+// Options.ConfigItems. The file holds one item per line in the name=value form
+// of the Config-Item fields of apt's 601 Configuration message. Blank lines
+// and lines starting with # are skipped.
+func ReadConfigFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	items, err := parseConfigItems(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return items, nil
+}
+
+// parseConfigItems returns the configuration items of r, as ReadConfigFile
+// describes.
+func parseConfigItems(r io.Reader) ([]string, error) {
+	var items []string
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		item := strings.TrimSpace(scanner.Text())
+		if item == "" || strings.HasPrefix(item, "#") {
+			continue
+		}
+		if name, _, found := strings.Cut(item, "="); !found || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("line %d: %q %w", line, item, errConfigFileSyntax)
+		}
+		items = append(items, item)
+	}
+	return items, scanner.Err()
+}
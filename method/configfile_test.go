@@ -0,0 +1,223 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+)
+
+func TestReadConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s3.items")
+	content := "# Written by the image build\n\nAcquire::s3::region=eu-west-1\n" +
+		"  Acquire::s3::fallback-endpoint::=https://replica.internal  \n" +
+		"Acquire::s3::role=\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := ReadConfigFile(path)
+	if err != nil {
+		t.Fatalf("ReadConfigFile() returned unexpected error: %v", err)
+	}
+	expected := []string{
+		"Acquire::s3::region=eu-west-1",
+		"Acquire::s3::fallback-endpoint::=https://replica.internal",
+		"Acquire::s3::role=",
+	}
+	if diff := cmp.Diff(expected, items); diff != "" {
+		t.Errorf("ReadConfigFile() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestReadConfigFileSyntaxError(t *testing.T) {
+	specs := map[string]string{
+		"no value":   "Acquire::s3::region=eu-west-1\nAcquire::s3::region\n",
+		"no name":    "Acquire::s3::region=eu-west-1\n=eu-west-1\n",
+		"apt.conf":   "Acquire::s3::region=eu-west-1\nAcquire::s3::region \"eu-west-1\";\n",
+		"spaced out": "Acquire::s3::region=eu-west-1\nAcquire::s3::region = eu-west-1\n",
+	}
+	for name, content := range specs {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "s3.items")
+			if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := ReadConfigFile(path)
+			if !errors.Is(err, errConfigFileSyntax) || !strings.Contains(err.Error(), "reading "+path+": line 2: ") {
+				t.Errorf("ReadConfigFile() returned %v; expected a syntax error on line 2", err)
+			}
+		})
+	}
+
+	if _, err := ReadConfigFile(filepath.Join(t.TempDir(), "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ReadConfigFile() of a missing file returned %v; expected os.ErrNotExist", err)
+	}
+}
+
+func TestRunConfigItems(t *testing.T) {
+	specs := map[string]struct {
+		configItems []string
+		message     string
+		expected    string
+	}{
+		"file only": {
+			[]string{"Acquire::s3::region=eu-west-1"},
+			"",
+			"eu-west-1",
+		},
+		"message overrides file": {
+			[]string{"Acquire::s3::region=eu-west-1"},
+			"601 Configuration\nConfig-Item: Acquire::s3::region=ap-south-1\n\n",
+			"ap-south-1",
+		},
+		"message without the item": {
+			[]string{"Acquire::s3::region=eu-west-1"},
+			"601 Configuration\nConfig-Item: Acquire::s3::fsync=true\n\n",
+			"eu-west-1",
+		},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			fake := testutil.NewFakeS3()
+			fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+			input := spec.message + fmt.Sprintf("600 URI Acquire\nURI: s3://apt-repo-bucket/apt/generic/hello.deb\nFilename: %s\n\n",
+				filepath.Join(t.TempDir(), "hello.deb"))
+			var mu sync.Mutex
+			var regions []string
+			out := &bytes.Buffer{}
+			method := NewWithOptions(Options{
+				Input:       strings.NewReader(input),
+				Output:      out,
+				ConfigItems: spec.configItems,
+				S3ClientFactory: func(cfg ClientConfig) (s3iface.S3API, error) {
+					mu.Lock()
+					defer mu.Unlock()
+					regions = append(regions, cfg.Region)
+					return fake, nil
+				},
+			})
+
+			errc := make(chan error, 1)
+			go func() { errc <- method.Run() }()
+			select {
+			case err := <-errc:
+				if err != nil {
+					t.Errorf("Run() = %v; expected nil", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Run() did not return after the input was exhausted")
+			}
+
+			if !strings.Contains(out.String(), "201 URI Done\n") {
+				t.Errorf("output = %q; expected the URI to be done", out)
+			}
+			if diff := cmp.Diff([]string{spec.expected}, regions); diff != "" {
+				t.Errorf("regions of the S3 clients differ (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRunConfigurationDuringAcquire(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	for _, key := range []string{"pool/first.deb", "pool/second.deb"} {
+		fake.Put("apt-repo-bucket", key, testutil.FakeObject{Body: []byte("hello")})
+	}
+	// apt's configuration is sent once the first acquire started downloading,
+	// which downloads until the acquire sent after the configuration started
+	// downloading.
+	firstStarted, secondStarted := make(chan struct{}), make(chan struct{})
+	var firstOnce, secondOnce sync.Once
+	fake.BeforeGet = func(key string) {
+		if key == "pool/first.deb" {
+			firstOnce.Do(func() { close(firstStarted) })
+			<-secondStarted
+			return
+		}
+		secondOnce.Do(func() { close(secondStarted) })
+	}
+	dir := t.TempDir()
+	first := "600 URI Acquire\nURI: s3://repo/pool/first.deb\nFilename: " + filepath.Join(dir, "first.deb") + "\n\n"
+	rest := "601 Configuration\nConfig-Item: Debug::Acquire::s3=true\nConfig-Item: Acquire::s3::alias::repo=apt-repo-bucket\n" +
+		"Config-Item: Acquire::s3::endpoint::other.example=https://other.example\nConfig-Item: Acquire::s3::Max-Parallel=2\n" +
+		"Config-Item: Acquire::s3::throttle-attempts=3\nConfig-Item: Acquire::s3::batch-head=true\n" +
+		"Config-Item: Acquire::s3::LogTarget=syslog\n\n" +
+		"600 URI Acquire\nURI: s3://repo/pool/second.deb\nFilename: " + filepath.Join(dir, "second.deb") + "\n\n"
+	inputReader, inputWriter := io.Pipe()
+	out := &lockedBuffer{}
+	method := NewWithOptions(Options{
+		Input:           inputReader,
+		Output:          out,
+		ConfigItems:     []string{"Acquire::s3::alias::repo=apt-repo-bucket", "Acquire::s3::Max-Parallel=2"},
+		S3ClientFactory: fakeFactory(fake),
+	})
+	method.dialSyslog = func(string) (syslogWriter, error) { return &fakeSyslog{}, nil }
+	queue := method.queue
+
+	errc := make(chan error, 1)
+	go func() { errc <- method.Run() }()
+	go func() {
+		io.WriteString(inputWriter, first)
+		<-firstStarted
+		io.WriteString(inputWriter, rest)
+		inputWriter.Close()
+	}()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("Run() = %v; expected nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return after the input was exhausted")
+	}
+
+	if count := strings.Count(out.String(), "201 URI Done\n"); count != 2 {
+		t.Errorf("output = %q; expected both URIs to be done", out)
+	}
+	if method.queue != queue && queue != nil {
+		t.Errorf("the configuration replaced the queue of the acquires in flight")
+	}
+}
+
+func TestRunConfigItemsFatal(t *testing.T) {
+	out := &bytes.Buffer{}
+	method := NewWithOptions(Options{
+		Input:       strings.NewReader(""),
+		Output:      out,
+		ConfigItems: []string{"Acquire::s3::strict=true", "Acquire::s3::regoin=eu-west-1"},
+	})
+
+	if err := method.Run(); !isFatal(err) {
+		t.Errorf("Run() = %v; expected a FatalError", err)
+	}
+	if expected := "401 General Failure\n"; !strings.Contains(out.String(), expected) {
+		t.Errorf("output = %q; expected it to contain %q", out, expected)
+	}
+}
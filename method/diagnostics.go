@@ -0,0 +1,220 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/google/apt-golang-s3/fetcher"
+	"github.com/google/apt-golang-s3/message"
+)
+
+// roleParameterPattern matches the value of the role parameter in the query of
+// a URI, up to the next parameter or the path apt appended to the query.
+//
+//nolint:gochecknoglobals
+var roleParameterPattern = regexp.MustCompile(`((?:^|&)` + fetcher.RoleParameter + `=)[^&/]*`)
+
+// A LogLevel selects the diagnostics a Method writes besides the messages of
+// the APT protocol, independently of apt's configuration. The zero LogLevel
+// writes none.
+type LogLevel int
+
+const (
+	// LogLevelNone writes no diagnostics.
+	LogLevelNone LogLevel = iota
+	// LogLevelDebug writes every message exchanged with apt and what the
+	// Method would log with Debug::Acquire::s3 set.
+	LogLevelDebug
+	// LogLevelInfo writes the configuration arriving and the URIs starting
+	// and completing.
+	LogLevelInfo
+	// LogLevelWarn writes warnings and failures only.
+	LogLevelWarn
+)
+
+// ErrUnknownLogLevel is returned by ParseLogLevel for names of no LogLevel.
+var ErrUnknownLogLevel = errors.New("unknown log level, expected debug, info or warn")
+
+// ParseLogLevel returns the LogLevel with the given name, which is one of
+// debug, info and warn.
+func ParseLogLevel(name string) (LogLevel, error) {
+	for _, level := range []LogLevel{LogLevelDebug, LogLevelInfo, LogLevelWarn} {
+		if strings.EqualFold(name, level.String()) {
+			return level, nil
+		}
+	}
+	return LogLevelNone, fmt.Errorf("%w: %q", ErrUnknownLogLevel, name)
+}
+
+func (level LogLevel) String() string {
+	switch level {
+	case LogLevelDebug:
+		return "debug"
+	case LogLevelInfo:
+		return "info"
+	case LogLevelWarn:
+		return "warn"
+	default:
+		return "none"
+	}
+}
+
+const (
+	logTargetStderr = "stderr"
+	logTargetSyslog = "syslog"
+
+	// syslogTag is the tag diagnostics are sent to syslog with.
+	syslogTag = "apt-s3"
+)
+
+// A syslogWriter is the part of a *syslog.Writer diagnostics are written
+// with, one method per severity.
+type syslogWriter interface {
+	Debug(m string) error
+	Info(m string) error
+	Warning(m string) error
+}
+
+// A diagnosticsSink is where a Method writes its diagnostics: the Diagnostics
+// of its Options or, once Acquire::s3::LogTarget asks for it, syslog.
+type diagnosticsSink struct {
+	mu     sync.Mutex
+	level  LogLevel
+	logger *log.Logger
+	syslog syslogWriter
+}
+
+// write writes a diagnostic line at the given level, if the LogLevel of the
+// sink lets it through. Lines sent to syslog are given the severity of their
+// level rather than a prefix naming it.
+func (sink *diagnosticsSink) write(level LogLevel, text string) {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.level == LogLevelNone || level < sink.level {
+		return
+	}
+	switch {
+	case sink.syslog != nil:
+		var err error
+		switch level {
+		case LogLevelDebug:
+			err = sink.syslog.Debug(text)
+		case LogLevelInfo:
+			err = sink.syslog.Info(text)
+		default:
+			err = sink.syslog.Warning(text)
+		}
+		if err != nil && sink.logger != nil {
+			sink.logger.Printf("%s: %s", level, text)
+		}
+	case sink.logger != nil:
+		sink.logger.Printf("%s: %s", level, text)
+	}
+}
+
+// useSyslog routes the diagnostics to the writer dial connects to syslog with,
+// writing warnings and failures when no LogLevel was selected. Where there is
+// no syslog daemon to connect to, as in most containers, the diagnostics stay
+// where they were.
+func (sink *diagnosticsSink) useSyslog(dial func(tag string) (syslogWriter, error)) {
+	writer, err := dial(syslogTag)
+	if err != nil {
+		return
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	sink.syslog = writer
+	if sink.level == LogLevelNone {
+		sink.level = LogLevelWarn
+	}
+}
+
+// diagnose writes a diagnostic line at the given level, if the Method's
+// LogLevel lets it through.
+func (method *Method) diagnose(level LogLevel, format string, args ...interface{}) {
+	method.diagnostics.write(level, fmt.Sprintf(format, args...))
+}
+
+// applyLogTarget routes the diagnostics to the target Acquire::s3::LogTarget
+// selects.
+func (method *Method) applyLogTarget() {
+	if method.logTarget == logTargetSyslog {
+		method.diagnostics.useSyslog(method.dialSyslog)
+	}
+}
+
+// diagnoseMessage writes a diagnostic line for a message received from or
+// sent to apt, at a level depending on its status code. Log messages are left
+// out, as debugf writes their text already.
+func (method *Method) diagnoseMessage(direction string, msg *message.Message) {
+	var level LogLevel
+	switch msg.Header.Status {
+	case headerCodeGeneralLog:
+		return
+	case headerCodeConfiguration, headerCodeURIStart, headerCodeURIDone:
+		level = LogLevelInfo
+	case headerCodeWarning, headerCodeURIFailure, headerCodeGeneralFailure:
+		level = LogLevelWarn
+	default:
+		level = LogLevelDebug
+	}
+	text := fmt.Sprintf("%s %d %s", direction, msg.Header.Status, msg.Header.Description)
+	if uri, ok := msg.GetFieldValue(fieldNameURI); ok {
+		text += " " + redactURI(uri)
+	}
+	if reason, ok := msg.GetFieldValue(fieldNameMessage); ok {
+		text += ": " + reason
+	}
+	method.diagnose(level, "%s", text)
+}
+
+// redactURI redacts the secret access key URIs may carry in their user
+// information, and the role they may name in their query. The credentials are
+// encoded as Locate encodes them first, so that a secret with a '/' or '@' is
+// parsed as user information.
+func redactURI(uri string) string {
+	parsed, err := url.Parse(fetcher.EncodeUserinfo(uri))
+	// Without user information, a port followed by an '@' may be the start of
+	// a secret that was taken for the host.
+	if err != nil || parsed.User == nil && parsed.Port() != "" && strings.Contains(uri, "@") {
+		return redactUnparsed(uri)
+	}
+	parsed.RawQuery = roleParameterPattern.ReplaceAllString(parsed.RawQuery, "${1}xxxxx")
+	return parsed.Redacted()
+}
+
+// redactUnparsed redacts a URI that cannot be parsed as one with user
+// information by cutting all up to its last '@', which may end user
+// information, and the role in its query.
+func redactUnparsed(uri string) string {
+	prefix, rest := "", uri
+	if scheme, afterScheme, found := strings.Cut(uri, "://"); found {
+		prefix, rest = scheme+"://", afterScheme
+	}
+	if path, query, found := strings.Cut(rest, "?"); found {
+		rest = path + "?" + roleParameterPattern.ReplaceAllString(query, "${1}xxxxx")
+	}
+	if idx := strings.LastIndex(rest, "@"); idx >= 0 {
+		rest = "xxxxx@" + rest[idx+1:]
+	}
+	return prefix + rest
+}
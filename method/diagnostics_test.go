@@ -0,0 +1,230 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	for name, expected := range map[string]LogLevel{"debug": LogLevelDebug, "INFO": LogLevelInfo, "warn": LogLevelWarn} {
+		if actual, err := ParseLogLevel(name); err != nil || actual != expected {
+			t.Errorf("ParseLogLevel(%q) = %v, %v; expected %v", name, actual, err, expected)
+		}
+	}
+	if _, err := ParseLogLevel("trace"); !errors.Is(err, ErrUnknownLogLevel) {
+		t.Errorf("ParseLogLevel(%q) returned %v; expected %v", "trace", err, ErrUnknownLogLevel)
+	}
+}
+
+func TestRunDiagnostics(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	input := configMsg + "600 URI Acquire\n" +
+		"URI: s3://fake-access-key-id:fake-access-key-secret@s3.us-east-2.amazonaws.com/apt-repo-bucket/apt/generic/hello.deb\n" +
+		"Filename: " + filepath.Join(t.TempDir(), "hello.deb") + "\n\n" +
+		"600 URI Acquire\n" +
+		"URI: s3://apt-repo-bucket/apt/generic/missing.deb\n" +
+		"Filename: " + filepath.Join(t.TempDir(), "missing.deb") + "\n\n"
+
+	specs := map[LogLevel]struct {
+		expected, unexpected []string
+	}{
+		LogLevelNone: {unexpected: []string{"apt-golang-s3:"}},
+		LogLevelWarn: {
+			expected:   []string{"apt-golang-s3: warn: Sent 400 URI Failure s3://apt-repo-bucket/apt/generic/missing.deb: "},
+			unexpected: []string{"info:", "debug:"},
+		},
+		LogLevelInfo: {
+			expected: []string{
+				"apt-golang-s3: info: Waiting for apt's messages on the input\n",
+				"info: Received 601 Configuration\n",
+				"info: Sent 201 URI Done s3://fake-access-key-id:xxxxx@s3.us-east-2.amazonaws.com/apt-repo-bucket/apt/generic/hello.deb\n",
+			},
+			unexpected: []string{"debug:", "fake-access-key-secret"},
+		},
+		LogLevelDebug: {expected: []string{"debug: Sent 100 Capabilities\n", "debug: Received 600 URI Acquire "}},
+	}
+	for level, spec := range specs {
+		t.Run(level.String(), func(t *testing.T) {
+			diagnostics := &bytes.Buffer{}
+			method := NewWithOptions(Options{
+				Input:           strings.NewReader(input),
+				Output:          &bytes.Buffer{},
+				S3ClientFactory: fakeFactory(fake),
+				LogLevel:        level,
+				Diagnostics:     diagnostics,
+			})
+
+			errc := make(chan error, 1)
+			go func() { errc <- method.Run() }()
+			select {
+			case <-errc:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Run() did not return after the input was exhausted")
+			}
+
+			for _, expected := range spec.expected {
+				if !strings.Contains(diagnostics.String(), expected) {
+					t.Errorf("diagnostics = %q; expected them to contain %q", diagnostics, expected)
+				}
+			}
+			for _, unexpected := range spec.unexpected {
+				if strings.Contains(diagnostics.String(), unexpected) {
+					t.Errorf("diagnostics = %q; expected them not to contain %q", diagnostics, unexpected)
+				}
+			}
+		})
+	}
+}
+
+func TestRedactURI(t *testing.T) {
+	const role = "arn%3Aaws%3Aiam%3A%3A123456789012%3Arole%2Fapt-reader"
+	// Secrets with a '/' in front of a bucket name rather than an endpoint
+	// either fail to parse or parse as a port and a path.
+	specs := map[string]string{
+		"s3://apt-repo-bucket/apt/generic/hello.deb":                           "s3://apt-repo-bucket/apt/generic/hello.deb",
+		"s3://AKIDEXAMPLE:wJalrXUtnFEMI@apt-repo-bucket/hello.deb":             "s3://AKIDEXAMPLE:xxxxx@apt-repo-bucket/hello.deb",
+		"s3://apt-repo-bucket/hello.deb?role=" + role:                          "s3://apt-repo-bucket/hello.deb?role=xxxxx",
+		"s3://apt-repo-bucket/dists?region=eu-west-1&role=" + role + "/stable": "s3://apt-repo-bucket/dists?region=eu-west-1&role=xxxxx/stable",
+		"s3://AKID:wJalr/XUtn@s3.amazonaws.com/apt-repo-bucket/hello.deb":      "s3://AKID:xxxxx@s3.amazonaws.com/apt-repo-bucket/hello.deb",
+		"s3://AKID:wJalr/XUtn@apt-repo-bucket/hello.deb":                       "s3://xxxxx@apt-repo-bucket/hello.deb",
+		"s3://AKID:1234/XUtn@apt-repo-bucket/hello.deb":                        "s3://xxxxx@apt-repo-bucket/hello.deb",
+		"s3://AKID:1234/X#Utn@apt-repo-bucket/hello.deb":                       "s3://xxxxx@apt-repo-bucket/hello.deb",
+		"s3://AKID:wJalr/XUtn@apt-repo-bucket/a%zz.deb?role=" + role:           "s3://xxxxx@apt-repo-bucket/a%zz.deb?role=xxxxx",
+	}
+	for uri, expected := range specs {
+		if actual := redactURI(uri); actual != expected {
+			t.Errorf("redactURI(%q) = %q; expected %q", uri, actual, expected)
+		}
+	}
+}
+
+// fakeSyslog records the lines written to it, prefixed with their severity.
+type fakeSyslog struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (fake *fakeSyslog) record(severity, m string) error {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.lines = append(fake.lines, severity+" "+m)
+	return nil
+}
+
+func (fake *fakeSyslog) Debug(m string) error   { return fake.record("debug", m) }
+func (fake *fakeSyslog) Info(m string) error    { return fake.record("info", m) }
+func (fake *fakeSyslog) Warning(m string) error { return fake.record("warning", m) }
+
+func TestRunDiagnosticsToSyslog(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	run := func(t *testing.T, logTarget string, dial func(string) (syslogWriter, error)) (output, diagnostics string) {
+		t.Helper()
+		input := strings.Replace(configMsg, "\n\n", "\nConfig-Item: Acquire::s3::LogTarget="+logTarget+"\n\n", 1) +
+			"600 URI Acquire\n" +
+			"URI: s3://apt-repo-bucket/apt/generic/missing.deb\n" +
+			"Filename: " + filepath.Join(t.TempDir(), "missing.deb") + "\n\n" +
+			// The secret in front of the bucket name keeps the URI from
+			// parsing.
+			"600 URI Acquire\n" +
+			"URI: s3://AKID:wJalr/XUtn@apt-repo-bucket/apt/generic/hello.deb\n" +
+			"Filename: " + filepath.Join(t.TempDir(), "hello.deb") + "\n\n"
+		out, diag := &bytes.Buffer{}, &bytes.Buffer{}
+		method := NewWithOptions(Options{
+			Input:           strings.NewReader(input),
+			Output:          out,
+			S3ClientFactory: fakeFactory(fake),
+			Diagnostics:     diag,
+		})
+		method.dialSyslog = dial
+
+		errc := make(chan error, 1)
+		go func() { errc <- method.Run() }()
+		select {
+		case <-errc:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Run() did not return after the input was exhausted")
+		}
+		// The acquires run at once, so their messages are compared in
+		// any order.
+		messages := strings.Split(out.String(), "\n\n")
+		slices.Sort(messages)
+		return strings.Join(messages, "\n\n"), diag.String()
+	}
+
+	var dialed []string
+	writer := &fakeSyslog{}
+	dial := func(tag string) (syslogWriter, error) {
+		dialed = append(dialed, tag)
+		return writer, nil
+	}
+	stderrOutput, _ := run(t, logTargetStderr, dial)
+	if len(dialed) != 0 {
+		t.Errorf("syslog was dialed %d times with Acquire::s3::LogTarget=stderr; expected none", len(dialed))
+	}
+	syslogOutput, diagnostics := run(t, logTargetSyslog, dial)
+	if len(dialed) != 1 || dialed[0] != "apt-s3" {
+		t.Errorf("syslog was dialed with tags %q; expected apt-s3 once", dialed)
+	}
+	if diagnostics != "" {
+		t.Errorf("diagnostics = %q; expected them all in syslog", diagnostics)
+	}
+	if syslogOutput != stderrOutput {
+		t.Errorf("output = %q with syslog; expected it to be %q as with stderr", syslogOutput, stderrOutput)
+	}
+	expected := []string{
+		"warning Sent 400 URI Failure s3://apt-repo-bucket/apt/generic/missing.deb: ",
+		"warning Sent 400 URI Failure s3://xxxxx@apt-repo-bucket/apt/generic/hello.deb: invalid URI",
+	}
+	if len(writer.lines) != len(expected) {
+		t.Fatalf("syslog lines = %q; expected %d", writer.lines, len(expected))
+	}
+	for _, line := range expected {
+		if !slices.ContainsFunc(writer.lines, func(actual string) bool { return strings.HasPrefix(actual, line) }) {
+			t.Errorf("syslog lines = %q; expected one starting with %q", writer.lines, line)
+		}
+	}
+	if lines := strings.Join(writer.lines, "\n"); strings.Contains(lines, "XUtn") {
+		t.Errorf("syslog lines = %q; expected the secret access key to be redacted", lines)
+	}
+
+	_, diagnostics = run(t, logTargetSyslog, func(string) (syslogWriter, error) { return nil, errors.New("no /dev/log") })
+	if diagnostics != "" {
+		t.Errorf("diagnostics = %q without syslog and a LogLevel; expected none", diagnostics)
+	}
+}
+
+func TestDiagnosticsSinkFallsBackToLogger(t *testing.T) {
+	diagnostics := &bytes.Buffer{}
+	sink := &diagnosticsSink{level: LogLevelInfo, logger: log.New(diagnostics, "", 0)}
+	sink.useSyslog(func(string) (syslogWriter, error) { return nil, errors.New("no /dev/log") })
+	sink.write(LogLevelDebug, "left out")
+	sink.write(LogLevelInfo, "kept")
+	if expected := "info: kept\n"; diagnostics.String() != expected {
+		t.Errorf("diagnostics = %q; expected %q", diagnostics, expected)
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+	"github.com/google/apt-golang-s3/message"
+)
+
+func TestURIAcquireInsufficientSpace(t *testing.T) {
+	dir := testutil.MountTmpfs(t, 1<<20)
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "pool/hello.deb", testutil.FakeObject{Body: make([]byte, 2<<20)})
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0), WithS3ClientFactory(fakeFactory(fake)))
+	close(method.configured)
+	uri := "s3://apt-repo-bucket/pool/hello.deb"
+
+	method.acquire(context.Background(), &message.Message{
+		Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+		Fields: []*message.Field{field(fieldNameURI, uri), field(fieldNameFilename, filepath.Join(dir, "hello.deb"))},
+	})
+
+	expected := "400 URI Failure\nURI: " + uri + "\nMessage: insufficient free space: need 2097152 bytes, have "
+	if output := out.String(); !strings.Contains(output, expected) || strings.Contains(output, "200 URI Start") {
+		t.Errorf("output = %q; expected it to contain %q, and no URI Start", output, expected)
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/google/apt-golang-s3/fetcher"
+)
+
+const (
+	aptConfigCommand  = "apt-config"
+	aptConfigS3Prefix = "Acquire::s3::"
+)
+
+var (
+	errDoctorChecksFailed = errors.New("one or more checks failed")
+)
+
+// doctorEnvVars are the environment variables that influence how the AWS SDK
+// resolves credentials and configuration.
+//
+//nolint:gochecknoglobals
+var doctorEnvVars = []string{
+	"AWS_ACCESS_KEY_ID",
+	"AWS_PROFILE",
+	"AWS_SHARED_CREDENTIALS_FILE",
+	"AWS_CONFIG_FILE",
+	"AWS_WEB_IDENTITY_TOKEN_FILE",
+	"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI",
+	"AWS_CONTAINER_CREDENTIALS_FULL_URI",
+}
+
+// A doctor runs the individual self-test steps and records their outcome.
+type doctor struct {
+	out    io.Writer
+	method *Method
+	failed bool
+}
+
+// Doctor checks, outside of the APT protocol, whether the object at the given
+// s3:// URI can be acquired. It resolves the configuration the same way apt
+// would hand it to the method, reports which credential provider was
+// selected, and then attempts HeadBucket and HeadObject. A human-readable
+// pass/fail line, with remediation hints on failure, is written to out for
+// each step. A non-nil error is returned when any step failed.
+func Doctor(out io.Writer, uri string) error {
+	doc := &doctor{out: out, method: New(log.New(io.Discard, "", 0))}
+
+	items, err := aptConfigItems()
+	if err != nil {
+		doc.info("Configuration", "could not read apt configuration (%v), using defaults", err)
+	}
+	if _, err := doc.method.applyConfig(items); err != nil {
+		doc.fail("Configuration", err, "correct or remove the Acquire::s3 configuration items the error names")
+		return errDoctorChecksFailed
+	}
+	doc.pass("Configuration", "region=%s endpoint=%s role=%s",
+		doc.method.region, orNone(doc.method.endpoint), orNone(doc.method.roleARN))
+	if count := len(doc.method.authEntries); count > 0 {
+		authConf, _ := doc.method.dirs.authConf()
+		doc.info("Configuration", "%d entries read from %s and its parts", count, authConf)
+	}
+	doc.info("Configuration", "shared AWS configuration read from %s", doc.method.sharedFiles())
+	for _, name := range doctorEnvVars {
+		if _, ok := os.LookupEnv(name); ok {
+			doc.info("Environment", "%s is set", name)
+		}
+	}
+
+	doc.run(uri)
+	if doc.failed {
+		return errDoctorChecksFailed
+	}
+	return nil
+}
+
+func (doc *doctor) run(uri string) {
+	f := doc.method.fetcher()
+	s3URL, err := f.Endpoint()
+	if err != nil {
+		doc.fail("Endpoint", err, "set Acquire::s3::region to a valid region or Acquire::s3::endpoint to a valid URL")
+		return
+	}
+	doc.pass("Endpoint", "%s", s3URL)
+
+	objLoc, err := f.Locate(uri)
+	if err != nil {
+		doc.fail("Location", err, "use s3://bucket/path/to/key or s3://"+s3URL.Host+"/bucket/path/to/key")
+		return
+	}
+	doc.pass("Location", "bucket=%s key=%s", objLoc.Bucket, objLoc.Key)
+
+	selection := fetcher.SelectCredentials(f.ClientConfig(objLoc))
+	doc.info("Credentials", "using %s", selection.Used)
+	for _, source := range selection.Ignored {
+		doc.info("Credentials", "ignoring %s", source)
+	}
+
+	sess, config, err := fetcher.NewSession(f.ClientConfig(objLoc))
+	if err != nil {
+		doc.fail("Credentials", err, "embed both the access key id and secret in the URI or auth.conf, or neither")
+		return
+	}
+	creds := config.Credentials
+	if creds == nil {
+		creds = sess.Config.Credentials
+	}
+	value, err := creds.Get()
+	if err != nil {
+		doc.fail("Credentials", err,
+			"embed static credentials in the URI, set AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY, "+
+				"configure a profile, or run on a host with an instance role")
+		return
+	}
+	doc.pass("Credentials", "provider=%s", value.ProviderName)
+
+	client := s3.New(sess, config)
+	_, err = client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(objLoc.Bucket)})
+	if err != nil {
+		doc.fail("HeadBucket", err, headBucketHint(err))
+	} else {
+		doc.pass("HeadBucket", "%s is reachable", objLoc.Bucket)
+	}
+
+	_, err = client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(objLoc.Bucket), Key: aws.String(objLoc.Key)})
+	if err != nil {
+		doc.fail("HeadObject", err, headObjectHint(err))
+		return
+	}
+	doc.pass("HeadObject", "%s exists", objLoc.Key)
+}
+
+func (doc *doctor) pass(step, format string, args ...interface{}) {
+	fmt.Fprintf(doc.out, "[PASS] %s: %s\n", step, fmt.Sprintf(format, args...))
+}
+
+func (doc *doctor) info(step, format string, args ...interface{}) {
+	fmt.Fprintf(doc.out, "[INFO] %s: %s\n", step, fmt.Sprintf(format, args...))
+}
+
+func (doc *doctor) fail(step string, err error, hint string) {
+	doc.failed = true
+	fmt.Fprintf(doc.out, "[FAIL] %s: %s\n", step, strings.ReplaceAll(err.Error(), "\n", " "))
+	fmt.Fprintf(doc.out, "       hint: %s\n", hint)
+}
+
+func headBucketHint(err error) string {
+	switch requestFailureStatus(err) {
+	case http.StatusMovedPermanently:
+		return "the bucket lives in a different region, set Acquire::s3::region accordingly"
+	case http.StatusForbidden:
+		return "the credentials lack s3:ListBucket on the bucket; acquiring objects may still work"
+	case http.StatusNotFound:
+		return "the bucket does not exist, check the bucket name in the URI"
+	default:
+		return "check network connectivity to the endpoint"
+	}
+}
+
+func headObjectHint(err error) string {
+	switch requestFailureStatus(err) {
+	case http.StatusMovedPermanently:
+		return "the bucket lives in a different region, set Acquire::s3::region accordingly"
+	case http.StatusForbidden:
+		return "the credentials lack s3:GetObject on the key, check the bucket policy"
+	case http.StatusNotFound:
+		return "the key does not exist in the bucket, check the path in the URI"
+	default:
+		return "check network connectivity to the endpoint"
+	}
+}
+
+// requestFailureStatus returns the HTTP status code of an awserr.RequestFailure
+// and 0 for any other error.
+func requestFailureStatus(err error) int {
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		return reqErr.StatusCode()
+	}
+	return 0
+}
+
+func orNone(value string) string {
+	if value == "" {
+		return "(none)"
+	}
+	return value
+}
+
+// aptConfigItems returns the Acquire::s3 configuration items known to apt as
+// "name=value" strings, as they would appear in a 601 Configuration message.
+func aptConfigItems() ([]string, error) {
+	path, err := exec.LookPath(aptConfigCommand)
+	if err != nil {
+		return nil, err
+	}
+	out, err := exec.Command(path, "dump").Output()
+	if err != nil {
+		return nil, fmt.Errorf("running %s dump: %w", aptConfigCommand, err)
+	}
+	return parseAptConfigDump(strings.NewReader(string(out))), nil
+}
+
+// parseAptConfigDump extracts the Acquire::s3 items from the output of
+// `apt-config dump`.
+//
+// Lines might look like the following:
+//
+// Acquire::s3 "";
+// Acquire::s3::region "us-west-2";
+func parseAptConfigDump(dump io.Reader) []string {
+	items := []string{}
+	scanner := bufio.NewScanner(dump)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		name, value, found := strings.Cut(line, " ")
+		if !found || !isS3ConfigItem(name) {
+			continue
+		}
+		value = strings.TrimSuffix(strings.TrimSpace(value), ";")
+		value = strings.TrimSuffix(strings.TrimPrefix(value, `"`), `"`)
+		items = append(items, name+"="+value)
+	}
+	return items
+}
@@ -0,0 +1,87 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+const (
+	aptConfigDump = `APT "";
+APT::Architecture "amd64";
+Acquire "";
+Acquire::s3 "";
+Acquire::s3::region "eu-west-1";
+Acquire::s3::role "arn:aws:iam::123456789012:role/s3-apt-reader";
+Acquire::http::Proxy "http://proxy.example.com:3128";
+Dir "/";
+`
+)
+
+func TestParseAptConfigDump(t *testing.T) {
+	actual := parseAptConfigDump(strings.NewReader(aptConfigDump))
+	expected := []string{
+		"Acquire::s3::region=eu-west-1",
+		"Acquire::s3::role=arn:aws:iam::123456789012:role/s3-apt-reader",
+	}
+	if diff := cmp.Diff(expected, actual); diff != "" {
+		t.Errorf("parseAptConfigDump() mismatch (-want +got):\n%s", diff)
+	}
+
+	method := New(logger(t))
+	for _, item := range actual {
+		if err := method.setConfigItem(item); err != nil {
+			t.Fatalf("setConfigItem(%q) returned unexpected error: %v", item, err)
+		}
+	}
+	if method.region != "eu-west-1" {
+		t.Errorf("method.region = %s; expected %s", method.region, "eu-west-1")
+	}
+}
+
+func TestHeadObjectHint(t *testing.T) {
+	specs := map[string]struct {
+		err      error
+		expected string
+	}{
+		"forbidden": {
+			awserr.NewRequestFailure(awserr.New("Forbidden", "Forbidden", nil), http.StatusForbidden, "id"),
+			"the credentials lack s3:GetObject on the key, check the bucket policy",
+		},
+		"not found": {
+			awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), http.StatusNotFound, "id"),
+			"the key does not exist in the bucket, check the path in the URI",
+		},
+		"network": {
+			errors.New("dial tcp: connection refused"),
+			"check network connectivity to the endpoint",
+		},
+	}
+
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			if actual := headObjectHint(spec.err); actual != spec.expected {
+				t.Errorf("headObjectHint(%v) = %s; expected %s", spec.err, actual, spec.expected)
+			}
+		})
+	}
+}
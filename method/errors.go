@@ -0,0 +1,64 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"errors"
+
+	"github.com/google/apt-golang-s3/fetcher"
+)
+
+// A FatalError wraps an error after which the Method cannot continue, as
+// opposed to an error that only affects the acquire of a single URI. A
+// FatalError is reported to apt with a 401 General Failure message and ends
+// Run, while any other error from an acquire is reported with a 400 URI
+// Failure message for that URI.
+type FatalError struct {
+	Err error
+}
+
+func (e *FatalError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FatalError) Unwrap() error {
+	return e.Err
+}
+
+// fatal wraps err in a FatalError. It returns nil if err is nil.
+func fatal(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &FatalError{Err: err}
+}
+
+// isFatal reports whether err is, or wraps, a FatalError.
+func isFatal(err error) bool {
+	var fatalErr *FatalError
+	return errors.As(err, &fatalErr)
+}
+
+// acquireError returns the error a fetch failed with as the error of its
+// acquire. Only the errors of the configuration every acquire shares, such as
+// an invalid endpoint or client certificate, are wrapped in a FatalError. Any
+// other error, be it a request S3 refused, a broken connection or a download
+// that does not match the object, only fails the acquire of its URI.
+func acquireError(err error) error {
+	if errors.Is(err, fetcher.ErrSession) || errors.Is(err, fetcher.ErrClientCert) || errors.Is(err, fetcher.ErrInvalidEndpoint) {
+		return fatal(err)
+	}
+	return err
+}
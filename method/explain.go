@@ -0,0 +1,66 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+
+	"github.com/google/apt-golang-s3/fetcher"
+)
+
+// errorExplanations tell users what well-known S3 error codes mean and what
+// to do about them, which the error messages S3 sends rarely do.
+//
+//nolint:gochecknoglobals,lll
+var errorExplanations = map[string]string{
+	"AccessDenied":                 "the credentials lack permission for the bucket or key, check the IAM and bucket policies",
+	"AllAccessDisabled":            "all access to the bucket has been disabled by its owner or AWS",
+	"AuthorizationHeaderMalformed": "the bucket lives in a different region, set Acquire::s3::region accordingly",
+	"ExpiredToken":                 "the session token of the credentials expired, renew the credentials",
+	"InvalidAccessKeyId":           "the access key id does not exist, check the credentials in the URI, auth.conf or environment",
+	"InvalidObjectState":           "the object is archived and must be restored before it can be acquired",
+	"NoSuchBucket":                 "the bucket does not exist, check the bucket name in the URI",
+	"NoSuchKey":                    "the key does not exist in the bucket, check the path in the URI",
+	"PermanentRedirect":            "the bucket lives in a different region, set Acquire::s3::region accordingly",
+	"RequestTimeTooSkewed":         "the local clock differs from AWS by more than 15 minutes, sync it, e.g. with timedatectl set-ntp true",
+	"SignatureDoesNotMatch":        "the secret access key does not match the access key id, check it for typos",
+	"SlowDown":                     "S3 throttled the requests, lower Acquire::s3::max-request-rate or Acquire::s3::Max-Parallel",
+}
+
+// failureText returns the text of err for a failure Message, on a single
+// line. If err carries a well-known S3 error code, an explanation of the code
+// is appended.
+func failureText(err error) string {
+	// The SDK separates the parts of its errors with a newline and a tab.
+	text := strings.Join(strings.Fields(err.Error()), " ")
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return text
+	}
+	explanation, known := errorExplanations[awsErr.Code()]
+	if !known {
+		return text
+	}
+	var skewErr *fetcher.ClockSkewError
+	if errors.As(err, &skewErr) && !skewErr.ServerTime.IsZero() {
+		explanation += fmt.Sprintf(" (the time at S3 was %s)", skewErr.ServerTime.UTC().Format(time.RFC1123))
+	}
+	return text + "; " + explanation
+}
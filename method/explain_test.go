@@ -0,0 +1,113 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+
+	"github.com/google/apt-golang-s3/fetcher"
+)
+
+func TestFailureText(t *testing.T) {
+	requestFailure := func(code string, status int) error {
+		return awserr.NewRequestFailure(awserr.New(code, "message from S3", nil), status, "id")
+	}
+	specs := map[string]struct {
+		err      error
+		expected string
+	}{
+		"access denied": {
+			requestFailure("AccessDenied", http.StatusForbidden),
+			"check the IAM and bucket policies",
+		},
+		"invalid access key id": {
+			requestFailure("InvalidAccessKeyId", http.StatusForbidden),
+			"the access key id does not exist",
+		},
+		"signature mismatch": {
+			requestFailure("SignatureDoesNotMatch", http.StatusForbidden),
+			"the secret access key does not match the access key id",
+		},
+		"wrong region": {
+			requestFailure("PermanentRedirect", http.StatusMovedPermanently),
+			"set Acquire::s3::region accordingly",
+		},
+		"archived": {
+			requestFailure("InvalidObjectState", http.StatusForbidden),
+			"must be restored",
+		},
+		"wrapped": {
+			fmt.Errorf("%w after 5 attempts: %w", fetcher.ErrThrottled, requestFailure("SlowDown", http.StatusServiceUnavailable)),
+			"lower Acquire::s3::max-request-rate",
+		},
+		"clock skew": {
+			requestFailure("RequestTimeTooSkewed", http.StatusForbidden),
+			"the local clock differs from AWS by more than 15 minutes",
+		},
+		"clock skew with server time": {
+			&fetcher.ClockSkewError{
+				RequestFailure: requestFailure("RequestTimeTooSkewed", http.StatusForbidden).(awserr.RequestFailure),
+				ServerTime:     time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC),
+			},
+			"sync it, e.g. with timedatectl set-ntp true (the time at S3 was Mon, 01 Jan 2024 12:00:00 UTC)",
+		},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			text := failureText(spec.err)
+			if !strings.HasPrefix(text, strings.Join(strings.Fields(spec.err.Error()), " ")+"; ") {
+				t.Errorf("failureText() = %q; expected it to start with the error", text)
+			}
+			if !strings.Contains(text, spec.expected) {
+				t.Errorf("failureText() = %q; expected it to contain %q", text, spec.expected)
+			}
+		})
+	}
+}
+
+func TestFailureTextUnknownCode(t *testing.T) {
+	specs := []struct {
+		err      error
+		expected string
+	}{
+		{errors.New("context canceled"), "context canceled"},
+		// The newline and tab the SDK separates the parts with are collapsed.
+		{
+			awserr.NewRequestFailure(awserr.New("InternalError", "We encountered an internal error.", nil), http.StatusInternalServerError, "id"),
+			"InternalError: We encountered an internal error. status code: 500, request id: id",
+		},
+	}
+	for _, spec := range specs {
+		if text := failureText(spec.err); text != spec.expected {
+			t.Errorf("failureText(%v) = %q; expected %q", spec.err, text, spec.expected)
+		}
+	}
+}
+
+func TestURIFailureExplainsCode(t *testing.T) {
+	err := awserr.NewRequestFailure(awserr.New("NoSuchBucket", "The specified bucket does not exist", nil), http.StatusNotFound, "id")
+	msg := uriFailure("s3://apt-repo-bucket/dists/stable/Release", err)
+	value, _ := msg.GetFieldValue(fieldNameMessage)
+	if !strings.HasSuffix(value, "; the bucket does not exist, check the bucket name in the URI") {
+		t.Errorf("uriFailure() Message = %q; expected it to explain NoSuchBucket", value)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/google/apt-golang-s3/fetcher"
+)
+
+// GetOptions override the apt configuration for Get, like the flags of the
+// get subcommand do.
+type GetOptions struct {
+	// Region, Endpoint and Role, when set, override Acquire::s3::region,
+	// Acquire::s3::endpoint and Acquire::s3::role.
+	Region, Endpoint, Role string
+	// S3ClientFactory, when set, replaces the default factory that creates
+	// AWS sessions.
+	S3ClientFactory S3ClientFactory
+}
+
+// Get fetches the object at the given s3:// URI to filename outside of the
+// APT protocol, resolving the configuration the same way Doctor does and
+// locating, authenticating, downloading and hashing the object the same way
+// an acquire does. The fields of the URI Done message the method would have
+// sent, such as the size, Last-Modified and hashes, are written to out. Objects
+// that do not exist yield an error wrapping fetcher.ErrNotFound or
+// fetcher.ErrBucketNotFound.
+func Get(out io.Writer, uri, filename string, opts GetOptions) error {
+	method := New(log.New(io.Discard, "", 0), WithS3ClientFactory(opts.S3ClientFactory))
+	items, _ := aptConfigItems()
+	for name, value := range map[string]string{
+		configItemAcquireS3Region:   opts.Region,
+		configItemAcquireS3Endpoint: opts.Endpoint,
+		configItemAcquireS3Role:     opts.Role,
+	} {
+		if value != "" {
+			items = append(items, name+"="+value)
+		}
+	}
+	if _, err := method.applyConfig(items); err != nil {
+		return err
+	}
+
+	result, err := method.fetcher().Fetch(context.Background(), fetcher.FetchRequest{URI: uri, Filename: filename})
+	if err != nil {
+		return err
+	}
+	for _, field := range uriDone(uri, result, filename).Fields {
+		fmt.Fprintf(out, "%s: %s\n", field.Name, field.Value)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/google/apt-golang-s3/fetcher"
+	"github.com/google/apt-golang-s3/internal/testutil"
+)
+
+func TestGet(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "pool/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	var cfg ClientConfig
+	opts := GetOptions{Region: "eu-west-1", S3ClientFactory: func(c ClientConfig) (s3iface.S3API, error) {
+		cfg = c
+		return fake, nil
+	}}
+
+	filename := filepath.Join(t.TempDir(), "hello.deb")
+	out := &bytes.Buffer{}
+	if err := Get(out, "s3://apt-repo-bucket/pool/hello.deb", filename, opts); err != nil {
+		t.Fatalf("Get() returned unexpected error: %v", err)
+	}
+	for _, expected := range []string{
+		"Filename: " + filename + "\n",
+		"Size: 5\n",
+		"SHA256-Hash: 2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824\n",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("output = %q; expected it to contain %q", out, expected)
+		}
+	}
+	if contents, err := os.ReadFile(filename); err != nil || string(contents) != "hello" {
+		t.Errorf("fetched file contains %q (%v); expected %q", contents, err, "hello")
+	}
+	if cfg.Region != "eu-west-1" {
+		t.Errorf("Region = %q; expected the one given in GetOptions", cfg.Region)
+	}
+
+	err := Get(out, "s3://apt-repo-bucket/pool/missing.deb", filename, opts)
+	if !errors.Is(err, fetcher.ErrNotFound) {
+		t.Errorf("Get() = %v; expected %v", err, fetcher.ErrNotFound)
+	}
+}
+
+func TestGetAppliesProvider(t *testing.T) {
+	if _, err := exec.LookPath(aptConfigCommand); err != nil {
+		t.Skipf("%s is not installed", aptConfigCommand)
+	}
+	aptConf := filepath.Join(t.TempDir(), "apt.conf")
+	if err := os.WriteFile(aptConf, []byte("Acquire::s3::provider \"scaleway\";\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("APT_CONFIG", aptConf)
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "pool/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	var cfg ClientConfig
+	opts := GetOptions{S3ClientFactory: func(c ClientConfig) (s3iface.S3API, error) {
+		cfg = c
+		return fake, nil
+	}}
+
+	filename := filepath.Join(t.TempDir(), "hello.deb")
+	if err := Get(&bytes.Buffer{}, "s3://apt-repo-bucket/pool/hello.deb", filename, opts); err != nil {
+		t.Fatalf("Get() returned unexpected error: %v", err)
+	}
+	if cfg.Region != "fr-par" || cfg.Endpoint != "https://s3.fr-par.scw.cloud" || !cfg.PathStyle {
+		t.Errorf("Region, Endpoint, PathStyle = %q, %q, %t; expected those of the scaleway provider preset",
+			cfg.Region, cfg.Endpoint, cfg.PathStyle)
+	}
+}
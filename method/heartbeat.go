@@ -0,0 +1,85 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// heartbeatInterval is how long a request for a URI may be outstanding before,
+// and between, the Status messages telling apt that the acquire still waits
+// for it, so that apt does not time the acquire out.
+const heartbeatInterval = 5 * time.Second
+
+// startHeartbeat sends a Status message about uri every heartbeatInterval,
+// giving status and how long the acquire has been waiting, until ctx is done
+// or the returned function is called. Once that function returns, no further
+// message is sent.
+func (method *Method) startHeartbeat(ctx context.Context, uri, status string) func() {
+	start := method.clock.Now()
+	return method.every(ctx, func() {
+		waited := method.clock.Now().Sub(start).Round(time.Second)
+		method.outputRequestStatus(uri, fmt.Sprintf("%s (%s)", status, waited))
+	})
+}
+
+// startProgress sends a Status message about uri every heartbeatInterval,
+// giving how many of the size bytes of the object written reports as written
+// so far, like startHeartbeat does. A negative size is unknown.
+func (method *Method) startProgress(ctx context.Context, uri string, size int64, written func() int64) func() {
+	return method.every(ctx, func() {
+		method.outputRequestStatus(uri, progressStatus(written(), size))
+	})
+}
+
+// progressStatus describes the progress of a download of size bytes, of which
+// written were written so far.
+func progressStatus(written, size int64) string {
+	if size <= 0 {
+		return fmt.Sprintf(fieldValueDownloadedUnsized, written)
+	}
+	return fmt.Sprintf(fieldValueDownloaded, written, size, written*100/size)
+}
+
+// every calls send every heartbeatInterval until ctx is done or the returned
+// function is called. Once that function returns, send is not called again.
+func (method *Method) every(ctx context.Context, send func()) func() {
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	ticker := method.clock.NewTicker(heartbeatInterval)
+	go func() {
+		defer close(stopped)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C():
+				send()
+			case <-stop:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			<-stopped
+		})
+	}
+}
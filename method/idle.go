@@ -0,0 +1,87 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"context"
+	"time"
+)
+
+// defaultIdleTimeout is how long HTTP connections are kept open while idle,
+// and how often the Method checks whether it sits idle, unless
+// Acquire::s3::idle-timeout says otherwise.
+const defaultIdleTimeout = 30 * time.Second
+
+// watchIdle calls checkIdle every idleTimeout, once the Method is configured
+// and until ctx is done. It does nothing if idleTimeout is not positive.
+func (method *Method) watchIdle(ctx context.Context) {
+	if method.waitForConfiguration(ctx) != nil {
+		return
+	}
+	timeout := method.currentIdleTimeout()
+	if timeout <= 0 {
+		return
+	}
+	ticker := method.clock.NewTicker(timeout)
+	defer ticker.Stop()
+	var reported time.Time
+	for {
+		select {
+		case <-ticker.C():
+			reported = method.checkIdle(reported)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkIdle writes to the debug log how many acquires are in flight, or that
+// the Method sits idle once it did for idleTimeout, closing the connections
+// kept open for acquires, unless it already did so for the pause that began at
+// reported. While idle, it refreshes the
+// credentials of the assumed roles that expire before the next check, so that
+// the next acquire does not wait for STS or fail to sign with them. It returns
+// when the pause it reported began.
+func (method *Method) checkIdle(reported time.Time) time.Time {
+	timeout, now := method.currentIdleTimeout(), method.clock.Now()
+	inFlight, idleSince := method.idleTracker.State()
+	if inFlight > 0 {
+		method.debugf("%d acquires in flight", inFlight)
+		return reported
+	}
+	if idleSince.IsZero() || now.Sub(idleSince) < timeout {
+		return reported
+	}
+	if !idleSince.Equal(reported) {
+		method.transports.CloseIdle()
+		method.debugf("Idle for %s, the connections kept open for acquires are closed", now.Sub(idleSince).Round(time.Second))
+	}
+	refreshed, err := method.roleCache.RefreshExpiring(method.clockOffset.ServerTime(now.Add(timeout)))
+	if refreshed > 0 {
+		method.debugf("Refreshed the credentials of %d assumed roles ahead of their expiry", refreshed)
+	}
+	if err != nil {
+		method.debugf("Cannot refresh the credentials of assumed roles ahead of their expiry: %v", err)
+	}
+	return idleSince
+}
+
+// currentIdleTimeout returns the idle timeout of the configuration applied
+// last.
+func (method *Method) currentIdleTimeout() time.Duration {
+	method.configMu.RLock()
+	defer method.configMu.RUnlock()
+	return method.idleTimeout
+}
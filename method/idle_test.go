@@ -0,0 +1,99 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+	"github.com/google/apt-golang-s3/message"
+)
+
+func TestCheckIdle(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	clock := testutil.NewFakeClock(time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC))
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0), WithS3ClientFactory(fakeFactory(fake)), WithClock(clock))
+	method.configure(&message.Message{Fields: []*message.Field{
+		field(fieldNameConfigItem, "Debug::Acquire::s3=true"),
+		field(fieldNameConfigItem, "Acquire::s3::idle-timeout=10"),
+	}})
+	if method.idleTimeout != 10*time.Second {
+		t.Fatalf("idleTimeout = %s; expected 10s", method.idleTimeout)
+	}
+
+	var reported time.Time
+	checkIdle := func() string {
+		out.Reset()
+		reported = method.checkIdle(reported)
+		return out.String()
+	}
+	if output := checkIdle(); output != "" {
+		t.Errorf("checkIdle() wrote %q before any acquire; expected nothing", output)
+	}
+
+	var inFlight string
+	fake.BeforeGet = func(string) {
+		inFlight = checkIdle()
+		clock.Advance(time.Second)
+	}
+	method.acquire(context.Background(), &message.Message{
+		Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+		Fields: []*message.Field{
+			field(fieldNameURI, "s3://apt-repo-bucket/apt/generic/hello.deb"),
+			field(fieldNameFilename, filepath.Join(t.TempDir(), "hello.deb")),
+		},
+	})
+	if expected := "Message: 1 acquires in flight\n"; !strings.Contains(inFlight, expected) {
+		t.Errorf("checkIdle() wrote %q during the acquire; expected it to contain %q", inFlight, expected)
+	}
+
+	clock.Advance(5 * time.Second)
+	if output := checkIdle(); output != "" {
+		t.Errorf("checkIdle() wrote %q 5s after the acquire; expected nothing", output)
+	}
+	clock.Advance(7 * time.Second)
+	expected := "Message: Idle for 12s, the connections kept open for acquires are closed\n"
+	if output := checkIdle(); !strings.Contains(output, expected) {
+		t.Errorf("checkIdle() wrote %q; expected it to contain %q", output, expected)
+	}
+	clock.Advance(10 * time.Second)
+	if output := checkIdle(); output != "" {
+		t.Errorf("checkIdle() wrote %q again for the same pause; expected nothing", output)
+	}
+}
+
+func TestWatchIdleStopsWithContext(t *testing.T) {
+	method := New(log.New(&bytes.Buffer{}, "", 0), WithClock(testutil.NewFakeClock(time.Now())))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		method.watchIdle(ctx)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("watchIdle() did not return after its context was cancelled")
+	}
+}
@@ -11,23 +11,21 @@
 // WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 // See the License for the specific language governing permissions and
 // limitations under the License.
+
 package method
 
 import (
-	"fmt"
-	"net/url"
-
-	"github.com/aws/aws-sdk-go/aws/endpoints"
-	"github.com/aws/aws-sdk-go/service/s3"
+	"os"
+	"testing"
 )
 
-func s3EndpointURL(region string) (*url.URL, error) {
-	resolver := endpoints.DefaultResolver()
-
-	endpoint, err := resolver.EndpointFor(s3.EndpointsID, region, endpoints.StrictMatchingOption)
-	if err != nil {
-		return nil, fmt.Errorf("resolving S3 endpoint for region %s: %w", region, err)
+// TestMain keeps the region of the machine running the tests out of them: the
+// environment is cleared of it, and the instance metadata service is not asked
+// for it, which would delay every configuration outside EC2.
+func TestMain(m *testing.M) {
+	for _, name := range regionEnvVars {
+		os.Unsetenv(name)
 	}
-
-	return url.Parse(endpoint.URL)
+	os.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	os.Exit(m.Run())
 }
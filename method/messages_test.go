@@ -0,0 +1,129 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+
+	"github.com/google/apt-golang-s3/fetcher"
+	"github.com/google/apt-golang-s3/internal/testutil"
+	"github.com/google/apt-golang-s3/message"
+)
+
+const (
+	messageGoldenDir = "testdata/messages"
+	messageGoldenURI = "s3://fake-access-key-id:fake-secret-access-key@s3.amazonaws.com/apt-repo-bucket/apt/generic/hello.deb"
+)
+
+// TestMessageGoldens renders every kind of message the Method sends apt with
+// the constructors the Method uses and compares them byte for byte with the
+// golden files in testdata/messages. The URI Done message describes the
+// fixture testdata/messages/hello.deb, and the times come from a fake clock,
+// so that the goldens are stable. Run `go test ./method -run
+// TestMessageGoldens -update` to rewrite the golden files.
+func TestMessageGoldens(t *testing.T) {
+	clk := testutil.NewFakeClock(transcriptLastModified)
+	fixture := filepath.Join(messageGoldenDir, "hello.deb")
+	info, err := os.Stat(fixture)
+	if err != nil {
+		t.Fatalf("failed to stat %s: %v", fixture, err)
+	}
+	digests, err := fetcher.FileDigests(fixture)
+	if err != nil {
+		t.Fatalf("failed to compute the digests of %s: %v", fixture, err)
+	}
+	fake := testutil.NewFakeS3()
+	fake.HeadErr = &fetcher.ClockSkewError{
+		RequestFailure: awserr.NewRequestFailure(awserr.New("RequestTimeTooSkewed",
+			"The difference between the request time and the current time is too large.", nil), 403, "4442587FB7D0A2F9"),
+		ServerTime: clk.Now().Add(20 * time.Minute),
+	}
+	failure := acquiredMessage(t, fake, headerCodeURIFailure)
+	loc := fetcher.Location{Bucket: "apt-repo-bucket", Key: "apt/generic/hello.deb"}
+	invalidEndpoint := &Method{endpoint: "https://objects-{bucket}.internal"}
+
+	specs := map[string]*message.Message{
+		"100-capabilities": capabilities(),
+		"102-status":       requestStatus(messageGoldenURI, "Connecting to s3.amazonaws.com"),
+		"200-uri-start":    uriStart(messageGoldenURI, info.Size(), clk.Now()),
+		"201-uri-done": uriDone(messageGoldenURI, fetcher.FetchResult{
+			Object:  fetcher.Object{Size: info.Size(), LastModified: clk.Now()},
+			Digests: digests,
+		}, "/var/cache/apt/archives/partial/hello.deb"),
+		"400-not-found":       notFound(messageGoldenURI, loc, true),
+		"400-bucket-missing":  notFound(messageGoldenURI, loc, false),
+		"400-failure":         failure,
+		"401-general-failure": generalFailure(invalidEndpoint.validateEndpoints()),
+	}
+	for name, msg := range specs {
+		t.Run(name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			if err := message.NewWriter(out).Write(msg); err != nil {
+				t.Fatalf("failed to write the message: %v", err)
+			}
+			actual := out.Bytes()
+
+			golden := filepath.Join(messageGoldenDir, name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, actual, 0o600); err != nil {
+					t.Fatalf("failed to write %s: %v", golden, err)
+				}
+				return
+			}
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("failed to read %s: %v", golden, err)
+			}
+			if !bytes.Equal(actual, expected) {
+				t.Errorf("message differs from %s\n--- got:\n%s\n--- expected:\n%s", golden, actual, expected)
+			}
+
+			parsed, err := message.FromBytes(expected)
+			if err != nil {
+				t.Fatalf("%s does not parse as a message: %v", golden, err)
+			}
+			if diff := cmp.Diff(msg, parsed); diff != "" {
+				t.Errorf("%s parses as a different message (-rendered +parsed):\n%s", golden, diff)
+			}
+		})
+	}
+}
+
+// acquiredMessage returns the message with the given status code the Method
+// sends apt for an acquire of messageGoldenURI from fake.
+func acquiredMessage(t *testing.T, fake *testutil.FakeS3, status int) *message.Message {
+	t.Helper()
+	output, err := acquire(t, fake, messageGoldenURI, filepath.Join(t.TempDir(), "hello.deb"))
+	if err != nil {
+		t.Fatalf("acquire() returned unexpected error: %v", err)
+	}
+	for _, raw := range strings.SplitAfter(output, "\n\n") {
+		msg, err := message.FromBytes([]byte(raw))
+		if err == nil && msg.Header.Status == status {
+			return msg
+		}
+	}
+	t.Fatalf("output = %q; expected a message with status %d", output, status)
+	return nil
+}
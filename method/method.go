@@ -18,55 +18,52 @@
 package method
 
 import (
-	"bufio"
-	"bytes"
-	"crypto/md5"
-	"crypto/sha1"
-	"crypto/sha256"
-	"crypto/sha512"
-	"encoding/hex"
+	"context"
 	"errors"
 	"fmt"
-	"hash"
 	"io"
 	"log"
+	"maps"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
+	"runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/endpoints"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3iface"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 
+	"github.com/google/apt-golang-s3/clock"
+	"github.com/google/apt-golang-s3/fetcher"
 	"github.com/google/apt-golang-s3/message"
+	"github.com/google/apt-golang-s3/version"
 )
 
 const (
 	headerCodeCapabilities   = 100
 	headerCodeGeneralLog     = 101
 	headerCodeStatus         = 102
+	headerCodeWarning        = 104
 	headerCodeURIStart       = 200
 	headerCodeURIDone        = 201
 	headerCodeURIFailure     = 400
 	headerCodeGeneralFailure = 401
 	headerCodeURIAcquire     = 600
 	headerCodeConfiguration  = 601
+	headerCodeAuthorization  = 602
+	headerCodeMediaChanged   = 603
 )
 
 const (
 	headerDescriptionCapabilities   = "Capabilities"
 	headerDescriptionGeneralLog     = "Log"
 	headerDescriptionStatus         = "Status"
+	headerDescriptionWarning        = "Warning"
 	headerDescriptionURIStart       = "URI Start"
 	headerDescriptionURIDone        = "URI Done"
 	headerDescriptionURIFailure     = "URI Failure"
@@ -79,6 +76,7 @@ const (
 	fieldNameCapabilities   = "Capabilities"
 	fieldNameConfigItem     = "Config-Item"
 	fieldNameSendConfig     = "Send-Config"
+	fieldNameSendURIEncoded = "Send-URI-Encoded"
 	fieldNamePipeline       = "Pipeline"
 	fieldNameSingleInstance = "Single-Instance"
 	fieldNameURI            = "URI"
@@ -86,343 +84,1113 @@ const (
 	fieldNameSize           = "Size"
 	fieldNameLastModified   = "Last-Modified"
 	fieldNameMessage        = "Message"
-	fieldNameMD5Hash        = "MD5-Hash"
-	fieldNameMD5SumHash     = "MD5Sum-Hash"
-	fieldNameSHA1Hash       = "SHA1-Hash"
-	fieldNameSHA256Hash     = "SHA256-Hash"
-	fieldNameSHA512Hash     = "SHA512-Hash"
+	fieldNameHashSuffix     = "-Hash"
+	fieldNameMaximumSize    = "Maximum-Size"
+	fieldNameExpectedSize   = "Expected-Size"
+	fieldNameExpectedPrefix = "Expected-"
 )
 
 const (
-	fieldValueTrue       = "true"
-	fieldValueYes        = "yes"
-	fieldValueNotFound   = "The specified key does not exist."
-	fieldValueConnecting = "Connecting to s3.amazonaws.com"
+	fieldValueTrue              = "true"
+	fieldValueYes               = "yes"
+	fieldValueNotFound          = "The specified key does not exist."
+	fieldValueBucketNotFound    = "The specified bucket does not exist."
+	fieldValueConnecting        = "Connecting to %s"
+	fieldValueWaitingForHeaders = "Waiting for headers"
+	fieldValueDownloaded        = "Downloaded %d of %d bytes (%d%%)"
+	fieldValueDownloadedUnsized = "Downloaded %d bytes"
+	fieldValueThrottled         = "Throttled by S3, retrying in %s"
+	fieldValueWaitingForSpace   = "Waiting for other downloads to finish, %v"
 )
 
+// quietStatusLevel is the quiet level of apt from which no Status messages are
+// sent.
+const quietStatusLevel = 2
+
 const (
-	configItemAcquireS3Region   = "Acquire::s3::region"
-	configItemAcquireS3Role     = "Acquire::s3::role"
-	configItemAcquireS3Endpoint = "Acquire::s3::endpoint"
+	configItemAcquireS3Region             = "Acquire::s3::region"
+	configItemAcquireS3Role               = "Acquire::s3::role"
+	configItemAcquireS3RoleSourceIdentity = "Acquire::s3::role-source-identity"
+	configItemAcquireS3STSEndpoint        = "Acquire::s3::sts-endpoint"
+	configItemAcquireS3Endpoint           = "Acquire::s3::endpoint"
+	configItemAcquireS3FallbackEndpoint   = "Acquire::s3::fallback-endpoint"
+	configItemAcquireS3Fsync              = "Acquire::s3::fsync"
+	configItemAcquireS3UserinfoIsProfile  = "Acquire::s3::userinfo-is-profile"
+	configItemAcquireS3SharedCredsFile    = "Acquire::s3::shared-credentials-file"
+	configItemAcquireS3SharedConfigFile   = "Acquire::s3::shared-config-file"
+	configItemAcquireS3DisableIMDS        = "Acquire::s3::disable-imds"
+	configItemAcquireS3IMDSRegion         = "Acquire::s3::imds-region"
+	configItemAcquireS3BatchHead          = "Acquire::s3::batch-head"
+	configItemAcquireS3DecodeContent      = "Acquire::s3::decode-content"
+	configItemAcquireS3AllowHTML          = "Acquire::s3::allow-html"
+	configItemAcquireS3VerifyParts        = "Acquire::s3::verify-parts"
+	configItemAcquireS3ListFallback       = "Acquire::s3::list-fallback"
+	configItemAcquireS3CSEKMSKeyID        = "Acquire::s3::cse-kms-key-id"
+	configItemAcquireS3Latest             = "Acquire::s3::latest"
+	configItemAcquireS3Preallocate        = "Acquire::s3::preallocate"
+	configItemAcquireS3Multipart          = "Acquire::s3::multipart"
+	configItemAcquireS3Strict             = "Acquire::s3::strict"
+	configItemAcquireS3ReuseExisting      = "Acquire::s3::reuse-existing"
+	configItemAcquireS3PartSize           = "Acquire::s3::part-size"
+	configItemAcquireS3Profile            = "Acquire::s3::Profile"
+	configItemAcquireS3Trace              = "Acquire::s3::Trace"
+	configItemAcquireS3Transcript         = "Acquire::s3::Transcript"
+	configItemAcquireS3StatsFile          = "Acquire::s3::stats-file"
+	configItemAcquireS3ThrottleAttempts   = "Acquire::s3::throttle-attempts"
+	configItemAcquireS3ResumeAttempts     = "Acquire::s3::resume-attempts"
+	configItemAcquireS3GetEmptyObjects    = "Acquire::s3::get-empty-objects"
+	configItemAcquireS3IdleTimeout        = "Acquire::s3::idle-timeout"
+	configItemAcquireS3MaxRequestRate     = "Acquire::s3::max-request-rate"
+	configItemAcquireS3SSLCert            = "Acquire::s3::SslCert"
+	configItemAcquireS3SSLKey             = "Acquire::s3::SslKey"
+	configItemAcquireS3TLSMinVersion      = "Acquire::s3::tls-min-version"
+	configItemAcquireS3TLSRestrictCiphers = "Acquire::s3::tls-restrict-ciphers"
+	configItemAcquireS3FileMode           = "Acquire::s3::FileMode"
+	configItemAcquireS3MaxMessageSize     = "Acquire::s3::max-message-size"
+	configItemAcquireS3LogTarget          = "Acquire::s3::LogTarget"
+	configItemAcquireS3Provider           = "Acquire::s3::provider"
+	configItemAcquireS3Namespace          = "Acquire::s3::namespace"
+	configItemAPTSandboxUser              = "APT::Sandbox::User"
+	configItemQuiet                       = "quiet"
+	configItemAPTQuiet                    = "APT::Quiet"
+	configItemAcquireSendURIEncoded       = "Acquire::Send-URI-Encoded"
+	configItemAcquireS3AliasPrefix        = "Acquire::s3::alias::"
+	configItemAcquireS3EndpointPrefix     = "Acquire::s3::endpoint::"
+	configItemDebugAcquireS3              = "Debug::Acquire::s3"
 )
 
+// defaultSandboxUser is the user apt's sandboxed methods run as unless
+// configItemAPTSandboxUser says otherwise.
+const defaultSandboxUser = "_apt"
+
 const (
-	locationMinTokensCount              = 3
-	userAndPasswordFormattedTokensCount = 2
+	// inputDrainTimeout is how long in-flight acquires may continue after apt
+	// closed the Method's input before they are cancelled.
+	inputDrainTimeout = 10 * time.Second
+	// cancelGracePeriod is how long Run waits for cancelled acquires to report
+	// their failures before returning.
+	cancelGracePeriod = time.Second
 )
 
 var (
-	errLocMissingRequiredTokens           = errors.New("location missing required number of tokens")
 	errAcqMsgMissingRequiredFieldURI      = errors.New("acquire message missing required field: URI")
 	errAcqMsgMissingRequiredFieldFilename = errors.New("acquire message missing required field: Filename")
-	errAcqMsgMissingRequiredFieldPassword = errors.New("acquire message missing required value: Password")
+	errPanicked                           = errors.New("internal error, rerun with Debug::Acquire::s3 for details")
 )
 
 // A Method implements the logic to process incoming apt messages and respond
 // accordingly.
 type Method struct {
 	region, roleARN, endpoint string
+	regionConfigured          bool
+	regionAuto                bool
+	regionSource              string
+	imdsRegion                bool
+	lookupIMDSRegion          func(ctx context.Context) (string, error)
+	imdsRegionOnce            sync.Once
+	imdsRegionFound           string
+	imdsRegionErr             error
+	fallbackEndpoints         []string
+	bucketAliases             map[string]string
+	hostEndpoints             map[string]string
+	provider, namespace       string
+	roleSourceIdentity        string
+	stsEndpoint               string
+	dirs                      aptDirs
+	authEntries               []fetcher.AuthEntry
 	msgChan                   chan []byte
-	configured                bool
+	configured                chan struct{}
+	configuredOnce            sync.Once
+	configMu                  sync.RWMutex
+	debug                     atomic.Bool
+	strict                    bool
+	fsync                     bool
+	cacheDir                  string
+	cacheMaxSize              int64
+	cache                     *fetcher.Cache
+	userAsProfile             bool
+	sharedCredentialsFile     string
+	sharedConfigFile          string
+	disableIMDS               bool
+	batchHead                 bool
+	decodeContent             bool
+	allowHTML                 bool
+	verifyParts               bool
+	listFallback              bool
+	cseKMSKeyID               string
+	latest                    bool
+	disablePreallocate        bool
+	disableMultipart          bool
+	sendURIEncoded            bool
+	reuseExisting             bool
+	partSize                  int64
+	profilePath, tracePath    string
+	profiles                  profiles
+	transcriptPath            string
+	transcript                transcriptRecorder
+	scheme                    string
+	disableSSL, accelerate    bool
+	sslCert, sslKey           string
+	tlsMinVersion             uint16
+	tlsRestrictCiphers        bool
+	fileMode                  os.FileMode
+	messageSizeLimit          atomic.Int64
+	sandboxUser               string
+	throttleAttempts          int
+	resumeAttempts            int
+	getEmptyObjects           bool
+	idleTimeout               time.Duration
+	idleTracker               *fetcher.IdleTracker
+	maxRequestRate            float64
+	throttle                  *fetcher.Throttle
+	diskSpace                 *fetcher.DiskSpace
+	clockOffset               *fetcher.ClockOffset
+	keyIndex                  *fetcher.KeyIndex
+	bucketRegions             *fetcher.BucketRegions
+	roleCache                 *fetcher.RoleCache
+	transports                *fetcher.TransportCache
+	queueMode                 string
+	maxParallel               int
+	queue                     *acquireQueue
+	filenames                 *filenameLocks
 	wg                        *sync.WaitGroup
-	stdout                    *log.Logger
+	input                     io.Reader
+	out                       *message.Writer
+	stats                     *runStats
+	statsFile                 string
+	configItems               []string
+	warnings                  sync.Map
+	newS3Client               S3ClientFactory
+	logTarget                 string
+	quiet                     int
+	diagnostics               *diagnosticsSink
+	dialSyslog                func(tag string) (syslogWriter, error)
+	clock                     clock.Clock
+	fatalErr                  chan error
+}
+
+// A ClientConfig holds the settings an S3 client is built from for a single
+// acquire.
+type ClientConfig = fetcher.ClientConfig
+
+// An S3ClientFactory builds the S3 client used for an acquire.
+type S3ClientFactory = fetcher.S3ClientFactory
+
+// An Option customizes a Method created by New.
+type Option func(*Method)
+
+// WithS3ClientFactory makes the Method build its S3 clients with the given
+// factory instead of creating AWS sessions itself.
+func WithS3ClientFactory(factory S3ClientFactory) Option {
+	return func(method *Method) {
+		method.newS3Client = factory
+	}
+}
+
+// WithClock makes the Method tell time with the given Clock instead of the
+// real one.
+func WithClock(clk clock.Clock) Option {
+	return func(method *Method) {
+		method.clock = clk
+	}
+}
+
+// Options configure a Method created by NewWithOptions.
+type Options struct {
+	// Input is where apt's messages are read from, usually os.Stdin.
+	Input io.Reader
+	// Output is where the Method's messages are written to, usually os.Stdout.
+	Output io.Writer
+	// S3ClientFactory, when set, replaces the default factory that creates
+	// AWS sessions.
+	S3ClientFactory S3ClientFactory
+	// Clock, when set, replaces the real clock.
+	Clock clock.Clock
+	// Scheme is the URI scheme the Method was installed for, when it is not
+	// plain s3, as the name of the method binary tells.
+	Scheme string
+	// DisableSSL makes the Method talk to S3 over plain HTTP.
+	DisableSSL bool
+	// Accelerate makes the Method use S3 Transfer Acceleration.
+	Accelerate bool
+	// LogLevel selects the diagnostics written to Diagnostics, usually
+	// os.Stderr, or to syslog when Acquire::s3::LogTarget is set to syslog.
+	// There are none by default.
+	LogLevel    LogLevel
+	Diagnostics io.Writer
+	// ConfigItems are configuration items in the name=value form of the
+	// Config-Item fields of apt's 601 Configuration message, such as those
+	// ReadConfigFile returns. Run applies them before reading any message, so
+	// that drivers other than apt need not send a 601 Configuration message.
+	// The items of one that is sent nonetheless take precedence.
+	ConfigItems []string
+	// Transcript, when set, names the file the messages exchanged with apt
+	// are appended to, as Acquire::s3::Transcript does.
+	Transcript string
 }
 
 // New returns a new Method configured to read from os.Stdin and write to
 // the given *log.Logger.
-func New(logger *log.Logger) *Method {
+func New(logger *log.Logger, opts ...Option) *Method {
+	method := NewWithOptions(Options{Input: os.Stdin, Output: loggerWriter{logger}})
+	for _, opt := range opts {
+		opt(method)
+	}
+	return method
+}
+
+// NewWithOptions returns a new Method configured with the given Options.
+func NewWithOptions(opts Options) *Method {
 	var waitGroup sync.WaitGroup
 	waitGroup.Add(1)
-	return &Method{
-		region:     endpoints.UsEast1RegionID,
-		endpoint:   "",
-		msgChan:    make(chan []byte),
-		configured: false,
-		wg:         &waitGroup,
-		stdout:     logger,
+	method := &Method{
+		region:       endpoints.UsEast1RegionID,
+		regionSource: regionSourceDefault,
+		imdsRegion:   true,
+		dirs:         defaultAptDirs(),
+		endpoint:     "",
+		msgChan:      make(chan []byte),
+		configured:   make(chan struct{}),
+		wg:           &waitGroup,
+		input:        opts.Input,
+		out:          message.NewWriter(opts.Output),
+		stats:        &runStats{},
+		filenames:    newFilenameLocks(),
+		fatalErr:     make(chan error, 1),
+	}
+	method.resumeAttempts, method.idleTimeout = fetcher.DefaultResumeAttempts, defaultIdleTimeout
+	method.newS3Client = opts.S3ClientFactory
+	method.scheme, method.disableSSL, method.accelerate = opts.Scheme, opts.DisableSSL, opts.Accelerate
+	method.configItems = opts.ConfigItems
+	method.transcriptPath = opts.Transcript
+	method.transcript.now = func() time.Time { return method.clock.Now() }
+	method.out.SetTap(method.transcript.recordOutput)
+	method.diagnostics, method.dialSyslog = &diagnosticsSink{}, dialSyslog
+	if opts.Diagnostics != nil {
+		method.diagnostics.level, method.diagnostics.logger = opts.LogLevel, log.New(opts.Diagnostics, version.Name+": ", 0)
+	}
+	method.sandboxUser = defaultSandboxUser
+	method.roleCache = fetcher.NewRoleCache()
+	method.transports = fetcher.NewTransportCache()
+	method.diskSpace = fetcher.NewDiskSpace()
+	method.clockOffset = fetcher.NewClockOffset()
+	method.idleTracker = fetcher.NewIdleTracker()
+	method.lookupIMDSRegion = func(ctx context.Context) (string, error) {
+		return fetcher.IMDSRegion(ctx, imdsRegionTimeout)
+	}
+	method.clock = clock.Real{}
+	if opts.Clock != nil {
+		method.clock = opts.Clock
 	}
+	return method
+}
+
+// A loggerWriter adapts a *log.Logger to an io.Writer, so that messages keep
+// going through the Logger handed to New.
+type loggerWriter struct {
+	logger *log.Logger
+}
+
+func (w loggerWriter) Write(p []byte) (int, error) {
+	w.logger.Print(string(p))
+	return len(p), nil
 }
 
 // Run flushes the Method's capabilities and then begins reading messages from
-// os.Stdin. Results are written to os.Stdout. The running Method waits for all
-// Messages to be processed before exiting.
-func (method *Method) Run() {
+// its input. Results are written to its output. The running Method waits for
+// all Messages to be processed before returning.
+//
+// In-flight acquires are cancelled when the process receives SIGINT or
+// SIGTERM, and inputDrainTimeout after apt closed the Method's input.
+//
+// If the Method encounters a condition it cannot continue from, it reports a
+// General Failure to apt and Run returns a *FatalError describing it. The
+// caller is expected to exit with a non-zero status in that case, as
+// specified in the APT method interface documentation.
+func (method *Method) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer method.closeTranscript()
+	defer method.stopProfiles()
+
 	method.flushCapabilities()
-	go method.readInput(os.Stdin)
-	go method.processMessages()
-	method.wg.Wait()
+	method.openTranscript()
+	if len(method.configItems) > 0 {
+		method.configureItems(method.configItems)
+	}
+	method.diagnose(LogLevelInfo, "Waiting for apt's messages on the input")
+	go func() {
+		method.readInput(ctx, method.input)
+		select {
+		case <-method.clock.After(inputDrainTimeout):
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	go method.processMessages(ctx)
+	go method.watchIdle(ctx)
+	err := method.wait(ctx)
+	method.writeStats()
+	if err != nil {
+		return err
+	}
+	for _, line := range method.stats.summary() {
+		method.debugf("%s", line)
+	}
+	return nil
+}
+
+// writeStats writes the outcomes of the acquires to the file
+// Acquire::s3::stats-file names, if any, warning if it cannot.
+func (method *Method) writeStats() {
+	if method.statsFile == "" {
+		return
+	}
+	if err := method.stats.writeReport(method.statsFile); err != nil {
+		method.output(warning(fmt.Sprintf("Cannot write the statistics of the run: %v", err)))
+	}
+}
+
+// wait blocks until all Messages have been processed or a fatal error
+// occurred, which it returns. Once ctx is cancelled, the cancelled acquires
+// are given cancelGracePeriod to report their failures.
+func (method *Method) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		method.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case err := <-method.fatalErr:
+		return err
+	case <-ctx.Done():
+		select {
+		case <-done:
+			return nil
+		case err := <-method.fatalErr:
+			return err
+		case <-method.clock.After(cancelGracePeriod):
+			return nil
+		}
+	}
 }
 
+// flushCapabilities announces the Method's capabilities, followed by a log
+// line naming the running version so it shows up in apt's debug output.
 func (method *Method) flushCapabilities() {
-	msg := capabilities()
-	method.stdout.Println(msg)
+	method.output(capabilities())
+	method.outputGeneralLog(fmt.Sprintf("%s %s", version.Name, version.Get()))
 }
 
 // readInput reads from the provided io.Reader and flushes each message to the
 // Method's Message channel for processing. It stops reading when io.Reader is
-// empty. Each message increments the Method's sync.WaitGroup by 1. Once all
+// empty. Each message increments the Method's sync.WaitGroup by 1 before it is
+// sent, and handleBytes decrements it once the message was processed. Once all
 // messages have been read from the io.Reader, the Method's sync.WaitGroup is
-// decremented by 1. Each code path that processes a message is responsible for
-// decrementing the WaitGroup when the code path terminates.
-func (method *Method) readInput(input io.Reader) {
-	scanner := bufio.NewScanner(input)
-	buffer := &bytes.Buffer{}
+// decremented by 1.
+//
+// Messages exceeding the size limit of configItemAcquireS3MaxMessageSize, or
+// message.DefaultMaxFields fields, are skipped and reported as a General
+// Failure without ending the Method. Reading stops as well once ctx is
+// cancelled, when Run returned and no message is processed anymore, so that
+// apt writing further messages does not block it forever.
+func (method *Method) readInput(ctx context.Context, input io.Reader) {
+	reader := message.NewReader(input)
+read:
 	for {
-		hasLine := scanner.Scan()
-		if hasLine {
-			line := scanner.Text() + "\n"
-			buffer.WriteString(line)
-			trimmed := strings.TrimRight(line, "\n")
-
-			// Messages are terminated with a blank line. If a line with no content
-			// comes in and the buffer already has some content, it's assuming that
-			// the buffer currently contains a complete message ready to be processed.
-			if len(trimmed) == 0 && buffer.Len() > 3 {
-				method.msgChan <- buffer.Bytes()
-				method.wg.Add(1)
-				buffer = &bytes.Buffer{}
-			}
-		} else {
+		reader.SetLimits(method.maxMessageSize(), message.DefaultMaxFields)
+		msg, err := reader.Read()
+		if errors.Is(err, message.ErrTooLarge) || errors.Is(err, message.ErrTooManyFields) {
+			method.outputGeneralFailure(fmt.Errorf("skipped a message from apt: %w", err))
+			continue
+		} else if err != nil {
 			break
 		}
+		method.transcript.recordInput(msg)
+		method.wg.Add(1)
+		select {
+		case method.msgChan <- msg:
+		case <-ctx.Done():
+			method.wg.Done()
+			break read
+		}
 	}
 	method.wg.Done()
 }
 
+// maxMessageSize returns the size limit of the messages read from apt.
+func (method *Method) maxMessageSize() int64 {
+	if size := method.messageSizeLimit.Load(); size > 0 {
+		return size
+	}
+	return message.DefaultMaxSize
+}
+
 func capabilities() *message.Message {
 	header := header(headerCodeCapabilities, headerDescriptionCapabilities)
 	fields := []*message.Field{
 		field(fieldNameSendConfig, fieldValueTrue),
+		field(fieldNameSendURIEncoded, fieldValueTrue),
 		field(fieldNamePipeline, fieldValueTrue),
 		field(fieldNameSingleInstance, fieldValueYes),
 	}
 	return &message.Message{Header: header, Fields: fields}
 }
 
-// processMessages loops over the channel of Messages
-// and starts a goroutine to process each Message.
-func (method *Method) processMessages() {
+// processMessages loops over the channel of Messages, handling each in a
+// goroutine of its own, until ctx is cancelled once Run returns. Configuration
+// messages are handled before the next message is taken, so that acquires
+// apt sent after its configuration use it even when Options.ConfigItems let
+// acquires proceed before it arrived.
+func (method *Method) processMessages(ctx context.Context) {
 	for {
-		bytes := <-method.msgChan
-		go method.handleBytes(bytes)
+		select {
+		case bytes := <-method.msgChan:
+			if isConfiguration(bytes) {
+				method.handleBytes(ctx, bytes)
+				continue
+			}
+			go method.handleBytes(ctx, bytes)
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
+// isConfiguration tells whether the raw message b is a 601 Configuration
+// message.
+func isConfiguration(b []byte) bool {
+	return strings.HasPrefix(string(b), strconv.Itoa(headerCodeConfiguration)+" ")
+}
+
 // handleBytes initializes a new Message and dispatches it according to
-// the Message.Header.Status value.
-func (method *Method) handleBytes(b []byte) {
+// the Message.Header.Status value. Messages the Method does not understand
+// are logged and dropped. Once the Message was processed, whatever the
+// outcome, the Method's sync.WaitGroup is decremented by 1, so that no
+// message keeps Run from returning.
+func (method *Method) handleBytes(ctx context.Context, b []byte) {
+	defer method.wg.Done()
+	defer method.recoverMessage()
 	msg, err := message.FromBytes(b)
-	method.handleError(err)
-	if msg.Header.Status == headerCodeURIAcquire {
-		// URI Acquire message
-		method.uriAcquire(msg)
-	} else if msg.Header.Status == headerCodeConfiguration {
-		// Configuration message
+	if err != nil {
+		method.handleError(fatal(err))
+		return
+	}
+	method.diagnoseMessage("Received", msg)
+	switch msg.Header.Status {
+	case headerCodeURIAcquire:
+		method.acquire(ctx, msg)
+	case headerCodeConfiguration:
 		method.configure(msg)
+	case headerCodeAuthorization, headerCodeMediaChanged:
+		// Answers to requests for credentials or media, which the Method
+		// never makes.
+	default:
+		method.debugf("Ignoring message %d %s, which the method does not understand", msg.Header.Status, msg.Header.Description)
 	}
 }
 
-// waitForConfiguration ensures that the configuration Message from APT
-// has been fully processed before continuing.
-func (method *Method) waitForConfiguration() {
-	for {
-		if method.configured {
-			return
-		}
-		time.Sleep(1 * time.Millisecond)
+// acquire runs uriAcquire and reports its error, if any: fatal errors end
+// the Method, any other error fails the requested URI only.
+func (method *Method) acquire(ctx context.Context, msg *message.Message) {
+	uri, _ := msg.GetFieldValue(fieldNameURI)
+	defer method.recoverAcquire(uri)
+	err := method.uriAcquire(ctx, msg)
+	if err == nil {
+		return
+	}
+	method.stats.failed.Add(1)
+	if isFatal(err) {
+		method.handleError(err)
+		return
 	}
+	method.outputURIFailure(uri, err)
 }
 
-// A objectLocation wraps details about the requested items location in S3.
-type objectLocation struct {
-	uri    *url.URL
-	bucket string
-	key    string
+// recoverAcquire turns a panic during the acquire of uri into a URI Failure,
+// so that a bug affecting a single object neither kills the Method without
+// a word nor fails any other acquire. The stack is written to the debug log.
+// It must be deferred directly.
+func (method *Method) recoverAcquire(uri string) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+	method.debugPanic("acquiring "+uri, recovered)
+	method.stats.failed.Add(1)
+	method.outputURIFailure(uri, fmt.Errorf("%w: %v", errPanicked, recovered))
 }
 
-func newLocation(value, s3Hostname string) (objectLocation, error) {
-	uri, err := url.Parse(preProcessURL(value))
-	if err != nil {
-		return objectLocation{}, err
+// recoverMessage turns a panic while handling a message other than a URI
+// Acquire, such as the configuration, into a General Failure: the Method
+// cannot be trusted to go on, but apt learns why it stopped. Panics during
+// an acquire are recovered by recoverAcquire already. It must be deferred
+// directly.
+func (method *Method) recoverMessage() {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+	method.debugPanic("handling a message", recovered)
+	method.handleError(fatal(fmt.Errorf("%w: %v", errPanicked, recovered)))
+}
+
+// debugPanic writes a recovered panic and the stack of the panicking
+// goroutine to the debug log.
+func (method *Method) debugPanic(during string, recovered interface{}) {
+	method.debugf("Recovered from panic %s: %v", during, recovered)
+	for _, line := range strings.Split(strings.TrimSpace(string(debug.Stack())), "\n") {
+		method.debugf("%s", line)
 	}
-	if uri.Host == s3Hostname {
-		tokens := strings.Split(uri.Path, "/")
+}
 
-		// Splitting "/bucket/this/is/a/path" on "/" produces
-		// ["", "bucket", "this", "is", "a", "path"]
-		// Note the initial empty string
-		if len(tokens) < locationMinTokensCount {
-			return objectLocation{}, errLocMissingRequiredTokens
+// waitForConfiguration ensures that the configuration Message from APT
+// has been fully processed before continuing. It returns an error if ctx is
+// cancelled first.
+func (method *Method) waitForConfiguration(ctx context.Context) error {
+	select {
+	case <-method.configured:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// uriAcquire downloads and stores objects from S3 based on the contents
+// of the provided Message. It translates the Message into a FetchRequest and
+// the result of the fetch back into Messages. Those name the URI exactly as
+// apt sent it, never as re-encoded from its parsed Location, since apt tells
+// which request a message answers by comparing the URIs as strings. The URI
+// is only brought into the percent-encoded form Locate expects, as apt sends
+// it if it honours Send-URI-Encoded, for locating and fetching the object.
+func (method *Method) uriAcquire(ctx context.Context, msg *message.Message) error {
+	uri, hasField := msg.GetFieldValue(fieldNameURI)
+	if !hasField {
+		return fatal(errAcqMsgMissingRequiredFieldURI)
+	}
+	filename, hasField := msg.GetFieldValue(fieldNameFilename)
+	if !hasField {
+		return fatal(errAcqMsgMissingRequiredFieldFilename)
+	}
+
+	if err := method.waitForConfiguration(ctx); err != nil {
+		return err
+	}
+	method.transcript.settle()
+	cfg := method.acquireConfig(uri)
+	unlock, err := method.filenames.lock(ctx, filename, uri, func(owner string) {
+		method.debugf("Waiting for the acquire of %s to finish writing %s before acquiring %s", owner, filename, uri)
+	})
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	encoded, f := cfg.encoded, cfg.fetcher
+	if cfg.queue != nil {
+		release, err := cfg.queue.enter(ctx, encoded)
+		if err != nil {
+			return err
 		}
+		defer release()
+	}
 
-		// The first non-zero length string is assumed to be the bucket. The rest are
-		// concatenated back together as the path to the object in the bucket.
-		return objectLocation{
-			uri:    uri,
-			bucket: tokens[1],
-			key:    strings.Join(tokens[2:], "/"),
-		}, nil
+	objLoc, err := f.Locate(encoded)
+	switch {
+	case errors.Is(err, fetcher.ErrEmptyKey), errors.Is(err, fetcher.ErrInvalidBucket), errors.Is(err, fetcher.ErrInvalidARN),
+		errors.Is(err, fetcher.ErrInvalidRegion), errors.Is(err, fetcher.ErrInvalidURI):
+		return err
+	case err != nil:
+		// Otherwise the configured endpoint, which every acquire shares, is
+		// invalid.
+		return fatal(err)
+	}
+	clientCfg := f.ClientConfig(objLoc)
+	method.warnCredentials(fetcher.SelectCredentials(clientCfg))
+	method.warnDefaultRegion(objLoc)
+	method.warnRegionParameter(objLoc)
+	if clientCfg.Profile != "" {
+		method.debugf("Taking the user name %s of the URI as the shared profile to read credentials from", clientCfg.Profile)
+	}
+	credentials := fetcher.DescribeCredentials(clientCfg)
+	method.debugf("Using %s for s3://%s/%s", credentials, objLoc.Bucket, objLoc.Key)
+
+	// Heartbeats keep apt from timing out while S3 is slow to answer the
+	// request for the object's metadata, and then tell it how far along the
+	// download is.
+	stopHeartbeat := func() {}
+	defer func() { stopHeartbeat() }()
+	var written atomic.Int64
+	result, err := f.Fetch(ctx, fetcher.FetchRequest{
+		URI:            encoded,
+		Filename:       filename,
+		ExpectedHashes: expectedHashes(msg),
+		MaxSize:        sizeField(msg, fieldNameMaximumSize),
+		ExpectedSize:   sizeField(msg, fieldNameExpectedSize),
+		OnConnect: func(host string) {
+			method.outputRequestStatus(uri, fmt.Sprintf(fieldValueConnecting, host))
+		},
+		OnHeaders: func() {
+			stopHeartbeat()
+			method.outputRequestStatus(uri, fieldValueWaitingForHeaders)
+			stopHeartbeat = method.startHeartbeat(ctx, uri, fieldValueWaitingForHeaders)
+		},
+		OnStart: func(obj fetcher.Object) {
+			stopHeartbeat()
+			method.outputURIStart(uri, obj.Size, obj.LastModified)
+			stopHeartbeat = method.startProgress(ctx, uri, obj.Size, written.Load)
+		},
+		OnProgress: written.Store,
+		OnFallback: func(endpoint string, err error) {
+			method.debugf("Falling back to %s for s3://%s/%s: %v", endpoint, objLoc.Bucket, objLoc.Key, err)
+		},
+		OnThrottle: func(delay time.Duration) {
+			method.outputRequestStatus(uri, fmt.Sprintf(fieldValueThrottled, max(delay.Round(time.Second), time.Second)))
+		},
+		OnClockSkew: method.warnClockSkew,
+		OnBucketRegion: func(region string, err error) {
+			if err != nil {
+				method.output(warning(fmt.Sprintf("Cannot discover the region of bucket %s, using %s: %v", objLoc.Bucket, cfg.region, err)))
+				return
+			}
+			method.debugf("Discovered the region %s of bucket %s", region, objLoc.Bucket)
+		},
+		OnCredentialsRefresh: func(reason string, info fetcher.CredentialsInfo) {
+			method.debugf("Refreshed credentials for s3://%s/%s as %s, now expiring at %s",
+				objLoc.Bucket, objLoc.Key, reason, info.Expires.UTC().Format(time.RFC3339))
+		},
+		OnSequentialRetry: func(err error) {
+			method.debugf("Downloading s3://%s/%s again in a single request: %v", objLoc.Bucket, objLoc.Key, err)
+		},
+		OnResume: func(offset int64, err error) {
+			method.debugf("Resuming s3://%s/%s at byte %d: %v", objLoc.Bucket, objLoc.Key, offset, err)
+		},
+		OnObjectChanged: func(err error) {
+			method.debugf("Fetching s3://%s/%s again as it changed during the download: %v", objLoc.Bucket, objLoc.Key, err)
+		},
+		OnDiskSpaceWait: func(err error) {
+			stopHeartbeat()
+			status := fmt.Sprintf(fieldValueWaitingForSpace, err)
+			method.outputRequestStatus(uri, status)
+			stopHeartbeat = method.startHeartbeat(ctx, uri, status)
+		},
+	})
+	// No Status may follow the Done or Failure of the URI.
+	stopHeartbeat()
+	if fetcher.IsCredentialError(err) {
+		err = fmt.Errorf("%w (using %s)", err, credentials)
+	}
+	switch {
+	case errors.Is(err, fetcher.ErrNotFound):
+		method.outputNotFound(uri, objLoc, true)
+		return nil
+	case errors.Is(err, fetcher.ErrBucketNotFound):
+		method.outputNotFound(uri, objLoc, false)
+		return nil
+	case err != nil:
+		return acquireError(err)
 	}
 
-	if strings.HasSuffix(uri.Host, s3Hostname) {
-		return objectLocation{
-			uri:    uri,
-			bucket: strings.TrimSuffix(uri.Host, "."+s3Hostname),
-			key:    uri.Path[1:],
-		}, nil
+	method.stats.recordResult(result)
+	if result.Reused {
+		method.debugf("Kept %s, which already matches the expected hashes of s3://%s/%s", filename, objLoc.Bucket, objLoc.Key)
+		method.outputURIDone(uriDone(uri, result, filename))
+		return nil
 	}
+	method.stats.record(result.Timings)
+	if result.Cached {
+		method.debugf("Copied s3://%s/%s from the cache, unchanged at %s", objLoc.Bucket, objLoc.Key, result.Endpoint)
+	} else {
+		method.debugf("Fetched s3://%s/%s from %s", objLoc.Bucket, objLoc.Key, result.Endpoint)
+	}
+	if result.LatestKey != "" {
+		method.debugf("Resolved s3://%s/%s to the latest key %s", objLoc.Bucket, objLoc.Key, result.LatestKey)
+	}
+	if result.Decoded {
+		method.debugf("Decoded gzip content of s3://%s/%s to %d bytes", objLoc.Bucket, objLoc.Key, result.Size)
+	}
+	if result.Decrypted {
+		keyID := result.KMSKeyID
+		if keyID == "" {
+			keyID = "named in its envelope"
+		}
+		method.debugf("Decrypted s3://%s/%s to %d bytes with KMS key %s", objLoc.Bucket, objLoc.Key, result.Size, keyID)
+	}
+	if creds := result.Credentials; creds.Container() {
+		method.debugf("Signed s3://%s/%s with container credentials expiring at %s",
+			objLoc.Bucket, objLoc.Key, creds.Expires.UTC().Format(time.RFC3339))
+	}
+	method.debugf("Timings for s3://%s/%s: %s", objLoc.Bucket, objLoc.Key, result.Timings)
+	method.outputURIDone(uriDone(uri, result, filename))
+	return nil
+}
+
+// An acquireConfig is what an acquire takes of the Method's configuration
+// when it starts, so that a configuration apt sends while it runs, which
+// Options.ConfigItems lets happen, changes nothing for it halfway.
+type acquireConfig struct {
+	fetcher *fetcher.Fetcher
+	queue   *acquireQueue
+	encoded string
+	region  string
+}
 
-	return objectLocation{
-		uri:    uri,
-		bucket: uri.Host,
-		key:    uri.Path[1:],
-	}, nil
+// acquireConfig returns the acquireConfig of an acquire of uri starting now.
+func (method *Method) acquireConfig(uri string) acquireConfig {
+	method.configMu.RLock()
+	defer method.configMu.RUnlock()
+	return acquireConfig{fetcher: method.fetcher(), queue: method.queue, encoded: method.encodeURI(uri), region: method.region}
 }
 
-// Replace any forward slashes in access key and secret.
-func preProcessURL(url string) string {
-	idx := strings.Index(url, "@")
-	if idx < 0 {
-		return url
+// encodeURI returns the given URI in the percent-encoded form Locate expects.
+// apt sends it in that form once configItemAcquireSendURIEncoded tells that it
+// honours the capability, apart from the stray '%' of URIs whose source was
+// decoded, and decoded otherwise.
+func (method *Method) encodeURI(uri string) string {
+	if method.sendURIEncoded {
+		return fetcher.EscapeStrayPercents(uri)
 	}
-	sub := url[0:idx] // drop everything after the @
-	sub = sub[5:]     // drop the s3://
+	return fetcher.EncodeURI(uri)
+}
 
-	key := ""
-	secret := ""
-	tkns := strings.Split(sub, ":")
-	if len(tkns) == userAndPasswordFormattedTokensCount {
-		key = tkns[0]
-		secret = tkns[1]
+// warnCredentials emits a Warning if the credentials selected for an acquire
+// leave other available credential sources unused, as a stale access key in
+// the sources list would. Each distinct selection is warned about only once.
+func (method *Method) warnCredentials(selection fetcher.CredentialSelection) {
+	if len(selection.Ignored) == 0 {
+		return
 	}
-	processedKey := strings.ReplaceAll(key, "/", "%2F")
-	processedSecret := strings.ReplaceAll(secret, "/", "%2F")
+	ignored := make([]string, len(selection.Ignored))
+	for idx, source := range selection.Ignored {
+		ignored[idx] = string(source)
+	}
+	text := fmt.Sprintf("Using %s for credentials, ignoring %s", selection.Used, strings.Join(ignored, " and "))
+	if _, warned := method.warnings.LoadOrStore(text, true); !warned {
+		method.output(warning(text))
+	}
+}
 
-	p := strings.ReplaceAll(url, key, processedKey)
-	p = strings.ReplaceAll(p, secret, processedSecret)
+// warnDefaultRegion emits a Warning if an acquire from AWS relies on the region
+// the Method defaults to, as resolveRegion found none, which fails with an
+// opaque error for buckets in any other region. It is warned about only once.
+func (method *Method) warnDefaultRegion(loc fetcher.Location) {
+	method.configMu.RLock()
+	defer method.configMu.RUnlock()
+	if method.regionSource != regionSourceDefault || method.regionAuto || loc.Region != "" || loc.Endpoint != "" || method.endpoint != "" {
+		return
+	}
+	text := fmt.Sprintf("No region is configured, assuming %s; set %s to the region of the bucket if it is in another one",
+		method.region, configItemAcquireS3Region)
+	if _, warned := method.warnings.LoadOrStore(text, true); !warned {
+		method.output(warning(text))
+	}
+}
 
-	return p
+// warnClockSkew emits a Warning once the fetcher measured the system clock to
+// be off from the Date of S3's responses by more than
+// fetcher.ClockSkewThreshold. A positive skew means S3's clock is ahead.
+func (method *Method) warnClockSkew(skew time.Duration) {
+	direction := "behind"
+	if skew < 0 {
+		direction, skew = "ahead of", -skew
+	}
+	method.output(warning(fmt.Sprintf("The system clock is %s %s S3's; times compared with S3's are corrected by that much, "+
+		"but the clock should be synchronised, e.g. with timedatectl set-ntp true", skew.Round(time.Second), direction)))
 }
 
-// uriAcquire downloads and stores objects from S3 based on the contents
-// of the provided Message.
-func (method *Method) uriAcquire(msg *message.Message) {
-	method.waitForConfiguration()
+// warnRegionParameter emits a Warning if the region a URI names in its query
+// overrides a different configured region. Each conflict is warned about only
+// once.
+func (method *Method) warnRegionParameter(loc fetcher.Location) {
+	method.configMu.RLock()
+	defer method.configMu.RUnlock()
+	region := loc.URI.Query().Get(fetcher.RegionParameter)
+	if !method.regionConfigured || region == "" || region != loc.Region || region == method.region {
+		return
+	}
+	text := fmt.Sprintf("Using the region %s of the URI for bucket %s rather than the region %s of %s",
+		region, loc.Bucket, method.region, configItemAcquireS3Region)
+	if _, warned := method.warnings.LoadOrStore(text, true); !warned {
+		method.output(warning(text))
+	}
+}
 
-	uri, hasField := msg.GetFieldValue(fieldNameURI)
-	if !hasField {
-		method.handleError(errAcqMsgMissingRequiredFieldURI)
+// fetcher returns a Fetcher for the Method's current configuration, with
+// copies of its maps and lists, which later configuration items add to.
+func (method *Method) fetcher() *fetcher.Fetcher {
+	opts := []fetcher.Option{fetcher.WithClock(method.clock)}
+	if method.newS3Client != nil {
+		opts = append(opts, fetcher.WithS3ClientFactory(method.newS3Client))
+	}
+	cfg := fetcher.Config{
+		Region:                method.region,
+		Endpoint:              method.endpoint,
+		FallbackEndpoints:     slices.Clone(method.fallbackEndpoints),
+		BucketAliases:         maps.Clone(method.bucketAliases),
+		HostEndpoints:         maps.Clone(method.hostEndpoints),
+		RoleARN:               method.roleARN,
+		RoleSourceIdentity:    method.roleSourceIdentity,
+		STSEndpoint:           method.stsEndpoint,
+		RoleCache:             method.roleCache,
+		Transports:            method.transports,
+		AuthEntries:           slices.Clone(method.authEntries),
+		Fsync:                 method.fsync,
+		Cache:                 method.cache,
+		UserAsProfile:         method.userAsProfile,
+		SharedCredentialsFile: method.sharedCredentialsFile,
+		SharedConfigFile:      method.sharedConfigFile,
+		DisableIMDS:           method.disableIMDS,
+		DisableSSL:            method.disableSSL,
+		Accelerate:            method.accelerate,
+		SSLCert:               method.sslCert,
+		SSLKey:                method.sslKey,
+		TLSMinVersion:         method.tlsMinVersion,
+		TLSRestrictCiphers:    method.tlsRestrictCiphers,
+		FileMode:              method.fileMode,
+		SandboxUser:           method.sandboxUser,
+		KeyIndex:              method.keyIndex,
+		BucketRegions:         method.bucketRegions,
+		DecodeContent:         method.decodeContent,
+		AllowHTML:             method.allowHTML,
+		VerifyParts:           method.verifyParts,
+		ListFallback:          method.listFallback,
+		CSEKMSKeyID:           method.cseKMSKeyID,
+		Latest:                method.latest,
+		DisablePreallocate:    method.disablePreallocate,
+		DisableMultipart:      method.disableMultipart,
+		ResumeAttempts:        method.resumeAttempts,
+		GetEmptyObjects:       method.getEmptyObjects,
+		IdleTimeout:           method.idleTimeout,
+		IdleTracker:           method.idleTracker,
+		ReuseExisting:         method.reuseExisting,
+		PartSize:              method.partSize,
+		Throttle:              method.throttle,
+		DiskSpace:             method.diskSpace,
+		ClockOffset:           method.clockOffset,
 	}
+	return fetcher.New(cfg, opts...)
+}
 
-	var s3URL *url.URL
-	var err error
-	if method.endpoint != "" {
-		s3URL, err = url.Parse(method.endpoint)
-		if err != nil {
-			method.handleError(fmt.Errorf("parsing S3 endpoint %s: %w", method.endpoint, err))
-		}
-	} else {
-		s3URL, err = s3EndpointURL(method.region)
-		if err != nil {
-			method.handleError(fmt.Errorf("resolving S3 endpoint for region %s: %w", method.region, err))
+// expectedHashes returns the digests apt expects the acquired file to have,
+// as given by the Expected-* fields of a URI Acquire Message.
+func expectedHashes(msg *message.Message) fetcher.Digests {
+	var digests fetcher.Digests
+	for _, h := range fetcher.Hashes {
+		for _, name := range h.Names() {
+			if digest, hasField := msg.GetFieldValue(fieldNameExpectedPrefix + name); hasField {
+				digests.Set(h, digest)
+			}
 		}
 	}
+	return digests
+}
 
-	objLoc, err := newLocation(uri, s3URL.Hostname())
-	method.handleError(err)
+// sizeField returns the size a field of a URI Acquire Message, such as
+// Maximum-Size, gives, or zero if there is no valid one.
+func sizeField(msg *message.Message, name string) int64 {
+	value, hasField := msg.GetFieldValue(name)
+	if !hasField {
+		return 0
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return size
+}
 
-	method.outputRequestStatus(objLoc.uri, fieldValueConnecting)
+// configure loops though the Config-Item fields of a configuration Message and
+// sets the appropriate state on the Method based on the field values.
+func (method *Method) configure(msg *message.Message) {
+	method.configureItems(configItems(msg))
+}
 
-	client := method.s3Client(objLoc.uri.User)
+// configItems returns the values of the Config-Item fields of a 601
+// Configuration message, in the name=value form applyConfig takes.
+func configItems(msg *message.Message) []string {
+	fields := msg.GetFieldList(fieldNameConfigItem)
+	items := make([]string, len(fields))
+	for idx, f := range fields {
+		items[idx] = f.Value
+	}
+	return items
+}
 
-	headObjectInput := &s3.HeadObjectInput{Bucket: &objLoc.bucket, Key: &objLoc.key}
-	headObjectOutput, err := client.HeadObject(headObjectInput)
+// configureItems applies the given configuration items, whether apt sent them
+// or Options.ConfigItems gave them, and marks the Method configured unless
+// they hold a fatal error. Items applied later replace the values of those
+// applied earlier, and add to their lists.
+func (method *Method) configureItems(items []string) {
+	method.configMu.Lock()
+	defer method.configMu.Unlock()
+	problems, err := method.applyConfig(items)
+	method.applyLogTarget()
+	for _, problem := range problems {
+		method.reportConfigProblem(problem)
+	}
 	if err != nil {
-		//nolint:errorlint
-		if reqErr, ok := err.(awserr.RequestFailure); ok {
-			if reqErr.StatusCode() == http.StatusNotFound {
-				method.outputNotFound(objLoc.uri)
-				return
-			}
-			// if the error is an awserr.RequestFailure, but the status was not 404
-			// handle the error
-			method.handleError(err)
-		} else {
-			method.handleError(err)
-		}
+		// The Method is left unconfigured, so that no acquire is processed.
+		method.handleError(err)
+		return
+	}
+	method.openCache()
+	if err := method.profiles.start(method.profilePath, method.tracePath); err != nil {
+		method.output(warning(fmt.Sprintf("Cannot profile the run: %v", err)))
+	}
+	method.openTranscript()
+	method.debugf("Reading shared AWS configuration from %s", method.sharedFiles())
+	if method.scheme != "" {
+		method.debugf("Running as the %s method, plain HTTP %t, Transfer Acceleration %t",
+			method.scheme, method.disableSSL, method.accelerate)
+	}
+	if method.batchHead && method.keyIndex == nil {
+		method.keyIndex = fetcher.NewKeyIndex()
 	}
+	if method.regionAuto && method.bucketRegions == nil {
+		method.bucketRegions = fetcher.NewBucketRegions()
+	}
+	// The acquires in flight keep counting against the queue and being held
+	// back by the throttle.
+	if method.queue == nil {
+		method.queue = newAcquireQueue(method.maxParallel, method.queueMode == queueModeHost)
+	} else {
+		method.queue.configure(method.maxParallel, method.queueMode == queueModeHost)
+	}
+	method.debugf("Running %s", method.queue)
+	if method.throttle == nil {
+		method.throttle = fetcher.NewThrottle(method.throttleAttempts, method.maxRequestRate, method.clock)
+	} else {
+		method.throttle.Configure(method.throttleAttempts, method.maxRequestRate)
+	}
+	method.debugf("Throttling S3 requests with %s", method.throttle)
+	method.configuredOnce.Do(func() { close(method.configured) })
+}
 
-	expectedLen := *headObjectOutput.ContentLength
-	lastModified := *headObjectOutput.LastModified
-	method.outputURIStart(objLoc.uri, expectedLen, lastModified)
+// applyConfig sets the given configuration items on the Method and resolves
+// the settings they imply, the same way for apt's configuration and for the
+// doctor and get commands. It returns the problems with the Acquire::s3
+// items, those setConfigItem returns followed by those of configConflicts,
+// for the caller to report, unless Acquire::s3::strict turns them into a
+// FatalError. The auth.conf entries are loaded and the region is resolved,
+// and a FatalError is also returned if the provider preset lacks a setting or
+// an endpoint is invalid.
+func (method *Method) applyConfig(items []string) ([]error, error) {
+	var problems []error
+	for _, item := range items {
+		if err := method.setConfigItem(item); err != nil && isS3ConfigItem(item) {
+			problems = append(problems, err)
+		}
+	}
+	problems = append(problems, method.configConflicts()...)
+	if method.strict && len(problems) > 0 {
+		return nil, fatal(strictConfigError(problems))
+	}
+	method.loadAuthConf()
+	if err := method.applyProvider(); err != nil {
+		return problems, err
+	}
+	method.resolveRegion()
+	return problems, method.validateEndpoints()
+}
 
-	filename, hasField := msg.GetFieldValue(fieldNameFilename)
-	if !hasField {
-		method.handleError(errAcqMsgMissingRequiredFieldFilename)
+// reportConfigProblem reports a problem applyConfig found, unless
+// Acquire::s3::strict turned it into a failure: invalid values and conflicting
+// items as warnings, as they are not applied as intended, and unknown items in
+// the debug output.
+func (method *Method) reportConfigProblem(problem error) {
+	switch {
+	case errors.Is(problem, errUnknownItem):
+		method.debugf("Ignoring configuration item %v", problem)
+	case errors.Is(problem, fetcher.ErrInvalidEndpoint):
+		// validateEndpoints fails the run for these.
+	case errors.Is(problem, errNeedsItem), errors.Is(problem, errConflicting):
+		method.output(warning(fmt.Sprintf("Conflicting configuration items: %v", problem)))
+	default:
+		method.output(warning(fmt.Sprintf("Invalid configuration item %v", problem)))
 	}
-	file, err := os.Create(filename)
-	method.handleError(err)
-	defer file.Close()
+}
 
-	downloader := s3manager.NewDownloaderWithClient(client)
-	numBytes, err := downloader.Download(file,
-		&s3.GetObjectInput{
-			Bucket: aws.String(objLoc.bucket),
-			Key:    aws.String(objLoc.key),
-		})
-	method.handleError(err)
+// stopProfiles stops the captures Acquire::s3::Profile and Acquire::s3::Trace
+// started, writing them out however the run ended.
+func (method *Method) stopProfiles() {
+	if err := method.profiles.stop(); err != nil {
+		method.output(warning(fmt.Sprintf("Cannot write the profile of the run: %v", err)))
+	}
+}
 
-	method.outputURIDone(objLoc.uri, numBytes, lastModified, filename)
+// openTranscript starts recording the messages exchanged with apt to the file
+// Options.Transcript or Acquire::s3::Transcript names, if any, warning if it
+// cannot be opened.
+func (method *Method) openTranscript() {
+	if method.transcriptPath == "" {
+		return
+	}
+	if err := method.transcript.open(method.transcriptPath); err != nil {
+		method.output(warning(fmt.Sprintf("Cannot write a transcript of the run: %v", err)))
+	}
 }
 
-// s3Client provides an initialized s3iface.S3API based on the contents of the
-// provided url.URL. The access key id and secret access key are assumed to
-// correspond to the Username() and Password() functions on the URL's User.
-func (method *Method) s3Client(user *url.Userinfo) s3iface.S3API {
-	config := &aws.Config{
-		Region: aws.String(method.region),
+// closeTranscript stops recording the messages exchanged with apt, warning if
+// the transcript could not be written completely.
+func (method *Method) closeTranscript() {
+	if err := method.transcript.close(); err != nil {
+		method.output(warning(fmt.Sprintf("Cannot write a transcript of the run: %v", err)))
 	}
-	if method.endpoint != "" {
-		config.Endpoint = aws.String(method.endpoint)
+}
+
+// validateEndpoints returns a FatalError if the configured endpoint, any
+// fallback endpoint or any endpoint of a host is neither a URL nor a valid
+// endpoint template.
+func (method *Method) validateEndpoints() error {
+	endpoints := append([]string{method.endpoint}, method.fallbackEndpoints...)
+	for _, endpoint := range method.hostEndpoints {
+		endpoints = append(endpoints, endpoint)
 	}
-	sess, err := session.NewSession(config)
-	if err != nil {
-		method.handleError(fmt.Errorf("creating AWS session: %w", err))
-	}
-	if accessKeyID := user.Username(); accessKeyID != "" {
-		// Use explicitly specified static credentials to access S3
-		if secretAccessKey, ok := user.Password(); ok {
-			config.Credentials = credentials.NewStaticCredentials(accessKeyID, secretAccessKey, "")
-		} else {
-			method.handleError(errAcqMsgMissingRequiredFieldPassword)
+	for _, endpoint := range endpoints {
+		if endpoint == "" {
+			continue
+		}
+		if err := fetcher.ValidateEndpoint(endpoint); err != nil {
+			return fatal(err)
 		}
-	} else if method.roleARN != "" {
-		// Use default credential chain to assume specified role
-		config.Credentials = stscreds.NewCredentials(sess, method.roleARN)
 	}
-
-	return s3.New(sess, config)
+	return nil
 }
 
-// configure loops though the Config-Item fields of a configuration Message and
-// sets the appropriate state on the Method based on the field values. Once the
-// configuration has been applied, the Method's sync.WaitGroup is decremented
-// by 1.
-func (method *Method) configure(msg *message.Message) {
-	items := msg.GetFieldList(fieldNameConfigItem)
-	for _, f := range items {
-		config := strings.Split(f.Value, "=")
-		switch config[0] {
-		case configItemAcquireS3Region:
-			method.region = config[1]
-		case configItemAcquireS3Role:
-			method.roleARN = config[1]
-		case configItemAcquireS3Endpoint:
-			method.endpoint = config[1]
+// sharedFiles describes the shared AWS configuration files the Method reads
+// credentials from, noting those that do not exist.
+func (method *Method) sharedFiles() string {
+	cfg := fetcher.ClientConfig{
+		SharedCredentialsFile: method.sharedCredentialsFile,
+		SharedConfigFile:      method.sharedConfigFile,
+	}
+	files := cfg.SharedFiles()
+	if len(files) == 0 {
+		return "no files, as the home directory is unknown"
+	}
+	for idx, file := range files {
+		if _, err := os.Stat(file); err != nil {
+			files[idx] += " (not found)"
 		}
 	}
-	method.configured = true
-	method.wg.Done()
+	return strings.Join(files, ", ")
+}
+
+// setConfigItem applies a single "name=value" configuration item as
+// applyConfigItem describes, returning its error for items the Method does
+// not know about and values it does not apply.
+func (method *Method) setConfigItem(item string) error {
+	name, value, _ := strings.Cut(item, "=")
+	return method.applyConfigItem(name, value)
+}
+
+// isS3ConfigItem tells whether the named configuration item is below
+// Acquire::s3, which like apt it compares case-insensitively.
+func isS3ConfigItem(name string) bool {
+	return len(name) >= len(aptConfigS3Prefix) && strings.EqualFold(name[:len(aptConfigS3Prefix)], aptConfigS3Prefix)
 }
 
 // requestStatus constructs a Message that when printed looks like the
@@ -431,9 +1199,9 @@ func (method *Method) configure(msg *message.Message) {
 // 102 Status
 // URI: s3://fake-access-key-id:fake-secret-access-key@s3.amazonaws.com/bucket-name/apt/trusty/riemann-sumd_0.7.2-1_all.deb
 // Message: Connecting to s3.amazonaws.com
-func requestStatus(s3Uri *url.URL, status string) *message.Message {
+func requestStatus(uri string, status string) *message.Message {
 	h := header(headerCodeStatus, headerDescriptionStatus)
-	uriField := field(fieldNameURI, s3Uri.String())
+	uriField := field(fieldNameURI, uri)
 	messageField := field(fieldNameMessage, status)
 	return &message.Message{Header: h, Fields: []*message.Field{uriField, messageField}}
 }
@@ -445,12 +1213,19 @@ func requestStatus(s3Uri *url.URL, status string) *message.Message {
 // URI: s3://fake-access-key-id:fake-secret-access-key@s3.amazonaws.com/bucket-name/apt/trusty/riemann-sumd_0.7.2-1_all.deb
 // Size: 9012
 // Last-Modified: Thu, 25 Oct 2018 20:17:39 GMT
-func (method *Method) uriStart(s3Uri *url.URL, size int64, t time.Time) *message.Message {
+//
+// The Size field is omitted if size is negative, and the Last-Modified field
+// if t is the zero time, as S3 did not report them.
+func uriStart(uri string, size int64, t time.Time) *message.Message {
 	h := header(headerCodeURIStart, headerDescriptionURIStart)
-	uriField := field(fieldNameURI, s3Uri.String())
-	sizeField := field(fieldNameSize, strconv.FormatInt(size, 10))
-	lmField := method.lastModified(t)
-	return &message.Message{Header: h, Fields: []*message.Field{uriField, sizeField, lmField}}
+	fields := []*message.Field{field(fieldNameURI, uri)}
+	if size >= 0 {
+		fields = append(fields, field(fieldNameSize, strconv.FormatInt(size, 10)))
+	}
+	if !t.IsZero() {
+		fields = append(fields, lastModified(t))
+	}
+	return &message.Message{Header: h, Fields: fields}
 }
 
 // uriDone constructs a Message that when printed looks like the following
@@ -467,25 +1242,22 @@ func (method *Method) uriStart(s3Uri *url.URL, size int64, t time.Time) *message
 // SHA256-Hash: 92a3f70eb1cf2c69880988a8e74dc6fea7e4f15ee261f74b9be55c866f69c64b
 // SHA512-Hash: ab3b1c94618cb58e2147db1c1d4bd3472f17fb11b1361e77216b461ab7d5f5952a5c6bb0443a1507d8ca5ef1eb18ac7552d0f2a537a0d44b8612d7218bf379fb
 //
+// The Last-Modified field is omitted if S3 did not report it.
+//
 //nolint:lll
-func (method *Method) uriDone(s3Uri *url.URL, size int64, t time.Time, filename string) *message.Message {
-	uriField := field(fieldNameURI, s3Uri.String())
-	filenameField := field(fieldNameFilename, filename)
-	sizeField := field(fieldNameSize, strconv.FormatInt(size, 10))
-	lmField := method.lastModified(t)
-	fileBytes, err := os.ReadFile(filename)
-	method.handleError(err)
-
+func uriDone(uri string, result fetcher.FetchResult, filename string) *message.Message {
 	fields := []*message.Field{
-		uriField,
-		filenameField,
-		sizeField,
-		lmField,
-		method.md5Field(fileBytes),
-		method.md5SumField(fileBytes),
-		method.sha1Field(fileBytes),
-		method.sha256Field(fileBytes),
-		method.sha512Field(fileBytes),
+		field(fieldNameURI, uri),
+		field(fieldNameFilename, filename),
+		field(fieldNameSize, strconv.FormatInt(result.Size, 10)),
+	}
+	if !result.LastModified.IsZero() {
+		fields = append(fields, lastModified(result.LastModified))
+	}
+	for _, h := range fetcher.Hashes {
+		for _, name := range h.Names() {
+			fields = append(fields, field(name+fieldNameHashSuffix, result.Digests.Get(h)))
+		}
 	}
 
 	return &message.Message{Header: header(headerCodeURIDone, headerDescriptionURIDone), Fields: fields}
@@ -495,24 +1267,53 @@ func (method *Method) uriDone(s3Uri *url.URL, size int64, t time.Time, filename
 // example:
 //
 // 400 URI Failure
-// Message: The specified key does not exist.
 // URI: s3://fake-access-key-id:fake-secret-access-key@s3.amazonaws.com/bucket-name/apt/trusty/riemann-sumd_0.7.2-1_all.deb
-func notFound(s3Uri *url.URL) *message.Message {
+// Message: The specified key does not exist. Bucket: bucket-name, Key: apt/trusty/riemann-sumd_0.7.2-1_all.deb
+//
+// If the bucket does not exist either, the Message says so instead.
+//
+//nolint:lll
+func notFound(uri string, objLoc fetcher.Location, bucketExists bool) *message.Message {
 	h := header(headerCodeURIFailure, headerDescriptionURIFailure)
-	uriField := field(fieldNameURI, s3Uri.String())
-	messageField := field(fieldNameMessage, fieldValueNotFound)
+	uriField := field(fieldNameURI, uri)
+	value := fmt.Sprintf("%s Bucket: %s, Key: %s", fieldValueNotFound, objLoc.Bucket, objLoc.Key)
+	if !bucketExists {
+		value = fmt.Sprintf("%s Bucket: %s", fieldValueBucketNotFound, objLoc.Bucket)
+	}
+	messageField := field(fieldNameMessage, value)
 	return &message.Message{Header: h, Fields: []*message.Field{uriField, messageField}}
 }
 
+// uriFailure constructs a Message that when printed looks like the following
+// example:
+//
+// 400 URI Failure
+// URI: s3://fake-access-key-id:fake-secret-access-key@s3.amazonaws.com/bucket-name/apt/trusty/riemann-sumd_0.7.2-1_all.deb
+// Message: context canceled
+func uriFailure(uri string, err error) *message.Message {
+	h := header(headerCodeURIFailure, headerDescriptionURIFailure)
+	uriField := field(fieldNameURI, uri)
+	messageField := field(fieldNameMessage, failureText(err))
+	return &message.Message{Header: h, Fields: []*message.Field{uriField, messageField}}
+}
+
+// warning constructs a Message that when printed looks like the following
+// example:
+//
+// 104 Warning
+// Message: Using the access key of the URI or auth.conf for credentials, ignoring the role of Acquire::s3::role
+//
+//nolint:lll
+func warning(text string) *message.Message {
+	h := header(headerCodeWarning, headerDescriptionWarning)
+	return &message.Message{Header: h, Fields: []*message.Field{field(fieldNameMessage, text)}}
+}
+
 // generalLog constructs a Message that when printed looks like the following
 // example:
 //
 // 101 Log
 // Message: Set the s3 region to us-west-1 based on Config-Item Acquire::s3:region.
-//
-// This function is unused, but it's part of the spec...
-//
-//nolint:unused
 func generalLog(status string) *message.Message {
 	h := header(headerCodeGeneralLog, headerDescriptionGeneralLog)
 	messageField := field(fieldNameMessage, status)
@@ -526,56 +1327,93 @@ func generalLog(status string) *message.Message {
 // Message: Error retrieving ...
 func generalFailure(err error) *message.Message {
 	h := header(headerCodeGeneralFailure, headerDescriptionGeneralFailure)
-	msg := strings.ReplaceAll(err.Error(), "\n", " ")
-	messageField := field(fieldNameMessage, msg)
+	messageField := field(fieldNameMessage, failureText(err))
 	return &message.Message{Header: h, Fields: []*message.Field{messageField}}
 }
 
-func (method *Method) outputRequestStatus(s3Uri *url.URL, status string) {
-	msg := requestStatus(s3Uri, status)
-	method.stdout.Println(msg.String())
+// outputRequestStatus writes a Status message about uri, unless apt runs at
+// quietStatusLevel or above, as apt-get -qq does, where only the messages apt
+// needs to track the acquire are sent.
+func (method *Method) outputRequestStatus(uri string, status string) {
+	if method.quiet >= quietStatusLevel {
+		return
+	}
+	msg := requestStatus(uri, status)
+	method.output(msg)
 }
 
-// This function is unused, but it's part of the spec...
-//
-//nolint:unused
 func (method *Method) outputGeneralLog(status string) {
 	msg := generalLog(status)
-	method.stdout.Println(msg.String())
+	method.output(msg)
 }
 
-func (method *Method) outputURIStart(s3Uri *url.URL, size int64, lastModified time.Time) {
-	msg := method.uriStart(s3Uri, size, lastModified)
-	method.stdout.Println(msg.String())
+// debugf writes a Log message when debug output was enabled with the
+// Debug::Acquire::s3 configuration item.
+func (method *Method) debugf(format string, args ...interface{}) {
+	method.diagnose(LogLevelDebug, format, args...)
+	if method.debug.Load() {
+		method.outputGeneralLog(fmt.Sprintf(format, args...))
+	}
 }
 
-// outputURIDone prints a message including the details of the finished URI,
-// and subsequently decrements the Method's sync.WaitGroup by 1.
-func (method *Method) outputURIDone(s3Uri *url.URL, size int64, lastModified time.Time, filename string) {
-	msg := method.uriDone(s3Uri, size, lastModified, filename)
-	method.stdout.Println(msg.String())
-	method.wg.Done()
+func (method *Method) outputURIStart(uri string, size int64, lastModified time.Time) {
+	msg := uriStart(uri, size, lastModified)
+	method.output(msg)
 }
 
-// outputURIDone prints a message including the details of the URI that could
-// not be found, and subsequently decrements the Method's sync.WaitGroup by 1.
-func (method *Method) outputNotFound(s3Uri *url.URL) {
-	msg := notFound(s3Uri)
-	method.stdout.Println(msg.String())
-	method.wg.Done()
+// outputURIDone prints the given URI Done message.
+func (method *Method) outputURIDone(msg *message.Message) {
+	method.output(msg)
+}
+
+// outputNotFound prints a message including the details of the URI that could
+// not be found.
+func (method *Method) outputNotFound(uri string, objLoc fetcher.Location, bucketExists bool) {
+	method.stats.failed.Add(1)
+	msg := notFound(uri, objLoc, bucketExists)
+	method.output(msg)
+}
+
+// outputURIFailure prints a message reporting that the given URI could not be
+// acquired.
+func (method *Method) outputURIFailure(uri string, err error) {
+	msg := uriFailure(uri, err)
+	method.output(msg)
 }
 
 func (method *Method) outputGeneralFailure(err error) {
 	msg := generalFailure(err)
-	method.stdout.Println(msg.String())
+	method.output(msg)
 }
 
-// handleError writes the contents of the given error and then exits the
-// program, as specified in the APT method interface documentation.
+// handleError writes the contents of the given error as a General Failure and
+// then ends the Method, as specified in the APT method interface
+// documentation.
 func (method *Method) handleError(err error) {
 	if err != nil {
 		method.outputGeneralFailure(err)
-		os.Exit(1)
+		method.abort(err)
+	}
+}
+
+// abort makes Run return the given error, wrapped in a FatalError if it isn't
+// one already. Only the first error is kept.
+func (method *Method) abort(err error) {
+	if !isFatal(err) {
+		err = fatal(err)
+	}
+	select {
+	case method.fatalErr <- err:
+	default:
+	}
+}
+
+// output writes the given Message. If apt is no longer listening there is
+// nothing left to do, so the Method is aborted.
+func (method *Method) output(msg *message.Message) {
+	method.diagnoseMessage("Sent", msg)
+	if err := method.out.Write(msg); err != nil {
+		method.abort(fmt.Errorf("writing message: %w", err))
 	}
 }
 
@@ -589,49 +1427,6 @@ func field(name string, value string) *message.Field {
 
 // lastModified returns a Field with the given Time formatted using the RFC1123
 // specification in GMT, as specified in the APT method interface documentation.
-func (method *Method) lastModified(t time.Time) *message.Field {
-	gmt, err := time.LoadLocation("GMT")
-	method.handleError(err)
-	return field(fieldNameLastModified, t.In(gmt).Format(time.RFC1123))
-}
-
-func (method *Method) md5Field(bytes []byte) *message.Field {
-	md5 := md5.New()
-	md5String := method.computeHash(md5, bytes)
-	return field(fieldNameMD5Hash, md5String)
-}
-
-func (method *Method) md5SumField(bytes []byte) *message.Field {
-	md5 := md5.New()
-	md5String := method.computeHash(md5, bytes)
-	return field(fieldNameMD5SumHash, md5String)
-}
-
-func (method *Method) sha1Field(bytes []byte) *message.Field {
-	sha1 := sha1.New()
-	sha1String := method.computeHash(sha1, bytes)
-	return field(fieldNameSHA1Hash, sha1String)
-}
-
-func (method *Method) sha256Field(bytes []byte) *message.Field {
-	sha256 := sha256.New()
-	sha256String := method.computeHash(sha256, bytes)
-	return field(fieldNameSHA256Hash, sha256String)
-}
-
-func (method *Method) sha512Field(bytes []byte) *message.Field {
-	sha512 := sha512.New()
-	sha512String := method.computeHash(sha512, bytes)
-	return field(fieldNameSHA512Hash, sha512String)
-}
-
-func (method *Method) computeHash(h hash.Hash, fileBytes []byte) string {
-	method.prepareHash(h, fileBytes)
-	return hex.EncodeToString(h.Sum(nil))
-}
-
-func (method *Method) prepareHash(h hash.Hash, fileBytes []byte) {
-	if _, err := io.Copy(h, bytes.NewReader(fileBytes)); err != nil {
-		method.handleError(err)
-	}
+func lastModified(t time.Time) *message.Field {
+	return field(fieldNameLastModified, t.UTC().Format(http.TimeFormat))
 }
@@ -15,17 +15,45 @@
 package method
 
 import (
-	"crypto/sha256"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/google/apt-golang-s3/fetcher"
+	"github.com/google/apt-golang-s3/internal/testutil"
+	"github.com/google/apt-golang-s3/message"
 )
 
 const (
 	capMsg = `100 Capabilities
 Send-Config: true
+Send-URI-Encoded: true
 Pipeline: true
 Single-Instance: yes
 `
@@ -49,6 +77,7 @@ Config-Item: Dir::Log::History=history.log
 Config-Item: Dir::Ignore-Files-Silently::=~$
 Config-Item: Acquire::cdrom::mount=/media/cdrom
 Config-Item: Acquire::s3::region=us-east-2
+Config-Item: Acquire::Send-URI-Encoded=1
 Config-Item: Aptitude::Get-Root-Command=sudo:/usr/bin/sudo
 Config-Item: Unattended-Upgrade::Allowed-Origins::=${distro_id}:${distro_codename}-security
 
@@ -58,6 +87,12 @@ Config-Item: Unattended-Upgrade::Allowed-Origins::=${distro_id}:${distro_codenam
 	endpointConfigMsg = `601 Configuration
 Config-Item: Acquire::s3::endpoint=https://minio.example.com
 
+`
+
+	// The trailing blank line is intentional.
+	debugConfigMsg = `601 Configuration
+Config-Item: Debug::Acquire::s3=true
+
 `
 )
 
@@ -71,7 +106,7 @@ func TestCapabilities(t *testing.T) {
 func TestReadInputFinishes(t *testing.T) {
 	reader := strings.NewReader(acqMsg)
 	method := New(logger(t))
-	go method.readInput(reader)
+	go method.readInput(t.Context(), reader)
 
 	msgs := 0
 loop:
@@ -92,15 +127,42 @@ loop:
 	}
 }
 
+func TestReadInputSkipsOversizedMessages(t *testing.T) {
+	oversized := "600 URI Acquire\n" + strings.Repeat("X-Padding: "+strings.Repeat("a", 1000)+"\n", 17<<10) + "\n"
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0))
+	go method.readInput(t.Context(), strings.NewReader(oversized+acqMsg))
+
+	msg := <-method.msgChan
+	if !strings.HasPrefix(string(msg), "600 URI Acquire\nURI: s3://") {
+		t.Errorf("readInput() passed on %.40q; expected the message after the oversized one", msg)
+	}
+	expected := "401 General Failure\nMessage: skipped a message from apt: message exceeds the size limit of 16777216 bytes\n"
+	if !strings.Contains(out.String(), expected) {
+		t.Errorf("output = %q; expected it to contain %q", out, expected)
+	}
+}
+
+func TestConfigureMaxMessageSize(t *testing.T) {
+	method := New(logger(t))
+	if size := method.maxMessageSize(); size != message.DefaultMaxSize {
+		t.Errorf("maxMessageSize() = %d; expected the default %d", size, message.DefaultMaxSize)
+	}
+	method.configure(&message.Message{Fields: []*message.Field{field(fieldNameConfigItem, "Acquire::s3::max-message-size=1048576")}})
+	if size := method.maxMessageSize(); size != 1<<20 {
+		t.Errorf("maxMessageSize() = %d; expected %d", size, 1<<20)
+	}
+}
+
 func TestSettingRegion(t *testing.T) {
 	reader := strings.NewReader(configMsg)
 	method := New(logger(t))
-	go method.readInput(reader)
+	go method.readInput(t.Context(), reader)
 
 	// consume the messages on the channel
 	for {
 		bytes := <-method.msgChan
-		method.handleBytes(bytes)
+		method.handleBytes(context.Background(), bytes)
 		if reader.Len() == 0 {
 			break
 		}
@@ -114,11 +176,11 @@ func TestSettingRegion(t *testing.T) {
 func TestSettingEndpoint(t *testing.T) {
 	reader := strings.NewReader(endpointConfigMsg)
 	method := New(logger(t))
-	go method.readInput(reader)
+	go method.readInput(t.Context(), reader)
 
 	for {
 		bytes := <-method.msgChan
-		method.handleBytes(bytes)
+		method.handleBytes(context.Background(), bytes)
 		if reader.Len() == 0 {
 			break
 		}
@@ -130,62 +192,1975 @@ func TestSettingEndpoint(t *testing.T) {
 	}
 }
 
-func TestComputeHash(t *testing.T) {
+func TestSettingDebug(t *testing.T) {
+	reader := strings.NewReader(debugConfigMsg)
+	method := New(logger(t))
+	go method.readInput(t.Context(), reader)
+
+	for {
+		bytes := <-method.msgChan
+		method.handleBytes(context.Background(), bytes)
+		if reader.Len() == 0 {
+			break
+		}
+	}
+
+	if !method.debug.Load() {
+		t.Errorf("method.debug = %t; expected %t", method.debug.Load(), true)
+	}
+}
+
+func TestSettingFsync(t *testing.T) {
+	method := New(logger(t))
+	if err := method.setConfigItem("Acquire::s3::fsync=true"); err != nil {
+		t.Fatalf("setConfigItem(%q) returned unexpected error: %v", "Acquire::s3::fsync=true", err)
+	}
+
+	if !method.fsync {
+		t.Errorf("method.fsync = %t; expected %t", method.fsync, true)
+	}
+}
+
+func TestSettingBatchHead(t *testing.T) {
+	method := New(logger(t))
+	method.configure(&message.Message{Fields: []*message.Field{
+		field(fieldNameConfigItem, "Acquire::s3::batch-head=true"),
+	}})
+
+	if method.keyIndex == nil {
+		t.Errorf("method.keyIndex = nil; expected a key index")
+	}
+}
+
+func TestConfigureInvalidEndpointTemplate(t *testing.T) {
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0))
+	method.configure(&message.Message{Fields: []*message.Field{
+		field(fieldNameConfigItem, "Acquire::s3::endpoint=https://objects-{bucket}.corp.example"),
+	}})
+
+	select {
+	case err := <-method.fatalErr:
+		if !errors.Is(err, fetcher.ErrInvalidEndpoint) {
+			t.Errorf("configure() aborted with %v; expected %v", err, fetcher.ErrInvalidEndpoint)
+		}
+	default:
+		t.Errorf("configure() did not abort the Method")
+	}
+	if !strings.Contains(out.String(), "401 General Failure") {
+		t.Errorf("output = %q; expected a General Failure", out)
+	}
+}
+
+func TestURIAcquireBucketAlias(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-staging", "pool/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0), WithS3ClientFactory(fakeFactory(fake)))
+	method.configure(&message.Message{Fields: []*message.Field{
+		field(fieldNameConfigItem, "Acquire::s3::alias::apt-repo=apt-repo-staging"),
+	}})
+	uri := "s3://apt-repo/pool/hello.deb"
+
+	method.acquire(context.Background(), &message.Message{
+		Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+		Fields: []*message.Field{field(fieldNameURI, uri), field(fieldNameFilename, filepath.Join(t.TempDir(), "hello.deb"))},
+	})
+
+	if expected := "201 URI Done\nURI: " + uri + "\n"; !strings.Contains(out.String(), expected) {
+		t.Errorf("output = %q; expected it to contain %q", out, expected)
+	}
+}
+
+func TestURIAcquireDecodeContent(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writer := gzip.NewWriter(buf)
+	writer.Write([]byte("Package: hello\n"))
+	writer.Close()
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "dists/stable/main/binary-amd64/Packages",
+		testutil.FakeObject{Body: buf.Bytes(), ContentEncoding: "gzip"})
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0), WithS3ClientFactory(fakeFactory(fake)))
+	method.configure(&message.Message{Fields: []*message.Field{
+		field(fieldNameConfigItem, "Acquire::s3::decode-content=true"),
+	}})
+	uri := "s3://apt-repo-bucket/dists/stable/main/binary-amd64/Packages"
+
+	method.acquire(context.Background(), &message.Message{
+		Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+		Fields: []*message.Field{field(fieldNameURI, uri), field(fieldNameFilename, filepath.Join(t.TempDir(), "Packages"))},
+	})
+
+	for _, expected := range []string{
+		"200 URI Start\nURI: " + uri + "\n\n",
+		"201 URI Done\nURI: " + uri + "\nFilename:",
+		"\nSize: 15\n",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("output = %q; expected it to contain %q", out, expected)
+		}
+	}
+}
+
+func TestURIAcquireErrorPage(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "dists/stable/Release",
+		testutil.FakeObject{Body: []byte("<!DOCTYPE html>\n<html>Bad Gateway</html>\n"), ContentType: "text/html"})
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0), WithS3ClientFactory(fakeFactory(fake)))
+	close(method.configured)
+	uri := "s3://apt-repo-bucket/dists/stable/Release"
+
+	method.acquire(context.Background(), &message.Message{
+		Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+		Fields: []*message.Field{field(fieldNameURI, uri), field(fieldNameFilename, filepath.Join(t.TempDir(), "Release"))},
+	})
+
+	expected := "400 URI Failure\nURI: " + uri + "\nMessage: the endpoint returned an error page instead of the object"
+	if !strings.Contains(out.String(), expected) {
+		t.Errorf("output = %q; expected it to contain %q", out, expected)
+	}
+}
+
+func TestURIAcquireThrottled(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.HeadErr = awserr.NewRequestFailure(
+		awserr.New("SlowDown", "Please reduce your request rate.", nil), http.StatusServiceUnavailable, "id")
+	clock := testutil.NewFakeClock(time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC))
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0), WithS3ClientFactory(fakeFactory(fake)), WithClock(clock))
+	method.configure(&message.Message{Fields: []*message.Field{
+		field(fieldNameConfigItem, "Acquire::s3::throttle-attempts=2"),
+	}})
+	uri := "s3://apt-repo-bucket/dists/stable/Release"
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		method.acquire(context.Background(), &message.Message{
+			Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+			Fields: []*message.Field{field(fieldNameURI, uri), field(fieldNameFilename, filepath.Join(t.TempDir(), "Release"))},
+		})
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	<-done
+
+	for _, expected := range []string{
+		"102 Status\nURI: " + uri + "\nMessage: Throttled by S3, retrying in 1s\n",
+		"400 URI Failure\nURI: " + uri + "\nMessage: throttled by S3 after 2 attempts",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("output = %q; expected it to contain %q", out, expected)
+		}
+	}
+}
+
+// A lockedBuffer is a bytes.Buffer that is safe for concurrent use.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// A slowHeadS3 is a FakeS3 whose HeadObject only answers once released.
+type slowHeadS3 struct {
+	*testutil.FakeS3
+	release chan struct{}
+}
+
+func (fake slowHeadS3) HeadObjectWithContext(
+	ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option,
+) (*s3.HeadObjectOutput, error) {
+	<-fake.release
+	return fake.FakeS3.HeadObjectWithContext(ctx, input, opts...)
+}
+
+func TestURIAcquireHeartbeat(t *testing.T) {
+	fake := slowHeadS3{FakeS3: testutil.NewFakeS3(), release: make(chan struct{})}
+	fake.Put("apt-repo-bucket", "dists/stable/Release", testutil.FakeObject{Body: []byte("Origin: apt-repo-bucket\n")})
+	clock := testutil.NewFakeClock(time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC))
+	out := &lockedBuffer{}
+	method := New(log.New(out, "", 0), WithS3ClientFactory(func(ClientConfig) (s3iface.S3API, error) {
+		return fake, nil
+	}), WithClock(clock))
+	close(method.configured)
+	uri := "s3://apt-repo-bucket/dists/stable/Release"
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		method.acquire(context.Background(), &message.Message{
+			Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+			Fields: []*message.Field{field(fieldNameURI, uri), field(fieldNameFilename, filepath.Join(t.TempDir(), "Release"))},
+		})
+	}()
+	clock.BlockUntil(1)
+	for _, waited := range []string{"(5s)", "(10s)", "(15s)"} {
+		clock.Advance(heartbeatInterval)
+		// Each heartbeat is awaited, lest the next tick be dropped.
+		deadline := time.Now().Add(5 * time.Second)
+		for !strings.Contains(out.String(), waited) && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	close(fake.release)
+	<-done
+	clock.Advance(time.Minute)
+
+	expected := ""
+	for _, waited := range []string{"", " (5s)", " (10s)", " (15s)"} {
+		expected += "102 Status\nURI: " + uri + "\nMessage: Waiting for headers" + waited + "\n\n"
+	}
+	expected += "200 URI Start\n"
+	output := out.String()
+	if !strings.Contains(output, expected) {
+		t.Errorf("output = %q; expected it to contain %q", output, expected)
+	}
+	if count := strings.Count(output, "Waiting for headers"); count != 4 {
+		t.Errorf("output has %d heartbeats; expected none after HeadObject returned:\n%s", count, output)
+	}
+}
+
+// A slowBodyS3 is a FakeS3 whose GetObject bodies pause after their first half
+// until released.
+type slowBodyS3 struct {
+	*testutil.FakeS3
+	release chan struct{}
+}
+
+func (fake slowBodyS3) GetObjectWithContext(
+	ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option,
+) (*s3.GetObjectOutput, error) {
+	output, err := fake.FakeS3.GetObjectWithContext(ctx, input, opts...)
+	if err != nil {
+		return nil, err
+	}
+	body, _ := io.ReadAll(output.Body)
+	half := len(body) / 2
+	output.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body[:half]), releaseReader(fake.release), bytes.NewReader(body[half:])))
+	return output, nil
+}
+
+// A releaseReader blocks until its channel is closed, and then is empty.
+type releaseReader chan struct{}
+
+func (r releaseReader) Read([]byte) (int, error) {
+	<-r
+	return 0, io.EOF
+}
+
+func TestURIAcquireProgress(t *testing.T) {
+	lastModified := time.Date(2018, time.October, 25, 20, 17, 39, 0, time.UTC)
+	specs := map[string]struct {
+		items []string
+		obj   testutil.FakeObject
+	}{
+		"ranged":         {nil, testutil.FakeObject{LastModified: lastModified}},
+		"single request": {[]string{"Acquire::s3::multipart=false"}, testutil.FakeObject{LastModified: lastModified}},
+		// Start waits for the size the GetObject reports.
+		"head without metadata": {nil, testutil.FakeObject{LastModified: lastModified, OmitHeadMetadata: true}},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			fake := slowBodyS3{FakeS3: testutil.NewFakeS3(), release: make(chan struct{})}
+			spec.obj.Body = bytes.Repeat([]byte("0123456789"), 100)
+			fake.Put("apt-repo-bucket", "pool/hello.deb", spec.obj)
+			clock := testutil.NewFakeClock(time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC))
+			out := &lockedBuffer{}
+			method := New(log.New(out, "", 0), WithS3ClientFactory(func(ClientConfig) (s3iface.S3API, error) {
+				return fake, nil
+			}), WithClock(clock))
+			var fields []*message.Field
+			for _, item := range spec.items {
+				fields = append(fields, field(fieldNameConfigItem, item))
+			}
+			method.configure(&message.Message{Fields: fields})
+			uri := "s3://apt-repo-bucket/pool/hello.deb"
+			filename := filepath.Join(t.TempDir(), "hello.deb")
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				method.acquire(context.Background(), &message.Message{
+					Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+					Fields: []*message.Field{field(fieldNameURI, uri), field(fieldNameFilename, filename)},
+				})
+			}()
+			// apt tells how far along the download is by the size of its file.
+			deadline := time.Now().Add(5 * time.Second)
+			for info, err := os.Stat(filename); (err != nil || info.Size() < 500) && time.Now().Before(deadline); info, err = os.Stat(filename) {
+				time.Sleep(time.Millisecond)
+			}
+			if info, err := os.Stat(filename); err != nil || info.Size() != 500 {
+				t.Errorf("file has %v bytes halfway through the download (%v); expected 500", info, err)
+			}
+			clock.BlockUntil(1)
+			clock.Advance(heartbeatInterval)
+			for !strings.Contains(out.String(), "Message: Downloaded") && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			close(fake.release)
+			<-done
+			clock.Advance(time.Minute)
+
+			output := out.String()
+			expected := "102 Status\nURI: " + uri + "\nMessage: Downloaded 500 of 1000 bytes (50%)\n\n"
+			if !strings.Contains(output, expected) {
+				t.Errorf("output = %q; expected it to contain %q", output, expected)
+			}
+			start := strings.Index(output, "200 URI Start\nURI: "+uri+"\nSize: 1000\nLast-Modified: Thu, 25 Oct 2018 20:17:39 GMT\n\n")
+			progress := strings.Index(output, expected)
+			finish := strings.Index(output, "201 URI Done\nURI: "+uri+"\nFilename: "+filename+"\nSize: 1000\n")
+			if start < 0 || progress < start || finish < progress {
+				t.Errorf("output = %q; expected a Start and a Done with Size: 1000 around the Status", output)
+			}
+			if count := strings.Count(output, "Message: Downloaded"); count != 1 {
+				t.Errorf("output has %d progress Status messages; expected 1:\n%s", count, output)
+			}
+		})
+	}
+}
+
+func TestURIAcquireVerifyParts(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "pool/hello.deb", testutil.FakeObject{
+		Body:  []byte("hello world"),
+		Parts: []testutil.FakePart{{Size: 6, ChecksumSHA256: "bm90IHRoZSBjaGVja3N1bQ=="}, {Size: 5}},
+	})
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0), WithS3ClientFactory(fakeFactory(fake)))
+	method.configure(&message.Message{Fields: []*message.Field{
+		field(fieldNameConfigItem, "Acquire::s3::verify-parts=true"),
+	}})
+	uri := "s3://apt-repo-bucket/pool/hello.deb"
+
+	method.acquire(context.Background(), &message.Message{
+		Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+		Fields: []*message.Field{field(fieldNameURI, uri), field(fieldNameFilename, filepath.Join(t.TempDir(), "hello.deb"))},
+	})
+
+	// Without checksums for every part, the object is downloaded as a whole.
+	if expected := "201 URI Done\nURI: " + uri + "\n"; !strings.Contains(out.String(), expected) {
+		t.Errorf("output = %q; expected it to contain %q", out, expected)
+	}
+
+	fake.Put("apt-repo-bucket", "pool/hello.deb", testutil.FakeObject{
+		Body: []byte("hello world"),
+		Parts: []testutil.FakePart{
+			{Size: 6, ChecksumSHA256: "bm90IHRoZSBjaGVja3N1bQ=="}, {Size: 5, ChecksumSHA256: "bm90IHRoZSBjaGVja3N1bQ=="},
+		},
+	})
+	out.Reset()
+	method.acquire(context.Background(), &message.Message{
+		Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+		Fields: []*message.Field{field(fieldNameURI, uri), field(fieldNameFilename, filepath.Join(t.TempDir(), "hello.deb"))},
+	})
+
+	if expected := "400 URI Failure\nURI: " + uri + "\nMessage: part checksum mismatch: part "; !strings.Contains(out.String(), expected) {
+		t.Errorf("output = %q; expected it to contain %q", out, expected)
+	}
+}
+
+func TestURIAcquireMultipartDisabled(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.CorruptRanges = true
+	fake.Put("apt-repo-bucket", "pool/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0), WithS3ClientFactory(fakeFactory(fake)))
+	method.configure(&message.Message{Fields: []*message.Field{
+		field(fieldNameConfigItem, "Acquire::s3::multipart=false"),
+	}})
+	uri := "s3://apt-repo-bucket/pool/hello.deb"
+	filename := filepath.Join(t.TempDir(), "hello.deb")
+
+	method.acquire(context.Background(), &message.Message{
+		Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+		Fields: []*message.Field{field(fieldNameURI, uri), field(fieldNameFilename, filename)},
+	})
+
+	if expected := "201 URI Done\nURI: " + uri + "\n"; !strings.Contains(out.String(), expected) {
+		t.Errorf("output = %q; expected it to contain %q", out, expected)
+	}
+	if contents, err := os.ReadFile(filename); err != nil || string(contents) != "hello" {
+		t.Errorf("fetched %q, %v; expected %q", contents, err, "hello")
+	}
+}
+
+func TestURIAcquireObjectChanged(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	version := 0
+	fake.BeforeGet = func(key string) {
+		version++
+		fake.Put("apt-repo-bucket", key, testutil.FakeObject{Body: []byte("hello"), ETag: fmt.Sprintf(`"%d"`, version)})
+	}
+	fake.Put("apt-repo-bucket", "pool/hello.deb", testutil.FakeObject{Body: []byte("hello"), ETag: `"0"`})
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0), WithS3ClientFactory(fakeFactory(fake)))
+	close(method.configured)
+	uri := "s3://apt-repo-bucket/pool/hello.deb"
+
+	method.acquire(context.Background(), &message.Message{
+		Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+		Fields: []*message.Field{field(fieldNameURI, uri), field(fieldNameFilename, filepath.Join(t.TempDir(), "hello.deb"))},
+	})
+
+	expected := "400 URI Failure\nURI: " + uri + "\nMessage: object changed during the download: s3://apt-repo-bucket/pool/hello.deb"
+	if !strings.Contains(out.String(), expected) {
+		t.Errorf("output = %q; expected it to contain %q", out, expected)
+	}
+}
+
+func TestURIAcquireListFallback(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "pool/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	fake.HeadErr = awserr.NewRequestFailure(awserr.New("Forbidden", "Forbidden", nil), http.StatusForbidden, "id")
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0), WithS3ClientFactory(fakeFactory(fake)))
+	method.configure(&message.Message{Fields: []*message.Field{
+		field(fieldNameConfigItem, "Acquire::s3::list-fallback=true"),
+	}})
+
+	for uri, expected := range map[string]string{
+		"s3://apt-repo-bucket/pool/hello.deb":   "201 URI Done\nURI: s3://apt-repo-bucket/pool/hello.deb\n",
+		"s3://apt-repo-bucket/pool/missing.deb": "400 URI Failure\nURI: s3://apt-repo-bucket/pool/missing.deb\nMessage: " + fieldValueNotFound,
+	} {
+		out.Reset()
+		method.acquire(context.Background(), &message.Message{
+			Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+			Fields: []*message.Field{field(fieldNameURI, uri), field(fieldNameFilename, filepath.Join(t.TempDir(), "hello.deb"))},
+		})
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("output = %q; expected it to contain %q", out, expected)
+		}
+	}
+}
+
+func TestURIAcquireDecryptFailure(t *testing.T) {
+	// The envelope of the legacy encryption client is refused before KMS is
+	// asked for the data key.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Amz-Meta-X-Amz-Key", "ZW5jcnlwdGVkIGRhdGEga2V5")
+		w.Header().Set("Content-Length", "5")
+		if r.Method != http.MethodHead {
+			fmt.Fprint(w, "hello")
+		}
+	}))
+	defer server.Close()
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0))
+	method.configure(&message.Message{Fields: []*message.Field{
+		field(fieldNameConfigItem, "Acquire::s3::endpoint="+server.URL+"/{bucket}"),
+		field(fieldNameConfigItem, "Acquire::s3::cse-kms-key-id=alias/apt"),
+	}})
+
+	uri := "s3://AKIDEXAMPLE:secret@apt-repo-bucket/pool/hello.deb"
+	method.acquire(context.Background(), &message.Message{
+		Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+		Fields: []*message.Field{field(fieldNameURI, uri), field(fieldNameFilename, filepath.Join(t.TempDir(), "hello.deb"))},
+	})
+	expected := "400 URI Failure\nURI: " + uri + "\nMessage: " + fetcher.ErrDecrypt.Error() +
+		" s3://apt-repo-bucket/pool/hello.deb with KMS key alias/apt: "
+	if !strings.Contains(out.String(), expected) {
+		t.Errorf("output = %q; expected it to contain %q", out, expected)
+	}
+}
+
+func TestURIAcquireLatest(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "pool/nightly/app_1_amd64.deb",
+		testutil.FakeObject{Body: []byte("old"), LastModified: time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)})
+	fake.Put("apt-repo-bucket", "pool/nightly/app_2_amd64.deb",
+		testutil.FakeObject{Body: []byte("new"), LastModified: time.Date(2024, time.March, 2, 0, 0, 0, 0, time.UTC)})
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0), WithS3ClientFactory(fakeFactory(fake)))
+	method.configure(&message.Message{Fields: []*message.Field{
+		field(fieldNameConfigItem, "Acquire::s3::latest=true"),
+	}})
+
+	for uri, expected := range map[string]string{
+		"s3://apt-repo-bucket/pool/nightly/?latest=true": "201 URI Done\nURI: s3://apt-repo-bucket/pool/nightly/?latest=true\n",
+		"s3://apt-repo-bucket/pool/stable/latest:app_": "400 URI Failure\nURI: s3://apt-repo-bucket/pool/stable/latest:app_\n" +
+			"Message: " + fetcher.ErrEmptyPrefix.Error() + " s3://apt-repo-bucket/pool/stable/app_\n",
+	} {
+		out.Reset()
+		filename := filepath.Join(t.TempDir(), "app.deb")
+		method.acquire(context.Background(), &message.Message{
+			Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+			Fields: []*message.Field{field(fieldNameURI, uri), field(fieldNameFilename, filename)},
+		})
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("output = %q; expected it to contain %q", out, expected)
+		}
+		if contents, err := os.ReadFile(filename); err == nil && string(contents) != "new" {
+			t.Errorf("acquired file contains %q; expected the latest object", contents)
+		}
+	}
+}
+
+func TestURIAcquirePartSize(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "pool/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0), WithS3ClientFactory(fakeFactory(fake)))
+	method.configure(&message.Message{Fields: []*message.Field{
+		field(fieldNameConfigItem, "Acquire::s3::part-size=2"),
+		field(fieldNameConfigItem, "Debug::Acquire::s3=true"),
+	}})
+
+	method.acquire(context.Background(), &message.Message{
+		Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+		Fields: []*message.Field{
+			field(fieldNameURI, "s3://apt-repo-bucket/pool/hello.deb"),
+			field(fieldNameFilename, filepath.Join(t.TempDir(), "hello.deb")),
+		},
+	})
+	for _, expected := range []string{"201 URI Done\n", "part-size=2 "} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("output = %q; expected it to contain %q", out, expected)
+		}
+	}
+}
+
+func TestURIAcquireClientCertFailure(t *testing.T) {
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0))
+	certFile := filepath.Join(t.TempDir(), "apt.crt")
+	method.configure(&message.Message{Fields: []*message.Field{
+		field(fieldNameConfigItem, "Acquire::s3::endpoint=https://gateway.internal"),
+		field(fieldNameConfigItem, "Acquire::s3::SslCert="+certFile),
+		field(fieldNameConfigItem, "Acquire::s3::SslKey=/etc/apt/missing.key"),
+	}})
+
+	method.acquire(context.Background(), &message.Message{
+		Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+		Fields: []*message.Field{
+			field(fieldNameURI, "s3://fake-access-key-id:fake-secret-access-key@apt-repo-bucket/pool/hello.deb"),
+			field(fieldNameFilename, filepath.Join(t.TempDir(), "hello.deb")),
+		},
+	})
+
+	expected := "401 General Failure\nMessage: cannot load the client certificate " + certFile + " with the key in /etc/apt/missing.key: "
+	if !strings.Contains(out.String(), expected) {
+		t.Errorf("output = %q; expected it to contain %q", out, expected)
+	}
+}
+
+func TestURIAcquireTLSMinVersion(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.TLS = &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11}
+	server.StartTLS()
+	defer server.Close()
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_CA_BUNDLE", bundle)
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0))
+	method.configure(&message.Message{Fields: []*message.Field{
+		field(fieldNameConfigItem, "Acquire::s3::endpoint="+server.URL),
+		field(fieldNameConfigItem, "Acquire::s3::tls-min-version=1.2"),
+	}})
+
+	method.acquire(context.Background(), &message.Message{
+		Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+		Fields: []*message.Field{
+			field(fieldNameURI, "s3://fake-access-key-id:fake-secret-access-key@apt-repo-bucket/pool/hello.deb"),
+			field(fieldNameFilename, filepath.Join(t.TempDir(), "hello.deb")),
+		},
+	})
+
+	expected := "the server negotiated TLS 1.1, older than the required TLS 1.2"
+	if !strings.Contains(out.String(), expected) {
+		t.Errorf("output = %q; expected it to contain %q", out, expected)
+	}
+}
+
+func TestURIAcquireWarnsAboutDefaultRegion(t *testing.T) {
+	specs := map[string]struct {
+		configItem string
+		envRegion  string
+		expected   int
+	}{
+		"default":         {"", "", 1},
+		"configured":      {"Acquire::s3::region=us-east-1", "", 0},
+		"environment":     {"", "us-east-1", 0},
+		"custom endpoint": {"Acquire::s3::endpoint=https://objects.internal", "", 0},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("AWS_REGION", spec.envRegion)
+			fake := testutil.NewFakeS3()
+			fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+			out := &bytes.Buffer{}
+			method := New(log.New(out, "", 0), WithS3ClientFactory(fakeFactory(fake)))
+			var fields []*message.Field
+			if spec.configItem != "" {
+				fields = append(fields, field(fieldNameConfigItem, spec.configItem))
+			}
+			method.configure(&message.Message{Fields: fields})
+
+			for range 2 {
+				method.acquire(context.Background(), &message.Message{
+					Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+					Fields: []*message.Field{
+						field(fieldNameURI, "s3://apt-repo-bucket/apt/generic/hello.deb"),
+						field(fieldNameFilename, filepath.Join(t.TempDir(), "hello.deb")),
+					},
+				})
+			}
+
+			warning := "104 Warning\nMessage: No region is configured, assuming us-east-1; set Acquire::s3::region to the region of the bucket"
+			if count := strings.Count(out.String(), warning); count != spec.expected {
+				t.Errorf("output has %d warnings about the default region; expected %d:\n%s", count, spec.expected, out)
+			}
+		})
+	}
+}
+
+func TestURIAcquireClockSkew(t *testing.T) {
+	now := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	fake := testutil.NewFakeS3()
+	fake.Date = now.Add(5 * time.Minute)
+	fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0), WithS3ClientFactory(fakeFactory(fake)), WithClock(testutil.NewFakeClock(now)))
+	method.configure(&message.Message{Fields: []*message.Field{field(fieldNameConfigItem, "Acquire::s3::region=us-east-1")}})
+
+	for range 2 {
+		method.acquire(context.Background(), &message.Message{
+			Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+			Fields: []*message.Field{
+				field(fieldNameURI, "s3://apt-repo-bucket/apt/generic/hello.deb"),
+				field(fieldNameFilename, filepath.Join(t.TempDir(), "hello.deb")),
+			},
+		})
+	}
+
+	warning := "104 Warning\nMessage: The system clock is 5m0s behind S3's"
+	if count := strings.Count(out.String(), warning); count != 1 {
+		t.Errorf("output has %d warnings about the clock; expected 1:\n%s", count, out)
+	}
+	if count := strings.Count(out.String(), "201 URI Done"); count != 2 {
+		t.Errorf("output has %d URI Done messages; expected 2:\n%s", count, out)
+	}
+}
+
+func TestURIAcquireRegionParameter(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	var regions []string
+	factory := func(cfg ClientConfig) (s3iface.S3API, error) {
+		regions = append(regions, cfg.Region)
+		return fake, nil
+	}
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0), WithS3ClientFactory(factory))
+	method.configure(&message.Message{Fields: []*message.Field{field(fieldNameConfigItem, "Acquire::s3::region=us-east-2")}})
+
+	uri := "s3://apt-repo-bucket/apt/generic/hello.deb?region=eu-central-1"
+	for range 2 {
+		method.acquire(context.Background(), &message.Message{
+			Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+			Fields: []*message.Field{field(fieldNameURI, uri), field(fieldNameFilename, filepath.Join(t.TempDir(), "hello.deb"))},
+		})
+	}
+
+	if len(regions) == 0 {
+		t.Fatal("no S3 client was built")
+	}
+	for _, region := range regions {
+		if region != "eu-central-1" {
+			t.Errorf("S3 client built for region %s; expected eu-central-1", region)
+		}
+	}
+	warning := "104 Warning\nMessage: Using the region eu-central-1 of the URI for bucket apt-repo-bucket rather than the region us-east-2"
+	if count := strings.Count(out.String(), warning); count != 1 {
+		t.Errorf("output has %d warnings about the region of the URI; expected 1:\n%s", count, out)
+	}
+	if count := strings.Count(out.String(), "201 URI Done\nURI: "+uri+"\n"); count != 2 {
+		t.Errorf("output has %d URI Done messages echoing %s; expected 2:\n%s", count, uri, out)
+	}
+}
+
+func TestURIAcquireRoleParameter(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	var configs []ClientConfig
+	factory := func(cfg ClientConfig) (s3iface.S3API, error) {
+		configs = append(configs, cfg)
+		return fake, nil
+	}
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0), WithS3ClientFactory(factory))
+	method.configure(&message.Message{Fields: []*message.Field{
+		field(fieldNameConfigItem, "Acquire::s3::role=arn:aws:iam::123456789012:role/global"),
+		field(fieldNameConfigItem, "Acquire::s3::role-source-identity=build-runner"),
+	}})
+
+	for _, uri := range []string{
+		"s3://apt-repo-bucket/apt/generic/hello.deb?role=arn%3Aaws%3Aiam%3A%3A123456789012%3Arole%2Fapt-reader",
+		"s3://apt-repo-bucket/apt/generic/hello.deb",
+	} {
+		method.acquire(context.Background(), &message.Message{
+			Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+			Fields: []*message.Field{field(fieldNameURI, uri), field(fieldNameFilename, filepath.Join(t.TempDir(), "hello.deb"))},
+		})
+	}
+
+	if len(configs) != 2 {
+		t.Fatalf("%d S3 clients were built; expected 2:\n%s", len(configs), out)
+	}
+	for i, expected := range []string{"arn:aws:iam::123456789012:role/apt-reader", "arn:aws:iam::123456789012:role/global"} {
+		if configs[i].RoleARN != expected || configs[i].RoleSourceIdentity != "build-runner" {
+			t.Errorf("S3 client %d built for role %s with source identity %q; expected %s with build-runner",
+				i, configs[i].RoleARN, configs[i].RoleSourceIdentity, expected)
+		}
+		if configs[i].RoleCache == nil || configs[i].RoleCache != configs[0].RoleCache {
+			t.Errorf("S3 client %d built without the RoleCache of the Method", i)
+		}
+	}
+}
+
+func TestURIAcquireUserinfoIsProfile(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	var profiles []string
+	factory := func(cfg ClientConfig) (s3iface.S3API, error) {
+		profiles = append(profiles, cfg.Profile)
+		return fake, nil
+	}
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0), WithS3ClientFactory(factory))
+	method.configure(&message.Message{Fields: []*message.Field{
+		field(fieldNameConfigItem, "Acquire::s3::userinfo-is-profile=true"),
+		field(fieldNameConfigItem, "Debug::Acquire::s3=true"),
+	}})
+
+	method.acquire(context.Background(), &message.Message{
+		Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+		Fields: []*message.Field{
+			field(fieldNameURI, "s3://prod@apt-repo-bucket/apt/generic/hello.deb"),
+			field(fieldNameFilename, filepath.Join(t.TempDir(), "hello.deb")),
+		},
+	})
+
+	if diff := cmp.Diff([]string{"prod"}, profiles); diff != "" {
+		t.Errorf("profiles of the S3 clients differ (-expected +actual):\n%s", diff)
+	}
+	expected := "Message: Taking the user name prod of the URI as the shared profile to read credentials from\n"
+	if !strings.Contains(out.String(), expected) {
+		t.Errorf("output does not contain %q:\n%s", expected, out)
+	}
+}
+
+func TestRunQuiet(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	dir := t.TempDir()
+	input := strings.Replace(configMsg, "\n\n", "\nConfig-Item: quiet=2\n\n", 1) +
+		"600 URI Acquire\nURI: s3://apt-repo-bucket/apt/generic/hello.deb\nFilename: " + filepath.Join(dir, "hello.deb") + "\n\n" +
+		"600 URI Acquire\nURI: s3://apt-repo-bucket/apt/generic/missing.deb\nFilename: " + filepath.Join(dir, "missing.deb") + "\n\n"
+	out := &bytes.Buffer{}
+	method := NewWithOptions(Options{
+		Input:           strings.NewReader(input),
+		Output:          out,
+		S3ClientFactory: func(ClientConfig) (s3iface.S3API, error) { return fake, nil },
+	})
+
+	errc := make(chan error, 1)
+	go func() { errc <- method.Run() }()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("Run() = %v; expected nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return after the input was exhausted")
+	}
+
+	var codes []string
+	for _, msg := range strings.Split(strings.TrimSpace(out.String()), "\n\n") {
+		code, _, _ := strings.Cut(msg, " ")
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	// The version is logged before apt sends the configuration.
+	if diff := cmp.Diff([]string{"100", "101", "200", "201", "400"}, codes); diff != "" {
+		t.Errorf("codes of the messages sent differ (-expected +actual):\n%s\noutput:\n%s", diff, out)
+	}
+}
+
+func TestURIAcquireReusesExistingFile(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	filename := filepath.Join(t.TempDir(), "hello.deb")
+	if err := os.WriteFile(filename, []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filename, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0), WithS3ClientFactory(func(ClientConfig) (s3iface.S3API, error) {
+		return fake, nil
+	}))
+	method.configure(&message.Message{Fields: []*message.Field{field(fieldNameConfigItem, "Acquire::s3::reuse-existing=true")}})
+	uri := "s3://apt-repo-bucket/apt/generic/hello.deb"
+	msg := &message.Message{
+		Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+		Fields: []*message.Field{
+			field(fieldNameURI, uri),
+			field(fieldNameFilename, filename),
+			field(fieldNameExpectedSize, "5"),
+			field(fieldNameExpectedPrefix+"SHA256", "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"),
+		},
+	}
+
+	method.acquire(context.Background(), msg)
+
+	if requests := fake.Heads() + fake.Gets(); requests != 0 {
+		t.Errorf("acquire() made %d requests to S3; expected none", requests)
+	}
+	expected := "201 URI Done\nURI: " + uri + "\nFilename: " + filename + "\nSize: 5\nLast-Modified: Fri, 01 Mar 2024 12:00:00 GMT\n"
+	if output := out.String(); !strings.Contains(output, expected) {
+		t.Errorf("output = %q; expected it to contain %q", output, expected)
+	}
+}
+
+func TestURIDoneHashFields(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "hello.deb")
+	if err := os.WriteFile(filename, []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	digests, err := fetcher.FileDigests(filename)
+	if err != nil {
+		t.Fatalf("FileDigests() returned %v; expected nil", err)
+	}
+	msg := uriDone("s3://apt-repo-bucket/hello.deb", fetcher.FetchResult{Digests: digests}, filename)
+
+	// The hex digest lengths of the fields apt reads from a URI Done.
+	expected := map[string]int{"MD5-Hash": 32, "MD5Sum-Hash": 32, "SHA1-Hash": 40, "SHA256-Hash": 64, "SHA512-Hash": 128}
+	actual := map[string]int{}
+	for _, f := range msg.Fields {
+		if strings.HasSuffix(f.Name, fieldNameHashSuffix) {
+			actual[f.Name] = len(f.Value)
+		}
+	}
+	if diff := cmp.Diff(expected, actual); diff != "" {
+		t.Errorf("hash fields of the URI Done differ (-expected +actual):\n%s", diff)
+	}
+}
+
+func TestExpectedHashes(t *testing.T) {
+	msg := &message.Message{Fields: []*message.Field{
+		field("Expected-MD5Sum", "md5"),
+		field("Expected-SHA1", "sha1"),
+		field("Expected-SHA256", "sha256"),
+		field("Expected-SHA512", "sha512"),
+	}}
+	expected := fetcher.Digests{MD5: "md5", SHA1: "sha1", SHA256: "sha256", SHA512: "sha512"}
+	if diff := cmp.Diff(expected, expectedHashes(msg)); diff != "" {
+		t.Errorf("expectedHashes() differs (-expected +actual):\n%s", diff)
+	}
+}
+
+func TestURIAcquireLogsCredentials(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0), WithS3ClientFactory(fakeFactory(fake)))
+	method.configure(&message.Message{Fields: []*message.Field{field(fieldNameConfigItem, "Debug::Acquire::s3=true")}})
+
+	method.acquire(context.Background(), &message.Message{
+		Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+		Fields: []*message.Field{
+			field(fieldNameURI, "s3://AKIDEXAMPLE:wJalrXUtnFEMI@apt-repo-bucket/apt/generic/hello.deb"),
+			field(fieldNameFilename, filepath.Join(t.TempDir(), "hello.deb")),
+		},
+	})
+
+	output := out.String()
+	expected := "Message: Using static credentials of the URI or auth.conf, access key AKID... " +
+		"for s3://apt-repo-bucket/apt/generic/hello.deb\n"
+	if !strings.Contains(output, expected) {
+		t.Errorf("output = %q; expected it to contain %q", output, expected)
+	}
+	if strings.Contains(strings.ReplaceAll(output, "s3://AKIDEXAMPLE:wJalrXUtnFEMI@", ""), "wJalrXUtnFEMI") {
+		t.Errorf("output = %q; expected the secret access key only in the URI apt sent", output)
+	}
+}
+
+func TestURIAcquireARN(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "pool/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0), WithS3ClientFactory(fakeFactory(fake)))
+	close(method.configured)
+
+	for uri, expected := range map[string]string{
+		"s3://arn:aws:s3:::apt-repo-bucket/pool/hello.deb": "201 URI Done\nURI: s3://arn:aws:s3:::apt-repo-bucket/pool/hello.deb\n",
+		"s3://arn:aws:s3:::apt-repo-bucket":                "400 URI Failure\nURI: s3://arn:aws:s3:::apt-repo-bucket\n",
+		"s3://arn:aws:sqs:::apt-repo-bucket/pool/hello.deb": "400 URI Failure\nURI: s3://arn:aws:sqs:::apt-repo-bucket/pool/hello.deb\n" +
+			"Message: invalid S3 ARN",
+	} {
+		out.Reset()
+		method.acquire(context.Background(), &message.Message{
+			Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+			Fields: []*message.Field{field(fieldNameURI, uri), field(fieldNameFilename, filepath.Join(t.TempDir(), "hello.deb"))},
+		})
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("output = %q; expected it to contain %q", out, expected)
+		}
+	}
+}
+
+func TestURIAcquireInvalidURI(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "pool/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0), WithS3ClientFactory(fakeFactory(fake)))
+	close(method.configured)
+
+	// The secret in front of the bucket name is taken for a port.
+	for uri, expected := range map[string]string{
+		"s3://AKIDEXAMPLE:wJalr/XUtn@apt-repo-bucket/pool/hello.deb": "400 URI Failure\n" +
+			"URI: s3://AKIDEXAMPLE:wJalr/XUtn@apt-repo-bucket/pool/hello.deb\nMessage: invalid URI: ",
+		"s3://apt-repo-bucket/pool/hello.deb": "201 URI Done\nURI: s3://apt-repo-bucket/pool/hello.deb\n",
+	} {
+		out.Reset()
+		method.acquire(context.Background(), &message.Message{
+			Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+			Fields: []*message.Field{field(fieldNameURI, uri), field(fieldNameFilename, filepath.Join(t.TempDir(), "hello.deb"))},
+		})
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("output = %q; expected it to contain %q", out, expected)
+		}
+		if strings.Contains(out.String(), "401 General Failure") {
+			t.Errorf("output = %q; expected an invalid URI to fail only its acquire", out)
+		}
+		if _, reason, _ := strings.Cut(out.String(), "Message: "); strings.Contains(reason, "wJalr") {
+			t.Errorf("output = %q; expected the secret only in the URI apt sent", out)
+		}
+	}
+}
+
+func TestSettingFallbackEndpoints(t *testing.T) {
 	method := New(logger(t))
-	hashed := method.computeHash(sha256.New(), []byte("hello"))
-	expected := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
-	if hashed != expected {
-		t.Errorf("method.computeHash(sha256.New(), []byte(\"hello\")) = %s; expected %s", hashed, expected)
+	if err := method.setConfigItem("Acquire::s3::fallback-endpoint::=https://replica.internal"); err != nil {
+		t.Fatalf("setConfigItem(%q) returned unexpected error: %v", "Acquire::s3::fallback-endpoint::=https://replica.internal", err)
+	}
+	if err := method.setConfigItem("Acquire::s3::fallback-endpoint::=https://s3.us-east-1.amazonaws.com"); err != nil {
+		t.Fatalf("setConfigItem(%q) returned unexpected error: %v", "Acquire::s3::fallback-endpoint::=https://s3.us-east-1.amazonaws.com", err)
+	}
+
+	expected := []string{"https://replica.internal", "https://s3.us-east-1.amazonaws.com"}
+	if diff := cmp.Diff(expected, method.fallbackEndpoints); diff != "" {
+		t.Errorf("method.fallbackEndpoints mismatch (-want +got):\n%s", diff)
 	}
 }
 
-type locTest struct {
-	url             string
-	accessKey       string
-	accessKeySecret string
+func TestURIAcquireFallsBack(t *testing.T) {
+	primary, fallback := testutil.NewFakeS3(), testutil.NewFakeS3()
+	primary.HeadErr = awserr.NewRequestFailure(
+		awserr.New("ServiceUnavailable", "Service Unavailable", nil), http.StatusServiceUnavailable, "id")
+	fallback.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0), WithS3ClientFactory(func(cfg ClientConfig) (s3iface.S3API, error) {
+		if cfg.Endpoint == "https://replica.internal" {
+			return fallback, nil
+		}
+		return primary, nil
+	}))
+	method.debug.Store(true)
+	if err := method.setConfigItem("Acquire::s3::endpoint=https://gateway.internal"); err != nil {
+		t.Fatalf("setConfigItem(%q) returned unexpected error: %v", "Acquire::s3::endpoint=https://gateway.internal", err)
+	}
+	if err := method.setConfigItem("Acquire::s3::fallback-endpoint=https://replica.internal"); err != nil {
+		t.Fatalf("setConfigItem(%q) returned unexpected error: %v", "Acquire::s3::fallback-endpoint=https://replica.internal", err)
+	}
+	close(method.configured)
+	uri := "s3://gateway.internal/apt-repo-bucket/apt/generic/hello.deb"
+	msg := &message.Message{
+		Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+		Fields: []*message.Field{field(fieldNameURI, uri), field(fieldNameFilename, filepath.Join(t.TempDir(), "hello.deb"))},
+	}
+
+	method.acquire(context.Background(), msg)
+
+	output := out.String()
+	for _, expected := range []string{
+		"Message: Falling back to https://replica.internal for s3://apt-repo-bucket/apt/generic/hello.deb: " +
+			"HeadObject s3://apt-repo-bucket/apt/generic/hello.deb failed: ServiceUnavailable",
+		"Message: Fetched s3://apt-repo-bucket/apt/generic/hello.deb from https://replica.internal\n",
+		"201 URI Done\nURI: " + uri + "\n",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("output = %q; expected it to contain %q", output, expected)
+		}
+	}
 }
 
-func TestCreateLocation(t *testing.T) {
-	locTests := []locTest{
-		{
-			"s3://fake-access-key-id:fake-access-key-secret@s3.amazonaws.com/apt-repo-bucket/apt/generic/python-bernhard_0.2.3-1_all.deb",
-			"fake-access-key-id",
-			"fake-access-key-secret",
+func TestLastModified(t *testing.T) {
+	specs := map[string]time.Time{
+		"UTC":      time.Date(2018, time.October, 25, 20, 17, 39, 0, time.UTC),
+		"behind":   time.Date(2018, time.October, 25, 13, 17, 39, 0, time.FixedZone("PDT", -7*60*60)),
+		"ahead":    time.Date(2018, time.October, 26, 5, 47, 39, 0, time.FixedZone("ACST", 9*60*60+30*60)),
+		"midnight": time.Date(2018, time.October, 26, 0, 17, 39, 0, time.FixedZone("CEST", 4*60*60)),
+	}
+	expected := "Thu, 25 Oct 2018 20:17:39 GMT"
+
+	for name, lm := range specs {
+		t.Run(name, func(t *testing.T) {
+			if actual := lastModified(lm).Value; actual != expected {
+				t.Errorf("lastModified(%s) = %s; expected %s", lm, actual, expected)
+			}
+		})
+	}
+}
+
+func TestURIAcquire(t *testing.T) {
+	lastModified := time.Date(2018, time.October, 25, 20, 17, 39, 0, time.UTC)
+	specs := map[string]struct {
+		setup          func(fake *testutil.FakeS3)
+		fields         []*message.Field
+		expectedFatal  bool
+		expectedOutput []string
+	}{
+		"success": {
+			func(fake *testutil.FakeS3) {
+				fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello"), LastModified: lastModified})
+			},
+			nil,
+			false,
+			[]string{"102 Status\n", "Message: Connecting to s3.amazonaws.com\n", "Message: Waiting for headers\n",
+				"200 URI Start\n", "201 URI Done\n", "Size: 5\n", "Last-Modified: Thu, 25 Oct 2018 20:17:39 GMT\n",
+				"SHA256-Hash: 2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824\n"},
+		},
+		// Created without a GetObject, which the service fails for empty
+		// objects, and reported with the digests of no input.
+		"empty object": {
+			func(fake *testutil.FakeS3) {
+				fake.EmptyRangeErr = awserr.New("InvalidArgument", "Invalid range", nil)
+				fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{LastModified: lastModified})
+			},
+			nil,
+			false,
+			[]string{"201 URI Done\n", "Size: 0\n", "MD5Sum-Hash: d41d8cd98f00b204e9800998ecf8427e\n",
+				"SHA256-Hash: e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\n"},
+		},
+		"head without metadata": {
+			func(fake *testutil.FakeS3) {
+				fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{
+					Body: []byte("hello"), LastModified: lastModified, OmitHeadMetadata: true,
+				})
+			},
+			nil,
+			false,
+			// The size and modification time are those the GetObject reported.
+			[]string{"200 URI Start\nURI: s3://fake-access-key-id:fake-access-key-secret@s3.amazonaws.com/apt-repo-bucket/apt/generic/hello.deb\n" +
+				"Size: 5\nLast-Modified: Thu, 25 Oct 2018 20:17:39 GMT\n\n", "201 URI Done\n"},
+		},
+		"not found": {
+			func(fake *testutil.FakeS3) {
+				fake.AddBucket("apt-repo-bucket")
+			},
+			nil,
+			false,
+			[]string{"400 URI Failure\n",
+				"Message: The specified key does not exist. Bucket: apt-repo-bucket, Key: apt/generic/hello.deb\n"},
 		},
-		{
-			"s3://fake-ac/cess-key-id:fake-ac/cess-key-secret@s3.amazonaws.com/apt-repo-bucket/apt/generic/python-bernhard_0.2.3-1_all.deb",
-			"fake-ac/cess-key-id",
-			"fake-ac/cess-key-secret", // secret contains a forward slash
+		"bucket not found": {
+			func(*testutil.FakeS3) {},
+			nil,
+			false,
+			[]string{"400 URI Failure\n", "Message: The specified bucket does not exist. Bucket: apt-repo-bucket\n"},
 		},
-		{
-			"s3://fake-ac%2Fcess-key-id:fake-ac%2Fcess-key-secret@s3.amazonaws.com/apt-repo-bucket/apt/generic/python-bernhard_0.2.3-1_all.deb",
-			"fake-ac/cess-key-id",     // access key contains a forward slash that was encoded as %2F in the original url
-			"fake-ac/cess-key-secret", // secret contains a forward slash that was encoded as %2F in the original url
+		"head forbidden": {
+			func(fake *testutil.FakeS3) {
+				fake.HeadErr = awserr.NewRequestFailure(awserr.New("Forbidden", "Forbidden", nil), http.StatusForbidden, "id")
+			},
+			nil,
+			false,
+			[]string{"400 URI Failure\n",
+				"Message: HeadObject s3://apt-repo-bucket/apt/generic/hello.deb failed: Forbidden: Forbidden (HTTP 403, request id id) " +
+					"(using static credentials of the URI or auth.conf, access key fake...)\n"},
 		},
-		{
-			"s3://fake-access-key-id:@s3.amazonaws.com/apt-repo-bucket/apt/generic/python-bernhard_0.2.3-1_all.deb",
-			"fake-access-key-id",
-			"", // secret is blank
+		"download error": {
+			func(fake *testutil.FakeS3) {
+				fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello"), LastModified: lastModified})
+				fake.GetErr = errors.New("connection reset by peer")
+			},
+			nil,
+			false,
+			[]string{"200 URI Start\n", "400 URI Failure\n", "connection reset by peer"},
 		},
-		{
-			"s3://:fake-access-key-secret@s3.amazonaws.com/apt-repo-bucket/apt/generic/python-bernhard_0.2.3-1_all.deb",
-			"", // access key is blank
-			"fake-access-key-secret",
+		// The code and message S3 answered with are reported for the URI.
+		"download server error": {
+			func(fake *testutil.FakeS3) {
+				fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello"), LastModified: lastModified})
+				fake.GetErr = awserr.NewRequestFailure(
+					awserr.New("InternalError", "We encountered an internal error.", nil), http.StatusInternalServerError, "id")
+			},
+			nil,
+			false,
+			[]string{"400 URI Failure\nURI: s3://fake-access-key-id:fake-access-key-secret@s3.amazonaws.com/apt-repo-bucket/apt/generic/hello.deb\n",
+				"Message: GetObject s3://apt-repo-bucket/apt/generic/hello.deb failed: InternalError: We encountered an internal error. " +
+					"(HTTP 500, request id id)\n"},
+		},
+		"size mismatch": {
+			func(fake *testutil.FakeS3) {
+				fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{
+					Body: []byte("hello"), LastModified: lastModified, ContentLength: aws.Int64(10),
+				})
+			},
+			nil,
+			false,
+			[]string{"200 URI Start\n", "400 URI Failure\n",
+				"Message: downloaded size does not match the object size: got 5 bytes, expected 10"},
+		},
+		"hash mismatch": {
+			func(fake *testutil.FakeS3) {
+				fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello"), LastModified: lastModified})
+			},
+			[]*message.Field{field(fieldNameExpectedPrefix+"SHA256", "0000")},
+			false,
+			[]string{"200 URI Start\n", "400 URI Failure\n", "Message: hash sum mismatch: SHA256 is 2cf24dba"},
+		},
+		"too large": {
+			func(fake *testutil.FakeS3) {
+				fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello"), LastModified: lastModified})
+			},
+			[]*message.Field{field(fieldNameMaximumSize, "4")},
+			false,
+			[]string{"400 URI Failure\n", "Message: object exceeds the maximum size: 5 bytes, limit 4\n"},
+		},
+	}
+
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			fake := testutil.NewFakeS3()
+			spec.setup(fake)
+			dir := t.TempDir()
+			filename := filepath.Join(dir, "hello.deb")
+			before := testutil.SnapshotDir(t, dir)
+
+			output, err := acquire(t, fake,
+				"s3://fake-access-key-id:fake-access-key-secret@s3.amazonaws.com/apt-repo-bucket/apt/generic/hello.deb", filename,
+				spec.fields...)
+			if !strings.Contains(output, "201 URI Done\n") {
+				before.CheckUnchanged(t)
+			}
+			var fatalErr *FatalError
+			if errors.As(err, &fatalErr) != spec.expectedFatal {
+				t.Errorf("fatal error = %v; expected fatal %t", err, spec.expectedFatal)
+			}
+			for _, expected := range spec.expectedOutput {
+				if !strings.Contains(output, expected) {
+					t.Errorf("output = %q; expected it to contain %q", output, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestURIAcquireMissingPassword(t *testing.T) {
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0), WithS3ClientFactory(func(cfg ClientConfig) (s3iface.S3API, error) {
+		if _, _, err := fetcher.NewSession(cfg); err != nil {
+			return nil, err
+		}
+		return testutil.NewFakeS3(), nil
+	}))
+	close(method.configured)
+	uri := "s3://AKIDEXAMPLE@apt-repo-bucket/apt/generic/hello.deb"
+	msg := &message.Message{
+		Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+		Fields: []*message.Field{field(fieldNameURI, uri), field(fieldNameFilename, filepath.Join(t.TempDir(), "hello.deb"))},
+	}
+
+	method.acquire(context.Background(), msg)
+
+	select {
+	case err := <-method.fatalErr:
+		t.Errorf("acquire() aborted the Method: %v", err)
+	default:
+	}
+	expected := "400 URI Failure\nURI: " + uri +
+		"\nMessage: a secret access key is required when the URI contains an access key id\n"
+	if output := out.String(); !strings.Contains(output, expected) {
+		t.Errorf("output = %q; expected it to contain %q", output, expected)
+	}
+}
+
+func TestURIAcquireWarnsAboutIgnoredCredentials(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDENV")
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	fake.Put("apt-repo-bucket", "apt/generic/world.deb", testutil.FakeObject{Body: []byte("world")})
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0), WithS3ClientFactory(fakeFactory(fake)))
+	method.roleARN = "arn:aws:iam::123456789012:role/s3-apt-reader"
+	close(method.configured)
+
+	for _, name := range []string{"hello.deb", "world.deb"} {
+		method.acquire(context.Background(), &message.Message{
+			Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+			Fields: []*message.Field{
+				field(fieldNameURI, "s3://AKIDEXAMPLE:secret@apt-repo-bucket/apt/generic/"+name),
+				field(fieldNameFilename, filepath.Join(t.TempDir(), name)),
+			},
+		})
+	}
+
+	expected := "104 Warning\nMessage: Using the access key of the URI or auth.conf for credentials, " +
+		"ignoring the role of Acquire::s3::role and the access key of AWS_ACCESS_KEY_ID\n"
+	if count := strings.Count(out.String(), expected); count != 1 {
+		t.Errorf("output contains %q %d times; expected once:\n%s", expected, count, out)
+	}
+}
+
+func TestURIAcquireRecoversFromPanic(t *testing.T) {
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0), WithS3ClientFactory(func(ClientConfig) (s3iface.S3API, error) {
+		panic("boom")
+	}))
+	method.debug.Store(true)
+	close(method.configured)
+	uri := "s3://fake-access-key-id:fake-access-key-secret@s3.amazonaws.com/apt-repo-bucket/apt/generic/hello.deb"
+	msg := &message.Message{
+		Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+		Fields: []*message.Field{field(fieldNameURI, uri), field(fieldNameFilename, filepath.Join(t.TempDir(), "hello.deb"))},
+	}
+
+	method.acquire(context.Background(), msg)
+
+	select {
+	case err := <-method.fatalErr:
+		t.Errorf("acquire() aborted the Method: %v", err)
+	default:
+	}
+	output := out.String()
+	for _, expected := range []string{
+		"Message: Recovered from panic acquiring " + uri + ": boom\n",
+		"Message: goroutine ",
+		"400 URI Failure\nURI: " + uri + "\nMessage: internal error, rerun with Debug::Acquire::s3 for details: boom\n",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("output = %q; expected it to contain %q", output, expected)
+		}
+	}
+}
+
+// A panickingS3 is a FakeS3 that panics on HeadObject for one key, like a
+// bug triggered by a single object would.
+type panickingS3 struct {
+	*testutil.FakeS3
+	key string
+}
+
+func (fake panickingS3) HeadObjectWithContext(
+	ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option,
+) (*s3.HeadObjectOutput, error) {
+	if aws.StringValue(input.Key) == fake.key {
+		var metadata map[string]*string
+		metadata["boom"] = nil
+	}
+	return fake.FakeS3.HeadObjectWithContext(ctx, input, opts...)
+}
+
+func TestRunContinuesAfterPanic(t *testing.T) {
+	fake := panickingS3{FakeS3: testutil.NewFakeS3(), key: "apt/generic/panic.deb"}
+	for _, key := range []string{"apt/generic/panic.deb", "apt/generic/hello.deb", "apt/generic/world.deb"} {
+		fake.Put("apt-repo-bucket", key, testutil.FakeObject{Body: []byte("hello")})
+	}
+	input := configMsg
+	for _, name := range []string{"hello.deb", "panic.deb", "world.deb"} {
+		input += "600 URI Acquire\nURI: s3://fake-access-key-id:fake-access-key-secret@apt-repo-bucket/apt/generic/" + name + "\n" +
+			"Filename: " + filepath.Join(t.TempDir(), name) + "\n\n"
+	}
+	out := &bytes.Buffer{}
+	method := NewWithOptions(Options{
+		Input:  strings.NewReader(input),
+		Output: out,
+		S3ClientFactory: func(ClientConfig) (s3iface.S3API, error) {
+			return fake, nil
 		},
+	})
+
+	errc := make(chan error, 1)
+	go func() { errc <- method.Run() }()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("Run() = %v; expected nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return after the input was exhausted")
+	}
+
+	output := out.String()
+	if count := strings.Count(output, "400 URI Failure\n"); count != 1 {
+		t.Errorf("output has %d URI Failures; expected one:\n%s", count, output)
+	}
+	expected := "Message: internal error, rerun with Debug::Acquire::s3 for details: assignment to entry in nil map\n"
+	if !strings.Contains(output, expected) {
+		t.Errorf("output = %q; expected it to contain %q", output, expected)
+	}
+	if count := strings.Count(output, "201 URI Done\n"); count != 2 {
+		t.Errorf("output has %d URI Dones; expected two:\n%s", count, output)
+	}
+}
+
+func TestRunEchoesURIsVerbatim(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "pool/main/h/hello/hello_1.0+1~bpo_amd64.deb", testutil.FakeObject{Body: []byte("hello")})
+	// Lower case escapes, escaped characters that need none and credentials
+	// that preProcessURL re-encodes all change when the URI is re-encoded.
+	uris := []string{
+		"s3://AKID%2fEXAMPLE:se%2bcret@apt-repo-bucket/pool/main/h/hello/hello_1.0%2b1%7Ebpo_amd64.deb",
+		"s3://AKID%2fEXAMPLE:se%2bcret@apt-repo-bucket/pool/main/h/hello/missing_1.0%2b1%7Ebpo_amd64.deb",
+	}
+	input := configMsg
+	for idx, uri := range uris {
+		input += fmt.Sprintf("600 URI Acquire\nURI: %s\nFilename: %s\n\n", uri, filepath.Join(t.TempDir(), fmt.Sprintf("%d.deb", idx)))
+	}
+	out := &bytes.Buffer{}
+	method := NewWithOptions(Options{
+		Input:           strings.NewReader(input),
+		Output:          out,
+		S3ClientFactory: func(ClientConfig) (s3iface.S3API, error) { return fake, nil },
+	})
+
+	errc := make(chan error, 1)
+	go func() { errc <- method.Run() }()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("Run() = %v; expected nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return after the input was exhausted")
+	}
+
+	echoed := map[string]bool{}
+	for _, msg := range strings.Split(strings.TrimSpace(out.String()), "\n\n") {
+		header, fields, _ := strings.Cut(msg, "\n")
+		for _, line := range strings.Split(fields, "\n") {
+			if uri, found := strings.CutPrefix(line, "URI: "); found {
+				echoed[header+" "+uri] = true
+			}
+		}
+	}
+	expected := map[string]bool{
+		"102 Status " + uris[0]:      true,
+		"200 URI Start " + uris[0]:   true,
+		"201 URI Done " + uris[0]:    true,
+		"102 Status " + uris[1]:      true,
+		"400 URI Failure " + uris[1]: true,
 	}
+	if diff := cmp.Diff(expected, echoed); diff != "" {
+		t.Errorf("URIs of the messages sent differ (-expected +actual):\n%s", diff)
+	}
+}
 
-	for _, spec := range locTests {
-		objLoc, err := newLocation(spec.url, "s3.amazonaws.com")
+func TestRunIgnoresUnknownMessages(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	input := configMsg + "700 Future Request\nURI: s3://apt-repo-bucket/apt/generic/hello.deb\n\n" +
+		"603 Media Changed\nMedia: Debian\n\n" +
+		"600 URI Acquire\nURI: s3://apt-repo-bucket/apt/generic/hello.deb\nFilename: " + filepath.Join(t.TempDir(), "hello.deb") + "\n\n"
+	out, diagnostics := &bytes.Buffer{}, &bytes.Buffer{}
+	method := NewWithOptions(Options{
+		Input:           strings.NewReader(input),
+		Output:          out,
+		Diagnostics:     diagnostics,
+		LogLevel:        LogLevelDebug,
+		S3ClientFactory: func(ClientConfig) (s3iface.S3API, error) { return fake, nil },
+	})
+
+	errc := make(chan error, 1)
+	go func() { errc <- method.Run() }()
+	select {
+	case err := <-errc:
 		if err != nil {
-			t.Fatalf("unexpected error: %v", err)
+			t.Errorf("Run() = %v; expected nil", err)
 		}
-		if objLoc.uri.User.Username() != spec.accessKey {
-			t.Errorf("unexpected accessKey: got %s, want %s", objLoc.uri.User.Username(), spec.accessKey)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return after the input was exhausted")
+	}
+
+	if output := out.String(); !strings.Contains(output, "201 URI Done\n") {
+		t.Errorf("output = %q; expected it to contain a URI Done", output)
+	}
+	expected := "Ignoring message 700 Future Request, which the method does not understand"
+	if logged := diagnostics.String(); !strings.Contains(logged, expected) || strings.Contains(logged, "Ignoring message 603") {
+		t.Errorf("diagnostics = %q; expected them to contain %q only", logged, expected)
+	}
+}
+
+// An overlapTrackingS3 is a FakeS3 that records how many object bodies are
+// being read at once.
+type overlapTrackingS3 struct {
+	*testutil.FakeS3
+	mu            sync.Mutex
+	open, maxOpen int
+}
+
+func (fake *overlapTrackingS3) GetObjectWithContext(
+	ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option,
+) (*s3.GetObjectOutput, error) {
+	output, err := fake.FakeS3.GetObjectWithContext(ctx, input, opts...)
+	if err != nil {
+		return nil, err
+	}
+	fake.mu.Lock()
+	fake.open++
+	fake.maxOpen = max(fake.maxOpen, fake.open)
+	fake.mu.Unlock()
+	// Give a concurrent acquire the chance to start its own read.
+	time.Sleep(20 * time.Millisecond)
+	output.Body = closeNotifier{ReadCloser: output.Body, onClose: func() {
+		fake.mu.Lock()
+		fake.open--
+		fake.mu.Unlock()
+	}}
+	return output, nil
+}
+
+type closeNotifier struct {
+	io.ReadCloser
+	onClose func()
+}
+
+func (c closeNotifier) Close() error {
+	c.onClose()
+	return c.ReadCloser.Close()
+}
+
+func TestRunStopsProcessingMessages(t *testing.T) {
+	method := NewWithOptions(Options{Input: strings.NewReader(configMsg), Output: &bytes.Buffer{}})
+	if err := method.Run(); err != nil {
+		t.Fatalf("Run() = %v; expected nil", err)
+	}
+
+	stacks := make([]byte, 1<<20)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stacks = stacks[:runtime.Stack(stacks[:cap(stacks)], true)]
+		if !bytes.Contains(stacks, []byte("(*Method).processMessages")) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("processMessages is still running after Run() returned:\n%s", stacks)
 		}
-		pass, _ := objLoc.uri.User.Password()
-		if pass != spec.accessKeySecret {
-			t.Errorf("unexpected accessKeySecret: got %s, want %s", pass, spec.accessKeySecret)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunStopsReadingInputAfterFatalError(t *testing.T) {
+	readers := func() int {
+		stacks := make([]byte, 1<<20)
+		stacks = stacks[:runtime.Stack(stacks, true)]
+		return bytes.Count(stacks, []byte("(*Method).readInput"))
+	}
+	before := readers()
+
+	// apt keeps writing messages after an acquire without a Filename, a
+	// protocol error, ended Run.
+	inputReader, inputWriter := io.Pipe()
+	t.Cleanup(func() { inputReader.Close() })
+	go func() {
+		message := configMsg + "600 URI Acquire\nURI: s3://apt-repo-bucket/apt/generic/hello.deb\n\n"
+		for {
+			if _, err := io.WriteString(inputWriter, message); err != nil {
+				return
+			}
+			message = "602 Unknown\nFoo: bar\n\n"
+		}
+	}()
+	method := NewWithOptions(Options{Input: inputReader, Output: &lockedBuffer{}})
+	if err := method.Run(); !isFatal(err) {
+		t.Fatalf("Run() = %v; expected a *FatalError", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for readers() > before {
+		if time.Now().After(deadline) {
+			t.Fatal("readInput is still running after Run() returned")
 		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunSerializesAcquiresOfOneFilename(t *testing.T) {
+	fake := &overlapTrackingS3{FakeS3: testutil.NewFakeS3()}
+	for _, bucket := range []string{"apt-repo-bucket", "apt-mirror-bucket"} {
+		fake.Put(bucket, "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello, " + bucket)})
+	}
+	filename := filepath.Join(t.TempDir(), "hello.deb")
+	input := configMsg
+	for _, bucket := range []string{"apt-repo-bucket", "apt-mirror-bucket"} {
+		input += "600 URI Acquire\nURI: s3://fake-access-key-id:fake-access-key-secret@" + bucket + "/apt/generic/hello.deb\n" +
+			"Filename: " + filename + "\n\n"
+	}
+	out := &bytes.Buffer{}
+	method := NewWithOptions(Options{
+		Input:  strings.NewReader(input),
+		Output: out,
+		S3ClientFactory: func(ClientConfig) (s3iface.S3API, error) {
+			return fake, nil
+		},
+	})
+
+	errc := make(chan error, 1)
+	go func() { errc <- method.Run() }()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("Run() = %v; expected nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return after the input was exhausted")
+	}
+
+	output := out.String()
+	if count := strings.Count(output, "201 URI Done\n"); count != 2 {
+		t.Errorf("output has %d URI Dones; expected two:\n%s", count, output)
+	}
+	if fake.maxOpen != 1 {
+		t.Errorf("%d objects were written to %s at once; expected one", fake.maxOpen, filename)
+	}
+	if n := method.filenames.len(); n != 0 {
+		t.Errorf("method.filenames holds %d Filenames after Run(); expected none", n)
+	}
+}
+
+func TestRunHostEndpoints(t *testing.T) {
+	aws, minio := testutil.NewFakeS3(), testutil.NewFakeS3()
+	aws.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello from AWS")})
+	minio.Put("apt-mirror", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello from MinIO")})
+	minio.Put("apt-repo", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello from MinIO")})
+	dir := t.TempDir()
+	input := strings.Replace(configMsg, "\n\n",
+		"\nConfig-Item: Acquire::s3::endpoint::minio.internal=https://minio.internal:9000/{bucket}\n\n", 1)
+	for idx, uri := range []string{
+		"s3://apt-repo-bucket/apt/generic/hello.deb",
+		"s3://minio.internal:9000/apt-mirror/apt/generic/hello.deb",
+		"s3://apt-repo.minio.internal/apt/generic/hello.deb",
+	} {
+		input += fmt.Sprintf("600 URI Acquire\nURI: %s\nFilename: %s\n\n", uri, filepath.Join(dir, fmt.Sprintf("hello-%d.deb", idx)))
+	}
+	var mu sync.Mutex
+	var endpoints []string
+	out := &bytes.Buffer{}
+	method := NewWithOptions(Options{
+		Input:  strings.NewReader(input),
+		Output: out,
+		S3ClientFactory: func(cfg ClientConfig) (s3iface.S3API, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			endpoints = append(endpoints, fmt.Sprintf("%s path-style %t", cfg.Endpoint, cfg.PathStyle))
+			if cfg.Endpoint == "" {
+				return aws, nil
+			}
+			return minio, nil
+		},
+	})
+
+	errc := make(chan error, 1)
+	go func() { errc <- method.Run() }()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("Run() = %v; expected nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return after the input was exhausted")
+	}
+
+	output := out.String()
+	if count := strings.Count(output, "201 URI Done\n"); count != 3 {
+		t.Errorf("output has %d URI Dones; expected three:\n%s", count, output)
+	}
+	for _, expected := range []string{"Connecting to s3.us-east-2.amazonaws.com\n", "Connecting to minio.internal\n"} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("output does not contain %q:\n%s", expected, output)
+		}
+	}
+	sort.Strings(endpoints)
+	expected := []string{
+		" path-style false",
+		"https://minio.internal:9000 path-style true",
+		"https://minio.internal:9000 path-style true",
+	}
+	if diff := cmp.Diff(expected, endpoints); diff != "" {
+		t.Errorf("endpoints of the S3 clients differ (-expected +actual):\n%s", diff)
+	}
+}
+
+func TestRecoverMessage(t *testing.T) {
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0))
+
+	func() {
+		defer method.recoverMessage()
+		panic("boom")
+	}()
+
+	select {
+	case err := <-method.fatalErr:
+		if !errors.Is(err, errPanicked) {
+			t.Errorf("recoverMessage() aborted the Method with %v; expected %v", err, errPanicked)
+		}
+	default:
+		t.Errorf("recoverMessage() did not abort the Method")
+	}
+	expected := "401 General Failure\nMessage: internal error, rerun with Debug::Acquire::s3 for details: boom\n"
+	if !strings.Contains(out.String(), expected) {
+		t.Errorf("output = %q; expected it to contain %q", out, expected)
+	}
+}
+
+func TestRunEndToEnd(t *testing.T) {
+	lastModified := time.Date(2018, time.October, 25, 20, 17, 39, 0, time.UTC)
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello"), LastModified: lastModified})
+	filename := filepath.Join(t.TempDir(), "hello.deb")
+
+	input := configMsg + "600 URI Acquire\n" +
+		"URI: s3://fake-access-key-id:fake-access-key-secret@s3.us-east-2.amazonaws.com/apt-repo-bucket/apt/generic/hello.deb\n" +
+		"Filename: " + filename + "\n\n"
+	out := &bytes.Buffer{}
+	method := NewWithOptions(Options{
+		Input:           strings.NewReader(input),
+		Output:          out,
+		S3ClientFactory: fakeFactory(fake),
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := method.Run(); err != nil {
+			t.Errorf("Run() = %v; expected nil", err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return after the input was exhausted")
+	}
+
+	statuses := []int{}
+	for _, raw := range strings.SplitAfter(strings.TrimSpace(out.String()), "\n\n") {
+		msg, err := message.FromBytes([]byte(raw))
+		if err != nil {
+			t.Fatalf("failed to parse emitted message %q: %v", raw, err)
+		}
+		statuses = append(statuses, msg.Header.Status)
+		if msg.Header.Status == headerCodeURIDone {
+			if value, _ := msg.GetFieldValue(fieldNameFilename); value != filename {
+				t.Errorf("URI Done Filename = %s; expected %s", value, filename)
+			}
+		}
+	}
+	expected := []int{
+		headerCodeCapabilities, headerCodeGeneralLog, headerCodeStatus, headerCodeStatus, headerCodeURIStart, headerCodeURIDone,
+	}
+	if diff := cmp.Diff(expected, statuses); diff != "" {
+		t.Errorf("emitted message codes mismatch (-want +got):\n%s", diff)
+	}
+
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("failed to read downloaded file: %v", err)
+	}
+	if string(contents) != "hello" {
+		t.Errorf("downloaded contents = %q; expected %q", contents, "hello")
+	}
+}
+
+func TestRunReturnsFatalError(t *testing.T) {
+	fake := testutil.NewFakeS3()
+
+	// An acquire without a Filename is a protocol error of apt.
+	input := configMsg + "600 URI Acquire\n" +
+		"URI: s3://fake-access-key-id:fake-access-key-secret@s3.us-east-2.amazonaws.com/apt-repo-bucket/apt/generic/hello.deb\n\n"
+	out := &bytes.Buffer{}
+	method := NewWithOptions(Options{
+		Input:           strings.NewReader(input),
+		Output:          out,
+		S3ClientFactory: fakeFactory(fake),
+	})
+
+	errc := make(chan error, 1)
+	go func() { errc <- method.Run() }()
+	var err error
+	select {
+	case err = <-errc:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return after a fatal error")
+	}
+
+	var fatalErr *FatalError
+	if !errors.As(err, &fatalErr) {
+		t.Errorf("Run() = %v; expected a *FatalError", err)
+	}
+	if !strings.Contains(out.String(), "401 General Failure\n") {
+		t.Errorf("output = %q; expected a General Failure", out.String())
+	}
+}
+
+func TestRunContinuesAfterResumesUsedUp(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "pool/broken.deb", testutil.FakeObject{Body: []byte("broken off twice"), ETag: "etag-1"})
+	fake.Put("apt-repo-bucket", "pool/hello.deb", testutil.FakeObject{Body: []byte("hello"), ETag: "etag-2"})
+	fake.ResetAt = []int64{5, 10}
+
+	dir := t.TempDir()
+	brokenURI := "s3://apt-repo-bucket.s3.us-east-2.amazonaws.com/pool/broken.deb"
+	helloURI := "s3://apt-repo-bucket.s3.us-east-2.amazonaws.com/pool/hello.deb"
+	input := strings.Replace(configMsg, "\n\n", "\nConfig-Item: Acquire::s3::multipart=false\n"+
+		"Config-Item: Acquire::s3::resume-attempts=1\n\n", 1) +
+		"600 URI Acquire\nURI: " + brokenURI + "\nFilename: " + filepath.Join(dir, "broken.deb") + "\n\n" +
+		"600 URI Acquire\nURI: " + helloURI + "\nFilename: " + filepath.Join(dir, "hello.deb") + "\n\n"
+	out := &lockedBuffer{}
+	method := NewWithOptions(Options{
+		Input:           strings.NewReader(input),
+		Output:          out,
+		S3ClientFactory: fakeFactory(fake),
+	})
+	errc := make(chan error, 1)
+	go func() { errc <- method.Run() }()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("Run() = %v; expected nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return after the input was exhausted")
+	}
+
+	expected := "400 URI Failure\nURI: " + brokenURI +
+		"\nMessage: the broken off download could not be resumed: broken off at byte 10 after 1 resumes"
+	if !strings.Contains(out.String(), expected) || strings.Contains(out.String(), "401 General Failure") {
+		t.Errorf("output = %q; expected a URI Failure containing %q", out, expected)
+	}
+	if expected := "201 URI Done\nURI: " + helloURI + "\n"; !strings.Contains(out.String(), expected) {
+		t.Errorf("output = %q; expected the other acquire to be done", out)
+	}
+}
+
+func TestAcquireError(t *testing.T) {
+	specs := map[string]struct {
+		err           error
+		expectedFatal bool
+	}{
+		"request":       {&fetcher.RequestError{Op: "GetObject", Code: "InternalError", StatusCode: http.StatusInternalServerError}, false},
+		"connection":    {syscall.ECONNRESET, false},
+		"size mismatch": {fetcher.ErrSizeMismatch, false},
+		"session":       {fmt.Errorf("%w: no region", fetcher.ErrSession), true},
+		"client cert":   {fmt.Errorf("%w /etc/apt/cert.pem", fetcher.ErrClientCert), true},
+		"endpoint":      {fmt.Errorf("%w https://{bucket}.example", fetcher.ErrInvalidEndpoint), true},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			err := acquireError(spec.err)
+			if isFatal(err) != spec.expectedFatal {
+				t.Errorf("acquireError(%v) = %#v; expected fatal %t", spec.err, err, spec.expectedFatal)
+			}
+			if !errors.Is(err, spec.err) {
+				t.Errorf("acquireError(%v) = %v; expected it to wrap the error", spec.err, err)
+			}
+		})
+	}
+}
+
+// TestRunStress pipelines hundreds of messages through Run, so that running it
+// with -race exercises the WaitGroup accounting of every message kind.
+func TestRunStress(t *testing.T) {
+	const objects, acquires, misses, unknown = 10, 300, 50, 50
+	fake := testutil.NewFakeS3()
+	for i := range objects {
+		fake.Put("apt-repo-bucket", fmt.Sprintf("pool/%d.deb", i), testutil.FakeObject{Body: []byte(strconv.Itoa(i))})
+	}
+	tmpDir := t.TempDir()
+
+	input := &strings.Builder{}
+	input.WriteString(configMsg)
+	for i := range acquires {
+		fmt.Fprintf(input, "600 URI Acquire\nURI: s3://apt-repo-bucket.s3.us-east-2.amazonaws.com/pool/%d.deb\n"+
+			"Filename: %s\n\n", i%objects, filepath.Join(tmpDir, strconv.Itoa(i)))
+		if i%(acquires/misses) == 0 {
+			fmt.Fprintf(input, "600 URI Acquire\nURI: s3://apt-repo-bucket.s3.us-east-2.amazonaws.com/pool/missing-%d.deb\n"+
+				"Filename: %s\n\n", i, filepath.Join(tmpDir, "missing-"+strconv.Itoa(i)))
+		}
+		if i%(acquires/unknown) == 0 {
+			input.WriteString("602 Unknown\nFoo: bar\n\n")
+		}
+	}
+	out := &bytes.Buffer{}
+	method := NewWithOptions(Options{
+		Input:           strings.NewReader(input.String()),
+		Output:          out,
+		S3ClientFactory: fakeFactory(fake),
+	})
+
+	errc := make(chan error, 1)
+	go func() { errc <- method.Run() }()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("Run() = %v; expected nil", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run() did not return after all messages were processed")
+	}
+
+	if actual := strings.Count(out.String(), "201 URI Done\n"); actual != acquires {
+		t.Errorf("got %d URI Done messages; expected %d", actual, acquires)
+	}
+	if actual := strings.Count(out.String(), "400 URI Failure\n"); actual != misses {
+		t.Errorf("got %d URI Failure messages; expected %d", actual, misses)
+	}
+}
+
+func TestRunCancelsAfterInputDrainTimeout(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello world")})
+	fake.StallAfter = 5
+	fake.Stalled = make(chan struct{})
+	clock := testutil.NewFakeClock(time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC))
+
+	input := configMsg + "600 URI Acquire\n" +
+		"URI: s3://fake-access-key-id:fake-access-key-secret@s3.us-east-2.amazonaws.com/apt-repo-bucket/apt/generic/hello.deb\n" +
+		"Filename: " + filepath.Join(t.TempDir(), "hello.deb") + "\n\n"
+	out := &bytes.Buffer{}
+	method := NewWithOptions(Options{
+		Input:           strings.NewReader(input),
+		Output:          out,
+		S3ClientFactory: fakeFactory(fake),
+		Clock:           clock,
+	})
+
+	errc := make(chan error, 1)
+	go func() { errc <- method.Run() }()
+	<-fake.Stalled
+	clock.BlockUntil(1)
+	clock.Advance(inputDrainTimeout)
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("Run() = %v; expected nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return after the input drain timeout")
+	}
+	if !strings.Contains(out.String(), "400 URI Failure\n") {
+		t.Errorf("output = %q; expected a URI Failure for the cancelled acquire", out.String())
+	}
+}
+
+func TestURIAcquireCancelledMidDownload(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello world")})
+	fake.StallAfter = 5
+	fake.Stalled = make(chan struct{})
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "hello.deb")
+	before := testutil.SnapshotDir(t, dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-fake.Stalled
+		cancel()
+	}()
+	output, err := acquireWithContext(ctx, t, fake,
+		"s3://fake-access-key-id:fake-access-key-secret@s3.amazonaws.com/apt-repo-bucket/apt/generic/hello.deb", filename)
+
+	if err != nil {
+		t.Errorf("fatal error = %v; expected none", err)
+	}
+	if count := strings.Count(output, "400 URI Failure\n"); count != 1 {
+		t.Errorf("output = %q; expected exactly one URI Failure, found %d", output, count)
+	}
+	if strings.Contains(output, "201 URI Done\n") || strings.Contains(output, "401 General Failure\n") {
+		t.Errorf("output = %q; expected no URI Done or General Failure", output)
+	}
+	before.CheckUnchanged(t)
+}
+
+// fakeFactory returns an S3ClientFactory that always hands out the fake.
+// BenchmarkAcquireSmallFiles measures the allocations of acquiring files of
+// the size of the Release, InRelease and small Packages files an update
+// mostly consists of.
+func BenchmarkAcquireSmallFiles(b *testing.B) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "dists/stable/InRelease", testutil.FakeObject{Body: bytes.Repeat([]byte("a"), 8<<10)})
+	method := New(log.New(io.Discard, "", 0), WithS3ClientFactory(fakeFactory(fake)))
+	close(method.configured)
+	msg := &message.Message{
+		Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+		Fields: []*message.Field{
+			field(fieldNameURI, "s3://apt-repo-bucket/dists/stable/InRelease"),
+			field(fieldNameFilename, filepath.Join(b.TempDir(), "InRelease")),
+		},
+	}
+	b.ReportAllocs()
+	for b.Loop() {
+		method.acquire(context.Background(), msg)
+	}
+}
+
+func fakeFactory(fake *testutil.FakeS3) S3ClientFactory {
+	return func(ClientConfig) (s3iface.S3API, error) {
+		return fake, nil
+	}
+}
+
+// acquire runs an acquire of the given URI, with any additional fields, against
+// the fake S3 and returns everything the Method wrote, along with the fatal
+// error if it aborted.
+func acquire(t *testing.T, fake *testutil.FakeS3, uri, filename string, fields ...*message.Field) (string, error) {
+	t.Helper()
+	return acquireWithContext(context.Background(), t, fake, uri, filename, fields...)
+}
+
+// acquireWithContext is acquire with a caller-provided context.
+func acquireWithContext(
+	ctx context.Context, t *testing.T, fake *testutil.FakeS3, uri, filename string, fields ...*message.Field,
+) (string, error) {
+	t.Helper()
+	out := &bytes.Buffer{}
+	method := New(log.New(out, "", 0), WithS3ClientFactory(fakeFactory(fake)))
+	close(method.configured)
+
+	msg := &message.Message{
+		Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+		Fields: append([]*message.Field{field(fieldNameURI, uri), field(fieldNameFilename, filename)}, fields...),
+	}
+	method.acquire(ctx, msg)
+
+	select {
+	case err := <-method.fatalErr:
+		return out.String(), err
+	default:
+		return out.String(), nil
 	}
 }
 
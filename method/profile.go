@@ -0,0 +1,85 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime/pprof"
+	"runtime/trace"
+	"sync"
+)
+
+// profiles captures a CPU profile and an execution trace of a Method's run, as
+// Acquire::s3::Profile and Acquire::s3::Trace ask for, to diagnose slow
+// updates. The zero value captures nothing.
+type profiles struct {
+	mu         sync.Mutex
+	cpu, trace *os.File
+}
+
+// start starts writing a CPU profile to cpuPath and an execution trace to
+// tracePath, skipping empty paths and whatever is already being captured.
+func (p *profiles) start(cpuPath, tracePath string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var errs []error
+	if cpuPath != "" && p.cpu == nil {
+		file, err := startCapture(cpuPath, pprof.StartCPUProfile)
+		p.cpu = file
+		errs = append(errs, err)
+	}
+	if tracePath != "" && p.trace == nil {
+		file, err := startCapture(tracePath, trace.Start)
+		p.trace = file
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// startCapture creates the file at path and starts capturing into it. It
+// returns nil and removes the file if the capture could not be started.
+func startCapture(path string, start func(w io.Writer) error) (*os.File, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := start(file); err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, fmt.Errorf("capturing to %s: %w", path, err)
+	}
+	return file, nil
+}
+
+// stop stops any capture and flushes it to its file.
+func (p *profiles) stop() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var errs []error
+	if p.cpu != nil {
+		pprof.StopCPUProfile()
+		errs = append(errs, p.cpu.Close())
+		p.cpu = nil
+	}
+	if p.trace != nil {
+		trace.Stop()
+		errs = append(errs, p.trace.Close())
+		p.trace = nil
+	}
+	return errors.Join(errs...)
+}
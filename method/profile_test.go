@@ -0,0 +1,79 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+)
+
+func TestRunWritesProfilesOnFailure(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	dir := t.TempDir()
+	profile, trace := filepath.Join(dir, "apt-s3.pprof"), filepath.Join(dir, "apt-s3.trace")
+
+	// An acquire without a Filename is a protocol error of apt.
+	input := "601 Configuration\n" +
+		"Config-Item: Acquire::s3::region=us-east-1\n" +
+		"Config-Item: Acquire::s3::Profile=" + profile + "\n" +
+		"Config-Item: Acquire::s3::Trace=" + trace + "\n\n" +
+		"600 URI Acquire\n" +
+		"URI: s3://apt-repo-bucket/apt/generic/hello.deb\n\n"
+	out := &bytes.Buffer{}
+	method := NewWithOptions(Options{
+		Input:           strings.NewReader(input),
+		Output:          out,
+		S3ClientFactory: fakeFactory(fake),
+	})
+
+	errc := make(chan error, 1)
+	go func() { errc <- method.Run() }()
+	select {
+	case err := <-errc:
+		if !isFatal(err) {
+			t.Fatalf("Run() = %v; expected a *FatalError", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return after a fatal error")
+	}
+
+	for _, filename := range []string{profile, trace} {
+		if info, err := os.Stat(filename); err != nil || info.Size() == 0 {
+			t.Errorf("%s was not written: %v", filename, err)
+		}
+	}
+	if strings.Contains(out.String(), "104 Warning") {
+		t.Errorf("output = %q; expected no warnings", out)
+	}
+}
+
+func TestProfilesInertWhenUnset(t *testing.T) {
+	var p profiles
+	if err := p.start("", ""); err != nil {
+		t.Errorf("start() = %v; expected nil", err)
+	}
+	if p.cpu != nil || p.trace != nil {
+		t.Error("start() captured without a path")
+	}
+	if err := p.stop(); err != nil {
+		t.Errorf("stop() = %v; expected nil", err)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+const (
+	providerGeneric      = "generic"
+	namespacePlaceholder = "{namespace}"
+)
+
+var (
+	errProviderEndpoint  = errors.New("needs " + configItemAcquireS3Endpoint)
+	errProviderNamespace = errors.New("needs " + configItemAcquireS3Namespace)
+)
+
+// A providerPreset holds the settings an S3 compatible provider needs, which
+// Acquire::s3::provider applies unless they are configured explicitly.
+type providerPreset struct {
+	// endpoint is the endpoint template of the provider. Its {namespace}
+	// placeholder is replaced by Acquire::s3::namespace.
+	endpoint string
+	// region is the region assumed when none is configured.
+	region string
+}
+
+// providerPresets holds the presets Acquire::s3::provider names. The generic
+// preset is for services with a flat namespace of buckets, such as MinIO or
+// Ceph, whose Acquire::s3::endpoint is addressed path-style.
+var providerPresets = map[string]providerPreset{ //nolint:gochecknoglobals
+	"wasabi":   {endpoint: "https://s3.{region}.wasabisys.com/{bucket}", region: "us-east-1"},
+	"scaleway": {endpoint: "https://s3.{region}.scw.cloud/{bucket}", region: "fr-par"},
+	"oracle": {
+		endpoint: "https://{namespace}.compat.objectstorage.{region}.oraclecloud.com/{bucket}",
+		region:   "us-ashburn-1",
+	},
+	providerGeneric: {},
+}
+
+// providerNames returns the names of the provider presets in order.
+func providerNames() []string {
+	return slices.Sorted(maps.Keys(providerPresets))
+}
+
+// applyProvider fills in the endpoint and region of the configured provider
+// preset that are not configured explicitly. It returns a FatalError if the
+// preset lacks a setting only the user can give.
+func (method *Method) applyProvider() error {
+	preset, found := providerPresets[method.provider]
+	if !found {
+		return nil
+	}
+	if !method.regionConfigured && preset.region != "" {
+		method.region = preset.region
+	}
+	switch {
+	case method.provider == providerGeneric && method.endpoint == "":
+		return fatal(fmt.Errorf("%s %s %w", configItemAcquireS3Provider, method.provider, errProviderEndpoint))
+	case method.provider == providerGeneric && !strings.Contains(method.endpoint, "{bucket}"):
+		method.endpoint = strings.TrimSuffix(method.endpoint, "/") + "/{bucket}"
+	case method.endpoint != "":
+		// The configured endpoint takes precedence over the preset's.
+	case strings.Contains(preset.endpoint, namespacePlaceholder) && method.namespace == "":
+		return fatal(fmt.Errorf("%s %s %w", configItemAcquireS3Provider, method.provider, errProviderNamespace))
+	default:
+		method.endpoint = strings.ReplaceAll(preset.endpoint, namespacePlaceholder, method.namespace)
+	}
+	method.debugf("Using the %s provider preset: endpoint %s, region %s", method.provider, method.endpoint, method.region)
+	return nil
+}
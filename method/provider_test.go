@@ -0,0 +1,119 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/google/apt-golang-s3/message"
+)
+
+func TestConfigureProvider(t *testing.T) {
+	specs := map[string]struct {
+		items    []string
+		expected ClientConfig
+	}{
+		"wasabi": {
+			[]string{"Acquire::s3::provider=wasabi", "Acquire::s3::region=eu-central-1"},
+			ClientConfig{Region: "eu-central-1", Endpoint: "https://s3.eu-central-1.wasabisys.com", PathStyle: true},
+		},
+		"scaleway": {
+			[]string{"Acquire::s3::provider=scaleway"},
+			ClientConfig{Region: "fr-par", Endpoint: "https://s3.fr-par.scw.cloud", PathStyle: true},
+		},
+		"oracle": {
+			[]string{"Acquire::s3::provider=oracle", "Acquire::s3::namespace=axaxnpcrorw5", "Acquire::s3::region=eu-frankfurt-1"},
+			ClientConfig{
+				Region:    "eu-frankfurt-1",
+				Endpoint:  "https://axaxnpcrorw5.compat.objectstorage.eu-frankfurt-1.oraclecloud.com",
+				PathStyle: true,
+			},
+		},
+		"generic": {
+			[]string{"Acquire::s3::provider=generic", "Acquire::s3::endpoint=https://minio.internal:9000/"},
+			ClientConfig{Region: "us-east-1", Endpoint: "https://minio.internal:9000", PathStyle: true},
+		},
+		"explicit endpoint": {
+			[]string{"Acquire::s3::provider=wasabi", "Acquire::s3::endpoint=https://{bucket}.s3.wasabisys.com"},
+			ClientConfig{Region: "us-east-1", Endpoint: "https://s3.wasabisys.com"},
+		},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			method := New(log.New(out, "", 0))
+			msg := &message.Message{}
+			for _, item := range spec.items {
+				msg.Fields = append(msg.Fields, field(fieldNameConfigItem, item))
+			}
+
+			method.configure(msg)
+
+			select {
+			case err := <-method.fatalErr:
+				t.Fatalf("configure() aborted the Method: %v", err)
+			default:
+			}
+			f := method.fetcher()
+			loc, err := f.Locate("s3://apt-repo-bucket/dists/stable/Release")
+			if err != nil {
+				t.Fatalf("Locate() returned %v; expected nil", err)
+			}
+			if loc.Bucket != "apt-repo-bucket" {
+				t.Errorf("Locate().Bucket = %s; expected apt-repo-bucket", loc.Bucket)
+			}
+			actual := f.ClientConfig(loc)
+			actual = ClientConfig{Region: actual.Region, Endpoint: actual.Endpoint, PathStyle: actual.PathStyle}
+			if diff := cmp.Diff(spec.expected, actual); diff != "" {
+				t.Errorf("ClientConfig() differs (-expected +actual):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestConfigureProviderMissingSetting(t *testing.T) {
+	specs := map[string]struct {
+		items    []string
+		expected error
+	}{
+		"generic without endpoint": {[]string{"Acquire::s3::provider=generic"}, errProviderEndpoint},
+		"oracle without namespace": {[]string{"Acquire::s3::provider=oracle"}, errProviderNamespace},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			method := New(log.New(&bytes.Buffer{}, "", 0))
+			msg := &message.Message{}
+			for _, item := range spec.items {
+				msg.Fields = append(msg.Fields, field(fieldNameConfigItem, item))
+			}
+
+			method.configure(msg)
+
+			select {
+			case err := <-method.fatalErr:
+				if !errors.Is(err, spec.expected) {
+					t.Errorf("configure() aborted the Method with %v; expected %v", err, spec.expected)
+				}
+			default:
+				t.Errorf("configure() did not abort the Method; expected %v", spec.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"context"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+const (
+	configItemAcquireQueueMode     = "Acquire::Queue-Mode"
+	configItemAcquireS3MaxParallel = "Acquire::s3::Max-Parallel"
+	queueModeHost                  = "host"
+)
+
+// An acquireQueue limits how many acquires run at once, in total and, in
+// apt's host queue mode, per URI host. The zero limit means no limit. The
+// limits may be changed while acquires run, which count against the new
+// ones.
+type acquireQueue struct {
+	mu          sync.Mutex
+	maxParallel int
+	perHost     bool
+	running     int
+	// hosts counts the running acquires of each host, whatever the mode, so
+	// that those count once the host queue mode is turned on.
+	hosts map[string]int
+	// changed is closed, and replaced, whenever an acquire finishes or the
+	// limits change, to wake the acquires waiting to enter.
+	changed chan struct{}
+}
+
+func newAcquireQueue(maxParallel int, perHost bool) *acquireQueue {
+	queue := &acquireQueue{hosts: map[string]int{}, changed: make(chan struct{})}
+	queue.configure(maxParallel, perHost)
+	return queue
+}
+
+// configure changes the limits of the queue.
+func (queue *acquireQueue) configure(maxParallel int, perHost bool) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.maxParallel, queue.perHost = maxParallel, perHost
+	queue.notify()
+}
+
+// String describes the concurrency of the queue for the debug log.
+func (queue *acquireQueue) String() string {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	limit := "any number of"
+	if queue.maxParallel > 0 {
+		limit = "up to " + strconv.Itoa(queue.maxParallel)
+	}
+	if queue.perHost {
+		return limit + " acquires at once, one per host"
+	}
+	return limit + " acquires at once"
+}
+
+// enter blocks until an acquire of uri may run, or ctx is cancelled. Unless
+// it returns an error, the returned func must be called once the acquire
+// finished.
+func (queue *acquireQueue) enter(ctx context.Context, uri string) (func(), error) {
+	var host string
+	if parsed, err := url.Parse(uri); err == nil {
+		host = parsed.Host
+	}
+	queue.mu.Lock()
+	for !queue.admits(host) {
+		changed := queue.changed
+		queue.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		queue.mu.Lock()
+	}
+	queue.running++
+	queue.hosts[host]++
+	queue.mu.Unlock()
+	return func() { queue.leave(host) }, nil
+}
+
+// admits tells whether an acquire of host may run now. The queue must be
+// locked.
+func (queue *acquireQueue) admits(host string) bool {
+	if queue.maxParallel > 0 && queue.running >= queue.maxParallel {
+		return false
+	}
+	return !queue.perHost || queue.hosts[host] == 0
+}
+
+// leave records that an acquire of host finished.
+func (queue *acquireQueue) leave(host string) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.running--
+	queue.hosts[host]--
+	if queue.hosts[host] == 0 {
+		delete(queue.hosts, host)
+	}
+	queue.notify()
+}
+
+// notify wakes the acquires waiting to enter. The queue must be locked.
+func (queue *acquireQueue) notify() {
+	close(queue.changed)
+	queue.changed = make(chan struct{})
+}
+
+// filenameLocks serializes the acquires writing to the same Filename, so
+// that apt asking for two URIs to be stored in one place never has them
+// written concurrently. The second acquire waits for the first to finish.
+type filenameLocks struct {
+	mu   sync.Mutex
+	held map[string]*filenameLock
+}
+
+// A filenameLock is held by the acquire currently writing a Filename; waiting
+// acquires are counted in refs so the lock is dropped with the last of them.
+type filenameLock struct {
+	sem  chan struct{}
+	uri  string
+	refs int
+}
+
+func newFilenameLocks() *filenameLocks {
+	return &filenameLocks{held: map[string]*filenameLock{}}
+}
+
+// lock blocks until uri may be written to filename, or ctx is cancelled.
+// When another acquire is writing to filename, onWait is called with its URI
+// first. Unless it returns an error, the returned func must be called once
+// the acquire finished.
+func (locks *filenameLocks) lock(ctx context.Context, filename, uri string, onWait func(owner string)) (func(), error) {
+	name := filepath.Clean(filename)
+	locks.mu.Lock()
+	held, ok := locks.held[name]
+	if !ok {
+		held = &filenameLock{sem: make(chan struct{}, 1), uri: uri}
+		locks.held[name] = held
+	}
+	held.refs++
+	owner := held.uri
+	locks.mu.Unlock()
+
+	select {
+	case held.sem <- struct{}{}:
+	default:
+		onWait(owner)
+		select {
+		case held.sem <- struct{}{}:
+		case <-ctx.Done():
+			locks.unref(name, held)
+			return nil, ctx.Err()
+		}
+	}
+	locks.mu.Lock()
+	held.uri = uri
+	locks.mu.Unlock()
+	return func() {
+		<-held.sem
+		locks.unref(name, held)
+	}, nil
+}
+
+func (locks *filenameLocks) unref(name string, held *filenameLock) {
+	locks.mu.Lock()
+	defer locks.mu.Unlock()
+	held.refs--
+	if held.refs == 0 {
+		delete(locks.held, name)
+	}
+}
+
+// len returns the number of Filenames being written or waited for.
+func (locks *filenameLocks) len() int {
+	locks.mu.Lock()
+	defer locks.mu.Unlock()
+	return len(locks.held)
+}
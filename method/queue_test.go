@@ -0,0 +1,149 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/apt-golang-s3/message"
+)
+
+func TestAcquireQueueLimitsParallelism(t *testing.T) {
+	queue := newAcquireQueue(2, false)
+	first, err := queue.enter(context.Background(), "s3://bucket-a/key")
+	if err != nil {
+		t.Fatalf("enter() returned unexpected error: %v", err)
+	}
+	if _, err := queue.enter(context.Background(), "s3://bucket-a/other"); err != nil {
+		t.Fatalf("enter() returned unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := queue.enter(ctx, "s3://bucket-b/key"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("enter() beyond the limit returned error %v; expected %v", err, context.DeadlineExceeded)
+	}
+	first()
+	if _, err := queue.enter(context.Background(), "s3://bucket-b/key"); err != nil {
+		t.Errorf("enter() after a release returned unexpected error: %v", err)
+	}
+}
+
+func TestAcquireQueueSerializesHosts(t *testing.T) {
+	queue := newAcquireQueue(0, true)
+	release, err := queue.enter(context.Background(), "s3://bucket-a/key")
+	if err != nil {
+		t.Fatalf("enter() returned unexpected error: %v", err)
+	}
+	if _, err := queue.enter(context.Background(), "s3://bucket-b/key"); err != nil {
+		t.Errorf("enter() for another host returned unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := queue.enter(ctx, "s3://bucket-a/other"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("enter() for a busy host returned error %v; expected %v", err, context.DeadlineExceeded)
+	}
+	release()
+	if _, err := queue.enter(context.Background(), "s3://bucket-a/other"); err != nil {
+		t.Errorf("enter() after a release returned unexpected error: %v", err)
+	}
+}
+
+func TestAcquireQueueConfigureCountsRunning(t *testing.T) {
+	queue := newAcquireQueue(0, false)
+	var releases []func()
+	for _, uri := range []string{"s3://bucket-a/key", "s3://bucket-b/key"} {
+		release, err := queue.enter(context.Background(), uri)
+		if err != nil {
+			t.Fatalf("enter() returned unexpected error: %v", err)
+		}
+		releases = append(releases, release)
+	}
+
+	queue.configure(2, true)
+	for _, uri := range []string{"s3://bucket-c/key", "s3://bucket-a/other"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		if _, err := queue.enter(ctx, uri); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("enter(%s) with two acquires running returned error %v; expected %v", uri, err, context.DeadlineExceeded)
+		}
+		cancel()
+	}
+	releases[1]()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := queue.enter(ctx, "s3://bucket-a/other"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("enter() for a busy host returned error %v; expected %v", err, context.DeadlineExceeded)
+	}
+	if _, err := queue.enter(context.Background(), "s3://bucket-c/key"); err != nil {
+		t.Errorf("enter() after a release returned unexpected error: %v", err)
+	}
+}
+
+func TestConfigureQueue(t *testing.T) {
+	method := New(logger(t))
+	method.configure(&message.Message{Fields: []*message.Field{
+		field(fieldNameConfigItem, "Acquire::Queue-Mode=host"),
+		field(fieldNameConfigItem, "Acquire::s3::Max-Parallel=4"),
+	}})
+
+	if expected := "up to 4 acquires at once, one per host"; method.queue.String() != expected {
+		t.Errorf("method.queue = %q; expected %q", method.queue, expected)
+	}
+}
+
+func TestFilenameLocksSerializeWrites(t *testing.T) {
+	locks := newFilenameLocks()
+	release, err := locks.lock(context.Background(), "/tmp/partial/hello.deb", "s3://bucket-a/hello.deb", func(string) {
+		t.Error("lock() of a free Filename waited")
+	})
+	if err != nil {
+		t.Fatalf("lock() returned unexpected error: %v", err)
+	}
+
+	var owner string
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = locks.lock(ctx, "/tmp/partial/../partial/hello.deb", "s3://bucket-b/hello.deb", func(o string) { owner = o })
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("lock() of a busy Filename returned error %v; expected %v", err, context.DeadlineExceeded)
+	}
+	if expected := "s3://bucket-a/hello.deb"; owner != expected {
+		t.Errorf("lock() waited for %q; expected %q", owner, expected)
+	}
+
+	locked := make(chan func())
+	go func() {
+		next, err := locks.lock(context.Background(), "/tmp/partial/hello.deb", "s3://bucket-b/hello.deb", func(string) {})
+		if err != nil {
+			t.Errorf("lock() returned unexpected error: %v", err)
+		}
+		locked <- next
+	}()
+	select {
+	case <-locked:
+		t.Fatal("lock() of a busy Filename returned before the release")
+	case <-time.After(10 * time.Millisecond):
+	}
+	release()
+	(<-locked)()
+
+	if n := locks.len(); n != 0 {
+		t.Errorf("locks hold %d Filenames after all releases; expected none", n)
+	}
+}
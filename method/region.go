@@ -0,0 +1,119 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// imdsRegionTimeout bounds the lookup of the region of the EC2 instance, which
+// machines outside EC2 wait for in full.
+const imdsRegionTimeout = 500 * time.Millisecond
+
+// regionAuto is the value of Acquire::s3::region that asks for the region of
+// each bucket to be discovered.
+const regionAuto = "auto"
+
+// The sources of the region that resolveRegion names, besides the
+// configuration items and environment variables.
+const (
+	regionSourceIMDS    = "the EC2 instance metadata service"
+	regionSourceDefault = "the default"
+)
+
+// regionEnvVars are the environment variables naming the region, in the order
+// the AWS CLI reads them.
+var regionEnvVars = []string{"AWS_REGION", "AWS_DEFAULT_REGION"} //nolint:gochecknoglobals
+
+// resolveRegion sets the region acquires use unless their URI names one, when
+// neither Acquire::s3::region nor the provider preset sets it: to the region
+// AWS_REGION or AWS_DEFAULT_REGION names, else to the region of the EC2
+// instance, else to the default us-east-1, which warnDefaultRegion warns about.
+// The instance metadata service is not asked if Acquire::s3::imds-region or
+// Acquire::s3::disable-imds turns it off, or for custom endpoints, whose
+// regions are not those of EC2. The debug output names the source of the
+// region, and, with a custom endpoint, that the endpoint is what requests are
+// sent to and the region only what they are signed for.
+func (method *Method) resolveRegion() {
+	method.regionSource = method.findRegion()
+	if method.regionAuto {
+		method.debugf("Discovering the region of each bucket, falling back to the region %s of %s",
+			method.region, method.regionSource)
+	} else {
+		method.debugf("Using the region %s of %s", method.region, method.regionSource)
+	}
+	if method.endpoint != "" {
+		method.debugf("Sending requests to the endpoint %s and signing them for the region %s", method.endpoint, method.region)
+	}
+}
+
+// setRegion applies Acquire::s3::region: the name of a region, or auto to
+// discover the region of each bucket whose URI names none, falling back to
+// the region resolveRegion finds otherwise if that fails.
+func (method *Method) setRegion(value string) {
+	method.regionAuto = value == regionAuto
+	if !method.regionAuto {
+		method.region, method.regionConfigured = value, true
+	}
+}
+
+// findRegion sets the region as resolveRegion describes and returns its
+// source.
+func (method *Method) findRegion() string {
+	switch {
+	case method.regionConfigured:
+		return configItemAcquireS3Region
+	case providerPresets[method.provider].region != "":
+		return configItemAcquireS3Provider
+	}
+	for _, name := range regionEnvVars {
+		region := os.Getenv(name)
+		if region == "" {
+			continue
+		}
+		if err := validateRegion(region); err != nil {
+			method.debugf("Ignoring %s=%s: %v", name, region, err)
+			continue
+		}
+		method.region = region
+		return name
+	}
+	if !method.imdsRegion || method.disableIMDS || method.endpoint != "" {
+		return regionSourceDefault
+	}
+	region, err := method.instanceRegion()
+	if err != nil {
+		method.debugf("Cannot look up the region of the EC2 instance: %v", err)
+		return regionSourceDefault
+	}
+	if err := validateRegion(region); err != nil {
+		method.debugf("Ignoring the region %s of %s: %v", region, regionSourceIMDS, err)
+		return regionSourceDefault
+	}
+	method.region = region
+	return regionSourceIMDS
+}
+
+// instanceRegion returns the region of the EC2 instance as lookupIMDSRegion
+// finds it. It is only looked up the first time, as the region is resolved
+// again for every configuration applied, while acquires wait for it.
+func (method *Method) instanceRegion() (string, error) {
+	method.imdsRegionOnce.Do(func() {
+		method.imdsRegionFound, method.imdsRegionErr = method.lookupIMDSRegion(context.Background())
+	})
+	return method.imdsRegionFound, method.imdsRegionErr
+}
@@ -0,0 +1,195 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+	"github.com/google/apt-golang-s3/message"
+)
+
+func TestResolveRegion(t *testing.T) {
+	errNotEC2 := errors.New("no route to host")
+	specs := map[string]struct {
+		items    []string
+		env      map[string]string
+		imds     string
+		imdsErr  error
+		expected string
+		source   string
+		asksIMDS bool
+	}{
+		"configured": {
+			items: []string{"Acquire::s3::region=eu-west-1"}, env: map[string]string{"AWS_REGION": "eu-north-1"}, imds: "eu-central-1",
+			expected: "eu-west-1", source: "Acquire::s3::region",
+		},
+		"provider preset": {
+			items: []string{"Acquire::s3::provider=scaleway"}, env: map[string]string{"AWS_REGION": "eu-north-1"},
+			expected: "fr-par", source: "Acquire::s3::provider",
+		},
+		"AWS_REGION": {
+			env: map[string]string{"AWS_REGION": "eu-north-1", "AWS_DEFAULT_REGION": "eu-south-1"}, imds: "eu-central-1",
+			expected: "eu-north-1", source: "AWS_REGION",
+		},
+		"AWS_DEFAULT_REGION": {
+			env: map[string]string{"AWS_DEFAULT_REGION": "eu-south-1"}, imds: "eu-central-1",
+			expected: "eu-south-1", source: "AWS_DEFAULT_REGION",
+		},
+		"invalid AWS_REGION": {
+			env: map[string]string{"AWS_REGION": "Europe/Berlin"}, imds: "eu-central-1",
+			expected: "eu-central-1", source: regionSourceIMDS, asksIMDS: true,
+		},
+		"instance metadata": {
+			imds: "eu-central-1", expected: "eu-central-1", source: regionSourceIMDS, asksIMDS: true,
+		},
+		"not on EC2": {
+			imdsErr: errNotEC2, expected: "us-east-1", source: regionSourceDefault, asksIMDS: true,
+		},
+		"imds-region off": {
+			items: []string{"Acquire::s3::imds-region=false"}, imds: "eu-central-1",
+			expected: "us-east-1", source: regionSourceDefault,
+		},
+		"disable-imds": {
+			items: []string{"Acquire::s3::disable-imds=true"}, imds: "eu-central-1",
+			expected: "us-east-1", source: regionSourceDefault,
+		},
+		"custom endpoint": {
+			items: []string{"Acquire::s3::endpoint=https://objects.internal"}, imds: "eu-central-1",
+			expected: "us-east-1", source: regionSourceDefault,
+		},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			for _, env := range regionEnvVars {
+				t.Setenv(env, spec.env[env])
+			}
+			out := &bytes.Buffer{}
+			method := New(log.New(out, "", 0))
+			asked := false
+			method.lookupIMDSRegion = func(context.Context) (string, error) {
+				asked = true
+				return spec.imds, spec.imdsErr
+			}
+			fields := []*message.Field{field(fieldNameConfigItem, "Debug::Acquire::s3=true")}
+			for _, item := range spec.items {
+				fields = append(fields, field(fieldNameConfigItem, item))
+			}
+			method.configure(&message.Message{Fields: fields})
+
+			if method.region != spec.expected {
+				t.Errorf("region = %q; expected %q", method.region, spec.expected)
+			}
+			if asked != spec.asksIMDS {
+				t.Errorf("asked the instance metadata service: %t; expected %t", asked, spec.asksIMDS)
+			}
+			if logged := "Using the region " + spec.expected + " of " + spec.source; !bytes.Contains(out.Bytes(), []byte(logged)) {
+				t.Errorf("output does not contain %q:\n%s", logged, out)
+			}
+			combination := "Sending requests to the endpoint " + method.endpoint + " and signing them for the region " + spec.expected
+			if logged := bytes.Contains(out.Bytes(), []byte(combination)); logged != (method.endpoint != "") {
+				t.Errorf("output contains %q: %t; expected %t:\n%s", combination, logged, method.endpoint != "", out)
+			}
+			if defaulted := method.regionSource == regionSourceDefault; defaulted != (spec.source == regionSourceDefault) {
+				t.Errorf("regionSource = %q; expected %q", method.regionSource, spec.source)
+			}
+		})
+	}
+}
+
+func TestResolveRegionLooksUpIMDSOnce(t *testing.T) {
+	for _, env := range regionEnvVars {
+		t.Setenv(env, "")
+	}
+	method := New(logger(t))
+	lookups := 0
+	method.lookupIMDSRegion = func(context.Context) (string, error) {
+		lookups++
+		return "eu-central-1", nil
+	}
+	for range 2 {
+		method.configure(&message.Message{Fields: []*message.Field{field(fieldNameConfigItem, "Acquire::s3::imds-region=true")}})
+		if method.region != "eu-central-1" {
+			t.Errorf("region = %q; expected eu-central-1", method.region)
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("looked up the region of the instance %d times; expected once", lookups)
+	}
+}
+
+func TestURIAcquireRegionAuto(t *testing.T) {
+	specs := map[string]struct {
+		bucketRegions map[string]string
+		expected      string
+		warnings      int
+	}{
+		"discovered":     {map[string]string{"apt-repo-bucket": "eu-central-1"}, "eu-central-1", 0},
+		"not discovered": {nil, "eu-north-1", 1},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			for _, env := range regionEnvVars {
+				t.Setenv(env, "")
+			}
+			t.Setenv("AWS_REGION", "eu-north-1")
+			fake := testutil.NewFakeS3()
+			fake.BucketRegions = spec.bucketRegions
+			fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+			var mu sync.Mutex
+			var regions []string
+			factory := func(cfg ClientConfig) (s3iface.S3API, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				regions = append(regions, cfg.Region)
+				return fake, nil
+			}
+			out := &bytes.Buffer{}
+			method := New(log.New(out, "", 0), WithS3ClientFactory(factory))
+			method.configure(&message.Message{Fields: []*message.Field{field(fieldNameConfigItem, "Acquire::s3::region=auto")}})
+
+			for range 2 {
+				method.acquire(context.Background(), &message.Message{
+					Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+					Fields: []*message.Field{
+						field(fieldNameURI, "s3://apt-repo-bucket/apt/generic/hello.deb"),
+						field(fieldNameFilename, filepath.Join(t.TempDir(), "hello.deb")),
+					},
+				})
+			}
+
+			if expected := []string{"us-east-1", spec.expected, spec.expected}; !slices.Equal(regions, expected) {
+				t.Errorf("regions of the clients = %q; expected %q", regions, expected)
+			}
+			warning := "104 Warning\nMessage: Cannot discover the region of bucket apt-repo-bucket, using eu-north-1"
+			if count := strings.Count(out.String(), warning); count != spec.warnings {
+				t.Errorf("output has %d warnings about the region; expected %d:\n%s", count, spec.warnings, out)
+			}
+			if count := strings.Count(out.String(), "201 URI Done"); count != 2 {
+				t.Errorf("output has %d URI Done messages; expected 2:\n%s", count, out)
+			}
+		})
+	}
+}
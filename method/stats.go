@@ -0,0 +1,153 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/apt-golang-s3/fetcher"
+)
+
+// A runStats accumulates the timings and outcomes of every acquire over the
+// life of the Method. It is safe for concurrent use.
+type runStats struct {
+	mu      sync.Mutex
+	timings []fetcher.Timings
+	// The acquires by outcome: files kept as they already matched, objects
+	// copied from the cache, downloaded in full or continuing a partial file,
+	// and acquires that failed.
+	reused, cached, downloaded, resumed, failed atomic.Int64
+	// bytesSaved counts the bytes of the objects that were reused or cached,
+	// and bytesTransferred those of the objects downloaded from S3.
+	bytesSaved, bytesTransferred atomic.Int64
+}
+
+// A statsReport is what Acquire::s3::stats-file receives at the end of the run.
+type statsReport struct {
+	Reused           int64 `json:"reused"`
+	Cached           int64 `json:"cached"`
+	Downloaded       int64 `json:"downloaded"`
+	Resumed          int64 `json:"resumed"`
+	Failed           int64 `json:"failed"`
+	BytesSaved       int64 `json:"bytesSaved"`
+	BytesTransferred int64 `json:"bytesTransferred"`
+}
+
+func (stats *runStats) record(t fetcher.Timings) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	stats.timings = append(stats.timings, t)
+}
+
+// recordResult counts the outcome of an acquire that succeeded.
+func (stats *runStats) recordResult(result fetcher.FetchResult) {
+	size := max(result.Size, 0)
+	switch {
+	case result.Reused:
+		stats.reused.Add(1)
+		stats.bytesSaved.Add(size)
+	case result.Cached:
+		stats.cached.Add(1)
+		stats.bytesSaved.Add(size)
+	case result.Resumes > 0:
+		stats.resumed.Add(1)
+		stats.bytesTransferred.Add(size)
+	default:
+		stats.downloaded.Add(1)
+		stats.bytesTransferred.Add(size)
+	}
+}
+
+// report returns the outcomes counted so far.
+func (stats *runStats) report() statsReport {
+	return statsReport{
+		Reused:           stats.reused.Load(),
+		Cached:           stats.cached.Load(),
+		Downloaded:       stats.downloaded.Load(),
+		Resumed:          stats.resumed.Load(),
+		Failed:           stats.failed.Load(),
+		BytesSaved:       stats.bytesSaved.Load(),
+		BytesTransferred: stats.bytesTransferred.Load(),
+	}
+}
+
+// writeReport writes the outcomes counted so far to the file at path as JSON.
+func (stats *runStats) writeReport(path string) error {
+	data, err := json.MarshalIndent(stats.report(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644) //nolint:gosec
+}
+
+// summary returns a line with the outcomes of the acquires, and one line per
+// phase with the 50th, 90th and 99th percentile durations across all recorded
+// acquires.
+func (stats *runStats) summary() []string {
+	report := stats.report()
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	phases := []struct {
+		name  string
+		value func(fetcher.Timings) time.Duration
+	}{
+		{"credentials", func(t fetcher.Timings) time.Duration { return t.Credentials }},
+		{"head", func(t fetcher.Timings) time.Duration { return t.HeadObject }},
+		{"first-byte", func(t fetcher.Timings) time.Duration { return t.FirstByte }},
+		{"transfer", func(t fetcher.Timings) time.Duration { return t.Transfer }},
+		{"hashing", func(t fetcher.Timings) time.Duration { return t.Hashing }},
+	}
+
+	lines := []string{
+		fmt.Sprintf("Acquired %d objects", len(stats.timings)),
+		fmt.Sprintf("Outcomes: %d reused, %d cached, %d downloaded, %d resumed, %d failed; %d bytes saved, %d bytes transferred",
+			report.Reused, report.Cached, report.Downloaded, report.Resumed, report.Failed, report.BytesSaved, report.BytesTransferred),
+	}
+	if len(stats.timings) == 0 {
+		return lines
+	}
+	for _, phase := range phases {
+		durations := make([]time.Duration, len(stats.timings))
+		for idx, t := range stats.timings {
+			durations[idx] = phase.value(t)
+		}
+		slices.Sort(durations)
+		fields := []string{}
+		for _, p := range []float64{50, 90, 99} {
+			fields = append(fields, fmt.Sprintf("p%.0f=%s", p, percentile(durations, p)))
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", phase.name, strings.Join(fields, " ")))
+	}
+	return lines
+}
+
+// percentile returns the p-th percentile of the sorted durations using the
+// nearest-rank method.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank, 1)-1]
+}
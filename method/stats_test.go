@@ -0,0 +1,151 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/google/apt-golang-s3/fetcher"
+	"github.com/google/apt-golang-s3/internal/testutil"
+	"github.com/google/apt-golang-s3/message"
+)
+
+func TestPercentile(t *testing.T) {
+	sorted := []time.Duration{}
+	for i := 1; i <= 10; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+
+	specs := map[float64]time.Duration{
+		50: 5 * time.Millisecond,
+		90: 9 * time.Millisecond,
+		99: 10 * time.Millisecond,
+		0:  1 * time.Millisecond,
+	}
+	for p, expected := range specs {
+		if actual := percentile(sorted, p); actual != expected {
+			t.Errorf("percentile(sorted, %v) = %s; expected %s", p, actual, expected)
+		}
+	}
+
+	if actual := percentile(nil, 50); actual != 0 {
+		t.Errorf("percentile(nil, 50) = %s; expected 0", actual)
+	}
+}
+
+func TestRunStatsSummary(t *testing.T) {
+	stats := &runStats{}
+	stats.record(fetcher.Timings{Credentials: time.Millisecond, HeadObject: 2 * time.Millisecond})
+	stats.record(fetcher.Timings{Credentials: 3 * time.Millisecond, HeadObject: 4 * time.Millisecond})
+
+	expected := []string{
+		"Acquired 2 objects",
+		"Outcomes: 0 reused, 0 cached, 0 downloaded, 0 resumed, 0 failed; 0 bytes saved, 0 bytes transferred",
+		"credentials: p50=1ms p90=3ms p99=3ms",
+		"head: p50=2ms p90=4ms p99=4ms",
+		"first-byte: p50=0s p90=0s p99=0s",
+		"transfer: p50=0s p90=0s p99=0s",
+		"hashing: p50=0s p90=0s p99=0s",
+	}
+	if diff := cmp.Diff(expected, stats.summary()); diff != "" {
+		t.Errorf("summary() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRunStatsCountsOutcomes(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "dists/stable/Release", testutil.FakeObject{Body: []byte("Suite: stable"), ETag: `"v1"`})
+	fake.Put("apt-repo-bucket", "apt/generic/hello.deb", testutil.FakeObject{Body: []byte("hello")})
+	fake.Put("apt-repo-bucket", "pool/main/big.deb", testutil.FakeObject{Body: []byte("a big package"), ETag: `"v1"`})
+	for i := range 4 {
+		fake.Put("apt-repo-bucket", fmt.Sprintf("pool/main/%d.deb", i), testutil.FakeObject{Body: []byte("package")})
+	}
+	dir := t.TempDir()
+	reused := filepath.Join(dir, "hello.deb")
+	if err := os.WriteFile(reused, []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	statsFile := filepath.Join(dir, "stats.json")
+	method := New(log.New(&bytes.Buffer{}, "", 0), WithS3ClientFactory(fakeFactory(fake)))
+	method.configure(&message.Message{Fields: []*message.Field{
+		field(fieldNameConfigItem, "Acquire::s3::CacheDir="+filepath.Join(dir, "cache")),
+		field(fieldNameConfigItem, "Acquire::s3::reuse-existing=true"),
+		field(fieldNameConfigItem, "Acquire::s3::stats-file="+statsFile),
+		// Downloads in a single request are resumed when the connection breaks.
+		field(fieldNameConfigItem, "Acquire::s3::multipart=false"),
+	}})
+	acquire := func(uri, filename string, fields ...*message.Field) {
+		method.acquire(context.Background(), &message.Message{
+			Header: header(headerCodeURIAcquire, headerDescriptionURIAcquire),
+			Fields: append([]*message.Field{field(fieldNameURI, uri), field(fieldNameFilename, filename)}, fields...),
+		})
+	}
+
+	// Downloaded, then copied from the cache.
+	acquire("s3://apt-repo-bucket/dists/stable/Release", filepath.Join(dir, "Release"))
+	acquire("s3://apt-repo-bucket/dists/stable/Release", filepath.Join(dir, "Release.again"))
+	// Kept as it already matches.
+	acquire("s3://apt-repo-bucket/apt/generic/hello.deb", reused,
+		field(fieldNameExpectedSize, "5"),
+		field(fieldNameExpectedPrefix+"SHA256", "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"))
+	// Resumed after the connection broke off.
+	fake.ResetAt = []int64{6}
+	acquire("s3://apt-repo-bucket/pool/main/big.deb", filepath.Join(dir, "big.deb"))
+	// Not found.
+	acquire("s3://apt-repo-bucket/missing.deb", filepath.Join(dir, "missing.deb"))
+	// Downloaded concurrently.
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			acquire(fmt.Sprintf("s3://apt-repo-bucket/pool/main/%d.deb", i), filepath.Join(dir, fmt.Sprintf("%d.deb", i)))
+		}()
+	}
+	wg.Wait()
+	method.writeStats()
+
+	data, err := os.ReadFile(statsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actual statsReport
+	if err := json.Unmarshal(data, &actual); err != nil {
+		t.Fatalf("json.Unmarshal(%q) returned %v; expected nil", data, err)
+	}
+	expected := statsReport{
+		Reused:           1,
+		Cached:           1,
+		Downloaded:       5,
+		Resumed:          1,
+		Failed:           1,
+		BytesSaved:       int64(len("hello") + len("Suite: stable")),
+		BytesTransferred: int64(len("Suite: stable") + 4*len("package") + len("a big package")),
+	}
+	if diff := cmp.Diff(expected, actual); diff != "" {
+		t.Errorf("stats file mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,28 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows || plan9
+
+package method
+
+import (
+	"errors"
+)
+
+var errNoSyslog = errors.New("syslog is not supported on this platform")
+
+// dialSyslog fails, as there is no syslog to connect to.
+func dialSyslog(string) (syslogWriter, error) {
+	return nil, errNoSyslog
+}
@@ -0,0 +1,167 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/apt-golang-s3/message"
+)
+
+const (
+	// transcriptSeparator starts the line that frames each message in a
+	// transcript, which ends with " --". The transcripts of the tests in
+	// testdata/transcripts are divided into sections by the same lines.
+	transcriptSeparator = "-- "
+
+	// transcriptIn and transcriptOut name the direction of a message in a
+	// transcript: received from apt, or sent to it.
+	transcriptIn  = "in"
+	transcriptOut = "out"
+
+	transcriptFileMode = 0o600
+)
+
+// A transcriptRecorder appends the messages a Method exchanges with apt to a
+// file, as Acquire::s3::Transcript or Options.Transcript ask for. Each message
+// is framed by a line naming its direction and the time it was read or
+// written, as in "-- in 2024-01-01T12:00:00.123456789Z --", and followed by
+// the blank line that ends it on the wire, with the credentials of its URIs
+// and configuration values redacted. Messages are recorded in the order they
+// were read from the input and written to the output.
+//
+// Until the file is opened, the messages are buffered, so that those
+// exchanged before apt sent the configuration naming it are recorded too. The
+// buffer is dropped once the first acquire starts without a transcript having
+// been asked for.
+type transcriptRecorder struct {
+	mu      sync.Mutex
+	now     func() time.Time // tells the time messages are recorded at
+	file    *os.File
+	pending []string
+	stopped bool
+	err     error
+}
+
+// open opens the file at path for appending, creating it if needed, and
+// writes the buffered messages to it. It does nothing if a file is open
+// already.
+func (rec *transcriptRecorder) open(path string) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.file != nil || rec.stopped {
+		return nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, transcriptFileMode)
+	if err != nil {
+		rec.stopped, rec.pending = true, nil
+		return err
+	}
+	rec.file = file
+	rec.write(strings.Join(rec.pending, ""))
+	rec.pending = nil
+	return rec.err
+}
+
+// recordInput records a raw message read from apt. Messages that do not parse
+// are left out, as the Method drops them as well.
+func (rec *transcriptRecorder) recordInput(raw []byte) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.stopped {
+		return
+	}
+	if msg, err := message.FromBytes(raw); err == nil {
+		rec.record(transcriptIn, msg)
+	}
+}
+
+// recordOutput records a message written to apt. It is the tap of the
+// Method's message.Writer.
+func (rec *transcriptRecorder) recordOutput(msg *message.Message) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if !rec.stopped {
+		rec.record(transcriptOut, msg)
+	}
+}
+
+// record writes the frame of msg, or buffers it until the file is open.
+func (rec *transcriptRecorder) record(direction string, msg *message.Message) {
+	frame := fmt.Sprintf("%s%s %s --\n%s\n", transcriptSeparator, direction,
+		rec.now().UTC().Format(time.RFC3339Nano), redactMessage(msg))
+	if rec.file == nil {
+		rec.pending = append(rec.pending, frame)
+		return
+	}
+	rec.write(frame)
+}
+
+// write writes to the open file. After a failed write, nothing more is
+// recorded, and close returns the error.
+func (rec *transcriptRecorder) write(text string) {
+	if _, err := rec.file.WriteString(text); err != nil {
+		rec.err = err
+		rec.stopped = true
+	}
+}
+
+// settle stops recording unless the file is open, dropping the buffered
+// messages. It is called once the configuration can no longer name a file.
+func (rec *transcriptRecorder) settle() {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.file == nil {
+		rec.stopped, rec.pending = true, nil
+	}
+}
+
+// close closes the file, if any, and stops recording. It returns the error of
+// a failed write or of closing the file.
+func (rec *transcriptRecorder) close() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.stopped, rec.pending = true, nil
+	if rec.file == nil {
+		return rec.err
+	}
+	err := errors.Join(rec.err, rec.file.Close())
+	rec.file = nil
+	return err
+}
+
+// redactMessage returns a copy of msg whose URI fields and Config-Item values
+// have the secrets of their URLs redacted, as the diagnostics do.
+func redactMessage(msg *message.Message) *message.Message {
+	redacted := &message.Message{Header: msg.Header, Fields: make([]*message.Field, len(msg.Fields))}
+	for idx, f := range msg.Fields {
+		value := f.Value
+		switch f.Name {
+		case fieldNameURI:
+			value = redactURI(value)
+		case fieldNameConfigItem:
+			if name, configValue, found := strings.Cut(value, "="); found {
+				value = name + "=" + redactConfigValue(configValue)
+			}
+		}
+		redacted.Fields[idx] = field(f.Name, value)
+	}
+	return redacted
+}
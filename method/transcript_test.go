@@ -0,0 +1,441 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package method
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+	"github.com/google/apt-golang-s3/message"
+	"github.com/google/apt-golang-s3/version"
+)
+
+//nolint:gochecknoglobals
+var update = flag.Bool("update", false, "update the golden files of the transcript and message tests")
+
+const (
+	transcriptDir     = "testdata/transcripts"
+	transcriptTmpDir  = "$TMPDIR"
+	transcriptTimeout = 5 * time.Second
+)
+
+// transcriptLastModified is the Last-Modified time of every object in a
+// transcript's fake S3.
+//
+//nolint:gochecknoglobals
+var transcriptLastModified = time.Date(2018, time.October, 25, 20, 17, 39, 0, time.UTC)
+
+// hashFieldPattern matches the digest fields of a URI Done message, whose
+// values are replaced by their length when normalizing output.
+//
+//nolint:gochecknoglobals
+var hashFieldPattern = regexp.MustCompile(`(?m)^([A-Za-z0-9]+-Hash): ([0-9a-f]+)$`)
+
+// TestTranscripts runs every transcript in testdata/transcripts through a
+// Method and compares what it writes with the transcript's golden file. Run
+// `go test ./method -run TestTranscripts -update` to rewrite the golden files.
+//
+// A transcript consists of sections, each introduced by a "-- name --" line:
+//
+//   - objects: one object of the fake S3 per line, as "bucket/key content".
+//     The name is percent-decoded, so keys with spaces can be written as %20.
+//   - input: the messages apt writes to the Method, separated by blank lines.
+//
+// Lines before the first section are comments. The string $TMPDIR is replaced
+// with a temporary directory in the input and restored in the output.
+func TestTranscripts(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join(transcriptDir, "*.txt"))
+	if err != nil {
+		t.Fatalf("failed to list transcripts: %v", err)
+	}
+	if len(paths) == 0 {
+		t.Fatalf("no transcripts found in %s", transcriptDir)
+	}
+
+	// Credential sources in the environment would add warnings to the output.
+	for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_PROFILE", "AWS_WEB_IDENTITY_TOKEN_FILE"} {
+		t.Setenv(name, "")
+	}
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".txt")
+		t.Run(name, func(t *testing.T) {
+			script := readTranscript(t, path)
+			actual := runTranscript(t, script)
+
+			golden := strings.TrimSuffix(path, ".txt") + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, []byte(actual), 0o600); err != nil {
+					t.Fatalf("failed to write %s: %v", golden, err)
+				}
+				return
+			}
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("failed to read %s: %v", golden, err)
+			}
+			if actual != string(expected) {
+				t.Errorf("output of %s differs from %s\n--- got:\n%s\n--- expected:\n%s", path, golden, actual, expected)
+			}
+		})
+	}
+}
+
+// A transcript is a parsed transcript file.
+type transcript struct {
+	objects map[string]string
+	input   []string
+	// record names the file the Method records the messages it exchanges
+	// to, as Options.Transcript does, if any.
+	record string
+}
+
+func readTranscript(t *testing.T, path string) transcript {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	script := transcript{objects: map[string]string{}}
+	section := ""
+	msg := &strings.Builder{}
+	flush := func() {
+		if msg.Len() > 0 {
+			script.input = append(script.input, msg.String()+"\n")
+			msg.Reset()
+		}
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, transcriptSeparator) && strings.HasSuffix(line, " --") {
+			flush()
+			section = strings.TrimSuffix(strings.TrimPrefix(line, transcriptSeparator), " --")
+			continue
+		}
+		switch section {
+		case "objects":
+			if name, content, found := strings.Cut(line, " "); found {
+				script.objects[name] = content
+			}
+		case "input":
+			if line == "" {
+				flush()
+				continue
+			}
+			msg.WriteString(line + "\n")
+		}
+	}
+	flush()
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+	return script
+}
+
+// runTranscript feeds the transcript's input to a Method the way apt would and
+// returns the normalized output, followed by the exit status a process running
+// the Method would have. After each URI Acquire message it waits for the
+// Method to finish that acquire, so that the output has a stable order.
+func runTranscript(t *testing.T, script transcript) string {
+	t.Helper()
+	tmpDir := t.TempDir()
+	fake := testutil.NewFakeS3()
+	for name, content := range script.objects {
+		name, err := url.PathUnescape(name)
+		if err != nil {
+			t.Fatalf("invalid object name %s: %v", name, err)
+		}
+		bucket, key, _ := strings.Cut(name, "/")
+		fake.Put(bucket, key, testutil.FakeObject{Body: []byte(content), LastModified: transcriptLastModified})
+	}
+
+	inputReader, inputWriter := io.Pipe()
+	out := newMessageRecorder()
+	method := NewWithOptions(Options{Input: inputReader, Output: out, S3ClientFactory: fakeFactory(fake), Transcript: script.record})
+	errc := make(chan error, 1)
+	go func() { errc <- method.Run() }()
+
+	var runErr error
+	ran := false
+	acquires := 0
+feed:
+	for _, raw := range script.input {
+		if _, err := io.WriteString(inputWriter, strings.ReplaceAll(raw, transcriptTmpDir, tmpDir)); err != nil {
+			t.Fatalf("failed to write input: %v", err)
+		}
+		if !strings.HasPrefix(raw, fmt.Sprintf("%d ", headerCodeURIAcquire)) {
+			continue
+		}
+		acquires++
+		select {
+		case <-out.finished(acquires):
+		case runErr = <-errc:
+			ran = true
+			break feed
+		case <-time.After(transcriptTimeout):
+			t.Fatalf("timed out waiting for the acquire of\n%s", raw)
+		}
+	}
+	inputWriter.Close()
+	if !ran {
+		select {
+		case runErr = <-errc:
+		case <-time.After(transcriptTimeout):
+			t.Fatal("Run() did not return after the input was closed")
+		}
+	}
+
+	exitStatus := 0
+	if runErr != nil {
+		exitStatus = 1
+	}
+	return fmt.Sprintf("%sexit status %d\n", normalizeTranscript(out.String(), tmpDir), exitStatus)
+}
+
+// TestRecordTranscript records the transcript of a scenario, replays the
+// messages it received through a Method of its own, and checks that the
+// replay sends the same messages as were recorded.
+func TestRecordTranscript(t *testing.T) {
+	for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_PROFILE", "AWS_WEB_IDENTITY_TOKEN_FILE"} {
+		t.Setenv(name, "")
+	}
+	script := readTranscript(t, filepath.Join(transcriptDir, "basic.txt"))
+	script.record = filepath.Join(t.TempDir(), "apt-s3.transcript")
+	actual := runTranscript(t, script)
+	expected, err := os.ReadFile(filepath.Join(transcriptDir, "basic.golden"))
+	if err != nil {
+		t.Fatalf("failed to read golden file: %v", err)
+	}
+	if actual != string(expected) {
+		t.Errorf("output while recording a transcript differs from basic.golden\n--- got:\n%s", actual)
+	}
+
+	recorded := readRecordedTranscript(t, script.record)
+	contents, err := os.ReadFile(script.record)
+	if err != nil {
+		t.Fatalf("failed to read transcript: %v", err)
+	}
+	if strings.Contains(string(contents), "fake-access-key-secret") {
+		t.Errorf("transcript contains the secret access key:\n%s", contents)
+	}
+	var directions []string
+	for _, frame := range recorded {
+		directions = append(directions, frame.direction+" "+strings.SplitN(frame.text, "\n", 2)[0])
+	}
+	expectedDirections := []string{
+		"out 100 Capabilities", "out 101 Log", "in 601 Configuration", "in 600 URI Acquire",
+		"out 102 Status", "out 102 Status", "out 200 URI Start", "out 201 URI Done",
+	}
+	if diff := cmp.Diff(expectedDirections, directions); diff != "" {
+		t.Errorf("transcript messages mismatch (-want +got):\n%s", diff)
+	}
+
+	replay := transcript{objects: script.objects}
+	sent := &strings.Builder{}
+	for _, frame := range recorded {
+		if frame.direction == transcriptIn {
+			replay.input = append(replay.input, frame.text)
+		} else {
+			sent.WriteString(frame.text)
+		}
+	}
+	replayed := runTranscript(t, replay)
+	if expected := normalizeTranscript(sent.String(), t.TempDir()) + "exit status 0\n"; replayed != expected {
+		t.Errorf("replayed output differs from the transcript\n--- got:\n%s\n--- expected:\n%s", replayed, expected)
+	}
+}
+
+func TestRecordTranscriptConfigItem(t *testing.T) {
+	fake := testutil.NewFakeS3()
+	fake.Put("apt-repo-bucket", "dists/stable/Release", testutil.FakeObject{Body: []byte("Suite: stable")})
+	dir := t.TempDir()
+	path := filepath.Join(dir, "apt-s3.transcript")
+	// An earlier run's transcript is appended to.
+	if err := os.WriteFile(path, []byte("-- out 2024-01-01T00:00:00Z --\n100 Capabilities\n\n"), 0o600); err != nil {
+		t.Fatalf("failed to write transcript: %v", err)
+	}
+	input := "601 Configuration\nConfig-Item: Acquire::s3::Transcript=" + path + "\n" +
+		"Config-Item: Acquire::s3::region=us-east-1\n\n" +
+		"600 URI Acquire\nURI: s3://AKID:secret@apt-repo-bucket/dists/stable/Release\nFilename: " + filepath.Join(dir, "Release") + "\n\n"
+	method := NewWithOptions(Options{Input: strings.NewReader(input), Output: io.Discard, S3ClientFactory: fakeFactory(fake)})
+	if err := method.Run(); err != nil {
+		t.Fatalf("Run() returned unexpected error: %v", err)
+	}
+
+	recorded := readRecordedTranscript(t, path)
+	if len(recorded) < 5 {
+		t.Fatalf("transcript has %d messages; expected the earlier run's and this run's", len(recorded))
+	}
+	for idx, expected := range []string{"100 Capabilities", "100 Capabilities", "101 Log", "601 Configuration", "600 URI Acquire"} {
+		if !strings.HasPrefix(recorded[idx].text, expected+"\n") {
+			t.Errorf("message %d of the transcript is %q; expected %s", idx, recorded[idx].text, expected)
+		}
+	}
+	if expected := "URI: s3://AKID:xxxxx@apt-repo-bucket/dists/stable/Release\n"; !strings.Contains(recorded[4].text, expected) {
+		t.Errorf("recorded acquire is %q; expected its URI to be redacted", recorded[4].text)
+	}
+}
+
+func TestRecordTranscriptSecretWithSlash(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "apt-s3.transcript")
+	// The secret in front of the bucket name keeps the URI from parsing.
+	uri := "s3://AKID:wJalr/XUtn@apt-repo-bucket/dists/stable/Release"
+	input := "601 Configuration\nConfig-Item: Acquire::s3::Transcript=" + path + "\n\n" +
+		"600 URI Acquire\nURI: " + uri + "\nFilename: " + filepath.Join(dir, "Release") + "\n\n"
+	method := NewWithOptions(Options{Input: strings.NewReader(input), Output: io.Discard, S3ClientFactory: fakeFactory(testutil.NewFakeS3())})
+	if err := method.Run(); err != nil {
+		t.Fatalf("Run() returned unexpected error: %v", err)
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read transcript: %v", err)
+	}
+	if strings.Contains(string(contents), "XUtn") {
+		t.Errorf("transcript contains the secret access key:\n%s", contents)
+	}
+	for _, expected := range []string{
+		"600 URI Acquire\nURI: s3://xxxxx@apt-repo-bucket/dists/stable/Release\n",
+		"400 URI Failure\nURI: s3://xxxxx@apt-repo-bucket/dists/stable/Release\n",
+	} {
+		if !strings.Contains(string(contents), expected) {
+			t.Errorf("transcript = %q; expected it to contain %q", contents, expected)
+		}
+	}
+}
+
+func TestTranscriptRecorderSettle(t *testing.T) {
+	rec := &transcriptRecorder{now: time.Now}
+	rec.recordOutput(&message.Message{Header: header(headerCodeCapabilities, headerDescriptionCapabilities)})
+	rec.settle()
+	path := filepath.Join(t.TempDir(), "apt-s3.transcript")
+	if err := rec.open(path); err != nil {
+		t.Fatalf("open() returned unexpected error: %v", err)
+	}
+	rec.recordOutput(&message.Message{Header: header(headerCodeGeneralLog, headerDescriptionGeneralLog)})
+	if err := rec.close(); err != nil {
+		t.Fatalf("close() returned unexpected error: %v", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("transcript was opened after the recorder settled without one: %v", err)
+	}
+}
+
+// A recordedMessage is a message of a transcript a Method recorded.
+type recordedMessage struct {
+	direction string
+	text      string
+}
+
+// readRecordedTranscript reads the messages of a transcript a Method recorded,
+// checking that each is framed with a direction and a timestamp.
+func readRecordedTranscript(t *testing.T, path string) []recordedMessage {
+	t.Helper()
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read transcript: %v", err)
+	}
+	var recorded []recordedMessage
+	for _, frame := range strings.SplitAfter(string(contents), "\n\n") {
+		if frame == "" {
+			continue
+		}
+		line, text, _ := strings.Cut(frame, "\n")
+		fields := strings.Fields(strings.TrimSuffix(strings.TrimPrefix(line, transcriptSeparator), " --"))
+		if len(fields) != 2 || (fields[0] != transcriptIn && fields[0] != transcriptOut) {
+			t.Fatalf("malformed frame %q in transcript", line)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, fields[1]); err != nil {
+			t.Errorf("frame %q has an invalid timestamp: %v", line, err)
+		}
+		recorded = append(recorded, recordedMessage{direction: fields[0], text: text})
+	}
+	return recorded
+}
+
+// normalizeTranscript replaces the parts of the output that legitimately vary
+// between runs.
+func normalizeTranscript(output, tmpDir string) string {
+	output = strings.ReplaceAll(output, tmpDir, transcriptTmpDir)
+	output = strings.ReplaceAll(output, version.Name+" "+version.Get(), version.Name+" $VERSION")
+	return hashFieldPattern.ReplaceAllStringFunc(output, func(line string) string {
+		match := hashFieldPattern.FindStringSubmatch(line)
+		return fmt.Sprintf("%s: <%d hex digits>", match[1], len(match[2]))
+	})
+}
+
+// A messageRecorder is an io.Writer that records the Messages a Method writes
+// and lets a test wait until a number of acquires finished.
+type messageRecorder struct {
+	mu      sync.Mutex
+	buf     strings.Builder
+	count   int
+	waiting map[int]chan struct{}
+}
+
+func newMessageRecorder() *messageRecorder {
+	return &messageRecorder{waiting: map[int]chan struct{}{}}
+}
+
+func (rec *messageRecorder) Write(p []byte) (int, error) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.buf.Write(p)
+	msg, err := message.FromBytes(p)
+	if err == nil && (msg.Header.Status == headerCodeURIDone || msg.Header.Status == headerCodeURIFailure) {
+		rec.count++
+		if ch, ok := rec.waiting[rec.count]; ok {
+			close(ch)
+			delete(rec.waiting, rec.count)
+		}
+	}
+	return len(p), nil
+}
+
+// finished returns a channel that is closed once n acquires have finished.
+func (rec *messageRecorder) finished(n int) <-chan struct{} {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	ch := make(chan struct{})
+	if rec.count >= n {
+		close(ch)
+		return ch
+	}
+	rec.waiting[n] = ch
+	return ch
+}
+
+func (rec *messageRecorder) String() string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.buf.String()
+}
@@ -0,0 +1,187 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	arMagic      = "!<arch>\n"
+	arHeaderSize = 60
+)
+
+var (
+	// ErrNotDeb is returned for files that are not Debian binary packages.
+	ErrNotDeb = errors.New("not a Debian binary package")
+	// ErrUnsupportedCompression is returned for packages whose control
+	// archive is compressed with something the standard library cannot read.
+	ErrUnsupportedCompression = errors.New("unsupported control archive compression, rebuild the package with dpkg-deb -Zgzip")
+)
+
+// decompressors are the commands that decompress the control archives whose
+// compression the standard library cannot read, by extension, as dpkg-deb
+// does.
+var decompressors = map[string][]string{ //nolint:gochecknoglobals
+	".xz":  {"xz", "--decompress", "--stdout"},
+	".zst": {"zstd", "--decompress", "--stdout"},
+}
+
+var (
+	// ErrInvalidControl is returned for control files missing a mandatory
+	// field.
+	ErrInvalidControl = errors.New("invalid control file")
+)
+
+// readControl returns the control stanza of the Debian binary package at
+// filename, which is an ar archive whose control.tar member holds it.
+func readControl(filename string) (stanza, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	magic := make([]byte, len(arMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != arMagic {
+		return nil, fmt.Errorf("%w: %s", ErrNotDeb, filename)
+	}
+	for {
+		name, size, err := nextArMember(reader)
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%w: %s has no control archive", ErrNotDeb, filename)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrNotDeb, filename, err)
+		}
+		member := io.LimitReader(reader, size)
+		if strings.HasPrefix(name, "control.tar") {
+			control, err := controlFromArchive(name, member)
+			if err != nil {
+				return nil, fmt.Errorf("reading %s: %w", filename, err)
+			}
+			return control, nil
+		}
+		// Members are padded to an even size.
+		if _, err := reader.Discard(int(size + size%2)); err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrNotDeb, filename, err)
+		}
+	}
+}
+
+// nextArMember reads the header of the next member of an ar archive,
+// returning its name and size.
+func nextArMember(r io.Reader) (string, int64, error) {
+	header := make([]byte, arHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return "", 0, fmt.Errorf("truncated member header: %w", err)
+		}
+		return "", 0, err
+	}
+	if string(header[58:60]) != "`\n" {
+		return "", 0, errors.New("malformed member header")
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(header[48:58])), 10, 64)
+	if err != nil || size < 0 {
+		return "", 0, fmt.Errorf("malformed member size %q", header[48:58])
+	}
+	return strings.TrimSuffix(strings.TrimSpace(string(header[:16])), "/"), size, nil
+}
+
+// decompress runs the decompressor of the control archive member with the
+// given name over it, returning a reader of its output.
+func decompress(name string, member io.Reader) (io.Reader, error) {
+	args := decompressors[path.Ext(name)]
+	command, err := exec.LookPath(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s needs %s, which is not installed: %w", name, args[0], ErrUnsupportedCompression)
+	}
+	cmd := exec.Command(command, args[1:]...)
+	cmd.Stdin = member
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s: %w: %s", name, args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return bytes.NewReader(out), nil
+}
+
+// controlFromArchive extracts the control stanza from the control archive
+// member with the given name.
+func controlFromArchive(name string, member io.Reader) (stanza, error) {
+	switch path.Ext(name) {
+	case ".tar":
+	case ".gz":
+		gz, err := gzip.NewReader(member)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		defer gz.Close()
+		member = gz
+	case ".xz", ".zst":
+		decompressed, err := decompress(name, member)
+		if err != nil {
+			return nil, err
+		}
+		member = decompressed
+	default:
+		return nil, fmt.Errorf("%s: %w", name, ErrUnsupportedCompression)
+	}
+
+	archive := tar.NewReader(member)
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%w: %s has no control file", ErrInvalidControl, name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if path.Clean(header.Name) != "control" {
+			continue
+		}
+		data, err := io.ReadAll(archive)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		stanzas, err := parseStanzas(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if len(stanzas) != 1 {
+			return nil, fmt.Errorf("%w: %d stanzas", ErrInvalidControl, len(stanzas))
+		}
+		for _, field := range []string{"Package", "Version", "Architecture"} {
+			if stanzas[0].get(field) == "" {
+				return nil, fmt.Errorf("%w: no %s field", ErrInvalidControl, field)
+			}
+		}
+		return stanzas[0], nil
+	}
+}
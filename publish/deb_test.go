@@ -0,0 +1,138 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// writeDeb writes a Debian binary package with the given control file to
+// dir, its control archive being a member named controlMember, and returns
+// its path.
+func writeDeb(t *testing.T, dir, name, controlMember, control string) string {
+	t.Helper()
+	var tarball bytes.Buffer
+	archive := tar.NewWriter(&tarball)
+	for _, file := range []struct{ name, content string }{{"./md5sums", ""}, {"./control", control}} {
+		if err := archive.WriteHeader(&tar.Header{Name: file.name, Mode: 0o644, Size: int64(len(file.content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := archive.Write([]byte(file.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	member := tarball.Bytes()
+	if compress, ok := map[string]string{".xz": "xz", ".zst": "zstd"}[filepath.Ext(controlMember)]; ok {
+		cmd := exec.Command(compress, "--stdout")
+		cmd.Stdin = bytes.NewReader(member)
+		compressed, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("compressing with %s: %v", compress, err)
+		}
+		member = compressed
+	}
+	if filepath.Ext(controlMember) == ".gz" {
+		var compressed bytes.Buffer
+		gz := gzip.NewWriter(&compressed)
+		if _, err := gz.Write(member); err != nil {
+			t.Fatal(err)
+		}
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+		member = compressed.Bytes()
+	}
+
+	var deb bytes.Buffer
+	deb.WriteString(arMagic)
+	for _, m := range []struct {
+		name    string
+		content []byte
+	}{{"debian-binary", []byte("2.0\n")}, {controlMember, member}, {"data.tar.gz", []byte("data")}} {
+		fmt.Fprintf(&deb, "%-16s%-12d%-6d%-6d%-8s%-10d`\n", m.name+"/", 0, 0, 0, "100644", len(m.content))
+		deb.Write(m.content)
+		if len(m.content)%2 == 1 {
+			deb.WriteByte('\n')
+		}
+	}
+	filename := filepath.Join(dir, name)
+	if err := os.WriteFile(filename, deb.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestReadControl(t *testing.T) {
+	control := "Package: hello\nVersion: 1.0-1\nArchitecture: amd64\nDescription: greets\n the world\n"
+	expected := stanza{
+		{name: "Package", value: "hello"},
+		{name: "Version", value: "1.0-1"},
+		{name: "Architecture", value: "amd64"},
+		{name: "Description", value: "greets\n the world"},
+	}
+	for _, member := range []string{"control.tar.gz", "control.tar", "control.tar.xz", "control.tar.zst"} {
+		t.Run(member, func(t *testing.T) {
+			if command := decompressors[filepath.Ext(member)]; command != nil {
+				if _, err := exec.LookPath(command[0]); err != nil {
+					t.Skipf("%s is not installed", command[0])
+				}
+			}
+			filename := writeDeb(t, t.TempDir(), "hello.deb", member, control)
+			actual, err := readControl(filename)
+			if err != nil {
+				t.Fatalf("readControl() returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(expected, actual, cmp.AllowUnexported(field{})); diff != "" {
+				t.Errorf("readControl() mismatch (-expected +actual):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestReadControlErrors(t *testing.T) {
+	dir := t.TempDir()
+	notDeb := filepath.Join(dir, "not.deb")
+	if err := os.WriteFile(notDeb, []byte("<html>"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, filename string
+		expected       error
+	}{
+		{"not an ar archive", notDeb, ErrNotDeb},
+		{"lz4", writeDeb(t, dir, "lz4.deb", "control.tar.lz4", ""), ErrUnsupportedCompression},
+		{"no version", writeDeb(t, dir, "nov.deb", "control.tar", "Package: a\nArchitecture: all\n"), ErrInvalidControl},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := readControl(tt.filename); !errors.Is(err, tt.expected) {
+				t.Errorf("readControl() returned %v; expected %v", err, tt.expected)
+			}
+		})
+	}
+}
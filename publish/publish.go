@@ -0,0 +1,549 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package publish uploads Debian binary packages to an APT repository hosted
+// in S3 and regenerates the indexes that list them. It is independent of the
+// APT method, with which it only shares how S3 clients are created.
+package publish
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha1" //nolint:gosec
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/google/apt-golang-s3/clock"
+	"github.com/google/apt-golang-s3/fetcher"
+)
+
+const (
+	debContentType   = "application/vnd.debian.binary-package"
+	indexContentType = "text/plain; charset=utf-8"
+	gzipContentType  = "application/gzip"
+
+	defaultDist      = "stable"
+	defaultComponent = "main"
+
+	// maxAttempts bounds how often an index is regenerated when other
+	// publishers keep changing it concurrently.
+	maxAttempts = 10
+)
+
+var (
+	// ErrNoPackages is returned when the source names no .deb file.
+	ErrNoPackages = errors.New("no .deb files found")
+	// ErrConflict is returned when an index kept being changed by other
+	// publishers for maxAttempts attempts.
+	ErrConflict = errors.New("gave up after concurrent updates")
+)
+
+// indexFields are the fields of a Packages entry that describe the published
+// file rather than the package, and are set by Publish.
+//
+//nolint:gochecknoglobals
+var indexFields = []string{"Filename", "Size", "MD5sum", "SHA1", "SHA256"}
+
+// Options configure Publish.
+type Options struct {
+	// Dist and Component name the distribution and component the packages
+	// are published to, stable and main by default.
+	Dist, Component string
+	// Release makes Publish regenerate the Release file of the distribution
+	// with the hashes of all its Packages indexes.
+	Release bool
+	// Region, Endpoint and Role are used like Acquire::s3::region,
+	// Acquire::s3::endpoint and Acquire::s3::role are by the method. The
+	// region defaults to us-east-1 like there.
+	Region, Endpoint, Role string
+	// S3ClientFactory, when set, replaces the default factory that creates
+	// AWS sessions.
+	S3ClientFactory fetcher.S3ClientFactory
+	// Clock, when set, replaces the real clock the Date of the Release file
+	// is taken from.
+	Clock clock.Clock
+}
+
+// A publisher publishes packages to the repository at a prefix of a bucket.
+type publisher struct {
+	client          s3iface.S3API
+	out             io.Writer
+	bucket, prefix  string
+	dist, component string
+	clock           clock.Clock
+}
+
+// Publish uploads the .deb file source, or the .deb files directly in the
+// directory source, to the pool of the APT repository at the s3:// URI and
+// adds them to the Packages and Packages.gz indexes of their architectures,
+// replacing entries with the same package, version and architecture. Indexes
+// are rewritten conditionally on them not having changed since they were
+// read, and regenerated when they have, so that publishers running
+// concurrently do not lose each other's packages. Progress is written to out.
+func Publish(ctx context.Context, out io.Writer, source, uri string, opts Options) error {
+	debs, err := findDebs(source)
+	if err != nil {
+		return err
+	}
+	p, err := newPublisher(out, uri, opts)
+	if err != nil {
+		return err
+	}
+
+	entries := map[string][]stanza{}
+	for _, deb := range debs {
+		entry, err := p.upload(ctx, deb)
+		if err != nil {
+			return err
+		}
+		arch := entry.get("Architecture")
+		entries[arch] = append(entries[arch], entry)
+	}
+	for _, arch := range slices.Sorted(maps.Keys(entries)) {
+		if err := p.updatePackages(ctx, arch, entries[arch]); err != nil {
+			return err
+		}
+	}
+	if opts.Release {
+		return p.updateRelease(ctx)
+	}
+	return nil
+}
+
+// findDebs returns the .deb files source names.
+func findDebs(source string) ([]string, error) {
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{source}, nil
+	}
+	dirEntries, err := os.ReadDir(source)
+	if err != nil {
+		return nil, err
+	}
+	var debs []string
+	for _, entry := range dirEntries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".deb") {
+			debs = append(debs, filepath.Join(source, entry.Name()))
+		}
+	}
+	if len(debs) == 0 {
+		return nil, fmt.Errorf("%w in %s", ErrNoPackages, source)
+	}
+	return debs, nil
+}
+
+// newPublisher creates the S3 client for the repository at uri the way the
+// method does for its objects.
+func newPublisher(out io.Writer, uri string, opts Options) (*publisher, error) {
+	if opts.Endpoint != "" {
+		if err := fetcher.ValidateEndpoint(opts.Endpoint); err != nil {
+			return nil, err
+		}
+	}
+	factory := opts.S3ClientFactory
+	if factory == nil {
+		factory = fetcher.NewS3Client
+	}
+	region := cmp.Or(opts.Region, endpoints.UsEast1RegionID)
+	f := fetcher.New(fetcher.Config{Region: region, Endpoint: opts.Endpoint, RoleARN: opts.Role})
+	// Locate insists on an object key, which the repository root need not
+	// have, so locate its dists directory instead.
+	loc, err := f.Locate(strings.TrimSuffix(uri, "/") + "/dists")
+	if err != nil {
+		return nil, err
+	}
+	client, err := factory(f.ClientConfig(loc))
+	if err != nil {
+		return nil, err
+	}
+	p := &publisher{
+		client:    client,
+		out:       out,
+		bucket:    loc.Bucket,
+		prefix:    strings.TrimSuffix(loc.Key, "dists"),
+		dist:      cmp.Or(opts.Dist, defaultDist),
+		component: cmp.Or(opts.Component, defaultComponent),
+		clock:     opts.Clock,
+	}
+	if p.clock == nil {
+		p.clock = clock.Real{}
+	}
+	return p, nil
+}
+
+// upload uploads the package at filename to the pool and returns its
+// Packages entry.
+func (p *publisher) upload(ctx context.Context, filename string) (stanza, error) {
+	control, err := readControl(filename)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	sums, err := checksum(file)
+	if err != nil {
+		return nil, fmt.Errorf("hashing %s: %w", filename, err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	name := control.get("Package")
+	poolPath := path.Join("pool", p.component, poolDirectory(name), name, filepath.Base(filename))
+	if _, err := p.put(ctx, p.prefix+poolPath, debContentType, file); err != nil {
+		return nil, fmt.Errorf("uploading %s: %w", filename, err)
+	}
+	fmt.Fprintf(p.out, "Uploaded s3://%s/%s%s\n", p.bucket, p.prefix, poolPath)
+
+	return append(control.without(indexFields...),
+		field{name: "Filename", value: poolPath},
+		field{name: "Size", value: strconv.FormatInt(sums.size, 10)},
+		field{name: "MD5sum", value: sums.md5},
+		field{name: "SHA1", value: sums.sha1},
+		field{name: "SHA256", value: sums.sha256},
+	), nil
+}
+
+// poolDirectory returns the directory of the pool that packages with the
+// given name are kept in, which like in the Debian archive is the first
+// letter of the name, or its first four for libraries.
+func poolDirectory(name string) string {
+	if strings.HasPrefix(name, "lib") && len(name) > 3 {
+		return name[:4]
+	}
+	return name[:1]
+}
+
+// updatePackages adds the entries to the Packages index of arch and then
+// uploads its compressed copy.
+func (p *publisher) updatePackages(ctx context.Context, arch string, entries []stanza) error {
+	key := p.prefix + path.Join("dists", p.dist, p.component, "binary-"+arch, "Packages")
+	etag, content, err := p.update(ctx, key, func(current []byte) ([]byte, error) {
+		stanzas, err := parseStanzas(bytes.NewReader(current))
+		if err != nil {
+			return nil, fmt.Errorf("parsing s3://%s/%s: %w", p.bucket, key, err)
+		}
+		return formatStanzas(mergePackages(stanzas, entries)), nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := p.syncCompressed(ctx, key, etag, content); err != nil {
+		return err
+	}
+	fmt.Fprintf(p.out, "Updated s3://%s/%s\n", p.bucket, key)
+	return nil
+}
+
+// mergePackages adds the entries to the stanzas of a Packages index,
+// replacing those with the same package, version and architecture, and sorts
+// them by package, Debian version and architecture.
+func mergePackages(stanzas, entries []stanza) []stanza {
+	id := func(s stanza) string {
+		return s.get("Package") + " " + s.get("Version") + " " + s.get("Architecture")
+	}
+	added := map[string]bool{}
+	for _, entry := range entries {
+		added[id(entry)] = true
+	}
+	merged := slices.DeleteFunc(slices.Clone(stanzas), func(s stanza) bool { return added[id(s)] })
+	merged = append(merged, entries...)
+	slices.SortStableFunc(merged, func(a, b stanza) int {
+		return cmp.Or(
+			cmp.Compare(a.get("Package"), b.get("Package")),
+			compareVersions(a.get("Version"), b.get("Version")),
+			cmp.Compare(a.get("Architecture"), b.get("Architecture")),
+		)
+	})
+	return merged
+}
+
+// update rewrites the index at key with what modify makes of its current
+// content, which is nil if it does not exist yet. The write only succeeds if
+// the index has not changed since it was read, and is redone from the newer
+// content otherwise. update returns the ETag and content written.
+func (p *publisher) update(
+	ctx context.Context, key string, modify func(current []byte) ([]byte, error),
+) (string, []byte, error) {
+	for range maxAttempts {
+		current, etag, err := p.get(ctx, key)
+		if err != nil {
+			return "", nil, err
+		}
+		content, err := modify(current)
+		if err != nil {
+			return "", nil, err
+		}
+		condition := map[string]string{"If-None-Match": "*"}
+		if etag != "" {
+			condition = map[string]string{"If-Match": etag}
+		}
+		written, err := p.put(ctx, key, indexContentType, bytes.NewReader(content), request.WithSetRequestHeaders(condition))
+		if isConflict(err) {
+			continue
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("uploading s3://%s/%s: %w", p.bucket, key, err)
+		}
+		return written, content, nil
+	}
+	return "", nil, fmt.Errorf("%w of s3://%s/%s", ErrConflict, p.bucket, key)
+}
+
+// syncCompressed uploads the gzip-compressed content of the index at key,
+// which has the given ETag, next to it. Another publisher may have rewritten
+// the index meanwhile and uploaded its compressed copy first, so the index is
+// read again afterwards, and compressed again until it no longer changes.
+func (p *publisher) syncCompressed(ctx context.Context, key, etag string, content []byte) error {
+	for range maxAttempts {
+		var compressed bytes.Buffer
+		gz := gzip.NewWriter(&compressed)
+		if _, err := gz.Write(content); err != nil {
+			return err
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		if _, err := p.put(ctx, key+".gz", gzipContentType, bytes.NewReader(compressed.Bytes())); err != nil {
+			return fmt.Errorf("uploading s3://%s/%s.gz: %w", p.bucket, key, err)
+		}
+		current, currentETag, err := p.get(ctx, key)
+		if err != nil {
+			return err
+		}
+		if currentETag == etag {
+			return nil
+		}
+		content, etag = current, currentETag
+	}
+	return fmt.Errorf("%w of s3://%s/%s.gz", ErrConflict, p.bucket, key)
+}
+
+// An index is a Packages index of the distribution, as listed.
+type index struct {
+	// path is the path of the index relative to the distribution, as the
+	// Release file names it.
+	path, etag string
+}
+
+// updateRelease regenerates the Release file of the distribution from all
+// its Packages indexes, keeping the fields that describe the repository.
+// Should an index change while it is being hashed, the Release file is
+// regenerated again.
+func (p *publisher) updateRelease(ctx context.Context) error {
+	distKey := p.prefix + path.Join("dists", p.dist) + "/"
+	for range maxAttempts {
+		indexes, err := p.listIndexes(ctx, distKey)
+		if err != nil {
+			return err
+		}
+		if _, _, err := p.update(ctx, distKey+"Release", func(current []byte) ([]byte, error) {
+			return p.release(ctx, distKey, current, indexes)
+		}); err != nil {
+			return err
+		}
+		after, err := p.listIndexes(ctx, distKey)
+		if err != nil {
+			return err
+		}
+		if slices.Equal(indexes, after) {
+			fmt.Fprintf(p.out, "Updated s3://%s/%sRelease\n", p.bucket, distKey)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w of s3://%s/%sRelease", ErrConflict, p.bucket, distKey)
+}
+
+// listIndexes lists the Packages indexes of the distribution below distKey.
+func (p *publisher) listIndexes(ctx context.Context, distKey string) ([]index, error) {
+	var (
+		indexes []index
+		token   *string
+	)
+	for {
+		output, err := p.client.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket:            aws.String(p.bucket),
+			Prefix:            aws.String(distKey),
+			ContinuationToken: token,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("listing s3://%s/%s: %w", p.bucket, distKey, err)
+		}
+		for _, object := range output.Contents {
+			relative := strings.TrimPrefix(aws.StringValue(object.Key), distKey)
+			if _, _, ok := indexArchitecture(relative); ok {
+				indexes = append(indexes, index{path: relative, etag: aws.StringValue(object.ETag)})
+			}
+		}
+		if !aws.BoolValue(output.IsTruncated) {
+			break
+		}
+		token = output.NextContinuationToken
+	}
+	slices.SortFunc(indexes, func(a, b index) int { return cmp.Compare(a.path, b.path) })
+	return indexes, nil
+}
+
+// indexArchitecture returns the component and architecture of the Packages
+// index at the given path relative to the distribution, such as
+// main/binary-amd64/Packages.gz, and whether it is one.
+func indexArchitecture(relative string) (string, string, bool) {
+	parts := strings.Split(relative, "/")
+	if len(parts) != 3 || (parts[2] != "Packages" && parts[2] != "Packages.gz") {
+		return "", "", false
+	}
+	arch, ok := strings.CutPrefix(parts[1], "binary-")
+	return parts[0], arch, ok && parts[0] != "" && arch != ""
+}
+
+// release returns the Release file for the indexes, based on the current one.
+func (p *publisher) release(ctx context.Context, distKey string, current []byte, indexes []index) ([]byte, error) {
+	stanzas, err := parseStanzas(bytes.NewReader(current))
+	if err != nil {
+		return nil, fmt.Errorf("parsing s3://%s/%sRelease: %w", p.bucket, distKey, err)
+	}
+	var release stanza
+	if len(stanzas) > 0 {
+		release = stanzas[0].without("Date", "Architectures", "Components", "MD5Sum", "SHA1", "SHA256")
+	}
+	for _, name := range []string{"Suite", "Codename"} {
+		if release.get(name) == "" {
+			release = append(release, field{name: name, value: p.dist})
+		}
+	}
+
+	var (
+		components, archs    []string
+		md5s, sha1s, sha256s strings.Builder
+	)
+	for _, idx := range indexes {
+		component, arch, _ := indexArchitecture(idx.path)
+		components, archs = append(components, component), append(archs, arch)
+		body, _, err := p.get(ctx, distKey+idx.path)
+		if err != nil {
+			return nil, err
+		}
+		sums, err := checksum(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&md5s, "\n %s %d %s", sums.md5, sums.size, idx.path)
+		fmt.Fprintf(&sha1s, "\n %s %d %s", sums.sha1, sums.size, idx.path)
+		fmt.Fprintf(&sha256s, "\n %s %d %s", sums.sha256, sums.size, idx.path)
+	}
+	slices.Sort(components)
+	slices.Sort(archs)
+	release = append(release,
+		field{name: "Date", value: p.clock.Now().UTC().Format(time.RFC1123)},
+		field{name: "Architectures", value: strings.Join(slices.Compact(archs), " ")},
+		field{name: "Components", value: strings.Join(slices.Compact(components), " ")},
+		field{name: "MD5Sum", value: md5s.String()},
+		field{name: "SHA1", value: sha1s.String()},
+		field{name: "SHA256", value: sha256s.String()},
+	)
+	return formatStanzas([]stanza{release}), nil
+}
+
+// get returns the content and ETag of the object at key, or neither if it
+// does not exist.
+func (p *publisher) get(ctx context.Context, key string) ([]byte, string, error) {
+	output, err := p.client.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: aws.String(p.bucket), Key: aws.String(key)})
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusNotFound && reqErr.Code() != s3.ErrCodeNoSuchBucket {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("reading s3://%s/%s: %w", p.bucket, key, err)
+	}
+	defer output.Body.Close()
+	body, err := io.ReadAll(output.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("reading s3://%s/%s: %w", p.bucket, key, err)
+	}
+	return body, aws.StringValue(output.ETag), nil
+}
+
+// put uploads body to key and returns the ETag of the new object.
+func (p *publisher) put(
+	ctx context.Context, key, contentType string, body io.ReadSeeker, opts ...request.Option,
+) (string, error) {
+	output, err := p.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(p.bucket),
+		Key:         aws.String(key),
+		Body:        body,
+		ContentType: aws.String(contentType),
+	}, opts...)
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(output.ETag), nil
+}
+
+// isConflict tells whether err is S3 refusing a conditional write because
+// the object changed, or is being changed, concurrently.
+func isConflict(err error) bool {
+	var reqErr awserr.RequestFailure
+	return errors.As(err, &reqErr) &&
+		(reqErr.StatusCode() == http.StatusPreconditionFailed || reqErr.StatusCode() == http.StatusConflict)
+}
+
+// checksums are the size and digests of a file as Packages and Release files
+// list them.
+type checksums struct {
+	size              int64
+	md5, sha1, sha256 string
+}
+
+// checksum reads r to its end and returns its checksums.
+func checksum(r io.Reader) (checksums, error) {
+	md5Hash, sha1Hash, sha256Hash := md5.New(), sha1.New(), sha256.New() //nolint:gosec
+	size, err := io.Copy(io.MultiWriter(md5Hash, sha1Hash, sha256Hash), r)
+	if err != nil {
+		return checksums{}, err
+	}
+	return checksums{
+		size:   size,
+		md5:    hex.EncodeToString(md5Hash.Sum(nil)),
+		sha1:   hex.EncodeToString(sha1Hash.Sum(nil)),
+		sha256: hex.EncodeToString(sha256Hash.Sum(nil)),
+	}, nil
+}
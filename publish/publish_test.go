@@ -0,0 +1,231 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/google/apt-golang-s3/fetcher"
+	"github.com/google/apt-golang-s3/internal/testutil"
+)
+
+const (
+	helloControl = "Package: hello\nVersion: 1.0-1\nArchitecture: amd64\nMaintainer: Jane <jane@example.com>\n"
+	docsControl  = "Package: hello-doc\nVersion: 1.0-1\nArchitecture: all\n"
+	amd64Key     = "repo/dists/stable/main/binary-amd64/Packages"
+)
+
+func fakeFactory(fake *testutil.FakeS3) fetcher.S3ClientFactory {
+	return func(fetcher.ClientConfig) (s3iface.S3API, error) {
+		return fake, nil
+	}
+}
+
+// gunzip returns the decompressed body of the given object.
+func gunzip(t *testing.T, fake *testutil.FakeS3, key string) string {
+	t.Helper()
+	obj, ok := fake.Object("bucket", key)
+	if !ok {
+		t.Fatalf("%s was not uploaded", key)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(obj.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestPublish(t *testing.T) {
+	dir := t.TempDir()
+	hello := writeDeb(t, dir, "hello_1.0-1_amd64.deb", "control.tar.gz", helloControl)
+	writeDeb(t, dir, "hello-doc_1.0-1_all.deb", "control.tar", docsControl)
+	fake := testutil.NewFakeS3()
+	fake.Put("bucket", amd64Key, testutil.FakeObject{
+		Body: []byte("Package: aardvark\nVersion: 2\nArchitecture: amd64\nFilename: pool/main/a/aardvark/a.deb\n\n" +
+			"Package: hello\nVersion: 1.0-1\nArchitecture: amd64\nFilename: pool/main/h/hello/old.deb\n"),
+		ETag: `"v1"`,
+	})
+	fake.Put("bucket", "repo/dists/stable/Release", testutil.FakeObject{
+		Body: []byte("Origin: Example\nDate: Thu, 01 Jan 1970 00:00:00 UTC\nMD5Sum:\n 00 1 main/binary-i386/Packages\n"),
+		ETag: `"r1"`,
+	})
+	var out bytes.Buffer
+
+	err := Publish(context.Background(), &out, dir, "s3://bucket/repo/", Options{
+		Release:         true,
+		S3ClientFactory: fakeFactory(fake),
+		Clock:           testutil.NewFakeClock(time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)),
+	})
+	if err != nil {
+		t.Fatalf("Publish() returned unexpected error: %v", err)
+	}
+
+	deb, ok := fake.Object("bucket", "repo/pool/main/h/hello/hello_1.0-1_amd64.deb")
+	if !ok || deb.ContentType != debContentType {
+		t.Errorf("the amd64 package was not uploaded to the pool with Content-Type %s: %+v", debContentType, deb.ContentType)
+	}
+	helloFile, err := os.Open(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer helloFile.Close()
+	sums, err := checksum(helloFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedPackages := "Package: aardvark\nVersion: 2\nArchitecture: amd64\nFilename: pool/main/a/aardvark/a.deb\n\n" +
+		helloControl + "Filename: pool/main/h/hello/hello_1.0-1_amd64.deb\n" +
+		fmt.Sprintf("Size: %d\nMD5sum: %s\nSHA1: %s\nSHA256: %s\n", sums.size, sums.md5, sums.sha1, sums.sha256)
+	packages, _ := fake.Object("bucket", amd64Key)
+	if diff := cmp.Diff(expectedPackages, string(packages.Body)); diff != "" {
+		t.Errorf("Packages mismatch (-expected +actual):\n%s", diff)
+	}
+	if packages.ContentType != indexContentType {
+		t.Errorf("Packages has Content-Type %q; expected %q", packages.ContentType, indexContentType)
+	}
+	if diff := cmp.Diff(expectedPackages, gunzip(t, fake, amd64Key+".gz")); diff != "" {
+		t.Errorf("Packages.gz mismatch (-expected +actual):\n%s", diff)
+	}
+	all, _ := fake.Object("bucket", "repo/dists/stable/main/binary-all/Packages")
+	if !strings.HasPrefix(string(all.Body), docsControl+"Filename: pool/main/h/hello-doc/hello-doc_1.0-1_all.deb\n") {
+		t.Errorf("binary-all/Packages = %q; expected the hello-doc entry", all.Body)
+	}
+
+	release, _ := fake.Object("bucket", "repo/dists/stable/Release")
+	for _, expected := range []string{
+		"Origin: Example\nSuite: stable\nCodename: stable\nDate: Mon, 06 May 2024 07:08:09 UTC\n",
+		"Architectures: all amd64\nComponents: main\n",
+		"\nSHA256:\n",
+		fmt.Sprintf(" %x %d main/binary-amd64/Packages\n", sha256.Sum256(packages.Body), len(packages.Body)),
+	} {
+		if !strings.Contains(string(release.Body), expected) {
+			t.Errorf("Release = %q; expected it to contain %q", release.Body, expected)
+		}
+	}
+	if strings.Contains(string(release.Body), "binary-i386") {
+		t.Errorf("Release = %q; expected the stale entries to be gone", release.Body)
+	}
+	for _, expected := range []string{
+		"Uploaded s3://bucket/repo/pool/main/h/hello/hello_1.0-1_amd64.deb\n",
+		"Updated s3://bucket/" + amd64Key + "\n",
+		"Updated s3://bucket/repo/dists/stable/Release\n",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Publish() wrote %q; expected it to contain %q", out.String(), expected)
+		}
+	}
+}
+
+func TestPublishConcurrentUpdate(t *testing.T) {
+	dir := t.TempDir()
+	writeDeb(t, dir, "hello_1.0-1_amd64.deb", "control.tar.gz", helloControl)
+	fake := testutil.NewFakeS3()
+	fake.AddBucket("bucket")
+	other := "Package: other\nVersion: 3\nArchitecture: amd64\nFilename: pool/main/o/other/other.deb\n"
+	interleaved := false
+	fake.BeforePut = func(key string) {
+		// Another publisher writes the index between this one reading and
+		// writing it.
+		if key == amd64Key && !interleaved {
+			interleaved = true
+			fake.Put("bucket", amd64Key, testutil.FakeObject{Body: []byte(other), ETag: `"other"`})
+		}
+	}
+
+	err := Publish(context.Background(), io.Discard, dir, "s3://bucket/repo", Options{S3ClientFactory: fakeFactory(fake)})
+	if err != nil {
+		t.Fatalf("Publish() returned unexpected error: %v", err)
+	}
+
+	packages, _ := fake.Object("bucket", amd64Key)
+	if !strings.HasPrefix(string(packages.Body), helloControl) || !strings.HasSuffix(string(packages.Body), "\n\n"+other) {
+		t.Errorf("Packages = %q; expected both the hello and the concurrently published entry", packages.Body)
+	}
+	if compressed := gunzip(t, fake, amd64Key+".gz"); compressed != string(packages.Body) {
+		t.Errorf("Packages.gz = %q; expected it to match Packages %q", compressed, packages.Body)
+	}
+}
+
+func TestPublishConflict(t *testing.T) {
+	dir := t.TempDir()
+	writeDeb(t, dir, "hello_1.0-1_amd64.deb", "control.tar.gz", helloControl)
+	fake := testutil.NewFakeS3()
+	fake.AddBucket("bucket")
+	writes := 0
+	fake.BeforePut = func(key string) {
+		if key == amd64Key {
+			writes++
+			fake.Put("bucket", amd64Key, testutil.FakeObject{Body: []byte{}, ETag: fmt.Sprintf(`"%d"`, writes)})
+		}
+	}
+
+	err := Publish(context.Background(), io.Discard, dir, "s3://bucket/repo", Options{S3ClientFactory: fakeFactory(fake)})
+	if !errors.Is(err, ErrConflict) {
+		t.Errorf("Publish() returned %v; expected %v", err, ErrConflict)
+	}
+	if writes != maxAttempts {
+		t.Errorf("Publish() attempted %d writes; expected %d", writes, maxAttempts)
+	}
+}
+
+func TestPublishNoPackages(t *testing.T) {
+	err := Publish(context.Background(), io.Discard, t.TempDir(), "s3://bucket/repo", Options{
+		S3ClientFactory: fakeFactory(testutil.NewFakeS3()),
+	})
+	if !errors.Is(err, ErrNoPackages) {
+		t.Errorf("Publish() returned %v; expected %v", err, ErrNoPackages)
+	}
+}
+
+func TestMergePackagesSortsVersions(t *testing.T) {
+	entry := func(version string) stanza {
+		return stanza{{name: "Package", value: "hello"}, {name: "Version", value: version}, {name: "Architecture", value: "amd64"}}
+	}
+	merged := mergePackages([]stanza{entry("1.10-1"), entry("1:0.9-1")}, []stanza{entry("1.9-1"), entry("1.10~rc1-1")})
+	var actual []string
+	for _, s := range merged {
+		actual = append(actual, s.get("Version"))
+	}
+	expected := []string{"1.9-1", "1.10~rc1-1", "1.10-1", "1:0.9-1"}
+	if diff := cmp.Diff(expected, actual); diff != "" {
+		t.Errorf("mergePackages() versions mismatch (-expected +actual):\n%s", diff)
+	}
+}
+
+func TestPoolDirectory(t *testing.T) {
+	for name, expected := range map[string]string{"hello": "h", "libssl3": "libs", "lib": "l"} {
+		if actual := poolDirectory(name); actual != expected {
+			t.Errorf("poolDirectory(%q) = %q; expected %q", name, actual, expected)
+		}
+	}
+}
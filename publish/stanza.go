@@ -0,0 +1,115 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A field is a field of a stanza. Values of multi-line fields keep their
+// continuation lines, each preceded by a newline and its leading space.
+type field struct {
+	name, value string
+}
+
+// A stanza is a paragraph of a Debian control file, such as a package entry
+// of a Packages index, with its fields in order.
+type stanza []field
+
+// get returns the value of the named field, compared case-insensitively, or
+// "" if there is none.
+func (s stanza) get(name string) string {
+	for _, f := range s {
+		if strings.EqualFold(f.name, name) {
+			return f.value
+		}
+	}
+	return ""
+}
+
+// without returns the stanza without the named fields.
+func (s stanza) without(names ...string) stanza {
+	var kept stanza
+	for _, f := range s {
+		drop := false
+		for _, name := range names {
+			drop = drop || strings.EqualFold(f.name, name)
+		}
+		if !drop {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// parseStanzas parses the paragraphs of a Debian control file.
+func parseStanzas(r io.Reader) ([]stanza, error) {
+	var (
+		stanzas []stanza
+		current stanza
+	)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case strings.TrimSpace(text) == "":
+			if len(current) > 0 {
+				stanzas, current = append(stanzas, current), nil
+			}
+		case text[0] == ' ' || text[0] == '\t':
+			if len(current) == 0 {
+				return nil, fmt.Errorf("%w: line %d continues no field", ErrInvalidControl, line)
+			}
+			current[len(current)-1].value += "\n" + text
+		case strings.HasPrefix(text, "#"):
+		default:
+			name, value, ok := strings.Cut(text, ":")
+			if !ok {
+				return nil, fmt.Errorf("%w: line %d is not a field", ErrInvalidControl, line)
+			}
+			current = append(current, field{name: name, value: strings.TrimSpace(value)})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(current) > 0 {
+		stanzas = append(stanzas, current)
+	}
+	return stanzas, nil
+}
+
+// formatStanzas renders stanzas as a Debian control file.
+func formatStanzas(stanzas []stanza) []byte {
+	var buf bytes.Buffer
+	for i, s := range stanzas {
+		if i > 0 {
+			buf.WriteByte('\n')
+		}
+		for _, f := range s {
+			buf.WriteString(f.name + ":")
+			if f.value != "" && f.value[0] != '\n' {
+				buf.WriteByte(' ')
+			}
+			buf.WriteString(f.value + "\n")
+		}
+	}
+	return buf.Bytes()
+}
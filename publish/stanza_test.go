@@ -0,0 +1,44 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStanzasRoundTrip(t *testing.T) {
+	input := "Package: a\nDescription: first\n second\n .\n third\n\nPackage: b\nMD5Sum:\n 0123 10 main/binary-amd64/Packages\n"
+	stanzas, err := parseStanzas(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("parseStanzas() returned unexpected error: %v", err)
+	}
+	if len(stanzas) != 2 || stanzas[1].get("md5sum") != "\n 0123 10 main/binary-amd64/Packages" {
+		t.Errorf("parseStanzas() = %q; expected two stanzas with a multi-line MD5Sum", stanzas)
+	}
+	if diff := cmp.Diff(input, string(formatStanzas(stanzas))); diff != "" {
+		t.Errorf("formatStanzas() mismatch (-expected +actual):\n%s", diff)
+	}
+}
+
+func TestParseStanzasInvalid(t *testing.T) {
+	for _, input := range []string{" continued\n", "Package\n"} {
+		if _, err := parseStanzas(strings.NewReader(input)); err == nil {
+			t.Errorf("parseStanzas(%q) returned no error", input)
+		}
+	}
+}
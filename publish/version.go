@@ -0,0 +1,108 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"cmp"
+	"strconv"
+	"strings"
+)
+
+// nonLetterWeight is added to the weight of the characters of versions that
+// are not letters, so that they sort after every letter.
+const nonLetterWeight = 256
+
+// compareVersions compares two Debian package versions the way dpkg does: by
+// epoch, then by upstream version, then by Debian revision, so that 1.10 sorts
+// after 1.9 and 1.0~rc1 before 1.0.
+func compareVersions(a, b string) int {
+	epochA, upstreamA, revisionA := splitVersion(a)
+	epochB, upstreamB, revisionB := splitVersion(b)
+	return cmp.Or(
+		cmp.Compare(epochA, epochB),
+		compareVersionPart(upstreamA, upstreamB),
+		compareVersionPart(revisionA, revisionB),
+	)
+}
+
+// splitVersion splits a Debian version into its epoch, which is 0 unless given,
+// its upstream version and its revision, which is empty unless given.
+func splitVersion(version string) (int, string, string) {
+	epoch := 0
+	if before, after, found := strings.Cut(version, ":"); found {
+		if parsed, err := strconv.Atoi(before); err == nil {
+			epoch, version = parsed, after
+		}
+	}
+	upstream, revision := version, ""
+	if idx := strings.LastIndex(version, "-"); idx >= 0 {
+		upstream, revision = version[:idx], version[idx+1:]
+	}
+	return epoch, upstream, revision
+}
+
+// compareVersionPart compares an upstream version or revision in alternating
+// runs of non-digits, compared by versionOrder, and digits, compared as
+// numbers.
+func compareVersionPart(a, b string) int {
+	for a != "" || b != "" {
+		for (a != "" && !isDigit(a[0])) || (b != "" && !isDigit(b[0])) {
+			if order := cmp.Compare(versionOrder(a), versionOrder(b)); order != 0 {
+				return order
+			}
+			if a != "" && !isDigit(a[0]) {
+				a = a[1:]
+			}
+			if b != "" && !isDigit(b[0]) {
+				b = b[1:]
+			}
+		}
+		digitsA, digitsB := leadingDigits(a), leadingDigits(b)
+		a, b = a[len(digitsA):], b[len(digitsB):]
+		digitsA, digitsB = strings.TrimLeft(digitsA, "0"), strings.TrimLeft(digitsB, "0")
+		if order := cmp.Or(cmp.Compare(len(digitsA), len(digitsB)), cmp.Compare(digitsA, digitsB)); order != 0 {
+			return order
+		}
+	}
+	return 0
+}
+
+// versionOrder returns the weight of the first character of a run of
+// non-digits: '~' sorts before anything, even the end of the run, and letters
+// before the other characters.
+func versionOrder(s string) int {
+	switch {
+	case s == "" || isDigit(s[0]):
+		return 0
+	case s[0] == '~':
+		return -1
+	case ('a' <= s[0] && s[0] <= 'z') || ('A' <= s[0] && s[0] <= 'Z'):
+		return int(s[0])
+	default:
+		return int(s[0]) + nonLetterWeight
+	}
+}
+
+func leadingDigits(s string) string {
+	idx := 0
+	for idx < len(s) && isDigit(s[idx]) {
+		idx++
+	}
+	return s[:idx]
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
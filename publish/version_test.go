@@ -0,0 +1,48 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.9", "1.10", -1},
+		{"1.10-1", "1.9-2", 1},
+		{"1.0-1", "1.0-2", -1},
+		{"1.0-10", "1.0-9", 1},
+		{"1:1.0", "2.0", 1},
+		{"0:1.0", "1.0", 0},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0~~", "1.0~", -1},
+		{"1.0", "1.0a", -1},
+		{"1.0a", "1.0+", -1},
+		{"1.0+b1", "1.0", 1},
+		{"1.007", "1.7", 0},
+		{"2.30-1ubuntu2", "2.30-1ubuntu10", -1},
+		{"1.2.3-4-5", "1.2.3-4-10", -1},
+	}
+	for _, tt := range tests {
+		if actual := compareVersions(tt.a, tt.b); actual != tt.expected {
+			t.Errorf("compareVersions(%q, %q) = %d; expected %d", tt.a, tt.b, actual, tt.expected)
+		}
+		if actual := compareVersions(tt.b, tt.a); actual != -tt.expected {
+			t.Errorf("compareVersions(%q, %q) = %d; expected %d", tt.b, tt.a, actual, -tt.expected)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/apt-golang-s3/internal/testutil"
+)
+
+func TestExplainTerminal(t *testing.T) {
+	_, terminal := testutil.OpenPTY(t)
+	pipe, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pipe.Close()
+	defer writer.Close()
+
+	specs := map[string]struct {
+		stdin    *os.File
+		flags    mainFlags
+		explains bool
+	}{
+		"terminal":          {terminal, mainFlags{}, true},
+		"terminal, --stdin": {terminal, mainFlags{stdin: true}, false},
+		"pipe, as apt runs": {pipe, mainFlags{}, false},
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			if explains := explainTerminal(spec.stdin, spec.flags, out); explains != spec.explains {
+				t.Errorf("explainTerminal() = %t; expected %t", explains, spec.explains)
+			}
+			if !spec.explains && out.Len() > 0 {
+				t.Errorf("explainTerminal() wrote %q; expected nothing", out)
+			}
+			for _, expected := range []string{"/usr/lib/apt/methods/s3", " doctor s3://", " get s3://", "--stdin"} {
+				if spec.explains && !strings.Contains(out.String(), expected) {
+					t.Errorf("explanation = %q; expected it to contain %q", out, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestIsTerminal(t *testing.T) {
+	_, terminal := testutil.OpenPTY(t)
+	file, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if !isTerminal(terminal) {
+		t.Errorf("isTerminal(%s) = false; expected a pseudo-terminal to be a terminal", terminal.Name())
+	}
+	if isTerminal(file) {
+		t.Errorf("isTerminal(%s) = true; expected it not to be a terminal", os.DevNull)
+	}
+}
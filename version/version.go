@@ -0,0 +1,55 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package version reports the build version of the apt-golang-s3 binary. The
+// version is normally embedded at link time, e.g.
+//
+//	go build -ldflags "-X github.com/google/apt-golang-s3/version.version=1.2.3"
+//
+// When it is not, the module version recorded by the Go toolchain is used.
+package version
+
+import (
+	"runtime/debug"
+)
+
+const (
+	// Name is the product name used when reporting the version.
+	Name = "apt-golang-s3"
+
+	develVersion = "(devel)"
+)
+
+// version is set at link time using -ldflags "-X".
+//
+//nolint:gochecknoglobals
+var version = ""
+
+// readBuildInfo is swapped out in tests.
+//
+//nolint:gochecknoglobals
+var readBuildInfo = debug.ReadBuildInfo
+
+// Get returns the version of the running binary. A version embedded via
+// -ldflags always wins. Otherwise the main module version from the build
+// information is used, and "(devel)" when neither is available.
+func Get() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := readBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return develVersion
+}
@@ -0,0 +1,60 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package version
+
+import (
+	"runtime/debug"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	specs := map[string]struct {
+		linked    string
+		buildInfo *debug.BuildInfo
+		expected  string
+	}{
+		"linker flag wins": {
+			"1.2.3",
+			&debug.BuildInfo{Main: debug.Module{Version: "v0.0.0-20240101000000-abcdef"}},
+			"1.2.3",
+		},
+		"build info fallback": {
+			"",
+			&debug.BuildInfo{Main: debug.Module{Version: "v1.1.0"}},
+			"v1.1.0",
+		},
+		"no build info": {
+			"",
+			nil,
+			"(devel)",
+		},
+	}
+
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			origVersion, origReadBuildInfo := version, readBuildInfo
+			t.Cleanup(func() { version, readBuildInfo = origVersion, origReadBuildInfo })
+
+			version = spec.linked
+			readBuildInfo = func() (*debug.BuildInfo, bool) {
+				return spec.buildInfo, spec.buildInfo != nil
+			}
+
+			if actual := Get(); actual != spec.expected {
+				t.Errorf("Get() = %s; expected %s", actual, spec.expected)
+			}
+		})
+	}
+}